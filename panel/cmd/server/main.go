@@ -169,6 +169,13 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 		public.POST("/auth/refresh", h.Auth.RefreshToken)
 		public.GET("/auth/oauth/:provider", h.Auth.OAuthStart)
 		public.GET("/auth/oauth/:provider/callback", h.Auth.OAuthCallback)
+
+		// File share links, for visitors without an account
+		public.GET("/shares/:token", h.File.ShareInfo)
+		public.POST("/shares/:token/access", h.File.ShareAccess)
+		public.GET("/shares/:token/download", h.File.ShareDownload)
+		public.HEAD("/shares/:token/download", h.File.ShareDownload)
+		public.POST("/shares/:token/upload", h.File.ShareUpload)
 	}
 
 	// Protected routes
@@ -213,6 +220,7 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 			docker.GET("/images", h.Docker.ListImages)
 			docker.POST("/images/pull", h.Docker.PullImage)
 			docker.DELETE("/images/:id", h.Docker.RemoveImage)
+			docker.POST("/images/prune", h.Docker.PruneImages)
 			docker.POST("/images/build", h.Docker.BuildImage)
 
 			docker.GET("/networks", h.Docker.ListNetworks)
@@ -222,12 +230,43 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 			docker.GET("/volumes", h.Docker.ListVolumes)
 			docker.POST("/volumes", h.Docker.CreateVolume)
 			docker.DELETE("/volumes/:id", h.Docker.RemoveVolume)
-
+			docker.POST("/volumes/:id/clone", h.Docker.CloneVolume)
+			docker.GET("/volumes/:id/files", h.Docker.ListVolumeFiles)
+			docker.GET("/volumes/:id/download", h.Docker.DownloadVolumeFile)
+			docker.POST("/volumes/:id/backup", h.Docker.BackupVolume)
+			docker.GET("/volume-backups", h.Docker.ListVolumeBackups)
+			docker.GET("/volume-backups/:id/download", h.Docker.DownloadVolumeBackup)
+			docker.POST("/volume-backups/:id/restore", h.Docker.RestoreVolumeBackup)
+			docker.DELETE("/volume-backups/:id", h.Docker.DeleteVolumeBackup)
+
+			docker.GET("/system/df", h.Docker.DiskUsage)
+			docker.POST("/prune", h.Docker.Prune)
+			docker.GET("/prune/policy", h.Docker.GetPrunePolicy)
+			docker.PUT("/prune/policy", h.Docker.UpdatePrunePolicy)
+
+			docker.GET("/events", h.Docker.ListEvents)
+			docker.GET("/events/stream", h.Docker.EventsStream)
 			docker.GET("/compose", h.Docker.ListComposeProjects)
 			docker.POST("/compose", h.Docker.CreateComposeProject)
+			docker.POST("/compose/validate", h.Docker.ValidateCompose)
+			docker.GET("/compose/discover", h.Docker.DiscoverComposeProjects)
+			docker.POST("/compose/import", h.Docker.ImportComposeProject)
+			docker.GET("/compose/:id", h.Docker.GetComposeProject)
+			docker.PUT("/compose/:id", h.Docker.UpdateComposeProject)
 			docker.DELETE("/compose/:id", h.Docker.RemoveComposeProject)
 			docker.POST("/compose/:id/up", h.Docker.ComposeUp)
 			docker.POST("/compose/:id/down", h.Docker.ComposeDown)
+			docker.POST("/compose/:id/pull", h.Docker.ComposePull)
+			docker.GET("/compose/:id/revisions", h.Docker.ListComposeRevisions)
+			docker.GET("/compose/:id/revisions/:version", h.Docker.GetComposeRevision)
+			docker.GET("/compose/:id/diff", h.Docker.DiffComposeRevisions)
+			docker.POST("/compose/:id/rollback", h.Docker.RollbackComposeProject)
+			docker.GET("/compose/:id/services", h.Docker.ListComposeServices)
+			docker.POST("/compose/:id/services/:service/start", h.Docker.StartComposeService)
+			docker.POST("/compose/:id/services/:service/stop", h.Docker.StopComposeService)
+			docker.POST("/compose/:id/services/:service/restart", h.Docker.RestartComposeService)
+			docker.GET("/compose/:id/services/:service/logs", h.Docker.ComposeServiceLogs)
+			docker.POST("/compose/:id/services/:service/scale", h.Docker.ScaleComposeService)
 		}
 
 		// Nginx Management
@@ -235,6 +274,8 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 		{
 			nginx.GET("/status", h.Nginx.Status)
 			nginx.POST("/reload", h.Nginx.Reload)
+			nginx.GET("/layout", h.Nginx.Layout)
+			nginx.POST("/layout/detect", h.Nginx.DetectLayout)
 			nginx.GET("/sites", h.Nginx.ListSites)
 			nginx.POST("/sites", h.Nginx.CreateSite)
 			nginx.GET("/sites/:id", h.Nginx.GetSite)
@@ -242,14 +283,35 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 			nginx.DELETE("/sites/:id", h.Nginx.DeleteSite)
 			nginx.POST("/sites/:id/enable", h.Nginx.EnableSite)
 			nginx.POST("/sites/:id/disable", h.Nginx.DisableSite)
+			nginx.GET("/sites/:id/locations", h.Nginx.ListLocations)
+			nginx.POST("/sites/:id/locations", h.Nginx.CreateLocation)
+			nginx.PUT("/sites/:id/locations/:location", h.Nginx.UpdateLocation)
+			nginx.DELETE("/sites/:id/locations/:location", h.Nginx.DeleteLocation)
+			nginx.GET("/sites/:id/auth-users", h.Nginx.ListAuthUsers)
+			nginx.POST("/sites/:id/auth-users", h.Nginx.CreateAuthUser)
+			nginx.PUT("/sites/:id/auth-users/:user", h.Nginx.UpdateAuthUser)
+			nginx.DELETE("/sites/:id/auth-users/:user", h.Nginx.DeleteAuthUser)
+			nginx.GET("/upstreams", h.Nginx.ListUpstreams)
+			nginx.POST("/upstreams", h.Nginx.CreateUpstream)
+			nginx.GET("/upstreams/:id", h.Nginx.GetUpstream)
+			nginx.PUT("/upstreams/:id", h.Nginx.UpdateUpstream)
+			nginx.DELETE("/upstreams/:id", h.Nginx.DeleteUpstream)
+			nginx.GET("/import", h.Nginx.ScanImport)
+			nginx.POST("/import", h.Nginx.ImportSites)
 
 			nginx.GET("/ssl/certificates", h.Nginx.ListCertificates)
 			nginx.POST("/ssl/certificates", h.Nginx.CreateCertificate)
+			nginx.PUT("/ssl/certificates/:id", h.Nginx.ReplaceCertificate)
 			nginx.DELETE("/ssl/certificates/:id", h.Nginx.DeleteCertificate)
 			nginx.POST("/ssl/certificates/:id/renew", h.Nginx.RenewCertificate)
+			nginx.GET("/ssl/certificates/:id/renewals", h.Nginx.ListRenewals)
+			nginx.GET("/ssl/renewals", h.Nginx.ListRenewals)
+			nginx.GET("/ssl/dns-providers", h.Nginx.ListDNSProviders)
 
 			nginx.GET("/logs/access", h.Nginx.AccessLogs)
 			nginx.GET("/logs/error", h.Nginx.ErrorLogs)
+			nginx.GET("/logs/access/stream", h.Nginx.AccessLogsStream)
+			nginx.GET("/logs/error/stream", h.Nginx.ErrorLogsStream)
 			nginx.GET("/analytics", h.Nginx.Analytics)
 		}
 
@@ -279,19 +341,70 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 		{
 			files.GET("/list", h.File.List)
 			files.GET("/read", h.File.Read)
+			files.GET("/view", h.File.View)
+			files.GET("/view/search", h.File.ViewSearch)
+			files.GET("/follow", h.File.Follow)
 			files.POST("/write", h.File.Write)
+			files.GET("/versions", h.File.ListVersions)
+			files.GET("/versions/:id", h.File.GetVersion)
+			files.GET("/versions/:id/diff", h.File.DiffVersions)
+			files.POST("/versions/:id/restore", h.File.RestoreVersion)
 			files.POST("/mkdir", h.File.Mkdir)
 			files.POST("/rename", h.File.Rename)
 			files.POST("/copy", h.File.Copy)
 			files.POST("/move", h.File.Move)
 			files.DELETE("/delete", h.File.Delete)
+			files.GET("/trash", h.File.ListTrash)
+			files.DELETE("/trash", h.File.EmptyTrash)
+			files.POST("/trash/:id/restore", h.File.RestoreTrash)
+			files.DELETE("/trash/:id", h.File.PurgeTrash)
 			files.POST("/upload", h.File.Upload)
 			files.GET("/download", h.File.Download)
+			files.GET("/uploads", h.File.ListUploads)
+			files.POST("/uploads", h.File.CreateUpload)
+			files.GET("/uploads/:id", h.File.GetUpload)
+			files.HEAD("/uploads/:id", h.File.GetUpload)
+			files.PATCH("/uploads/:id", h.File.UploadChunk)
+			files.DELETE("/uploads/:id", h.File.CancelUpload)
 			files.POST("/compress", h.File.Compress)
 			files.POST("/decompress", h.File.Decompress)
+			files.POST("/transfer", h.File.Transfer)
+			files.GET("/jobs", h.File.ListJobs)
+			files.GET("/jobs/:id", h.File.GetJob)
+			files.DELETE("/jobs/:id", h.File.CancelJob)
+			files.GET("/shares", h.File.ListShares)
+			files.POST("/shares", h.File.CreateShare)
+			files.DELETE("/shares/:id", h.File.DeleteShare)
 			files.GET("/permissions", h.File.GetPermissions)
 			files.POST("/permissions", h.File.SetPermissions)
+			files.GET("/acl", h.File.GetACL)
+			files.POST("/acl", h.File.SetACL)
 			files.GET("/search", h.File.Search)
+			files.GET("/grep", h.File.Grep)
+			files.GET("/index", h.File.ListIndexes)
+			files.POST("/index", h.File.BuildIndex)
+			files.DELETE("/index", h.File.DeleteIndex)
+			files.GET("/roots", h.File.Roots)
+
+			// Jails (Admin only)
+			jails := files.Group("/jails")
+			jails.Use(middleware.RequireRole("admin"))
+			{
+				jails.GET("", h.File.ListJails)
+				jails.POST("", h.File.CreateJail)
+				jails.PUT("/:id", h.File.UpdateJail)
+				jails.DELETE("/:id", h.File.DeleteJail)
+			}
+
+			// Remote locations (Admin only, listed for everyone)
+			files.GET("/locations", h.File.ListLocations)
+			locations := files.Group("/locations")
+			locations.Use(middleware.RequireRole("admin"))
+			{
+				locations.POST("", h.File.CreateLocation)
+				locations.PUT("/:id", h.File.UpdateLocation)
+				locations.DELETE("/:id", h.File.DeleteLocation)
+			}
 		}
 
 		// Terminal
@@ -331,6 +444,8 @@ func setupRoutes(r *gin.Engine, h *handlers.Handler, svc *services.Container, pm
 		{
 			software.GET("/installed", h.Software.ListInstalled)
 			software.GET("/available", h.Software.ListAvailable)
+			software.GET("/available/:name", h.Software.GetApp)
+			software.POST("/available/refresh", h.Software.RefreshCatalog)
 			software.POST("/install", h.Software.Install)
 			software.POST("/uninstall", h.Software.Uninstall)
 			software.POST("/upgrade", h.Software.Upgrade)
@@ -16,6 +16,10 @@ type Config struct {
 	Auth     AuthConfig     `mapstructure:"auth"`
 	Plugin   PluginConfig   `mapstructure:"plugin"`
 	Storage  StorageConfig  `mapstructure:"storage"`
+	Files    FilesConfig    `mapstructure:"files"`
+	Apps     AppsConfig     `mapstructure:"apps"`
+	ACME     ACMEConfig     `mapstructure:"acme"`
+	Nginx    NginxConfig    `mapstructure:"nginx"`
 	Logging  LoggingConfig  `mapstructure:"logging"`
 }
 
@@ -118,6 +122,78 @@ type StorageConfig struct {
 	TempDir   string `mapstructure:"temp_dir"`
 	BackupDir string `mapstructure:"backup_dir"`
 	LogDir    string `mapstructure:"log_dir"`
+
+	UploadExpiry int `mapstructure:"upload_expiry"` // hours an unfinished upload can be resumed
+}
+
+// FilesConfig holds the file manager policy, role and user jails narrow it further
+type FilesConfig struct {
+	Roots []FileRootConfig `mapstructure:"roots"` // accessible directories, / when empty
+	Deny  []string         `mapstructure:"deny"`  // globs never accessible, one without a slash matches a name anywhere
+
+	TrashDir     string `mapstructure:"trash_dir"`      // deleted files are moved here, empty deletes them permanently
+	TrashMaxAge  int    `mapstructure:"trash_max_age"`  // days an item is kept, 0 keeps it until purged
+	TrashMaxSize int64  `mapstructure:"trash_max_size"` // MB the trash holds, the oldest items are purged first
+
+	VersionDir  string `mapstructure:"version_dir"`  // snapshots of text files edited in the panel, by content hash
+	MaxVersions int    `mapstructure:"max_versions"` // versions kept per file, 0 keeps no history
+
+	IndexTTL int `mapstructure:"index_ttl"` // minutes a filename index is used before it is rebuilt
+
+	ExtractMaxSize  int64 `mapstructure:"extract_max_size"`  // MB an extracted archive may write
+	ExtractMaxFiles int64 `mapstructure:"extract_max_files"` // entries an extracted archive may have
+	ExtractMaxRatio int64 `mapstructure:"extract_max_ratio"` // times an archive may expand
+
+	ShareMaxUpload int64 `mapstructure:"share_max_upload"` // MB a file dropped into an upload share may have
+}
+
+// FileRootConfig is a directory the file manager can access
+type FileRootConfig struct {
+	Path     string `mapstructure:"path"`
+	ReadOnly bool   `mapstructure:"read_only"`
+}
+
+// AppsConfig holds app catalogue configuration
+type AppsConfig struct {
+	TemplateDir string `mapstructure:"template_dir"` // local templates, override built-in ones
+	InstallDir  string `mapstructure:"install_dir"`  // compose projects of installed apps
+	RemoteIndex string `mapstructure:"remote_index"` // optional URL of a remote catalogue index
+}
+
+// ACMEConfig holds ACME (Let's Encrypt) certificate issuance configuration
+type ACMEConfig struct {
+	DirectoryURL string `mapstructure:"directory_url"`
+	Email        string `mapstructure:"email"`
+	EABKeyID     string `mapstructure:"eab_key_id"`   // external account binding, required by some CAs
+	EABHMACKey   string `mapstructure:"eab_hmac_key"` // base64url encoded
+	KeyType      string `mapstructure:"key_type"`     // ec256, ec384, rsa2048, rsa3072, rsa4096
+	CertDir      string `mapstructure:"cert_dir"`     // issued certificates and account keys
+	WebrootDir   string `mapstructure:"webroot_dir"`  // served by nginx for HTTP-01 challenges
+	CAFile       string `mapstructure:"ca_file"`      // extra CA trusted for the directory, e.g. Pebble's
+
+	RenewBeforeDays int `mapstructure:"renew_before_days"` // renew certificates expiring within this many days
+	RenewInterval   int `mapstructure:"renew_interval"`    // minutes between renewal checks
+	ExpiryWarnDays  int `mapstructure:"expiry_warn_days"`  // alert about certificates expiring within this many days
+}
+
+// NginxConfig overrides the nginx layout, empty values are detected from nginx -V and
+// the main configuration file
+type NginxConfig struct {
+	Binary       string `mapstructure:"binary"`         // nginx executable, looked up on PATH by default
+	ConfPath     string `mapstructure:"conf_path"`      // main configuration file as nginx sees it
+	SitesDir     string `mapstructure:"sites_dir"`      // where site configurations are written
+	EnabledDir   string `mapstructure:"enabled_dir"`    // where enabled sites are linked, "none" when sites are not linked
+	LogDir       string `mapstructure:"log_dir"`        // site access and error logs
+	PIDPath      string `mapstructure:"pid_path"`       // pid file of the master process
+	PHPFPMSocket string `mapstructure:"php_fpm_socket"` // fastcgi_pass address, {version} is replaced by the PHP version
+	Container    string `mapstructure:"container"`      // Docker container running nginx, empty for nginx on the host
+	Reload       string `mapstructure:"reload"`         // exec (nginx -s reload) or signal (SIGHUP to the master)
+
+	// Access log analytics
+	AnalyticsInterval   int `mapstructure:"analytics_interval"`    // seconds between log ingestion runs, 0 disables ingestion
+	AnalyticsMinuteDays int `mapstructure:"analytics_minute_days"` // how long per-minute aggregates are kept
+	AnalyticsHourDays   int `mapstructure:"analytics_hour_days"`   // how long hourly aggregates are kept
+	AnalyticsDays       int `mapstructure:"analytics_days"`        // how long daily aggregates are kept
 }
 
 // LoggingConfig holds logging configuration
@@ -178,7 +254,7 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.web_dir", "./web/dist")
 	v.SetDefault("server.cors.enabled", true)
 	v.SetDefault("server.cors.allowed_origins", []string{"*"})
-	v.SetDefault("server.cors.allowed_methods", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
+	v.SetDefault("server.cors.allowed_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"})
 	v.SetDefault("server.cors.allowed_headers", []string{"*"})
 	v.SetDefault("server.rate_limit.enabled", true)
 	v.SetDefault("server.rate_limit.requests", 100)
@@ -206,6 +282,49 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("storage.temp_dir", "./data/temp")
 	v.SetDefault("storage.backup_dir", "./data/backups")
 	v.SetDefault("storage.log_dir", "./logs")
+	v.SetDefault("storage.upload_expiry", 24)
+
+	// File manager defaults
+	v.SetDefault("files.deny", []string{"/etc/shadow*", "/etc/gshadow*", "/etc/passwd*"})
+	v.SetDefault("files.trash_dir", "./data/trash")
+	v.SetDefault("files.trash_max_age", 30)
+	v.SetDefault("files.trash_max_size", 10240)
+	v.SetDefault("files.version_dir", "./data/file_versions")
+	v.SetDefault("files.max_versions", 20)
+	v.SetDefault("files.index_ttl", 10)
+	v.SetDefault("files.extract_max_size", 10240)
+	v.SetDefault("files.extract_max_files", 100000)
+	v.SetDefault("files.extract_max_ratio", 1000)
+	v.SetDefault("files.share_max_upload", 1024)
+
+	// Apps defaults
+	v.SetDefault("apps.template_dir", "./data/apps/templates")
+	v.SetDefault("apps.install_dir", "./data/apps/installed")
+	v.SetDefault("apps.remote_index", "")
+
+	// ACME defaults
+	v.SetDefault("acme.directory_url", "https://acme-v02.api.letsencrypt.org/directory")
+	v.SetDefault("acme.key_type", "ec256")
+	v.SetDefault("acme.cert_dir", "./data/certs")
+	v.SetDefault("acme.webroot_dir", "./data/acme")
+	v.SetDefault("acme.renew_before_days", 30)
+	v.SetDefault("acme.renew_interval", 60)
+	v.SetDefault("acme.expiry_warn_days", 14)
+
+	// Nginx defaults, the layout is detected
+	v.SetDefault("nginx.binary", "")
+	v.SetDefault("nginx.conf_path", "")
+	v.SetDefault("nginx.sites_dir", "")
+	v.SetDefault("nginx.enabled_dir", "")
+	v.SetDefault("nginx.log_dir", "")
+	v.SetDefault("nginx.pid_path", "")
+	v.SetDefault("nginx.php_fpm_socket", "")
+	v.SetDefault("nginx.container", "")
+	v.SetDefault("nginx.reload", "exec")
+	v.SetDefault("nginx.analytics_interval", 30)
+	v.SetDefault("nginx.analytics_minute_days", 7)
+	v.SetDefault("nginx.analytics_hour_days", 90)
+	v.SetDefault("nginx.analytics_days", 730)
 
 	// Logging defaults
 	v.SetDefault("logging.level", "info")
@@ -231,6 +350,12 @@ func ensureDirectories(cfg *Config) {
 		cfg.Storage.TempDir,
 		cfg.Storage.BackupDir,
 		cfg.Storage.LogDir,
+		cfg.Files.TrashDir,
+		cfg.Files.VersionDir,
+		cfg.Apps.TemplateDir,
+		cfg.Apps.InstallDir,
+		cfg.ACME.CertDir,
+		cfg.ACME.WebrootDir,
 		cfg.Plugin.Directory,
 		cfg.Plugin.DataDirectory,
 		filepath.Dir(cfg.Database.Database),
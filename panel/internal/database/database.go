@@ -2,6 +2,8 @@ package database
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/vpanel/server/internal/config"
 	"github.com/vpanel/server/internal/models"
@@ -54,7 +56,7 @@ func New(cfg config.DatabaseConfig) (*gorm.DB, error) {
 
 // AutoMigrate runs database migrations
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(
+	err := db.AutoMigrate(
 		// User & Auth
 		&models.User{},
 		&models.Session{},
@@ -65,10 +67,19 @@ func AutoMigrate(db *gorm.DB) error {
 
 		// Docker
 		&models.DockerComposeProject{},
+		&models.DockerComposeRevision{},
+		&models.DockerEvent{},
+		&models.DockerVolumeBackup{},
 
 		// Nginx
 		&models.NginxSite{},
+		&models.NginxUpstream{},
+		&models.NginxLocation{},
+		&models.NginxAuthUser{},
+		&models.NginxLogStat{},
+		&models.NginxLogCursor{},
 		&models.SSLCertificate{},
+		&models.SSLRenewal{},
 
 		// Database
 		&models.DatabaseServer{},
@@ -81,6 +92,14 @@ func AutoMigrate(db *gorm.DB) error {
 		// Firewall
 		&models.FirewallRule{},
 
+		// File manager
+		&models.FileUpload{},
+		&models.FileTrash{},
+		&models.FileVersion{},
+		&models.FileJail{},
+		&models.FileShare{},
+		&models.FileLocation{},
+
 		// Plugin
 		&models.Plugin{},
 
@@ -93,6 +112,41 @@ func AutoMigrate(db *gorm.DB) error {
 		&models.Notification{},
 		&models.Alert{},
 	)
+	if err != nil {
+		return err
+	}
+	return migrateComposeProjectNames(db)
+}
+
+// migrateComposeProjectNames stores the compose project name of projects created before
+// it was kept. Compose named them after the directory they were started in, imported
+// projects keep the name compose gave them.
+func migrateComposeProjectNames(db *gorm.DB) error {
+	var projects []models.DockerComposeProject
+	if err := db.Where("project_name IS NULL OR project_name = ''").Find(&projects).Error; err != nil {
+		return err
+	}
+	for _, project := range projects {
+		name := project.Name
+		if !project.Imported {
+			name = composeDirProjectName(filepath.Base(project.Path))
+		}
+		if err := db.Model(&project).UpdateColumn("project_name", name).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// composeDirProjectName returns the project name compose derives from a directory name
+func composeDirProjectName(dir string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(dir) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			sb.WriteRune(r)
+		}
+	}
+	return strings.TrimLeft(sb.String(), "-_")
 }
 
 // Seed populates the database with initial data
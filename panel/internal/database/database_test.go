@@ -0,0 +1,61 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a database of its own
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+func TestMigrateComposeProjectNames(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.DockerComposeProject{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		project models.DockerComposeProject
+		want    string
+	}{
+		{models.DockerComposeProject{Name: "Blog", Path: "/opt/stacks/My.Blog_1"}, "myblog_1"},
+		{models.DockerComposeProject{Name: "web", Path: "/srv/-web-"}, "web-"},
+		{models.DockerComposeProject{Name: "Legacy Stack", Path: "/srv/legacy", Imported: true}, "Legacy Stack"},
+		{models.DockerComposeProject{Name: "new", ProjectName: "kept", Path: "/srv/other"}, "kept"},
+	}
+	for i := range tests {
+		if err := db.Create(&tests[i].project).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateComposeProjectNames(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var got models.DockerComposeProject
+		if err := db.First(&got, "id = ?", tt.project.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if got.ProjectName != tt.want {
+			t.Errorf("project %q in %s: project name = %q, want %q", tt.project.Name, tt.project.Path, got.ProjectName, tt.want)
+		}
+	}
+}
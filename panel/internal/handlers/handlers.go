@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -632,787 +637,3214 @@ func (h *DockerHandler) RemoveVolume(c *gin.Context) {
 	response.NoContent(c)
 }
 
-func (h *DockerHandler) ListComposeProjects(c *gin.Context) {
+func (h *DockerHandler) CloneVolume(c *gin.Context) {
 	ctx := context.Background()
-	projects, err := h.svc.Docker.ListComposeProjects(ctx)
+	var req struct {
+		Target string `json:"target" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Target volume name is required")
+		return
+	}
+
+	vol, err := h.svc.Docker.CloneVolume(ctx, c.Param("id"), req.Target)
 	if err != nil {
-		response.InternalError(c, "Failed to list compose projects: "+err.Error())
+		h.volumeError(c, "Failed to clone volume", err)
 		return
 	}
-	response.Success(c, projects)
+	response.Created(c, vol)
 }
 
-func (h *DockerHandler) CreateComposeProject(c *gin.Context) {
+func (h *DockerHandler) ListVolumeFiles(c *gin.Context) {
 	ctx := context.Background()
-	var req struct {
-		Name        string `json:"name" binding:"required"`
-		Path        string `json:"path" binding:"required"`
-		Content     string `json:"content" binding:"required"`
-		Description string `json:"description"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Name, path, and content are required")
+	files, err := h.svc.Docker.ListVolumeFiles(ctx, c.Param("id"), c.DefaultQuery("path", "/"))
+	if err != nil {
+		h.volumeError(c, "Failed to list volume files", err)
 		return
 	}
+	response.Success(c, files)
+}
 
-	project, err := h.svc.Docker.CreateComposeProject(ctx, req.Name, req.Path, req.Content, req.Description)
+func (h *DockerHandler) DownloadVolumeFile(c *gin.Context) {
+	ctx := c.Request.Context()
+	reader, file, err := h.svc.Docker.OpenVolumePath(ctx, c.Param("id"), c.DefaultQuery("path", "/"))
 	if err != nil {
-		response.InternalError(c, "Failed to create compose project: "+err.Error())
+		h.volumeError(c, "Failed to read volume file", err)
 		return
 	}
-	response.Created(c, project)
+	defer reader.Close()
+
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	if file.IsDir {
+		c.Header("Content-Disposition", "attachment; filename="+file.Name+".tar.gz")
+		c.DataFromReader(http.StatusOK, -1, "application/gzip", reader, nil)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+file.Name)
+	c.DataFromReader(http.StatusOK, file.Size, "application/octet-stream", reader, nil)
 }
 
-func (h *DockerHandler) RemoveComposeProject(c *gin.Context) {
+func (h *DockerHandler) BackupVolume(c *gin.Context) {
 	ctx := context.Background()
-	id := c.Param("id")
+	username, _ := c.Get("username")
 
-	if err := h.svc.Docker.RemoveComposeProject(ctx, id); err != nil {
-		response.InternalError(c, "Failed to remove compose project: "+err.Error())
+	backup, err := h.svc.Docker.BackupVolume(ctx, c.Param("id"), fmt.Sprint(username))
+	if err != nil {
+		h.volumeError(c, "Failed to back up volume", err)
 		return
 	}
-	response.NoContent(c)
+	response.Created(c, backup)
 }
 
-func (h *DockerHandler) ComposeUp(c *gin.Context) {
-	ctx := context.Background()
-	id := c.Param("id")
+func (h *DockerHandler) ListVolumeBackups(c *gin.Context) {
+	backups, err := h.svc.Docker.ListVolumeBackups(c.Query("volume"))
+	if err != nil {
+		response.InternalError(c, "Failed to list volume backups: "+err.Error())
+		return
+	}
+	response.Success(c, backups)
+}
 
-	if err := h.svc.Docker.ComposeUp(ctx, id); err != nil {
-		response.InternalError(c, "Failed to start compose project: "+err.Error())
+func (h *DockerHandler) DownloadVolumeBackup(c *gin.Context) {
+	backup, err := h.svc.Docker.GetVolumeBackup(c.Param("id"))
+	if err != nil {
+		h.volumeError(c, "Failed to get volume backup", err)
+		return
+	}
+	if backup.Status != "completed" {
+		response.BadRequest(c, services.ErrVolumeBackupIncomplete.Error())
 		return
 	}
-	response.Success(c, gin.H{"message": "Compose project started"})
+	c.FileAttachment(backup.FilePath, backup.FileName)
 }
 
-func (h *DockerHandler) ComposeDown(c *gin.Context) {
+func (h *DockerHandler) RestoreVolumeBackup(c *gin.Context) {
 	ctx := context.Background()
-	id := c.Param("id")
+	var req struct {
+		Volume string `json:"volume"` // defaults to the backed up volume
+		Force  bool   `json:"force"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		response.BadRequest(c, "Invalid request body")
+		return
+	}
 
-	if err := h.svc.Docker.ComposeDown(ctx, id); err != nil {
-		response.InternalError(c, "Failed to stop compose project: "+err.Error())
+	if err := h.svc.Docker.RestoreVolumeBackup(ctx, c.Param("id"), req.Volume, req.Force); err != nil {
+		h.volumeError(c, "Failed to restore volume backup", err)
 		return
 	}
-	response.Success(c, gin.H{"message": "Compose project stopped"})
+	response.Success(c, gin.H{"message": "Volume restored"})
 }
-func (h *DockerHandler) ContainerLogsWS(c *gin.Context)  { /* WebSocket */ }
-func (h *DockerHandler) ContainerStatsWS(c *gin.Context) { /* WebSocket */ }
 
-// ============================================
-// Nginx Handler
-// ============================================
+func (h *DockerHandler) DeleteVolumeBackup(c *gin.Context) {
+	if err := h.svc.Docker.DeleteVolumeBackup(c.Param("id")); err != nil {
+		h.volumeError(c, "Failed to delete volume backup", err)
+		return
+	}
+	response.NoContent(c)
+}
 
-type NginxHandler struct {
-	svc *services.Container
-	log *logger.Logger
+// volumeError maps volume errors to responses
+func (h *DockerHandler) volumeError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, services.ErrVolumeNotFound), errors.Is(err, services.ErrVolumeBackupNotFound), os.IsNotExist(err):
+		response.NotFound(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrVolumeExists), errors.Is(err, services.ErrVolumeInUse):
+		response.Conflict(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrVolumeNotDirectory), errors.Is(err, services.ErrVolumePathOutside),
+		errors.Is(err, services.ErrVolumeBackupIncomplete):
+		response.BadRequest(c, message+": "+err.Error())
+	default:
+		response.InternalError(c, message+": "+err.Error())
+	}
 }
 
-func (h *NginxHandler) Status(c *gin.Context) {
-	status, err := h.svc.Nginx.GetStatus()
+func (h *DockerHandler) DiskUsage(c *gin.Context) {
+	ctx := context.Background()
+	usage, err := h.svc.Docker.DiskUsage(ctx)
 	if err != nil {
-		response.InternalError(c, "Failed to get nginx status: "+err.Error())
+		response.InternalError(c, "Failed to get disk usage: "+err.Error())
 		return
 	}
-	response.Success(c, status)
+	response.Success(c, usage)
 }
 
-func (h *NginxHandler) Reload(c *gin.Context) {
-	if err := h.svc.Nginx.Reload(); err != nil {
-		response.InternalError(c, "Failed to reload nginx: "+err.Error())
+func (h *DockerHandler) Prune(c *gin.Context) {
+	ctx := context.Background()
+	var req services.PruneOptions
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request body")
 		return
 	}
-	response.Success(c, gin.H{"message": "Nginx reloaded successfully"})
-}
 
-func (h *NginxHandler) ListSites(c *gin.Context) {
-	nodeID := c.Query("node_id")
-	sites, err := h.svc.Nginx.ListSites(nodeID)
+	report, err := h.svc.Docker.Prune(ctx, req)
 	if err != nil {
-		response.InternalError(c, "Failed to list sites: "+err.Error())
+		if errors.Is(err, services.ErrInvalidPruneOptions) {
+			response.BadRequest(c, err.Error())
+			return
+		}
+		response.InternalError(c, "Prune failed: "+err.Error())
 		return
 	}
-	response.Success(c, sites)
+	response.Success(c, report)
 }
 
-func (h *NginxHandler) CreateSite(c *gin.Context) {
-	var site models.NginxSite
-	if err := c.ShouldBindJSON(&site); err != nil {
-		response.BadRequest(c, "Invalid request data")
+func (h *DockerHandler) PruneImages(c *gin.Context) {
+	ctx := context.Background()
+	var req struct {
+		Mode   string   `json:"mode"` // dangling (default) or unused
+		Until  string   `json:"until"`
+		Labels []string `json:"labels"`
+		DryRun bool     `json:"dry_run"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		response.BadRequest(c, "Invalid request body")
 		return
 	}
 
-	if err := h.svc.Nginx.CreateSite(&site); err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			response.Conflict(c, err.Error())
+	report, err := h.svc.Docker.PruneImages(ctx, services.PruneOptions{
+		Images: req.Mode,
+		Until:  req.Until,
+		Labels: req.Labels,
+		DryRun: req.DryRun,
+	})
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPruneOptions) {
+			response.BadRequest(c, err.Error())
 			return
 		}
-		response.InternalError(c, "Failed to create site: "+err.Error())
+		response.InternalError(c, "Prune failed: "+err.Error())
 		return
 	}
-	response.Created(c, site)
+	response.Success(c, report)
 }
 
-func (h *NginxHandler) GetSite(c *gin.Context) {
-	id := c.Param("id")
-	site, err := h.svc.Nginx.GetSite(id)
+func (h *DockerHandler) GetPrunePolicy(c *gin.Context) {
+	policy, err := h.svc.Docker.GetPrunePolicy()
 	if err != nil {
-		response.NotFound(c, "Site not found")
+		response.InternalError(c, "Failed to get prune policy: "+err.Error())
 		return
 	}
-	response.Success(c, site)
+	response.Success(c, policy)
 }
 
-func (h *NginxHandler) UpdateSite(c *gin.Context) {
-	id := c.Param("id")
-	var updates map[string]interface{}
-	if err := c.ShouldBindJSON(&updates); err != nil {
-		response.BadRequest(c, "Invalid request data")
+func (h *DockerHandler) UpdatePrunePolicy(c *gin.Context) {
+	var req struct {
+		Enabled  bool                  `json:"enabled"`
+		Schedule string                `json:"schedule" binding:"required"`
+		Options  services.PruneOptions `json:"options"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Schedule is required")
 		return
 	}
 
-	if err := h.svc.Nginx.UpdateSite(id, updates); err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			response.Conflict(c, err.Error())
+	policy, err := h.svc.Docker.UpdatePrunePolicy(req.Enabled, req.Schedule, req.Options)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPruneOptions) || err == services.ErrInvalidCronExpression {
+			response.BadRequest(c, err.Error())
 			return
 		}
-		response.InternalError(c, "Failed to update site: "+err.Error())
+		response.InternalError(c, "Failed to update prune policy: "+err.Error())
 		return
 	}
+	response.Success(c, policy)
+}
 
-	site, err := h.svc.Nginx.GetSite(id)
+func (h *DockerHandler) ListComposeProjects(c *gin.Context) {
+	ctx := context.Background()
+	projects, err := h.svc.Docker.ListComposeProjects(ctx)
 	if err != nil {
-		response.InternalError(c, "Failed to get updated site")
+		response.InternalError(c, "Failed to list compose projects: "+err.Error())
 		return
 	}
-	response.Success(c, site)
+	response.Success(c, projects)
 }
 
-func (h *NginxHandler) DeleteSite(c *gin.Context) {
-	id := c.Param("id")
-	if err := h.svc.Nginx.DeleteSite(id); err != nil {
-		response.InternalError(c, "Failed to delete site: "+err.Error())
+func (h *DockerHandler) CreateComposeProject(c *gin.Context) {
+	ctx := context.Background()
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Path        string `json:"path" binding:"required"`
+		Content     string `json:"content" binding:"required"`
+		EnvContent  string `json:"env_content"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Name, path, and content are required")
 		return
 	}
-	response.NoContent(c)
+
+	username, _ := c.Get("username")
+	project, err := h.svc.Docker.CreateComposeProject(ctx, req.Name, req.Path, req.Content, req.EnvContent, req.Description, fmt.Sprint(username))
+	if err != nil {
+		if errors.Is(err, services.ErrComposeInvalid) {
+			response.ValidationError(c, err.Error())
+			return
+		}
+		if errors.Is(err, services.ErrComposeProjectExists) {
+			response.Conflict(c, err.Error())
+			return
+		}
+		response.InternalError(c, "Failed to create compose project: "+err.Error())
+		return
+	}
+	response.Created(c, project)
 }
 
-func (h *NginxHandler) EnableSite(c *gin.Context) {
+func (h *DockerHandler) GetComposeProject(c *gin.Context) {
+	ctx := context.Background()
 	id := c.Param("id")
-	if err := h.svc.Nginx.EnableSite(id); err != nil {
-		response.InternalError(c, "Failed to enable site: "+err.Error())
+
+	project, err := h.svc.Docker.GetComposeProject(ctx, id)
+	if err != nil {
+		response.NotFound(c, "Compose project not found")
 		return
 	}
-	response.Success(c, gin.H{"message": "Site enabled"})
+	response.Success(c, project)
 }
 
-func (h *NginxHandler) DisableSite(c *gin.Context) {
+func (h *DockerHandler) UpdateComposeProject(c *gin.Context) {
+	ctx := context.Background()
 	id := c.Param("id")
-	if err := h.svc.Nginx.DisableSite(id); err != nil {
-		response.InternalError(c, "Failed to disable site: "+err.Error())
+	var req struct {
+		Content    string `json:"content" binding:"required"`
+		EnvContent string `json:"env_content"`
+		Message    string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Content is required")
 		return
 	}
-	response.Success(c, gin.H{"message": "Site disabled"})
-}
 
-func (h *NginxHandler) ListCertificates(c *gin.Context) {
-	nodeID := c.Query("node_id")
-	certs, err := h.svc.Nginx.ListCertificates(nodeID)
+	username, _ := c.Get("username")
+	project, err := h.svc.Docker.UpdateComposeProject(ctx, id, req.Content, req.EnvContent, req.Message, fmt.Sprint(username))
 	if err != nil {
-		response.InternalError(c, "Failed to list certificates: "+err.Error())
+		if errors.Is(err, services.ErrComposeInvalid) {
+			response.ValidationError(c, err.Error())
+			return
+		}
+		response.InternalError(c, "Failed to update compose project: "+err.Error())
 		return
 	}
-	response.Success(c, certs)
+	response.Success(c, project)
 }
 
-func (h *NginxHandler) CreateCertificate(c *gin.Context) {
-	var cert models.SSLCertificate
-	if err := c.ShouldBindJSON(&cert); err != nil {
-		response.BadRequest(c, "Invalid request data")
-		return
+func (h *DockerHandler) ValidateCompose(c *gin.Context) {
+	ctx := context.Background()
+	var req struct {
+		Path       string `json:"path"`
+		Content    string `json:"content" binding:"required"`
+		EnvContent string `json:"env_content"`
 	}
-
-	if err := h.svc.Nginx.CreateCertificate(&cert); err != nil {
-		response.InternalError(c, "Failed to create certificate: "+err.Error())
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Content is required")
 		return
 	}
-	response.Created(c, cert)
-}
 
-func (h *NginxHandler) DeleteCertificate(c *gin.Context) {
-	id := c.Param("id")
-	if err := h.svc.Nginx.DeleteCertificate(id); err != nil {
-		if strings.Contains(err.Error(), "in use") {
-			response.BadRequest(c, err.Error())
+	config, err := h.svc.Docker.ValidateCompose(ctx, req.Path, req.Content, req.EnvContent)
+	if err != nil {
+		if errors.Is(err, services.ErrComposeInvalid) {
+			response.Success(c, gin.H{"valid": false, "error": err.Error()})
 			return
 		}
-		response.InternalError(c, "Failed to delete certificate: "+err.Error())
+		response.InternalError(c, "Failed to validate compose file: "+err.Error())
 		return
 	}
-	response.NoContent(c)
+	response.Success(c, gin.H{"valid": true, "config": config})
 }
 
-func (h *NginxHandler) RenewCertificate(c *gin.Context) {
+func (h *DockerHandler) ListComposeRevisions(c *gin.Context) {
 	id := c.Param("id")
-	if err := h.svc.Nginx.RenewCertificate(id); err != nil {
-		response.InternalError(c, "Failed to renew certificate: "+err.Error())
+
+	revisions, err := h.svc.Docker.ListComposeRevisions(id)
+	if err != nil {
+		response.InternalError(c, "Failed to list revisions: "+err.Error())
 		return
 	}
-	response.Success(c, gin.H{"message": "Certificate renewed successfully"})
+	response.Success(c, revisions)
 }
 
-func (h *NginxHandler) AccessLogs(c *gin.Context) {
-	siteID := c.Query("site_id")
-	lines, _ := strconv.Atoi(c.DefaultQuery("lines", "100"))
-
-	logs, err := h.svc.Nginx.GetAccessLogs(siteID, lines)
+func (h *DockerHandler) GetComposeRevision(c *gin.Context) {
+	id := c.Param("id")
+	version, err := strconv.Atoi(c.Param("version"))
 	if err != nil {
-		response.InternalError(c, "Failed to get access logs: "+err.Error())
+		response.BadRequest(c, "Invalid version")
 		return
 	}
-	response.Success(c, gin.H{"logs": logs})
-}
 
-func (h *NginxHandler) ErrorLogs(c *gin.Context) {
-	siteID := c.Query("site_id")
-	lines, _ := strconv.Atoi(c.DefaultQuery("lines", "100"))
-
-	logs, err := h.svc.Nginx.GetErrorLogs(siteID, lines)
+	revision, err := h.svc.Docker.GetComposeRevision(id, version)
 	if err != nil {
-		response.InternalError(c, "Failed to get error logs: "+err.Error())
+		response.NotFound(c, "Revision not found")
 		return
 	}
-	response.Success(c, gin.H{"logs": logs})
+	response.Success(c, revision)
 }
 
-func (h *NginxHandler) Analytics(c *gin.Context) {
-	siteID := c.Query("site_id")
-	days, _ := strconv.Atoi(c.DefaultQuery("days", "30"))
-
-	analytics, err := h.svc.Nginx.GetAnalytics(siteID, days)
+func (h *DockerHandler) DiffComposeRevisions(c *gin.Context) {
+	id := c.Param("id")
+	from, err := strconv.Atoi(c.Query("from"))
 	if err != nil {
-		response.InternalError(c, "Failed to get analytics: "+err.Error())
+		response.BadRequest(c, "Invalid from version")
 		return
 	}
-	response.Success(c, analytics)
-}
-
-// ============================================
-// Database Handler
-// ============================================
+	to, _ := strconv.Atoi(c.DefaultQuery("to", "0"))
 
-type DatabaseHandler struct {
-	svc *services.Container
-	log *logger.Logger
-}
-
-func (h *DatabaseHandler) ListServers(c *gin.Context) {
-	servers, err := h.svc.Database.ListServers()
+	result, err := h.svc.Docker.DiffComposeRevisions(id, from, to)
 	if err != nil {
-		h.log.Error("Failed to list database servers", "error", err)
-		response.InternalError(c, "Failed to list database servers")
+		if errors.Is(err, services.ErrComposeRevisionNotFound) {
+			response.NotFound(c, "Revision not found")
+			return
+		}
+		response.InternalError(c, "Failed to diff revisions: "+err.Error())
 		return
 	}
-	response.Success(c, servers)
+	response.Success(c, result)
 }
 
-func (h *DatabaseHandler) CreateServer(c *gin.Context) {
-	var req models.DatabaseServer
+func (h *DockerHandler) RollbackComposeProject(c *gin.Context) {
+	ctx := context.Background()
+	id := c.Param("id")
+	var req struct {
+		Version int `json:"version" binding:"required"`
+	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+		response.BadRequest(c, "Version is required")
 		return
 	}
 
-	// Validate required fields
-	if req.Name == "" {
-		response.BadRequest(c, "Server name is required")
+	username, _ := c.Get("username")
+	project, err := h.svc.Docker.RollbackComposeProject(ctx, id, req.Version, fmt.Sprint(username))
+	if err != nil {
+		if errors.Is(err, services.ErrComposeRevisionNotFound) {
+			response.NotFound(c, "Revision not found")
+			return
+		}
+		if errors.Is(err, services.ErrComposeInvalid) {
+			response.ValidationError(c, err.Error())
+			return
+		}
+		response.InternalError(c, "Failed to rollback compose project: "+err.Error())
 		return
 	}
-	if req.Type == "" {
-		response.BadRequest(c, "Database type is required")
+	response.Success(c, project)
+}
+
+func (h *DockerHandler) RemoveComposeProject(c *gin.Context) {
+	ctx := context.Background()
+	id := c.Param("id")
+
+	if err := h.svc.Docker.RemoveComposeProject(ctx, id); err != nil {
+		response.InternalError(c, "Failed to remove compose project: "+err.Error())
 		return
 	}
-	if req.Host == "" {
-		response.BadRequest(c, "Host is required")
+	response.NoContent(c)
+}
+
+func (h *DockerHandler) ComposeUp(c *gin.Context) {
+	id := c.Param("id")
+	streamOutput(c, c.Query("stream") == "true", "start compose project", func(_ context.Context, w io.Writer) error {
+		return h.svc.Docker.ComposeUp(context.Background(), id, w)
+	})
+}
+
+func (h *DockerHandler) ComposeDown(c *gin.Context) {
+	id := c.Param("id")
+	streamOutput(c, c.Query("stream") == "true", "stop compose project", func(_ context.Context, w io.Writer) error {
+		return h.svc.Docker.ComposeDown(context.Background(), id, w)
+	})
+}
+
+func (h *DockerHandler) ComposePull(c *gin.Context) {
+	id := c.Param("id")
+	streamOutput(c, c.Query("stream") == "true", "pull compose images", func(_ context.Context, w io.Writer) error {
+		return h.svc.Docker.ComposePull(context.Background(), id, w)
+	})
+}
+
+func (h *DockerHandler) ListComposeServices(c *gin.Context) {
+	ctx := context.Background()
+	id := c.Param("id")
+
+	svcs, err := h.svc.Docker.ListComposeServices(ctx, id)
+	if err != nil {
+		response.InternalError(c, "Failed to list compose services: "+err.Error())
+		return
+	}
+	response.Success(c, svcs)
+}
+
+func (h *DockerHandler) StartComposeService(c *gin.Context)   { h.composeServiceAction(c, "start") }
+func (h *DockerHandler) StopComposeService(c *gin.Context)    { h.composeServiceAction(c, "stop") }
+func (h *DockerHandler) RestartComposeService(c *gin.Context) { h.composeServiceAction(c, "restart") }
+
+func (h *DockerHandler) composeServiceAction(c *gin.Context, action string) {
+	id := c.Param("id")
+	service := c.Param("service")
+	streamOutput(c, c.Query("stream") == "true", action+" service", func(_ context.Context, w io.Writer) error {
+		return h.svc.Docker.ComposeServiceAction(context.Background(), id, service, action, w)
+	})
+}
+
+func (h *DockerHandler) ComposeServiceLogs(c *gin.Context) {
+	id := c.Param("id")
+	service := c.Param("service")
+	tail, _ := strconv.Atoi(c.DefaultQuery("tail", "500"))
+	follow := c.Query("follow") == "true"
+
+	// Following only makes sense as a stream
+	streamOutput(c, follow || c.Query("stream") == "true", "get service logs", func(ctx context.Context, w io.Writer) error {
+		return h.svc.Docker.ComposeServiceLogs(ctx, id, service, tail, follow, w)
+	})
+}
+
+func (h *DockerHandler) ScaleComposeService(c *gin.Context) {
+	id := c.Param("id")
+	service := c.Param("service")
+	var req struct {
+		Replicas *int `json:"replicas" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Replicas is required")
+		return
+	}
+
+	streamOutput(c, c.Query("stream") == "true", "scale service", func(_ context.Context, w io.Writer) error {
+		return h.svc.Docker.ComposeScale(context.Background(), id, service, *req.Replicas, w)
+	})
+}
+
+func (h *DockerHandler) DiscoverComposeProjects(c *gin.Context) {
+	ctx := context.Background()
+	projects, err := h.svc.Docker.DiscoverComposeProjects(ctx)
+	if err != nil {
+		response.InternalError(c, "Failed to discover compose projects: "+err.Error())
+		return
+	}
+	response.Success(c, projects)
+}
+
+func (h *DockerHandler) ImportComposeProject(c *gin.Context) {
+	ctx := context.Background()
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Project name is required")
+		return
+	}
+
+	username, _ := c.Get("username")
+	project, err := h.svc.Docker.ImportComposeProject(ctx, req.Name, req.Description, fmt.Sprint(username))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrComposeProjectNotFound):
+			response.NotFound(c, "Compose project not found")
+		case errors.Is(err, services.ErrComposeProjectExists):
+			response.Conflict(c, "Compose project is already managed")
+		default:
+			response.InternalError(c, "Failed to import compose project: "+err.Error())
+		}
+		return
+	}
+	response.Created(c, project)
+}
+
+func (h *DockerHandler) ContainerLogsWS(c *gin.Context)  { /* WebSocket */ }
+func (h *DockerHandler) ContainerStatsWS(c *gin.Context) { /* WebSocket */ }
+
+func (h *DockerHandler) ListEvents(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+
+	query := services.DockerEventQuery{
+		Page:     page,
+		PageSize: pageSize,
+		Type:     c.Query("type"),
+		Action:   c.Query("action"),
+		Actor:    c.Query("actor"),
+		Project:  c.Query("project"),
+		Since:    c.Query("since"),
+		Until:    c.Query("until"),
+	}
+
+	result, err := h.svc.Docker.ListEvents(query)
+	if err != nil {
+		response.InternalError(c, "Failed to list docker events: "+err.Error())
+		return
+	}
+	response.Success(c, result)
+}
+
+// EventsStream streams docker events as server-sent events
+func (h *DockerHandler) EventsStream(c *gin.Context) {
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	eventType := c.Query("type")
+	actions := map[string]bool{}
+	for _, a := range strings.Split(c.Query("action"), ",") {
+		if a != "" {
+			actions[a] = true
+		}
+	}
+	actor := c.Query("actor")
+	project := c.Query("project")
+
+	events, unsubscribe := h.svc.Docker.SubscribeEvents()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			c.Writer.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if eventType != "" && ev.Type != eventType {
+				continue
+			}
+			if len(actions) > 0 && !actions[ev.Action] {
+				continue
+			}
+			if actor != "" && ev.ActorName != actor && !strings.HasPrefix(ev.ActorID, actor) {
+				continue
+			}
+			if project != "" && ev.Project != project {
+				continue
+			}
+			c.SSEvent("event", ev)
+			c.Writer.Flush()
+		}
+	}
+}
+
+// streamOutput runs fn and returns its output. When stream is set the output is
+// sent line by line as server-sent "output" events followed by a "done" event.
+func streamOutput(c *gin.Context, stream bool, action string, fn func(ctx context.Context, w io.Writer) error) {
+	// Long running commands must not be cut off by the server write timeout
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	if !stream {
+		var buf bytes.Buffer
+		if err := fn(c.Request.Context(), &buf); err != nil {
+			status := http.StatusInternalServerError
+			code := "INTERNAL_ERROR"
+			if services.IsComposeError(err) {
+				status, code = http.StatusBadRequest, "BAD_REQUEST"
+			}
+			response.ErrorWithDetails(c, status, code, "Failed to "+action+": "+err.Error(), gin.H{"output": buf.String()})
+			return
+		}
+		response.Success(c, gin.H{"output": buf.String()})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	w := &sseWriter{c: c}
+	err := fn(c.Request.Context(), w)
+	w.flushPartial()
+
+	done := gin.H{"success": err == nil}
+	if err != nil {
+		done["error"] = "Failed to " + action + ": " + err.Error()
+	}
+	w.event("done", done)
+}
+
+// sseWriter turns written output into server-sent events, one per line
+type sseWriter struct {
+	c       *gin.Context
+	mu      sync.Mutex
+	partial []byte
+	closed  bool
+}
+
+func (w *sseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexAny(w.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		if line := string(w.partial[:i]); line != "" {
+			w.send("output", line)
+		}
+		w.partial = w.partial[i+1:]
+	}
+
+	// Never fail the writer, a disconnected client must not block the command
+	return len(p), nil
+}
+
+func (w *sseWriter) flushPartial() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.send("output", string(w.partial))
+		w.partial = nil
+	}
+}
+
+func (w *sseWriter) event(name string, data interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.send(name, data)
+}
+
+func (w *sseWriter) send(name string, data interface{}) {
+	if w.closed {
+		return
+	}
+	if w.c.Request.Context().Err() != nil {
+		w.closed = true
+		return
+	}
+	w.c.SSEvent(name, data)
+	w.c.Writer.Flush()
+}
+
+// ============================================
+// Nginx Handler
+// ============================================
+
+type NginxHandler struct {
+	svc *services.Container
+	log *logger.Logger
+}
+
+func (h *NginxHandler) Status(c *gin.Context) {
+	status, err := h.svc.Nginx.GetStatus()
+	if err != nil {
+		response.InternalError(c, "Failed to get nginx status: "+err.Error())
+		return
+	}
+	response.Success(c, status)
+}
+
+func (h *NginxHandler) Reload(c *gin.Context) {
+	if err := h.svc.Nginx.Reload(); err != nil {
+		response.InternalError(c, "Failed to reload nginx: "+err.Error())
+		return
+	}
+	response.Success(c, gin.H{"message": "Nginx reloaded successfully"})
+}
+
+func (h *NginxHandler) ListSites(c *gin.Context) {
+	nodeID := c.Query("node_id")
+	sites, err := h.svc.Nginx.ListSites(nodeID)
+	if err != nil {
+		response.InternalError(c, "Failed to list sites: "+err.Error())
+		return
+	}
+	response.Success(c, sites)
+}
+
+func (h *NginxHandler) CreateSite(c *gin.Context) {
+	var site models.NginxSite
+	if err := c.ShouldBindJSON(&site); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.Nginx.CreateSite(&site); err != nil {
+		h.siteError(c, "Failed to create site", err)
+		return
+	}
+	response.Created(c, site)
+}
+
+func (h *NginxHandler) GetSite(c *gin.Context) {
+	id := c.Param("id")
+	site, err := h.svc.Nginx.GetSite(id)
+	if err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+	response.Success(c, site)
+}
+
+func (h *NginxHandler) UpdateSite(c *gin.Context) {
+	id := c.Param("id")
+	var updates map[string]interface{}
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.Nginx.UpdateSite(id, updates); err != nil {
+		h.siteError(c, "Failed to update site", err)
+		return
+	}
+
+	site, err := h.svc.Nginx.GetSite(id)
+	if err != nil {
+		response.InternalError(c, "Failed to get updated site")
+		return
+	}
+	response.Success(c, site)
+}
+
+func (h *NginxHandler) DeleteSite(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.svc.Nginx.DeleteSite(id); err != nil {
+		h.siteError(c, "Failed to delete site", err)
+		return
+	}
+	response.NoContent(c)
+}
+
+func (h *NginxHandler) EnableSite(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.svc.Nginx.EnableSite(id); err != nil {
+		h.siteError(c, "Failed to enable site", err)
+		return
+	}
+	response.Success(c, gin.H{"message": "Site enabled"})
+}
+
+func (h *NginxHandler) DisableSite(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.svc.Nginx.DisableSite(id); err != nil {
+		h.siteError(c, "Failed to disable site", err)
+		return
+	}
+	response.Success(c, gin.H{"message": "Site disabled"})
+}
+
+func (h *NginxHandler) ListUpstreams(c *gin.Context) {
+	nodeID := c.Query("node_id")
+	upstreams, err := h.svc.Nginx.ListUpstreams(nodeID)
+	if err != nil {
+		response.InternalError(c, "Failed to list upstreams: "+err.Error())
+		return
+	}
+	response.Success(c, upstreams)
+}
+
+func (h *NginxHandler) GetUpstream(c *gin.Context) {
+	upstream, err := h.svc.Nginx.GetUpstream(c.Param("id"))
+	if err != nil {
+		response.NotFound(c, "Upstream not found")
+		return
+	}
+	response.Success(c, upstream)
+}
+
+func (h *NginxHandler) CreateUpstream(c *gin.Context) {
+	var upstream models.NginxUpstream
+	if err := c.ShouldBindJSON(&upstream); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.Nginx.CreateUpstream(&upstream); err != nil {
+		h.siteError(c, "Failed to create upstream", err)
+		return
+	}
+	response.Created(c, upstream)
+}
+
+// UpdateUpstream replaces an upstream group, the servers are sent in full
+func (h *NginxHandler) UpdateUpstream(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetUpstream(id); err != nil {
+		response.NotFound(c, "Upstream not found")
+		return
+	}
+
+	var upstream models.NginxUpstream
+	if err := c.ShouldBindJSON(&upstream); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.Nginx.UpdateUpstream(id, &upstream); err != nil {
+		h.siteError(c, "Failed to update upstream", err)
+		return
+	}
+	response.Success(c, upstream)
+}
+
+func (h *NginxHandler) DeleteUpstream(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetUpstream(id); err != nil {
+		response.NotFound(c, "Upstream not found")
+		return
+	}
+
+	if err := h.svc.Nginx.DeleteUpstream(id); err != nil {
+		h.siteError(c, "Failed to delete upstream", err)
+		return
+	}
+	response.NoContent(c)
+}
+
+// ListLocations returns the location rules of a site
+func (h *NginxHandler) ListLocations(c *gin.Context) {
+	locations, err := h.svc.Nginx.ListLocations(c.Param("id"))
+	if err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+	response.Success(c, locations)
+}
+
+func (h *NginxHandler) CreateLocation(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetSite(id); err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+
+	var location models.NginxLocation
+	if err := c.ShouldBindJSON(&location); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.Nginx.CreateLocation(id, &location); err != nil {
+		h.siteError(c, "Failed to create location", err)
+		return
+	}
+	response.Created(c, location)
+}
+
+// UpdateLocation replaces a location rule of a site
+func (h *NginxHandler) UpdateLocation(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetSite(id); err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+
+	var location models.NginxLocation
+	if err := c.ShouldBindJSON(&location); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.Nginx.UpdateLocation(id, c.Param("location"), &location); err != nil {
+		h.siteError(c, "Failed to update location", err)
+		return
+	}
+	response.Success(c, location)
+}
+
+func (h *NginxHandler) DeleteLocation(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetSite(id); err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+
+	if err := h.svc.Nginx.DeleteLocation(id, c.Param("location")); err != nil {
+		h.siteError(c, "Failed to delete location", err)
+		return
+	}
+	response.NoContent(c)
+}
+
+// ListAuthUsers returns the basic auth users of a site
+func (h *NginxHandler) ListAuthUsers(c *gin.Context) {
+	users, err := h.svc.Nginx.ListAuthUsers(c.Param("id"))
+	if err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+	response.Success(c, users)
+}
+
+func (h *NginxHandler) CreateAuthUser(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetSite(id); err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required,min=8"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, err.Error())
+		return
+	}
+
+	user, err := h.svc.Nginx.CreateAuthUser(id, req.Username, req.Password)
+	if err != nil {
+		h.siteError(c, "Failed to create auth user", err)
+		return
+	}
+	response.Created(c, user)
+}
+
+// UpdateAuthUser changes the password of a basic auth user
+func (h *NginxHandler) UpdateAuthUser(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetSite(id); err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+
+	var req struct {
+		Password string `json:"password" binding:"required,min=8"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, err.Error())
+		return
+	}
+
+	if err := h.svc.Nginx.UpdateAuthUser(id, c.Param("user"), req.Password); err != nil {
+		h.siteError(c, "Failed to update auth user", err)
+		return
+	}
+	response.Success(c, gin.H{"message": "Password updated"})
+}
+
+func (h *NginxHandler) DeleteAuthUser(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetSite(id); err != nil {
+		response.NotFound(c, "Site not found")
+		return
+	}
+
+	if err := h.svc.Nginx.DeleteAuthUser(id, c.Param("user")); err != nil {
+		h.siteError(c, "Failed to delete auth user", err)
+		return
+	}
+	response.NoContent(c)
+}
+
+// Layout returns the detected nginx layout
+func (h *NginxHandler) Layout(c *gin.Context) {
+	response.Success(c, h.svc.Nginx.Layout())
+}
+
+// DetectLayout detects the nginx layout again
+func (h *NginxHandler) DetectLayout(c *gin.Context) {
+	response.Success(c, h.svc.Nginx.DetectLayout())
+}
+
+// ScanImport lists the server blocks of the existing nginx configuration that can be imported
+func (h *NginxHandler) ScanImport(c *gin.Context) {
+	scan, err := h.svc.Nginx.ScanImport()
+	if err != nil {
+		response.InternalError(c, "Failed to scan nginx configuration: "+err.Error())
+		return
+	}
+	response.Success(c, scan)
+}
+
+// ImportSites imports the selected server blocks as sites
+func (h *NginxHandler) ImportSites(c *gin.Context) {
+	var req struct {
+		Keys []string `json:"keys" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, err.Error())
+		return
+	}
+
+	sites, err := h.svc.Nginx.ImportSites(req.Keys)
+	if err != nil {
+		h.siteError(c, "Failed to import sites", err)
+		return
+	}
+	response.Created(c, sites)
+}
+
+// siteError responds with the nginx parser error and the lines around it when the
+// configuration was rejected
+func (h *NginxHandler) siteError(c *gin.Context, message string, err error) {
+	var cfgErr *services.NginxConfigError
+	switch {
+	case errors.As(err, &cfgErr):
+		response.ErrorWithDetails(c, http.StatusBadRequest, "BAD_REQUEST", message+": "+err.Error(), cfgErr)
+	case strings.Contains(err.Error(), "already exists"), errors.Is(err, services.ErrUpstreamInUse):
+		response.Conflict(c, err.Error())
+	case errors.Is(err, services.ErrLocationNotFound), errors.Is(err, services.ErrAuthUserNotFound):
+		response.NotFound(c, err.Error())
+	case errors.Is(err, services.ErrCertificateDomainMismatch), errors.Is(err, services.ErrNginxImport),
+		errors.Is(err, services.ErrInvalidCertificate), errors.Is(err, services.ErrCertificateKeyMismatch),
+		errors.Is(err, services.ErrInvalidUpstream), errors.Is(err, services.ErrInvalidLocation),
+		errors.Is(err, services.ErrInvalidSiteRule):
+		response.BadRequest(c, err.Error())
+	default:
+		response.InternalError(c, message+": "+err.Error())
+	}
+}
+
+func (h *NginxHandler) ListCertificates(c *gin.Context) {
+	nodeID := c.Query("node_id")
+	certs, err := h.svc.Nginx.ListCertificates(nodeID)
+	if err != nil {
+		response.InternalError(c, "Failed to list certificates: "+err.Error())
+		return
+	}
+	response.Success(c, certs)
+}
+
+func (h *NginxHandler) CreateCertificate(c *gin.Context) {
+	var req struct {
+		Domain      string      `json:"domain"`
+		SANs        []string    `json:"sans"`
+		SiteID      string      `json:"site_id"` // cover the site's domain and aliases and attach the certificate
+		Type        string      `json:"type"`
+		KeyType     string      `json:"key_type"`
+		Challenge   string      `json:"challenge"`
+		DNSProvider string      `json:"dns_provider"`
+		DNSConfig   models.JSON `json:"dns_config"`
+		CertPath    string      `json:"cert_path"`
+		KeyPath     string      `json:"key_path"`
+		ChainPath   string      `json:"chain_path"`
+		AutoRenew   *bool       `json:"auto_renew"`
+
+		// Custom certificate upload, PEM parts or a base64 encoded PKCS#12 bundle
+		Certificate    string `json:"certificate"`
+		Chain          string `json:"chain"`
+		PrivateKey     string `json:"private_key"`
+		PKCS12         []byte `json:"pkcs12"`
+		Password       string `json:"password"`
+		AllowUntrusted bool   `json:"allow_untrusted"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	cert := models.SSLCertificate{
+		Domain:      req.Domain,
+		SANs:        req.SANs,
+		Type:        req.Type,
+		KeyType:     req.KeyType,
+		Challenge:   req.Challenge,
+		DNSProvider: req.DNSProvider,
+		DNSConfig:   req.DNSConfig,
+		CertPath:    req.CertPath,
+		KeyPath:     req.KeyPath,
+		ChainPath:   req.ChainPath,
+		AutoRenew:   req.AutoRenew == nil || *req.AutoRenew,
+	}
+
+	var site *models.NginxSite
+	if req.SiteID != "" {
+		var err error
+		if site, err = h.svc.Nginx.GetSite(req.SiteID); err != nil {
+			response.NotFound(c, "Site not found")
+			return
+		}
+	}
+
+	var err error
+	if cert.Type == "letsencrypt" {
+		if site != nil {
+			if cert.Domain == "" {
+				cert.Domain = site.Domain
+			} else {
+				cert.SANs = append(cert.SANs, site.Domain)
+			}
+			cert.SANs = append(cert.SANs, site.Aliases...)
+		}
+		err = h.svc.Nginx.CreateCertificate(&cert)
+	} else {
+		err = h.svc.Nginx.CreateCustomCertificate(&cert, &services.CertificateUpload{
+			Certificate:    []byte(req.Certificate),
+			Chain:          []byte(req.Chain),
+			Key:            []byte(req.PrivateKey),
+			PKCS12:         req.PKCS12,
+			Password:       req.Password,
+			AllowUntrusted: req.AllowUntrusted,
+		}, site)
+	}
+	if err != nil {
+		h.certificateError(c, "Failed to create certificate", err)
+		return
+	}
+
+	if site != nil {
+		if err := h.svc.Nginx.UpdateSite(site.ID, map[string]interface{}{
+			"ssl_enabled": true,
+			"ssl_cert_id": cert.ID,
+		}); err != nil {
+			h.siteError(c, "Certificate issued but failed to enable SSL on site", err)
+			return
+		}
+	}
+	response.Created(c, cert)
+}
+
+// ReplaceCertificate uploads new files for a custom certificate
+func (h *NginxHandler) ReplaceCertificate(c *gin.Context) {
+	var req struct {
+		Certificate    string `json:"certificate"`
+		Chain          string `json:"chain"`
+		PrivateKey     string `json:"private_key"`
+		PKCS12         []byte `json:"pkcs12"`
+		Password       string `json:"password"`
+		AllowUntrusted bool   `json:"allow_untrusted"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	id := c.Param("id")
+	if _, err := h.svc.Nginx.GetCertificate(id); err != nil {
+		response.NotFound(c, "Certificate not found")
+		return
+	}
+
+	cert, err := h.svc.Nginx.ReplaceCertificate(id, &services.CertificateUpload{
+		Certificate:    []byte(req.Certificate),
+		Chain:          []byte(req.Chain),
+		Key:            []byte(req.PrivateKey),
+		PKCS12:         req.PKCS12,
+		Password:       req.Password,
+		AllowUntrusted: req.AllowUntrusted,
+	})
+	if err != nil {
+		h.certificateError(c, "Failed to replace certificate", err)
+		return
+	}
+	response.Success(c, cert)
+}
+
+func (h *NginxHandler) certificateError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, services.ErrWildcardNeedsDNS), errors.Is(err, services.ErrUnknownDNSProvider),
+		errors.Is(err, services.ErrInvalidKeyType), errors.Is(err, services.ErrUnsupportedChallenge),
+		errors.Is(err, services.ErrInvalidCertificate), errors.Is(err, services.ErrCertificateKeyMismatch),
+		errors.Is(err, services.ErrCertificateChain), errors.Is(err, services.ErrCertificateDomainMismatch):
+		response.BadRequest(c, err.Error())
+	default:
+		response.InternalError(c, message+": "+err.Error())
+	}
+}
+
+func (h *NginxHandler) ListDNSProviders(c *gin.Context) {
+	response.Success(c, services.DNSProviders())
+}
+
+func (h *NginxHandler) DeleteCertificate(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.svc.Nginx.DeleteCertificate(id); err != nil {
+		if strings.Contains(err.Error(), "in use") {
+			response.BadRequest(c, err.Error())
+			return
+		}
+		response.InternalError(c, "Failed to delete certificate: "+err.Error())
+		return
+	}
+	response.NoContent(c)
+}
+
+func (h *NginxHandler) RenewCertificate(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.svc.Nginx.RenewCertificate(id); err != nil {
+		response.InternalError(c, "Failed to renew certificate: "+err.Error())
+		return
+	}
+	response.Success(c, gin.H{"message": "Certificate renewed successfully"})
+}
+
+// ListRenewals returns certificate renewal history, of one certificate when an id is given
+func (h *NginxHandler) ListRenewals(c *gin.Context) {
+	certID := c.Param("id")
+	if certID == "" {
+		certID = c.Query("cert_id")
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	renewals, err := h.svc.Nginx.ListRenewals(certID, limit)
+	if err != nil {
+		response.InternalError(c, "Failed to list renewals: "+err.Error())
+		return
+	}
+	response.Success(c, renewals)
+}
+
+// AccessLogs returns the last lines of the access log, parsed and filtered when parsed
+// is set or a filter is given
+func (h *NginxHandler) AccessLogs(c *gin.Context) {
+	h.logs(c, "access")
+}
+
+// ErrorLogs returns the last lines of the error log, parsed and filtered when parsed is
+// set or a filter is given
+func (h *NginxHandler) ErrorLogs(c *gin.Context) {
+	h.logs(c, "error")
+}
+
+func (h *NginxHandler) logs(c *gin.Context, kind string) {
+	siteID := c.Query("site_id")
+	lines, _ := strconv.Atoi(c.DefaultQuery("lines", "100"))
+
+	filter, filtered, err := nginxLogFilter(c)
+	if err != nil {
+		response.BadRequest(c, err.Error())
+		return
+	}
+	if !filtered && c.Query("parsed") != "true" {
+		var logs []string
+		if kind == "access" {
+			logs, err = h.svc.Nginx.GetAccessLogs(siteID, lines)
+		} else {
+			logs, err = h.svc.Nginx.GetErrorLogs(siteID, lines)
+		}
+		if err != nil {
+			h.logError(c, siteID, "Failed to get "+kind+" logs", err)
+			return
+		}
+		response.Success(c, gin.H{"logs": logs})
+		return
+	}
+
+	entries, err := h.svc.Nginx.QueryLogs(siteID, kind, lines, filter)
+	if err != nil {
+		h.logError(c, siteID, "Failed to get "+kind+" logs", err)
+		return
+	}
+	response.Success(c, gin.H{"entries": entries})
+}
+
+// AccessLogsStream streams the parsed access log entries that match the filter as
+// server-sent events, the last lines first
+func (h *NginxHandler) AccessLogsStream(c *gin.Context) {
+	h.logsStream(c, "access")
+}
+
+// ErrorLogsStream streams the parsed error log entries that match the filter as
+// server-sent events, the last lines first
+func (h *NginxHandler) ErrorLogsStream(c *gin.Context) {
+	h.logsStream(c, "error")
+}
+
+func (h *NginxHandler) logsStream(c *gin.Context, kind string) {
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	siteID := c.Query("site_id")
+	lines, _ := strconv.Atoi(c.DefaultQuery("lines", "100"))
+	filter, _, err := nginxLogFilter(c)
+	if err != nil {
+		response.BadRequest(c, err.Error())
+		return
+	}
+
+	entries, err := h.svc.Nginx.FollowLogs(c.Request.Context(), siteID, kind, lines, filter)
+	if err != nil {
+		h.logError(c, siteID, "Failed to follow "+kind+" log", err)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			c.Writer.Flush()
+		case entry, ok := <-entries:
+			if !ok {
+				return
+			}
+			c.SSEvent("entry", entry)
+			c.Writer.Flush()
+		}
+	}
+}
+
+func (h *NginxHandler) logError(c *gin.Context, siteID, message string, err error) {
+	if errors.Is(err, services.ErrInvalidLogFilter) {
+		response.BadRequest(c, err.Error())
+		return
+	}
+	if siteID != "" {
+		if _, getErr := h.svc.Nginx.GetSite(siteID); getErr != nil {
+			response.NotFound(c, "Site not found")
+			return
+		}
+	}
+	response.InternalError(c, message+": "+err.Error())
+}
+
+// nginxLogFilter reads a log filter from the query: status (404, 4xx or 500-599), method
+// (comma separated), path (a regular expression), ip (an IP or CIDR), min_time
+// (seconds) and level. It reports whether a filter was given.
+func nginxLogFilter(c *gin.Context) (services.NginxLogFilter, bool, error) {
+	filter := services.NginxLogFilter{
+		Path:     c.Query("path"),
+		ClientIP: c.Query("ip"),
+		Level:    c.Query("level"),
+	}
+	for _, m := range strings.Split(c.Query("method"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			filter.Methods = append(filter.Methods, m)
+		}
+	}
+
+	if status := strings.ToLower(c.Query("status")); status != "" {
+		low, high, ranged := strings.Cut(status, "-")
+		if !ranged && len(status) == 3 && strings.HasSuffix(status, "xx") {
+			low, high = status[:1]+"00", status[:1]+"99"
+		} else if !ranged {
+			high = low
+		}
+		var err1, err2 error
+		filter.StatusMin, err1 = strconv.Atoi(low)
+		filter.StatusMax, err2 = strconv.Atoi(high)
+		if err1 != nil || err2 != nil {
+			return filter, false, errors.New("Invalid status filter")
+		}
+	}
+	if v := c.Query("min_time"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 {
+			return filter, false, errors.New("Invalid min_time filter")
+		}
+		filter.MinTime = t
+	}
+
+	filtered := filter.Path != "" || filter.ClientIP != "" || filter.Level != "" || len(filter.Methods) > 0 ||
+		filter.StatusMin != 0 || filter.MinTime != 0
+	return filter, filtered, nil
+}
+
+// Analytics returns access log analytics between from and to (RFC 3339), or over the last days
+func (h *NginxHandler) Analytics(c *gin.Context) {
+	siteID := c.Query("site_id")
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if days <= 0 {
+		days = 30
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -days)
+	var err error
+	if v := c.Query("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			response.BadRequest(c, "Invalid from time")
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			response.BadRequest(c, "Invalid to time")
+			return
+		}
+	}
+
+	analytics, err := h.svc.Nginx.GetAnalytics(siteID, from, to)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidAnalyticsRange) {
+			response.BadRequest(c, err.Error())
+			return
+		}
+		if siteID != "" {
+			if _, getErr := h.svc.Nginx.GetSite(siteID); getErr != nil {
+				response.NotFound(c, "Site not found")
+				return
+			}
+		}
+		response.InternalError(c, "Failed to get analytics: "+err.Error())
+		return
+	}
+	response.Success(c, analytics)
+}
+
+// ============================================
+// Database Handler
+// ============================================
+
+type DatabaseHandler struct {
+	svc *services.Container
+	log *logger.Logger
+}
+
+func (h *DatabaseHandler) ListServers(c *gin.Context) {
+	servers, err := h.svc.Database.ListServers()
+	if err != nil {
+		h.log.Error("Failed to list database servers", "error", err)
+		response.InternalError(c, "Failed to list database servers")
+		return
+	}
+	response.Success(c, servers)
+}
+
+func (h *DatabaseHandler) CreateServer(c *gin.Context) {
+	var req models.DatabaseServer
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	// Validate required fields
+	if req.Name == "" {
+		response.BadRequest(c, "Server name is required")
+		return
+	}
+	if req.Type == "" {
+		response.BadRequest(c, "Database type is required")
+		return
+	}
+	if req.Host == "" {
+		response.BadRequest(c, "Host is required")
+		return
+	}
+	if req.Port == 0 {
+		response.BadRequest(c, "Port is required")
+		return
+	}
+
+	if err := h.svc.Database.CreateServer(&req); err != nil {
+		h.log.Error("Failed to create database server", "error", err)
+		response.BadRequest(c, "Failed to create database server: "+err.Error())
+		return
+	}
+
+	response.Created(c, req)
+}
+
+func (h *DatabaseHandler) DeleteServer(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		response.BadRequest(c, "Server ID is required")
+		return
+	}
+
+	if err := h.svc.Database.DeleteServer(id); err != nil {
+		h.log.Error("Failed to delete database server", "id", id, "error", err)
+		response.InternalError(c, "Failed to delete database server")
+		return
+	}
+
+	response.NoContent(c)
+}
+
+func (h *DatabaseHandler) ListDatabases(c *gin.Context) {
+	serverID := c.Param("id")
+	if serverID == "" {
+		response.BadRequest(c, "Server ID is required")
+		return
+	}
+
+	databases, err := h.svc.Database.ListDatabases(serverID)
+	if err != nil {
+		h.log.Error("Failed to list databases", "server_id", serverID, "error", err)
+		response.InternalError(c, "Failed to list databases")
+		return
+	}
+	response.Success(c, databases)
+}
+
+func (h *DatabaseHandler) CreateDatabase(c *gin.Context) {
+	response.Success(c, nil) // TODO: Implement
+}
+
+func (h *DatabaseHandler) DeleteDatabase(c *gin.Context) {
+	response.Success(c, nil) // TODO: Implement
+}
+
+func (h *DatabaseHandler) ListUsers(c *gin.Context) {
+	response.Success(c, []interface{}{}) // TODO: Implement
+}
+
+func (h *DatabaseHandler) CreateUser(c *gin.Context) {
+	response.Success(c, nil) // TODO: Implement
+}
+
+func (h *DatabaseHandler) DeleteUser(c *gin.Context) {
+	response.Success(c, nil) // TODO: Implement
+}
+
+func (h *DatabaseHandler) Backup(c *gin.Context) {
+	serverID := c.Param("id")
+	if serverID == "" {
+		response.BadRequest(c, "Server ID is required")
+		return
+	}
+
+	var req struct {
+		Database string `json:"database"`
+		Type     string `json:"type"` // manual, scheduled
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if req.Database == "" {
+		req.Database = "all"
+	}
+	if req.Type == "" {
+		req.Type = "manual"
+	}
+
+	backup, err := h.svc.Database.CreateBackup(serverID, req.Database, req.Type)
+	if err != nil {
+		h.log.Error("Failed to create backup", "server_id", serverID, "error", err)
+		response.BadRequest(c, "Failed to create backup: "+err.Error())
+		return
+	}
+
+	response.Created(c, backup)
+}
+
+func (h *DatabaseHandler) Restore(c *gin.Context) {
+	serverID := c.Param("id")
+	if serverID == "" {
+		response.BadRequest(c, "Server ID is required")
+		return
+	}
+
+	var req struct {
+		BackupID       string `json:"backup_id"`
+		TargetDatabase string `json:"target_database"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if req.BackupID == "" {
+		response.BadRequest(c, "Backup ID is required")
+		return
+	}
+	if req.TargetDatabase == "" {
+		response.BadRequest(c, "Target database is required")
+		return
+	}
+
+	if err := h.svc.Database.RestoreBackup(req.BackupID, serverID, req.TargetDatabase); err != nil {
+		h.log.Error("Failed to restore backup", "backup_id", req.BackupID, "error", err)
+		response.BadRequest(c, "Failed to restore backup: "+err.Error())
+		return
+	}
+
+	response.Success(c, gin.H{"message": "Restore started"})
+}
+
+func (h *DatabaseHandler) ListBackups(c *gin.Context) {
+	serverID := c.Query("server_id")
+
+	backups, err := h.svc.Database.ListBackups(serverID)
+	if err != nil {
+		h.log.Error("Failed to list backups", "error", err)
+		response.InternalError(c, "Failed to list backups")
+		return
+	}
+	response.Success(c, backups)
+}
+
+func (h *DatabaseHandler) GetBackup(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		response.BadRequest(c, "Backup ID is required")
+		return
+	}
+
+	backup, err := h.svc.Database.GetBackup(id)
+	if err != nil {
+		h.log.Error("Failed to get backup", "id", id, "error", err)
+		response.NotFound(c, "Backup not found")
+		return
+	}
+	response.Success(c, backup)
+}
+
+func (h *DatabaseHandler) DeleteBackup(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		response.BadRequest(c, "Backup ID is required")
+		return
+	}
+
+	if err := h.svc.Database.DeleteBackup(id); err != nil {
+		h.log.Error("Failed to delete backup", "id", id, "error", err)
+		response.InternalError(c, "Failed to delete backup")
+		return
+	}
+
+	response.NoContent(c)
+}
+
+// ============================================
+// File Handler
+// ============================================
+
+type FileHandler struct {
+	svc *services.Container
+	log *logger.Logger
+}
+
+// fileService returns the file service restricted to the jail of the requesting user
+func (h *FileHandler) fileService(c *gin.Context) (*services.FileService, bool) {
+	fs, err := h.svc.File.ForUser(c.GetString("user_id"), c.GetString("username"), c.GetString("user_role"))
+	if err != nil {
+		h.fileError(c, "Failed to access files", err)
+		return nil, false
+	}
+	return fs, true
+}
+
+// Roots returns the directories the requesting user can access
+func (h *FileHandler) Roots(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+	response.Success(c, fs.Roots())
+}
+
+func (h *FileHandler) ListJails(c *gin.Context) {
+	jails, err := h.svc.File.ListJails()
+	if err != nil {
+		h.fileError(c, "Failed to list jails", err)
+		return
+	}
+	response.Success(c, jails)
+}
+
+func (h *FileHandler) CreateJail(c *gin.Context) {
+	var jail models.FileJail
+	if err := c.ShouldBindJSON(&jail); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.File.CreateJail(&jail); err != nil {
+		h.fileError(c, "Failed to create jail", err)
+		return
+	}
+	response.Created(c, jail)
+}
+
+func (h *FileHandler) UpdateJail(c *gin.Context) {
+	var jail models.FileJail
+	if err := c.ShouldBindJSON(&jail); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := h.svc.File.UpdateJail(c.Param("id"), &jail); err != nil {
+		h.fileError(c, "Failed to update jail", err)
+		return
+	}
+	response.Success(c, jail)
+}
+
+func (h *FileHandler) DeleteJail(c *gin.Context) {
+	if err := h.svc.File.DeleteJail(c.Param("id")); err != nil {
+		h.fileError(c, "Failed to delete jail", err)
+		return
+	}
+	response.NoContent(c)
+}
+
+func (h *FileHandler) List(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	path := c.DefaultQuery("path", fs.Roots()[0].Path)
+	files, err := fs.ListDir(path)
+	if err != nil {
+		h.fileError(c, "Failed to list directory", err)
+		return
+	}
+	response.Success(c, gin.H{
+		"path":  path,
+		"files": files,
+	})
+}
+
+func (h *FileHandler) Read(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+
+	content, err := fs.ReadFile(path)
+	if err != nil {
+		h.fileError(c, "Failed to read file", err)
+		return
+	}
+	info, err := fs.GetFileInfo(path)
+	if err != nil {
+		h.fileError(c, "Failed to read file", err)
+		return
+	}
+
+	// Sent back as If-Match or If-Unmodified-Since when the file is saved
+	etag := services.FileETag(content)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	response.Success(c, gin.H{
+		"path":     path,
+		"content":  string(content),
+		"etag":     etag,
+		"mod_time": info.ModTime,
+	})
+}
+
+// View returns a page of the lines of a file of any size: from the line the offset is
+// in, from a line, or before an offset or the end of the file with end=true. Compressed
+// files, e.g. rotated logs, are decompressed.
+func (h *FileHandler) View(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+
+	// Finding a line may read a large file
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
+	line, _ := strconv.Atoi(c.Query("line"))
+	before, _ := strconv.ParseInt(c.Query("before"), 10, 64)
+	if c.Query("end") == "true" {
+		before = -1
+	}
+	lines, _ := strconv.Atoi(c.Query("lines"))
+
+	page, err := fs.ViewFile(c.Request.Context(), services.FileViewQuery{
+		Path:   path,
+		Offset: offset,
+		Line:   line,
+		Before: before,
+		Lines:  lines,
+	})
+	if err != nil {
+		h.fileError(c, "Failed to view file", err)
+		return
+	}
+	response.Success(c, page)
+}
+
+// ViewSearch returns the lines of a file matching a pattern from an offset, a search of
+// a large file goes on from the next offset it returns
+func (h *FileHandler) ViewSearch(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	offset, _ := strconv.ParseInt(c.Query("offset"), 10, 64)
+	maxResults, _ := strconv.Atoi(c.Query("max_results"))
+	matches, err := fs.SearchFile(c.Request.Context(), services.FileViewSearch{
+		Path:       path,
+		Pattern:    c.Query("pattern"),
+		Literal:    c.Query("literal") == "true",
+		IgnoreCase: c.Query("ignore_case") == "true",
+		Offset:     offset,
+		MaxResults: maxResults,
+	})
+	if err != nil {
+		h.fileError(c, "Failed to search file", err)
+		return
+	}
+	response.Success(c, matches)
+}
+
+// Follow sends the lines appended to a file over a WebSocket like tail -F, as JSON
+// events that also tell when the file is truncated, rotated or removed. Following starts
+// at the offset, or after the last lines of the file when there is none.
+func (h *FileHandler) Follow(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+	offset, err := strconv.ParseInt(c.DefaultQuery("offset", "-1"), 10, 64)
+	if err != nil {
+		response.BadRequest(c, "Invalid offset")
+		return
+	}
+	lines, _ := strconv.Atoi(c.DefaultQuery("lines", "10"))
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	// Errors are answered before the connection is upgraded
+	events, err := fs.FollowFile(ctx, path, offset, lines)
+	if err != nil {
+		h.fileError(c, "Failed to follow file", err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		h.log.Error("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Nothing is read from the client but its close
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *FileHandler) Write(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Path    string `json:"path" binding:"required"`
+		Content string `json:"content"`
+		ETag    string `json:"etag"` // the If-Match header takes precedence
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+	cond, ok := filePrecondition(c, req.ETag)
+	if !ok {
+		return
+	}
+
+	etag, err := fs.WriteFile(req.Path, []byte(req.Content), cond)
+	if err != nil {
+		h.fileError(c, "Failed to write file", err)
+		return
+	}
+	c.Header("ETag", etag)
+	response.Success(c, gin.H{"etag": etag})
+}
+
+func (h *FileHandler) ListVersions(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	path := c.Query("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+
+	versions, err := fs.ListVersions(path)
+	if err != nil {
+		h.fileError(c, "Failed to list versions", err)
+		return
+	}
+	response.Success(c, versions)
+}
+
+func (h *FileHandler) GetVersion(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	version, content, err := fs.GetVersion(c.Param("id"))
+	if err != nil {
+		h.fileError(c, "Failed to get version", err)
+		return
+	}
+	response.Success(c, gin.H{
+		"version": version,
+		"content": string(content),
+	})
+}
+
+// DiffVersions compares a version with another one, or with the file on disk when no
+// "to" version is given
+func (h *FileHandler) DiffVersions(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	result, err := fs.DiffVersions(c.Param("id"), c.Query("to"))
+	if err != nil {
+		h.fileError(c, "Failed to diff versions", err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func (h *FileHandler) RestoreVersion(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ETag string `json:"etag"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.BadRequest(c, "Invalid request data")
+			return
+		}
+	}
+	cond, ok := filePrecondition(c, req.ETag)
+	if !ok {
+		return
+	}
+
+	etag, err := fs.RestoreVersion(c.Param("id"), cond)
+	if err != nil {
+		h.fileError(c, "Failed to restore version", err)
+		return
+	}
+	c.Header("ETag", etag)
+	response.Success(c, gin.H{"etag": etag})
+}
+
+// filePrecondition reads If-Match and If-Unmodified-Since, etag is the If-Match of
+// clients that cannot set headers
+func filePrecondition(c *gin.Context, etag string) (services.FilePrecondition, bool) {
+	cond := services.FilePrecondition{IfMatch: c.GetHeader("If-Match")}
+	if cond.IfMatch == "" {
+		cond.IfMatch = etag
+	}
+	if since := c.GetHeader("If-Unmodified-Since"); since != "" {
+		t, err := http.ParseTime(since)
+		if err != nil {
+			response.BadRequest(c, "Invalid If-Unmodified-Since header")
+			return cond, false
+		}
+		cond.IfUnmodifiedSince = t
+	}
+	return cond, true
+}
+
+func (h *FileHandler) Mkdir(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Path string `json:"path" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := fs.CreateDir(req.Path); err != nil {
+		h.fileError(c, "Failed to create directory", err)
+		return
+	}
+	response.Success(c, nil)
+}
+
+func (h *FileHandler) Rename(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		OldPath string `json:"old_path" binding:"required"`
+		NewPath string `json:"new_path" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	if err := fs.Rename(req.OldPath, req.NewPath); err != nil {
+		h.fileError(c, "Failed to rename", err)
+		return
+	}
+	response.Success(c, nil)
+}
+
+func (h *FileHandler) Copy(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Source      string `json:"source" binding:"required"`
+		Destination string `json:"destination" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	// Copies from or to a remote location may take a while
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	if err := fs.Copy(req.Source, req.Destination); err != nil {
+		h.fileError(c, "Failed to copy", err)
+		return
+	}
+	response.Success(c, nil)
+}
+
+func (h *FileHandler) Move(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Source      string `json:"source" binding:"required"`
+		Destination string `json:"destination" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	if err := fs.Rename(req.Source, req.Destination); err != nil {
+		h.fileError(c, "Failed to move", err)
+		return
+	}
+	response.Success(c, nil)
+}
+
+func (h *FileHandler) Delete(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	// Support both DELETE with query param and POST with body
+	path := c.Query("path")
+	permanent := c.Query("permanent") == "true"
+	if path == "" {
+		var req struct {
+			Path      string `json:"path" binding:"required"`
+			Permanent bool   `json:"permanent"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.BadRequest(c, "Path is required")
+			return
+		}
+		path = req.Path
+		permanent = permanent || req.Permanent
+	}
+
+	if path == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+
+	// Deleted files go to the trash unless asked otherwise, remote locations have none
+	if permanent || services.IsRemotePath(path) {
+		if err := fs.Delete(path); err != nil {
+			h.fileError(c, "Failed to delete", err)
+			return
+		}
+		response.Success(c, nil)
+		return
+	}
+	item, err := fs.Trash(path)
+	if err != nil {
+		h.fileError(c, "Failed to delete", err)
+		return
+	}
+	response.Success(c, item)
+}
+
+func (h *FileHandler) ListTrash(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	items, err := fs.ListTrash()
+	if err != nil {
+		h.fileError(c, "Failed to list trash", err)
+		return
+	}
+	response.Success(c, items)
+}
+
+func (h *FileHandler) RestoreTrash(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	// Both fields are optional, the item goes back where it was and an existing file fails
+	var req struct {
+		Path     string `json:"path"`
+		Conflict string `json:"conflict"` // fail, rename or overwrite
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			response.BadRequest(c, "Invalid request data")
+			return
+		}
+	}
+
+	path, err := fs.RestoreTrash(c.Param("id"), req.Path, req.Conflict)
+	if err != nil {
+		h.fileError(c, "Failed to restore", err)
+		return
+	}
+	response.Success(c, gin.H{"path": path})
+}
+
+func (h *FileHandler) PurgeTrash(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	if err := fs.PurgeTrash(c.Param("id")); err != nil {
+		h.fileError(c, "Failed to purge", err)
+		return
+	}
+	response.NoContent(c)
+}
+
+func (h *FileHandler) EmptyTrash(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	purged, err := fs.EmptyTrash()
+	if err != nil {
+		h.fileError(c, "Failed to empty trash", err)
+		return
+	}
+	response.Success(c, gin.H{"purged": purged})
+}
+
+func (h *FileHandler) Upload(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
-	if req.Port == 0 {
-		response.BadRequest(c, "Port is required")
+
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		response.BadRequest(c, "No file uploaded")
 		return
 	}
 
-	if err := h.svc.Database.CreateServer(&req); err != nil {
-		h.log.Error("Failed to create database server", "error", err)
-		response.BadRequest(c, "Failed to create database server: "+err.Error())
+	path := c.PostForm("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
 		return
 	}
 
-	response.Created(c, req)
+	// Open uploaded file
+	src, err := file.Open()
+	if err != nil {
+		response.InternalError(c, "Failed to open uploaded file")
+		return
+	}
+	defer src.Close()
+
+	// Write to destination
+	destPath := path
+	if !strings.HasSuffix(destPath, "/") {
+		destPath = destPath + "/"
+	}
+	destPath = destPath + filepath.Base(file.Filename)
+
+	if err := fs.SaveFile(destPath, src); err != nil {
+		h.fileError(c, "Failed to save file", err)
+		return
+	}
+
+	response.Success(c, gin.H{"message": "File uploaded successfully"})
 }
 
-func (h *DatabaseHandler) DeleteServer(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
-		response.BadRequest(c, "Server ID is required")
+// CreateUpload starts a resumable upload, the chunks are sent with UploadChunk
+func (h *FileHandler) CreateUpload(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	if err := h.svc.Database.DeleteServer(id); err != nil {
-		h.log.Error("Failed to delete database server", "id", id, "error", err)
-		response.InternalError(c, "Failed to delete database server")
+	var req struct {
+		Path      string `json:"path" binding:"required"`
+		Size      int64  `json:"size"`
+		Checksum  string `json:"checksum"` // sha256 hex of the whole file
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
 		return
 	}
 
-	response.NoContent(c)
+	userID, _ := c.Get("user_id")
+	uid, _ := userID.(string)
+	upload, err := fs.CreateUpload(uid, req.Path, req.Size, req.Checksum, req.Overwrite)
+	if err != nil {
+		h.fileError(c, "Failed to create upload", err)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	response.Created(c, upload)
 }
 
-func (h *DatabaseHandler) ListDatabases(c *gin.Context) {
-	serverID := c.Param("id")
-	if serverID == "" {
-		response.BadRequest(c, "Server ID is required")
+func (h *FileHandler) ListUploads(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	databases, err := h.svc.Database.ListDatabases(serverID)
+	userID, _ := c.Get("user_id")
+	uid, _ := userID.(string)
+	uploads, err := fs.ListUploads(uid)
 	if err != nil {
-		h.log.Error("Failed to list databases", "server_id", serverID, "error", err)
-		response.InternalError(c, "Failed to list databases")
+		h.fileError(c, "Failed to list uploads", err)
 		return
 	}
-	response.Success(c, databases)
+	response.Success(c, uploads)
 }
 
-func (h *DatabaseHandler) CreateDatabase(c *gin.Context) {
-	response.Success(c, nil) // TODO: Implement
-}
+// GetUpload returns an upload with its offset, also in the Upload-Offset header
+func (h *FileHandler) GetUpload(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
 
-func (h *DatabaseHandler) DeleteDatabase(c *gin.Context) {
-	response.Success(c, nil) // TODO: Implement
+	upload, err := fs.GetUpload(c.Param("id"))
+	if err != nil {
+		h.fileError(c, "Failed to get upload", err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	response.Success(c, upload)
 }
 
-func (h *DatabaseHandler) ListUsers(c *gin.Context) {
-	response.Success(c, []interface{}{}) // TODO: Implement
-}
+// UploadChunk appends the request body to an upload. The Upload-Offset header (or the
+// offset query) must match the bytes received so far, Upload-Checksum optionally
+// carries "<md5|sha1|sha256> <base64 digest>" of the chunk.
+func (h *FileHandler) UploadChunk(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
 
-func (h *DatabaseHandler) CreateUser(c *gin.Context) {
-	response.Success(c, nil) // TODO: Implement
+	http.NewResponseController(c.Writer).SetReadDeadline(time.Time{})
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	offsetValue := c.GetHeader("Upload-Offset")
+	if offsetValue == "" {
+		offsetValue = c.Query("offset")
+	}
+	offset, err := strconv.ParseInt(offsetValue, 10, 64)
+	if err != nil || offset < 0 {
+		response.BadRequest(c, "Invalid upload offset")
+		return
+	}
+
+	upload, err := fs.WriteUploadChunk(c.Param("id"), offset, c.Request.Body, c.GetHeader("Upload-Checksum"))
+	if upload != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	}
+	if err != nil {
+		h.fileError(c, "Failed to write upload", err)
+		return
+	}
+	response.Success(c, gin.H{
+		"upload":    upload,
+		"completed": upload.Offset == upload.Size,
+	})
 }
 
-func (h *DatabaseHandler) DeleteUser(c *gin.Context) {
-	response.Success(c, nil) // TODO: Implement
+func (h *FileHandler) CancelUpload(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	if err := fs.CancelUpload(c.Param("id")); err != nil {
+		h.fileError(c, "Failed to cancel upload", err)
+		return
+	}
+	response.NoContent(c)
 }
 
-func (h *DatabaseHandler) Backup(c *gin.Context) {
-	serverID := c.Param("id")
-	if serverID == "" {
-		response.BadRequest(c, "Server ID is required")
+// Download streams a file with Range support. Directories, and several paths, are
+// streamed as a zip or tar.gz archive built on the fly.
+func (h *FileHandler) Download(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	paths := c.QueryArray("path")
+	if len(paths) == 0 || paths[0] == "" {
+		response.BadRequest(c, "Path is required")
+		return
+	}
+
+	if len(paths) == 1 {
+		file, info, err := fs.OpenFile(paths[0])
+		if err == nil {
+			defer file.Close()
+			c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+			c.Header("Content-Type", "application/octet-stream")
+			// Large files take longer than the server's write timeout
+			http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+			http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
+			return
+		}
+		if !errors.Is(err, services.ErrIsDirectory) {
+			h.fileError(c, "Failed to read file", err)
+			return
+		}
+	}
+
+	format := c.DefaultQuery("format", "zip")
+	var contentType, ext string
+	switch format {
+	case "zip":
+		contentType, ext = "application/zip", ".zip"
+	case "tar":
+		contentType, ext = "application/x-tar", ".tar"
+	case "tar.gz", "tgz":
+		contentType, ext = "application/gzip", ".tar.gz"
+	case "tar.bz2", "tbz2":
+		contentType, ext = "application/x-bzip2", ".tar.bz2"
+	case "tar.xz", "txz":
+		contentType, ext = "application/x-xz", ".tar.xz"
+	case "tar.zst", "tzst":
+		contentType, ext = "application/zstd", ".tar.zst"
+	default:
+		response.BadRequest(c, "Unsupported archive format")
+		return
+	}
+	name := "download"
+	if len(paths) == 1 {
+		name = filepath.Base(filepath.Clean(paths[0]))
+	}
+
+	// Archives are written as they are read, check the paths before the headers go out
+	for _, path := range paths {
+		if services.IsRemotePath(path) {
+			h.fileError(c, "Failed to read "+path, services.ErrRemoteUnsupported)
+			return
+		}
+		if _, err := fs.GetFileInfo(path); err != nil {
+			h.fileError(c, "Failed to read "+path, err)
+			return
+		}
+	}
+
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	c.Header("Content-Type", contentType)
+	c.Status(http.StatusOK)
+	if err := fs.WriteArchive(c.Request.Context(), c.Writer, paths, format); err != nil {
+		// The response has started, the client sees a truncated archive
+		h.log.Warn("Failed to stream archive", "paths", paths, "error", err)
+	}
+}
+
+// fileError responds to a failed file operation with the status of its error
+func (h *FileHandler) fileError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, services.ErrPathNotAllowed), errors.Is(err, services.ErrPathReadOnly):
+		response.Forbidden(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrUploadNotFound), errors.Is(err, services.ErrFileJailNotFound),
+		errors.Is(err, services.ErrTrashNotFound), errors.Is(err, services.ErrFileVersionNotFound),
+		errors.Is(err, services.ErrFileIndexNotFound), errors.Is(err, services.ErrFileJobNotFound),
+		errors.Is(err, services.ErrShareNotFound), errors.Is(err, services.ErrFileLocationNotFound),
+		errors.Is(err, os.ErrNotExist):
+		response.NotFound(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrFileExists), errors.Is(err, services.ErrUploadBusy),
+		errors.Is(err, services.ErrUploadOffset):
+		response.Conflict(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrFileChanged):
+		response.PreconditionFailed(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrInvalidUpload), errors.Is(err, services.ErrUploadTooLarge),
+		errors.Is(err, services.ErrInvalidFileJail), errors.Is(err, services.ErrTrashTooLarge),
+		errors.Is(err, services.ErrInvalidTrashRestore), errors.Is(err, services.ErrFileNotText),
+		errors.Is(err, services.ErrFilesTooDifferent), errors.Is(err, services.ErrInvalidPermissions), errors.Is(err, services.ErrACLUnsupported),
+		errors.Is(err, services.ErrInvalidSearch),
+		errors.Is(err, services.ErrChecksumMismatch), errors.Is(err, services.ErrIsDirectory),
+		errors.Is(err, services.ErrUnsupportedFormat), errors.Is(err, services.ErrArchivePassword),
+		errors.Is(err, services.ErrArchiveLimit), errors.Is(err, services.ErrInvalidShare),
+		errors.Is(err, services.ErrInvalidFileLocation), errors.Is(err, services.ErrRemoteUnsupported),
+		errors.Is(err, services.ErrInvalidTransfer), errors.Is(err, services.ErrInvalidFileView):
+		response.BadRequest(c, message+": "+err.Error())
+	default:
+		response.InternalError(c, message+": "+err.Error())
+	}
+}
+
+// Compress starts compressing files into an archive in the background
+func (h *FileHandler) Compress(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
 	var req struct {
-		Database string `json:"database"`
-		Type     string `json:"type"` // manual, scheduled
+		Paths      []string `json:"paths" binding:"required"`
+		DestPath   string   `json:"dest_path" binding:"required"`
+		Format     string   `json:"format"`
+		Password   string   `json:"password"`
+		Encryption string   `json:"encryption"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		response.BadRequest(c, "Invalid request data")
 		return
 	}
 
-	if req.Database == "" {
-		req.Database = "all"
+	job, err := fs.Compress(req.Paths, req.DestPath, services.ArchiveOptions{
+		Format:     req.Format,
+		Password:   req.Password,
+		Encryption: req.Encryption,
+	})
+	if err != nil {
+		h.fileError(c, "Failed to compress", err)
+		return
 	}
-	if req.Type == "" {
-		req.Type = "manual"
+	response.Success(c, job)
+}
+
+// Decompress starts extracting an archive in the background
+func (h *FileHandler) Decompress(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
 	}
 
-	backup, err := h.svc.Database.CreateBackup(serverID, req.Database, req.Type)
-	if err != nil {
-		h.log.Error("Failed to create backup", "server_id", serverID, "error", err)
-		response.BadRequest(c, "Failed to create backup: "+err.Error())
+	var req struct {
+		ArchivePath string `json:"archive_path" binding:"required"`
+		DestPath    string `json:"dest_path" binding:"required"`
+		Password    string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
 		return
 	}
 
-	response.Created(c, backup)
+	job, err := fs.Decompress(req.ArchivePath, req.DestPath, req.Password)
+	if err != nil {
+		h.fileError(c, "Failed to decompress", err)
+		return
+	}
+	response.Success(c, job)
 }
 
-func (h *DatabaseHandler) Restore(c *gin.Context) {
-	serverID := c.Param("id")
-	if serverID == "" {
-		response.BadRequest(c, "Server ID is required")
+// Transfer starts copying or moving files into a directory in the background, across
+// locations too
+func (h *FileHandler) Transfer(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
 	var req struct {
-		BackupID       string `json:"backup_id"`
-		TargetDatabase string `json:"target_database"`
+		Sources     []string `json:"sources" binding:"required"`
+		Destination string   `json:"destination" binding:"required"`
+		Move        bool     `json:"move"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		response.BadRequest(c, "Invalid request data")
 		return
 	}
 
-	if req.BackupID == "" {
-		response.BadRequest(c, "Backup ID is required")
+	job, err := fs.Transfer(req.Sources, req.Destination, req.Move)
+	if err != nil {
+		h.fileError(c, "Failed to transfer", err)
 		return
 	}
-	if req.TargetDatabase == "" {
-		response.BadRequest(c, "Target database is required")
+	response.Success(c, job)
+}
+
+// ListJobs returns the archive and transfer jobs of the current user
+func (h *FileHandler) ListJobs(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
+	response.Success(c, fs.ListJobs())
+}
 
-	if err := h.svc.Database.RestoreBackup(req.BackupID, serverID, req.TargetDatabase); err != nil {
-		h.log.Error("Failed to restore backup", "backup_id", req.BackupID, "error", err)
-		response.BadRequest(c, "Failed to restore backup: "+err.Error())
+// GetJob returns the progress of an archive or transfer job
+func (h *FileHandler) GetJob(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	response.Success(c, gin.H{"message": "Restore started"})
+	job, err := fs.GetJob(c.Param("id"))
+	if err != nil {
+		h.fileError(c, "Failed to get job", err)
+		return
+	}
+	response.Success(c, job)
 }
 
-func (h *DatabaseHandler) ListBackups(c *gin.Context) {
-	serverID := c.Query("server_id")
+// CancelJob stops an archive or transfer job
+func (h *FileHandler) CancelJob(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
 
-	backups, err := h.svc.Database.ListBackups(serverID)
+	job, err := fs.CancelJob(c.Param("id"))
 	if err != nil {
-		h.log.Error("Failed to list backups", "error", err)
-		response.InternalError(c, "Failed to list backups")
+		h.fileError(c, "Failed to cancel job", err)
 		return
 	}
-	response.Success(c, backups)
+	response.Success(c, job)
 }
 
-func (h *DatabaseHandler) GetBackup(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
-		response.BadRequest(c, "Backup ID is required")
+// ListLocations returns the remote locations the user can browse, paths on them are
+// written as "<name>:/<path>"
+func (h *FileHandler) ListLocations(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	backup, err := h.svc.Database.GetBackup(id)
+	locations, err := fs.ListLocations()
 	if err != nil {
-		h.log.Error("Failed to get backup", "id", id, "error", err)
-		response.NotFound(c, "Backup not found")
+		h.fileError(c, "Failed to list locations", err)
 		return
 	}
-	response.Success(c, backup)
+	response.Success(c, locations)
 }
 
-func (h *DatabaseHandler) DeleteBackup(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
-		response.BadRequest(c, "Backup ID is required")
+func (h *FileHandler) CreateLocation(c *gin.Context) {
+	var req services.FileLocationOptions
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
 		return
 	}
 
-	if err := h.svc.Database.DeleteBackup(id); err != nil {
-		h.log.Error("Failed to delete backup", "id", id, "error", err)
-		response.InternalError(c, "Failed to delete backup")
+	location, err := h.svc.File.CreateLocation(req)
+	if err != nil {
+		h.fileError(c, "Failed to create location", err)
+		return
+	}
+	response.Created(c, location)
+}
+
+func (h *FileHandler) UpdateLocation(c *gin.Context) {
+	var req services.FileLocationOptions
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	location, err := h.svc.File.UpdateLocation(c.Param("id"), req)
+	if err != nil {
+		h.fileError(c, "Failed to update location", err)
 		return
 	}
+	response.Success(c, location)
+}
 
+func (h *FileHandler) DeleteLocation(c *gin.Context) {
+	if err := h.svc.File.DeleteLocation(c.Param("id")); err != nil {
+		h.fileError(c, "Failed to delete location", err)
+		return
+	}
 	response.NoContent(c)
 }
 
-// ============================================
-// File Handler
-// ============================================
+// ListShares returns the public share links of the files the user can access
+func (h *FileHandler) ListShares(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
 
-type FileHandler struct {
-	svc *services.Container
-	log *logger.Logger
+	shares, err := fs.ListShares()
+	if err != nil {
+		h.fileError(c, "Failed to list shares", err)
+		return
+	}
+	response.Success(c, shares)
 }
 
-func (h *FileHandler) List(c *gin.Context) {
-	path := c.DefaultQuery("path", "/")
-	files, err := h.svc.File.ListDir(path)
+// CreateShare creates a public share link for a file or directory
+func (h *FileHandler) CreateShare(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	var req services.ShareOptions
+	if err := c.ShouldBindJSON(&req); err != nil || req.Path == "" {
+		response.BadRequest(c, "Invalid request data")
+		return
+	}
+
+	share, err := fs.CreateShare(req)
 	if err != nil {
-		response.InternalError(c, "Failed to list directory: "+err.Error())
+		h.fileError(c, "Failed to create share", err)
 		return
 	}
-	response.Success(c, gin.H{
-		"path":  path,
-		"files": files,
+	c.Set("audit_resource", "file_share")
+	c.Set("audit_resource_id", share.ID)
+	c.Set("audit_details", map[string]interface{}{
+		"share_path":    share.Path,
+		"upload":        share.Upload,
+		"protected":     share.Protected,
+		"expires_at":    share.ExpiresAt,
+		"max_downloads": share.MaxDownloads,
 	})
+	response.Created(c, share)
 }
 
-func (h *FileHandler) Read(c *gin.Context) {
-	path := c.Query("path")
-	if path == "" {
-		response.BadRequest(c, "Path is required")
+// DeleteShare revokes a public share link
+func (h *FileHandler) DeleteShare(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
+	c.Set("audit_resource", "file_share")
+	c.Set("audit_resource_id", c.Param("id"))
+	if err := fs.DeleteShare(c.Param("id")); err != nil {
+		h.fileError(c, "Failed to delete share", err)
+		return
+	}
+	response.Success(c, gin.H{"message": "Share deleted"})
+}
+
+// ShareInfo describes a share link to a visitor, with the entries of a shared directory
+// at path. It needs no account.
+func (h *FileHandler) ShareInfo(c *gin.Context) {
+	share, fs, ok := h.openShare(c, "share_view")
+	if !ok {
+		return
+	}
+
+	info := gin.H{
+		"name":          filepath.Base(share.Path),
+		"is_dir":        share.IsDir,
+		"upload":        share.Upload,
+		"expires_at":    share.ExpiresAt,
+		"max_downloads": share.MaxDownloads,
+		"downloads":     share.Downloads,
+	}
+	if share.Upload {
+		info["max_upload"] = fs.ShareMaxUpload()
+	} else if share.IsDir {
+		entries, err := fs.ListShareDir(share, c.Query("path"))
+		if err != nil {
+			h.shareError(c, "Failed to list share", err)
+			return
+		}
+		info["entries"] = entries
+	} else if _, file, err := fs.ShareFile(share, ""); err == nil {
+		info["size"] = file.Size()
+		info["mod_time"] = file.ModTime()
+	}
+	h.auditShare(c, share, "share_view", "success", map[string]interface{}{"file": c.Query("path")})
+	response.Success(c, info)
+}
+
+// ShareDownload sends a shared file, or a file below a shared directory at path, with
+// Range support. Directories are sent as zip archives. Every GET counts against the
+// limit of the link, except a Range request resuming a counted download of the file with
+// the ticket cookie set then. HEAD sends no content and is not counted.
+func (h *FileHandler) ShareDownload(c *gin.Context) {
+	share, fs, ok := h.openShare(c, "share_download")
+	if !ok {
 		return
 	}
 
-	content, err := h.svc.File.ReadFile(path)
+	fullPath, info, err := fs.ShareFile(share, c.Query("path"))
 	if err != nil {
-		response.InternalError(c, "Failed to read file: "+err.Error())
+		h.auditShare(c, share, "share_download", "failed", map[string]interface{}{"file": c.Query("path"), "error": err.Error()})
+		h.shareError(c, "Failed to download", err)
 		return
 	}
-	response.Success(c, gin.H{
-		"path":    path,
-		"content": string(content),
-	})
-}
 
-func (h *FileHandler) Write(c *gin.Context) {
-	var req struct {
-		Path    string `json:"path" binding:"required"`
-		Content string `json:"content"`
+	rangeHeader := c.GetHeader("Range")
+	ticket, _ := c.Cookie(shareDownloadCookie)
+	resumed := rangeHeader != "" && !info.IsDir() && fs.CheckShareTicket(share, services.ShareTicketDownload, fullPath, ticket)
+	if c.Request.Method == http.MethodGet && !resumed {
+		if err := fs.CountShareDownload(share); err != nil {
+			h.auditShare(c, share, "share_download", "failed", map[string]interface{}{"file": fullPath, "error": err.Error()})
+			h.shareError(c, "Failed to download", err)
+			return
+		}
+		h.auditShare(c, share, "share_download", "success", map[string]interface{}{"file": fullPath, "range": rangeHeader})
+		ticket, expires := fs.ShareTicket(share, services.ShareTicketDownload, fullPath)
+		h.setShareCookie(c, shareDownloadCookie, ticket, c.Request.URL.Path, expires)
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+
+	if info.IsDir() {
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name() + ".zip"}))
+		c.Header("Content-Type", "application/zip")
+		c.Status(http.StatusOK)
+		if c.Request.Method == http.MethodHead {
+			return
+		}
+		if err := fs.WriteArchive(c.Request.Context(), c.Writer, []string{fullPath}, "zip"); err != nil {
+			h.log.Warn("Failed to stream shared archive", "path", fullPath, "error", err)
+		}
 		return
 	}
 
-	if err := h.svc.File.WriteFile(req.Path, []byte(req.Content)); err != nil {
-		response.InternalError(c, "Failed to write file: "+err.Error())
+	file, err := os.Open(fullPath)
+	if err != nil {
+		h.shareError(c, "Failed to download", err)
 		return
 	}
-	response.Success(c, nil)
+	defer file.Close()
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	c.Header("Content-Type", "application/octet-stream")
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), file)
 }
 
-func (h *FileHandler) Mkdir(c *gin.Context) {
-	var req struct {
-		Path string `json:"path" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+// ShareUpload takes a file a visitor drops into an upload share
+func (h *FileHandler) ShareUpload(c *gin.Context) {
+	share, fs, ok := h.openShare(c, "share_upload")
+	if !ok {
 		return
 	}
 
-	if err := h.svc.File.CreateDir(req.Path); err != nil {
-		response.InternalError(c, "Failed to create directory: "+err.Error())
+	http.NewResponseController(c.Writer).SetReadDeadline(time.Time{})
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	max := fs.ShareMaxUpload()
+	if max > 0 {
+		// Room for the multipart framing around the file
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max+1024*1024)
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		response.BadRequest(c, "No file uploaded, or it is too large")
 		return
 	}
-	response.Success(c, nil)
-}
-
-func (h *FileHandler) Rename(c *gin.Context) {
-	var req struct {
-		OldPath string `json:"old_path" binding:"required"`
-		NewPath string `json:"new_path" binding:"required"`
+	if max > 0 && file.Size > max {
+		response.BadRequest(c, fmt.Sprintf("The file is larger than %d MB", max/1024/1024))
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+	src, err := file.Open()
+	if err != nil {
+		response.InternalError(c, "Failed to open uploaded file")
 		return
 	}
+	defer src.Close()
 
-	if err := h.svc.File.Rename(req.OldPath, req.NewPath); err != nil {
-		response.InternalError(c, "Failed to rename: "+err.Error())
+	name, err := fs.ShareUpload(share, file.Filename, src)
+	if err != nil {
+		h.auditShare(c, share, "share_upload", "failed", map[string]interface{}{"file": file.Filename, "error": err.Error()})
+		h.shareError(c, "Failed to upload", err)
 		return
 	}
-	response.Success(c, nil)
+	h.auditShare(c, share, "share_upload", "success", map[string]interface{}{"file": name, "size": file.Size})
+	response.Success(c, gin.H{"name": name, "size": file.Size})
 }
 
-func (h *FileHandler) Copy(c *gin.Context) {
+// ShareAccess exchanges the password of a protected share link, sent in the body, for an
+// access ticket. The ticket is set as a cookie for browsers and returned for clients to
+// send in the X-Share-Ticket header.
+func (h *FileHandler) ShareAccess(c *gin.Context) {
 	var req struct {
-		Source      string `json:"source" binding:"required"`
-		Destination string `json:"destination" binding:"required"`
+		Password string `json:"password" form:"password"`
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+	if err := c.ShouldBind(&req); err != nil {
+		response.BadRequest(c, "Invalid request body")
 		return
 	}
-
-	if err := h.svc.File.Copy(req.Source, req.Destination); err != nil {
-		response.InternalError(c, "Failed to copy: "+err.Error())
+	share, fs, err := h.svc.File.OpenShare(c.Param("token"), services.ShareAccess{Password: req.Password})
+	if err != nil {
+		if share != nil {
+			h.auditShare(c, share, "share_access", "failed", map[string]interface{}{"error": err.Error()})
+		}
+		h.shareError(c, "Share unavailable", err)
 		return
 	}
-	response.Success(c, nil)
+
+	ticket, expires := fs.ShareTicket(share, services.ShareTicketAccess, "")
+	h.setShareCookie(c, shareAccessCookie, ticket, strings.TrimSuffix(c.Request.URL.Path, "/access"), expires)
+	h.auditShare(c, share, "share_access", "success", map[string]interface{}{})
+	response.Success(c, gin.H{"ticket": ticket, "expires_at": expires})
 }
 
-func (h *FileHandler) Move(c *gin.Context) {
-	var req struct {
-		Source      string `json:"source" binding:"required"`
-		Destination string `json:"destination" binding:"required"`
+// Cookies of share visitors
+const (
+	shareAccessCookie   = "share_access"
+	shareDownloadCookie = "share_download"
+)
+
+// openShare opens the share link of a request for a visitor, with the file service of its
+// creator. The password of a protected link is taken from the X-Share-Password header, or
+// an access ticket from the X-Share-Ticket header or cookie. A refused access is audited
+// and responded to.
+func (h *FileHandler) openShare(c *gin.Context, action string) (*models.FileShare, *services.FileService, bool) {
+	access := services.ShareAccess{
+		Password: c.GetHeader("X-Share-Password"),
+		Ticket:   c.GetHeader("X-Share-Ticket"),
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
-		return
+	if access.Ticket == "" {
+		access.Ticket, _ = c.Cookie(shareAccessCookie)
 	}
-
-	if err := h.svc.File.Rename(req.Source, req.Destination); err != nil {
-		response.InternalError(c, "Failed to move: "+err.Error())
-		return
+	// Whether the download is resumed is checked against its ticket once the file is known
+	if _, err := c.Cookie(shareDownloadCookie); err == nil && action == "share_download" && c.GetHeader("Range") != "" {
+		access.Resume = true
 	}
-	response.Success(c, nil)
-}
 
-func (h *FileHandler) Delete(c *gin.Context) {
-	// Support both DELETE with query param and POST with body
-	path := c.Query("path")
-	if path == "" {
-		var req struct {
-			Path string `json:"path" binding:"required"`
-		}
-		if err := c.ShouldBindJSON(&req); err != nil {
-			response.BadRequest(c, "Path is required")
-			return
+	share, fs, err := h.svc.File.OpenShare(c.Param("token"), access)
+	if err != nil {
+		if share != nil {
+			h.auditShare(c, share, action, "failed", map[string]interface{}{"error": err.Error()})
 		}
-		path = req.Path
+		h.shareError(c, "Share unavailable", err)
+		return nil, nil, false
 	}
+	return share, fs, true
+}
 
-	if path == "" {
-		response.BadRequest(c, "Path is required")
-		return
-	}
+// setShareCookie sets a ticket of a share visitor for the requests below path
+func (h *FileHandler) setShareCookie(c *gin.Context, name, ticket, path string, expires time.Time) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, ticket, int(time.Until(expires).Seconds()), path, "", c.Request.TLS != nil, true)
+}
 
-	if err := h.svc.File.Delete(path); err != nil {
-		response.InternalError(c, "Failed to delete: "+err.Error())
-		return
+// auditShare records an access of a share link by a visitor
+func (h *FileHandler) auditShare(c *gin.Context, share *models.FileShare, action, status string, details map[string]interface{}) {
+	details["share_path"] = share.Path
+	details["owner"] = share.Username
+	h.svc.Audit.Log("", "", action, "file_share", share.ID, c.ClientIP(), c.Request.UserAgent(), status, details)
+}
+
+// shareError responds to a visitor, without revealing paths on the server
+func (h *FileHandler) shareError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, services.ErrSharePassword):
+		response.Unauthorized(c, message+": "+err.Error())
+	case errors.Is(err, services.ErrShareExpired):
+		response.Error(c, http.StatusGone, "GONE", message+": "+err.Error())
+	case errors.Is(err, services.ErrShareNotFound), errors.Is(err, os.ErrNotExist):
+		response.NotFound(c, message+": not found")
+	case errors.Is(err, services.ErrPathNotAllowed):
+		response.Forbidden(c, message+": not allowed")
+	case errors.Is(err, services.ErrInvalidShare):
+		response.BadRequest(c, message+": "+err.Error())
+	default:
+		h.log.Warn("Share access failed", "error", err)
+		response.InternalError(c, message)
 	}
-	response.Success(c, nil)
 }
 
-func (h *FileHandler) Upload(c *gin.Context) {
-	file, err := c.FormFile("file")
-	if err != nil {
-		response.BadRequest(c, "No file uploaded")
+func (h *FileHandler) GetPermissions(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	path := c.PostForm("path")
+	path := c.Query("path")
 	if path == "" {
 		response.BadRequest(c, "Path is required")
 		return
 	}
 
-	// Open uploaded file
-	src, err := file.Open()
+	info, err := fs.GetFileInfo(path)
 	if err != nil {
-		response.InternalError(c, "Failed to open uploaded file")
+		h.fileError(c, "Failed to get file info", err)
 		return
 	}
-	defer src.Close()
 
-	// Read file content
-	content := make([]byte, file.Size)
-	if _, err := src.Read(content); err != nil {
-		response.InternalError(c, "Failed to read uploaded file")
+	response.Success(c, gin.H{
+		"mode":        info.Mode,
+		"mode_string": info.ModeString,
+		"owner":       info.Owner,
+		"group":       info.Group,
+	})
+}
+
+func (h *FileHandler) SetPermissions(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	// Write to destination
-	destPath := path
-	if !strings.HasSuffix(destPath, "/") {
-		destPath = destPath + "/"
+	// A dry run previews how many entries a recursive change touches
+	var req services.PermissionChange
+	if err := c.ShouldBindJSON(&req); err != nil || req.Path == "" {
+		response.BadRequest(c, "Invalid request data")
+		return
 	}
-	destPath = destPath + file.Filename
 
-	if err := h.svc.File.WriteFile(destPath, content); err != nil {
-		response.InternalError(c, "Failed to save file: "+err.Error())
+	result, err := fs.ChangePermissions(req)
+	if err != nil {
+		h.fileError(c, "Failed to set permissions", err)
 		return
 	}
-
-	response.Success(c, gin.H{"message": "File uploaded successfully"})
+	response.Success(c, result)
 }
 
-func (h *FileHandler) Download(c *gin.Context) {
+func (h *FileHandler) GetACL(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
 	path := c.Query("path")
 	if path == "" {
 		response.BadRequest(c, "Path is required")
 		return
 	}
 
-	content, err := h.svc.File.ReadFile(path)
+	acl, err := fs.GetACL(path)
 	if err != nil {
-		response.InternalError(c, "Failed to read file: "+err.Error())
+		h.fileError(c, "Failed to get ACL", err)
 		return
 	}
-
-	// Get filename from path
-	filename := filepath.Base(path)
-	c.Header("Content-Disposition", "attachment; filename="+filename)
-	c.Data(http.StatusOK, "application/octet-stream", content)
+	response.Success(c, acl)
 }
 
-func (h *FileHandler) Compress(c *gin.Context) {
-	var req struct {
-		Paths    []string `json:"paths" binding:"required"`
-		DestPath string   `json:"dest_path" binding:"required"`
-		Format   string   `json:"format"`
+func (h *FileHandler) SetACL(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
+
+	var req services.ACLChange
+	if err := c.ShouldBindJSON(&req); err != nil || req.Path == "" {
 		response.BadRequest(c, "Invalid request data")
 		return
 	}
 
-	if req.Format == "" {
-		req.Format = "zip"
+	if err := fs.SetACL(req); err != nil {
+		h.fileError(c, "Failed to set ACL", err)
+		return
 	}
-
-	if err := h.svc.File.Compress(req.Paths, req.DestPath, req.Format); err != nil {
-		response.InternalError(c, "Failed to compress: "+err.Error())
+	acl, err := fs.GetACL(req.Path)
+	if err != nil {
+		h.fileError(c, "Failed to get ACL", err)
 		return
 	}
-	response.Success(c, gin.H{"message": "Files compressed successfully"})
+	response.Success(c, acl)
 }
 
-func (h *FileHandler) Decompress(c *gin.Context) {
-	var req struct {
-		ArchivePath string `json:"archive_path" binding:"required"`
-		DestPath    string `json:"dest_path" binding:"required"`
+func (h *FileHandler) Search(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+
+	path := c.DefaultQuery("path", fs.Roots()[0].Path)
+	pattern := c.Query("pattern")
+	if pattern == "" {
+		response.BadRequest(c, "Search pattern is required")
 		return
 	}
 
-	if err := h.svc.File.Decompress(req.ArchivePath, req.DestPath); err != nil {
-		response.InternalError(c, "Failed to decompress: "+err.Error())
+	files, err := fs.Search(path, pattern, 100)
+	if err != nil {
+		h.fileError(c, "Failed to search", err)
 		return
 	}
-	response.Success(c, gin.H{"message": "Archive decompressed successfully"})
+	response.Success(c, files)
 }
 
-func (h *FileHandler) GetPermissions(c *gin.Context) {
-	path := c.Query("path")
-	if path == "" {
-		response.BadRequest(c, "Path is required")
+// Grep streams the lines of the files below a path matching a pattern as server-sent
+// events, the search stops when the client goes away
+func (h *FileHandler) Grep(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	info, err := h.svc.File.GetFileInfo(path)
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	maxSize, _ := strconv.ParseInt(c.Query("max_size"), 10, 64)
+	contextLines, _ := strconv.Atoi(c.Query("context"))
+	maxResults, _ := strconv.Atoi(c.Query("max_results"))
+	search := services.ContentSearch{
+		Path:        c.DefaultQuery("path", fs.Roots()[0].Path),
+		Pattern:     c.Query("pattern"),
+		Literal:     c.Query("literal") == "true",
+		IgnoreCase:  c.Query("ignore_case") == "true",
+		Include:     c.QueryArray("include"),
+		Exclude:     c.QueryArray("exclude"),
+		MaxFileSize: maxSize,
+		Context:     contextLines,
+		MaxResults:  maxResults,
+	}
+
+	results, err := fs.SearchContent(c.Request.Context(), search)
 	if err != nil {
-		response.InternalError(c, "Failed to get file info: "+err.Error())
+		h.fileError(c, "Failed to search", err)
 		return
 	}
 
-	response.Success(c, gin.H{
-		"mode":        info.Mode,
-		"mode_string": info.ModeString,
-	})
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepalive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			c.Writer.Flush()
+		case result, ok := <-results:
+			if !ok {
+				return
+			}
+			if done, isDone := result.(*services.ContentSearchDone); isDone {
+				c.SSEvent("done", done)
+			} else {
+				c.SSEvent("match", result)
+			}
+			c.Writer.Flush()
+		}
+	}
 }
 
-func (h *FileHandler) SetPermissions(c *gin.Context) {
+func (h *FileHandler) ListIndexes(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+	response.Success(c, fs.ListIndexes())
+}
+
+// BuildIndex starts indexing the file names of a directory for the name search
+func (h *FileHandler) BuildIndex(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
+		return
+	}
+
 	var req struct {
-		Path string      `json:"path" binding:"required"`
-		Mode os.FileMode `json:"mode"`
+		Path string `json:"path" binding:"required"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
-		response.BadRequest(c, "Invalid request data")
+		response.BadRequest(c, "Path is required")
 		return
 	}
 
-	if err := h.svc.File.SetPermissions(req.Path, req.Mode); err != nil {
-		response.InternalError(c, "Failed to set permissions: "+err.Error())
+	index, err := fs.BuildIndex(req.Path)
+	if err != nil {
+		h.fileError(c, "Failed to build index", err)
 		return
 	}
-	response.Success(c, gin.H{"message": "Permissions updated successfully"})
+	response.Success(c, index)
 }
 
-func (h *FileHandler) Search(c *gin.Context) {
-	path := c.DefaultQuery("path", "/")
-	pattern := c.Query("pattern")
-	if pattern == "" {
-		response.BadRequest(c, "Search pattern is required")
+func (h *FileHandler) DeleteIndex(c *gin.Context) {
+	fs, ok := h.fileService(c)
+	if !ok {
 		return
 	}
 
-	files, err := h.svc.File.Search(path, pattern, 100)
-	if err != nil {
-		response.InternalError(c, "Failed to search: "+err.Error())
+	path := c.Query("path")
+	if path == "" {
+		response.BadRequest(c, "Path is required")
 		return
 	}
-	response.Success(c, files)
+
+	if err := fs.DeleteIndex(path); err != nil {
+		h.fileError(c, "Failed to delete index", err)
+		return
+	}
+	response.NoContent(c)
 }
 
 // ============================================
@@ -1782,12 +4214,133 @@ type SoftwareHandler struct {
 	log *logger.Logger
 }
 
-func (h *SoftwareHandler) ListInstalled(c *gin.Context) { response.Success(c, []interface{}{}) }
-func (h *SoftwareHandler) ListAvailable(c *gin.Context) { response.Success(c, []interface{}{}) }
-func (h *SoftwareHandler) Install(c *gin.Context)       { response.Success(c, nil) }
-func (h *SoftwareHandler) Uninstall(c *gin.Context)     { response.Success(c, nil) }
-func (h *SoftwareHandler) Upgrade(c *gin.Context)       { response.Success(c, nil) }
-func (h *SoftwareHandler) Status(c *gin.Context)        { response.Success(c, nil) }
+func (h *SoftwareHandler) ListInstalled(c *gin.Context) {
+	ctx := context.Background()
+	apps, err := h.svc.Software.ListInstalled(ctx)
+	if err != nil {
+		response.InternalError(c, "Failed to list installed apps: "+err.Error())
+		return
+	}
+	response.Success(c, apps)
+}
+
+func (h *SoftwareHandler) ListAvailable(c *gin.Context) {
+	ctx := context.Background()
+	templates, err := h.svc.Software.ListTemplates(ctx, c.Query("category"))
+	if err != nil {
+		response.InternalError(c, "Failed to load app catalogue: "+err.Error())
+		return
+	}
+
+	// Compose content is only returned for a single template
+	for i := range templates {
+		templates[i].Compose = ""
+	}
+	response.Success(c, templates)
+}
+
+func (h *SoftwareHandler) GetApp(c *gin.Context) {
+	ctx := context.Background()
+	tmpl, err := h.svc.Software.GetTemplate(ctx, c.Param("name"))
+	if err != nil {
+		response.NotFound(c, "App template not found")
+		return
+	}
+	response.Success(c, tmpl)
+}
+
+func (h *SoftwareHandler) RefreshCatalog(c *gin.Context) {
+	ctx := context.Background()
+	templates, err := h.svc.Software.RefreshCatalog(ctx)
+	if err != nil {
+		response.InternalError(c, "Failed to refresh app catalogue: "+err.Error())
+		return
+	}
+	response.Success(c, gin.H{"count": len(templates)})
+}
+
+func (h *SoftwareHandler) Install(c *gin.Context) {
+	ctx := context.Background()
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	var req services.InstallAppRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "App and name are required")
+		return
+	}
+
+	username, _ := c.Get("username")
+	result, err := h.svc.Software.Install(ctx, &req, fmt.Sprint(username))
+	if err != nil {
+		var verr *services.AppValidationError
+		switch {
+		case errors.As(err, &verr):
+			response.ValidationError(c, verr.Fields)
+		case errors.Is(err, services.ErrComposeInvalid):
+			response.ValidationError(c, err.Error())
+		case errors.Is(err, services.ErrAppTemplateNotFound):
+			response.NotFound(c, "App template not found")
+		case errors.Is(err, services.ErrAppAlreadyInstalled), errors.Is(err, services.ErrComposeProjectExists):
+			response.Conflict(c, err.Error())
+		default:
+			response.InternalError(c, "Failed to install app: "+err.Error())
+		}
+		return
+	}
+	response.Created(c, result)
+}
+
+func (h *SoftwareHandler) Uninstall(c *gin.Context) {
+	ctx := context.Background()
+	var req struct {
+		ID         string `json:"id" binding:"required"`
+		RemoveData bool   `json:"remove_data"`
+		RemoveSite bool   `json:"remove_site"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "App ID is required")
+		return
+	}
+
+	if err := h.svc.Software.Uninstall(ctx, req.ID, req.RemoveData, req.RemoveSite); err != nil {
+		if errors.Is(err, services.ErrAppNotInstalled) {
+			response.NotFound(c, "App not found")
+			return
+		}
+		response.InternalError(c, "Failed to uninstall app: "+err.Error())
+		return
+	}
+	response.Success(c, gin.H{"message": "App uninstalled"})
+}
+
+func (h *SoftwareHandler) Upgrade(c *gin.Context) {
+	var req struct {
+		ID string `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.BadRequest(c, "App ID is required")
+		return
+	}
+
+	username, _ := c.Get("username")
+	streamOutput(c, c.Query("stream") == "true", "upgrade app", func(_ context.Context, w io.Writer) error {
+		return h.svc.Software.Upgrade(context.Background(), req.ID, fmt.Sprint(username), w)
+	})
+}
+
+func (h *SoftwareHandler) Status(c *gin.Context) {
+	ctx := context.Background()
+	status, err := h.svc.Software.GetStatus(ctx, c.Param("name"))
+	if err != nil {
+		if errors.Is(err, services.ErrAppNotInstalled) {
+			response.NotFound(c, "App not found")
+			return
+		}
+		response.InternalError(c, "Failed to get app status: "+err.Error())
+		return
+	}
+	response.Success(c, status)
+}
 
 // ============================================
 // Plugin Handler
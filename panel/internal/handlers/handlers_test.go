@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/internal/services"
+	"github.com/vpanel/server/pkg/logger"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// newShareRouter returns the public share routes over a file service whose only root is
+// a temporary directory
+func newShareRouter(t *testing.T) (*gin.Engine, *services.FileService, string) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: gormlogger.Default.LogMode(gormlogger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a database of its own
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(&models.User{}, &models.FileJail{}, &models.FileShare{}, &models.AuditLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Files.Roots = []config.FileRootConfig{{Path: root}}
+	log := logger.New(logger.Config{Level: "error"})
+	fs := services.NewFileService(db, cfg, log)
+	h := &FileHandler{svc: &services.Container{File: fs, Audit: services.NewAuditService(db, log)}, log: log}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/shares/:token", h.ShareInfo)
+	r.POST("/api/shares/:token/access", h.ShareAccess)
+	r.GET("/api/shares/:token/download", h.ShareDownload)
+	r.HEAD("/api/shares/:token/download", h.ShareDownload)
+	return r, fs, root
+}
+
+func serve(r *gin.Engine, method, url string, body string, header map[string]string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	r, fs, root := newShareRouter(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("0123456789"), 0644)
+	share, err := fs.CreateShare(services.ShareOptions{Path: filepath.Join(root, "a.txt"), MaxDownloads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/api/shares/" + share.Token + "/download"
+
+	var ticket []*http.Cookie
+	steps := []struct {
+		name       string
+		method     string
+		rng        string
+		withTicket bool
+		wantStatus int
+		wantBody   string
+		downloads  int
+	}{
+		{"head", http.MethodHead, "", false, http.StatusOK, "", 0},
+		{"range without a ticket", http.MethodGet, "bytes=2-", false, http.StatusPartialContent, "23456789", 1},
+		{"range with the ticket", http.MethodGet, "bytes=5-", true, http.StatusPartialContent, "56789", 1},
+		{"range without a ticket at the limit", http.MethodGet, "bytes=5-", false, http.StatusGone, "", 1},
+		{"whole file with the ticket", http.MethodGet, "", true, http.StatusGone, "", 1},
+		{"head at the limit", http.MethodHead, "", false, http.StatusGone, "", 1},
+	}
+	for _, step := range steps {
+		var header map[string]string
+		if step.rng != "" {
+			header = map[string]string{"Range": step.rng}
+		}
+		var cookies []*http.Cookie
+		if step.withTicket {
+			cookies = ticket
+		}
+		w := serve(r, step.method, url, "", header, cookies)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if step.wantBody != "" && w.Body.String() != step.wantBody {
+			t.Errorf("%s: body = %q, want %q", step.name, w.Body, step.wantBody)
+		}
+		if cookies := w.Result().Cookies(); len(cookies) > 0 {
+			ticket = cookies
+			if cookies[0].Path != url || !cookies[0].HttpOnly {
+				t.Errorf("%s: ticket cookie = %+v, want an HttpOnly cookie for %s", step.name, cookies[0], url)
+			}
+		}
+		got, _, err := fs.OpenShare(share.Token, services.ShareAccess{Resume: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Downloads != step.downloads {
+			t.Errorf("%s: downloads = %d, want %d", step.name, got.Downloads, step.downloads)
+		}
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	r, fs, root := newShareRouter(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	share, err := fs.CreateShare(services.ShareOptions{Path: filepath.Join(root, "a.txt"), Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "/api/shares/" + share.Token
+
+	// The password is exchanged for a ticket
+	w := serve(r, http.MethodPost, url+"/access", `{"password":"secret"}`, map[string]string{"Content-Type": "application/json"}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("access: status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data struct {
+			Ticket string `json:"ticket"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Data.Ticket == "" {
+		t.Fatalf("access: response %s has no ticket", w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Path != url || !cookies[0].HttpOnly || cookies[0].Value != resp.Data.Ticket {
+		t.Fatalf("access: cookies = %+v, want the ticket for %s", cookies, url)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		header     map[string]string
+		cookies    []*http.Cookie
+		wantStatus int
+	}{
+		{"no password", http.MethodGet, url, "", nil, nil, http.StatusUnauthorized},
+		{"password in the query", http.MethodGet, url + "?password=secret", "", nil, nil, http.StatusUnauthorized},
+		{"password header", http.MethodGet, url, "", map[string]string{"X-Share-Password": "secret"}, nil, http.StatusOK},
+		{"wrong password header", http.MethodGet, url, "", map[string]string{"X-Share-Password": "guess"}, nil, http.StatusUnauthorized},
+		{"ticket header", http.MethodGet, url + "/download", "", map[string]string{"X-Share-Ticket": resp.Data.Ticket}, nil, http.StatusOK},
+		{"ticket cookie", http.MethodGet, url + "/download", "", nil, cookies, http.StatusOK},
+		{"ticket in the query", http.MethodGet, url + "?ticket=" + resp.Data.Ticket, "", nil, nil, http.StatusUnauthorized},
+		{"wrong password for a ticket", http.MethodPost, url + "/access", "password=guess", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, nil, http.StatusUnauthorized},
+		{"form password for a ticket", http.MethodPost, url + "/access", "password=secret", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(r, tt.method, tt.url, tt.body, tt.header, tt.cookies); w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
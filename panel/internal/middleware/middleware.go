@@ -62,6 +62,8 @@ func CORS(cfg config.CORSConfig) gin.HandlerFunc {
 
 		c.Header("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
 		c.Header("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+		// Ranged downloads and resumable uploads are driven by these
+		c.Header("Access-Control-Expose-Headers", "Content-Disposition, Content-Range, Accept-Ranges, Upload-Offset, Upload-Length")
 		c.Header("Access-Control-Allow-Credentials", "true")
 		c.Header("Access-Control-Max-Age", "86400")
 
@@ -331,9 +333,15 @@ func Audit(auditService *services.AuditService) gin.HandlerFunc {
 			usernameStr = username.(string)
 		}
 
-		// Determine action and resource from path and method
+		// Determine action and resource from path and method, handlers may name them
 		action := getActionFromMethod(method)
 		resource, resourceID := getResourceFromPath(path)
+		if value := c.GetString("audit_resource"); value != "" {
+			resource = value
+		}
+		if value := c.GetString("audit_resource_id"); value != "" {
+			resourceID = value
+		}
 
 		// Determine status
 		status := "success"
@@ -347,6 +355,11 @@ func Audit(auditService *services.AuditService) gin.HandlerFunc {
 			"path":        path,
 			"status_code": c.Writer.Status(),
 		}
+		if extra, ok := c.Get("audit_details"); ok {
+			for key, value := range extra.(map[string]interface{}) {
+				details[key] = value
+			}
+		}
 
 		// Log the audit entry
 		auditService.Log(
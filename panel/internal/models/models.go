@@ -137,10 +137,57 @@ type DockerComposeProject struct {
 	BaseModel
 	NodeID      string `gorm:"type:varchar(36);index" json:"node_id"`
 	Name        string `gorm:"type:varchar(100);not null" json:"name"`
+	ProjectName string `gorm:"type:varchar(100)" json:"project_name"` // the name compose knows the project by
 	Path        string `gorm:"type:varchar(500)" json:"path"`
 	Content     string `gorm:"type:text" json:"content"`
 	Status      string `gorm:"type:varchar(20);default:'stopped'" json:"status"` // running, stopped, partial
 	Description string `gorm:"type:varchar(500)" json:"description"`
+	ComposeFile string `gorm:"type:varchar(255)" json:"compose_file"` // relative to Path, defaults to docker-compose.yml
+	EnvContent  string `gorm:"type:text" json:"env_content"`
+	Version     int    `gorm:"default:1" json:"version"`
+	Imported    bool   `gorm:"default:false" json:"imported"`
+}
+
+// DockerComposeRevision represents a saved revision of a compose project
+type DockerComposeRevision struct {
+	BaseModel
+	ProjectID  string `gorm:"type:varchar(36);index;not null" json:"project_id"`
+	Version    int    `gorm:"not null" json:"version"`
+	Content    string `gorm:"type:text" json:"content"`
+	EnvContent string `gorm:"type:text" json:"env_content"`
+	Message    string `gorm:"type:varchar(500)" json:"message"`
+	CreatedBy  string `gorm:"type:varchar(100)" json:"created_by"`
+}
+
+// DockerEvent records a Docker daemon lifecycle event
+type DockerEvent struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	NodeID     string    `gorm:"type:varchar(36);index" json:"node_id"`
+	Type       string    `gorm:"type:varchar(20);index" json:"type"`   // container, image, network, volume
+	Action     string    `gorm:"type:varchar(50);index" json:"action"` // start, die, oom, health_status, restart, ...
+	ActorID    string    `gorm:"type:varchar(100);index" json:"actor_id"`
+	ActorName  string    `gorm:"type:varchar(255);index" json:"actor_name"`
+	Image      string    `gorm:"type:varchar(255)" json:"image"`
+	Project    string    `gorm:"type:varchar(100);index" json:"project"` // compose project label
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	Health     string    `gorm:"type:varchar(20)" json:"health,omitempty"` // healthy, unhealthy, starting
+	Attributes JSON      `gorm:"type:text" json:"attributes"`
+	Time       time.Time `gorm:"index" json:"time"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// DockerVolumeBackup represents a compressed snapshot of a Docker volume
+type DockerVolumeBackup struct {
+	BaseModel
+	Volume      string     `gorm:"type:varchar(255);index;not null" json:"volume"`
+	FileName    string     `gorm:"type:varchar(255)" json:"file_name"`
+	FilePath    string     `gorm:"type:varchar(500)" json:"file_path"`
+	FileSize    int64      `json:"file_size"`
+	Method      string     `gorm:"type:varchar(20)" json:"method"` // mountpoint, helper
+	Status      string     `gorm:"type:varchar(20)" json:"status"` // completed, failed, in_progress
+	Error       string     `gorm:"type:text" json:"error"`
+	CreatedBy   string     `gorm:"type:varchar(100)" json:"created_by"`
+	CompletedAt *time.Time `json:"completed_at"`
 }
 
 // ===============================
@@ -164,20 +211,306 @@ type NginxSite struct {
 	PHPVersion   string `gorm:"type:varchar(20)" json:"php_version"`
 	Config       string `gorm:"type:text" json:"config"`
 	Enabled      bool   `gorm:"default:true" json:"enabled"`
+
+	// Access controls and request routing
+	Access        NginxAccess     `gorm:"type:text" json:"access"`
+	CanonicalHost string          `gorm:"type:varchar(10)" json:"canonical_host"` // www, apex, the other name redirects to it
+	Redirects     NginxRedirects  `gorm:"type:text" json:"redirects"`
+	ErrorPages    NginxErrorPages `gorm:"type:text" json:"error_pages"`
+	LogFormat     string          `gorm:"type:varchar(20)" json:"log_format"` // combined, json
+}
+
+// NginxAccess holds the access controls of a site or a location, zero values disable them
+type NginxAccess struct {
+	BasicAuth   bool     `json:"basic_auth"` // require one of the site's auth users
+	AuthRealm   string   `json:"auth_realm,omitempty"`
+	Allow       []string `json:"allow,omitempty"` // IPs or CIDRs, other clients are denied when set
+	Deny        []string `json:"deny,omitempty"`
+	Satisfy     string   `json:"satisfy,omitempty"`       // all, any: either the IP rules or basic auth let a client in
+	RateLimit   int      `json:"rate_limit,omitempty"`    // requests per second per client IP
+	RateBurst   int      `json:"rate_burst,omitempty"`    // requests above the rate that are served without delay
+	ConnLimit   int      `json:"conn_limit,omitempty"`    // concurrent connections per client IP
+	MaxBodySize string   `json:"max_body_size,omitempty"` // e.g. 10m, 0 disables the check
+}
+
+func (a NginxAccess) Value() (driver.Value, error) {
+	return json.Marshal(a)
+}
+
+func (a *NginxAccess) Scan(value interface{}) error {
+	if value == nil {
+		*a = NginxAccess{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, a)
+}
+
+// NginxRedirect is a redirect or an internal rewrite of request paths
+type NginxRedirect struct {
+	Match string `json:"match"` // exact, prefix, regex
+	From  string `json:"from"`  // the rest of a prefix is appended to To
+	To    string `json:"to"`    // path or URL, regex captures are available as $1...
+	Code  int    `json:"code"`  // 301, 302, 0 rewrites internally
+}
+
+// NginxRedirects type for storing ordered redirect rules
+type NginxRedirects []NginxRedirect
+
+func (r NginxRedirects) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+func (r *NginxRedirects) Scan(value interface{}) error {
+	if value == nil {
+		*r = NginxRedirects{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, r)
+}
+
+// NginxErrorPage is a page served for error statuses
+type NginxErrorPage struct {
+	Codes []int  `json:"codes"`
+	Page  string `json:"page"` // URI or URL
+}
+
+// NginxErrorPages type for storing custom error pages
+type NginxErrorPages []NginxErrorPage
+
+func (p NginxErrorPages) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
+func (p *NginxErrorPages) Scan(value interface{}) error {
+	if value == nil {
+		*p = NginxErrorPages{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, p)
+}
+
+// NginxLogStat holds the access log aggregates of a site over a minute, an hour or a day
+type NginxLogStat struct {
+	ID            uint      `gorm:"primaryKey" json:"-"`
+	SiteID        string    `gorm:"type:varchar(36);uniqueIndex:idx_nginx_log_stat" json:"site_id"`
+	Period        string    `gorm:"type:varchar(10);uniqueIndex:idx_nginx_log_stat" json:"period"` // minute, hour, day
+	Time          time.Time `gorm:"uniqueIndex:idx_nginx_log_stat;index" json:"time"`              // start of the period
+	Requests      int64     `json:"requests"`
+	Bytes         int64     `json:"bytes"`
+	Visitors      int64     `json:"visitors"` // distinct client IPs in the period
+	Statuses      Counts    `gorm:"type:text" json:"statuses"`
+	UpstreamCount int64     `json:"upstream_count"` // requests passed to an upstream
+	UpstreamP50   float64   `json:"upstream_p50"`   // milliseconds
+	UpstreamP95   float64   `json:"upstream_p95"`
+	UpstreamHist  Histogram `gorm:"type:text" json:"-"` // upstream times, merged for percentiles over ranges
+	Paths         Counts    `gorm:"type:text" json:"-"`
+	Referrers     Counts    `gorm:"type:text" json:"-"`
+	UserAgents    Counts    `gorm:"type:text" json:"-"`
+	IPs           Counts    `gorm:"type:text" json:"-"`
+}
+
+// NginxLogCursor records how far the access log of a site has been ingested
+type NginxLogCursor struct {
+	SiteID      string    `gorm:"primaryKey;type:varchar(36)" json:"site_id"`
+	Path        string    `gorm:"type:varchar(500)" json:"path"`
+	Inode       uint64    `json:"inode"`
+	Offset      int64     `json:"offset"`
+	Fingerprint string    `gorm:"type:varchar(64)" json:"fingerprint"` // SHA-256 of the first line, finds the file after rotation
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Counts type for storing counts by key
+type Counts map[string]int64
+
+func (c Counts) Value() (driver.Value, error) {
+	return json.Marshal(c)
+}
+
+func (c *Counts) Scan(value interface{}) error {
+	if value == nil {
+		*c = make(Counts)
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, c)
+}
+
+// Histogram type for storing bucket counts
+type Histogram []int64
+
+func (h Histogram) Value() (driver.Value, error) {
+	return json.Marshal(h)
+}
+
+func (h *Histogram) Scan(value interface{}) error {
+	if value == nil {
+		*h = Histogram{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, h)
+}
+
+// NginxAuthUser is an HTTP basic auth user of a site
+type NginxAuthUser struct {
+	BaseModel
+	SiteID       string `gorm:"type:varchar(36);index;not null" json:"site_id"`
+	Username     string `gorm:"type:varchar(64);not null" json:"username"`
+	PasswordHash string `gorm:"type:varchar(255)" json:"-"` // apr1 as written by htpasswd -m
+}
+
+// NginxUpstream represents a named group of backends that site locations balance over
+type NginxUpstream struct {
+	BaseModel
+	NodeID           string          `gorm:"type:varchar(36);index" json:"node_id"`
+	Name             string          `gorm:"type:varchar(100);not null" json:"name"` // upstream name in nginx
+	Method           string          `gorm:"type:varchar(20)" json:"method"`         // round_robin, least_conn, ip_hash, hash, consistent_hash, random
+	HashKey          string          `gorm:"type:varchar(255)" json:"hash_key"`      // key of the hash methods, e.g. $request_uri
+	Keepalive        int             `json:"keepalive"`                              // idle connections cached per worker, 0 disables
+	KeepaliveTimeout int             `json:"keepalive_timeout"`                      // seconds
+	Servers          UpstreamServers `gorm:"type:text" json:"servers"`
+	Description      string          `gorm:"type:varchar(500)" json:"description"`
+}
+
+// UpstreamServer is a backend of an upstream group, zero values keep nginx's defaults
+type UpstreamServer struct {
+	Address     string `json:"address"` // host:port or unix:/path
+	Weight      int    `json:"weight,omitempty"`
+	MaxFails    int    `json:"max_fails,omitempty"`
+	FailTimeout int    `json:"fail_timeout,omitempty"` // seconds
+	MaxConns    int    `json:"max_conns,omitempty"`
+	Backup      bool   `json:"backup,omitempty"`
+	Down        bool   `json:"down,omitempty"`
+}
+
+// UpstreamServers type for storing the backends of an upstream
+type UpstreamServers []UpstreamServer
+
+func (s UpstreamServers) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *UpstreamServers) Scan(value interface{}) error {
+	if value == nil {
+		*s = UpstreamServers{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, s)
+}
+
+// NginxLocation represents a location rule of a site that routes a path to an upstream,
+// a proxied URL or a static root
+type NginxLocation struct {
+	BaseModel
+	SiteID          string       `gorm:"type:varchar(36);index;not null" json:"site_id"`
+	Match           string       `gorm:"type:varchar(20)" json:"match"` // prefix, exact, priority (^~), regex (~), regex_i (~*)
+	Path            string       `gorm:"type:varchar(500);not null" json:"path"`
+	Priority        int          `gorm:"default:0" json:"priority"`      // regex locations are tried in this order
+	Target          string       `gorm:"type:varchar(20)" json:"target"` // upstream, proxy, static
+	UpstreamID      string       `gorm:"type:varchar(36);index" json:"upstream_id"`
+	UpstreamPath    string       `gorm:"type:varchar(500)" json:"upstream_path"` // URI passed to the upstream, "/" strips the location prefix
+	ProxyTarget     string       `gorm:"type:varchar(500)" json:"proxy_target"`
+	RootPath        string       `gorm:"type:varchar(500)" json:"root_path"`
+	Alias           bool         `gorm:"default:false" json:"alias"`        // RootPath replaces the location prefix instead of prefixing the URI
+	Headers         NginxHeaders `gorm:"type:text" json:"headers"`          // request headers sent to the backend
+	ResponseHeaders NginxHeaders `gorm:"type:text" json:"response_headers"` // headers added to responses
+	ConnectTimeout  int          `json:"connect_timeout"`                   // seconds, 0 keeps the default
+	SendTimeout     int          `json:"send_timeout"`
+	ReadTimeout     int          `json:"read_timeout"`
+	WebSocket       bool         `gorm:"default:false" json:"websocket"`
+	NoBuffering     bool         `gorm:"default:false" json:"no_buffering"`         // stream responses, e.g. server-sent events
+	NoRequestBuffer bool         `gorm:"default:false" json:"no_request_buffering"` // stream request bodies, e.g. large uploads
+	Access          NginxAccess  `gorm:"type:text" json:"access"`
+}
+
+// NginxHeader is a header name and value
+type NginxHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// NginxHeaders type for storing ordered headers
+type NginxHeaders []NginxHeader
+
+func (h NginxHeaders) Value() (driver.Value, error) {
+	return json.Marshal(h)
+}
+
+func (h *NginxHeaders) Scan(value interface{}) error {
+	if value == nil {
+		*h = NginxHeaders{}
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, h)
 }
 
 // SSLCertificate represents an SSL certificate
 type SSLCertificate struct {
 	BaseModel
-	NodeID      string    `gorm:"type:varchar(36);index" json:"node_id"`
-	Domain      string    `gorm:"type:varchar(255);not null" json:"domain"`
-	Type        string    `gorm:"type:varchar(50)" json:"type"` // letsencrypt, custom
-	CertPath    string    `gorm:"type:varchar(500)" json:"cert_path"`
-	KeyPath     string    `gorm:"type:varchar(500)" json:"key_path"`
-	ChainPath   string    `gorm:"type:varchar(500)" json:"chain_path"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	AutoRenew   bool      `gorm:"default:true" json:"auto_renew"`
-	LastRenewed *time.Time `json:"last_renewed"`
+	NodeID      string      `gorm:"type:varchar(36);index" json:"node_id"`
+	Domain      string      `gorm:"type:varchar(255);not null" json:"domain"`
+	SANs        StringArray `gorm:"type:text" json:"sans"` // additional names, may include wildcards
+	Type        string      `gorm:"type:varchar(50)" json:"type"` // letsencrypt, custom
+	KeyType     string      `gorm:"type:varchar(20)" json:"key_type"` // ec256, ec384, rsa2048, rsa3072, rsa4096
+	Challenge   string      `gorm:"type:varchar(20)" json:"challenge"` // http-01, dns-01
+	DNSProvider string      `gorm:"type:varchar(50)" json:"dns_provider"`
+	DNSConfig   JSON        `gorm:"type:text" json:"-"` // provider credentials
+	CertPath    string      `gorm:"type:varchar(500)" json:"cert_path"`
+	KeyPath     string      `gorm:"type:varchar(500)" json:"key_path"`
+	ChainPath   string      `gorm:"type:varchar(500)" json:"chain_path"`
+	ExpiresAt   time.Time   `json:"expires_at"`
+	NotBefore   time.Time   `json:"not_before"`
+	Issuer      string      `gorm:"type:varchar(255)" json:"issuer"`
+	Serial      string      `gorm:"type:varchar(64)" json:"serial"`
+	Fingerprint string      `gorm:"type:varchar(64)" json:"fingerprint"` // SHA-256 of the leaf certificate
+	AutoRenew   bool        `gorm:"default:true" json:"auto_renew"`
+	LastRenewed *time.Time  `json:"last_renewed"`
+
+	// Automatic renewal state
+	RenewFailures  int        `gorm:"default:0" json:"renew_failures"`
+	LastRenewError string     `gorm:"type:text" json:"last_renew_error"`
+	NextRenewAt    *time.Time `json:"next_renew_at"` // retry backoff after a failed renewal
+	LastAlertAt    *time.Time `json:"-"`
+}
+
+// SSLRenewal records a certificate renewal attempt
+type SSLRenewal struct {
+	BaseModel
+	CertificateID string     `gorm:"type:varchar(36);index" json:"certificate_id"`
+	Domain        string     `gorm:"type:varchar(255)" json:"domain"`
+	Trigger       string     `gorm:"type:varchar(20)" json:"trigger"` // auto, manual
+	Status        string     `gorm:"type:varchar(20)" json:"status"`  // success, failed
+	Error         string     `gorm:"type:text" json:"error"`
+	Changed       bool       `json:"changed"` // the certificate files were replaced
+	OldExpiresAt  time.Time  `json:"old_expires_at"`
+	NewExpiresAt  *time.Time `json:"new_expires_at"`
+	Duration      int64      `json:"duration"` // milliseconds
 }
 
 // ===============================
@@ -264,6 +597,116 @@ type FirewallRule struct {
 	Description string `gorm:"type:varchar(500)" json:"description"`
 }
 
+// ===============================
+// File Manager Models
+// ===============================
+
+// FileJail restricts the file manager of a role or of a user, a user's jail takes
+// precedence over the jail of their role. Root paths may contain {username}.
+type FileJail struct {
+	BaseModel
+	Role        string    `gorm:"type:varchar(50);index" json:"role"`
+	UserID      string    `gorm:"type:varchar(36);index" json:"user_id"`
+	Roots       FileRoots `gorm:"type:text" json:"roots"`
+	Description string    `gorm:"type:varchar(255)" json:"description"`
+}
+
+// FileRoot is a directory the file manager can access
+type FileRoot struct {
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// FileRoots is a JSON column of roots
+type FileRoots []FileRoot
+
+func (r FileRoots) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+func (r *FileRoots) Scan(value interface{}) error {
+	bytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(bytes, r)
+}
+
+// FileUpload is a resumable upload, chunks are appended to a part file next to the
+// destination that is renamed into place once complete
+type FileUpload struct {
+	BaseModel
+	UserID    string    `gorm:"type:varchar(36);index" json:"user_id"`
+	Path      string    `gorm:"type:varchar(1000);not null" json:"path"`
+	Size      int64     `gorm:"not null" json:"size"`
+	Offset    int64     `gorm:"default:0" json:"offset"`
+	Checksum  string    `gorm:"type:varchar(64)" json:"checksum"` // sha256 hex of the whole file, checked on completion
+	HashState []byte    `json:"-"`                                // sha256 state of the received bytes
+	Overwrite bool      `gorm:"default:false" json:"overwrite"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+}
+
+// FileTrash is a deleted file or directory kept in the trash until it is restored,
+// purged or expires. It is stored in the trash directory under its ID.
+type FileTrash struct {
+	BaseModel
+	Path     string `gorm:"type:varchar(1000);not null;index" json:"path"` // where it was deleted from
+	Name     string `gorm:"type:varchar(255)" json:"name"`
+	IsDir    bool   `gorm:"default:false" json:"is_dir"`
+	Size     int64  `gorm:"default:0" json:"size"`
+	UserID   string `gorm:"type:varchar(36);index" json:"user_id"`
+	Username string `gorm:"type:varchar(100)" json:"username"`
+}
+
+// FileVersion is a snapshot of a text file edited in the panel, its content is stored
+// once per hash and shared by every version with that content
+type FileVersion struct {
+	BaseModel
+	Path     string `gorm:"type:varchar(1000);not null;index" json:"path"`
+	Hash     string `gorm:"type:varchar(64);not null;index" json:"hash"` // sha256 hex of the content
+	Size     int64  `gorm:"default:0" json:"size"`
+	UserID   string `gorm:"type:varchar(36)" json:"user_id"`
+	Username string `gorm:"type:varchar(100)" json:"username"` // empty when the content was found on disk
+}
+
+// FileShare is a public link to a file or directory. An upload share is a drop box,
+// visitors add files to the directory without seeing what it holds.
+type FileShare struct {
+	BaseModel
+	Token        string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"token"`
+	Path         string     `gorm:"type:varchar(1000);not null;index" json:"path"`
+	IsDir        bool       `gorm:"default:false" json:"is_dir"`
+	Upload       bool       `gorm:"default:false" json:"upload"`
+	Password     string     `gorm:"type:varchar(255)" json:"-"` // bcrypt hash
+	Protected    bool       `gorm:"default:false" json:"protected"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `gorm:"default:0" json:"max_downloads"` // 0 for no limit
+	Downloads    int        `gorm:"default:0" json:"downloads"`
+	Uploads      int        `gorm:"default:0" json:"uploads"`
+	UserID       string     `gorm:"type:varchar(36);index" json:"user_id"`
+	Username     string     `gorm:"type:varchar(100)" json:"username"`
+}
+
+// FileLocation is a remote storage the file manager browses next to the local
+// filesystem, its paths are written as "<name>:/<path>"
+type FileLocation struct {
+	BaseModel
+	Name       string `gorm:"type:varchar(100);uniqueIndex;not null" json:"name"`
+	Type       string `gorm:"type:varchar(20);not null" json:"type"` // sftp, s3
+	Host       string `gorm:"type:varchar(255)" json:"host"`         // host[:port] of the SSH server or the S3 endpoint
+	Username   string `gorm:"type:varchar(100)" json:"username"`
+	Password   string `gorm:"type:varchar(255)" json:"-"`
+	PrivateKey string `gorm:"type:text" json:"-"`
+	HostKey    string `gorm:"type:text" json:"host_key"` // SSH server key, pinned on the first connection when empty
+	Bucket     string `gorm:"type:varchar(255)" json:"bucket"`
+	Region     string `gorm:"type:varchar(100)" json:"region"`
+	AccessKey  string `gorm:"type:varchar(255)" json:"access_key"`
+	SecretKey  string `gorm:"type:varchar(255)" json:"-"`
+	UseSSL     bool   `gorm:"default:false" json:"use_ssl"`
+	Root       string `gorm:"type:varchar(1000)" json:"root"` // directory or key prefix the location starts at
+	ReadOnly   bool   `gorm:"default:false" json:"read_only"`
+}
+
 // ===============================
 // Plugin Models
 // ===============================
@@ -291,16 +734,19 @@ type Plugin struct {
 // Software represents installed software
 type Software struct {
 	BaseModel
-	NodeID         string `gorm:"type:varchar(36);index" json:"node_id"`
-	Name           string `gorm:"type:varchar(100);not null" json:"name"`
-	Version        string `gorm:"type:varchar(50)" json:"version"`
-	LatestVersion  string `gorm:"type:varchar(50)" json:"latest_version"`
-	Status         string `gorm:"type:varchar(20)" json:"status"` // installed, running, stopped
-	ServiceName    string `gorm:"type:varchar(100)" json:"service_name"`
-	Port           int    `json:"port"`
-	ConfigPath     string `gorm:"type:varchar(500)" json:"config_path"`
-	DataPath       string `gorm:"type:varchar(500)" json:"data_path"`
-	AutoStart      bool   `gorm:"default:true" json:"auto_start"`
+	NodeID           string `gorm:"type:varchar(36);index" json:"node_id"`
+	Name             string `gorm:"type:varchar(100);not null" json:"name"`
+	Version          string `gorm:"type:varchar(50)" json:"version"`
+	LatestVersion    string `gorm:"type:varchar(50)" json:"latest_version"`
+	Status           string `gorm:"type:varchar(20)" json:"status"` // installed, running, stopped
+	ServiceName      string `gorm:"type:varchar(100)" json:"service_name"`
+	Port             int    `json:"port"`
+	ConfigPath       string `gorm:"type:varchar(500)" json:"config_path"`
+	DataPath         string `gorm:"type:varchar(500)" json:"data_path"`
+	AutoStart        bool   `gorm:"default:true" json:"auto_start"`
+	App              string `gorm:"type:varchar(100);index" json:"app"` // catalogue template name
+	ComposeProjectID string `gorm:"type:varchar(36);index" json:"compose_project_id"`
+	SiteID           string `gorm:"type:varchar(36)" json:"site_id"`
 }
 
 // ===============================
@@ -0,0 +1,483 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// Path served from the ACME webroot by every managed site
+	acmeChallengePath = "/.well-known/acme-challenge/"
+
+	// Upper bound for a single issuance including challenge validation
+	acmeIssueTimeout = 10 * time.Minute
+)
+
+// Key types supported for issued certificates
+var certKeyTypes = map[string]bool{"ec256": true, "ec384": true, "rsa2048": true, "rsa3072": true, "rsa4096": true}
+
+// acmeClient returns the client for the configured directory, creating the
+// account key and registering the account on first use
+func (s *NginxService) acmeClient(ctx context.Context) (*acme.Client, error) {
+	s.acmeMu.Lock()
+	defer s.acmeMu.Unlock()
+
+	if s.acme != nil {
+		return s.acme, nil
+	}
+
+	cfg := s.cfg.ACME
+	directory, err := url.Parse(cfg.DirectoryURL)
+	if err != nil || directory.Host == "" {
+		return nil, fmt.Errorf("invalid ACME directory URL %q", cfg.DirectoryURL)
+	}
+
+	// One account key per CA
+	keyPath := filepath.Join(cfg.CertDir, "accounts", directory.Host, "account.key")
+	key, err := loadPrivateKey(keyPath)
+	if os.IsNotExist(err) {
+		key, err = generateCertKey("ec256")
+		if err == nil {
+			err = writePrivateKey(keyPath, key)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ACME account key: %w", err)
+	}
+
+	httpClient, err := acmeHTTPClient(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: cfg.DirectoryURL,
+		HTTPClient:   httpClient,
+		UserAgent:    "vpanel",
+	}
+
+	account := &acme.Account{}
+	if cfg.Email != "" {
+		account.Contact = []string{"mailto:" + cfg.Email}
+	}
+	if cfg.EABKeyID != "" {
+		hmacKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cfg.EABHMACKey, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACME EAB HMAC key: %w", err)
+		}
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: cfg.EABKeyID, Key: hmacKey}
+	}
+
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	s.acme = client
+	return client, nil
+}
+
+// obtainCertificate runs an ACME order for the certificate's names and stores the
+// issued certificate and key under the certificate directory
+func (s *NginxService) obtainCertificate(ctx context.Context, cert *models.SSLCertificate) error {
+	domains := certificateDomains(cert)
+
+	keyType := cert.KeyType
+	if keyType == "" {
+		keyType = s.cfg.ACME.KeyType
+	}
+	if !certKeyTypes[keyType] {
+		return fmt.Errorf("%w: %s", ErrInvalidKeyType, keyType)
+	}
+
+	challenge := cert.Challenge
+	if challenge == "" {
+		challenge = "http-01"
+		if cert.DNSProvider != "" {
+			challenge = "dns-01"
+		}
+	}
+
+	var provider DNSProvider
+	switch challenge {
+	case "dns-01":
+		var err error
+		if provider, err = newDNSProvider(cert.DNSProvider, cert.DNSConfig); err != nil {
+			return err
+		}
+	case "http-01":
+		for _, d := range domains {
+			if strings.HasPrefix(d, "*.") {
+				return ErrWildcardNeedsDNS
+			}
+		}
+		s.prepareHTTPChallenge(domains)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedChallenge, challenge)
+	}
+
+	client, err := s.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create ACME order: %w", err)
+	}
+	if order.Status == acme.StatusPending {
+		if err := s.completeAuthorizations(ctx, client, order, challenge, provider); err != nil {
+			return err
+		}
+	}
+	// Polled orders carry no Location header, keep the URL from the creation response
+	orderURL := order.URI
+	if order, err = client.WaitOrder(ctx, orderURL); err != nil {
+		return fmt.Errorf("ACME order failed: %w", err)
+	}
+
+	key, err := generateCertKey(keyType)
+	if err != nil {
+		return err
+	}
+	template := &x509.CertificateRequest{DNSNames: domains}
+	if len(domains[0]) <= 64 {
+		template.Subject = pkix.Name{CommonName: domains[0]}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return err
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// CAs finalizing asynchronously may answer without a Location header, which
+		// leaves the client polling an empty URL; poll the known order URL instead
+		valid, werr := client.WaitOrder(ctx, orderURL)
+		if werr != nil || valid.Status != acme.StatusValid {
+			return fmt.Errorf("failed to finalize ACME order: %w", err)
+		}
+		if der, err = client.FetchCert(ctx, valid.CertURL, true); err != nil {
+			return fmt.Errorf("failed to download certificate: %w", err)
+		}
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse issued certificate: %w", err)
+	}
+
+	paths, err := s.storeCertificate(certificateDirName(cert.Domain), der, key)
+	if err != nil {
+		return err
+	}
+
+	cert.CertPath = paths.fullchain
+	cert.KeyPath = paths.key
+	cert.ChainPath = paths.chain
+	applyCertificateMeta(cert, leaf)
+	cert.KeyType = keyType
+	cert.Challenge = challenge
+	cert.SANs = models.StringArray(domains[1:])
+
+	s.log.Info("ACME certificate issued", "domain", cert.Domain, "names", len(domains), "expires_at", leaf.NotAfter)
+	return nil
+}
+
+// completeAuthorizations answers every pending authorization of the order. All
+// challenges are prepared first so DNS propagation is only waited for once.
+func (s *NginxService) completeAuthorizations(ctx context.Context, client *acme.Client, order *acme.Order, challenge string, provider DNSProvider) error {
+	type pendingChallenge struct {
+		domain   string
+		authzURL string
+		chal     *acme.Challenge
+	}
+
+	var pending []pendingChallenge
+	var cleanups []func()
+	defer func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}()
+
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+
+		domain := z.Identifier.Value
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == challenge {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("%w: %s is not offered for %s", ErrUnsupportedChallenge, challenge, domain)
+		}
+
+		switch challenge {
+		case "http-01":
+			keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(s.cfg.ACME.WebrootDir, filepath.FromSlash(acmeChallengePath), chal.Token)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, []byte(keyAuth), 0644); err != nil {
+				return err
+			}
+			cleanups = append(cleanups, func() { os.Remove(path) })
+
+		case "dns-01":
+			value, err := client.DNS01ChallengeRecord(chal.Token)
+			if err != nil {
+				return err
+			}
+			fqdn := "_acme-challenge." + domain
+			if err := provider.Present(ctx, fqdn, value); err != nil {
+				return fmt.Errorf("failed to create DNS record for %s: %w", domain, err)
+			}
+			cleanups = append(cleanups, func() {
+				if err := provider.CleanUp(context.Background(), fqdn, value); err != nil {
+					s.log.Warn("Failed to remove ACME DNS record", "fqdn", fqdn, "error", err)
+				}
+			})
+		}
+
+		pending = append(pending, pendingChallenge{domain: domain, authzURL: z.URI, chal: chal})
+	}
+
+	if provider != nil && len(pending) > 0 {
+		select {
+		case <-time.After(provider.PropagationDelay()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, p := range pending {
+		if _, err := client.Accept(ctx, p.chal); err != nil {
+			return fmt.Errorf("failed to accept challenge for %s: %w", p.domain, err)
+		}
+		if _, err := client.WaitAuthorization(ctx, p.authzURL); err != nil {
+			return fmt.Errorf("validation failed for %s: %w", p.domain, err)
+		}
+	}
+	return nil
+}
+
+// prepareHTTPChallenge makes sure the sites serving the names include the ACME
+// challenge location, sites written by older versions may not have it yet
+func (s *NginxService) prepareHTTPChallenge(domains []string) {
+	names := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		names[d] = true
+	}
+
+	var sites []models.NginxSite
+	s.db.Where("enabled = ?", true).Find(&sites)
+
+	for i := range sites {
+		site := &sites[i]
+		covered := names[site.Domain]
+		for _, alias := range site.Aliases {
+			covered = covered || names[alias]
+		}
+		if !covered {
+			continue
+		}
+		if err := s.writeSiteConfig(site); err != nil {
+			s.log.Warn("Failed to write nginx config for ACME challenge", "site_id", site.ID, "error", err)
+		}
+	}
+}
+
+type certificatePaths struct {
+	fullchain string
+	chain     string
+	key       string
+}
+
+// storeCertificate writes the chain and key to the named directory under the certificate directory
+func (s *NginxService) storeCertificate(name string, der [][]byte, key crypto.Signer) (*certificatePaths, error) {
+	dir, err := filepath.Abs(filepath.Join(s.cfg.ACME.CertDir, name))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var leaf, chain []byte
+	for i, b := range der {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})
+		if i == 0 {
+			leaf = block
+		} else {
+			chain = append(chain, block...)
+		}
+	}
+
+	paths := &certificatePaths{
+		fullchain: filepath.Join(dir, "fullchain.pem"),
+		chain:     filepath.Join(dir, "chain.pem"),
+		key:       filepath.Join(dir, "privkey.pem"),
+	}
+
+	// The key goes first so the new certificate is never paired with the old key
+	if err := writePrivateKey(paths.key, key); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "cert.pem"), leaf, 0644); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(paths.chain, chain, 0644); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(paths.fullchain, append(leaf, chain...), 0644); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// certificateDomains returns the primary domain followed by the deduplicated SANs
+func certificateDomains(cert *models.SSLCertificate) []string {
+	seen := map[string]bool{}
+	var domains []string
+	for _, d := range append([]string{cert.Domain}, cert.SANs...) {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" && !seen[d] {
+			seen[d] = true
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// certificateDirName maps a domain to a directory name, wildcards become "_wildcard"
+func certificateDirName(domain string) string {
+	return strings.Replace(strings.ToLower(domain), "*", "_wildcard", 1)
+}
+
+// acmeHTTPClient trusts caFile in addition to the system roots, e.g. for Pebble
+func acmeHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{Timeout: 30 * time.Second}, nil
+	}
+
+	pemData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in ACME CA file %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func generateCertKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ec256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ec384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKeyType, keyType)
+	}
+}
+
+func writePrivateKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// loadPrivateKey reads a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(data)
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("unsupported private key type")
+			}
+			return signer, nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+}
+
+// Errors
+var (
+	ErrInvalidKeyType       = errors.New("invalid key type")
+	ErrUnknownDNSProvider   = errors.New("unknown DNS provider")
+	ErrUnsupportedChallenge = errors.New("unsupported ACME challenge")
+	ErrWildcardNeedsDNS     = errors.New("wildcard certificates require the dns-01 challenge")
+)
@@ -0,0 +1,303 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSProvider creates and removes the TXT records answering DNS-01 challenges
+type DNSProvider interface {
+	// Present creates a TXT record for fqdn (e.g. _acme-challenge.example.com) with value
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+	// PropagationDelay is how long to wait after Present before asking the CA to validate
+	PropagationDelay() time.Duration
+}
+
+// DNSProviderFactory creates a provider from its configuration, e.g. API credentials
+type DNSProviderFactory func(config map[string]string) (DNSProvider, error)
+
+var (
+	dnsProvidersMu sync.RWMutex
+	dnsProviders   = map[string]DNSProviderFactory{
+		"cloudflare":   newCloudflareDNSProvider,
+		"exec":         newExecDNSProvider,
+		"challtestsrv": newChallTestSrvDNSProvider,
+	}
+)
+
+// RegisterDNSProvider makes a DNS provider available for DNS-01 challenges
+func RegisterDNSProvider(name string, factory DNSProviderFactory) {
+	dnsProvidersMu.Lock()
+	defer dnsProvidersMu.Unlock()
+	dnsProviders[name] = factory
+}
+
+// DNSProviders returns the names of the registered DNS providers
+func DNSProviders() []string {
+	dnsProvidersMu.RLock()
+	defer dnsProvidersMu.RUnlock()
+
+	names := make([]string, 0, len(dnsProviders))
+	for name := range dnsProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newDNSProvider creates a registered provider, config values are converted to strings
+func newDNSProvider(name string, config map[string]interface{}) (DNSProvider, error) {
+	dnsProvidersMu.RLock()
+	factory, ok := dnsProviders[name]
+	dnsProvidersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDNSProvider, name)
+	}
+
+	values := make(map[string]string, len(config))
+	for k, v := range config {
+		values[k] = fmt.Sprint(v)
+	}
+	return factory(values)
+}
+
+// propagationDelay reads the propagation_seconds option, falling back to def
+func propagationDelay(config map[string]string, def time.Duration) time.Duration {
+	if v, err := strconv.Atoi(config["propagation_seconds"]); err == nil && v >= 0 {
+		return time.Duration(v) * time.Second
+	}
+	return def
+}
+
+// ============================================
+// Cloudflare
+// ============================================
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+type cloudflareDNSProvider struct {
+	token  string
+	zoneID string
+	delay  time.Duration
+}
+
+func newCloudflareDNSProvider(config map[string]string) (DNSProvider, error) {
+	if config["api_token"] == "" {
+		return nil, fmt.Errorf("cloudflare: api_token is required")
+	}
+	return &cloudflareDNSProvider{
+		token:  config["api_token"],
+		zoneID: config["zone_id"],
+		delay:  propagationDelay(config, 30*time.Second),
+	}, nil
+}
+
+func (p *cloudflareDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, http.MethodPost, "/zones/"+zone+"/dns_records", map[string]interface{}{
+		"type":    "TXT",
+		"name":    fqdn,
+		"content": value,
+		"ttl":     120,
+	}, nil)
+}
+
+func (p *cloudflareDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	zone, err := p.zone(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	var records []struct {
+		ID string `json:"id"`
+	}
+	query := url.Values{"type": {"TXT"}, "name": {fqdn}, "content": {value}}
+	if err := p.do(ctx, http.MethodGet, "/zones/"+zone+"/dns_records?"+query.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := p.do(ctx, http.MethodDelete, "/zones/"+zone+"/dns_records/"+r.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *cloudflareDNSProvider) PropagationDelay() time.Duration {
+	return p.delay
+}
+
+// zone finds the zone of fqdn by trying its parent domains from the longest
+func (p *cloudflareDNSProvider) zone(ctx context.Context, fqdn string) (string, error) {
+	if p.zoneID != "" {
+		return p.zoneID, nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 1; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		name := strings.Join(labels[i:], ".")
+		if err := p.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			p.zoneID = zones[0].ID
+			return p.zoneID, nil
+		}
+	}
+	return "", fmt.Errorf("cloudflare: no zone found for %s", fqdn)
+}
+
+func (p *cloudflareDNSProvider) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s", resp.Status)
+	}
+	if !envelope.Success {
+		var messages []string
+		for _, e := range envelope.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("cloudflare: %s", strings.Join(messages, "; "))
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+// ============================================
+// Exec
+// ============================================
+
+// execDNSProvider runs "<command> present|cleanup <fqdn> <value>", the convention
+// used by lego's exec provider, so existing hook scripts can be reused
+type execDNSProvider struct {
+	command string
+	delay   time.Duration
+}
+
+func newExecDNSProvider(config map[string]string) (DNSProvider, error) {
+	if config["command"] == "" {
+		return nil, fmt.Errorf("exec: command is required")
+	}
+	return &execDNSProvider{
+		command: config["command"],
+		delay:   propagationDelay(config, 60*time.Second),
+	}, nil
+}
+
+func (p *execDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *execDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p *execDNSProvider) PropagationDelay() time.Duration {
+	return p.delay
+}
+
+func (p *execDNSProvider) run(ctx context.Context, action, fqdn, value string) error {
+	output, err := exec.CommandContext(ctx, p.command, action, fqdn+".", value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec %s: %w: %s", action, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ============================================
+// Pebble challenge test server
+// ============================================
+
+// challTestSrvDNSProvider drives pebble-challtestsrv, for testing against a local Pebble CA
+type challTestSrvDNSProvider struct {
+	url string
+}
+
+func newChallTestSrvDNSProvider(config map[string]string) (DNSProvider, error) {
+	u := config["url"]
+	if u == "" {
+		u = "http://localhost:8055"
+	}
+	return &challTestSrvDNSProvider{url: strings.TrimSuffix(u, "/")}, nil
+}
+
+func (p *challTestSrvDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.post(ctx, "/set-txt", map[string]string{"host": fqdn + ".", "value": value})
+}
+
+func (p *challTestSrvDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.post(ctx, "/clear-txt", map[string]string{"host": fqdn + "."})
+}
+
+func (p *challTestSrvDNSProvider) PropagationDelay() time.Duration {
+	return 0
+}
+
+func (p *challTestSrvDNSProvider) post(ctx context.Context, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("challtestsrv: %s", resp.Status)
+	}
+	return nil
+}
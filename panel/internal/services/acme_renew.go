@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+const (
+	// Failed renewals are retried after an exponential, jittered backoff
+	renewBackoffBase = time.Hour
+	renewBackoffMax  = 24 * time.Hour
+
+	// Renewal failures are alerted once this many attempts in a row failed
+	renewAlertFailures = 3
+
+	// Expiry alerts for the same certificate are repeated at most this often
+	expiryAlertInterval = 24 * time.Hour
+
+	// How long renewal history is kept
+	renewalRetention = 180 * 24 * time.Hour
+)
+
+// ListRenewals returns the latest renewal attempts, of one certificate when certID is set
+func (s *NginxService) ListRenewals(certID string, limit int) ([]models.SSLRenewal, error) {
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	db := s.db.Model(&models.SSLRenewal{})
+	if certID != "" {
+		db = db.Where("certificate_id = ?", certID)
+	}
+
+	var renewals []models.SSLRenewal
+	if err := db.Order("created_at DESC").Limit(limit).Find(&renewals).Error; err != nil {
+		return nil, err
+	}
+	return renewals, nil
+}
+
+// renewLoop periodically renews auto-renew certificates that are close to expiry
+func (s *NginxService) renewLoop() {
+	interval := time.Duration(s.cfg.ACME.RenewInterval) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	// Spread the first check so panels restarted together do not hit the CA at once
+	time.Sleep(jitter(time.Minute))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.renewDue()
+		<-ticker.C
+	}
+}
+
+// renewDue renews the certificates inside the renewal window whose retry backoff has
+// passed, then reloads nginx once if an enabled site uses a replaced certificate
+func (s *NginxService) renewDue() {
+	now := time.Now()
+	window := time.Duration(s.cfg.ACME.RenewBeforeDays) * 24 * time.Hour
+
+	var certs []models.SSLCertificate
+	if err := s.db.Where("auto_renew = ? AND type = ? AND expires_at < ?", true, "letsencrypt", now.Add(window)).
+		Find(&certs).Error; err != nil {
+		s.log.Error("Failed to list certificates for renewal", "error", err)
+		return
+	}
+
+	reload := false
+	for i := range certs {
+		cert := &certs[i]
+		if cert.NextRenewAt != nil && cert.NextRenewAt.After(now) {
+			continue
+		}
+
+		changed, err := s.renewCertificate(cert, "auto")
+		if err != nil {
+			s.log.Warn("Automatic certificate renewal failed", "domain", cert.Domain, "failures", cert.RenewFailures, "error", err)
+			continue
+		}
+		if changed && s.certificateInUse(cert.ID) {
+			reload = true
+		}
+	}
+
+	if reload {
+		if err := s.Reload(); err != nil {
+			s.log.Error("Failed to reload nginx after certificate renewal", "error", err)
+		}
+	}
+
+	s.checkExpiry()
+	s.db.Where("created_at < ?", now.Add(-renewalRetention)).Delete(&models.SSLRenewal{})
+}
+
+// renewCertificate re-issues the certificate and records the attempt. It reports
+// whether the certificate on disk changed.
+func (s *NginxService) renewCertificate(cert *models.SSLCertificate, trigger string) (bool, error) {
+	s.renewMu.Lock()
+	defer s.renewMu.Unlock()
+
+	start := time.Now()
+	before := certificateFingerprint(cert.CertPath)
+	record := models.SSLRenewal{
+		CertificateID: cert.ID,
+		Domain:        cert.Domain,
+		Trigger:       trigger,
+		OldExpiresAt:  cert.ExpiresAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acmeIssueTimeout)
+	err := s.obtainCertificate(ctx, cert)
+	cancel()
+
+	record.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		cert.RenewFailures++
+		cert.LastRenewError = err.Error()
+		next := time.Now().Add(renewBackoff(cert.RenewFailures))
+		cert.NextRenewAt = &next
+
+		record.Status = "failed"
+		record.Error = err.Error()
+	} else {
+		now := time.Now()
+		cert.LastRenewed = &now
+		cert.RenewFailures = 0
+		cert.LastRenewError = ""
+		cert.NextRenewAt = nil
+		cert.LastAlertAt = nil
+
+		expires := cert.ExpiresAt
+		record.Status = "success"
+		record.NewExpiresAt = &expires
+		record.Changed = certificateFingerprint(cert.CertPath) != before
+	}
+
+	if saveErr := s.db.Save(cert).Error; saveErr != nil && err == nil {
+		err = saveErr
+	}
+	if createErr := s.db.Create(&record).Error; createErr != nil {
+		s.log.Error("Failed to record certificate renewal", "domain", cert.Domain, "error", createErr)
+	}
+
+	if err != nil && cert.RenewFailures >= renewAlertFailures {
+		s.alertExpiry(cert)
+	}
+	return record.Changed, err
+}
+
+// checkExpiry alerts about certificates nearing expiry that will not be renewed
+// automatically, renewal failures are alerted by renewCertificate
+func (s *NginxService) checkExpiry() {
+	warn := time.Duration(s.cfg.ACME.ExpiryWarnDays) * 24 * time.Hour
+	if warn <= 0 {
+		return
+	}
+
+	var certs []models.SSLCertificate
+	s.db.Where("expires_at < ? AND (auto_renew = ? OR type <> ?)", time.Now().Add(warn), false, "letsencrypt").Find(&certs)
+	for i := range certs {
+		s.alertExpiry(&certs[i])
+	}
+}
+
+// alertExpiry raises an "ssl" alert for the certificate, at most once per expiryAlertInterval
+func (s *NginxService) alertExpiry(cert *models.SSLCertificate) {
+	if s.notify == nil || cert.ExpiresAt.IsZero() {
+		return
+	}
+	if cert.LastAlertAt != nil && time.Since(*cert.LastAlertAt) < expiryAlertInterval {
+		return
+	}
+
+	left := time.Until(cert.ExpiresAt)
+	severity := "warning"
+	if left < 3*24*time.Hour {
+		severity = "critical"
+	}
+
+	var title, message string
+	switch {
+	case left <= 0:
+		title = fmt.Sprintf("SSL certificate for %s has expired", cert.Domain)
+		message = fmt.Sprintf("The certificate for %s expired at %s.", cert.Domain, cert.ExpiresAt.Format(time.RFC3339))
+	default:
+		title = fmt.Sprintf("SSL certificate for %s expires soon", cert.Domain)
+		message = fmt.Sprintf("The certificate for %s expires at %s, in %s.", cert.Domain,
+			cert.ExpiresAt.Format(time.RFC3339), left.Round(time.Hour))
+	}
+	if cert.RenewFailures > 0 {
+		message += fmt.Sprintf(" Automatic renewal failed %d times in a row, last error: %s", cert.RenewFailures, cert.LastRenewError)
+	} else if !cert.AutoRenew || cert.Type != "letsencrypt" {
+		message += " It is not renewed automatically."
+	}
+
+	if _, err := s.notify.Alert("ssl", severity, title, message); err != nil {
+		s.log.Error("Failed to raise certificate expiry alert", "domain", cert.Domain, "error", err)
+		return
+	}
+
+	now := time.Now()
+	cert.LastAlertAt = &now
+	s.db.Model(cert).Update("last_alert_at", now)
+}
+
+// certificateInUse reports whether an enabled site serves the certificate
+func (s *NginxService) certificateInUse(certID string) bool {
+	var count int64
+	s.db.Model(&models.NginxSite{}).Where("ssl_cert_id = ? AND enabled = ?", certID, true).Count(&count)
+	return count > 0
+}
+
+// certificateFingerprint hashes a certificate file, empty when it cannot be read
+func certificateFingerprint(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// renewBackoff returns the delay before retrying after the given number of failures
+func renewBackoff(failures int) time.Duration {
+	d := renewBackoffBase
+	for i := 1; i < failures && d < renewBackoffMax; i++ {
+		d *= 2
+	}
+	if d > renewBackoffMax {
+		d = renewBackoffMax
+	}
+	return jitter(d)
+}
+
+// jitter randomizes d by up to ±25%
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d*3/4 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
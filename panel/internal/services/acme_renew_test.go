@@ -0,0 +1,262 @@
+package services
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// withTestNotifications gives the service a notification service that records alerts
+func withTestNotifications(t *testing.T, s *NginxService) {
+	t.Helper()
+	if err := s.db.AutoMigrate(&models.Alert{}, &models.SystemSetting{}, &models.Notification{}); err != nil {
+		t.Fatal(err)
+	}
+	s.notify = NewNotificationService(s.db, s.log, NewSettingsService(s.db, s.cfg, s.log))
+}
+
+// testAlerts returns the titles of the raised alerts
+func testAlerts(t *testing.T, s *NginxService) []string {
+	t.Helper()
+	var alerts []models.Alert
+	if err := s.db.Order("created_at ASC").Find(&alerts).Error; err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, len(alerts))
+	for i, a := range alerts {
+		titles[i] = a.Severity + ": " + a.Title
+	}
+	return titles
+}
+
+// createTestCertificate stores a certificate, auto renew is written as given as gorm
+// replaces false with its default on create
+func createTestCertificate(t *testing.T, s *NginxService, cert models.SSLCertificate) *models.SSLCertificate {
+	t.Helper()
+	autoRenew := cert.AutoRenew
+	if err := s.db.Create(&cert).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Model(&cert).Update("auto_renew", autoRenew).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// reloads counts the reloads of the test nginx binary
+func reloads(t *testing.T, s *NginxService) int {
+	n := 0
+	for _, cmd := range nginxCommands(t, s) {
+		if strings.HasSuffix(cmd, "-s reload") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRenewBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, time.Hour},
+		{2, 2 * time.Hour},
+		{3, 4 * time.Hour},
+		{5, 16 * time.Hour},
+		{6, renewBackoffMax},
+		{50, renewBackoffMax},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := renewBackoff(tt.failures); d < tt.base*3/4 || d > tt.base*5/4 {
+				t.Fatalf("renewBackoff(%d) = %s, want %s ±25%%", tt.failures, d, tt.base)
+			}
+		}
+	}
+	if d := jitter(0); d != 0 {
+		t.Errorf("jitter(0) = %s", d)
+	}
+}
+
+func TestRenewDue(t *testing.T) {
+	s := newTestNginxService(t)
+	ca := newTestACME(t, s)
+	s.cfg.ACME.RenewBeforeDays = 30
+	s.cfg.ACME.ExpiryWarnDays = 14
+	withTestNotifications(t, s)
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+	expiring := func(domain string, days int) models.SSLCertificate {
+		return models.SSLCertificate{Domain: domain, Type: "letsencrypt", AutoRenew: true, ExpiresAt: now.Add(time.Duration(days) * 24 * time.Hour)}
+	}
+	due := createTestCertificate(t, s, expiring("due.example.com", 10))
+	unused := createTestCertificate(t, s, expiring("unused.example.com", 20))
+	notDue := createTestCertificate(t, s, expiring("later.example.com", 60))
+	backingOff := expiring("backoff.example.com", 5)
+	backingOff.RenewFailures, backingOff.NextRenewAt = 1, &later
+	createTestCertificate(t, s, backingOff)
+	optedOut := expiring("manual.example.com", 5)
+	optedOut.AutoRenew = false
+	createTestCertificate(t, s, optedOut)
+	custom := expiring("custom.example.com", 5)
+	custom.Type = "custom"
+	createTestCertificate(t, s, custom)
+
+	site := models.NginxSite{Domain: "due.example.com", Port: 443, SSLEnabled: true, SSLCertID: due.ID, RootPath: "/srv/due", Enabled: true}
+	if err := s.db.Create(&site).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	s.renewDue()
+
+	renewals, err := s.ListRenewals("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := map[string]models.SSLRenewal{}
+	for _, r := range renewals {
+		renewed[r.Domain] = r
+	}
+	if len(renewed) != 2 || renewed[due.Domain].Status != "success" || renewed[unused.Domain].Status != "success" {
+		t.Fatalf("renewals = %+v, want due and unused renewed", renewed)
+	}
+	for _, r := range renewed {
+		if !r.Changed || r.Trigger != "auto" || r.NewExpiresAt == nil || !r.NewExpiresAt.After(r.OldExpiresAt) {
+			t.Errorf("renewal of %s = %+v, want a changed certificate with a later expiry", r.Domain, r)
+		}
+	}
+	if got := ca.issued.Load(); got != 2 {
+		t.Errorf("%d certificates issued, want 2", got)
+	}
+	if got := reloads(t, s); got != 1 {
+		t.Errorf("nginx reloaded %d times, want once for the certificate in use", got)
+	}
+
+	var stored models.SSLCertificate
+	s.db.First(&stored, "id = ?", due.ID)
+	if time.Until(stored.ExpiresAt) < 80*24*time.Hour || stored.LastRenewed == nil {
+		t.Errorf("renewed certificate expires at %s, last renewed %v", stored.ExpiresAt, stored.LastRenewed)
+	}
+	var untouched models.SSLCertificate
+	s.db.First(&untouched, "id = ?", notDue.ID)
+	if untouched.LastRenewed != nil {
+		t.Errorf("certificate outside the renewal window renewed")
+	}
+
+	// The certificates that will not be renewed are alerted instead
+	alerts := testAlerts(t, s)
+	sort.Strings(alerts)
+	want := []string{"warning: SSL certificate for custom.example.com expires soon", "warning: SSL certificate for manual.example.com expires soon"}
+	if !reflect.DeepEqual(alerts, want) {
+		t.Errorf("alerts = %q, want %q", alerts, want)
+	}
+
+	// Nothing is due any more
+	s.renewDue()
+	if got := ca.issued.Load(); got != 2 {
+		t.Errorf("%d certificates issued after a second run, want 2", got)
+	}
+}
+
+func TestRenewCertificateFailures(t *testing.T) {
+	s := newTestNginxService(t)
+	ca := newTestACME(t, s)
+	withTestNotifications(t, s)
+	ca.fail.Store(true)
+
+	cert := createTestCertificate(t, s, models.SSLCertificate{Domain: "example.com", Type: "letsencrypt", AutoRenew: true,
+		ExpiresAt: time.Now().Add(10 * 24 * time.Hour)})
+
+	for failures := 1; failures <= renewAlertFailures+1; failures++ {
+		start := time.Now()
+		if _, err := s.renewCertificate(cert, "auto"); err == nil {
+			t.Fatal("renewCertificate() succeeded against a failing CA")
+		}
+
+		var stored models.SSLCertificate
+		s.db.First(&stored, "id = ?", cert.ID)
+		if stored.RenewFailures != failures || !strings.Contains(stored.LastRenewError, "refuses") {
+			t.Errorf("after %d failures: stored failures %d, error %q", failures, stored.RenewFailures, stored.LastRenewError)
+		}
+		backoff := renewBackoffBase << (failures - 1)
+		if stored.NextRenewAt == nil || stored.NextRenewAt.Before(start.Add(backoff*3/4)) || stored.NextRenewAt.After(time.Now().Add(backoff*5/4)) {
+			t.Errorf("after %d failures: next renewal at %v, want in %s", failures, stored.NextRenewAt, backoff)
+		}
+
+		// Failures are alerted from the third in a row, once a day
+		wantAlerts := 0
+		if failures >= renewAlertFailures {
+			wantAlerts = 1
+		}
+		if got := len(testAlerts(t, s)); got != wantAlerts {
+			t.Errorf("after %d failures: %d alerts, want %d", failures, got, wantAlerts)
+		}
+	}
+
+	var alert models.Alert
+	s.db.First(&alert)
+	if alert.Severity != "warning" || !strings.Contains(alert.Message, "failed 3 times in a row") {
+		t.Errorf("alert = %s: %s", alert.Severity, alert.Message)
+	}
+	var renewals int64
+	s.db.Model(&models.SSLRenewal{}).Where("certificate_id = ? AND status = ?", cert.ID, "failed").Count(&renewals)
+	if renewals != renewAlertFailures+1 {
+		t.Errorf("%d failed renewals recorded, want %d", renewals, renewAlertFailures+1)
+	}
+
+	// A success clears the failures
+	ca.fail.Store(false)
+	changed, err := s.renewCertificate(cert, "manual")
+	if err != nil || !changed {
+		t.Fatalf("renewCertificate() = %v, %v", changed, err)
+	}
+	var stored models.SSLCertificate
+	s.db.First(&stored, "id = ?", cert.ID)
+	if stored.RenewFailures != 0 || stored.LastRenewError != "" || stored.NextRenewAt != nil || stored.LastAlertAt != nil {
+		t.Errorf("after a success: failures %d, error %q, next %v, alerted %v", stored.RenewFailures, stored.LastRenewError, stored.NextRenewAt, stored.LastAlertAt)
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	s := newTestNginxService(t)
+	s.cfg.ACME.ExpiryWarnDays = 14
+	withTestNotifications(t, s)
+
+	now := time.Now()
+	for _, cert := range []models.SSLCertificate{
+		{Domain: "soon.example.com", Type: "custom", ExpiresAt: now.Add(10 * 24 * time.Hour)},
+		{Domain: "tomorrow.example.com", Type: "letsencrypt", ExpiresAt: now.Add(24 * time.Hour)},
+		{Domain: "expired.example.com", Type: "custom", ExpiresAt: now.Add(-time.Hour)},
+		{Domain: "renewed.example.com", Type: "letsencrypt", AutoRenew: true, ExpiresAt: now.Add(24 * time.Hour)},
+		{Domain: "fine.example.com", Type: "custom", ExpiresAt: now.Add(60 * 24 * time.Hour)},
+	} {
+		createTestCertificate(t, s, cert)
+	}
+
+	s.checkExpiry()
+	want := map[string]bool{
+		"warning: SSL certificate for soon.example.com expires soon":      true,
+		"critical: SSL certificate for tomorrow.example.com expires soon": true,
+		"critical: SSL certificate for expired.example.com has expired":   true,
+	}
+	alerts := testAlerts(t, s)
+	if len(alerts) != len(want) {
+		t.Errorf("alerts = %q, want %d", alerts, len(want))
+	}
+	for _, a := range alerts {
+		if !want[a] {
+			t.Errorf("unexpected alert %q", a)
+		}
+	}
+
+	// Alerts are repeated at most once a day
+	s.checkExpiry()
+	if got := len(testAlerts(t, s)); got != len(want) {
+		t.Errorf("%d alerts after a second check, want %d", got, len(want))
+	}
+}
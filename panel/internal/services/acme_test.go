@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// testACME is an ACME directory whose orders are ready without authorizations and
+// whose certificates are issued by a throwaway CA
+type testACME struct {
+	*httptest.Server
+	validity time.Duration // lifetime of issued certificates
+	fail     atomic.Bool   // reject new orders
+	issued   atomic.Int32
+
+	mu     sync.Mutex
+	chains map[string][]byte
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+}
+
+// newTestACME starts a test directory and points the service at it
+func newTestACME(t *testing.T, s *NginxService) *testACME {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour * 365),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testACME{validity: 90 * 24 * time.Hour, chains: map[string][]byte{}, caKey: caKey, caCert: caCert}
+	ca.Server = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.Close)
+
+	s.cfg.ACME.DirectoryURL = ca.URL + "/directory"
+	s.cfg.ACME.KeyType = "ec256"
+	return ca
+}
+
+func (ca *testACME) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	id := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+
+	switch {
+	case r.URL.Path == "/directory":
+		writeACME(w, http.StatusOK, map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/order",
+			"revokeCert": ca.URL + "/revoke",
+			"keyChange":  ca.URL + "/key-change",
+		})
+	case r.URL.Path == "/nonce":
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Path == "/account":
+		w.Header().Set("Location", ca.URL+"/account/1")
+		writeACME(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case r.URL.Path == "/order":
+		if ca.fail.Load() {
+			writeACME(w, http.StatusForbidden, map[string]string{
+				"type":   "urn:ietf:params:acme:error:rejectedIdentifier",
+				"detail": "the CA refuses to issue for this name",
+			})
+			return
+		}
+		id := fmt.Sprint(time.Now().UnixNano())
+		w.Header().Set("Location", ca.URL+"/order/"+id)
+		writeACME(w, http.StatusCreated, ca.order(id, "ready"))
+	case strings.HasPrefix(r.URL.Path, "/order/"):
+		status := "ready"
+		ca.mu.Lock()
+		if ca.chains[id] != nil {
+			status = "valid"
+		}
+		ca.mu.Unlock()
+		writeACME(w, http.StatusOK, ca.order(id, status))
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		if err := ca.finalize(id, r); err != nil {
+			writeACME(w, http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()})
+			return
+		}
+		w.Header().Set("Location", ca.URL+"/order/"+id)
+		writeACME(w, http.StatusOK, ca.order(id, "valid"))
+	case strings.HasPrefix(r.URL.Path, "/cert/"):
+		ca.mu.Lock()
+		chain := ca.chains[id]
+		ca.mu.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *testACME) order(id, status string) map[string]interface{} {
+	order := map[string]interface{}{
+		"status":         status,
+		"identifiers":    []interface{}{},
+		"authorizations": []string{},
+		"finalize":       ca.URL + "/finalize/" + id,
+	}
+	if status == "valid" {
+		order["certificate"] = ca.URL + "/cert/" + id
+	}
+	return order
+}
+
+// finalize signs the CSR in the JWS payload of the request
+func (ca *testACME) finalize(id string, r *http.Request) error {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+
+	n := ca.issued.Add(1)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(n) + 1),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		return err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+
+	ca.mu.Lock()
+	ca.chains[id] = chain
+	ca.mu.Unlock()
+	return nil
+}
+
+func writeACME(w http.ResponseWriter, status int, v interface{}) {
+	if status >= 400 {
+		w.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestCreateCertificate(t *testing.T) {
+	tests := []struct {
+		name      string
+		autoRenew bool
+	}{
+		{"auto renew", true},
+		{"opted out of auto renew", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNginxService(t)
+			ca := newTestACME(t, s)
+
+			cert := &models.SSLCertificate{Type: "letsencrypt", Domain: "Example.com", SANs: []string{"www.example.com", "example.com"}, AutoRenew: tt.autoRenew}
+			if err := s.CreateCertificate(cert); err != nil {
+				t.Fatal(err)
+			}
+
+			var stored models.SSLCertificate
+			if err := s.db.First(&stored, "id = ?", cert.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if stored.AutoRenew != tt.autoRenew {
+				t.Errorf("stored auto renew = %v, want %v", stored.AutoRenew, tt.autoRenew)
+			}
+			if d := time.Until(stored.ExpiresAt); d < ca.validity-time.Hour || d > ca.validity {
+				t.Errorf("expires in %s, want %s", d, ca.validity)
+			}
+			if stored.KeyType != "ec256" || stored.Challenge != "http-01" || stored.Issuer != "Test ACME CA" {
+				t.Errorf("stored key type %q, challenge %q, issuer %q", stored.KeyType, stored.Challenge, stored.Issuer)
+			}
+
+			leaf, err := loadLeafCertificate(stored.CertPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"example.com", "www.example.com"}; strings.Join(leaf.DNSNames, " ") != strings.Join(want, " ") {
+				t.Errorf("certificate names = %q, want %q", leaf.DNSNames, want)
+			}
+			if _, err := os.Stat(stored.KeyPath); err != nil {
+				t.Errorf("key not stored: %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateCertificateRejected(t *testing.T) {
+	s := newTestNginxService(t)
+	ca := newTestACME(t, s)
+	ca.fail.Store(true)
+
+	err := s.CreateCertificate(&models.SSLCertificate{Type: "letsencrypt", Domain: "example.com"})
+	if err == nil || !strings.Contains(err.Error(), "refuses") {
+		t.Errorf("CreateCertificate() error = %v, want the CA's problem", err)
+	}
+	var count int64
+	s.db.Model(&models.SSLCertificate{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d certificates stored after a rejected order", count)
+	}
+}
+
+func TestObtainCertificateChecks(t *testing.T) {
+	tests := []struct {
+		name string
+		cert models.SSLCertificate
+		want error
+	}{
+		{"wildcard over http", models.SSLCertificate{Domain: "*.example.com"}, ErrWildcardNeedsDNS},
+		{"wildcard name over http", models.SSLCertificate{Domain: "example.com", SANs: []string{"*.example.com"}}, ErrWildcardNeedsDNS},
+		{"key type", models.SSLCertificate{Domain: "example.com", KeyType: "dsa"}, ErrInvalidKeyType},
+		{"challenge", models.SSLCertificate{Domain: "example.com", Challenge: "tls-alpn-01"}, ErrUnsupportedChallenge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNginxService(t)
+			s.cfg.ACME.KeyType = "ec256"
+			if err := s.obtainCertificate(context.Background(), &tt.cert); !errors.Is(err, tt.want) {
+				t.Errorf("obtainCertificate() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/vpanel/server/internal/config"
@@ -52,21 +53,21 @@ func NewContainer(db *gorm.DB, cfg *config.Config, log *logger.Logger) *Containe
 	c.Node = NewNodeService(db, log)
 	c.Monitor = NewMonitorService(db, log)
 
+	// Initialize support services
+	c.Plugin = NewPluginService(db, log)
+	c.Settings = NewSettingsService(db, cfg, log)
+	c.Audit = NewAuditService(db, log)
+	c.Notification = NewNotificationService(db, log, c.Settings)
+
 	// Initialize feature services
-	c.Docker = NewDockerService(db, log)
-	c.Nginx = NewNginxService(db, log)
-	c.Database = NewDatabaseService(db, log)
+	c.Docker = NewDockerService(db, log, c.Settings, c.Notification)
+	c.Nginx = NewNginxService(db, cfg, log, c.Notification, c.Docker)
+	c.Database = NewDatabaseService(db, log, c.Settings)
 	c.File = NewFileService(db, cfg, log)
 	c.Terminal = NewTerminalService(log)
 	c.Cron = NewCronService(db, log)
 	c.Firewall = NewFirewallService(db, log)
-	c.Software = NewSoftwareService(db, log)
-
-	// Initialize support services
-	c.Plugin = NewPluginService(db, log)
-	c.Settings = NewSettingsService(db, log)
-	c.Audit = NewAuditService(db, log)
-	c.Notification = NewNotificationService(db, log)
+	c.Software = NewSoftwareService(db, cfg, log, c.Docker, c.Nginx)
 
 	return c
 }
@@ -112,13 +113,14 @@ func NewNodeService(db *gorm.DB, log *logger.Logger) *NodeService {
 
 // DatabaseService manages database servers
 type DatabaseService struct {
-	db  *gorm.DB
-	log *logger.Logger
+	db       *gorm.DB
+	log      *logger.Logger
+	settings *SettingsService
 }
 
 // NewDatabaseService creates a new database service
-func NewDatabaseService(db *gorm.DB, log *logger.Logger) *DatabaseService {
-	return &DatabaseService{db: db, log: log}
+func NewDatabaseService(db *gorm.DB, log *logger.Logger, settings *SettingsService) *DatabaseService {
+	return &DatabaseService{db: db, log: log, settings: settings}
 }
 
 // ============================================
@@ -338,16 +340,7 @@ func (s *FirewallService) GetBackend() FirewallBackend {
 // Software Service
 // ============================================
 
-// SoftwareService manages software installation
-type SoftwareService struct {
-	db  *gorm.DB
-	log *logger.Logger
-}
-
-// NewSoftwareService creates a new software service
-func NewSoftwareService(db *gorm.DB, log *logger.Logger) *SoftwareService {
-	return &SoftwareService{db: db, log: log}
-}
+// SoftwareService implementation is in software.go
 
 // ============================================
 // Plugin Service
@@ -371,12 +364,46 @@ func NewPluginService(db *gorm.DB, log *logger.Logger) *PluginService {
 // SettingsService manages system settings
 type SettingsService struct {
 	db  *gorm.DB
+	cfg *config.Config
 	log *logger.Logger
 }
 
 // NewSettingsService creates a new settings service
-func NewSettingsService(db *gorm.DB, log *logger.Logger) *SettingsService {
-	return &SettingsService{db: db, log: log}
+func NewSettingsService(db *gorm.DB, cfg *config.Config, log *logger.Logger) *SettingsService {
+	return &SettingsService{db: db, cfg: cfg, log: log}
+}
+
+// GetString returns a setting value, or defaultValue when it is not set
+func (s *SettingsService) GetString(key, defaultValue string) string {
+	var setting models.SystemSetting
+	if err := s.db.Where("key = ?", key).Limit(1).Find(&setting).Error; err != nil || setting.Value == "" {
+		return defaultValue
+	}
+	return setting.Value
+}
+
+// GetBool returns a boolean setting, or defaultValue when it is not set
+func (s *SettingsService) GetBool(key string, defaultValue bool) bool {
+	value := s.GetString(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	return value == "true"
+}
+
+// GetInt returns an integer setting, or defaultValue when it is not set or invalid
+func (s *SettingsService) GetInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(s.GetString(key, ""))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// BackupDir returns the backup storage location, the backup_path setting
+// falling back to the configured storage directory
+func (s *SettingsService) BackupDir() string {
+	return s.GetString("backup_path", s.cfg.Storage.BackupDir)
 }
 
 // ============================================
@@ -600,13 +627,4 @@ func (s *AuditService) GetDistinctResources() ([]string, error) {
 // Notification Service
 // ============================================
 
-// NotificationService handles notifications
-type NotificationService struct {
-	db  *gorm.DB
-	log *logger.Logger
-}
-
-// NewNotificationService creates a new notification service
-func NewNotificationService(db *gorm.DB, log *logger.Logger) *NotificationService {
-	return &NotificationService{db: db, log: log}
-}
+// NotificationService implementation is in notification.go
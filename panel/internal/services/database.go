@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"path/filepath"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib" // PostgreSQL driver
@@ -248,8 +249,8 @@ func (s *DatabaseService) CreateBackup(serverID, database string, backupType str
 		fileName = fmt.Sprintf("%s_%s_%s.tar.gz", server.Name, dbName, timestamp)
 	}
 
-	// Determine backup path (use config storage path if available)
-	backupPath := fmt.Sprintf("./backups/%s/%s", serverID, fileName)
+	// Backups live in the shared backup storage location
+	backupPath := filepath.Join(s.settings.BackupDir(), "databases", serverID, fileName)
 
 	// Create backup record
 	backup := &models.DatabaseBackup{
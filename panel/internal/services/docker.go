@@ -1,13 +1,16 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -16,6 +19,7 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/robfig/cron/v3"
 	"github.com/vpanel/server/internal/models"
 	"github.com/vpanel/server/pkg/logger"
 	"gorm.io/gorm"
@@ -23,18 +27,44 @@ import (
 
 // DockerService manages Docker containers
 type DockerService struct {
-	db     *gorm.DB
-	log    *logger.Logger
-	client *client.Client
+	db       *gorm.DB
+	log      *logger.Logger
+	client   *client.Client
+	settings *SettingsService
+	notify   *NotificationService
+	events   *dockerEventHub
+
+	scheduler  *cron.Cron
+	pruneEntry cron.EntryID
+	pruneMu    sync.Mutex
 }
 
 // NewDockerService creates a new docker service
-func NewDockerService(db *gorm.DB, log *logger.Logger) *DockerService {
+func NewDockerService(db *gorm.DB, log *logger.Logger, settings *SettingsService, notify *NotificationService) *DockerService {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		log.Warn("Failed to connect to Docker", "error", err)
 	}
-	return &DockerService{db: db, log: log, client: cli}
+	svc := &DockerService{
+		db:        db,
+		log:       log,
+		client:    cli,
+		settings:  settings,
+		notify:    notify,
+		events:    newDockerEventHub(),
+		scheduler: cron.New(cron.WithSeconds()),
+	}
+
+	// Run the scheduled prune policy
+	svc.scheduler.Start()
+	go svc.loadPrunePolicy()
+
+	// Record daemon events in the background
+	if cli != nil {
+		go svc.watchEvents()
+	}
+
+	return svc
 }
 
 // ContainerInfo represents container information
@@ -557,20 +587,6 @@ func (s *DockerService) RemoveVolume(ctx context.Context, name string, force boo
 	return s.client.VolumeRemove(ctx, name, force)
 }
 
-// PruneImages removes unused images
-func (s *DockerService) PruneImages(ctx context.Context) (uint64, error) {
-	if s.client == nil {
-		return 0, ErrDockerNotConnected
-	}
-
-	report, err := s.client.ImagesPrune(ctx, filters.Args{})
-	if err != nil {
-		return 0, err
-	}
-
-	return report.SpaceReclaimed, nil
-}
-
 // ComposeProjectInfo represents compose project information
 type ComposeProjectInfo struct {
 	ID          string `json:"id"`
@@ -578,6 +594,8 @@ type ComposeProjectInfo struct {
 	Path        string `json:"path"`
 	Status      string `json:"status"`
 	Description string `json:"description"`
+	Version     int    `json:"version"`
+	Imported    bool   `json:"imported"`
 	Created     string `json:"created"`
 	Updated     string `json:"updated"`
 }
@@ -592,7 +610,7 @@ func (s *DockerService) ListComposeProjects(ctx context.Context) ([]ComposeProje
 	result := make([]ComposeProjectInfo, len(projects))
 	for i, p := range projects {
 		// Check actual status by checking if containers are running
-		status := s.checkComposeStatus(ctx, p.Path, p.Name)
+		status := s.checkComposeStatus(ctx, p.Path, p.ProjectName)
 
 		result[i] = ComposeProjectInfo{
 			ID:          p.ID,
@@ -600,6 +618,8 @@ func (s *DockerService) ListComposeProjects(ctx context.Context) ([]ComposeProje
 			Path:        p.Path,
 			Status:      status,
 			Description: p.Description,
+			Version:     p.Version,
+			Imported:    p.Imported,
 			Created:     p.CreatedAt.Format(time.RFC3339),
 			Updated:     p.UpdatedAt.Format(time.RFC3339),
 		}
@@ -609,30 +629,49 @@ func (s *DockerService) ListComposeProjects(ctx context.Context) ([]ComposeProje
 }
 
 // CreateComposeProject creates a new compose project
-func (s *DockerService) CreateComposeProject(ctx context.Context, name, path, content, description string) (*models.DockerComposeProject, error) {
-	// Ensure directory exists
-	if err := os.MkdirAll(path, 0755); err != nil {
+func (s *DockerService) CreateComposeProject(ctx context.Context, name, path, content, envContent, description, createdBy string) (*models.DockerComposeProject, error) {
+	// Names that normalize to the same project name would share containers and volumes
+	projectName := composeProjectName(name)
+	if projectName == "" {
+		return nil, fmt.Errorf("%w: project name %q has no letters or digits", ErrComposeInvalid, name)
+	}
+	if err := s.checkComposeProjectFree(ctx, projectName); err != nil {
 		return nil, err
 	}
 
-	// Write docker-compose.yml file
-	composeFile := filepath.Join(path, "docker-compose.yml")
-	if err := os.WriteFile(composeFile, []byte(content), 0644); err != nil {
+	// Validate before touching the filesystem
+	if _, err := s.ValidateCompose(ctx, path, content, envContent); err != nil {
+		return nil, err
+	}
+
+	// Ensure directory exists
+	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
 
 	project := &models.DockerComposeProject{
 		Name:        name,
+		ProjectName: projectName,
 		Path:        path,
+		ComposeFile: defaultComposeFile,
 		Content:     content,
+		EnvContent:  envContent,
 		Description: description,
 		Status:      "stopped",
+		Version:     1,
+	}
+
+	// Write docker-compose.yml and .env files
+	if err := writeComposeFiles(project); err != nil {
+		return nil, err
 	}
 
 	if err := s.db.Create(project).Error; err != nil {
 		return nil, err
 	}
 
+	s.saveComposeRevision(project, "Initial version", createdBy)
+
 	return project, nil
 }
 
@@ -643,24 +682,33 @@ func (s *DockerService) RemoveComposeProject(ctx context.Context, id string) err
 		return err
 	}
 
-	// Stop and remove containers first
-	s.execComposeCommand(ctx, project.Path, "down", "-v")
+	if project.Imported {
+		// Imported projects own their files and volumes, only stop the containers
+		s.execComposeCommand(ctx, project.Path, nil, composeArgs(&project, "down")...)
+	} else {
+		// Stop and remove containers first
+		s.execComposeCommand(ctx, project.Path, nil, composeArgs(&project, "down", "-v")...)
 
-	// Remove compose file
-	composeFile := filepath.Join(project.Path, "docker-compose.yml")
-	os.Remove(composeFile)
+		// Remove compose files
+		os.Remove(composeFilePath(&project))
+		if project.EnvContent != "" {
+			os.Remove(filepath.Join(project.Path, composeEnvFile))
+		}
+	}
+
+	s.db.Where("project_id = ?", project.ID).Delete(&models.DockerComposeRevision{})
 
 	return s.db.Delete(&project).Error
 }
 
-// ComposeUp starts a compose project
-func (s *DockerService) ComposeUp(ctx context.Context, id string) error {
+// ComposeUp starts a compose project, writing command output to out
+func (s *DockerService) ComposeUp(ctx context.Context, id string, out io.Writer) error {
 	var project models.DockerComposeProject
 	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
 		return err
 	}
 
-	if err := s.execComposeCommand(ctx, project.Path, "up", "-d"); err != nil {
+	if err := s.execComposeCommand(ctx, project.Path, out, composeArgs(&project, "up", "-d")...); err != nil {
 		return err
 	}
 
@@ -669,14 +717,14 @@ func (s *DockerService) ComposeUp(ctx context.Context, id string) error {
 	return nil
 }
 
-// ComposeDown stops a compose project
-func (s *DockerService) ComposeDown(ctx context.Context, id string) error {
+// ComposeDown stops a compose project, writing command output to out
+func (s *DockerService) ComposeDown(ctx context.Context, id string, out io.Writer) error {
 	var project models.DockerComposeProject
 	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
 		return err
 	}
 
-	if err := s.execComposeCommand(ctx, project.Path, "down"); err != nil {
+	if err := s.execComposeCommand(ctx, project.Path, out, composeArgs(&project, "down")...); err != nil {
 		return err
 	}
 
@@ -686,7 +734,7 @@ func (s *DockerService) ComposeDown(ctx context.Context, id string) error {
 }
 
 // Helper functions for compose
-func (s *DockerService) execComposeCommand(ctx context.Context, workDir string, args ...string) error {
+func (s *DockerService) composeCommand(ctx context.Context, workDir string, args ...string) (*exec.Cmd, error) {
 	// Try docker compose first (newer), fallback to docker-compose
 	var cmd *exec.Cmd
 	if _, err := exec.LookPath("docker"); err == nil {
@@ -694,19 +742,66 @@ func (s *DockerService) execComposeCommand(ctx context.Context, workDir string,
 	} else if _, err := exec.LookPath("docker-compose"); err == nil {
 		cmd = exec.CommandContext(ctx, "docker-compose", args...)
 	} else {
-		return newError("docker compose or docker-compose not found")
+		return nil, ErrComposeNotFound
 	}
 
 	cmd.Dir = workDir
+	return cmd, nil
+}
+
+// execComposeCommand runs a compose command. When out is nil the combined output
+// is collected and attached to the returned error, otherwise it is streamed to out.
+func (s *DockerService) execComposeCommand(ctx context.Context, workDir string, out io.Writer, args ...string) error {
+	cmd, err := s.composeCommand(ctx, workDir, args...)
+	if err != nil {
+		return err
+	}
+
+	if out != nil {
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			s.log.Error("Compose command failed", "args", args, "error", err)
+			return err
+		}
+		return nil
+	}
+
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		s.log.Error("Compose command failed", "error", err, "output", string(output))
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
 		return err
 	}
 	return nil
 }
 
+// composeOutput runs a compose command and returns its standard output
+func (s *DockerService) composeOutput(ctx context.Context, workDir string, args ...string) (string, error) {
+	cmd, err := s.composeCommand(ctx, workDir, args...)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
 func (s *DockerService) checkComposeStatus(ctx context.Context, path, projectName string) string {
+	if s.client == nil {
+		return "unknown"
+	}
+
 	// Check if containers are running by looking for containers with the project label
 	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
 		All: true,
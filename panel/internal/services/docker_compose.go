@@ -0,0 +1,690 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/diff"
+)
+
+const (
+	defaultComposeFile = "docker-compose.yml"
+	composeEnvFile     = ".env"
+
+	// Number of revisions kept per compose project
+	maxComposeRevisions = 50
+
+	composeProjectLabel    = "com.docker.compose.project"
+	composeServiceLabel    = "com.docker.compose.service"
+	composeWorkingDirLabel = "com.docker.compose.project.working_dir"
+	composeConfigLabel     = "com.docker.compose.project.config_files"
+	composeNumberLabel     = "com.docker.compose.container-number"
+)
+
+// ComposeRevisionDiff represents the difference between two revisions
+type ComposeRevisionDiff struct {
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	Compose string `json:"compose"`
+	Env     string `json:"env"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// ComposeServiceInfo represents a service defined in a compose project
+type ComposeServiceInfo struct {
+	Name       string                 `json:"name"`
+	Image      string                 `json:"image"`
+	State      string                 `json:"state"` // running, stopped, partial
+	Replicas   int                    `json:"replicas"`
+	Running    int                    `json:"running"`
+	Containers []ComposeContainerInfo `json:"containers"`
+}
+
+// ComposeContainerInfo represents a container belonging to a compose service
+type ComposeContainerInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Number string `json:"number"`
+	State  string `json:"state"`
+	Status string `json:"status"`
+}
+
+// DiscoveredComposeProject represents a compose project found through container labels
+type DiscoveredComposeProject struct {
+	Name        string   `json:"name"`
+	WorkingDir  string   `json:"working_dir"`
+	ConfigFiles []string `json:"config_files"`
+	Services    []string `json:"services"`
+	Containers  int      `json:"containers"`
+	Running     int      `json:"running"`
+	Managed     bool     `json:"managed"`
+}
+
+// GetComposeProject returns a compose project with its current status
+func (s *DockerService) GetComposeProject(ctx context.Context, id string) (*models.DockerComposeProject, error) {
+	var project models.DockerComposeProject
+	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	project.Status = s.checkComposeStatus(ctx, project.Path, project.ProjectName)
+	return &project, nil
+}
+
+// ValidateCompose validates compose and env content with `docker compose config`
+// and returns the normalized configuration. Relative paths are resolved against dir.
+func (s *DockerService) ValidateCompose(ctx context.Context, dir, content, envContent string) (string, error) {
+	if strings.TrimSpace(content) == "" {
+		return "", fmt.Errorf("%w: compose file is empty", ErrComposeInvalid)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "vpanel-compose-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	composePath := filepath.Join(tmpDir, defaultComposeFile)
+	if err := os.WriteFile(composePath, []byte(content), 0600); err != nil {
+		return "", err
+	}
+	envPath := filepath.Join(tmpDir, composeEnvFile)
+	if err := os.WriteFile(envPath, []byte(envContent), 0600); err != nil {
+		return "", err
+	}
+
+	projectDir := tmpDir
+	if dir != "" {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			projectDir = dir
+		}
+	}
+
+	cmd, err := s.composeCommand(ctx, projectDir,
+		"--project-directory", projectDir, "-f", composePath, "--env-file", envPath, "config")
+	if err != nil {
+		return "", err
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(strings.ReplaceAll(string(output), composePath, defaultComposeFile))
+		return "", fmt.Errorf("%w: %s", ErrComposeInvalid, msg)
+	}
+
+	return string(output), nil
+}
+
+// UpdateComposeProject validates and writes new compose and env content, recording a revision
+func (s *DockerService) UpdateComposeProject(ctx context.Context, id, content, envContent, message, updatedBy string) (*models.DockerComposeProject, error) {
+	var project models.DockerComposeProject
+	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	// Nothing changed, keep the current revision
+	if project.Content == content && project.EnvContent == envContent {
+		return &project, nil
+	}
+
+	if _, err := s.ValidateCompose(ctx, project.Path, content, envContent); err != nil {
+		return nil, err
+	}
+
+	hadEnv := project.EnvContent != ""
+	project.Content = content
+	project.EnvContent = envContent
+	project.Version++
+
+	if err := writeComposeFiles(&project); err != nil {
+		return nil, err
+	}
+	if hadEnv && envContent == "" {
+		os.Remove(filepath.Join(project.Path, composeEnvFile))
+	}
+
+	if err := s.db.Model(&project).Updates(map[string]interface{}{
+		"content":     project.Content,
+		"env_content": project.EnvContent,
+		"version":     project.Version,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if message == "" {
+		message = fmt.Sprintf("Update to version %d", project.Version)
+	}
+	s.saveComposeRevision(&project, message, updatedBy)
+
+	return &project, nil
+}
+
+// ListComposeRevisions returns the revision history of a compose project
+func (s *DockerService) ListComposeRevisions(projectID string) ([]models.DockerComposeRevision, error) {
+	var revisions []models.DockerComposeRevision
+	if err := s.db.Where("project_id = ?", projectID).Order("version DESC").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// GetComposeRevision returns a specific revision of a compose project
+func (s *DockerService) GetComposeRevision(projectID string, version int) (*models.DockerComposeRevision, error) {
+	var revision models.DockerComposeRevision
+	if err := s.db.Where("project_id = ? AND version = ?", projectID, version).First(&revision).Error; err != nil {
+		return nil, ErrComposeRevisionNotFound
+	}
+	return &revision, nil
+}
+
+// DiffComposeRevisions returns a unified diff between two revisions.
+// A "to" version of 0 compares against the current project content.
+func (s *DockerService) DiffComposeRevisions(projectID string, from, to int) (*ComposeRevisionDiff, error) {
+	var project models.DockerComposeProject
+	if err := s.db.First(&project, "id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+
+	fromRev, err := s.GetComposeRevision(projectID, from)
+	if err != nil {
+		return nil, err
+	}
+
+	toContent, toEnv := project.Content, project.EnvContent
+	if to == 0 {
+		to = project.Version
+	} else {
+		toRev, err := s.GetComposeRevision(projectID, to)
+		if err != nil {
+			return nil, err
+		}
+		toContent, toEnv = toRev.Content, toRev.EnvContent
+	}
+
+	fromLabel := fmt.Sprintf("v%d", from)
+	toLabel := fmt.Sprintf("v%d", to)
+	edits := diff.Lines(diff.SplitLines(fromRev.Content), diff.SplitLines(toContent))
+	envEdits := diff.Lines(diff.SplitLines(fromRev.EnvContent), diff.SplitLines(toEnv))
+	result := &ComposeRevisionDiff{
+		From:    from,
+		To:      to,
+		Compose: diff.UnifiedEdits(fromLabel+"/"+defaultComposeFile, toLabel+"/"+defaultComposeFile, edits, 3),
+		Env:     diff.UnifiedEdits(fromLabel+"/"+composeEnvFile, toLabel+"/"+composeEnvFile, envEdits, 3),
+	}
+
+	added, removed := diff.Stats(edits)
+	envAdded, envRemoved := diff.Stats(envEdits)
+	result.Added = added + envAdded
+	result.Removed = removed + envRemoved
+
+	return result, nil
+}
+
+// RollbackComposeProject restores the content of a previous revision as a new revision
+func (s *DockerService) RollbackComposeProject(ctx context.Context, projectID string, version int, updatedBy string) (*models.DockerComposeProject, error) {
+	revision, err := s.GetComposeRevision(projectID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.UpdateComposeProject(ctx, projectID, revision.Content, revision.EnvContent,
+		fmt.Sprintf("Rollback to version %d", version), updatedBy)
+}
+
+// ComposePull pulls the images of a compose project, writing command output to out
+func (s *DockerService) ComposePull(ctx context.Context, id string, out io.Writer) error {
+	var project models.DockerComposeProject
+	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	return s.execComposeCommand(ctx, project.Path, out, composeArgs(&project, "pull")...)
+}
+
+// ListComposeServices returns the services of a compose project with their containers
+func (s *DockerService) ListComposeServices(ctx context.Context, id string) ([]ComposeServiceInfo, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	var project models.DockerComposeProject
+	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	names, err := s.composeServiceNames(ctx, &project)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]*ComposeServiceInfo, len(names))
+	result := make([]*ComposeServiceInfo, 0, len(names))
+	for _, name := range names {
+		svc := &ComposeServiceInfo{Name: name, Containers: []ComposeContainerInfo{}}
+		services[name] = svc
+		result = append(result, svc)
+	}
+
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", composeProjectLabel+"="+project.ProjectName),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range containers {
+		name := c.Labels[composeServiceLabel]
+		svc, ok := services[name]
+		if !ok {
+			// Orphaned service no longer present in the compose file
+			svc = &ComposeServiceInfo{Name: name, Containers: []ComposeContainerInfo{}}
+			services[name] = svc
+			result = append(result, svc)
+		}
+
+		containerName := ""
+		if len(c.Names) > 0 {
+			containerName = strings.TrimPrefix(c.Names[0], "/")
+		}
+
+		svc.Image = c.Image
+		svc.Replicas++
+		if c.State == "running" {
+			svc.Running++
+		}
+		svc.Containers = append(svc.Containers, ComposeContainerInfo{
+			ID:     c.ID[:12],
+			Name:   containerName,
+			Number: c.Labels[composeNumberLabel],
+			State:  mapContainerState(c.State),
+			Status: c.Status,
+		})
+	}
+
+	list := make([]ComposeServiceInfo, len(result))
+	for i, svc := range result {
+		switch {
+		case svc.Running == 0:
+			svc.State = "stopped"
+		case svc.Running == svc.Replicas:
+			svc.State = "running"
+		default:
+			svc.State = "partial"
+		}
+		list[i] = *svc
+	}
+
+	return list, nil
+}
+
+// ComposeServiceAction starts, stops or restarts a single service of a compose project
+func (s *DockerService) ComposeServiceAction(ctx context.Context, id, service, action string, out io.Writer) error {
+	switch action {
+	case "start", "stop", "restart":
+	default:
+		return ErrInvalidComposeAction
+	}
+
+	project, err := s.composeProjectWithService(ctx, id, service)
+	if err != nil {
+		return err
+	}
+
+	return s.execComposeCommand(ctx, project.Path, out, composeArgs(project, action, service)...)
+}
+
+// ComposeServiceLogs writes the logs of a compose service to out, optionally following new output
+func (s *DockerService) ComposeServiceLogs(ctx context.Context, id, service string, tail int, follow bool, out io.Writer) error {
+	project, err := s.composeProjectWithService(ctx, id, service)
+	if err != nil {
+		return err
+	}
+
+	if tail <= 0 {
+		tail = 500
+	}
+
+	args := []string{"logs", "--no-color", "--timestamps", "--tail", fmt.Sprintf("%d", tail)}
+	if follow {
+		args = append(args, "--follow")
+	}
+	args = append(args, service)
+
+	cmd, err := s.composeCommand(ctx, project.Path, composeArgs(project, args...)...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// ComposeScale sets the number of containers running for a compose service
+func (s *DockerService) ComposeScale(ctx context.Context, id, service string, replicas int, out io.Writer) error {
+	if replicas < 0 || replicas > 100 {
+		return ErrInvalidReplicas
+	}
+
+	project, err := s.composeProjectWithService(ctx, id, service)
+	if err != nil {
+		return err
+	}
+
+	return s.execComposeCommand(ctx, project.Path, out, composeArgs(project,
+		"up", "-d", "--no-recreate", "--scale", fmt.Sprintf("%s=%d", service, replicas), service)...)
+}
+
+// DiscoverComposeProjects returns compose projects found on the host through container labels
+func (s *DockerService) DiscoverComposeProjects(ctx context.Context) ([]DiscoveredComposeProject, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var managed []models.DockerComposeProject
+	if err := s.db.Select("project_name").Find(&managed).Error; err != nil {
+		return nil, err
+	}
+	managedNames := make(map[string]bool, len(managed))
+	for _, p := range managed {
+		managedNames[p.ProjectName] = true
+	}
+
+	projects := make(map[string]*DiscoveredComposeProject)
+	var names []string
+	for _, c := range containers {
+		name := c.Labels[composeProjectLabel]
+		if name == "" {
+			continue
+		}
+
+		p, ok := projects[name]
+		if !ok {
+			p = &DiscoveredComposeProject{
+				Name:       name,
+				WorkingDir: c.Labels[composeWorkingDirLabel],
+				Services:   []string{},
+				Managed:    managedNames[name],
+			}
+			if files := c.Labels[composeConfigLabel]; files != "" {
+				p.ConfigFiles = strings.Split(files, ",")
+			}
+			projects[name] = p
+			names = append(names, name)
+		}
+
+		p.Containers++
+		if c.State == "running" {
+			p.Running++
+		}
+		if svc := c.Labels[composeServiceLabel]; svc != "" && !containsString(p.Services, svc) {
+			p.Services = append(p.Services, svc)
+		}
+	}
+
+	sort.Strings(names)
+	result := make([]DiscoveredComposeProject, len(names))
+	for i, name := range names {
+		sort.Strings(projects[name].Services)
+		result[i] = *projects[name]
+	}
+
+	return result, nil
+}
+
+// ImportComposeProject registers an existing compose project found through discovery.
+// Only the first config file is managed; override files keep being read from disk by compose.
+func (s *DockerService) ImportComposeProject(ctx context.Context, name, description, importedBy string) (*models.DockerComposeProject, error) {
+	discovered, err := s.DiscoverComposeProjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *DiscoveredComposeProject
+	for i := range discovered {
+		if discovered[i].Name == name {
+			found = &discovered[i]
+			break
+		}
+	}
+	if found == nil {
+		return nil, ErrComposeProjectNotFound
+	}
+	if found.Managed {
+		return nil, ErrComposeProjectExists
+	}
+	if found.WorkingDir == "" || len(found.ConfigFiles) == 0 {
+		return nil, fmt.Errorf("%w: project has no working directory or config files", ErrComposeInvalid)
+	}
+
+	configFile := found.ConfigFiles[0]
+	if !filepath.IsAbs(configFile) {
+		configFile = filepath.Join(found.WorkingDir, configFile)
+	}
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	composeFile := configFile
+	if rel, err := filepath.Rel(found.WorkingDir, configFile); err == nil && !strings.HasPrefix(rel, "..") {
+		composeFile = rel
+	}
+
+	envContent, _ := os.ReadFile(filepath.Join(found.WorkingDir, composeEnvFile))
+
+	project := &models.DockerComposeProject{
+		Name:        found.Name,
+		ProjectName: found.Name,
+		Path:        found.WorkingDir,
+		ComposeFile: composeFile,
+		Content:     string(content),
+		EnvContent:  string(envContent),
+		Description: description,
+		Status:      s.checkComposeStatus(ctx, found.WorkingDir, found.Name),
+		Version:     1,
+		Imported:    true,
+	}
+
+	if err := s.db.Create(project).Error; err != nil {
+		return nil, err
+	}
+
+	s.saveComposeRevision(project, "Imported existing project", importedBy)
+
+	return project, nil
+}
+
+// composeProjectWithService loads a project and checks the service is defined in it
+func (s *DockerService) composeProjectWithService(ctx context.Context, id, service string) (*models.DockerComposeProject, error) {
+	var project models.DockerComposeProject
+	if err := s.db.First(&project, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	names, err := s.composeServiceNames(ctx, &project)
+	if err != nil {
+		return nil, err
+	}
+	if !containsString(names, service) {
+		return nil, ErrComposeServiceNotFound
+	}
+
+	return &project, nil
+}
+
+// composeServiceNames returns the services defined in the project's compose file
+func (s *DockerService) composeServiceNames(ctx context.Context, project *models.DockerComposeProject) ([]string, error) {
+	output, err := s.composeOutput(ctx, project.Path, composeArgs(project, "config", "--services")...)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(output, "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// saveComposeRevision records the current project content as a revision and prunes old ones
+func (s *DockerService) saveComposeRevision(project *models.DockerComposeProject, message, createdBy string) {
+	revision := &models.DockerComposeRevision{
+		ProjectID:  project.ID,
+		Version:    project.Version,
+		Content:    project.Content,
+		EnvContent: project.EnvContent,
+		Message:    message,
+		CreatedBy:  createdBy,
+	}
+	if err := s.db.Create(revision).Error; err != nil {
+		s.log.Error("Failed to save compose revision", "project_id", project.ID, "error", err)
+		return
+	}
+
+	if project.Version > maxComposeRevisions {
+		s.db.Where("project_id = ? AND version <= ?", project.ID, project.Version-maxComposeRevisions).
+			Delete(&models.DockerComposeRevision{})
+	}
+}
+
+// writeComposeFiles writes the compose file and, when set, the .env file of a project
+func writeComposeFiles(project *models.DockerComposeProject) error {
+	if err := writeFileAtomic(composeFilePath(project), []byte(project.Content), 0644); err != nil {
+		return err
+	}
+	if project.EnvContent != "" {
+		// .env files usually contain secrets
+		if err := writeFileAtomic(filepath.Join(project.Path, composeEnvFile), []byte(project.EnvContent), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// composeFilePath returns the absolute path of the project's compose file
+func composeFilePath(project *models.DockerComposeProject) string {
+	name := project.ComposeFile
+	if name == "" {
+		name = defaultComposeFile
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(project.Path, name)
+}
+
+// composeArgs prefixes compose arguments with the project name and compose file
+func composeArgs(project *models.DockerComposeProject, args ...string) []string {
+	base := []string{"-p", project.ProjectName, "-f", composeFilePath(project)}
+	return append(base, args...)
+}
+
+// checkComposeProjectFree returns ErrComposeProjectExists when a managed project or
+// containers of an unmanaged one already use the compose project name
+func (s *DockerService) checkComposeProjectFree(ctx context.Context, projectName string) error {
+	var count int64
+	if err := s.db.Model(&models.DockerComposeProject{}).Where("project_name = ?", projectName).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrComposeProjectExists, projectName)
+	}
+
+	if s.client == nil {
+		return nil
+	}
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", composeProjectLabel+"="+projectName)),
+	})
+	if err != nil {
+		return err
+	}
+	if len(containers) > 0 {
+		return fmt.Errorf("%w: %s has containers that are not managed by the panel", ErrComposeProjectExists, projectName)
+	}
+	return nil
+}
+
+// composeProjectName normalizes a name the way compose expects project names
+func composeProjectName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('-')
+		}
+	}
+	return strings.TrimLeft(sb.String(), "-_")
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Compose errors
+var (
+	ErrComposeNotFound         = newError("docker compose or docker-compose not found")
+	ErrComposeInvalid          = newError("invalid compose file")
+	ErrComposeRevisionNotFound = newError("compose revision not found")
+	ErrComposeProjectNotFound  = newError("compose project not found")
+	ErrComposeProjectExists    = newError("compose project already exists")
+	ErrComposeServiceNotFound  = newError("compose service not found")
+	ErrInvalidComposeAction    = newError("invalid compose service action")
+	ErrInvalidReplicas         = newError("replicas must be between 0 and 100")
+)
+
+// IsComposeError reports whether err is a compose validation or lookup error caused by the request
+func IsComposeError(err error) bool {
+	return errors.Is(err, ErrComposeInvalid) ||
+		errors.Is(err, ErrComposeServiceNotFound) ||
+		errors.Is(err, ErrInvalidComposeAction) ||
+		errors.Is(err, ErrInvalidReplicas)
+}
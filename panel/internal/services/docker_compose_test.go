@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+func TestComposeProjectName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"blog", "blog"},
+		{"My Blog", "my-blog"},
+		{"__web.app", "web-app"},
+		{"a_b-c9", "a_b-c9"},
+		{"My App", "my-app"},
+		{"--", ""},
+		{"日本", ""},
+	}
+	for _, tt := range tests {
+		if got := composeProjectName(tt.name); got != tt.want {
+			t.Errorf("composeProjectName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreateComposeProjectName(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.DockerComposeProject{}); err != nil {
+		t.Fatal(err)
+	}
+	s := &DockerService{db: db}
+	if err := db.Create(&models.DockerComposeProject{Name: "my-app", ProjectName: "my-app", Path: "/srv/my-app"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"My App", ErrComposeProjectExists},
+		{"my.app", ErrComposeProjectExists},
+		{"日本", ErrComposeInvalid},
+		{"-", ErrComposeInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := s.CreateComposeProject(context.Background(), tt.name, dir, "services: {}\n", "", "", "admin")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("CreateComposeProject() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	var count int64
+	db.Model(&models.DockerComposeProject{}).Count(&count)
+	if count != 1 {
+		t.Errorf("%d projects stored, want only the existing one", count)
+	}
+}
+
+func TestComposeArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		project models.DockerComposeProject
+		want    []string
+	}{
+		{
+			"default file",
+			models.DockerComposeProject{Name: "Blog", ProjectName: "blog", Path: "/srv/blog"},
+			[]string{"-p", "blog", "-f", "/srv/blog/docker-compose.yml", "ps"},
+		},
+		{
+			// Projects started before the name was stored keep the name of their directory
+			"stored project name",
+			models.DockerComposeProject{Name: "Blog", ProjectName: "stacks", Path: "/srv/stacks", ComposeFile: "compose.yaml"},
+			[]string{"-p", "stacks", "-f", "/srv/stacks/compose.yaml", "ps"},
+		},
+		{
+			"absolute compose file",
+			models.DockerComposeProject{ProjectName: "legacy", Path: "/srv/legacy", ComposeFile: "/etc/legacy/docker-compose.yml"},
+			[]string{"-p", "legacy", "-f", "/etc/legacy/docker-compose.yml", "ps"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := composeArgs(&tt.project, "ps"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("composeArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
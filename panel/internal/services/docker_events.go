@@ -0,0 +1,329 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/vpanel/server/internal/models"
+)
+
+const (
+	// How long docker events are kept
+	dockerEventRetention = 30 * 24 * time.Hour
+
+	// A container dying this many times within the window is reported as crash looping
+	crashLoopThreshold = 5
+	crashLoopWindow    = 10 * time.Minute
+
+	// Events replayed after a reconnect older than this do not raise alerts
+	eventAlertMaxAge = time.Hour
+)
+
+// Lifecycle actions recorded per event type, everything else (exec, attach, top, ...) is ignored
+var recordedDockerActions = map[string]map[string]bool{
+	events.ContainerEventType: {
+		"create": true, "start": true, "restart": true, "die": true, "oom": true, "kill": true,
+		"stop": true, "destroy": true, "pause": true, "unpause": true, "health_status": true,
+		"rename": true, "update": true,
+	},
+	events.ImageEventType: {
+		"pull": true, "push": true, "delete": true, "tag": true, "untag": true,
+		"import": true, "load": true, "prune": true,
+	},
+	events.NetworkEventType: {
+		"create": true, "destroy": true, "remove": true, "connect": true, "disconnect": true, "prune": true,
+	},
+	events.VolumeEventType: {
+		"create": true, "destroy": true, "prune": true,
+	},
+}
+
+// DockerEventQuery represents query parameters for listing docker events
+type DockerEventQuery struct {
+	Page     int
+	PageSize int
+	Type     string
+	Action   string
+	Actor    string // container/image/network/volume ID or name
+	Project  string
+	Since    string
+	Until    string
+}
+
+// DockerEventResult represents paginated docker event results
+type DockerEventResult struct {
+	Events     []models.DockerEvent `json:"events"`
+	Total      int64                `json:"total"`
+	Page       int                  `json:"page"`
+	PageSize   int                  `json:"page_size"`
+	TotalPages int                  `json:"total_pages"`
+}
+
+// ListEvents returns paginated docker events with filtering
+func (s *DockerService) ListEvents(query DockerEventQuery) (*DockerEventResult, error) {
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize < 1 || query.PageSize > 100 {
+		query.PageSize = 20
+	}
+
+	var list []models.DockerEvent
+	var total int64
+
+	db := s.db.Model(&models.DockerEvent{})
+
+	// Apply filters
+	if query.Type != "" {
+		db = db.Where("type = ?", query.Type)
+	}
+	if query.Action != "" {
+		db = db.Where("action IN ?", strings.Split(query.Action, ","))
+	}
+	if query.Actor != "" {
+		db = db.Where("actor_id LIKE ? OR actor_name = ?", query.Actor+"%", query.Actor)
+	}
+	if query.Project != "" {
+		db = db.Where("project = ?", query.Project)
+	}
+	if query.Since != "" {
+		if t, err := parseEventTime(query.Since); err == nil {
+			db = db.Where("time >= ?", t)
+		}
+	}
+	if query.Until != "" {
+		if t, err := parseEventTime(query.Until); err == nil {
+			db = db.Where("time <= ?", t)
+		}
+	}
+
+	// Get total count
+	if err := db.Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	// Get paginated results
+	offset := (query.Page - 1) * query.PageSize
+	if err := db.Order("time DESC, id DESC").Offset(offset).Limit(query.PageSize).Find(&list).Error; err != nil {
+		return nil, err
+	}
+
+	totalPages := int(total) / query.PageSize
+	if int(total)%query.PageSize > 0 {
+		totalPages++
+	}
+
+	return &DockerEventResult{
+		Events:     list,
+		Total:      total,
+		Page:       query.Page,
+		PageSize:   query.PageSize,
+		TotalPages: totalPages,
+	}, nil
+}
+
+// SubscribeEvents returns a channel receiving recorded events as they happen.
+// The returned function must be called to unsubscribe.
+func (s *DockerService) SubscribeEvents() (<-chan models.DockerEvent, func()) {
+	return s.events.subscribe()
+}
+
+// watchEvents follows the docker event stream, reconnecting with backoff
+func (s *DockerService) watchEvents() {
+	backoff := time.Second
+	crashes := make(map[string][]time.Time)
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+
+	s.pruneEvents()
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		msgs, errs := s.client.Events(ctx, types.EventsOptions{
+			Since: s.eventsSince(),
+			Filters: filters.NewArgs(
+				filters.Arg("type", events.ContainerEventType),
+				filters.Arg("type", events.ImageEventType),
+				filters.Arg("type", events.NetworkEventType),
+				filters.Arg("type", events.VolumeEventType),
+			),
+		})
+
+	stream:
+		for {
+			select {
+			case msg := <-msgs:
+				backoff = time.Second
+				s.handleEvent(msg, crashes)
+			case err := <-errs:
+				if err != nil {
+					s.log.Debug("Docker event stream closed", "error", err)
+				}
+				break stream
+			case <-pruneTicker.C:
+				s.pruneEvents()
+			}
+		}
+		cancel()
+
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// eventsSince returns where to resume the event stream, just after the last recorded event
+func (s *DockerService) eventsSince() string {
+	var last models.DockerEvent
+	if err := s.db.Order("time DESC").First(&last).Error; err != nil {
+		return strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	t := last.Time.Add(time.Nanosecond)
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func (s *DockerService) pruneEvents() {
+	s.db.Where("time < ?", time.Now().Add(-dockerEventRetention)).Delete(&models.DockerEvent{})
+}
+
+// handleEvent records a daemon event, publishes it to subscribers and raises alerts
+func (s *DockerService) handleEvent(msg events.Message, crashes map[string][]time.Time) {
+	action, detail, _ := strings.Cut(msg.Action, ":")
+	if !recordedDockerActions[msg.Type][action] {
+		return
+	}
+
+	attrs := msg.Actor.Attributes
+	event := models.DockerEvent{
+		Type:      msg.Type,
+		Action:    action,
+		ActorID:   msg.Actor.ID,
+		ActorName: attrs["name"],
+		Image:     attrs["image"],
+		Project:   attrs[composeProjectLabel],
+		Time:      time.Unix(0, msg.TimeNano),
+	}
+	if msg.TimeNano == 0 {
+		event.Time = time.Unix(msg.Time, 0)
+	}
+	if action == "health_status" {
+		event.Health = strings.TrimSpace(detail)
+	}
+	if code, err := strconv.Atoi(attrs["exitCode"]); err == nil {
+		event.ExitCode = &code
+	}
+
+	// Keep attributes useful for diagnosis, labels are available on the container itself
+	event.Attributes = models.JSON{}
+	for k, v := range attrs {
+		if !strings.Contains(k, ".") || k == composeServiceLabel {
+			event.Attributes[k] = v
+		}
+	}
+
+	if err := s.db.Create(&event).Error; err != nil {
+		s.log.Error("Failed to record docker event", "error", err)
+		return
+	}
+	s.events.publish(event)
+
+	if msg.Type != events.ContainerEventType || time.Since(event.Time) > eventAlertMaxAge || s.notify == nil {
+		return
+	}
+
+	name := event.ActorName
+	if name == "" && len(event.ActorID) >= 12 {
+		name = event.ActorID[:12]
+	}
+
+	switch action {
+	case "oom":
+		s.notify.Alert("service", "critical",
+			fmt.Sprintf("Container %s ran out of memory", name),
+			fmt.Sprintf("Container %s (%s) was killed by the OOM killer at %s.", name, event.Image, event.Time.Format(time.RFC3339)))
+
+	case "die":
+		history := crashes[event.ActorID]
+		cutoff := event.Time.Add(-crashLoopWindow)
+		kept := history[:0]
+		for _, t := range history {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		kept = append(kept, event.Time)
+		crashes[event.ActorID] = kept
+
+		if len(kept) >= crashLoopThreshold {
+			exitCode := "unknown"
+			if event.ExitCode != nil {
+				exitCode = strconv.Itoa(*event.ExitCode)
+			}
+			s.notify.Alert("service", "warning",
+				fmt.Sprintf("Container %s is crash looping", name),
+				fmt.Sprintf("Container %s (%s) exited %d times in the last %s, last exit code %s.",
+					name, event.Image, len(kept), crashLoopWindow, exitCode))
+			delete(crashes, event.ActorID)
+		}
+
+	case "destroy":
+		delete(crashes, event.ActorID)
+	}
+}
+
+// parseEventTime accepts RFC3339 timestamps or unix seconds
+func parseEventTime(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// dockerEventHub fans recorded events out to live subscribers
+type dockerEventHub struct {
+	mu   sync.RWMutex
+	subs map[chan models.DockerEvent]struct{}
+}
+
+func newDockerEventHub() *dockerEventHub {
+	return &dockerEventHub{subs: make(map[chan models.DockerEvent]struct{})}
+}
+
+func (h *dockerEventHub) subscribe() (<-chan models.DockerEvent, func()) {
+	ch := make(chan models.DockerEvent, 64)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (h *dockerEventHub) publish(event models.DockerEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber, drop the event rather than blocking the watcher
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/logger"
+)
+
+// newTestDockerEvents returns a docker service without a daemon that records events
+// and raises alerts in a test database
+func newTestDockerEvents(t *testing.T) *DockerService {
+	t.Helper()
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.DockerEvent{}, &models.Alert{}, &models.SystemSetting{}, &models.Notification{}); err != nil {
+		t.Fatal(err)
+	}
+	log := logger.New(logger.Config{Level: "error"})
+	return &DockerService{
+		db:     db,
+		log:    log,
+		notify: NewNotificationService(db, log, NewSettingsService(db, nil, log)),
+		events: newDockerEventHub(),
+	}
+}
+
+// containerEvent returns a container event message at t
+func containerEvent(id, action string, t time.Time, attrs map[string]string) events.Message {
+	return events.Message{
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: id, Attributes: attrs},
+		TimeNano: t.UnixNano(),
+	}
+}
+
+// dockerAlerts returns the severities and titles of the raised alerts
+func dockerAlerts(t *testing.T, s *DockerService) []string {
+	t.Helper()
+	var alerts []models.Alert
+	if err := s.db.Order("created_at ASC").Find(&alerts).Error; err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, len(alerts))
+	for i, a := range alerts {
+		titles[i] = a.Severity + ": " + a.Title
+	}
+	return titles
+}
+
+func TestHandleEvent(t *testing.T) {
+	s := newTestDockerEvents(t)
+	ch, unsubscribe := s.SubscribeEvents()
+	defer unsubscribe()
+
+	now := time.Now().Truncate(time.Millisecond)
+	attrs := map[string]string{
+		"name":                        "web",
+		"image":                       "nginx:1.25",
+		"exitCode":                    "137",
+		composeProjectLabel:           "shop",
+		composeServiceLabel:           "web",
+		"com.example.owner":           "ops",
+		"org.opencontainers.image.os": "linux",
+	}
+	msgs := []events.Message{
+		containerEvent("abc123", "die", now, attrs),
+		containerEvent("abc123", "health_status: unhealthy", now, map[string]string{"name": "web"}),
+		containerEvent("abc123", "exec_start: sh -c ls", now, nil),
+		containerEvent("abc123", "attach", now, nil),
+		{Type: events.ImageEventType, Action: "pull", Actor: events.Actor{ID: "nginx:1.25"}, Time: now.Unix()},
+		{Type: events.PluginEventType, Action: "enable", Actor: events.Actor{ID: "plugin"}, Time: now.Unix()},
+	}
+	for _, msg := range msgs {
+		s.handleEvent(msg, map[string][]time.Time{})
+	}
+
+	var recorded []models.DockerEvent
+	if err := s.db.Order("id ASC").Find(&recorded).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 3 {
+		t.Fatalf("recorded %d events, want die, health_status and pull", len(recorded))
+	}
+
+	die := recorded[0]
+	if die.Action != "die" || die.ActorName != "web" || die.Image != "nginx:1.25" || die.Project != "shop" ||
+		die.ExitCode == nil || *die.ExitCode != 137 || !die.Time.Equal(now) {
+		t.Errorf("die event = %+v", die)
+	}
+	wantAttrs := models.JSON{"name": "web", "image": "nginx:1.25", "exitCode": "137", composeServiceLabel: "web"}
+	if !reflect.DeepEqual(die.Attributes, wantAttrs) {
+		t.Errorf("attributes = %v, want %v", die.Attributes, wantAttrs)
+	}
+	if health := recorded[1]; health.Action != "health_status" || health.Health != "unhealthy" || health.ExitCode != nil {
+		t.Errorf("health event = %+v", health)
+	}
+	if pull := recorded[2]; pull.Type != events.ImageEventType || pull.ActorID != "nginx:1.25" || !pull.Time.Equal(now.Truncate(time.Second)) {
+		t.Errorf("pull event = %+v", pull)
+	}
+
+	// Subscribers receive recorded events only
+	for i, want := range []string{"die", "health_status", "pull"} {
+		select {
+		case event := <-ch:
+			if event.Action != want {
+				t.Errorf("published event %d = %s, want %s", i, event.Action, want)
+			}
+		default:
+			t.Fatalf("published %d events, want 3", i)
+		}
+	}
+	select {
+	case event := <-ch:
+		t.Errorf("ignored event published: %+v", event)
+	default:
+	}
+}
+
+func TestHandleEventAlerts(t *testing.T) {
+	now := time.Now()
+	crashed := func(n int, gap time.Duration, last string) []events.Message {
+		var msgs []events.Message
+		for i := n - 1; i >= 0; i-- {
+			msgs = append(msgs, containerEvent("0123456789abcdef", "die", now.Add(-time.Duration(i)*gap), map[string]string{"exitCode": last, "image": "app"}))
+		}
+		return msgs
+	}
+
+	tests := []struct {
+		name string
+		msgs []events.Message
+		want []string
+	}{
+		{
+			"out of memory",
+			[]events.Message{containerEvent("abc", "oom", now, map[string]string{"name": "db"})},
+			[]string{"critical: Container db ran out of memory"},
+		},
+		{"crash loop", crashed(crashLoopThreshold, time.Minute, "1"), []string{"warning: Container 0123456789ab is crash looping"}},
+		{"below the threshold", crashed(crashLoopThreshold-1, time.Minute, "1"), []string{}},
+		{"outside of the window", crashed(crashLoopThreshold, crashLoopWindow/2, "1"), []string{}},
+		{
+			"destroyed between crashes",
+			append(append(crashed(crashLoopThreshold-1, time.Second, "1"), containerEvent("0123456789abcdef", "destroy", now, nil)),
+				containerEvent("0123456789abcdef", "die", now, nil)),
+			[]string{},
+		},
+		{
+			"replayed after a reconnect",
+			[]events.Message{containerEvent("abc", "oom", now.Add(-2*eventAlertMaxAge), map[string]string{"name": "db"})},
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestDockerEvents(t)
+			crashes := map[string][]time.Time{}
+			for _, msg := range tt.msgs {
+				s.handleEvent(msg, crashes)
+			}
+			if got := dockerAlerts(t, s); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("alerts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	s := newTestDockerEvents(t)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seed := []models.DockerEvent{
+		{Type: "container", Action: "start", ActorID: "aaa111", ActorName: "web", Project: "shop", Time: base},
+		{Type: "container", Action: "die", ActorID: "aaa111", ActorName: "web", Project: "shop", Time: base.Add(time.Minute)},
+		{Type: "container", Action: "oom", ActorID: "bbb222", ActorName: "db", Project: "shop", Time: base.Add(2 * time.Minute)},
+		{Type: "container", Action: "start", ActorID: "ccc333", ActorName: "cache", Time: base.Add(3 * time.Minute)},
+		{Type: "image", Action: "pull", ActorID: "nginx:1.25", Time: base.Add(4 * time.Minute)},
+	}
+	for i := range seed {
+		if err := s.db.Create(&seed[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query DockerEventQuery
+		want  []uint
+	}{
+		{"all newest first", DockerEventQuery{}, []uint{5, 4, 3, 2, 1}},
+		{"type", DockerEventQuery{Type: "image"}, []uint{5}},
+		{"actions", DockerEventQuery{Action: "die,oom"}, []uint{3, 2}},
+		{"actor id prefix", DockerEventQuery{Actor: "aaa"}, []uint{2, 1}},
+		{"actor name", DockerEventQuery{Actor: "db"}, []uint{3}},
+		{"actor name is not a prefix", DockerEventQuery{Actor: "ca"}, []uint{}},
+		{"project", DockerEventQuery{Project: "shop", Action: "start"}, []uint{1}},
+		{"since rfc3339", DockerEventQuery{Since: base.Add(3 * time.Minute).Format(time.RFC3339)}, []uint{5, 4}},
+		{"until unix", DockerEventQuery{Until: strconv.FormatInt(base.Add(time.Minute).Unix(), 10)}, []uint{2, 1}},
+		{"invalid since ignored", DockerEventQuery{Since: "yesterday", Type: "image"}, []uint{5}},
+		{"page", DockerEventQuery{Page: 2, PageSize: 2}, []uint{3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.ListEvents(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []uint{}
+			for _, e := range result.Events {
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ListEvents() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	result, err := s.ListEvents(DockerEventQuery{Page: 0, PageSize: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Page != 1 || result.PageSize != 20 || result.Total != 5 || result.TotalPages != 1 {
+		t.Errorf("page %d of %d, size %d, total %d", result.Page, result.TotalPages, result.PageSize, result.Total)
+	}
+	if result, _ := s.ListEvents(DockerEventQuery{PageSize: 2}); result.TotalPages != 3 {
+		t.Errorf("%d pages of 2 events, want 3", result.TotalPages)
+	}
+}
+
+func TestEventsSince(t *testing.T) {
+	s := newTestDockerEvents(t)
+	before := time.Now().Unix()
+	if since, err := strconv.ParseInt(s.eventsSince(), 10, 64); err != nil || since < before {
+		t.Errorf("eventsSince() without events = %d, %v", since, err)
+	}
+
+	last := time.Date(2024, 5, 1, 12, 0, 0, 999999999, time.UTC)
+	s.db.Create(&models.DockerEvent{Type: "container", Action: "start", Time: last.Add(-time.Hour)})
+	s.db.Create(&models.DockerEvent{Type: "container", Action: "die", Time: last})
+	if got, want := s.eventsSince(), strconv.FormatInt(last.Unix()+1, 10)+".000000000"; got != want {
+		t.Errorf("eventsSince() = %s, want %s", got, want)
+	}
+}
+
+func TestParseEventTime(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, value := range []string{"1714564800", "2024-05-01T12:00:00Z", "2024-05-01T14:00:00+02:00"} {
+		if got, err := parseEventTime(value); err != nil || !got.Equal(want) {
+			t.Errorf("parseEventTime(%q) = %v, %v", value, got, err)
+		}
+	}
+	for _, value := range []string{"", "2024-05-01", "1714564800.5"} {
+		if _, err := parseEventTime(value); err == nil {
+			t.Errorf("parseEventTime(%q) succeeded", value)
+		}
+	}
+}
+
+func TestDockerEventHub(t *testing.T) {
+	h := newDockerEventHub()
+	first, unsubscribeFirst := h.subscribe()
+	second, unsubscribeSecond := h.subscribe()
+	defer unsubscribeSecond()
+
+	h.publish(models.DockerEvent{Action: "start"})
+	for _, ch := range []<-chan models.DockerEvent{first, second} {
+		if event := <-ch; event.Action != "start" {
+			t.Errorf("received %q", event.Action)
+		}
+	}
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if _, open := <-first; open {
+		t.Error("channel open after unsubscribing")
+	}
+
+	// A subscriber that does not read drops events instead of blocking
+	for i := 0; i < 100; i++ {
+		h.publish(models.DockerEvent{Action: "die"})
+	}
+	if len(second) != cap(second) {
+		t.Errorf("%d of %d buffered events", len(second), cap(second))
+	}
+}
@@ -0,0 +1,752 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/vpanel/server/internal/models"
+)
+
+const (
+	// System setting holding the scheduled prune policy
+	dockerPrunePolicyKey = "docker_prune_policy"
+
+	// Label the daemon sets on anonymous volumes (API 1.42+)
+	anonymousVolumeLabel = "com.docker.volume.anonymous"
+
+	// Upper bound for a scheduled prune run
+	scheduledPruneTimeout = 30 * time.Minute
+)
+
+// Networks created by the daemon that can never be pruned
+var predefinedNetworks = map[string]bool{"bridge": true, "host": true, "none": true}
+
+// DiskUsageItem is a single image, container, volume or build cache record
+type DiskUsageItem struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	InUse       bool   `json:"in_use"`
+	Reclaimable bool   `json:"reclaimable"`
+	Created     string `json:"created"`
+}
+
+// DiskUsageCategory summarises the disk usage of one object type
+type DiskUsageCategory struct {
+	Total       int             `json:"total"`
+	Active      int             `json:"active"`
+	Size        int64           `json:"size"`
+	Reclaimable int64           `json:"reclaimable"`
+	Items       []DiskUsageItem `json:"items"`
+}
+
+// DockerDiskUsage is the equivalent of `docker system df -v`
+type DockerDiskUsage struct {
+	Images           DiskUsageCategory `json:"images"`
+	Containers       DiskUsageCategory `json:"containers"`
+	Volumes          DiskUsageCategory `json:"volumes"`
+	BuildCache       DiskUsageCategory `json:"build_cache"`
+	TotalSize        int64             `json:"total_size"`
+	TotalReclaimable int64             `json:"total_reclaimable"`
+}
+
+// PruneOptions selects what to prune and how to filter it
+type PruneOptions struct {
+	Images     string   `json:"images"` // "", dangling or unused
+	Containers bool     `json:"containers"`
+	Networks   bool     `json:"networks"`
+	Volumes    bool     `json:"volumes"`
+	AllVolumes bool     `json:"all_volumes"` // include named volumes, not only anonymous ones
+	BuildCache bool     `json:"build_cache"`
+	Until      string   `json:"until"`  // duration (24h) or timestamp, objects created before it
+	Labels     []string `json:"labels"` // key, key=value, !key or !key=value
+	DryRun     bool     `json:"dry_run"`
+}
+
+// PruneItem is an object removed, or that would be removed, by a prune
+type PruneItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Size int64  `json:"size"`
+}
+
+// PruneReport lists pruned objects. For dry runs SpaceReclaimed is an estimate.
+type PruneReport struct {
+	DryRun         bool        `json:"dry_run"`
+	Containers     []PruneItem `json:"containers"`
+	Images         []PruneItem `json:"images"`
+	Networks       []PruneItem `json:"networks"`
+	Volumes        []PruneItem `json:"volumes"`
+	BuildCache     []PruneItem `json:"build_cache"`
+	SpaceReclaimed uint64      `json:"space_reclaimed"`
+}
+
+// PrunePolicy is a prune run on a cron schedule
+type PrunePolicy struct {
+	Enabled       bool         `json:"enabled"`
+	Schedule      string       `json:"schedule"`
+	Options       PruneOptions `json:"options"`
+	LastRunAt     *time.Time   `json:"last_run_at,omitempty"`
+	LastReclaimed uint64       `json:"last_reclaimed"`
+	LastError     string       `json:"last_error,omitempty"`
+	NextRunAt     *time.Time   `json:"next_run_at,omitempty"`
+}
+
+// DiskUsage reports space used by images, containers, volumes and build cache
+func (s *DockerService) DiskUsage(ctx context.Context) (*DockerDiskUsage, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	du, err := s.client.DiskUsage(ctx, types.DiskUsageOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DockerDiskUsage{}
+
+	// Images share layers, so the total is the layer size and only the part
+	// unique to images used by containers is not reclaimable
+	images := &result.Images
+	images.Size = du.LayersSize
+	var used int64
+	for _, img := range du.Images {
+		inUse := img.Containers > 0
+		name := "<none>"
+		if len(img.RepoTags) > 0 {
+			name = img.RepoTags[0]
+		}
+		images.Items = append(images.Items, DiskUsageItem{
+			ID:          img.ID,
+			Name:        name,
+			Size:        img.Size,
+			InUse:       inUse,
+			Reclaimable: !inUse,
+			Created:     time.Unix(img.Created, 0).Format(time.RFC3339),
+		})
+		if inUse {
+			images.Active++
+			if img.SharedSize >= 0 {
+				used += img.Size - img.SharedSize
+			}
+		}
+	}
+	images.Total = len(du.Images)
+	images.Reclaimable = du.LayersSize - used
+
+	containers := &result.Containers
+	for _, ctr := range du.Containers {
+		running := ctr.State == "running" || ctr.State == "paused"
+		name := ""
+		if len(ctr.Names) > 0 {
+			name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		containers.Items = append(containers.Items, DiskUsageItem{
+			ID:          ctr.ID,
+			Name:        name,
+			Size:        ctr.SizeRw,
+			InUse:       running,
+			Reclaimable: !running,
+			Created:     time.Unix(ctr.Created, 0).Format(time.RFC3339),
+		})
+		containers.Size += ctr.SizeRw
+		if running {
+			containers.Active++
+		} else {
+			containers.Reclaimable += ctr.SizeRw
+		}
+	}
+	containers.Total = len(du.Containers)
+
+	volumes := &result.Volumes
+	for _, vol := range du.Volumes {
+		var size int64
+		var refs int64
+		if vol.UsageData != nil {
+			size, refs = vol.UsageData.Size, vol.UsageData.RefCount
+		}
+		if size < 0 {
+			size = 0
+		}
+		volumes.Items = append(volumes.Items, DiskUsageItem{
+			ID:          vol.Name,
+			Name:        vol.Name,
+			Size:        size,
+			InUse:       refs > 0,
+			Reclaimable: refs == 0,
+			Created:     vol.CreatedAt,
+		})
+		volumes.Size += size
+		if refs > 0 {
+			volumes.Active++
+		} else {
+			volumes.Reclaimable += size
+		}
+	}
+	volumes.Total = len(du.Volumes)
+
+	cache := &result.BuildCache
+	for _, bc := range du.BuildCache {
+		cache.Items = append(cache.Items, DiskUsageItem{
+			ID:          bc.ID,
+			Name:        bc.Description,
+			Size:        bc.Size,
+			InUse:       bc.InUse,
+			Reclaimable: !bc.InUse && !bc.Shared,
+			Created:     bc.CreatedAt.Format(time.RFC3339),
+		})
+		// Shared records are accounted for in the image layers
+		if bc.Shared {
+			continue
+		}
+		cache.Size += bc.Size
+		if bc.InUse {
+			cache.Active++
+		} else {
+			cache.Reclaimable += bc.Size
+		}
+	}
+	cache.Total = len(du.BuildCache)
+
+	result.TotalSize = images.Size + containers.Size + volumes.Size + cache.Size
+	result.TotalReclaimable = images.Reclaimable + containers.Reclaimable + volumes.Reclaimable + cache.Reclaimable
+
+	return result, nil
+}
+
+// Prune removes unused docker objects, or only lists them when DryRun is set
+func (s *DockerService) Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+	if err := validatePruneOptions(opts); err != nil {
+		return nil, err
+	}
+	if opts.Images == "" && !opts.Containers && !opts.Networks && !opts.Volumes && !opts.BuildCache {
+		return nil, fmt.Errorf("%w: nothing selected to prune", ErrInvalidPruneOptions)
+	}
+
+	report := &PruneReport{DryRun: opts.DryRun}
+
+	var du *types.DiskUsage
+	if opts.DryRun {
+		usage, err := s.client.DiskUsage(ctx, types.DiskUsageOptions{})
+		if err != nil {
+			return nil, err
+		}
+		du = &usage
+	}
+
+	// Containers go first so that the images, networks and volumes they held become unused
+	if opts.Containers {
+		if err := s.pruneContainers(ctx, opts, du, report); err != nil {
+			return nil, fmt.Errorf("failed to prune containers: %w", err)
+		}
+	}
+	if opts.Images != "" {
+		if err := s.pruneImages(ctx, opts, du, report); err != nil {
+			return nil, fmt.Errorf("failed to prune images: %w", err)
+		}
+	}
+	if opts.Networks {
+		if err := s.pruneNetworks(ctx, opts, report); err != nil {
+			return nil, fmt.Errorf("failed to prune networks: %w", err)
+		}
+	}
+	if opts.Volumes {
+		if err := s.pruneVolumes(ctx, opts, du, report); err != nil {
+			return nil, fmt.Errorf("failed to prune volumes: %w", err)
+		}
+	}
+	if opts.BuildCache {
+		if err := s.pruneBuildCache(ctx, opts, du, report); err != nil {
+			return nil, fmt.Errorf("failed to prune build cache: %w", err)
+		}
+	}
+
+	if !opts.DryRun {
+		s.log.Info("Docker prune completed",
+			"containers", len(report.Containers), "images", len(report.Images), "networks", len(report.Networks),
+			"volumes", len(report.Volumes), "build_cache", len(report.BuildCache), "reclaimed", report.SpaceReclaimed)
+	}
+
+	return report, nil
+}
+
+// PruneImages removes dangling images, or all unused images when opts.Images is "unused"
+func (s *DockerService) PruneImages(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	if opts.Images == "" {
+		opts.Images = "dangling"
+	}
+	return s.Prune(ctx, PruneOptions{Images: opts.Images, Until: opts.Until, Labels: opts.Labels, DryRun: opts.DryRun})
+}
+
+func (s *DockerService) pruneContainers(ctx context.Context, opts PruneOptions, du *types.DiskUsage, report *PruneReport) error {
+	if du != nil {
+		until, _ := parsePruneUntil(opts.Until)
+		for _, ctr := range du.Containers {
+			if ctr.State == "running" || ctr.State == "paused" || ctr.State == "restarting" {
+				continue
+			}
+			if !createdBefore(time.Unix(ctr.Created, 0), until) || !matchPruneLabels(ctr.Labels, opts.Labels) {
+				continue
+			}
+			name := ""
+			if len(ctr.Names) > 0 {
+				name = strings.TrimPrefix(ctr.Names[0], "/")
+			}
+			report.Containers = append(report.Containers, PruneItem{ID: ctr.ID, Name: name, Size: ctr.SizeRw})
+			report.SpaceReclaimed += uint64(ctr.SizeRw)
+		}
+		return nil
+	}
+
+	res, err := s.client.ContainersPrune(ctx, pruneFilters(opts, true, true))
+	if err != nil {
+		return err
+	}
+	for _, id := range res.ContainersDeleted {
+		report.Containers = append(report.Containers, PruneItem{ID: id})
+	}
+	report.SpaceReclaimed += res.SpaceReclaimed
+	return nil
+}
+
+func (s *DockerService) pruneImages(ctx context.Context, opts PruneOptions, du *types.DiskUsage, report *PruneReport) error {
+	dangling := opts.Images == "dangling"
+
+	if du != nil {
+		// Containers removed earlier in this dry run no longer hold their images
+		removed := make(map[string]bool)
+		for _, item := range report.Containers {
+			removed[item.ID] = true
+		}
+		inUse := make(map[string]bool)
+		for _, ctr := range du.Containers {
+			if !removed[ctr.ID] {
+				inUse[ctr.ImageID] = true
+			}
+		}
+
+		until, _ := parsePruneUntil(opts.Until)
+		for _, img := range du.Images {
+			if inUse[img.ID] {
+				continue
+			}
+			untagged := len(img.RepoTags) == 0 || (len(img.RepoTags) == 1 && img.RepoTags[0] == "<none>:<none>")
+			if dangling && !untagged {
+				continue
+			}
+			if !createdBefore(time.Unix(img.Created, 0), until) || !matchPruneLabels(img.Labels, opts.Labels) {
+				continue
+			}
+			size := img.Size
+			if img.SharedSize > 0 {
+				size -= img.SharedSize
+			}
+			name := ""
+			if !untagged {
+				name = strings.Join(img.RepoTags, ", ")
+			}
+			report.Images = append(report.Images, PruneItem{ID: img.ID, Name: name, Size: size})
+			report.SpaceReclaimed += uint64(size)
+		}
+		return nil
+	}
+
+	args := pruneFilters(opts, true, true)
+	args.Add("dangling", strconv.FormatBool(dangling))
+
+	res, err := s.client.ImagesPrune(ctx, args)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.ImagesDeleted {
+		if item.Deleted != "" {
+			report.Images = append(report.Images, PruneItem{ID: item.Deleted})
+		}
+	}
+	report.SpaceReclaimed += res.SpaceReclaimed
+	return nil
+}
+
+func (s *DockerService) pruneNetworks(ctx context.Context, opts PruneOptions, report *PruneReport) error {
+	if opts.DryRun {
+		networks, err := s.client.NetworkList(ctx, types.NetworkListOptions{})
+		if err != nil {
+			return err
+		}
+		containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{All: true})
+		if err != nil {
+			return err
+		}
+
+		removed := make(map[string]bool)
+		for _, item := range report.Containers {
+			removed[item.ID] = true
+		}
+		inUse := make(map[string]bool)
+		for _, ctr := range containers {
+			if removed[ctr.ID] || ctr.NetworkSettings == nil {
+				continue
+			}
+			for _, ep := range ctr.NetworkSettings.Networks {
+				if ep != nil {
+					inUse[ep.NetworkID] = true
+				}
+			}
+		}
+
+		until, _ := parsePruneUntil(opts.Until)
+		for _, n := range networks {
+			if predefinedNetworks[n.Name] || n.Ingress || n.Scope == "swarm" || inUse[n.ID] {
+				continue
+			}
+			if !createdBefore(n.Created, until) || !matchPruneLabels(n.Labels, opts.Labels) {
+				continue
+			}
+			report.Networks = append(report.Networks, PruneItem{ID: n.ID, Name: n.Name})
+		}
+		return nil
+	}
+
+	res, err := s.client.NetworksPrune(ctx, pruneFilters(opts, true, true))
+	if err != nil {
+		return err
+	}
+	for _, name := range res.NetworksDeleted {
+		report.Networks = append(report.Networks, PruneItem{ID: name, Name: name})
+	}
+	return nil
+}
+
+func (s *DockerService) pruneVolumes(ctx context.Context, opts PruneOptions, du *types.DiskUsage, report *PruneReport) error {
+	if du != nil {
+		removed := make(map[string]bool)
+		for _, item := range report.Containers {
+			removed[item.ID] = true
+		}
+		// Volumes referenced only by containers removed in this dry run become unused
+		freed := make(map[string]int64)
+		for _, ctr := range du.Containers {
+			if !removed[ctr.ID] {
+				continue
+			}
+			for _, m := range ctr.Mounts {
+				if m.Type == "volume" {
+					freed[m.Name]++
+				}
+			}
+		}
+
+		for _, vol := range du.Volumes {
+			var size, refs int64
+			if vol.UsageData != nil {
+				size, refs = vol.UsageData.Size, vol.UsageData.RefCount
+			}
+			if refs-freed[vol.Name] > 0 {
+				continue
+			}
+			if _, anonymous := vol.Labels[anonymousVolumeLabel]; !anonymous && !opts.AllVolumes {
+				continue
+			}
+			if !matchPruneLabels(vol.Labels, opts.Labels) {
+				continue
+			}
+			if size < 0 {
+				size = 0
+			}
+			report.Volumes = append(report.Volumes, PruneItem{ID: vol.Name, Name: vol.Name, Size: size})
+			report.SpaceReclaimed += uint64(size)
+		}
+		return nil
+	}
+
+	// The daemon rejects the until filter for volumes
+	args := pruneFilters(opts, false, true)
+	if opts.AllVolumes {
+		args.Add("all", "true")
+	}
+
+	res, err := s.client.VolumesPrune(ctx, args)
+	if err != nil {
+		return err
+	}
+	for _, name := range res.VolumesDeleted {
+		report.Volumes = append(report.Volumes, PruneItem{ID: name, Name: name})
+	}
+	report.SpaceReclaimed += res.SpaceReclaimed
+	return nil
+}
+
+func (s *DockerService) pruneBuildCache(ctx context.Context, opts PruneOptions, du *types.DiskUsage, report *PruneReport) error {
+	if du != nil {
+		until, _ := parsePruneUntil(opts.Until)
+		for _, bc := range du.BuildCache {
+			if bc.InUse {
+				continue
+			}
+			lastUsed := bc.CreatedAt
+			if bc.LastUsedAt != nil {
+				lastUsed = *bc.LastUsedAt
+			}
+			if !createdBefore(lastUsed, until) {
+				continue
+			}
+			size := bc.Size
+			if bc.Shared {
+				size = 0
+			}
+			report.BuildCache = append(report.BuildCache, PruneItem{ID: bc.ID, Name: bc.Description, Size: size})
+			report.SpaceReclaimed += uint64(size)
+		}
+		return nil
+	}
+
+	// Build cache has no labels, only the until filter applies
+	res, err := s.client.BuildCachePrune(ctx, types.BuildCachePruneOptions{
+		All:     true,
+		Filters: pruneFilters(opts, true, false),
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range res.CachesDeleted {
+		report.BuildCache = append(report.BuildCache, PruneItem{ID: id})
+	}
+	report.SpaceReclaimed += res.SpaceReclaimed
+	return nil
+}
+
+// GetPrunePolicy returns the scheduled prune policy
+func (s *DockerService) GetPrunePolicy() (*PrunePolicy, error) {
+	policy := &PrunePolicy{
+		Schedule: "0 3 * * 0",
+		Options:  PruneOptions{Images: "dangling", Containers: true, Networks: true, BuildCache: true, Until: "24h"},
+	}
+
+	var setting models.SystemSetting
+	if err := s.db.Where("key = ?", dockerPrunePolicyKey).Limit(1).Find(&setting).Error; err != nil {
+		return nil, err
+	}
+	if setting.Value != "" {
+		if err := json.Unmarshal([]byte(setting.Value), policy); err != nil {
+			return nil, err
+		}
+	}
+
+	s.pruneMu.Lock()
+	if s.pruneEntry != 0 {
+		if next := s.scheduler.Entry(s.pruneEntry).Next; !next.IsZero() {
+			policy.NextRunAt = &next
+		}
+	}
+	s.pruneMu.Unlock()
+
+	return policy, nil
+}
+
+// UpdatePrunePolicy validates and stores the prune policy and reschedules it
+func (s *DockerService) UpdatePrunePolicy(enabled bool, schedule string, opts PruneOptions) (*PrunePolicy, error) {
+	policy, err := s.GetPrunePolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		if opts.Images == "" && !opts.Containers && !opts.Networks && !opts.Volumes && !opts.BuildCache {
+			return nil, fmt.Errorf("%w: nothing selected to prune", ErrInvalidPruneOptions)
+		}
+	}
+	if err := validatePruneOptions(opts); err != nil {
+		return nil, err
+	}
+	parsed, err := parseCronExpression(schedule)
+	if err != nil {
+		return nil, ErrInvalidCronExpression
+	}
+
+	opts.DryRun = false
+	policy.Enabled = enabled
+	policy.Schedule = strings.TrimSpace(schedule)
+	policy.Options = opts
+
+	if err := s.savePrunePolicy(policy); err != nil {
+		return nil, err
+	}
+	if err := s.schedulePrune(policy.Enabled, parsed); err != nil {
+		return nil, err
+	}
+
+	return s.GetPrunePolicy()
+}
+
+// loadPrunePolicy schedules the stored prune policy on startup
+func (s *DockerService) loadPrunePolicy() {
+	policy, err := s.GetPrunePolicy()
+	if err != nil {
+		s.log.Error("Failed to load docker prune policy", "error", err)
+		return
+	}
+	if !policy.Enabled {
+		return
+	}
+	parsed, err := parseCronExpression(policy.Schedule)
+	if err != nil {
+		s.log.Error("Invalid docker prune schedule", "schedule", policy.Schedule, "error", err)
+		return
+	}
+	if err := s.schedulePrune(true, parsed); err != nil {
+		s.log.Error("Failed to schedule docker prune", "error", err)
+	}
+}
+
+func (s *DockerService) schedulePrune(enabled bool, schedule string) error {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+
+	if s.pruneEntry != 0 {
+		s.scheduler.Remove(s.pruneEntry)
+		s.pruneEntry = 0
+	}
+	if !enabled {
+		return nil
+	}
+
+	entryID, err := s.scheduler.AddFunc(schedule, s.runScheduledPrune)
+	if err != nil {
+		return err
+	}
+	s.pruneEntry = entryID
+
+	s.log.Info("Docker prune scheduled", "schedule", schedule)
+	return nil
+}
+
+func (s *DockerService) runScheduledPrune() {
+	policy, err := s.GetPrunePolicy()
+	if err != nil || !policy.Enabled {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scheduledPruneTimeout)
+	defer cancel()
+
+	opts := policy.Options
+	opts.DryRun = false
+	report, err := s.Prune(ctx, opts)
+
+	now := time.Now()
+	policy.LastRunAt = &now
+	policy.LastError = ""
+	policy.LastReclaimed = 0
+	if err != nil {
+		policy.LastError = err.Error()
+		s.log.Error("Scheduled docker prune failed", "error", err)
+	} else {
+		policy.LastReclaimed = report.SpaceReclaimed
+	}
+
+	if err := s.savePrunePolicy(policy); err != nil {
+		s.log.Error("Failed to save docker prune result", "error", err)
+	}
+}
+
+func (s *DockerService) savePrunePolicy(policy *PrunePolicy) error {
+	stored := *policy
+	stored.NextRunAt = nil
+
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return s.db.Save(&models.SystemSetting{
+		Key:      dockerPrunePolicyKey,
+		Value:    string(value),
+		Type:     "json",
+		Category: "docker",
+	}).Error
+}
+
+func validatePruneOptions(opts PruneOptions) error {
+	switch opts.Images {
+	case "", "dangling", "unused":
+	default:
+		return fmt.Errorf("%w: images must be dangling or unused", ErrInvalidPruneOptions)
+	}
+	if _, err := parsePruneUntil(opts.Until); err != nil {
+		return fmt.Errorf("%w: invalid until %q", ErrInvalidPruneOptions, opts.Until)
+	}
+	for _, label := range opts.Labels {
+		if strings.TrimPrefix(label, "!") == "" || strings.HasPrefix(label, "=") || strings.HasPrefix(label, "!=") {
+			return fmt.Errorf("%w: invalid label filter %q", ErrInvalidPruneOptions, label)
+		}
+	}
+	return nil
+}
+
+// pruneFilters builds daemon filters, until and label filters are not supported by every object type
+func pruneFilters(opts PruneOptions, until, labels bool) filters.Args {
+	args := filters.NewArgs()
+	if until && opts.Until != "" {
+		args.Add("until", opts.Until)
+	}
+	if labels {
+		for _, label := range opts.Labels {
+			if strings.HasPrefix(label, "!") {
+				args.Add("label!", label[1:])
+			} else {
+				args.Add("label", label)
+			}
+		}
+	}
+	return args
+}
+
+// parsePruneUntil accepts the same values as the daemon: a duration relative to now,
+// an RFC3339 timestamp or unix seconds. A zero time means no limit.
+func parsePruneUntil(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+func createdBefore(created, until time.Time) bool {
+	return until.IsZero() || created.Before(until)
+}
+
+// matchPruneLabels applies label filters the way the daemon does
+func matchPruneLabels(labels map[string]string, filters []string) bool {
+	for _, f := range filters {
+		negate := strings.HasPrefix(f, "!")
+		key, value, hasValue := strings.Cut(strings.TrimPrefix(f, "!"), "=")
+
+		actual, ok := labels[key]
+		match := ok && (!hasValue || actual == value)
+		if match == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Errors
+var (
+	ErrInvalidPruneOptions = newError("invalid prune options")
+)
@@ -0,0 +1,309 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+)
+
+func TestValidatePruneOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  PruneOptions
+		valid bool
+	}{
+		{"empty", PruneOptions{}, true},
+		{"dangling images", PruneOptions{Images: "dangling"}, true},
+		{"unused images", PruneOptions{Images: "unused"}, true},
+		{"all images", PruneOptions{Images: "all"}, false},
+		{"duration", PruneOptions{Until: "24h"}, true},
+		{"timestamp", PruneOptions{Until: "2024-01-02T03:04:05Z"}, true},
+		{"unix seconds", PruneOptions{Until: "1704164645.5"}, true},
+		{"days", PruneOptions{Until: "7d"}, false},
+		{"labels", PruneOptions{Labels: []string{"keep", "env=dev", "!keep", "!env=prod"}}, true},
+		{"empty label", PruneOptions{Labels: []string{""}}, false},
+		{"negated nothing", PruneOptions{Labels: []string{"!"}}, false},
+		{"value without key", PruneOptions{Labels: []string{"=dev"}}, false},
+		{"negated value without key", PruneOptions{Labels: []string{"!=dev"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePruneOptions(tt.opts)
+			if tt.valid && err != nil {
+				t.Errorf("validatePruneOptions() error = %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidPruneOptions) {
+				t.Errorf("validatePruneOptions() error = %v, want ErrInvalidPruneOptions", err)
+			}
+		})
+	}
+}
+
+func TestParsePruneUntil(t *testing.T) {
+	if until, err := parsePruneUntil(""); err != nil || !until.IsZero() {
+		t.Errorf("parsePruneUntil(\"\") = %v, %v", until, err)
+	}
+	if until, err := parsePruneUntil("2h"); err != nil || time.Since(until) < 2*time.Hour || time.Since(until) > 2*time.Hour+time.Minute {
+		t.Errorf("parsePruneUntil(2h) = %v, %v", until, err)
+	}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC)
+	for _, value := range []string{"2024-01-02T03:04:05.5Z", "1704164645.5"} {
+		if until, err := parsePruneUntil(value); err != nil || !until.Equal(want) {
+			t.Errorf("parsePruneUntil(%q) = %v, %v, want %v", value, until, err, want)
+		}
+	}
+	if _, err := parsePruneUntil("yesterday"); err == nil {
+		t.Error("parsePruneUntil(yesterday) succeeded")
+	}
+
+	if !createdBefore(want, time.Time{}) {
+		t.Error("createdBefore() without a limit = false")
+	}
+	if createdBefore(want, want) || !createdBefore(want.Add(-time.Second), want) {
+		t.Error("createdBefore() does not exclude objects created at or after the limit")
+	}
+}
+
+func TestPruneFilters(t *testing.T) {
+	opts := PruneOptions{Until: "24h", Labels: []string{"env=dev", "!keep"}}
+	tests := []struct {
+		name   string
+		until  bool
+		labels bool
+		want   map[string][]string
+	}{
+		{"all", true, true, map[string][]string{"until": {"24h"}, "label": {"env=dev"}, "label!": {"keep"}}},
+		{"volumes", false, true, map[string][]string{"label": {"env=dev"}, "label!": {"keep"}}},
+		{"build cache", true, false, map[string][]string{"until": {"24h"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := pruneFilters(opts, tt.until, tt.labels)
+			got := make(map[string][]string)
+			for _, key := range args.Keys() {
+				got[key] = args.Get(key)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pruneFilters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if args := pruneFilters(PruneOptions{}, true, true); args.Len() != 0 {
+		t.Errorf("pruneFilters() without options has %d filters", args.Len())
+	}
+}
+
+func TestMatchPruneLabels(t *testing.T) {
+	labels := map[string]string{"env": "dev", "keep": ""}
+	tests := []struct {
+		filters []string
+		want    bool
+	}{
+		{nil, true},
+		{[]string{"env"}, true},
+		{[]string{"env=dev"}, true},
+		{[]string{"env=prod"}, false},
+		{[]string{"keep="}, true},
+		{[]string{"team"}, false},
+		{[]string{"!env"}, false},
+		{[]string{"!env=prod"}, true},
+		{[]string{"!team"}, true},
+		{[]string{"env=dev", "!keep"}, false},
+		{[]string{"env", "!team"}, true},
+	}
+	for _, tt := range tests {
+		if got := matchPruneLabels(labels, tt.filters); got != tt.want {
+			t.Errorf("matchPruneLabels(%q) = %v, want %v", tt.filters, got, tt.want)
+		}
+	}
+	if matchPruneLabels(nil, []string{"env"}) || !matchPruneLabels(nil, []string{"!env"}) {
+		t.Error("matchPruneLabels() of an object without labels")
+	}
+}
+
+// testDiskUsage returns disk usage of a daemon with a running web container and an old
+// exited job container, the images, volumes and build cache of both and unused ones
+func testDiskUsage() *types.DiskUsage {
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	return &types.DiskUsage{
+		Containers: []*types.Container{
+			{ID: "web", Names: []string{"/web"}, ImageID: "img-web", State: "running", Created: old.Unix(), SizeRw: 10,
+				Mounts: []types.MountPoint{{Type: "volume", Name: "shared"}}},
+			{ID: "job", Names: []string{"/job"}, ImageID: "img-job", State: "exited", Created: old.Unix(), SizeRw: 20,
+				Labels: map[string]string{"env": "dev"},
+				Mounts: []types.MountPoint{{Type: "volume", Name: "job-data"}, {Type: "volume", Name: "shared"}, {Type: "bind", Name: ""}}},
+			{ID: "fresh", Names: []string{"/fresh"}, ImageID: "img-web", State: "created", Created: recent.Unix(), SizeRw: 40,
+				Labels: map[string]string{"keep": ""}},
+			{ID: "paused", Names: []string{"/paused"}, ImageID: "img-web", State: "paused", Created: old.Unix(), SizeRw: 80},
+		},
+		Images: []*types.ImageSummary{
+			{ID: "img-web", RepoTags: []string{"web:latest"}, Created: old.Unix(), Size: 100},
+			{ID: "img-job", RepoTags: []string{"job:1", "job:latest"}, Created: old.Unix(), Size: 200, SharedSize: 50,
+				Labels: map[string]string{"env": "dev"}},
+			{ID: "img-dangling", RepoTags: []string{"<none>:<none>"}, Created: old.Unix(), Size: 300},
+			{ID: "img-untagged", Created: recent.Unix(), Size: 400},
+		},
+		Volumes: []*volume.Volume{
+			{Name: "shared", UsageData: &volume.UsageData{Size: 1000, RefCount: 2}},
+			{Name: "job-data", UsageData: &volume.UsageData{Size: 2000, RefCount: 1}},
+			{Name: "anon", Labels: map[string]string{anonymousVolumeLabel: ""}, UsageData: &volume.UsageData{Size: 3000}},
+			{Name: "named", UsageData: &volume.UsageData{Size: -1}},
+			{Name: "no-usage", Labels: map[string]string{anonymousVolumeLabel: "", "env": "dev"}},
+		},
+		BuildCache: []*types.BuildCache{
+			{ID: "bc-active", InUse: true, Size: 10000, CreatedAt: old},
+			{ID: "bc-shared", Shared: true, Size: 20000, CreatedAt: old, Description: "shared layer"},
+			{ID: "bc-old", Size: 30000, CreatedAt: old},
+			{ID: "bc-used", Size: 40000, CreatedAt: old, LastUsedAt: &recent},
+		},
+	}
+}
+
+// pruneItemIDs returns the sorted ids of items
+func pruneItemIDs(items []PruneItem) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestPruneDryRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       PruneOptions
+		containers []string
+		images     []string
+		volumes    []string
+		buildCache []string
+		reclaimed  uint64
+	}{
+		{
+			name:       "dangling",
+			opts:       PruneOptions{Containers: true, Images: "dangling", Volumes: true, BuildCache: true},
+			containers: []string{"fresh", "job"},
+			images:     []string{"img-dangling", "img-untagged"},
+			volumes:    []string{"anon", "no-usage"},
+			buildCache: []string{"bc-old", "bc-shared", "bc-used"},
+			reclaimed:  20 + 40 + 300 + 400 + 3000 + 30000 + 40000,
+		},
+		{
+			// Images and volumes of the removed job container become unused
+			name:       "unused and named volumes",
+			opts:       PruneOptions{Containers: true, Images: "unused", Volumes: true, AllVolumes: true},
+			containers: []string{"fresh", "job"},
+			images:     []string{"img-dangling", "img-job", "img-untagged"},
+			volumes:    []string{"anon", "job-data", "named", "no-usage"},
+			reclaimed:  20 + 40 + 300 + 150 + 400 + 2000 + 3000,
+		},
+		{
+			name:      "images held by kept containers",
+			opts:      PruneOptions{Images: "unused"},
+			images:    []string{"img-dangling", "img-untagged"},
+			reclaimed: 300 + 400,
+		},
+		{
+			name:       "until",
+			opts:       PruneOptions{Containers: true, Images: "unused", BuildCache: true, Until: "24h"},
+			containers: []string{"job"},
+			images:     []string{"img-dangling", "img-job"},
+			buildCache: []string{"bc-old", "bc-shared"},
+			reclaimed:  20 + 300 + 150 + 30000,
+		},
+		{
+			name:       "labels",
+			opts:       PruneOptions{Containers: true, Images: "unused", Volumes: true, Labels: []string{"env=dev"}},
+			containers: []string{"job"},
+			images:     []string{"img-job"},
+			volumes:    []string{"no-usage"},
+			reclaimed:  20 + 150,
+		},
+		{
+			name:       "negated labels",
+			opts:       PruneOptions{Containers: true, Labels: []string{"!keep"}},
+			containers: []string{"job"},
+			reclaimed:  20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &DockerService{}
+			du := testDiskUsage()
+			tt.opts.DryRun = true
+			report := &PruneReport{DryRun: true}
+
+			// Same order as Prune
+			if tt.opts.Containers {
+				if err := s.pruneContainers(context.Background(), tt.opts, du, report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.opts.Images != "" {
+				if err := s.pruneImages(context.Background(), tt.opts, du, report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.opts.Volumes {
+				if err := s.pruneVolumes(context.Background(), tt.opts, du, report); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.opts.BuildCache {
+				if err := s.pruneBuildCache(context.Background(), tt.opts, du, report); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, got := range []struct {
+				kind  string
+				items []PruneItem
+				want  []string
+			}{
+				{"containers", report.Containers, tt.containers},
+				{"images", report.Images, tt.images},
+				{"volumes", report.Volumes, tt.volumes},
+				{"build cache", report.BuildCache, tt.buildCache},
+			} {
+				if ids := pruneItemIDs(got.items); !reflect.DeepEqual(ids, append([]string{}, got.want...)) {
+					t.Errorf("%s = %q, want %q", got.kind, ids, got.want)
+				}
+			}
+			if report.SpaceReclaimed != tt.reclaimed {
+				t.Errorf("reclaimed %d, want %d", report.SpaceReclaimed, tt.reclaimed)
+			}
+		})
+	}
+}
+
+func TestPruneDryRunNames(t *testing.T) {
+	s := &DockerService{}
+	report := &PruneReport{}
+	opts := PruneOptions{Containers: true, Images: "unused", DryRun: true}
+	du := testDiskUsage()
+	s.pruneContainers(context.Background(), opts, du, report)
+	s.pruneImages(context.Background(), opts, du, report)
+
+	names := make(map[string]string)
+	for _, item := range append(report.Containers, report.Images...) {
+		names[item.ID] = item.Name
+	}
+	want := map[string]string{"job": "job", "fresh": "fresh", "img-job": "job:1, job:latest", "img-dangling": "", "img-untagged": ""}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+}
+
+func TestPruneNotConnected(t *testing.T) {
+	s := &DockerService{}
+	if _, err := s.Prune(context.Background(), PruneOptions{Containers: true}); !errors.Is(err, ErrDockerNotConnected) {
+		t.Errorf("Prune() error = %v, want ErrDockerNotConnected", err)
+	}
+}
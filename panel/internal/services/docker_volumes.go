@@ -0,0 +1,836 @@
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/vpanel/server/internal/models"
+)
+
+const (
+	// Image of the throwaway container used when the volume mountpoint is not reachable
+	volumeHelperImage = "busybox:latest"
+	volumeHelperMount = "/volume"
+	volumeHelperLabel = "io.vpanel.helper"
+)
+
+// VolumeFileInfo represents a file inside a Docker volume
+type VolumeFileInfo struct {
+	Name        string      `json:"name"`
+	Path        string      `json:"path"`
+	IsDir       bool        `json:"is_dir"`
+	Size        int64       `json:"size"`
+	Mode        os.FileMode `json:"mode"`
+	ModeString  string      `json:"mode_string"`
+	ModTime     time.Time   `json:"mod_time"`
+	IsSymlink   bool        `json:"is_symlink"`
+	SymlinkPath string      `json:"symlink_path,omitempty"`
+}
+
+// ListVolumeBackups returns volume backups, optionally for a single volume
+func (s *DockerService) ListVolumeBackups(volumeName string) ([]models.DockerVolumeBackup, error) {
+	var backups []models.DockerVolumeBackup
+	query := s.db.Order("created_at DESC")
+	if volumeName != "" {
+		query = query.Where("volume = ?", volumeName)
+	}
+	if err := query.Find(&backups).Error; err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+// GetVolumeBackup returns a volume backup by ID
+func (s *DockerService) GetVolumeBackup(id string) (*models.DockerVolumeBackup, error) {
+	var backup models.DockerVolumeBackup
+	if err := s.db.Where("id = ?", id).Limit(1).Find(&backup).Error; err != nil {
+		return nil, err
+	}
+	if backup.ID == "" {
+		return nil, ErrVolumeBackupNotFound
+	}
+	return &backup, nil
+}
+
+// BackupVolume snapshots a volume into a tar.gz archive in the backup storage location.
+// The archive is written in the background, the returned record tracks its status.
+func (s *DockerService) BackupVolume(ctx context.Context, name, createdBy string) (*models.DockerVolumeBackup, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	vol, err := s.inspectVolume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := fmt.Sprintf("%s_%s.tar.gz", vol.Name, time.Now().Format("20060102_150405"))
+	backup := &models.DockerVolumeBackup{
+		Volume:    vol.Name,
+		FileName:  fileName,
+		FilePath:  filepath.Join(s.settings.BackupDir(), "volumes", vol.Name, fileName),
+		Status:    "in_progress",
+		CreatedBy: createdBy,
+	}
+	if err := s.db.Create(backup).Error; err != nil {
+		return nil, err
+	}
+
+	go s.performVolumeBackup(backup, vol)
+
+	s.log.Info("Volume backup started", "id", backup.ID, "volume", vol.Name)
+	return backup, nil
+}
+
+// performVolumeBackup writes the archive and records the outcome
+func (s *DockerService) performVolumeBackup(backup *models.DockerVolumeBackup, vol volume.Volume) {
+	startTime := time.Now()
+	method, err := s.writeVolumeArchive(context.Background(), vol, backup.FilePath)
+
+	completedAt := time.Now()
+	updates := map[string]interface{}{
+		"method":       method,
+		"completed_at": &completedAt,
+	}
+
+	if err != nil {
+		updates["status"] = "failed"
+		updates["error"] = err.Error()
+		s.log.Error("Volume backup failed", "id", backup.ID, "volume", vol.Name, "error", err)
+	} else {
+		updates["status"] = "completed"
+		if info, statErr := os.Stat(backup.FilePath); statErr == nil {
+			updates["file_size"] = info.Size()
+		}
+		s.log.Info("Volume backup completed", "id", backup.ID, "volume", vol.Name, "method", method, "duration", completedAt.Sub(startTime))
+	}
+
+	s.db.Model(backup).Updates(updates)
+}
+
+func (s *DockerService) writeVolumeArchive(ctx context.Context, vol volume.Volume, dest string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
+	}
+
+	tmp := dest + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	gz := gzip.NewWriter(f)
+	method, err := s.readVolume(ctx, vol, gz)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return method, err
+	}
+
+	return method, os.Rename(tmp, dest)
+}
+
+// RestoreVolumeBackup extracts a backup into target, or into the original volume when
+// target is empty. Missing volumes are created, files in existing ones are overwritten.
+// Volumes used by running containers are only restored into when force is set.
+func (s *DockerService) RestoreVolumeBackup(ctx context.Context, id, target string, force bool) error {
+	if s.client == nil {
+		return ErrDockerNotConnected
+	}
+
+	backup, err := s.GetVolumeBackup(id)
+	if err != nil {
+		return err
+	}
+	if backup.Status != "completed" {
+		return ErrVolumeBackupIncomplete
+	}
+	if target == "" {
+		target = backup.Volume
+	}
+
+	f, err := os.Open(backup.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+	defer gz.Close()
+
+	vol, err := s.inspectVolume(ctx, target)
+	switch {
+	case errors.Is(err, ErrVolumeNotFound):
+		vol, err = s.client.VolumeCreate(ctx, volume.CreateOptions{Name: target, Driver: "local"})
+		if err != nil {
+			return fmt.Errorf("failed to create volume: %w", err)
+		}
+	case err != nil:
+		return err
+	case !force:
+		inUse, err := s.volumeInUse(ctx, target)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return ErrVolumeInUse
+		}
+	}
+
+	method, err := s.writeVolume(ctx, vol, gz)
+	if err != nil {
+		return fmt.Errorf("failed to restore volume: %w", err)
+	}
+
+	s.log.Info("Volume restored", "backup_id", id, "volume", target, "method", method)
+	return nil
+}
+
+// DeleteVolumeBackup deletes a backup record and its archive
+func (s *DockerService) DeleteVolumeBackup(id string) error {
+	backup, err := s.GetVolumeBackup(id)
+	if err != nil {
+		return err
+	}
+	if backup.Status == "in_progress" {
+		return ErrVolumeBackupIncomplete
+	}
+
+	if err := os.Remove(backup.FilePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := s.db.Delete(backup).Error; err != nil {
+		return err
+	}
+
+	s.log.Info("Volume backup deleted", "id", id)
+	return nil
+}
+
+// CloneVolume creates target with the driver and labels of source and copies its files
+func (s *DockerService) CloneVolume(ctx context.Context, source, target string) (*VolumeInfo, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	src, err := s.inspectVolume(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.inspectVolume(ctx, target); err == nil {
+		return nil, ErrVolumeExists
+	} else if !errors.Is(err, ErrVolumeNotFound) {
+		return nil, err
+	}
+
+	dst, err := s.client.VolumeCreate(ctx, volume.CreateOptions{
+		Name:       target,
+		Driver:     src.Driver,
+		DriverOpts: src.Options,
+		Labels:     src.Labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.readVolume(ctx, src, pw)
+		pw.CloseWithError(err)
+	}()
+
+	if _, err := s.writeVolume(ctx, dst, pr); err != nil {
+		pr.CloseWithError(err)
+		s.client.VolumeRemove(ctx, dst.Name, true)
+		return nil, fmt.Errorf("failed to copy volume: %w", err)
+	}
+
+	s.log.Info("Volume cloned", "source", source, "target", target)
+	return &VolumeInfo{
+		Name:       dst.Name,
+		Driver:     dst.Driver,
+		Mountpoint: dst.Mountpoint,
+		Created:    dst.CreatedAt,
+	}, nil
+}
+
+// ListVolumeFiles lists a directory inside a volume
+func (s *DockerService) ListVolumeFiles(ctx context.Context, name, dir string) ([]VolumeFileInfo, error) {
+	if s.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	vol, err := s.inspectVolume(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rel := cleanVolumePath(dir)
+
+	if root, ok := localMountpoint(vol); ok {
+		full, err := resolveInVolume(root, rel)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(full)
+		if err != nil {
+			return nil, err
+		}
+
+		files := make([]VolumeFileInfo, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			file := volumeFileInfo(path.Join("/", rel, entry.Name()), info)
+			if file.IsSymlink {
+				file.SymlinkPath, _ = os.Readlink(filepath.Join(full, entry.Name()))
+			}
+			files = append(files, file)
+		}
+		return files, nil
+	}
+
+	// Without the mountpoint the directory is read as an archive from a helper container
+	rc, cleanup, err := s.copyFromVolume(ctx, vol.Name, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	defer rc.Close()
+
+	files := []VolumeFileInfo{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Entries are rooted at the base name of the requested path
+		_, child, _ := strings.Cut(strings.TrimSuffix(hdr.Name, "/"), "/")
+		if child == "" || strings.Contains(child, "/") {
+			if child == "" && hdr.Typeflag != tar.TypeDir {
+				return nil, ErrVolumeNotDirectory
+			}
+			continue
+		}
+
+		file := volumeFileInfo(path.Join("/", rel, child), hdr.FileInfo())
+		file.SymlinkPath = hdr.Linkname
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// OpenVolumePath opens a file inside a volume for download. Directories are
+// streamed as a tar.gz archive.
+func (s *DockerService) OpenVolumePath(ctx context.Context, name, p string) (io.ReadCloser, *VolumeFileInfo, error) {
+	if s.client == nil {
+		return nil, nil, ErrDockerNotConnected
+	}
+
+	vol, err := s.inspectVolume(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	rel := cleanVolumePath(p)
+	base := path.Base("/" + rel)
+	if rel == "" {
+		base = vol.Name
+	}
+
+	if root, ok := localMountpoint(vol); ok {
+		full, err := resolveInVolume(root, rel)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			return nil, nil, err
+		}
+		file := volumeFileInfo("/"+rel, info)
+		file.Name = base
+
+		if !info.IsDir() {
+			f, err := os.Open(full)
+			if err != nil {
+				return nil, nil, err
+			}
+			return f, &file, nil
+		}
+
+		return gzipPipe(func(w io.Writer) error {
+			return tarDirectory(full, base, w)
+		}), &file, nil
+	}
+
+	rc, cleanup, err := s.copyFromVolume(ctx, vol.Name, rel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		rc.Close()
+		cleanup()
+		return nil, nil, err
+	}
+	file := volumeFileInfo("/"+rel, hdr.FileInfo())
+	file.Name = base
+
+	if hdr.Typeflag != tar.TypeDir {
+		return &readCloser{Reader: tr, close: func() error {
+			defer cleanup()
+			return rc.Close()
+		}}, &file, nil
+	}
+
+	// Re-read the archive so the directory entry itself is included
+	rc.Close()
+	cleanup()
+	return gzipPipe(func(w io.Writer) error {
+		rc, cleanup, err := s.copyFromVolume(ctx, vol.Name, rel)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		defer rc.Close()
+		return rebaseTar(rc, w, base)
+	}), &file, nil
+}
+
+// readVolume writes the volume contents to w as a tar stream with paths relative to its root
+func (s *DockerService) readVolume(ctx context.Context, vol volume.Volume, w io.Writer) (string, error) {
+	if root, ok := localMountpoint(vol); ok {
+		return "mountpoint", tarDirectory(root, "", w)
+	}
+
+	rc, cleanup, err := s.copyFromVolume(ctx, vol.Name, "")
+	if err != nil {
+		return "helper", err
+	}
+	defer cleanup()
+	defer rc.Close()
+
+	return "helper", rebaseTar(rc, w, "")
+}
+
+// writeVolume extracts a tar stream with relative paths into the volume
+func (s *DockerService) writeVolume(ctx context.Context, vol volume.Volume, r io.Reader) (string, error) {
+	if root, ok := localMountpoint(vol); ok {
+		return "mountpoint", extractTar(root, r)
+	}
+
+	id, cleanup, err := s.createVolumeHelper(ctx, vol.Name, false)
+	if err != nil {
+		return "helper", err
+	}
+	defer cleanup()
+
+	return "helper", s.client.CopyToContainer(ctx, id, volumeHelperMount, r, types.CopyToContainerOptions{CopyUIDGID: true})
+}
+
+// copyFromVolume returns the daemon's tar archive of a path inside the volume.
+// Entries are rooted at the base name of the path ("volume" for the root).
+func (s *DockerService) copyFromVolume(ctx context.Context, name, rel string) (io.ReadCloser, func(), error) {
+	id, cleanup, err := s.createVolumeHelper(ctx, name, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rc, _, err := s.client.CopyFromContainer(ctx, id, path.Join(volumeHelperMount, rel))
+	if err != nil {
+		cleanup()
+		if client.IsErrNotFound(err) {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, err
+	}
+	return rc, cleanup, nil
+}
+
+// createVolumeHelper creates, but never starts, a container with the volume mounted so
+// its files can be copied through the archive API
+func (s *DockerService) createVolumeHelper(ctx context.Context, name string, readOnly bool) (string, func(), error) {
+	if _, _, err := s.client.ImageInspectWithRaw(ctx, volumeHelperImage); err != nil {
+		if !client.IsErrNotFound(err) {
+			return "", nil, err
+		}
+		reader, err := s.client.ImagePull(ctx, volumeHelperImage, types.ImagePullOptions{})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to pull helper image: %w", err)
+		}
+		io.Copy(io.Discard, reader)
+		reader.Close()
+	}
+
+	resp, err := s.client.ContainerCreate(ctx,
+		&container.Config{
+			Image:           volumeHelperImage,
+			Cmd:             []string{"true"},
+			Labels:          map[string]string{volumeHelperLabel: "volume"},
+			NetworkDisabled: true,
+		},
+		&container.HostConfig{
+			Mounts: []mount.Mount{{
+				Type:     mount.TypeVolume,
+				Source:   name,
+				Target:   volumeHelperMount,
+				ReadOnly: readOnly,
+			}},
+		},
+		nil, nil, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create helper container: %w", err)
+	}
+
+	cleanup := func() {
+		if err := s.client.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			s.log.Warn("Failed to remove volume helper container", "id", resp.ID, "error", err)
+		}
+	}
+	return resp.ID, cleanup, nil
+}
+
+func (s *DockerService) inspectVolume(ctx context.Context, name string) (volume.Volume, error) {
+	vol, err := s.client.VolumeInspect(ctx, name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return vol, ErrVolumeNotFound
+		}
+		return vol, err
+	}
+	return vol, nil
+}
+
+// volumeInUse reports whether a running container mounts the volume
+func (s *DockerService) volumeInUse(ctx context.Context, name string) (bool, error) {
+	containers, err := s.client.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("volume", name)),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(containers) > 0, nil
+}
+
+// localMountpoint returns the host path of a local volume when the panel can reach it
+func localMountpoint(vol volume.Volume) (string, bool) {
+	if vol.Driver != "local" || vol.Mountpoint == "" {
+		return "", false
+	}
+	if info, err := os.Stat(vol.Mountpoint); err != nil || !info.IsDir() {
+		return "", false
+	}
+	return vol.Mountpoint, true
+}
+
+// cleanVolumePath normalises a user supplied path to one relative to the volume root
+func cleanVolumePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// resolveInVolume resolves rel under root, rejecting symlinks that lead outside of it
+func resolveInVolume(root, rel string) (string, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(resolvedRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	if resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+		return "", ErrVolumePathOutside
+	}
+	return resolved, nil
+}
+
+func volumeFileInfo(p string, info fs.FileInfo) VolumeFileInfo {
+	return VolumeFileInfo{
+		Name:       info.Name(),
+		Path:       p,
+		IsDir:      info.IsDir(),
+		Size:       info.Size(),
+		Mode:       info.Mode(),
+		ModeString: info.Mode().String(),
+		ModTime:    info.ModTime(),
+		IsSymlink:  info.Mode()&os.ModeSymlink != 0,
+	}
+}
+
+// tarDirectory writes dir to w as a tar stream, entries are prefixed with prefix when set.
+// Ownership, permissions and symlinks are preserved, symlinks are never followed.
+func tarDirectory(dir, prefix string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if rel == "." {
+			if prefix == "" {
+				return nil
+			}
+			name = prefix
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice) != 0 {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// rebaseTar copies a daemon archive to w, replacing the leading path component with prefix
+func rebaseTar(r io.Reader, w io.Writer, prefix string) error {
+	rebase := func(name string) string {
+		_, rest, _ := strings.Cut(name, "/")
+		return path.Join(prefix, rest)
+	}
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = rebase(hdr.Name)
+		if hdr.Name == "" || hdr.Name == "." {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rebase(hdr.Linkname)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// extractTar extracts a tar stream into root. Entries may not escape root, either by
+// their name or through symlinks extracted earlier.
+func extractTar(root string, r io.Reader) error {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	// within checks that the deepest existing parent of p resolves inside root
+	within := func(p string) error {
+		dir := filepath.Dir(p)
+		for {
+			resolved, err := filepath.EvalSymlinks(dir)
+			if os.IsNotExist(err) {
+				dir = filepath.Dir(dir)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+string(filepath.Separator)) {
+				return ErrVolumePathOutside
+			}
+			return nil
+		}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := cleanVolumePath(hdr.Name)
+		if rel == "" {
+			continue
+		}
+		target := filepath.Join(resolvedRoot, filepath.FromSlash(rel))
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+		if err := within(target); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				os.Remove(target)
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			os.Chmod(target, mode)
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// Replace rather than write through an existing symlink
+			if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(target)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			os.Chmod(target, mode)
+
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			source := filepath.Join(resolvedRoot, filepath.FromSlash(cleanVolumePath(hdr.Linkname)))
+			if err := within(source); err != nil {
+				return err
+			}
+			os.RemoveAll(target)
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+
+		default:
+			// Devices, fifos and sockets are not restored
+			continue
+		}
+
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+		if hdr.Typeflag != tar.TypeSymlink {
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
+
+// gzipPipe runs fn in the background and returns its output gzip compressed
+func gzipPipe(fn func(w io.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := fn(gz)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// Errors
+var (
+	ErrVolumeNotFound         = newError("volume not found")
+	ErrVolumeExists           = newError("volume already exists")
+	ErrVolumeInUse            = newError("volume is in use by a running container")
+	ErrVolumeNotDirectory     = newError("not a directory")
+	ErrVolumePathOutside      = newError("path resolves outside of the volume")
+	ErrVolumeBackupNotFound   = newError("volume backup not found")
+	ErrVolumeBackupIncomplete = newError("volume backup is not completed")
+)
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// volumeTarEntry is an entry of a test archive
+type volumeTarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+	mode     int64
+}
+
+// volumeTar builds a tar stream of entries
+func volumeTar(t *testing.T, entries ...volumeTarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: mode,
+			Size: int64(len(e.content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// newTestVolume returns a volume root and a directory outside of it holding secret.txt,
+// the root has a regular file, a directory and links inside and out of it
+func newTestVolume(t *testing.T) (root, outside string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(base, "volume")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "data"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(root, "data", "a.txt"): "a",
+		filepath.Join(outside, "secret.txt"): "secret",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"inside":   "data/a.txt",
+		"absolute": outside,
+		"relative": "../outside/secret.txt",
+		"dotdot":   "data/../../outside",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestCleanVolumePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"data/a.txt", "data/a.txt"},
+		{"/data/./a.txt", "data/a.txt"},
+		{"../../etc/passwd", "etc/passwd"},
+		{"data/../../etc", "etc"},
+		{"/etc/passwd", "etc/passwd"},
+	}
+	for _, tt := range tests {
+		if got := cleanVolumePath(tt.path); got != tt.want {
+			t.Errorf("cleanVolumePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestResolveInVolume(t *testing.T) {
+	root, _ := newTestVolume(t)
+	tests := []struct {
+		rel  string
+		want string // relative to root
+		err  error
+	}{
+		{"", ".", nil},
+		{"data", "data", nil},
+		{"data/a.txt", "data/a.txt", nil},
+		{"inside", "data/a.txt", nil},
+		{"absolute", "", ErrVolumePathOutside},
+		{"absolute/secret.txt", "", ErrVolumePathOutside},
+		{"relative", "", ErrVolumePathOutside},
+		{"dotdot", "", ErrVolumePathOutside},
+		{cleanVolumePath("../outside/secret.txt"), "", os.ErrNotExist},
+		{cleanVolumePath("/etc/passwd"), "", os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		got, err := resolveInVolume(root, tt.rel)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("resolveInVolume(%q) = %q, %v, want %v", tt.rel, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != filepath.Join(root, tt.want) {
+			t.Errorf("resolveInVolume(%q) = %q, %v, want %q", tt.rel, got, err, tt.want)
+		}
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	root, outside := newTestVolume(t)
+	archive := volumeTar(t,
+		volumeTarEntry{name: "app/", typeflag: tar.TypeDir, mode: 0750},
+		volumeTarEntry{name: "app/config.yml", typeflag: tar.TypeReg, content: "port: 80\n", mode: 0600},
+		volumeTarEntry{name: "app/current", typeflag: tar.TypeSymlink, linkname: "config.yml"},
+		volumeTarEntry{name: "app/hard", typeflag: tar.TypeLink, linkname: "app/config.yml"},
+		volumeTarEntry{name: "app/fifo", typeflag: tar.TypeFifo},
+		// Names are cleaned to the volume root
+		volumeTarEntry{name: "../../escaped.txt", typeflag: tar.TypeReg, content: "x"},
+		volumeTarEntry{name: "/absolute.txt", typeflag: tar.TypeReg, content: "y"},
+		// Existing links are replaced rather than written through
+		volumeTarEntry{name: "relative", typeflag: tar.TypeReg, content: "replaced"},
+		volumeTarEntry{name: "absolute/", typeflag: tar.TypeDir},
+	)
+	if err := extractTar(root, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"app/config.yml":        "port: 80\n",
+		"app/current":           "port: 80\n",
+		"app/hard":              "port: 80\n",
+		"escaped.txt":           "x",
+		"absolute.txt":          "y",
+		"relative":              "replaced",
+		"../outside/secret.txt": "secret",
+	}
+	for name, want := range files {
+		if data, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	modes := map[string]os.FileMode{"app": os.ModeDir | 0750, "app/config.yml": 0600, "relative": 0644, "absolute": os.ModeDir | 0644}
+	for name, want := range modes {
+		if info, err := os.Lstat(filepath.Join(root, name)); err != nil || info.Mode() != want {
+			t.Errorf("%s mode = %v, want %v (%v)", name, info.Mode(), want, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "app", "fifo")); !os.IsNotExist(err) {
+		t.Errorf("fifo extracted: %v", err)
+	}
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 1 {
+		t.Errorf("%d entries outside of the volume, want only secret.txt", len(entries))
+	}
+}
+
+func TestExtractTarEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []volumeTarEntry
+	}{
+		{"file through an existing link", []volumeTarEntry{
+			{name: "absolute/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+		}},
+		{"file through a relative link", []volumeTarEntry{
+			{name: "dotdot/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+		}},
+		{"file through an extracted link", []volumeTarEntry{
+			{name: "out", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "out/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+		}},
+		{"directory through an extracted link", []volumeTarEntry{
+			{name: "out", typeflag: tar.TypeSymlink, linkname: "/"},
+			{name: "out/tmp/evil/", typeflag: tar.TypeDir},
+		}},
+		{"link through an extracted link", []volumeTarEntry{
+			{name: "out", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "out/evil", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"},
+		}},
+		{"hard link to a file outside", []volumeTarEntry{
+			{name: "out", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			{name: "stolen", typeflag: tar.TypeLink, linkname: "out/secret.txt"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, outside := newTestVolume(t)
+			if err := extractTar(root, volumeTar(t, tt.entries...)); !errors.Is(err, ErrVolumePathOutside) {
+				t.Fatalf("extractTar() error = %v, want ErrVolumePathOutside", err)
+			}
+			entries, _ := os.ReadDir(outside)
+			if len(entries) != 1 {
+				t.Errorf("%d entries outside of the volume, want only secret.txt", len(entries))
+			}
+			if _, err := os.Lstat(filepath.Join(root, "stolen")); !os.IsNotExist(err) {
+				t.Errorf("hard link to a file outside created: %v", err)
+			}
+		})
+	}
+}
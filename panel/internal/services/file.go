@@ -1,38 +1,75 @@
 package services
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
+	"context"
+	"crypto/rand"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
 	"github.com/vpanel/server/pkg/logger"
 	"gorm.io/gorm"
 )
 
 // FileService handles file operations
 type FileService struct {
-	db       *gorm.DB
-	config   *config.Config
-	log      *logger.Logger
-	rootPath string
+	db        *gorm.DB
+	config    *config.Config
+	log       *logger.Logger
+	rootPath  string
+	jail      *fileJail
+	userID    string // who the service acts for, see ForUser
+	username  string
+	localOnly bool   // a jail keeps the user off remote locations
+	jailed    bool   // restricted by a file manager jail, see ForUser
+	shareKey  []byte // signs the tickets of share visitors, new on every start
+
+	uploadLocks *sync.Map // upload ID -> *sync.Mutex
+	writeLocks  *sync.Map // path -> *sync.Mutex
+	indexes     *sync.Map // path -> *FileIndex
+	jobs        *sync.Map // job ID -> *FileJob
+	remotes     *sync.Map // location ID -> remoteFS
+	lineIndexes *sync.Map // path -> *fileLineIndex
+	trashLock   *sync.Mutex
 }
 
-// NewFileService creates a new file service
+// NewFileService creates a new file service restricted to the configured roots
 func NewFileService(db *gorm.DB, cfg *config.Config, log *logger.Logger) *FileService {
-	return &FileService{
-		db:       db,
-		config:   cfg,
-		log:      log,
-		rootPath: "/", // Can be restricted for security
-	}
+	roots := make([]models.FileRoot, 0, len(cfg.Files.Roots))
+	for _, root := range cfg.Files.Roots {
+		roots = append(roots, models.FileRoot{Path: root.Path, ReadOnly: root.ReadOnly})
+	}
+	jail := newFileJail(roots, cfg.Files.Deny)
+	shareKey := make([]byte, 32)
+	rand.Read(shareKey)
+
+	svc := &FileService{
+		db:          db,
+		config:      cfg,
+		log:         log,
+		rootPath:    jail.roots[0].Path,
+		jail:        jail,
+		shareKey:    shareKey,
+		uploadLocks: &sync.Map{},
+		writeLocks:  &sync.Map{},
+		indexes:     &sync.Map{},
+		jobs:        &sync.Map{},
+		remotes:     &sync.Map{},
+		lineIndexes: &sync.Map{},
+		trashLock:   &sync.Mutex{},
+	}
+
+	// Purge expired trash in the background
+	go svc.trashLoop()
+
+	return svc
 }
 
 // FileInfo represents file information
@@ -53,25 +90,19 @@ type FileInfo struct {
 
 // ListDir lists directory contents
 func (s *FileService) ListDir(path string) ([]FileInfo, error) {
-	fullPath := s.resolvePath(path)
-
-	// Security check
-	if !s.isPathAllowed(fullPath) {
-		return nil, ErrPathNotAllowed
+	backend, fullPath, err := s.locate(path, fileRead)
+	if err != nil {
+		return nil, err
 	}
 
-	entries, err := os.ReadDir(fullPath)
+	entries, err := backend.ReadDir(fullPath)
 	if err != nil {
 		return nil, err
 	}
 
+	names := newOwnerNames()
 	files := make([]FileInfo, 0, len(entries))
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
-			continue
-		}
-
+	for _, info := range entries {
 		fi := FileInfo{
 			Name:       info.Name(),
 			Path:       filepath.Join(path, info.Name()),
@@ -81,11 +112,12 @@ func (s *FileService) ListDir(path string) ([]FileInfo, error) {
 			ModeString: info.Mode().String(),
 			ModTime:    info.ModTime(),
 		}
+		fi.Owner, fi.Group = names.of(info)
 
 		// Check if symlink
 		if info.Mode()&os.ModeSymlink != 0 {
 			fi.IsSymlink = true
-			target, _ := os.Readlink(filepath.Join(fullPath, info.Name()))
+			target, _ := backend.Readlink(filepath.Join(fullPath, info.Name()))
 			fi.SymlinkPath = target
 		}
 
@@ -110,14 +142,13 @@ func (s *FileService) ListDir(path string) ([]FileInfo, error) {
 
 // ReadFile reads file content
 func (s *FileService) ReadFile(path string) ([]byte, error) {
-	fullPath := s.resolvePath(path)
-
-	if !s.isPathAllowed(fullPath) {
-		return nil, ErrPathNotAllowed
+	backend, fullPath, err := s.locate(path, fileRead)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check file size
-	info, err := os.Stat(fullPath)
+	info, err := backend.Stat(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -131,56 +162,99 @@ func (s *FileService) ReadFile(path string) ([]byte, error) {
 		return nil, ErrFileTooLarge
 	}
 
-	return os.ReadFile(fullPath)
+	f, err := backend.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
 }
 
-// WriteFile writes content to file
-func (s *FileService) WriteFile(path string, content []byte) error {
-	fullPath := s.resolvePath(path)
+// WriteFile writes content to file when the file still meets cond. The content on disk
+// and the new content are kept as versions, the new ETag of the file is returned.
+func (s *FileService) WriteFile(path string, content []byte, cond FilePrecondition) (string, error) {
+	backend, fullPath, err := s.locate(path, fileWrite)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := backend.(localFS); !ok {
+		return s.writeRemote(backend, path, fullPath, content, cond)
+	}
 
-	if !s.isPathAllowed(fullPath) {
-		return ErrPathNotAllowed
+	lock := s.writeLock(fullPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, info, etag, err := readVersionable(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := cond.check(info, etag); err != nil {
+		return "", err
+	}
+	// Edits made outside the panel since the last version are kept as well
+	if current != nil {
+		s.saveVersion(fullPath, current, false)
 	}
 
 	// Ensure parent directory exists
 	dir := filepath.Dir(fullPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+		return "", err
 	}
 
-	return os.WriteFile(fullPath, content, 0644)
+	if err := os.WriteFile(fullPath, content, 0644); err != nil {
+		return "", err
+	}
+	s.saveVersion(fullPath, content, true)
+	return FileETag(content), nil
 }
 
 // CreateDir creates a directory
 func (s *FileService) CreateDir(path string) error {
-	fullPath := s.resolvePath(path)
-
-	if !s.isPathAllowed(fullPath) {
-		return ErrPathNotAllowed
+	backend, fullPath, err := s.locate(path, fileWrite)
+	if err != nil {
+		return err
 	}
 
-	return os.MkdirAll(fullPath, 0755)
+	return backend.MkdirAll(fullPath)
 }
 
-// Rename renames/moves a file or directory
+// Rename renames/moves a file or directory, to another location it is copied and then
+// removed
 func (s *FileService) Rename(oldPath, newPath string) error {
-	fullOldPath := s.resolvePath(oldPath)
-	fullNewPath := s.resolvePath(newPath)
-
-	if !s.isPathAllowed(fullOldPath) || !s.isPathAllowed(fullNewPath) {
+	src, fullOldPath, err := s.locate(oldPath, fileWrite|fileNoFollow)
+	if err != nil {
+		return err
+	}
+	dst, fullNewPath, err := s.locate(newPath, fileWrite|fileNoFollow)
+	if err != nil {
+		return err
+	}
+	if s.isTop(src, fullOldPath) {
 		return ErrPathNotAllowed
 	}
 
-	return os.Rename(fullOldPath, fullNewPath)
+	if src == dst {
+		return src.Rename(fullOldPath, fullNewPath)
+	}
+	return s.moveAcross(context.Background(), src, fullOldPath, dst, fullNewPath, nil)
 }
 
 // Copy copies a file or directory
 func (s *FileService) Copy(srcPath, dstPath string) error {
-	fullSrcPath := s.resolvePath(srcPath)
-	fullDstPath := s.resolvePath(dstPath)
-
-	if !s.isPathAllowed(fullSrcPath) || !s.isPathAllowed(fullDstPath) {
-		return ErrPathNotAllowed
+	src, fullSrcPath, err := s.locate(srcPath, fileRead)
+	if err != nil {
+		return err
+	}
+	dst, fullDstPath, err := s.locate(dstPath, fileWrite)
+	if err != nil {
+		return err
+	}
+	_, srcLocal := src.(localFS)
+	_, dstLocal := dst.(localFS)
+	if !srcLocal || !dstLocal {
+		return s.copyAcross(context.Background(), src, fullSrcPath, dst, fullDstPath, nil)
 	}
 
 	info, err := os.Stat(fullSrcPath)
@@ -196,29 +270,27 @@ func (s *FileService) Copy(srcPath, dstPath string) error {
 
 // Delete deletes a file or directory
 func (s *FileService) Delete(path string) error {
-	fullPath := s.resolvePath(path)
-
-	if !s.isPathAllowed(fullPath) {
-		return ErrPathNotAllowed
+	backend, fullPath, err := s.locate(path, fileWrite|fileNoFollow)
+	if err != nil {
+		return err
 	}
 
 	// Don't allow deleting root or critical paths
-	if fullPath == "/" || fullPath == s.rootPath {
+	if s.isTop(backend, fullPath) {
 		return ErrPathNotAllowed
 	}
 
-	return os.RemoveAll(fullPath)
+	return backend.RemoveAll(fullPath)
 }
 
 // GetFileInfo returns file information
 func (s *FileService) GetFileInfo(path string) (*FileInfo, error) {
-	fullPath := s.resolvePath(path)
-
-	if !s.isPathAllowed(fullPath) {
-		return nil, ErrPathNotAllowed
+	backend, fullPath, err := s.locate(path, fileRead)
+	if err != nil {
+		return nil, err
 	}
 
-	info, err := os.Stat(fullPath)
+	info, err := backend.Stat(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -232,6 +304,7 @@ func (s *FileService) GetFileInfo(path string) (*FileInfo, error) {
 		ModeString: info.Mode().String(),
 		ModTime:    info.ModTime(),
 	}
+	fi.Owner, fi.Group = newOwnerNames().of(info)
 
 	if !info.IsDir() {
 		fi.Extension = strings.TrimPrefix(filepath.Ext(info.Name()), ".")
@@ -240,23 +313,11 @@ func (s *FileService) GetFileInfo(path string) (*FileInfo, error) {
 	return fi, nil
 }
 
-// SetPermissions sets file permissions
-func (s *FileService) SetPermissions(path string, mode os.FileMode) error {
-	fullPath := s.resolvePath(path)
-
-	if !s.isPathAllowed(fullPath) {
-		return ErrPathNotAllowed
-	}
-
-	return os.Chmod(fullPath, mode)
-}
-
 // Search searches for files
 func (s *FileService) Search(basePath, pattern string, maxResults int) ([]FileInfo, error) {
-	fullPath := s.resolvePath(basePath)
-
-	if !s.isPathAllowed(fullPath) {
-		return nil, ErrPathNotAllowed
+	fullPath, err := s.checkPath(basePath, fileRead)
+	if err != nil {
+		return nil, err
 	}
 
 	if maxResults <= 0 {
@@ -265,8 +326,30 @@ func (s *FileService) Search(basePath, pattern string, maxResults int) ([]FileIn
 
 	results := make([]FileInfo, 0)
 	pattern = strings.ToLower(pattern)
+	add := func(path string, info os.FileInfo) {
+		relPath, _ := filepath.Rel(fullPath, path)
+		results = append(results, FileInfo{
+			Name:       info.Name(),
+			Path:       filepath.Join(basePath, relPath),
+			IsDir:      info.IsDir(),
+			Size:       info.Size(),
+			Mode:       info.Mode(),
+			ModeString: info.Mode().String(),
+			ModTime:    info.ModTime(),
+		})
+	}
+
+	// A current filename index of the tree saves the walk
+	if paths, ok := s.searchIndex(fullPath, pattern, maxResults); ok {
+		for _, path := range paths {
+			if info, err := os.Lstat(path); err == nil {
+				add(path, info)
+			}
+		}
+		return results, nil
+	}
 
-	err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Skip errors
 		}
@@ -274,18 +357,15 @@ func (s *FileService) Search(basePath, pattern string, maxResults int) ([]FileIn
 		if len(results) >= maxResults {
 			return filepath.SkipAll
 		}
+		if s.jail.check(path, false) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		if strings.Contains(strings.ToLower(info.Name()), pattern) {
-			relPath, _ := filepath.Rel(fullPath, path)
-			results = append(results, FileInfo{
-				Name:       info.Name(),
-				Path:       filepath.Join(basePath, relPath),
-				IsDir:      info.IsDir(),
-				Size:       info.Size(),
-				Mode:       info.Mode(),
-				ModeString: info.Mode().String(),
-				ModTime:    info.ModTime(),
-			})
+		if strings.Contains(strings.ToLower(info.Name()), pattern) && path != fullPath {
+			add(path, info)
 		}
 
 		return nil
@@ -294,49 +374,6 @@ func (s *FileService) Search(basePath, pattern string, maxResults int) ([]FileIn
 	return results, err
 }
 
-// Compress compresses files into an archive
-func (s *FileService) Compress(paths []string, destPath string, format string) error {
-	fullDestPath := s.resolvePath(destPath)
-
-	if !s.isPathAllowed(fullDestPath) {
-		return ErrPathNotAllowed
-	}
-
-	switch format {
-	case "zip":
-		return s.compressZip(paths, fullDestPath)
-	case "tar.gz", "tgz":
-		return s.compressTarGz(paths, fullDestPath)
-	default:
-		return s.compressZip(paths, fullDestPath)
-	}
-}
-
-// Decompress extracts an archive
-func (s *FileService) Decompress(archivePath, destPath string) error {
-	fullArchivePath := s.resolvePath(archivePath)
-	fullDestPath := s.resolvePath(destPath)
-
-	if !s.isPathAllowed(fullArchivePath) || !s.isPathAllowed(fullDestPath) {
-		return ErrPathNotAllowed
-	}
-
-	ext := strings.ToLower(filepath.Ext(archivePath))
-	switch ext {
-	case ".zip":
-		return s.decompressZip(fullArchivePath, fullDestPath)
-	case ".gz":
-		if strings.HasSuffix(strings.ToLower(archivePath), ".tar.gz") {
-			return s.decompressTarGz(fullArchivePath, fullDestPath)
-		}
-		return ErrUnsupportedFormat
-	case ".tgz":
-		return s.decompressTarGz(fullArchivePath, fullDestPath)
-	default:
-		return ErrUnsupportedFormat
-	}
-}
-
 // Helper methods
 
 func (s *FileService) resolvePath(path string) string {
@@ -346,34 +383,6 @@ func (s *FileService) resolvePath(path string) string {
 	return filepath.Clean(filepath.Join(s.rootPath, path))
 }
 
-func (s *FileService) isPathAllowed(path string) bool {
-	// Basic security checks
-	if path == "" {
-		return false
-	}
-
-	// Prevent path traversal
-	clean := filepath.Clean(path)
-	if strings.Contains(clean, "..") {
-		return false
-	}
-
-	// Add more restrictions as needed
-	// For example, block access to sensitive directories
-	blockedPaths := []string{
-		"/etc/shadow",
-		"/etc/passwd",
-	}
-
-	for _, blocked := range blockedPaths {
-		if strings.HasPrefix(clean, blocked) {
-			return false
-		}
-	}
-
-	return true
-}
-
 func (s *FileService) copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -416,233 +425,26 @@ func (s *FileService) copyDir(src, dst string) error {
 		srcPath := filepath.Join(src, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
 
-		if entry.IsDir() {
-			if err := s.copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			if err := s.copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-func (s *FileService) compressZip(paths []string, destPath string) error {
-	zipFile, err := os.Create(destPath)
-	if err != nil {
-		return err
-	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
-	for _, path := range paths {
-		fullPath := s.resolvePath(path)
-		if !s.isPathAllowed(fullPath) {
+		if s.jail.check(srcPath, false) != nil {
 			continue
 		}
-
-		err := filepath.Walk(fullPath, func(filePath string, info os.FileInfo, err error) error {
+		if entry.Type()&os.ModeSymlink != 0 {
+			// Links are copied as links, never followed
+			target, err := os.Readlink(srcPath)
 			if err != nil {
 				return err
 			}
-
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return err
-			}
-
-			relPath, _ := filepath.Rel(filepath.Dir(fullPath), filePath)
-			header.Name = relPath
-
-			if info.IsDir() {
-				header.Name += "/"
-			} else {
-				header.Method = zip.Deflate
-			}
-
-			writer, err := zipWriter.CreateHeader(header)
-			if err != nil {
-				return err
-			}
-
-			if !info.IsDir() {
-				file, err := os.Open(filePath)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-				_, err = io.Copy(writer, file)
-				return err
-			}
-
-			return nil
-		})
-
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (s *FileService) compressTarGz(paths []string, destPath string) error {
-	file, err := os.Create(destPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	gzWriter := gzip.NewWriter(file)
-	defer gzWriter.Close()
-
-	tarWriter := tar.NewWriter(gzWriter)
-	defer tarWriter.Close()
-
-	for _, path := range paths {
-		fullPath := s.resolvePath(path)
-		if !s.isPathAllowed(fullPath) {
-			continue
-		}
-
-		err := filepath.Walk(fullPath, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			header, err := tar.FileInfoHeader(info, "")
-			if err != nil {
-				return err
-			}
-
-			relPath, _ := filepath.Rel(filepath.Dir(fullPath), filePath)
-			header.Name = relPath
-
-			if err := tarWriter.WriteHeader(header); err != nil {
-				return err
-			}
-
-			if !info.IsDir() {
-				file, err := os.Open(filePath)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-				_, err = io.Copy(tarWriter, file)
-				return err
-			}
-
-			return nil
-		})
-
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (s *FileService) decompressZip(archivePath, destPath string) error {
-	reader, err := zip.OpenReader(archivePath)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-
-	for _, file := range reader.File {
-		filePath := filepath.Join(destPath, file.Name)
-
-		// Security check
-		if !strings.HasPrefix(filePath, filepath.Clean(destPath)+string(os.PathSeparator)) {
-			return ErrPathNotAllowed
-		}
-
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(filePath, file.Mode())
-			continue
-		}
-
-		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-			return err
-		}
-
-		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			return err
-		}
-
-		srcFile, err := file.Open()
-		if err != nil {
-			dstFile.Close()
-			return err
-		}
-
-		_, err = io.Copy(dstFile, srcFile)
-		srcFile.Close()
-		dstFile.Close()
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (s *FileService) decompressTarGz(archivePath, destPath string) error {
-	file, err := os.Open(archivePath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	gzReader, err := gzip.NewReader(file)
-	if err != nil {
-		return err
-	}
-	defer gzReader.Close()
-
-	tarReader := tar.NewReader(gzReader)
-
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-
-		filePath := filepath.Join(destPath, header.Name)
-
-		// Security check
-		if !strings.HasPrefix(filePath, filepath.Clean(destPath)+string(os.PathSeparator)) {
-			return ErrPathNotAllowed
-		}
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(filePath, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			if err := os.Symlink(target, dstPath); err != nil {
 				return err
 			}
-			dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
+		} else if entry.IsDir() {
+			if err := s.copyDir(srcPath, dstPath); err != nil {
 				return err
 			}
-			if _, err := io.Copy(dstFile, tarReader); err != nil {
-				dstFile.Close()
+		} else {
+			if err := s.copyFile(srcPath, dstPath); err != nil {
 				return err
 			}
-			dstFile.Close()
 		}
 	}
 
@@ -0,0 +1,753 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Archive formats, 7z archives are only extracted
+const (
+	ArchiveZip    = "zip"
+	ArchiveTar    = "tar"
+	ArchiveTarGz  = "tar.gz"
+	ArchiveTarBz2 = "tar.bz2"
+	ArchiveTarXz  = "tar.xz"
+	ArchiveTarZst = "tar.zst"
+	Archive7z     = "7z"
+)
+
+const (
+	// Bytes a symlink target in an archive takes at most
+	archiveMaxLink = 4096
+	// Output below which the compression ratio of an extraction is not checked
+	archiveRatioFloor = 1024 * 1024
+)
+
+var archiveAliases = map[string]string{
+	"tgz":  ArchiveTarGz,
+	"tbz":  ArchiveTarBz2,
+	"tbz2": ArchiveTarBz2,
+	"txz":  ArchiveTarXz,
+	"tzst": ArchiveTarZst,
+}
+
+// Signatures of the compressions a tar or a single file can have
+var compressionMagic = []struct {
+	name  string
+	magic []byte
+}{
+	{"gz", []byte{0x1f, 0x8b}},
+	{"bz2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+var (
+	zipMagic      = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06"), []byte("PK\x07\x08")}
+	sevenZipMagic = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+)
+
+// ArchiveOptions describes an archive to create
+type ArchiveOptions struct {
+	Format     string `json:"format"`     // zip when empty, see the Archive constants
+	Password   string `json:"password"`   // encrypts the files of a zip
+	Encryption string `json:"encryption"` // aes when empty, or zipcrypto for tools without AES
+}
+
+// archiveEntry is a file read from an archive
+type archiveEntry struct {
+	Name    string
+	Mode    os.FileMode
+	ModTime time.Time
+	Link    string // target of a symlink, or the entry a hard link is to
+	Hard    bool
+}
+
+// archiveLimits keep an extraction from filling the disk, e.g. with a zip bomb. Zero
+// turns a limit off.
+type archiveLimits struct {
+	size  int64 // bytes written
+	files int64 // entries
+	ratio int64 // bytes written per archive byte
+}
+
+// archiveFormat returns the canonical name of a format to create
+func archiveFormat(format string) (string, error) {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	if alias, ok := archiveAliases[format]; ok {
+		format = alias
+	}
+	switch format {
+	case "":
+		return ArchiveZip, nil
+	case ArchiveZip, ArchiveTar, ArchiveTarGz, ArchiveTarBz2, ArchiveTarXz, ArchiveTarZst:
+		return format, nil
+	case Archive7z:
+		return "", fmt.Errorf("%w: 7z archives can be extracted but not created", ErrUnsupportedFormat)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedFormat, format)
+	}
+}
+
+// detectArchive tells the format of an archive by its content. A compressed file that is
+// not a tar is returned as its compression, e.g. gz for a rotated log.
+func detectArchive(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+
+	for _, magic := range zipMagic {
+		if bytes.HasPrefix(head, magic) {
+			return ArchiveZip, nil
+		}
+	}
+	if bytes.HasPrefix(head, sevenZipMagic) {
+		return Archive7z, nil
+	}
+	for _, c := range compressionMagic {
+		if !bytes.HasPrefix(head, c.magic) {
+			continue
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		r, err := decompressReader(f, c.name)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+		}
+		inner := make([]byte, 512)
+		n, _ := io.ReadFull(r, inner)
+		r.Close()
+		// Old tars have no ustar magic, their name tells them apart
+		if isTar(inner[:n]) || strings.Contains(strings.ToLower(filepath.Base(path)), ".tar.") {
+			return ArchiveTar + "." + c.name, nil
+		}
+		return c.name, nil
+	}
+	if isTar(head) || strings.EqualFold(filepath.Ext(path), ".tar") {
+		return ArchiveTar, nil
+	}
+	return "", ErrUnsupportedFormat
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar"))
+}
+
+// compressWriter compresses what is written to w, an empty compression writes it as is
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gz":
+		return gzip.NewWriter(w), nil
+	case "bz2":
+		return bzip2.NewWriter(w, nil)
+	case "xz":
+		return xz.NewWriter(w)
+	case "zst":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, compression)
+	}
+}
+
+// decompressReader decompresses r, an empty compression reads it as is
+func decompressReader(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return io.NopCloser(r), nil
+	case "gz":
+		return gzip.NewReader(r)
+	case "bz2":
+		return bzip2.NewReader(r, nil)
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case "zst":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, compression)
+	}
+}
+
+// writeArchive writes the trees of resolved paths to w. Entries are named relative to
+// the directory of their path, symlinks are stored as links and modes are kept. skip is
+// left out, e.g. the archive being written. progress gets the bytes of file content read.
+func (s *FileService) writeArchive(ctx context.Context, w io.Writer, paths []string, opts ArchiveOptions, skip string, progress func(int64)) error {
+	format, err := archiveFormat(opts.Format)
+	if err != nil {
+		return err
+	}
+
+	walk := func(add func(path, name, link string, info os.FileInfo) error) error {
+		for _, fullPath := range paths {
+			err := filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				// Entries the jail denies are left out
+				if path == skip || s.jail.check(path, false) != nil {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				link := ""
+				if info.Mode()&os.ModeSymlink != 0 {
+					if link, err = os.Readlink(path); err != nil {
+						return err
+					}
+				}
+				name, _ := filepath.Rel(filepath.Dir(fullPath), path)
+				return add(path, filepath.ToSlash(name), link, info)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	content := func(path string, w io.Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, &progressReader{ctx: ctx, r: f, progress: progress})
+		return err
+	}
+
+	if format == ArchiveZip {
+		zw := zip.NewWriter(w)
+		err := walk(func(path, name, link string, info os.FileInfo) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if info.IsDir() {
+				header.Name += "/"
+			} else {
+				header.Method = zip.Deflate
+			}
+
+			// Link targets are not encrypted, most tools cannot read encrypted links
+			var fw io.Writer
+			if opts.Password != "" && info.Mode().IsRegular() {
+				ew, err := createEncrypted(zw, header, opts.Password, opts.Encryption)
+				if err != nil {
+					return err
+				}
+				fw = ew
+			} else if fw, err = zw.CreateHeader(header); err != nil {
+				return err
+			}
+
+			// Links are stored as links, their target is the content
+			if link != "" {
+				_, err = fw.Write([]byte(link))
+			} else if info.Mode().IsRegular() {
+				err = content(path, fw)
+			}
+			if err != nil {
+				return err
+			}
+			if closer, ok := fw.(io.Closer); ok {
+				return closer.Close()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	compression := strings.TrimPrefix(strings.TrimPrefix(format, ArchiveTar), ".")
+	cw, err := compressWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	err = walk(func(path, name, link string, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return content(path, tw)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// extractor writes the entries of an archive below a directory. Entry paths may not
+// leave it, neither with .. nor through links extracted before them.
+type extractor struct {
+	s           *FileService
+	ctx         context.Context
+	dest        string // resolved
+	limits      archiveLimits
+	archiveSize int64
+	progress    func(int64) // bytes written, nil when progress is counted on the archive
+	files       int64
+	written     int64
+	dirs        []archiveEntry // modes and times are set once their content is written
+}
+
+// extractArchive extracts an archive of a detected format to dest
+func (s *FileService) extractArchive(ctx context.Context, archivePath, format, dest, password string, job *FileJob) error {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	x := &extractor{
+		s:           s,
+		ctx:         ctx,
+		dest:        dest,
+		limits:      s.archiveLimits(),
+		archiveSize: info.Size(),
+	}
+
+	switch format {
+	case ArchiveZip:
+		err = x.zip(archivePath, password, job)
+	case Archive7z:
+		err = x.sevenZip(archivePath, password, job)
+	default:
+		job.setTotal(info.Size())
+		err = x.stream(archivePath, format, info, job)
+	}
+	if err != nil {
+		return err
+	}
+	return x.finish()
+}
+
+func (x *extractor) zip(archivePath, password string, job *FileJob) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Declared sizes are checked up front, the written bytes are counted regardless
+	var total int64
+	for _, f := range r.File {
+		total += int64(f.UncompressedSize64)
+	}
+	if err := x.checkDeclared(int64(len(r.File)), total); err != nil {
+		return err
+	}
+	job.setTotal(total)
+	x.progress = job.add
+
+	for _, f := range r.File {
+		entry := archiveEntry{Name: f.Name, Mode: f.Mode(), ModTime: f.Modified}
+		if entry.Mode.IsDir() {
+			if err := x.extract(entry, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var rc io.ReadCloser
+		if f.Flags&zipFlagEncrypted != 0 {
+			rc, err = openEncrypted(f, password)
+		} else {
+			rc, err = f.Open()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		err = x.extractFrom(entry, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) sevenZip(archivePath, password string, job *FileJob) error {
+	r, err := sevenzip.OpenReaderWithPassword(archivePath, password)
+	if err != nil {
+		return sevenZipError(err)
+	}
+	defer r.Close()
+
+	var total int64
+	for _, f := range r.File {
+		total += int64(f.UncompressedSize)
+	}
+	if err := x.checkDeclared(int64(len(r.File)), total); err != nil {
+		return err
+	}
+	job.setTotal(total)
+	x.progress = job.add
+
+	for _, f := range r.File {
+		entry := archiveEntry{Name: f.Name, Mode: f.Mode(), ModTime: f.Modified}
+		if entry.Mode.IsDir() {
+			if err := x.extract(entry, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return sevenZipError(err)
+		}
+		err = x.extractFrom(entry, rc)
+		rc.Close()
+		if err != nil {
+			return sevenZipError(err)
+		}
+	}
+	return nil
+}
+
+// stream extracts a tar or a single compressed file, progress is the archive bytes read
+func (x *extractor) stream(archivePath, format string, info os.FileInfo, job *FileJob) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	compression := format
+	if format == ArchiveTar || strings.HasPrefix(format, ArchiveTar+".") {
+		compression = strings.TrimPrefix(strings.TrimPrefix(format, ArchiveTar), ".")
+	}
+	r, err := decompressReader(bufio.NewReader(&progressReader{ctx: x.ctx, r: f, progress: job.add}), compression)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	defer r.Close()
+
+	if compression == format {
+		// A single compressed file is written next to where it would be without it
+		name := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		if name == info.Name() || name == "" {
+			name = info.Name() + ".out"
+		}
+		return x.extractFrom(archiveEntry{Name: name, Mode: info.Mode().Perm(), ModTime: info.ModTime()}, r)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := archiveEntry{Name: header.Name, Mode: header.FileInfo().Mode(), ModTime: header.ModTime, Link: header.Linkname}
+		switch header.Typeflag {
+		case tar.TypeLink:
+			entry.Hard = true
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeGNUSparse:
+		default:
+			// Devices, pipes and the like are left out
+			continue
+		}
+		if err := x.extract(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractFrom(entry archiveEntry, r io.Reader) error {
+	if entry.Mode&os.ModeSymlink != 0 {
+		link, err := io.ReadAll(io.LimitReader(r, archiveMaxLink))
+		if err != nil {
+			return err
+		}
+		entry.Link = string(link)
+	}
+	return x.extract(entry, r)
+}
+
+// extract writes an entry, r has the content of a regular file
+func (x *extractor) extract(entry archiveEntry, r io.Reader) error {
+	if err := x.ctx.Err(); err != nil {
+		return err
+	}
+	if x.files++; x.limits.files > 0 && x.files > x.limits.files {
+		return fmt.Errorf("%w: more than %d entries", ErrArchiveLimit, x.limits.files)
+	}
+	path, err := x.target(entry.Name)
+	if err != nil || path == x.dest {
+		return err
+	}
+
+	switch {
+	case entry.Mode.IsDir():
+		info, err := os.Lstat(path)
+		if err == nil && !info.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		entry.Name = path
+		x.dirs = append(x.dirs, entry)
+		return nil
+
+	case entry.Hard:
+		// Hard links only to files extracted with the entry
+		src, err := x.target(entry.Link)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(src)
+		if err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("%w: hard link %s to %s", ErrPathNotAllowed, entry.Name, entry.Link)
+		}
+		if err := x.replace(path); err != nil {
+			return err
+		}
+		return os.Link(src, path)
+
+	case entry.Mode&os.ModeSymlink != 0:
+		if entry.Link == "" {
+			return fmt.Errorf("%w: %s links to nothing", ErrUnsupportedFormat, entry.Name)
+		}
+		if err := x.replace(path); err != nil {
+			return err
+		}
+		return os.Symlink(entry.Link, path)
+
+	case entry.Mode.IsRegular():
+		if err := x.replace(path); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if err := x.copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, extractMode(entry.Mode, 0644)); err != nil {
+			return err
+		}
+		return os.Chtimes(path, entry.ModTime, entry.ModTime)
+	}
+	return nil
+}
+
+// target returns where an entry is extracted to. The parents it needs are created.
+func (x *extractor) target(name string) (string, error) {
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("%w: entry %s leaves the destination", ErrPathNotAllowed, name)
+		}
+	}
+	path := filepath.Join(x.dest, filepath.Clean("/"+name))
+	if path == x.dest {
+		return path, nil
+	}
+
+	parent, err := realPath(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	if !pathWithin(parent, x.dest) {
+		return "", fmt.Errorf("%w: entry %s leaves the destination through a link", ErrPathNotAllowed, name)
+	}
+	path = filepath.Join(parent, filepath.Base(path))
+	if err := x.s.jail.check(path, true); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// replace removes what a file entry is extracted over, a link there is never written through
+func (x *extractor) replace(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w: %s", ErrIsDirectory, path)
+	}
+	return os.Remove(path)
+}
+
+func (x *extractor) copy(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			x.written += int64(n)
+			if err := x.checkWritten(); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if x.progress != nil {
+				x.progress(int64(n))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) checkWritten() error {
+	if x.limits.size > 0 && x.written > x.limits.size {
+		return fmt.Errorf("%w: more than %d MB", ErrArchiveLimit, x.limits.size/1024/1024)
+	}
+	if x.limits.ratio > 0 && x.written > archiveRatioFloor && x.written > x.archiveSize*x.limits.ratio {
+		return fmt.Errorf("%w: expands more than %d times", ErrArchiveLimit, x.limits.ratio)
+	}
+	return nil
+}
+
+// checkDeclared checks the entries and sizes an archive lists before any is extracted
+func (x *extractor) checkDeclared(files, size int64) error {
+	if x.limits.files > 0 && files > x.limits.files {
+		return fmt.Errorf("%w: more than %d entries", ErrArchiveLimit, x.limits.files)
+	}
+	saved := x.written
+	x.written = size
+	defer func() { x.written = saved }()
+	return x.checkWritten()
+}
+
+// finish sets the modes and times of the directories, deepest first so setting the
+// time of a directory is not undone by its children
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		dir := x.dirs[i]
+		if err := os.Chmod(dir.Name, extractMode(dir.Mode, 0755)); err != nil {
+			return err
+		}
+		os.Chtimes(dir.Name, dir.ModTime, dir.ModTime)
+	}
+	return nil
+}
+
+// extractMode drops the setuid and setgid bits of an extracted entry, archives made on
+// Windows have no permissions and get fallback
+func extractMode(mode, fallback os.FileMode) os.FileMode {
+	mode &= os.ModePerm | os.ModeSticky
+	if mode.Perm() == 0 {
+		return fallback
+	}
+	return mode
+}
+
+func (s *FileService) archiveLimits() archiveLimits {
+	return archiveLimits{
+		size:  s.config.Files.ExtractMaxSize * 1024 * 1024,
+		files: s.config.Files.ExtractMaxFiles,
+		ratio: s.config.Files.ExtractMaxRatio,
+	}
+}
+
+// sevenZipError reports a failed 7z read as a password error, 7z cannot tell a wrong
+// password from a corrupt archive
+func sevenZipError(err error) error {
+	var pathErr *os.PathError
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrArchiveLimit) || errors.Is(err, ErrPathNotAllowed) ||
+		errors.Is(err, ErrIsDirectory) || errors.As(err, &pathErr) {
+		return err
+	}
+	return fmt.Errorf("%w, or the archive is corrupt: %s", ErrArchivePassword, strings.TrimSpace(err.Error()))
+}
+
+// progressReader reports the bytes read and stops when its context is done
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	progress func(int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if n > 0 && r.progress != nil {
+		r.progress(int64(n))
+	}
+	return n, err
+}
+
+// Errors
+var (
+	ErrArchiveLimit = errors.New("archive exceeds the extraction limits")
+)
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vpanel/server/internal/config"
+)
+
+// tarEntry is an entry of a test tar, content is the body of a regular file
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+func writeTar(t *testing.T, path string, entries []tarEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := e.header
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(e.content))
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tarFile(name, content string) tarEntry {
+	return tarEntry{tar.Header{Typeflag: tar.TypeReg, Name: name}, content}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"", ArchiveZip, false},
+		{"ZIP", ArchiveZip, false},
+		{".tgz", ArchiveTarGz, false},
+		{"tbz2", ArchiveTarBz2, false},
+		{"tar.zst", ArchiveTarZst, false},
+		{"7z", "", true},
+		{"rar", "", true},
+	}
+	for _, tt := range tests {
+		got, err := archiveFormat(tt.format)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("archiveFormat(%q) = %q, %v, want %q", tt.format, got, err, tt.want)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	fs, root := newTestFileService(t)
+	src := filepath.Join(root, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte(strings.Repeat("a", 5000)), 0640)
+	os.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b"), 0644)
+	os.Symlink("a.txt", filepath.Join(src, "link"))
+
+	tests := []struct {
+		opts ArchiveOptions
+		want string // detected format
+	}{
+		{ArchiveOptions{Format: ArchiveZip}, ArchiveZip},
+		{ArchiveOptions{Format: ArchiveZip, Password: "secret"}, ArchiveZip},
+		{ArchiveOptions{Format: ArchiveZip, Password: "secret", Encryption: ZipEncryptionZipCrypto}, ArchiveZip},
+		{ArchiveOptions{Format: ArchiveTar}, ArchiveTar},
+		{ArchiveOptions{Format: ArchiveTarGz}, ArchiveTarGz},
+		{ArchiveOptions{Format: ArchiveTarBz2}, ArchiveTarBz2},
+		{ArchiveOptions{Format: ArchiveTarXz}, ArchiveTarXz},
+		{ArchiveOptions{Format: ArchiveTarZst}, ArchiveTarZst},
+	}
+	for i, tt := range tests {
+		name := tt.opts.Format + tt.opts.Encryption
+		if tt.opts.Password != "" && tt.opts.Encryption == "" {
+			name += "aes"
+		}
+		t.Run(name, func(t *testing.T) {
+			// Archives are detected by content, not by name
+			archive := filepath.Join(root, "archive"+string(rune('0'+i)))
+			f, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.writeArchive(context.Background(), f, []string{src}, tt.opts, "", func(int64) {}); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			format, err := detectArchive(archive)
+			if err != nil || format != tt.want {
+				t.Fatalf("detectArchive() = %q, %v, want %q", format, err, tt.want)
+			}
+			dest := filepath.Join(root, "out"+string(rune('0'+i)))
+			os.Mkdir(dest, 0755)
+			if err := fs.extractArchive(context.Background(), archive, format, dest, tt.opts.Password, &FileJob{}); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range map[string]string{"src/a.txt": strings.Repeat("a", 5000), "src/sub/b.txt": "b"} {
+				if got, err := os.ReadFile(filepath.Join(dest, name)); err != nil || string(got) != want {
+					t.Errorf("%s = %d bytes, %v, want %d", name, len(got), err, len(want))
+				}
+			}
+			if info, err := os.Stat(filepath.Join(dest, "src", "a.txt")); err != nil || info.Mode().Perm() != 0640 {
+				t.Errorf("src/a.txt mode = %v, %v, want 0640", info, err)
+			}
+			if target, err := os.Readlink(filepath.Join(dest, "src", "link")); err != nil || target != "a.txt" {
+				t.Errorf("src/link = %q, %v, want a link to a.txt", target, err)
+			}
+		})
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	big := strings.Repeat("0", 3*1024*1024)
+	tests := []struct {
+		name    string
+		limits  config.FilesConfig
+		entries []tarEntry
+		wantErr error
+	}{
+		{"within the limits", config.FilesConfig{ExtractMaxFiles: 2, ExtractMaxSize: 1}, []tarEntry{tarFile("a", "a"), tarFile("b", "b")}, nil},
+		{"too many entries", config.FilesConfig{ExtractMaxFiles: 2}, []tarEntry{tarFile("a", "a"), tarFile("b", "b"), tarFile("c", "c")}, ErrArchiveLimit},
+		{"too large", config.FilesConfig{ExtractMaxSize: 2}, []tarEntry{tarFile("a", big)}, ErrArchiveLimit},
+		{"large but not limited", config.FilesConfig{}, []tarEntry{tarFile("a", big)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, root := newTestFileService(t, func(cfg *config.FilesConfig) {
+				cfg.ExtractMaxFiles = tt.limits.ExtractMaxFiles
+				cfg.ExtractMaxSize = tt.limits.ExtractMaxSize
+			})
+			archive := filepath.Join(root, "a.tar")
+			writeTar(t, archive, tt.entries)
+			dest := filepath.Join(root, "out")
+			os.Mkdir(dest, 0755)
+			if err := fs.extractArchive(context.Background(), archive, ArchiveTar, dest, "", &FileJob{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("extractArchive() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtractRatio(t *testing.T) {
+	// 16 MB of zeros deflate to a few KB
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("zeros")
+	w.Write(make([]byte, 16*1024*1024))
+	zw.Close()
+
+	tests := []struct {
+		ratio   int64
+		wantErr error
+	}{
+		{0, nil},
+		{100000, nil},
+		{100, ErrArchiveLimit},
+	}
+	for _, tt := range tests {
+		fs, root := newTestFileService(t, func(cfg *config.FilesConfig) { cfg.ExtractMaxRatio = tt.ratio })
+		archive := filepath.Join(root, "bomb.zip")
+		os.WriteFile(archive, buf.Bytes(), 0644)
+		dest := filepath.Join(root, "out")
+		os.Mkdir(dest, 0755)
+		if err := fs.extractArchive(context.Background(), archive, ArchiveZip, dest, "", &FileJob{}); !errors.Is(err, tt.wantErr) {
+			t.Errorf("ratio %d: extractArchive() error = %v, want %v", tt.ratio, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExtractUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr error
+		check   func(t *testing.T, root, dest string)
+	}{
+		{
+			"parent directory", []tarEntry{tarFile("../evil", "x")}, ErrPathNotAllowed,
+			func(t *testing.T, root, dest string) {
+				if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+					t.Error("../evil was written")
+				}
+			},
+		},
+		{
+			"absolute path", []tarEntry{tarFile("/abs.txt", "x")}, nil,
+			func(t *testing.T, root, dest string) {
+				if _, err := os.Stat(filepath.Join(dest, "abs.txt")); err != nil {
+					t.Errorf("/abs.txt was not written below the destination: %v", err)
+				}
+			},
+		},
+		{
+			"through a symlink", []tarEntry{
+				{tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: ".."}, ""},
+				tarFile("link/evil", "x"),
+			}, ErrPathNotAllowed,
+			func(t *testing.T, root, dest string) {
+				if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+					t.Error("link/evil was written outside the destination")
+				}
+			},
+		},
+		{
+			"over a symlink", []tarEntry{
+				{tar.Header{Typeflag: tar.TypeSymlink, Name: "target", Linkname: "../victim"}, ""},
+				tarFile("target", "x"),
+			}, nil,
+			func(t *testing.T, root, dest string) {
+				if data, _ := os.ReadFile(filepath.Join(root, "victim")); string(data) != "victim" {
+					t.Errorf("victim = %q, was written through a link", data)
+				}
+			},
+		},
+		{
+			"hard link out", []tarEntry{{tar.Header{Typeflag: tar.TypeLink, Name: "hard", Linkname: "../victim"}, ""}}, ErrPathNotAllowed,
+			nil,
+		},
+		{
+			"setuid", []tarEntry{{tar.Header{Typeflag: tar.TypeReg, Name: "suid", Mode: 04755}, ""}}, nil,
+			func(t *testing.T, root, dest string) {
+				if info, err := os.Stat(filepath.Join(dest, "suid")); err != nil || info.Mode() != 0755 {
+					t.Errorf("suid mode = %v, %v, want 0755", info.Mode(), err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, root := newTestFileService(t)
+			os.WriteFile(filepath.Join(root, "victim"), []byte("victim"), 0644)
+			archive := filepath.Join(root, "a.tar")
+			writeTar(t, archive, tt.entries)
+			dest := filepath.Join(root, "out")
+			os.Mkdir(dest, 0755)
+
+			if err := fs.extractArchive(context.Background(), archive, ArchiveTar, dest, "", &FileJob{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("extractArchive() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, root, dest)
+			}
+		})
+	}
+}
+
+func TestExtractEncryptedZip(t *testing.T) {
+	fs, root := newTestFileService(t)
+	archive := filepath.Join(root, "secret.zip")
+	os.WriteFile(archive, encryptedZip(t, []byte("content"), zip.Deflate, "secret", ZipEncryptionAES), 0644)
+
+	for _, password := range []string{"", "wrong"} {
+		dest := filepath.Join(root, "out-"+password)
+		os.Mkdir(dest, 0755)
+		if err := fs.extractArchive(context.Background(), archive, ArchiveZip, dest, password, &FileJob{}); !errors.Is(err, ErrArchivePassword) {
+			t.Errorf("password %q: extractArchive() error = %v, want ErrArchivePassword", password, err)
+		}
+	}
+	dest := filepath.Join(root, "out")
+	os.Mkdir(dest, 0755)
+	if err := fs.extractArchive(context.Background(), archive, ArchiveZip, dest, "secret", &FileJob{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "file.txt")); err != nil || string(data) != "content" {
+		t.Errorf("file.txt = %q, %v, want %q", data, err, "content")
+	}
+}
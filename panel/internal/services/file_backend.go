@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileBackend is the storage the paths of the file manager live on, the local filesystem
+// or a remote location. Paths are absolute and clean as the backend sees them.
+type fileBackend interface {
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error) // entries as Lstat returns them
+	Readlink(path string) (string, error)
+	Symlink(target, path string) error
+	Open(path string) (io.ReadSeekCloser, error)
+	Create(path string, mode os.FileMode) (fileWriter, error)
+	MkdirAll(path string) error
+	Rename(oldPath, newPath string) error
+	RemoveAll(path string) error
+}
+
+// fileWriter is a file being written, it replaces the file at its path only when closed
+// and is discarded when aborted
+type fileWriter interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// localFS is the local filesystem, paths are checked against the jail before they get here
+type localFS struct{}
+
+func (localFS) Stat(path string) (os.FileInfo, error)  { return os.Stat(path) }
+func (localFS) Lstat(path string) (os.FileInfo, error) { return os.Lstat(path) }
+func (localFS) Readlink(path string) (string, error)   { return os.Readlink(path) }
+func (localFS) Symlink(target, path string) error      { return os.Symlink(target, path) }
+func (localFS) MkdirAll(path string) error             { return os.MkdirAll(path, 0755) }
+func (localFS) Rename(oldPath, newPath string) error   { return os.Rename(oldPath, newPath) }
+func (localFS) RemoveAll(path string) error            { return os.RemoveAll(path) }
+
+func (localFS) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// Entries removed since the directory was read are left out
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (localFS) Open(path string) (io.ReadSeekCloser, error) {
+	return os.Open(path)
+}
+
+// Create writes next to path under a temporary name and renames over path when closed
+func (localFS) Create(path string, mode os.FileMode) (fileWriter, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filePartPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: tmp, path: path, mode: mode}, nil
+}
+
+type localWriter struct {
+	*os.File
+	path string
+	mode os.FileMode
+}
+
+func (w *localWriter) Close() error {
+	err := w.File.Chmod(w.mode)
+	if closeErr := w.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.File.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w *localWriter) Abort() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// remoteFileInfo is a file of a remote location without a native file info, e.g. an
+// object of a bucket
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *remoteFileInfo) Name() string       { return i.name }
+func (i *remoteFileInfo) Size() int64        { return i.size }
+func (i *remoteFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *remoteFileInfo) ModTime() time.Time { return i.modTime }
+func (i *remoteFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *remoteFileInfo) Sys() interface{}   { return nil }
+
+// backendCopy copies trees within a backend or from one to another. Links are copied as
+// links where the destination has them and left out where it has not, sockets, pipes and
+// devices are left out.
+type backendCopy struct {
+	ctx      context.Context
+	src, dst fileBackend
+	skip     func(srcPath, dstPath string) bool // leaves out paths the service cannot access
+	progress func(int64)                        // bytes copied
+	skipped  int
+}
+
+// copy copies srcPath to dstPath, a link at srcPath itself is followed
+func (c *backendCopy) copy(srcPath, dstPath string) error {
+	info, err := c.src.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	return c.copyTree(srcPath, dstPath, info)
+}
+
+func (c *backendCopy) copyTree(srcPath, dstPath string, info os.FileInfo) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	if c.skip != nil && c.skip(srcPath, dstPath) {
+		c.skipped++
+		return nil
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := c.src.Readlink(srcPath)
+		if err != nil {
+			return err
+		}
+		err = c.dst.Symlink(target, dstPath)
+		if err != nil && !errors.Is(err, ErrRemoteUnsupported) {
+			// Replace what the link is copied over, like a file is
+			if _, statErr := c.dst.Lstat(dstPath); statErr != nil {
+				return err
+			}
+			if err := c.dst.RemoveAll(dstPath); err != nil {
+				return err
+			}
+			return c.dst.Symlink(target, dstPath)
+		}
+	case info.IsDir():
+		if err := c.dst.MkdirAll(dstPath); err != nil {
+			return err
+		}
+		entries, err := c.src.ReadDir(srcPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if err := c.copyTree(filepath.Join(srcPath, name), filepath.Join(dstPath, name), entry); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		return c.copyFile(srcPath, dstPath, info.Mode().Perm())
+	}
+	return nil
+}
+
+func (c *backendCopy) copyFile(srcPath, dstPath string, mode os.FileMode) error {
+	in, err := c.src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := c.dst.Create(dstPath, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, &progressReader{ctx: c.ctx, r: in, progress: c.progress}); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Close()
+}
+
+// backendTreeSize returns the bytes of the regular files of a tree, links not followed
+// below path
+func backendTreeSize(ctx context.Context, backend fileBackend, path string) (int64, error) {
+	info, err := backend.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	var size int64
+	dirs := []string{path}
+	for len(dirs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		entries, err := backend.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			switch {
+			case entry.IsDir():
+				dirs = append(dirs, filepath.Join(dir, entry.Name()))
+			case entry.Mode().IsRegular():
+				size += entry.Size()
+			}
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// Access a path is checked for
+const (
+	fileRead     = 0
+	fileWrite    = 1 << 0
+	fileNoFollow = 1 << 1 // the operation acts on a symlink itself, e.g. delete and rename
+)
+
+// Most symlinks followed while resolving a path, like the kernel's limit
+const fileMaxLinks = 40
+
+// fileJail is the policy the paths of a FileService are checked against
+type fileJail struct {
+	roots []models.FileRoot // relative paths start at the first
+	deny  []string
+}
+
+// newFileJail returns a jail of roots, the first root is where relative paths start
+func newFileJail(roots []models.FileRoot, deny []string) *fileJail {
+	j := &fileJail{deny: deny}
+	for _, root := range roots {
+		if root.Path = filepath.Clean(root.Path); filepath.IsAbs(root.Path) {
+			j.roots = append(j.roots, root)
+		}
+	}
+	if len(j.roots) == 0 {
+		j.roots = []models.FileRoot{{Path: "/"}}
+	}
+	return j
+}
+
+// ForUser returns the file service as seen by a user, restricted to the user's jail or
+// else the jail of the user's role. Users without a jail get the system roots.
+func (s *FileService) ForUser(userID, username, role string) (*FileService, error) {
+	var jails []models.FileJail
+	if err := s.db.Where("user_id = ? OR (role = ? AND user_id = '')", userID, role).Find(&jails).Error; err != nil {
+		return nil, err
+	}
+	jailed := *s
+	jailed.userID = userID
+	jailed.username = username
+	if len(jails) == 0 {
+		return &jailed, nil
+	}
+	sort.Slice(jails, func(i, k int) bool { return jails[i].UserID != "" && jails[k].UserID == "" })
+
+	// A jail narrows the system roots and never widens them. Roots are resolved first,
+	// a symlink below a system root may lead out of it.
+	var roots []models.FileRoot
+	for _, root := range jails[0].Roots {
+		resolved, err := realPath(strings.ReplaceAll(root.Path, "{username}", username))
+		if err != nil {
+			continue
+		}
+		root.Path = resolved
+		system, ok := s.jail.root(root.Path)
+		if !ok {
+			continue
+		}
+		root.ReadOnly = root.ReadOnly || system.ReadOnly
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("%w: the file manager jail has no accessible root", ErrPathNotAllowed)
+	}
+
+	jailed.jail = newFileJail(roots, s.jail.deny)
+	jailed.jailed = true
+	jailed.localOnly = true
+	jailed.rootPath = jailed.jail.roots[0].Path
+	return &jailed, nil
+}
+
+// Roots returns the roots the service can access
+func (s *FileService) Roots() []models.FileRoot {
+	return s.jail.roots
+}
+
+// ListJails returns the file manager jails
+func (s *FileService) ListJails() ([]models.FileJail, error) {
+	var jails []models.FileJail
+	if err := s.db.Order("role, user_id").Find(&jails).Error; err != nil {
+		return nil, err
+	}
+	return jails, nil
+}
+
+// CreateJail restricts the file manager of a role or a user
+func (s *FileService) CreateJail(jail *models.FileJail) error {
+	if err := s.validateJail(jail); err != nil {
+		return err
+	}
+	return s.db.Create(jail).Error
+}
+
+// UpdateJail replaces a jail
+func (s *FileService) UpdateJail(id string, jail *models.FileJail) error {
+	var existing models.FileJail
+	if err := s.db.First(&existing, "id = ?", id).Error; err != nil {
+		return ErrFileJailNotFound
+	}
+	jail.BaseModel = existing.BaseModel
+	if err := s.validateJail(jail); err != nil {
+		return err
+	}
+	return s.db.Save(jail).Error
+}
+
+// DeleteJail lifts a jail
+func (s *FileService) DeleteJail(id string) error {
+	result := s.db.Delete(&models.FileJail{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrFileJailNotFound
+	}
+	return nil
+}
+
+func (s *FileService) validateJail(jail *models.FileJail) error {
+	if (jail.Role == "") == (jail.UserID == "") {
+		return fmt.Errorf("%w: a jail applies to either a role or a user", ErrInvalidFileJail)
+	}
+	if len(jail.Roots) == 0 {
+		return fmt.Errorf("%w: a jail needs at least one root", ErrInvalidFileJail)
+	}
+	for i, root := range jail.Roots {
+		if !filepath.IsAbs(root.Path) {
+			return fmt.Errorf("%w: root %q must be absolute", ErrInvalidFileJail, root.Path)
+		}
+		jail.Roots[i].Path = filepath.Clean(root.Path)
+	}
+
+	var count int64
+	query := s.db.Model(&models.FileJail{}).Where("role = ? AND user_id = ?", jail.Role, jail.UserID)
+	if jail.ID != "" {
+		query = query.Where("id != ?", jail.ID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		if jail.Role != "" {
+			return fmt.Errorf("%w: role %s already has a jail", ErrInvalidFileJail, jail.Role)
+		}
+		return fmt.Errorf("%w: the user already has a jail", ErrInvalidFileJail)
+	}
+	return nil
+}
+
+// checkPath resolves a path and checks it against the jail. Symlinks are resolved so a
+// link cannot lead out of the roots, with fileNoFollow the last element is not resolved.
+// The resolved path is returned for the operation to act on. Paths on remote locations
+// are refused, operations on them go through locate.
+func (s *FileService) checkPath(path string, access int) (string, error) {
+	if path == "" {
+		return "", ErrPathNotAllowed
+	}
+	if IsRemotePath(path) {
+		return "", ErrRemoteUnsupported
+	}
+	fullPath := s.resolvePath(path)
+
+	var resolved string
+	var err error
+	if access&fileNoFollow != 0 && fullPath != "/" {
+		resolved, err = realPath(filepath.Dir(fullPath))
+		resolved = filepath.Join(resolved, filepath.Base(fullPath))
+	} else {
+		resolved, err = realPath(fullPath)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.jail.check(resolved, access&fileWrite != 0); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// isRoot reports whether a resolved path is one of the roots, which are not removed
+func (s *FileService) isRoot(path string) bool {
+	for _, root := range s.jail.roots {
+		if resolved, err := realPath(root.Path); err == nil && resolved == path {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns why a resolved path cannot be accessed, nil when it can
+func (j *fileJail) check(path string, write bool) error {
+	for _, pattern := range j.deny {
+		if fileDenied(pattern, path) {
+			return ErrPathNotAllowed
+		}
+	}
+	root, ok := j.root(path)
+	if !ok {
+		return ErrPathNotAllowed
+	}
+	if write && root.ReadOnly {
+		return ErrPathReadOnly
+	}
+	return nil
+}
+
+// root returns the most specific root containing a resolved path
+func (j *fileJail) root(path string) (models.FileRoot, bool) {
+	var best models.FileRoot
+	found := false
+	for _, root := range j.roots {
+		resolved, err := realPath(root.Path)
+		if err != nil {
+			continue
+		}
+		if pathWithin(path, resolved) && (!found || len(resolved) > len(best.Path)) {
+			best = models.FileRoot{Path: resolved, ReadOnly: root.ReadOnly}
+			found = true
+		}
+	}
+	return best, found
+}
+
+// realPath resolves the symlinks of an absolute path like the kernel does, dangling links
+// included, elements that do not exist are kept as they are
+func realPath(path string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(filepath.Clean(path), "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(next)
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				resolved = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > fileMaxLinks {
+			return "", &os.PathError{Op: "resolve", Path: path, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+// fileDenied reports whether a deny glob matches a path or one of its parents. A glob
+// without a slash matches a name in any directory, e.g. .env or *.pem.
+func fileDenied(pattern, path string) bool {
+	if !strings.Contains(pattern, "/") {
+		for _, name := range strings.Split(path, "/") {
+			if ok, _ := filepath.Match(pattern, name); ok && name != "" {
+				return true
+			}
+		}
+		return false
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+// pathWithin reports whether path is root or below it
+func pathWithin(path, root string) bool {
+	return root == "/" || path == root || strings.HasPrefix(path, root+"/")
+}
+
+// Errors
+var (
+	ErrPathReadOnly     = errors.New("path is read-only")
+	ErrInvalidFileJail  = errors.New("invalid file jail")
+	ErrFileJailNotFound = errors.New("file jail not found")
+)
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+func TestRealPath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "real", "sub"), 0755)
+	os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "abs"))
+	os.Symlink("real/sub", filepath.Join(dir, "rel"))
+	os.Symlink("missing", filepath.Join(dir, "dangling"))
+	os.Symlink("loop", filepath.Join(dir, "loop"))
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"real/sub", "real/sub", false},
+		{"abs/sub", "real/sub", false},
+		{"rel", "real/sub", false},
+		{"dangling", "missing", false},
+		{"new/file", "new/file", false},
+		{"loop", "", true},
+	}
+	for _, tt := range tests {
+		got, err := realPath(filepath.Join(dir, tt.path))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("realPath(%q) = %q, want an error", tt.path, got)
+			}
+			continue
+		}
+		if want := filepath.Join(dir, tt.want); err != nil || got != want {
+			t.Errorf("realPath(%q) = %q, %v, want %q", tt.path, got, err, want)
+		}
+	}
+}
+
+func TestFileDenied(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{".env", "/srv/app/.env", true},
+		{".env", "/srv/app/.env.example", false},
+		{"*.pem", "/etc/ssl/key.pem", true},
+		{"*.pem", "/etc/ssl/key.pem/inside", true},
+		{"/etc/shadow", "/etc/shadow", true},
+		{"/etc/shadow", "/etc/shadowed", false},
+		{"/root", "/root/.ssh/id_rsa", true},
+		{"/root", "/rooted", false},
+	}
+	for _, tt := range tests {
+		if got := fileDenied(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("fileDenied(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	fs, root := newTestFileService(t)
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "rw"), 0755)
+	os.MkdirAll(filepath.Join(root, "ro"), 0755)
+	os.WriteFile(filepath.Join(root, "rw", ".env"), nil, 0644)
+	os.Symlink(outside, filepath.Join(root, "rw", "out"))
+	os.Symlink("../ro", filepath.Join(root, "rw", "to-ro"))
+	fs.jail = newFileJail([]models.FileRoot{
+		{Path: filepath.Join(root, "rw")},
+		{Path: filepath.Join(root, "ro"), ReadOnly: true},
+	}, []string{".env"})
+	fs.rootPath = filepath.Join(root, "rw")
+
+	tests := []struct {
+		name    string
+		path    string
+		access  int
+		want    string
+		wantErr error
+	}{
+		{"relative to the first root", "a.txt", fileRead, "rw/a.txt", nil},
+		{"absolute", filepath.Join(root, "ro", "b"), fileRead, "ro/b", nil},
+		{"outside the roots", filepath.Join(root, "other"), fileRead, "", ErrPathNotAllowed},
+		{"dot dot", "../other", fileRead, "", ErrPathNotAllowed},
+		{"denied", ".env", fileRead, "", ErrPathNotAllowed},
+		{"symlink out of the roots", "out/x", fileRead, "", ErrPathNotAllowed},
+		{"symlink itself", "out", fileRead | fileNoFollow, "rw/out", nil},
+		{"read-only root", filepath.Join(root, "ro", "b"), fileWrite, "", ErrPathReadOnly},
+		{"symlink into a read-only root", "to-ro/b", fileWrite, "", ErrPathReadOnly},
+		{"empty", "", fileRead, "", ErrPathNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fs.checkPath(tt.path, tt.access)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("checkPath(%q) = %q, %v, want %v", tt.path, got, err, tt.wantErr)
+				}
+				return
+			}
+			if want := filepath.Join(root, tt.want); err != nil || got != want {
+				t.Errorf("checkPath(%q) = %q, %v, want %q", tt.path, got, err, want)
+			}
+		})
+	}
+}
+
+func TestForUser(t *testing.T) {
+	fs, root := newTestFileService(t)
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "home", "alice"), 0755)
+	os.MkdirAll(filepath.Join(root, "shared"), 0755)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink("home", filepath.Join(root, "users"))
+
+	jails := []models.FileJail{
+		{UserID: "alice", Roots: models.FileRoots{{Path: filepath.Join(root, "home", "{username}")}, {Path: filepath.Join(root, "shared"), ReadOnly: true}}},
+		{UserID: "mallory", Roots: models.FileRoots{{Path: filepath.Join(root, "escape")}}},
+		{UserID: "carol", Roots: models.FileRoots{{Path: filepath.Join(root, "users", "{username}")}}},
+		{Role: "operator", Roots: models.FileRoots{{Path: filepath.Join(root, "shared")}}},
+	}
+	for i := range jails {
+		if err := fs.CreateJail(&jails[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		user      string
+		role      string
+		wantRoots []models.FileRoot
+		wantErr   error
+	}{
+		{
+			"user jail", "alice", "admin",
+			[]models.FileRoot{{Path: filepath.Join(root, "home", "alice")}, {Path: filepath.Join(root, "shared"), ReadOnly: true}},
+			nil,
+		},
+		{"symlink out of the system roots", "mallory", "user", nil, ErrPathNotAllowed},
+		{"symlinked root", "carol", "user", []models.FileRoot{{Path: filepath.Join(root, "home", "carol")}}, nil},
+		{"role jail", "dave", "operator", []models.FileRoot{{Path: filepath.Join(root, "shared")}}, nil},
+		{"no jail", "erin", "admin", []models.FileRoot{{Path: root}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jailed, err := fs.ForUser(tt.user, tt.user, tt.role)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ForUser() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ForUser() error = %v", err)
+			}
+			got := jailed.Roots()
+			if len(got) != len(tt.wantRoots) {
+				t.Fatalf("Roots() = %v, want %v", got, tt.wantRoots)
+			}
+			for i := range got {
+				if got[i] != tt.wantRoots[i] {
+					t.Errorf("Roots() = %v, want %v", got, tt.wantRoots)
+				}
+			}
+		})
+	}
+
+	alice, err := fs.ForUser("alice", "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.checkPath(filepath.Join(root, "home", "bob"), fileRead); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("checkPath() outside the jail error = %v, want ErrPathNotAllowed", err)
+	}
+	if _, err := alice.checkPath(filepath.Join(root, "shared", "x"), fileWrite); !errors.Is(err, ErrPathReadOnly) {
+		t.Errorf("checkPath() in a read-only jail root error = %v, want ErrPathReadOnly", err)
+	}
+}
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// File job types and statuses
+const (
+	FileJobCompress = "compress"
+	FileJobExtract  = "extract"
+	FileJobCopy     = "copy"
+	FileJobMove     = "move"
+
+	FileJobRunning   = "running"
+	FileJobDone      = "done"
+	FileJobFailed    = "failed"
+	FileJobCancelled = "cancelled"
+)
+
+// How long a finished job is kept for its status to be read
+const fileJobRetention = time.Hour
+
+// FileJob is an archive compressed or extracted, or files copied or moved, in the
+// background
+type FileJob struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Status     string     `json:"status"`
+	Sources    []string   `json:"sources"`
+	Dest       string     `json:"dest"`
+	Format     string     `json:"format"`
+	Total      int64      `json:"total"` // bytes of the sources, the archive content or the archive
+	Done       int64      `json:"done"`
+	Progress   float64    `json:"progress"` // percent
+	Error      string     `json:"error,omitempty"`
+	UserID     string     `json:"user_id,omitempty"`
+	Username   string     `json:"username,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// Compress starts writing files and directories to an archive at destPath. The archive
+// is written next to it under a temporary name and only replaces destPath when complete.
+func (s *FileService) Compress(paths []string, destPath string, opts ArchiveOptions) (*FileJob, error) {
+	format, err := archiveFormat(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	opts.Format = format
+	switch opts.Encryption {
+	case "", ZipEncryptionAES, ZipEncryptionZipCrypto:
+	default:
+		return nil, fmt.Errorf("%w: unknown zip encryption %q", ErrUnsupportedFormat, opts.Encryption)
+	}
+	if opts.Password != "" && format != ArchiveZip {
+		return nil, fmt.Errorf("%w: only zip archives take a password", ErrUnsupportedFormat)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: nothing to compress", os.ErrNotExist)
+	}
+
+	sources := make([]string, 0, len(paths))
+	for _, path := range paths {
+		fullPath, err := s.checkPath(path, fileRead)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(fullPath); err != nil {
+			return nil, err
+		}
+		sources = append(sources, fullPath)
+	}
+	fullDestPath, err := s.checkPath(destPath, fileWrite)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(fullDestPath); err == nil && info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+
+	job := &FileJob{Type: FileJobCompress, Sources: sources, Dest: fullDestPath, Format: format}
+	return s.startJob(job, func(ctx context.Context) error {
+		var total int64
+		for _, source := range sources {
+			size, err := treeSize(source)
+			if err != nil {
+				return err
+			}
+			total += size
+		}
+		job.setTotal(total)
+
+		tmp, err := os.CreateTemp(filepath.Dir(fullDestPath), "."+filepath.Base(fullDestPath)+".*.part")
+		if err != nil {
+			return err
+		}
+		err = s.writeArchive(ctx, tmp, sources, opts, tmp.Name(), job.add)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			if err = os.Chmod(tmp.Name(), 0644); err == nil {
+				err = os.Rename(tmp.Name(), fullDestPath)
+			}
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+		return err
+	}), nil
+}
+
+// Decompress starts extracting an archive into destPath, which is created when missing.
+// The format is told by the content of the archive. Entries extracted before a failure
+// or a cancel are left in place.
+func (s *FileService) Decompress(archivePath, destPath, password string) (*FileJob, error) {
+	fullArchivePath, err := s.checkPath(archivePath, fileRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullArchivePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+	format, err := detectArchive(fullArchivePath)
+	if err != nil {
+		return nil, err
+	}
+	fullDestPath, err := s.checkPath(destPath, fileWrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(fullDestPath, 0755); err != nil {
+		return nil, err
+	}
+
+	job := &FileJob{Type: FileJobExtract, Sources: []string{fullArchivePath}, Dest: fullDestPath, Format: format}
+	return s.startJob(job, func(ctx context.Context) error {
+		return s.extractArchive(ctx, fullArchivePath, format, fullDestPath, password, job)
+	}), nil
+}
+
+// Transfer starts copying or moving files and directories into the directory destPath,
+// which is created when missing. Sources and destination may be on different locations,
+// a move between locations copies and then removes the source.
+func (s *FileService) Transfer(paths []string, destPath string, move bool) (*FileJob, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: nothing to transfer", os.ErrNotExist)
+	}
+	dst, fullDestPath, err := s.locate(destPath, fileWrite)
+	if err != nil {
+		return nil, err
+	}
+	if err := dst.MkdirAll(fullDestPath); err != nil {
+		return nil, err
+	}
+	if info, err := dst.Stat(fullDestPath); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%w: the destination is not a directory", ErrInvalidTransfer)
+	}
+
+	type source struct {
+		backend          fileBackend
+		fullPath, target string
+	}
+	access := fileRead
+	if move {
+		access = fileWrite | fileNoFollow
+	}
+	sources := make([]source, 0, len(paths))
+	for _, path := range paths {
+		src, fullPath, err := s.locate(path, access)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := src.Lstat(fullPath); err != nil {
+			return nil, err
+		}
+		if fullPath == "/" || (move && s.isTop(src, fullPath)) {
+			return nil, fmt.Errorf("%w: cannot transfer a root", ErrInvalidTransfer)
+		}
+		target := filepath.Join(fullDestPath, filepath.Base(fullPath))
+		if src == dst && pathWithin(target, fullPath) {
+			return nil, fmt.Errorf("%w: cannot transfer %s into itself", ErrInvalidTransfer, path)
+		}
+		sources = append(sources, source{backend: src, fullPath: fullPath, target: target})
+	}
+
+	jobType := FileJobCopy
+	if move {
+		jobType = FileJobMove
+	}
+	job := &FileJob{Type: jobType, Sources: paths, Dest: destPath}
+	return s.startJob(job, func(ctx context.Context) error {
+		var total int64
+		for _, source := range sources {
+			size, err := backendTreeSize(ctx, source.backend, source.fullPath)
+			if err != nil {
+				return err
+			}
+			total += size
+		}
+		job.setTotal(total)
+
+		for _, source := range sources {
+			var err error
+			switch {
+			case move && source.backend == dst:
+				err = dst.Rename(source.fullPath, source.target)
+				if errors.Is(err, syscall.EXDEV) {
+					err = s.moveAcross(ctx, source.backend, source.fullPath, dst, source.target, job.add)
+				}
+			case move:
+				err = s.moveAcross(ctx, source.backend, source.fullPath, dst, source.target, job.add)
+			default:
+				err = s.copyAcross(ctx, source.backend, source.fullPath, dst, source.target, job.add)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
+
+// ListJobs returns the file jobs of the user the service acts for, most recent first
+func (s *FileService) ListJobs() []*FileJob {
+	jobs := make([]*FileJob, 0)
+	s.jobs.Range(func(key, value interface{}) bool {
+		job := value.(*FileJob)
+		status := job.status()
+		if status.FinishedAt != nil && time.Since(*status.FinishedAt) > fileJobRetention {
+			s.jobs.Delete(key)
+			return true
+		}
+		if s.ownsJob(status) {
+			jobs = append(jobs, status)
+		}
+		return true
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return jobs
+}
+
+// GetJob returns a file job
+func (s *FileService) GetJob(id string) (*FileJob, error) {
+	value, ok := s.jobs.Load(id)
+	if !ok {
+		return nil, ErrFileJobNotFound
+	}
+	status := value.(*FileJob).status()
+	if !s.ownsJob(status) {
+		return nil, ErrFileJobNotFound
+	}
+	return status, nil
+}
+
+// CancelJob stops a running file job, a finished job is left as it is
+func (s *FileService) CancelJob(id string) (*FileJob, error) {
+	if _, err := s.GetJob(id); err != nil {
+		return nil, err
+	}
+	value, _ := s.jobs.Load(id)
+	job := value.(*FileJob)
+	job.cancel()
+	return job.status(), nil
+}
+
+// startJob runs a job in the background
+func (s *FileService) startJob(job *FileJob, run func(ctx context.Context) error) *FileJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job.ID = uuid.New().String()
+	job.Status = FileJobRunning
+	job.UserID = s.userID
+	job.Username = s.username
+	job.StartedAt = time.Now()
+	job.cancel = cancel
+	s.jobs.Store(job.ID, job)
+
+	go func() {
+		defer cancel()
+		err := run(ctx)
+
+		job.mu.Lock()
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case err == nil:
+			job.Status = FileJobDone
+			job.Done = job.Total
+		case ctx.Err() != nil:
+			job.Status = FileJobCancelled
+		default:
+			job.Status = FileJobFailed
+			job.Error = err.Error()
+		}
+		job.mu.Unlock()
+
+		if err != nil && ctx.Err() == nil {
+			s.log.Warn("File job failed", "type", job.Type, "sources", job.Sources, "dest", job.Dest, "error", err)
+		} else {
+			s.log.Info("File job finished", "type", job.Type, "status", job.Status, "dest", job.Dest, "user", job.Username)
+		}
+	}()
+	return job.status()
+}
+
+func (s *FileService) ownsJob(job *FileJob) bool {
+	return s.userID == "" || job.UserID == s.userID
+}
+
+func (j *FileJob) setTotal(total int64) {
+	j.mu.Lock()
+	j.Total = total
+	j.mu.Unlock()
+}
+
+func (j *FileJob) add(n int64) {
+	j.mu.Lock()
+	j.Done += n
+	j.mu.Unlock()
+}
+
+func (j *FileJob) status() *FileJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := &FileJob{
+		ID:         j.ID,
+		Type:       j.Type,
+		Status:     j.Status,
+		Sources:    j.Sources,
+		Dest:       j.Dest,
+		Format:     j.Format,
+		Total:      j.Total,
+		Done:       j.Done,
+		Error:      j.Error,
+		UserID:     j.UserID,
+		Username:   j.Username,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+	}
+	if j.Total > 0 {
+		status.Progress = min(100, float64(j.Done)*100/float64(j.Total))
+	} else if j.Status == FileJobDone {
+		status.Progress = 100
+	}
+	return status
+}
+
+// Errors
+var (
+	ErrFileJobNotFound = errors.New("file job not found")
+)
@@ -0,0 +1,416 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// File location types
+const (
+	FileLocationSFTP = "sftp"
+	FileLocationS3   = "s3"
+)
+
+// How long connecting to a remote location may take
+const fileRemoteTimeout = 10 * time.Second
+
+// Names of locations, a path "<name>:/<path>" is on the location
+var fileLocationName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// FileLocationOptions describes a remote location to create or update. Secrets left
+// empty on an update keep their value.
+type FileLocationOptions struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Host       string `json:"host"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`    // sftp, also the passphrase of the private key
+	PrivateKey string `json:"private_key"` // sftp, PEM
+	HostKey    string `json:"host_key"`    // sftp, authorized_keys format
+	Bucket     string `json:"bucket"`
+	Region     string `json:"region"`
+	AccessKey  string `json:"access_key"`
+	SecretKey  string `json:"secret_key"`
+	UseSSL     bool   `json:"use_ssl"`
+	Root       string `json:"root"`
+	ReadOnly   bool   `json:"read_only"`
+}
+
+// remoteFS is a connection to a remote location
+type remoteFS interface {
+	fileBackend
+	Close() error
+	alive() bool
+}
+
+// IsRemotePath reports whether a path is on a remote location rather than the local
+// filesystem
+func IsRemotePath(path string) bool {
+	_, _, ok := splitLocation(path)
+	return ok
+}
+
+// ListLocations returns the remote locations the service can access
+func (s *FileService) ListLocations() ([]models.FileLocation, error) {
+	locations := make([]models.FileLocation, 0)
+	if s.localOnly {
+		return locations, nil
+	}
+	if err := s.db.Order("name").Find(&locations).Error; err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// CreateLocation adds a remote location after connecting to it. The host key of an SSH
+// server is pinned when none is given.
+func (s *FileService) CreateLocation(opts FileLocationOptions) (*models.FileLocation, error) {
+	loc := &models.FileLocation{}
+	applyLocationOptions(loc, opts)
+	if err := s.validateLocation(loc); err != nil {
+		return nil, err
+	}
+	if err := s.testLocation(loc); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(loc).Error; err != nil {
+		return nil, err
+	}
+	s.log.Info("File location created", "name", loc.Name, "type", loc.Type, "host", loc.Host)
+	return loc, nil
+}
+
+// UpdateLocation changes a remote location after connecting to it
+func (s *FileService) UpdateLocation(id string, opts FileLocationOptions) (*models.FileLocation, error) {
+	var loc models.FileLocation
+	if err := s.db.First(&loc, "id = ?", id).Error; err != nil {
+		return nil, ErrFileLocationNotFound
+	}
+	// Another server is another host key
+	if opts.HostKey == "" && (opts.Host != loc.Host || opts.Type != loc.Type) {
+		loc.HostKey = ""
+	}
+	applyLocationOptions(&loc, opts)
+	if err := s.validateLocation(&loc); err != nil {
+		return nil, err
+	}
+	if err := s.testLocation(&loc); err != nil {
+		return nil, err
+	}
+	if err := s.db.Save(&loc).Error; err != nil {
+		return nil, err
+	}
+	s.disconnect(loc.ID)
+	s.log.Info("File location updated", "name", loc.Name, "type", loc.Type, "host", loc.Host)
+	return &loc, nil
+}
+
+// DeleteLocation removes a remote location, its files are left as they are
+func (s *FileService) DeleteLocation(id string) error {
+	var loc models.FileLocation
+	if err := s.db.First(&loc, "id = ?", id).Error; err != nil {
+		return ErrFileLocationNotFound
+	}
+	if err := s.db.Unscoped().Delete(&loc).Error; err != nil {
+		return err
+	}
+	s.disconnect(loc.ID)
+	s.log.Info("File location deleted", "name", loc.Name)
+	return nil
+}
+
+func applyLocationOptions(loc *models.FileLocation, opts FileLocationOptions) {
+	loc.Name = strings.TrimSpace(opts.Name)
+	loc.Type = opts.Type
+	loc.Host = strings.TrimSpace(opts.Host)
+	loc.Username = opts.Username
+	loc.Bucket = opts.Bucket
+	loc.Region = opts.Region
+	loc.AccessKey = opts.AccessKey
+	loc.UseSSL = opts.UseSSL
+	loc.Root = opts.Root
+	loc.ReadOnly = opts.ReadOnly
+	if opts.HostKey != "" {
+		loc.HostKey = strings.TrimSpace(opts.HostKey)
+	}
+	if opts.Password != "" {
+		loc.Password = opts.Password
+	}
+	if opts.PrivateKey != "" {
+		loc.PrivateKey = opts.PrivateKey
+	}
+	if opts.SecretKey != "" {
+		loc.SecretKey = opts.SecretKey
+	}
+}
+
+func (s *FileService) validateLocation(loc *models.FileLocation) error {
+	if !fileLocationName.MatchString(loc.Name) {
+		return fmt.Errorf("%w: the name may only have letters, digits, '.', '_' and '-'", ErrInvalidFileLocation)
+	}
+	if loc.Host == "" {
+		return fmt.Errorf("%w: the host is required", ErrInvalidFileLocation)
+	}
+
+	switch loc.Type {
+	case FileLocationSFTP:
+		if loc.Username == "" || (loc.Password == "" && loc.PrivateKey == "") {
+			return fmt.Errorf("%w: a username and a password or private key are required", ErrInvalidFileLocation)
+		}
+		if loc.Root != "" {
+			if !filepath.IsAbs(loc.Root) {
+				return fmt.Errorf("%w: root %q must be absolute", ErrInvalidFileLocation, loc.Root)
+			}
+			loc.Root = filepath.Clean(loc.Root)
+		}
+	case FileLocationS3:
+		if loc.Bucket == "" {
+			return fmt.Errorf("%w: the bucket is required", ErrInvalidFileLocation)
+		}
+		// An endpoint URL tells whether to use TLS
+		if strings.Contains(loc.Host, "://") {
+			endpoint, err := url.Parse(loc.Host)
+			if err != nil || endpoint.Host == "" {
+				return fmt.Errorf("%w: invalid endpoint %q", ErrInvalidFileLocation, loc.Host)
+			}
+			loc.Host = endpoint.Host
+			loc.UseSSL = endpoint.Scheme == "https"
+		}
+		loc.Root = strings.Trim(filepath.Clean("/"+loc.Root), "/")
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidFileLocation, loc.Type)
+	}
+
+	var count int64
+	query := s.db.Model(&models.FileLocation{}).Where("name = ?", loc.Name)
+	if loc.ID != "" {
+		query = query.Where("id != ?", loc.ID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: location %s already exists", ErrInvalidFileLocation, loc.Name)
+	}
+	return nil
+}
+
+// testLocation connects to a location once, pinning the host key of an SSH server
+func (s *FileService) testLocation(loc *models.FileLocation) error {
+	conn, err := dialLocation(loc)
+	if err != nil {
+		if errors.Is(err, ErrInvalidFileLocation) {
+			return err
+		}
+		return fmt.Errorf("%w: connection failed: %v", ErrInvalidFileLocation, err)
+	}
+	if _, err := conn.Stat("/"); err != nil {
+		conn.Close()
+		return fmt.Errorf("%w: root: %v", ErrInvalidFileLocation, err)
+	}
+	return conn.Close()
+}
+
+// locate returns the backend a path is on and the path within the backend, checked for
+// access like checkPath. Paths "<name>:/<path>" are on the remote location of the name.
+func (s *FileService) locate(path string, access int) (fileBackend, string, error) {
+	name, rest, ok := splitLocation(path)
+	if !ok {
+		fullPath, err := s.checkPath(path, access)
+		if err != nil {
+			return nil, "", err
+		}
+		return localFS{}, fullPath, nil
+	}
+
+	if s.localOnly {
+		return nil, "", fmt.Errorf("%w: remote locations are outside the jail", ErrPathNotAllowed)
+	}
+	var loc models.FileLocation
+	if s.db.Where("name = ?", name).Limit(1).Find(&loc).RowsAffected == 0 {
+		return nil, "", fmt.Errorf("%w: %s", ErrFileLocationNotFound, name)
+	}
+	if access&fileWrite != 0 && loc.ReadOnly {
+		return nil, "", ErrPathReadOnly
+	}
+	conn, err := s.remote(&loc)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, rest, nil
+}
+
+// remote returns the connection to a location, connecting when there is none or it was
+// lost
+func (s *FileService) remote(loc *models.FileLocation) (remoteFS, error) {
+	if value, ok := s.remotes.Load(loc.ID); ok {
+		conn := value.(remoteFS)
+		if conn.alive() {
+			return conn, nil
+		}
+		s.remotes.CompareAndDelete(loc.ID, conn)
+		conn.Close()
+	}
+
+	pinned := loc.HostKey
+	conn, err := dialLocation(loc)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", loc.Name, err)
+	}
+	if loc.HostKey != pinned {
+		s.db.Model(loc).UpdateColumn("host_key", loc.HostKey)
+	}
+	if value, loaded := s.remotes.LoadOrStore(loc.ID, conn); loaded {
+		conn.Close()
+		return value.(remoteFS), nil
+	}
+	return conn, nil
+}
+
+// disconnect closes the connection to a location, the next access connects again
+func (s *FileService) disconnect(id string) {
+	if value, ok := s.remotes.LoadAndDelete(id); ok {
+		value.(remoteFS).Close()
+	}
+}
+
+// copyAcross copies a tree within a remote location or from one location to another
+func (s *FileService) copyAcross(ctx context.Context, src fileBackend, srcPath string, dst fileBackend, dstPath string, progress func(int64)) error {
+	if src == dst && pathWithin(dstPath, srcPath) {
+		return fmt.Errorf("%w: cannot copy a directory into itself", ErrInvalidTransfer)
+	}
+	c := &backendCopy{ctx: ctx, src: src, dst: dst, skip: s.skipDenied(src, dst), progress: progress}
+	return c.copy(srcPath, dstPath)
+}
+
+// moveAcross moves a tree to another location, it is copied and then removed. A tree with
+// paths the service cannot access is copied and left in place.
+func (s *FileService) moveAcross(ctx context.Context, src fileBackend, srcPath string, dst fileBackend, dstPath string, progress func(int64)) error {
+	_, err := dst.Lstat(dstPath)
+	existed := err == nil
+
+	c := &backendCopy{ctx: ctx, src: src, dst: dst, skip: s.skipDenied(src, dst), progress: progress}
+	if err := c.copy(srcPath, dstPath); err != nil {
+		if !existed {
+			dst.RemoveAll(dstPath)
+		}
+		return err
+	}
+	if c.skipped > 0 {
+		return fmt.Errorf("%w: copied without %d denied paths, the source is kept", ErrPathNotAllowed, c.skipped)
+	}
+	return src.RemoveAll(srcPath)
+}
+
+// writeRemote writes a file on a remote location when it still meets cond. Remote files
+// have no versions.
+func (s *FileService) writeRemote(backend fileBackend, path, fullPath string, content []byte, cond FilePrecondition) (string, error) {
+	lock := s.writeLock(path)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if cond.IfMatch != "" || !cond.IfUnmodifiedSince.IsZero() {
+		info, etag, err := remoteETag(backend, fullPath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err := cond.check(info, etag); err != nil {
+			return "", err
+		}
+	}
+
+	if err := backend.MkdirAll(filepath.Dir(fullPath)); err != nil {
+		return "", err
+	}
+	w, err := backend.Create(fullPath, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return FileETag(content), nil
+}
+
+// remoteETag returns a remote file and its ETag, see FileETag
+func remoteETag(backend fileBackend, path string) (os.FileInfo, string, error) {
+	info, err := backend.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.IsDir() {
+		return nil, "", ErrIsDirectory
+	}
+	f, err := backend.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, "", err
+	}
+	return info, `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
+
+// isTop reports whether a located path is a root, which is not removed or moved
+func (s *FileService) isTop(backend fileBackend, path string) bool {
+	if _, ok := backend.(localFS); ok {
+		return path == "/" || s.isRoot(path)
+	}
+	return path == "/"
+}
+
+// skipDenied returns the filter of a copy between backends, local paths the service
+// cannot access are left out
+func (s *FileService) skipDenied(src, dst fileBackend) func(string, string) bool {
+	_, srcLocal := src.(localFS)
+	_, dstLocal := dst.(localFS)
+	return func(srcPath, dstPath string) bool {
+		return (srcLocal && s.jail.check(srcPath, false) != nil) || (dstLocal && s.jail.check(dstPath, true) != nil)
+	}
+}
+
+func dialLocation(loc *models.FileLocation) (remoteFS, error) {
+	switch loc.Type {
+	case FileLocationSFTP:
+		return dialSFTP(loc)
+	case FileLocationS3:
+		return dialS3(loc)
+	}
+	return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidFileLocation, loc.Type)
+}
+
+// splitLocation splits a path "<name>:/<path>" into the name of the location and the
+// clean path on it
+func splitLocation(path string) (string, string, bool) {
+	name, rest, ok := strings.Cut(path, ":")
+	if !ok || !fileLocationName.MatchString(name) || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", "", false
+	}
+	return name, filepath.Clean("/" + rest), true
+}
+
+// Errors
+var (
+	ErrFileLocationNotFound = errors.New("file location not found")
+	ErrInvalidFileLocation  = errors.New("invalid file location")
+	ErrRemoteUnsupported    = errors.New("not supported on remote locations")
+	ErrInvalidTransfer      = errors.New("invalid transfer")
+)
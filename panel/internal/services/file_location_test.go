@@ -0,0 +1,288 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// testRemote is a remote location kept in a local directory, it joins paths to its root
+// the way the sftp backend does
+type testRemote struct {
+	root   string
+	closed bool
+}
+
+func (r *testRemote) full(path string) string {
+	return filepath.Join(r.root, path)
+}
+
+func (r *testRemote) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(r.full(path))
+}
+
+func (r *testRemote) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(r.full(path))
+}
+
+func (r *testRemote) ReadDir(path string) ([]os.FileInfo, error) {
+	return localFS{}.ReadDir(r.full(path))
+}
+
+func (r *testRemote) Readlink(path string) (string, error) {
+	return os.Readlink(r.full(path))
+}
+
+func (r *testRemote) Symlink(target, path string) error {
+	return os.Symlink(target, r.full(path))
+}
+
+func (r *testRemote) Open(path string) (io.ReadSeekCloser, error) {
+	return localFS{}.Open(r.full(path))
+}
+
+func (r *testRemote) Create(path string, mode os.FileMode) (fileWriter, error) {
+	return localFS{}.Create(r.full(path), mode)
+}
+
+func (r *testRemote) MkdirAll(path string) error {
+	return os.MkdirAll(r.full(path), 0755)
+}
+
+func (r *testRemote) Rename(oldPath, newPath string) error {
+	return os.Rename(r.full(oldPath), r.full(newPath))
+}
+
+func (r *testRemote) RemoveAll(path string) error {
+	return os.RemoveAll(r.full(path))
+}
+
+func (r *testRemote) alive() bool {
+	return !r.closed
+}
+
+func (r *testRemote) Close() error {
+	r.closed = true
+	return nil
+}
+
+// newTestRemote adds a connected location of the name to the file service and returns
+// the directory it keeps its files in
+func newTestRemote(t *testing.T, s *FileService, name string, readOnly bool) string {
+	t.Helper()
+	loc := &models.FileLocation{Name: name, Type: FileLocationSFTP, Host: "example.com", ReadOnly: readOnly}
+	if err := s.db.Create(loc).Error; err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	s.remotes.Store(loc.ID, &testRemote{root: root})
+	return root
+}
+
+func TestSplitLocation(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		rest string
+		ok   bool
+	}{
+		{"backup:/", "backup", "/", true},
+		{"backup:", "backup", "/", true},
+		{"backup:/sites/a.tar", "backup", "/sites/a.tar", true},
+		{"s3.eu-west_1:/a//b/./c/", "s3.eu-west_1", "/a/b/c", true},
+		{"backup:/../../etc/passwd", "backup", "/etc/passwd", true},
+		{"backup:/a/../../b", "backup", "/b", true},
+		{"/srv/www", "", "", false},
+		{"/srv/a:b", "", "", false},
+		{"backup:relative", "", "", false},
+		{"C:\\Windows", "", "", false},
+		{".hidden:/a", "", "", false},
+		{"back up:/a", "", "", false},
+		{":/a", "", "", false},
+	}
+	for _, tt := range tests {
+		name, rest, ok := splitLocation(tt.path)
+		if name != tt.name || rest != tt.rest || ok != tt.ok {
+			t.Errorf("splitLocation(%q) = %q, %q, %v, want %q, %q, %v", tt.path, name, rest, ok, tt.name, tt.rest, tt.ok)
+		}
+		if IsRemotePath(tt.path) != tt.ok {
+			t.Errorf("IsRemotePath(%q) = %v", tt.path, !tt.ok)
+		}
+	}
+}
+
+func TestValidateLocationRoot(t *testing.T) {
+	s, _ := newTestFileService(t)
+	tests := []struct {
+		name string
+		loc  models.FileLocation
+		root string
+		err  bool
+	}{
+		{"sftp without root", models.FileLocation{Type: FileLocationSFTP}, "", false},
+		{"sftp root cleaned", models.FileLocation{Type: FileLocationSFTP, Root: "/home/user/../backup//"}, "/home/backup", false},
+		{"sftp relative root", models.FileLocation{Type: FileLocationSFTP, Root: "backup"}, "", true},
+		{"s3 without prefix", models.FileLocation{Type: FileLocationS3, Root: "/"}, "", false},
+		{"s3 prefix trimmed", models.FileLocation{Type: FileLocationS3, Root: "/backups//sites/"}, "backups/sites", false},
+		{"s3 prefix kept in the bucket", models.FileLocation{Type: FileLocationS3, Root: "../../other"}, "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := tt.loc
+			loc.Name, loc.Host = "remote", "example.com"
+			loc.Username, loc.Password, loc.Bucket = "user", "secret", "bucket"
+			err := s.validateLocation(&loc)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidFileLocation) {
+					t.Errorf("validateLocation() error = %v, want ErrInvalidFileLocation", err)
+				}
+				return
+			}
+			if err != nil || loc.Root != tt.root {
+				t.Errorf("root = %q, %v, want %q", loc.Root, err, tt.root)
+			}
+		})
+	}
+
+	loc := models.FileLocation{Name: "minio", Type: FileLocationS3, Host: "https://minio.example.com:9000/", Bucket: "b"}
+	if err := s.validateLocation(&loc); err != nil || loc.Host != "minio.example.com:9000" || !loc.UseSSL {
+		t.Errorf("endpoint = %q, tls %v, %v", loc.Host, loc.UseSSL, err)
+	}
+}
+
+func TestS3Key(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		key    string
+		dir    string
+	}{
+		{"", "/", "", ""},
+		{"", "/a.txt", "a.txt", "a.txt/"},
+		{"", "/dir/", "dir", "dir/"},
+		{"backups/", "/", "backups", "backups/"},
+		{"backups/", "/sites/a.tar", "backups/sites/a.tar", "backups/sites/a.tar/"},
+		{"backups/", "/../../other/a", "backups/other/a", "backups/other/a/"},
+		{"backups/", "//a/./b//", "backups/a/b", "backups/a/b/"},
+	}
+	for _, tt := range tests {
+		fs := &s3FS{prefix: tt.prefix}
+		if got := fs.key(tt.path); got != tt.key {
+			t.Errorf("key(%q) under %q = %q, want %q", tt.path, tt.prefix, got, tt.key)
+		}
+		if got := fs.dirPrefix(tt.path); got != tt.dir {
+			t.Errorf("dirPrefix(%q) under %q = %q, want %q", tt.path, tt.prefix, got, tt.dir)
+		}
+	}
+}
+
+func TestSFTPFull(t *testing.T) {
+	tests := []struct {
+		root string
+		path string
+		want string
+	}{
+		{"/", "/", "/"},
+		{"/", "/etc/hosts", "/etc/hosts"},
+		{"/home/user", "/", "/home/user"},
+		{"/home/user", "/site/index.html", "/home/user/site/index.html"},
+	}
+	for _, tt := range tests {
+		fs := &sftpFS{root: tt.root}
+		if got := fs.full(tt.path); got != tt.want {
+			t.Errorf("full(%q) under %q = %q, want %q", tt.path, tt.root, got, tt.want)
+		}
+	}
+
+	// Located paths are clean, .. cannot leave the root
+	_, rest, _ := splitLocation("backup:/../../etc/passwd")
+	if got := (&sftpFS{root: "/home/user"}).full(rest); got != "/home/user/etc/passwd" {
+		t.Errorf("full(%q) = %q", rest, got)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	s, root := newTestFileService(t)
+	newTestRemote(t, s, "backup", false)
+	newTestRemote(t, s, "archive", true)
+
+	backend, fullPath, err := s.locate(root+"/a.txt", fileWrite)
+	if _, ok := backend.(localFS); !ok || fullPath != root+"/a.txt" || err != nil {
+		t.Errorf("locate() of a local path = %T, %q, %v", backend, fullPath, err)
+	}
+	backend, fullPath, err = s.locate("backup:/sites/../a.txt", fileWrite)
+	if _, ok := backend.(*testRemote); !ok || fullPath != "/a.txt" || err != nil {
+		t.Errorf("locate() of a remote path = %T, %q, %v", backend, fullPath, err)
+	}
+	if _, _, err := s.locate("archive:/a.txt", fileRead); err != nil {
+		t.Errorf("reading a read-only location: %v", err)
+	}
+	if _, _, err := s.locate("archive:/a.txt", fileWrite); !errors.Is(err, ErrPathReadOnly) {
+		t.Errorf("writing a read-only location error = %v", err)
+	}
+	if _, _, err := s.locate("missing:/a.txt", fileRead); !errors.Is(err, ErrFileLocationNotFound) {
+		t.Errorf("locate() of an unknown location error = %v", err)
+	}
+
+	s.localOnly = true
+	if _, _, err := s.locate("backup:/a.txt", fileRead); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("locate() in a jail error = %v", err)
+	}
+}
+
+func TestRemoteTransfer(t *testing.T) {
+	s, root := newTestFileService(t)
+	remote := newTestRemote(t, s, "backup", false)
+
+	// Parent directories are created, .. stays on the location
+	if err := s.SaveFile("backup:/../sites/a/index.html", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(remote, "sites/a/index.html")); err != nil || string(data) != "hello" {
+		t.Fatalf("saved file = %q, %v", data, err)
+	}
+	f, info, err := s.OpenFile("backup:/sites/a/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "hello" || info.Name() != "index.html" {
+		t.Errorf("opened %s = %q", info.Name(), data)
+	}
+	if _, _, err := s.OpenFile("backup:/sites"); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("OpenFile() of a directory error = %v", err)
+	}
+
+	// Between the location and the local filesystem
+	if err := s.Copy("backup:/sites", root+"/restore"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(root + "/restore/a/index.html"); err != nil || string(data) != "hello" {
+		t.Errorf("copied file = %q, %v", data, err)
+	}
+	if err := s.Rename(root+"/restore", "backup:/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root + "/restore"); !os.IsNotExist(err) {
+		t.Errorf("moved source kept: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(remote, "moved/a/index.html")); err != nil || string(data) != "hello" {
+		t.Errorf("moved file = %q, %v", data, err)
+	}
+
+	if err := s.Copy("backup:/sites", "backup:/sites/a/nested"); !errors.Is(err, ErrInvalidTransfer) {
+		t.Errorf("copying a directory into itself error = %v", err)
+	}
+	if err := s.Delete("backup:/"); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("deleting the location root error = %v", err)
+	}
+	if err := s.Rename("backup:/../", root+"/x"); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("moving the location root error = %v", err)
+	}
+}
@@ -0,0 +1,448 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Mode bits a permission change can set
+	fileModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+	// The setuid, setgid and sticky bits of a Unix mode
+	unixSpecialBits os.FileMode = 07000
+
+	// Paths passed to one setfacl run
+	setfaclBatch = 256
+)
+
+var (
+	// An ACL entry as setfacl takes it, e.g. user:www-data:rwx or default:group::r-x
+	aclEntry = regexp.MustCompile(`^(d:|default:)?(u|user|g|group|m|mask|o|other):[^:,\s]*:[rwxX-]{1,3}$`)
+	// An ACL entry to remove, without permissions
+	aclRemoveEntry = regexp.MustCompile(`^(d:|default:)?(u|user|g|group|m|mask|o|other):[^:,\s]*$`)
+)
+
+// PermissionChange is a chmod, chown and chgrp of a path. Recursive changes apply to the
+// whole tree with separate modes for files and directories, symlinks are left alone.
+type PermissionChange struct {
+	Path      string       `json:"path"`
+	Mode      *os.FileMode `json:"mode"`      // for files and directories without their own mode
+	FileMode  *os.FileMode `json:"file_mode"` // e.g. 0644 for a web root
+	DirMode   *os.FileMode `json:"dir_mode"`  // e.g. 0755 for a web root
+	Owner     string       `json:"owner"`     // user name or uid
+	Group     string       `json:"group"`     // group name or gid
+	Recursive bool         `json:"recursive"`
+	DryRun    bool         `json:"dry_run"` // only count the entries the change touches
+}
+
+// PermissionResult counts the entries a permission change went through
+type PermissionResult struct {
+	Files   int  `json:"files"`
+	Dirs    int  `json:"dirs"`
+	Changed int  `json:"changed"` // entries whose mode or owner differs, changed unless a dry run
+	Skipped int  `json:"skipped"` // symlinks and entries the jail keeps from being written
+	DryRun  bool `json:"dry_run"`
+}
+
+// FileACL is the POSIX ACL of a path
+type FileACL struct {
+	Path      string   `json:"path"`
+	Supported bool     `json:"supported"` // false when getfacl is not installed
+	Owner     string   `json:"owner"`
+	Group     string   `json:"group"`
+	Entries   []string `json:"entries"` // e.g. user::rwx, user:www-data:r-x, default:group::r-x
+}
+
+// ACLChange edits the POSIX ACL of a path
+type ACLChange struct {
+	Path      string   `json:"path"`
+	Entries   []string `json:"entries"` // added or modified, or the whole ACL with Replace
+	Remove    []string `json:"remove"`  // entries without permissions, e.g. user:www-data
+	Replace   bool     `json:"replace"`
+	Recursive bool     `json:"recursive"`
+}
+
+// ChangePermissions applies a permission change, or only counts what it would touch when
+// it is a dry run
+func (s *FileService) ChangePermissions(change PermissionChange) (*PermissionResult, error) {
+	if change.Mode == nil && change.FileMode == nil && change.DirMode == nil && change.Owner == "" && change.Group == "" {
+		return nil, fmt.Errorf("%w: nothing to change", ErrInvalidPermissions)
+	}
+	for _, mode := range []**os.FileMode{&change.Mode, &change.FileMode, &change.DirMode} {
+		if *mode == nil {
+			continue
+		}
+		parsed, err := permissionMode(**mode)
+		if err != nil {
+			return nil, err
+		}
+		// A jail keeps its users from making setuid programs
+		if s.jailed && parsed&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			return nil, fmt.Errorf("%w: setuid and setgid are not allowed in a jail", ErrInvalidPermissions)
+		}
+		*mode = &parsed
+	}
+	uid, err := lookupOwner(change.Owner, false)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := lookupOwner(change.Group, true)
+	if err != nil {
+		return nil, err
+	}
+
+	fullPath, err := s.checkPath(change.Path, fileWrite)
+	if err != nil {
+		return nil, err
+	}
+	if change.Recursive && fullPath == "/" {
+		return nil, fmt.Errorf("%w: recursive changes of / are not allowed", ErrPathNotAllowed)
+	}
+	if s.jailed && (uid >= 0 || gid >= 0) {
+		if err := s.checkJailOwner(fullPath, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &PermissionResult{DryRun: change.DryRun}
+	apply := func(path string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSymlink != 0 {
+			result.Skipped++
+			return nil
+		}
+		mode := change.Mode
+		if info.IsDir() {
+			result.Dirs++
+			if change.DirMode != nil {
+				mode = change.DirMode
+			}
+		} else {
+			result.Files++
+			if change.FileMode != nil {
+				mode = change.FileMode
+			}
+		}
+
+		stat, _ := info.Sys().(*syscall.Stat_t)
+		chmod := mode != nil && info.Mode()&fileModeBits != *mode
+		chown := stat != nil && ((uid >= 0 && uint32(uid) != stat.Uid) || (gid >= 0 && uint32(gid) != stat.Gid))
+		if !chmod && !chown {
+			return nil
+		}
+		result.Changed++
+		if change.DryRun {
+			return nil
+		}
+		// Ownership first, chown clears the setuid and setgid bits. They are left cleared
+		// unless the change sets a mode itself.
+		if chown {
+			if err := os.Lchown(path, uid, gid); err != nil {
+				return err
+			}
+		}
+		if mode != nil && (chmod || chown) {
+			return os.Chmod(path, *mode)
+		}
+		return nil
+	}
+
+	if !change.Recursive {
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := apply(fullPath, info); err != nil {
+			return nil, err
+		}
+	} else {
+		err = filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if s.jail.check(path, true) != nil {
+				result.Skipped++
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return apply(path, info)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !change.DryRun {
+		s.log.Info("File permissions changed", "path", fullPath, "recursive", change.Recursive,
+			"changed", result.Changed, "user", s.username)
+	}
+	return result, nil
+}
+
+// checkJailOwner refuses to give a file in a jail to anyone but the owner and group of
+// the jail root holding it
+func (s *FileService) checkJailOwner(path string, uid, gid int) error {
+	root, ok := s.jail.root(path)
+	if !ok {
+		return ErrPathNotAllowed
+	}
+	info, err := os.Stat(root.Path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || (uid >= 0 && uint32(uid) != stat.Uid) || (gid >= 0 && uint32(gid) != stat.Gid) {
+		return fmt.Errorf("%w: files in a jail can only be given to the owner of its root", ErrInvalidPermissions)
+	}
+	return nil
+}
+
+// permissionMode takes a mode as Unix octal, e.g. 04755, or as os.FileMode bits like the
+// mode of a FileInfo, whose type bits are ignored
+func permissionMode(mode os.FileMode) (os.FileMode, error) {
+	parsed := mode &^ (os.ModeType | unixSpecialBits)
+	for unix, bit := range map[os.FileMode]os.FileMode{04000: os.ModeSetuid, 02000: os.ModeSetgid, 01000: os.ModeSticky} {
+		if mode&unix != 0 {
+			parsed |= bit
+		}
+	}
+	if parsed&^fileModeBits != 0 {
+		return 0, fmt.Errorf("%w: mode %o has bits other than permissions", ErrInvalidPermissions, mode)
+	}
+	return parsed, nil
+}
+
+// GetACL returns the POSIX ACL of a path
+func (s *FileService) GetACL(path string) (*FileACL, error) {
+	fullPath, err := s.checkPath(path, fileRead)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(fullPath); err != nil {
+		return nil, err
+	}
+
+	acl := &FileACL{Path: fullPath, Entries: []string{}}
+	if _, err := exec.LookPath("getfacl"); err != nil {
+		return acl, nil
+	}
+	acl.Supported = true
+
+	output, err := exec.Command("getfacl", "--absolute-names", "--", fullPath).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("getfacl: %s", strings.TrimSpace(string(output)))
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# owner: "):
+			acl.Owner = strings.TrimPrefix(line, "# owner: ")
+		case strings.HasPrefix(line, "# group: "):
+			acl.Group = strings.TrimPrefix(line, "# group: ")
+		case strings.HasPrefix(line, "#"):
+		default:
+			// Drop the "#effective:r-x" note of entries limited by the mask
+			entry, _, _ := strings.Cut(line, "#")
+			acl.Entries = append(acl.Entries, strings.TrimSpace(entry))
+		}
+	}
+	return acl, nil
+}
+
+// SetACL edits the POSIX ACL of a path with setfacl
+func (s *FileService) SetACL(change ACLChange) error {
+	if len(change.Entries) == 0 && len(change.Remove) == 0 {
+		return fmt.Errorf("%w: no ACL entries", ErrInvalidPermissions)
+	}
+	for _, entry := range change.Entries {
+		if !aclEntry.MatchString(entry) {
+			return fmt.Errorf("%w: invalid ACL entry %q", ErrInvalidPermissions, entry)
+		}
+	}
+	for _, entry := range change.Remove {
+		if !aclRemoveEntry.MatchString(entry) {
+			return fmt.Errorf("%w: invalid ACL entry to remove %q", ErrInvalidPermissions, entry)
+		}
+	}
+	if change.Replace && len(change.Remove) > 0 {
+		return fmt.Errorf("%w: a replaced ACL has nothing to remove", ErrInvalidPermissions)
+	}
+
+	fullPath, err := s.checkPath(change.Path, fileWrite)
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("setfacl"); err != nil {
+		return ErrACLUnsupported
+	}
+
+	if !change.Recursive {
+		if err := runSetfacl(setfaclArgs(change, true), []string{fullPath}); err != nil {
+			return err
+		}
+	} else {
+		// The tree is walked rather than left to setfacl -R so that every entry goes
+		// through the jail. Files take no default entries.
+		dirs, files, err := s.aclTargets(fullPath)
+		if err != nil {
+			return err
+		}
+		if err := runSetfacl(setfaclArgs(change, true), dirs); err != nil {
+			return err
+		}
+		if args := setfaclArgs(change, false); len(args) > 0 {
+			if err := runSetfacl(args, files); err != nil {
+				return err
+			}
+		}
+	}
+	s.log.Info("File ACL changed", "path", fullPath, "recursive", change.Recursive, "user", s.username)
+	return nil
+}
+
+// aclTargets returns the directories and files of a tree an ACL change applies to, leaving
+// out symlinks and what the jail keeps from being written
+func (s *FileService) aclTargets(root string) (dirs, files []string, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if s.jail.check(path, true) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+		case info.IsDir():
+			dirs = append(dirs, path)
+		default:
+			files = append(files, path)
+		}
+		return nil
+	})
+	return dirs, files, err
+}
+
+// setfaclArgs returns the setfacl options of a change, without the default entries unless
+// defaults. It is empty when nothing is left to change.
+func setfaclArgs(change ACLChange, defaults bool) []string {
+	keep := func(entries []string) []string {
+		var kept []string
+		for _, entry := range entries {
+			if defaults || !(strings.HasPrefix(entry, "d:") || strings.HasPrefix(entry, "default:")) {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	}
+
+	var args []string
+	if entries := keep(change.Entries); len(entries) > 0 {
+		if change.Replace {
+			args = append(args, "--set="+strings.Join(entries, ","))
+		} else {
+			args = append(args, "-m", strings.Join(entries, ","))
+		}
+	}
+	if remove := keep(change.Remove); len(remove) > 0 {
+		args = append(args, "-x", strings.Join(remove, ","))
+	}
+	return args
+}
+
+// runSetfacl runs setfacl on paths, in batches that keep the command line short
+func runSetfacl(args, paths []string) error {
+	for len(paths) > 0 {
+		n := min(len(paths), setfaclBatch)
+		cmdArgs := append(append(append([]string{}, args...), "--"), paths[:n]...)
+		if output, err := exec.Command("setfacl", cmdArgs...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidPermissions, strings.TrimSpace(string(output)))
+		}
+		paths = paths[n:]
+	}
+	return nil
+}
+
+// lookupOwner returns the uid of a user or the gid of a group given by name or number,
+// -1 leaves it unchanged
+func lookupOwner(name string, group bool) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, fmt.Errorf("%w: unknown group %q", ErrInvalidPermissions, name)
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, fmt.Errorf("%w: unknown user %q", ErrInvalidPermissions, name)
+		}
+		id = u.Uid
+	}
+	return strconv.Atoi(id)
+}
+
+// ownerNames looks up the user and group names of files, once per id
+type ownerNames struct {
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func newOwnerNames() *ownerNames {
+	return &ownerNames{users: map[uint32]string{}, groups: map[uint32]string{}}
+}
+
+// of returns the owner and group of a file, ids without a name are returned as numbers
+func (n *ownerNames) of(info os.FileInfo) (string, string) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+
+	owner, ok := n.users[stat.Uid]
+	if !ok {
+		owner = strconv.FormatUint(uint64(stat.Uid), 10)
+		if u, err := user.LookupId(owner); err == nil {
+			owner = u.Username
+		}
+		n.users[stat.Uid] = owner
+	}
+	group, ok := n.groups[stat.Gid]
+	if !ok {
+		group = strconv.FormatUint(uint64(stat.Gid), 10)
+		if g, err := user.LookupGroupId(group); err == nil {
+			group = g.Name
+		}
+		n.groups[stat.Gid] = group
+	}
+	return owner, group
+}
+
+// Errors
+var (
+	ErrInvalidPermissions = errors.New("invalid permission change")
+	ErrACLUnsupported     = errors.New("POSIX ACLs need the acl package (getfacl and setfacl)")
+)
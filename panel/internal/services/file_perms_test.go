@@ -0,0 +1,322 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+)
+
+func TestPermissionMode(t *testing.T) {
+	tests := []struct {
+		mode    os.FileMode
+		want    os.FileMode
+		wantErr bool
+	}{
+		{0644, 0644, false},
+		{0755, 0755, false},
+		{04755, os.ModeSetuid | 0755, false},
+		{02775, os.ModeSetgid | 0775, false},
+		{01777, os.ModeSticky | 0777, false},
+		{06755, os.ModeSetuid | os.ModeSetgid | 0755, false},
+		{os.ModeSetuid | 0755, os.ModeSetuid | 0755, false},
+		{os.ModeDir | 0755, 0755, false},                   // as read back from a directory
+		{os.ModeSymlink | 0777, 0777, false},               // type bits are ignored
+		{os.ModeAppend | 0644, 0, true},                    // not a permission
+		{os.ModeTemporary | os.ModeSticky | 0644, 0, true}, // not a permission
+		{os.ModeExclusive | os.ModeDir | 0755, 0, true},    // not a permission
+		{os.ModeSetuid | os.ModeSetgid | os.ModeSticky, os.ModeSetuid | os.ModeSetgid | os.ModeSticky, false},
+	}
+	for _, tt := range tests {
+		got, err := permissionMode(tt.mode)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("permissionMode(%o) = %o, %v, want %o", uint32(tt.mode), uint32(got), err, uint32(tt.want))
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPermissions) {
+			t.Errorf("permissionMode(%o) error = %v, want ErrInvalidPermissions", uint32(tt.mode), err)
+		}
+	}
+}
+
+func fileMode(mode os.FileMode) *os.FileMode {
+	return &mode
+}
+
+// fileOwner returns the uid and gid of a file
+func fileOwner(t *testing.T, path string) (uint32, uint32) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	return stat.Uid, stat.Gid
+}
+
+func modeOf(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Mode() & fileModeBits
+}
+
+func TestChangePermissionsRecursive(t *testing.T) {
+	fs, root := newTestFileService(t, func(c *config.FilesConfig) { c.Deny = []string{"*.pem"} })
+	site := filepath.Join(root, "site")
+	os.MkdirAll(filepath.Join(site, "sub"), 0700)
+	os.WriteFile(filepath.Join(site, "index.html"), nil, 0600)
+	os.WriteFile(filepath.Join(site, "sub", "app.js"), nil, 0600)
+	os.WriteFile(filepath.Join(site, "key.pem"), nil, 0600)
+	os.Symlink("index.html", filepath.Join(site, "link"))
+
+	change := PermissionChange{Path: site, FileMode: fileMode(0644), DirMode: fileMode(0755), Recursive: true, DryRun: true}
+	result, err := fs.ChangePermissions(change)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PermissionResult{Files: 2, Dirs: 2, Changed: 4, Skipped: 2, DryRun: true}
+	if *result != want {
+		t.Errorf("dry run = %+v, want %+v", *result, want)
+	}
+	if got := modeOf(t, filepath.Join(site, "index.html")); got != 0600 {
+		t.Errorf("dry run changed the mode to %o", got)
+	}
+
+	change.DryRun = false
+	if _, err := fs.ChangePermissions(change); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{
+		"":           0755,
+		"sub":        0755,
+		"index.html": 0644,
+		"sub/app.js": 0644,
+		"key.pem":    0600, // denied
+	} {
+		if got := modeOf(t, filepath.Join(site, path)); got != want {
+			t.Errorf("mode of %q = %o, want %o", path, got, want)
+		}
+	}
+
+	// Nothing left to change
+	change.DryRun = true
+	if result, err := fs.ChangePermissions(change); err != nil || result.Changed != 0 {
+		t.Errorf("second run = %+v, %v, want nothing changed", result, err)
+	}
+
+	if _, err := fs.ChangePermissions(PermissionChange{Path: site}); !errors.Is(err, ErrInvalidPermissions) {
+		t.Errorf("empty change error = %v, want ErrInvalidPermissions", err)
+	}
+	if _, err := fs.ChangePermissions(PermissionChange{Path: site, Mode: fileMode(os.ModeAppend | 0644)}); !errors.Is(err, ErrInvalidPermissions) {
+		t.Errorf("append-only mode error = %v, want ErrInvalidPermissions", err)
+	}
+}
+
+func TestChangePermissionsChownClearsSetuid(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chown needs root")
+	}
+	fs, root := newTestFileService(t)
+	tests := []struct {
+		name   string
+		change PermissionChange
+		want   os.FileMode
+	}{
+		// The kernel clears the bits on chown, they are not put back
+		{"owner only", PermissionChange{Owner: "1000"}, 0755},
+		{"owner and group", PermissionChange{Owner: "1000", Group: "1000"}, 0755},
+		// A mode asked for along with the owner is applied after the chown
+		{"owner and mode", PermissionChange{Owner: "1000", Mode: fileMode(04750)}, os.ModeSetuid | 0750},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(root, strings.ReplaceAll(tt.name, " ", "-"))
+			os.WriteFile(path, []byte("#!/bin/sh\n"), 0755)
+			if err := os.Chmod(path, os.ModeSetuid|os.ModeSetgid|0755); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.change.Path = path
+			if _, err := fs.ChangePermissions(tt.change); err != nil {
+				t.Fatal(err)
+			}
+			if uid, _ := fileOwner(t, path); uid != 1000 {
+				t.Errorf("owner = %d, want 1000", uid)
+			}
+			if got := modeOf(t, path); got != tt.want {
+				t.Errorf("mode = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangePermissionsJail(t *testing.T) {
+	fs, root := newTestFileService(t)
+	home := filepath.Join(root, "home", "alice")
+	os.MkdirAll(home, 0755)
+	os.WriteFile(filepath.Join(home, "tool"), nil, 0755)
+	uid, gid := fileOwner(t, home)
+	if os.Geteuid() == 0 {
+		if err := os.Chown(home, 1000, 1000); err != nil {
+			t.Fatal(err)
+		}
+		uid, gid = 1000, 1000
+	}
+
+	if err := fs.CreateJail(&models.FileJail{UserID: "alice", Roots: models.FileRoots{{Path: filepath.Join(root, "home", "{username}")}}}); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := fs.ForUser("alice", "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tool := filepath.Join(home, "tool")
+	tests := []struct {
+		name   string
+		change PermissionChange
+		want   error
+	}{
+		{"plain mode", PermissionChange{Mode: fileMode(0700)}, nil},
+		{"setuid", PermissionChange{Mode: fileMode(04755)}, ErrInvalidPermissions},
+		{"setgid", PermissionChange{Mode: fileMode(02755)}, ErrInvalidPermissions},
+		{"setuid as file mode bits", PermissionChange{FileMode: fileMode(os.ModeSetuid | 0755)}, ErrInvalidPermissions},
+		{"setuid for directories", PermissionChange{DirMode: fileMode(06755), Recursive: true}, ErrInvalidPermissions},
+		{"sticky", PermissionChange{Mode: fileMode(01755)}, nil},
+		{"owner of the root", PermissionChange{Owner: itoa(uid), Group: itoa(gid)}, nil},
+		{"root", PermissionChange{Owner: "0"}, ErrInvalidPermissions},
+		{"other user", PermissionChange{Owner: itoa(uid + 1)}, ErrInvalidPermissions},
+		{"other group", PermissionChange{Group: itoa(gid + 1)}, ErrInvalidPermissions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change.Path = tool
+			_, err := alice.ChangePermissions(tt.change)
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("ChangePermissions() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if got := modeOf(t, tool); got&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		t.Errorf("jailed change left mode %v", got)
+	}
+
+	// The same changes are allowed without a jail
+	if _, err := fs.ChangePermissions(PermissionChange{Path: tool, Mode: fileMode(04755)}); err != nil {
+		t.Errorf("unjailed setuid error = %v", err)
+	}
+}
+
+func itoa(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// stubSetfacl puts a setfacl on PATH that appends its arguments to the returned log
+func stubSetfacl(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "setfacl"), []byte("#!/bin/sh\necho \"$@\" >> \"$0.log\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return filepath.Join(dir, "setfacl.log")
+}
+
+func setfaclRuns(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestSetACL(t *testing.T) {
+	log := stubSetfacl(t)
+	fs, root := newTestFileService(t, func(c *config.FilesConfig) {
+		c.Deny = []string{".env", "*.pem"}
+		c.Roots = append(c.Roots, config.FileRootConfig{Path: filepath.Join(c.Roots[0].Path, "site", "ro"), ReadOnly: true})
+	})
+	site := filepath.Join(root, "site")
+	for _, dir := range []string{"sub", "ro", "conf"} {
+		os.MkdirAll(filepath.Join(site, dir), 0755)
+	}
+	for _, file := range []string{"index.html", ".env", "key.pem", "sub/app.js", "ro/config.php", "conf/tls.pem"} {
+		os.WriteFile(filepath.Join(site, file), nil, 0644)
+	}
+	os.Symlink("/etc/shadow", filepath.Join(site, "link"))
+
+	change := ACLChange{Path: site, Entries: []string{"u:www-data:rwX", "d:u:www-data:rwX"}, Remove: []string{"u:nobody"}, Recursive: true}
+	if err := fs.SetACL(change); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-m u:www-data:rwX,d:u:www-data:rwX -x u:nobody -- " + strings.Join([]string{site, site + "/conf", site + "/sub"}, " "),
+		"-m u:www-data:rwX -x u:nobody -- " + strings.Join([]string{site + "/index.html", site + "/sub/app.js"}, " "),
+	}
+	if got := setfaclRuns(t, log); !reflect.DeepEqual(got, want) {
+		t.Errorf("setfacl runs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	os.Remove(log)
+
+	// Files are left alone when only default entries change
+	change.Entries, change.Remove = []string{"default:g:dev:r-x"}, nil
+	if err := fs.SetACL(change); err != nil {
+		t.Fatal(err)
+	}
+	if got := setfaclRuns(t, log); len(got) != 1 || !strings.HasPrefix(got[0], "-m default:g:dev:r-x -- "+site+" ") {
+		t.Errorf("setfacl runs = %q, want the directories only", got)
+	}
+	os.Remove(log)
+
+	// A single path takes the entries as they are
+	if err := fs.SetACL(ACLChange{Path: filepath.Join(site, "index.html"), Entries: []string{"user::rw-", "group::r--", "other::---"}, Replace: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := setfaclRuns(t, log), []string{"--set=user::rw-,group::r--,other::--- -- " + site + "/index.html"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("setfacl runs = %q, want %q", got, want)
+	}
+
+	for _, path := range []string{".env", "key.pem", "ro", "ro/config.php"} {
+		if err := fs.SetACL(ACLChange{Path: filepath.Join(site, path), Entries: []string{"o::rwx"}}); err == nil {
+			t.Errorf("SetACL(%q) succeeded", path)
+		}
+	}
+}
+
+func TestSetACLInvalid(t *testing.T) {
+	stubSetfacl(t)
+	fs, root := newTestFileService(t)
+	tests := []struct {
+		name   string
+		change ACLChange
+	}{
+		{"nothing to change", ACLChange{}},
+		{"option injection", ACLChange{Entries: []string{"--set-file=/etc/acl"}}},
+		{"two entries in one", ACLChange{Entries: []string{"u:a:rwx,u:b:rwx"}}},
+		{"unknown tag", ACLChange{Entries: []string{"x:a:rwx"}}},
+		{"bad permissions", ACLChange{Entries: []string{"u:a:rwxs"}}},
+		{"removal with permissions", ACLChange{Remove: []string{"u:a:rwx"}}},
+		{"replace and remove", ACLChange{Entries: []string{"u::rwx"}, Remove: []string{"u:a"}, Replace: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change.Path = root
+			if err := fs.SetACL(tt.change); !errors.Is(err, ErrInvalidPermissions) {
+				t.Errorf("SetACL() error = %v, want ErrInvalidPermissions", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/vpanel/server/internal/models"
+)
+
+// Part size of uploads to a bucket, the size of an upload is not known beforehand and a
+// part is buffered in memory. Objects can have up to 10000 parts.
+const s3PartSize = 16 * 1024 * 1024
+
+// s3FS is a location in a bucket of an S3 compatible storage, e.g. MinIO. Directories are
+// key prefixes, an empty directory is kept as an object named like the prefix.
+type s3FS struct {
+	client *minio.Client
+	bucket string
+	prefix string // key prefix of the location root, "" or ending with a slash
+}
+
+// dialS3 connects to the bucket of a location
+func dialS3(loc *models.FileLocation) (*s3FS, error) {
+	client, err := minio.New(loc.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(loc.AccessKey, loc.SecretKey, ""),
+		Secure: loc.UseSSL,
+		Region: loc.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fileRemoteTimeout)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, loc.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: bucket %s does not exist", ErrInvalidFileLocation, loc.Bucket)
+	}
+
+	prefix := strings.Trim(filepath.Clean("/"+loc.Root), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3FS{client: client, bucket: loc.Bucket, prefix: prefix}, nil
+}
+
+// key returns the object key of a path of the location, "" for the bucket root
+func (fs *s3FS) key(path string) string {
+	return strings.TrimSuffix(fs.prefix+strings.TrimPrefix(filepath.Clean("/"+path), "/"), "/")
+}
+
+// dirPrefix returns the key prefix of the objects in a directory
+func (fs *s3FS) dirPrefix(path string) string {
+	if key := fs.key(path); key != "" {
+		return key + "/"
+	}
+	return ""
+}
+
+func (fs *s3FS) Stat(path string) (os.FileInfo, error) {
+	name := filepath.Base(filepath.Clean("/" + path))
+	key := fs.key(path)
+	if key == "" {
+		return &remoteFileInfo{name: name, mode: os.ModeDir | 0755}, nil
+	}
+
+	object, err := fs.client.StatObject(context.Background(), fs.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return s3FileInfo(name, object), nil
+	}
+	if !s3NotFound(err) {
+		return nil, err
+	}
+
+	// A directory is any prefix with objects below it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		return &remoteFileInfo{name: name, mode: os.ModeDir | 0755, modTime: object.LastModified}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+func (fs *s3FS) Lstat(path string) (os.FileInfo, error) {
+	return fs.Stat(path)
+}
+
+func (fs *s3FS) ReadDir(path string) ([]os.FileInfo, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	prefix := fs.dirPrefix(path)
+	var infos []os.FileInfo
+	for object := range fs.client.ListObjects(context.Background(), fs.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if object.Key == prefix {
+			continue // the marker of the directory itself
+		}
+		name := strings.TrimPrefix(object.Key, prefix)
+		if strings.HasSuffix(name, "/") {
+			infos = append(infos, &remoteFileInfo{name: strings.TrimSuffix(name, "/"), mode: os.ModeDir | 0755})
+			continue
+		}
+		infos = append(infos, s3FileInfo(name, object))
+	}
+	return infos, nil
+}
+
+func (fs *s3FS) Readlink(path string) (string, error) {
+	return "", fmt.Errorf("%w: buckets have no links", ErrRemoteUnsupported)
+}
+
+func (fs *s3FS) Symlink(target, path string) error {
+	return fmt.Errorf("%w: buckets have no links", ErrRemoteUnsupported)
+}
+
+func (fs *s3FS) Open(path string) (io.ReadSeekCloser, error) {
+	object, err := fs.client.GetObject(context.Background(), fs.bucket, fs.key(path), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// Objects are fetched lazily, a missing one fails here
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if s3NotFound(err) {
+			if info, statErr := fs.Stat(path); statErr == nil && info.IsDir() {
+				return nil, ErrIsDirectory
+			}
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+// Create uploads the object as it is written, it only appears in the bucket when closed
+func (fs *s3FS) Create(path string, mode os.FileMode) (fileWriter, error) {
+	key := fs.key(path)
+	if key == "" {
+		return nil, ErrIsDirectory
+	}
+	r, w := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &s3Writer{w: w, cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		_, err := fs.client.PutObject(ctx, fs.bucket, key, r, -1, minio.PutObjectOptions{
+			PartSize:    s3PartSize,
+			ContentType: s3ContentType(key),
+		})
+		r.CloseWithError(err)
+		writer.done <- err
+	}()
+	return writer, nil
+}
+
+func (fs *s3FS) MkdirAll(path string) error {
+	key := fs.key(path)
+	if key == "" {
+		return nil
+	}
+	info, err := fs.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%w: %s is a file", ErrFileExists, path)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	_, err = fs.client.PutObject(context.Background(), fs.bucket, key+"/", bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return err
+}
+
+// Rename copies the objects within the storage and removes the originals, a directory is
+// not renamed at once
+func (fs *s3FS) Rename(oldPath, newPath string) error {
+	info, err := fs.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	oldKey, newKey := fs.key(oldPath), fs.key(newPath)
+	if !info.IsDir() {
+		if err := fs.copyObject(oldKey, newKey); err != nil {
+			return err
+		}
+		return fs.client.RemoveObject(context.Background(), fs.bucket, oldKey, minio.RemoveObjectOptions{})
+	}
+
+	for object := range fs.client.ListObjects(context.Background(), fs.bucket, minio.ListObjectsOptions{Prefix: oldKey + "/", Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if err := fs.copyObject(object.Key, newKey+strings.TrimPrefix(object.Key, oldKey)); err != nil {
+			return err
+		}
+	}
+	return fs.RemoveAll(oldPath)
+}
+
+func (fs *s3FS) RemoveAll(path string) error {
+	key := fs.key(path)
+	if key == "" {
+		return ErrPathNotAllowed
+	}
+	err := fs.client.RemoveObject(context.Background(), fs.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && !s3NotFound(err) {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objects := fs.client.ListObjects(ctx, fs.bucket, minio.ListObjectsOptions{Prefix: key + "/", Recursive: true})
+	for removeErr := range fs.client.RemoveObjects(ctx, fs.bucket, objects, minio.RemoveObjectsOptions{}) {
+		return removeErr.Err
+	}
+	return nil
+}
+
+func (fs *s3FS) Close() error {
+	return nil
+}
+
+func (fs *s3FS) alive() bool {
+	return true
+}
+
+// copyObject copies an object within the bucket, by parts when it is larger than a
+// single copy takes
+func (fs *s3FS) copyObject(srcKey, dstKey string) error {
+	_, err := fs.client.ComposeObject(context.Background(),
+		minio.CopyDestOptions{Bucket: fs.bucket, Object: dstKey},
+		minio.CopySrcOptions{Bucket: fs.bucket, Object: srcKey},
+	)
+	return err
+}
+
+type s3Writer struct {
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	w.w.Close()
+	err := <-w.done
+	w.cancel()
+	return err
+}
+
+// Abort cancels the upload, the parts uploaded so far are removed
+func (w *s3Writer) Abort() {
+	w.cancel()
+	w.w.CloseWithError(context.Canceled)
+	<-w.done
+}
+
+func s3FileInfo(name string, object minio.ObjectInfo) os.FileInfo {
+	return &remoteFileInfo{name: filepath.Base(name), size: object.Size, mode: 0644, modTime: object.LastModified}
+}
+
+func s3NotFound(err error) bool {
+	response := minio.ToErrorResponse(err)
+	return response.StatusCode == http.StatusNotFound || response.Code == "NoSuchKey"
+}
+
+// s3ContentType returns the content type an object is stored with, which browsers get
+// when the object is downloaded from the storage directly
+func s3ContentType(key string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,436 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults and limits of a content search
+	grepMaxFileSize = 10 * 1024 * 1024
+	grepMaxResults  = 1000
+	grepMaxContext  = 10
+	grepMaxLine     = 1024 * 1024
+
+	// Entries a filename index holds at most
+	fileIndexMaxEntries = 2000000
+)
+
+// ContentSearch is a grep of the files below a path
+type ContentSearch struct {
+	Path        string
+	Pattern     string // RE2 regular expression, or plain text with Literal
+	Literal     bool
+	IgnoreCase  bool
+	Include     []string // globs a file must match one of, a glob with a slash matches the relative path
+	Exclude     []string // globs of the files and directories skipped
+	MaxFileSize int64    // bytes, larger files are skipped
+	Context     int      // lines shown before and after a match
+	MaxResults  int      // matching lines
+}
+
+// ContentMatch is a line matching a content search
+type ContentMatch struct {
+	Path   string   `json:"path"`
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Ranges [][]int  `json:"ranges"` // byte offsets of the matches in the line
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// ContentSearchDone ends a content search
+type ContentSearchDone struct {
+	Files     int  `json:"files"`   // files searched
+	Matched   int  `json:"matched"` // files with a match
+	Matches   int  `json:"matches"`
+	Skipped   int  `json:"skipped"`   // binary, large and unreadable files
+	Truncated bool `json:"truncated"` // stopped at the maximum results
+}
+
+// FileIndex is a filename index of a tree, kept in memory so repeated name searches do
+// not walk the tree. Indexes older than the configured lifetime are rebuilt on use. A
+// tree with more entries than an index holds is not indexed, searches walk it instead.
+type FileIndex struct {
+	Path      string    `json:"path"`
+	Entries   int       `json:"entries"`
+	Building  bool      `json:"building"`
+	BuiltAt   time.Time `json:"built_at"`
+	Truncated bool      `json:"truncated"` // the tree has more entries than an index holds
+	Error     string    `json:"error,omitempty"`
+
+	mu      sync.RWMutex
+	paths   []string
+	names   []string  // lower case base names of paths
+	checked time.Time // when the last build ended, whether it failed or not
+}
+
+// SearchContent greps the files below a path. Matches are sent as *ContentMatch and the
+// search ends with a *ContentSearchDone, the channel is closed when it is over or ctx is
+// cancelled.
+func (s *FileService) SearchContent(ctx context.Context, search ContentSearch) (<-chan interface{}, error) {
+	if search.Pattern == "" {
+		return nil, fmt.Errorf("%w: a pattern is required", ErrInvalidSearch)
+	}
+	re, err := compileSearch(search.Pattern, search.Literal, search.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+	for _, glob := range append(append([]string{}, search.Include...), search.Exclude...) {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("%w: invalid glob %q", ErrInvalidSearch, glob)
+		}
+	}
+	if search.MaxFileSize <= 0 {
+		search.MaxFileSize = grepMaxFileSize
+	}
+	if search.MaxResults <= 0 || search.MaxResults > grepMaxResults {
+		search.MaxResults = grepMaxResults
+	}
+	search.Context = max(0, min(search.Context, grepMaxContext))
+
+	fullPath, err := s.checkPath(search.Path, fileRead)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(fullPath); err != nil {
+		return nil, err
+	}
+
+	results := make(chan interface{}, 64)
+	go func() {
+		defer close(results)
+
+		done := &ContentSearchDone{}
+		send := func(v interface{}) bool {
+			select {
+			case results <- v:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		err := filepath.WalkDir(fullPath, func(path string, entry fs.DirEntry, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if err != nil {
+				done.Skipped++
+				return nil
+			}
+			rel, _ := filepath.Rel(fullPath, path)
+			if s.jail.check(path, false) != nil || (rel != "." && globsMatch(search.Exclude, rel)) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !entry.Type().IsRegular() || (len(search.Include) > 0 && !globsMatch(search.Include, rel)) {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil || info.Size() > search.MaxFileSize {
+				done.Skipped++
+				return nil
+			}
+			done.Files++
+			matches, searched := grepFile(path, re, search.Context, search.MaxResults-done.Matches, func(m *ContentMatch) bool {
+				return send(m)
+			})
+			if !searched {
+				done.Skipped++
+				done.Files--
+			}
+			if matches > 0 {
+				done.Matched++
+				done.Matches += matches
+			}
+			if done.Matches >= search.MaxResults {
+				done.Truncated = true
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err == nil {
+			send(done)
+		}
+	}()
+	return results, nil
+}
+
+// compileSearch compiles the pattern of a search, plain text with literal
+func compileSearch(pattern string, literal, ignoreCase bool) (*regexp.Regexp, error) {
+	if literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+	}
+	return re, nil
+}
+
+// grepFile sends the lines of a file matching re with their context, up to limit. It
+// reports false when the file is binary or cannot be read.
+func grepFile(path string, re *regexp.Regexp, context, limit int, send func(*ContentMatch) bool) (int, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	head, _ := reader.Peek(fileBinaryScan)
+	if isBinary(head) {
+		return 0, false
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), grepMaxLine)
+
+	var before []string
+	var pending []*ContentMatch // matches still collecting the lines after them
+	matches := 0
+	flush := func(all bool) bool {
+		for len(pending) > 0 && (all || len(pending[0].After) >= context) {
+			if !send(pending[0]) {
+				return false
+			}
+			pending = pending[1:]
+		}
+		return true
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		for _, m := range pending {
+			if len(m.After) < context {
+				m.After = append(m.After, text)
+			}
+		}
+		if !flush(false) {
+			return matches, true
+		}
+
+		if matches < limit {
+			if ranges := re.FindAllStringIndex(text, -1); ranges != nil {
+				match := &ContentMatch{Path: path, Line: line, Text: text, Ranges: ranges}
+				if len(before) > 0 {
+					match.Before = append([]string{}, before...)
+				}
+				pending = append(pending, match)
+				matches++
+				if !flush(false) {
+					return matches, true
+				}
+			}
+		} else if len(pending) == 0 {
+			break
+		}
+
+		if context > 0 {
+			if before = append(before, text); len(before) > context {
+				before = before[1:]
+			}
+		}
+	}
+	// Lines too long to be text make the file binary, anything else is a read error
+	if err := scanner.Err(); err != nil && matches == 0 {
+		return 0, false
+	}
+	flush(true)
+	return matches, true
+}
+
+// globsMatch reports whether one of the globs matches the name of a relative path, or
+// the path itself for a glob with a slash
+func globsMatch(globs []string, rel string) bool {
+	name := filepath.Base(rel)
+	for _, glob := range globs {
+		target := name
+		if strings.Contains(glob, "/") {
+			target = rel
+		}
+		if ok, _ := filepath.Match(glob, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildIndex indexes the file names below a path in the background, replacing an
+// index of the same path
+func (s *FileService) BuildIndex(path string) (*FileIndex, error) {
+	fullPath, err := s.checkPath(path, fileRead)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%w: only directories are indexed", ErrInvalidSearch)
+	}
+
+	value, _ := s.indexes.LoadOrStore(fullPath, &FileIndex{Path: fullPath})
+	index := value.(*FileIndex)
+	index.refresh()
+	return index.status(), nil
+}
+
+// ListIndexes returns the filename indexes
+func (s *FileService) ListIndexes() []*FileIndex {
+	indexes := make([]*FileIndex, 0)
+	s.indexes.Range(func(_, value interface{}) bool {
+		if index := value.(*FileIndex); s.jail.check(index.Path, false) == nil {
+			indexes = append(indexes, index.status())
+		}
+		return true
+	})
+	return indexes
+}
+
+// DeleteIndex drops a filename index
+func (s *FileService) DeleteIndex(path string) error {
+	fullPath, err := s.checkPath(path, fileRead)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.indexes.LoadAndDelete(fullPath); !ok {
+		return ErrFileIndexNotFound
+	}
+	return nil
+}
+
+// searchIndex looks a name up in a current index covering a path, it reports false when
+// there is none and the tree has to be walked. Stale indexes are refreshed.
+func (s *FileService) searchIndex(fullPath, pattern string, limit int) ([]string, bool) {
+	var best *FileIndex
+	s.indexes.Range(func(_, value interface{}) bool {
+		index := value.(*FileIndex)
+		if pathWithin(fullPath, index.Path) && (best == nil || len(index.Path) > len(best.Path)) {
+			best = index
+		}
+		return true
+	})
+	if best == nil {
+		return nil, false
+	}
+
+	best.mu.RLock()
+	defer best.mu.RUnlock()
+	// Builds that failed or were truncated are retried no sooner than current ones
+	if !best.Building && time.Since(best.checked) > s.indexTTL() {
+		go best.refresh()
+	}
+	if best.BuiltAt.IsZero() || best.Truncated || time.Since(best.BuiltAt) > s.indexTTL() {
+		return nil, false
+	}
+
+	var paths []string
+	for i, name := range best.names {
+		if strings.Contains(name, pattern) && pathWithin(best.paths[i], fullPath) && best.paths[i] != fullPath {
+			if s.jail.check(best.paths[i], false) != nil {
+				continue
+			}
+			if paths = append(paths, best.paths[i]); len(paths) >= limit {
+				break
+			}
+		}
+	}
+	return paths, true
+}
+
+func (s *FileService) indexTTL() time.Duration {
+	minutes := s.config.Files.IndexTTL
+	if minutes <= 0 {
+		minutes = 10
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// refresh rebuilds the index unless it is being built
+func (i *FileIndex) refresh() {
+	i.mu.Lock()
+	if i.Building {
+		i.mu.Unlock()
+		return
+	}
+	i.Building = true
+	i.mu.Unlock()
+
+	go func() {
+		var paths, names []string
+		truncated := false
+		err := filepath.WalkDir(i.Path, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if entry != nil && entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if path == i.Path {
+				return nil
+			}
+			if len(paths) >= fileIndexMaxEntries {
+				truncated = true
+				return filepath.SkipAll
+			}
+			paths = append(paths, path)
+			names = append(names, strings.ToLower(entry.Name()))
+			return nil
+		})
+
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		i.Building = false
+		i.checked = time.Now()
+		if err != nil {
+			i.Error = err.Error()
+			return
+		}
+		// A partial index would miss names, it is not searched so it keeps no entries
+		i.Entries = len(paths)
+		if truncated {
+			paths, names = nil, nil
+		}
+		i.paths, i.names = paths, names
+		i.Truncated = truncated
+		i.BuiltAt = time.Now()
+		i.Error = ""
+	}()
+}
+
+func (i *FileIndex) status() *FileIndex {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return &FileIndex{
+		Path:      i.Path,
+		Entries:   i.Entries,
+		Building:  i.Building,
+		BuiltAt:   i.BuiltAt,
+		Truncated: i.Truncated,
+		Error:     i.Error,
+	}
+}
+
+// Errors
+var (
+	ErrInvalidSearch     = errors.New("invalid search")
+	ErrFileIndexNotFound = errors.New("file index not found")
+)
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// waitIndex waits for the build of an index to end
+func waitIndex(t *testing.T, index *FileIndex) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); index.status().Building; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the index is still building")
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.MkdirAll(filepath.Join(root, "src", "app"), 0755)
+	for _, name := range []string{"src/Main.go", "src/app/main_test.go", "README.md"} {
+		os.WriteFile(filepath.Join(root, name), nil, 0644)
+	}
+	if _, err := fs.BuildIndex(root); err != nil {
+		t.Fatal(err)
+	}
+	value, _ := fs.indexes.Load(root)
+	index := value.(*FileIndex)
+	waitIndex(t, index)
+
+	tests := []struct {
+		name      string
+		path      string
+		pattern   string
+		truncated bool
+		builtAgo  time.Duration
+		checkAgo  time.Duration
+		want      []string
+		wantOK    bool
+		wantBuild bool
+	}{
+		{"current", root, "main", false, 0, time.Minute, []string{"src/Main.go", "src/app/main_test.go"}, true, false},
+		{"below the indexed path", filepath.Join(root, "src", "app"), "main", false, 0, time.Minute, []string{"src/app/main_test.go"}, true, false},
+		{"stale", root, "main", false, time.Hour, time.Hour, nil, false, true},
+		{"truncated", root, "main", true, 0, time.Minute, nil, false, false},
+		{"truncated and stale", root, "main", true, time.Hour, time.Hour, nil, false, true},
+		{"failed recently", root, "main", false, -1, time.Minute, nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waitIndex(t, index)
+			checked := time.Now().Add(-tt.checkAgo)
+			index.mu.Lock()
+			index.Truncated = tt.truncated
+			index.BuiltAt = time.Now().Add(-tt.builtAgo)
+			if tt.builtAgo < 0 {
+				index.BuiltAt = time.Time{}
+			}
+			index.checked = checked
+			index.mu.Unlock()
+
+			paths, ok := fs.searchIndex(tt.path, tt.pattern, 10)
+			if ok != tt.wantOK {
+				t.Fatalf("searchIndex() ok = %v, want %v", ok, tt.wantOK)
+			}
+			var got []string
+			for _, path := range paths {
+				rel, _ := filepath.Rel(root, path)
+				got = append(got, rel)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("searchIndex() = %q, want %q", got, tt.want)
+			}
+
+			// The rebuild runs in the background, give it time to start and end
+			rebuilt := false
+			for wait := 0; wait < 50 && !rebuilt; wait++ {
+				time.Sleep(5 * time.Millisecond)
+				index.mu.RLock()
+				rebuilt = index.checked != checked
+				index.mu.RUnlock()
+			}
+			if rebuilt != tt.wantBuild {
+				t.Errorf("index rebuilt = %v, want %v", rebuilt, tt.wantBuild)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	for _, name := range []string{"a/Notes.txt", "a/b/notes.md", "other.txt"} {
+		os.WriteFile(filepath.Join(root, name), nil, 0644)
+	}
+
+	tests := []struct {
+		name       string
+		base       string
+		pattern    string
+		maxResults int
+		want       []string
+	}{
+		{"case insensitive", root, "NOTES", 0, []string{"Notes.txt", "notes.md"}},
+		{"below a path", filepath.Join(root, "a", "b"), "notes", 0, []string{"notes.md"}},
+		{"limited", root, "t", 1, nil},
+		{"no match", root, "missing", 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := fs.Search(tt.base, tt.pattern, tt.maxResults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if len(results) != tt.maxResults {
+					t.Errorf("Search() = %d results, want %d", len(results), tt.maxResults)
+				}
+				return
+			}
+			got := []string{}
+			for _, r := range results {
+				got = append(got, r.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchContent(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("one\nTwo two\nthree\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.log"), []byte("two\n"), 0644)
+	os.WriteFile(filepath.Join(root, "bin"), []byte("two\x00"), 0644)
+
+	tests := []struct {
+		name   string
+		search ContentSearch
+		want   []string // path:line
+		done   ContentSearchDone
+	}{
+		{
+			"ignore case", ContentSearch{Pattern: "two", IgnoreCase: true},
+			[]string{"a.txt:2", "b.log:1"}, ContentSearchDone{Files: 2, Matched: 2, Matches: 2, Skipped: 1},
+		},
+		{
+			"include", ContentSearch{Pattern: "two", Include: []string{"*.txt"}},
+			[]string{"a.txt:2"}, ContentSearchDone{Files: 1, Matched: 1, Matches: 1},
+		},
+		{
+			"exclude", ContentSearch{Pattern: "t", Exclude: []string{"*.txt"}},
+			[]string{"b.log:1"}, ContentSearchDone{Files: 1, Matched: 1, Matches: 1, Skipped: 1},
+		},
+		{
+			"max results", ContentSearch{Pattern: "t", Include: []string{"*.txt"}, MaxResults: 1},
+			[]string{"a.txt:2"}, ContentSearchDone{Files: 1, Matched: 1, Matches: 1, Truncated: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.search.Path = root
+			results, err := fs.SearchContent(context.Background(), tt.search)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			var done *ContentSearchDone
+			for v := range results {
+				switch v := v.(type) {
+				case *ContentMatch:
+					rel, _ := filepath.Rel(root, v.Path)
+					got = append(got, rel+":"+string(rune('0'+v.Line)))
+				case *ContentSearchDone:
+					done = v
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches = %q, want %q", got, tt.want)
+			}
+			if done == nil || *done != tt.done {
+				t.Errorf("done = %+v, want %+v", done, tt.done)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"github.com/vpanel/server/internal/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpFS is a location on an SSH server
+type sftpFS struct {
+	root   string
+	conn   *ssh.Client
+	client *sftp.Client
+	done   chan struct{} // closed when the connection is lost
+}
+
+// dialSFTP connects to the SSH server of a location. The server must present the pinned
+// host key, a location without one pins the key presented.
+func dialSFTP(loc *models.FileLocation) (*sftpFS, error) {
+	var auth []ssh.AuthMethod
+	if loc.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(loc.PrivateKey))
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && loc.Password != "" {
+			// The password unlocks the key
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(loc.PrivateKey), []byte(loc.Password))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: private key: %v", ErrInvalidFileLocation, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if loc.Password != "" {
+		auth = append(auth, ssh.Password(loc.Password))
+	}
+
+	var hostKey ssh.HostKeyCallback
+	if loc.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(loc.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("%w: host key: %v", ErrInvalidFileLocation, err)
+		}
+		hostKey = ssh.FixedHostKey(key)
+	} else {
+		hostKey = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			loc.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+			return nil
+		}
+	}
+
+	addr := loc.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            loc.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         fileRemoteTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	root := loc.Root
+	if root == "" {
+		if root, err = client.Getwd(); err != nil {
+			client.Close()
+			conn.Close()
+			return nil, err
+		}
+	}
+	fs := &sftpFS{root: filepath.Clean(root), conn: conn, client: client, done: make(chan struct{})}
+	go func() {
+		conn.Wait()
+		close(fs.done)
+	}()
+	return fs, nil
+}
+
+// full returns the path on the server of a path of the location
+func (fs *sftpFS) full(path string) string {
+	return filepath.Join(fs.root, path)
+}
+
+func (fs *sftpFS) Stat(path string) (os.FileInfo, error) {
+	return fs.client.Stat(fs.full(path))
+}
+
+func (fs *sftpFS) Lstat(path string) (os.FileInfo, error) {
+	return fs.client.Lstat(fs.full(path))
+}
+
+func (fs *sftpFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return fs.client.ReadDir(fs.full(path))
+}
+
+func (fs *sftpFS) Readlink(path string) (string, error) {
+	return fs.client.ReadLink(fs.full(path))
+}
+
+func (fs *sftpFS) Symlink(target, path string) error {
+	return fs.client.Symlink(target, fs.full(path))
+}
+
+func (fs *sftpFS) Open(path string) (io.ReadSeekCloser, error) {
+	return fs.client.Open(fs.full(path))
+}
+
+// Create writes next to path under a temporary name and renames over path when closed
+func (fs *sftpFS) Create(path string, mode os.FileMode) (fileWriter, error) {
+	tmp := filepath.Join(filepath.Dir(fs.full(path)), filePartPrefix+uuid.New().String())
+	f, err := fs.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{File: f, fs: fs, path: fs.full(path), mode: mode}, nil
+}
+
+func (fs *sftpFS) MkdirAll(path string) error {
+	return fs.client.MkdirAll(fs.full(path))
+}
+
+func (fs *sftpFS) Rename(oldPath, newPath string) error {
+	return fs.rename(fs.full(oldPath), fs.full(newPath))
+}
+
+func (fs *sftpFS) RemoveAll(path string) error {
+	return fs.client.RemoveAll(fs.full(path))
+}
+
+func (fs *sftpFS) Close() error {
+	fs.client.Close()
+	return fs.conn.Close()
+}
+
+func (fs *sftpFS) alive() bool {
+	select {
+	case <-fs.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// rename replaces newPath like rename(2) where the server has the posix-rename extension,
+// plain SFTP renames fail over an existing file
+func (fs *sftpFS) rename(oldPath, newPath string) error {
+	if _, ok := fs.client.HasExtension("posix-rename@openssh.com"); ok {
+		return fs.client.PosixRename(oldPath, newPath)
+	}
+	if info, err := fs.client.Lstat(newPath); err == nil && !info.IsDir() {
+		if err := fs.client.Remove(newPath); err != nil {
+			return err
+		}
+	}
+	return fs.client.Rename(oldPath, newPath)
+}
+
+type sftpWriter struct {
+	*sftp.File
+	fs   *sftpFS
+	path string
+	mode os.FileMode
+}
+
+func (w *sftpWriter) Close() error {
+	err := w.File.Close()
+	if err == nil {
+		err = w.fs.client.Chmod(w.File.Name(), w.mode)
+	}
+	if err == nil {
+		err = w.fs.rename(w.File.Name(), w.path)
+	}
+	if err != nil {
+		w.fs.client.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w *sftpWriter) Abort() {
+	w.File.Close()
+	w.fs.client.Remove(w.File.Name())
+}
@@ -0,0 +1,398 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Random bytes of a share token
+const shareTokenBytes = 24
+
+// What a share ticket stands for, and how long it does
+const (
+	ShareTicketAccess   = "access"   // the password of a protected share
+	ShareTicketDownload = "download" // a counted download, which a client may resume with Ranges
+
+	shareAccessTTL   = time.Hour
+	shareDownloadTTL = 24 * time.Hour
+)
+
+// ShareAccess is what a visitor presents to open a share
+type ShareAccess struct {
+	Password string // the password of a protected share
+	Ticket   string // an access ticket in place of the password
+	Resume   bool   // the request resumes a download, which is checked against its ticket instead of the limit
+}
+
+// ShareOptions describes a share link to create
+type ShareOptions struct {
+	Path         string     `json:"path"`
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	ExpiresIn    int        `json:"expires_in"` // hours, when no expiry time is given
+	MaxDownloads int        `json:"max_downloads"`
+	Upload       bool       `json:"upload"` // a drop box, only for directories
+}
+
+// ShareEntry is a file of a shared directory as visitors see it, without owners or the
+// path on the server
+type ShareEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"` // relative to the shared directory
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// CreateShare creates a public link to a file or directory
+func (s *FileService) CreateShare(opts ShareOptions) (*models.FileShare, error) {
+	if opts.MaxDownloads < 0 || opts.ExpiresIn < 0 {
+		return nil, fmt.Errorf("%w: limits cannot be negative", ErrInvalidShare)
+	}
+	access := fileRead
+	if opts.Upload {
+		access = fileWrite
+	}
+	fullPath, err := s.checkPath(opts.Path, access)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Upload && !info.IsDir() {
+		return nil, fmt.Errorf("%w: only directories can take uploads", ErrInvalidShare)
+	}
+
+	expiresAt := opts.ExpiresAt
+	if expiresAt == nil && opts.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(opts.ExpiresIn) * time.Hour)
+		expiresAt = &t
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: the expiry is in the past", ErrInvalidShare)
+	}
+
+	token := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	share := &models.FileShare{
+		Token:        base64.RawURLEncoding.EncodeToString(token),
+		Path:         fullPath,
+		IsDir:        info.IsDir(),
+		Upload:       opts.Upload,
+		ExpiresAt:    expiresAt,
+		MaxDownloads: opts.MaxDownloads,
+		UserID:       s.userID,
+		Username:     s.username,
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		share.Password = string(hash)
+		share.Protected = true
+	}
+	if err := s.db.Create(share).Error; err != nil {
+		return nil, err
+	}
+	s.log.Info("File share created", "path", fullPath, "upload", share.Upload, "user", s.username)
+	return share, nil
+}
+
+// ListShares returns the share links of the paths the service can access, most recent first
+func (s *FileService) ListShares() ([]models.FileShare, error) {
+	var shares []models.FileShare
+	if err := s.db.Order("created_at DESC").Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	visible := make([]models.FileShare, 0, len(shares))
+	for _, share := range shares {
+		if _, err := s.checkPath(share.Path, fileRead); err == nil {
+			visible = append(visible, share)
+		}
+	}
+	return visible, nil
+}
+
+// DeleteShare revokes a share link
+func (s *FileService) DeleteShare(id string) error {
+	var share models.FileShare
+	if err := s.db.First(&share, "id = ?", id).Error; err != nil {
+		return ErrShareNotFound
+	}
+	if _, err := s.checkPath(share.Path, fileRead); err != nil {
+		return ErrShareNotFound
+	}
+	if err := s.db.Unscoped().Delete(&share).Error; err != nil {
+		return err
+	}
+	s.log.Info("File share deleted", "path", share.Path, "user", s.username)
+	return nil
+}
+
+// OpenShare returns the share of a token for a visitor, and the file service of its
+// creator the visitor is kept to. Expired and used up links are reported as such, a
+// protected link needs its password or an access ticket.
+func (s *FileService) OpenShare(token string, access ShareAccess) (*models.FileShare, *FileService, error) {
+	var share models.FileShare
+	if token == "" || s.db.Where("token = ?", token).Limit(1).Find(&share).RowsAffected == 0 {
+		return nil, nil, ErrShareNotFound
+	}
+	if share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt) {
+		return &share, nil, ErrShareExpired
+	}
+	if !share.Upload && !access.Resume && share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		return &share, nil, fmt.Errorf("%w: the download limit is reached", ErrShareExpired)
+	}
+	if share.Protected && !s.CheckShareTicket(&share, ShareTicketAccess, "", access.Ticket) &&
+		(access.Password == "" || bcrypt.CompareHashAndPassword([]byte(share.Password), []byte(access.Password)) != nil) {
+		return &share, nil, ErrSharePassword
+	}
+
+	// The path may have been removed, or left the jail of the creator since the link was
+	// created
+	owner, err := s.ShareOwner(&share)
+	if err != nil {
+		return &share, nil, err
+	}
+	if _, err := owner.checkPath(share.Path, fileRead); err != nil {
+		return &share, nil, ErrShareNotFound
+	}
+	if _, err := os.Stat(share.Path); err != nil {
+		return &share, nil, ErrShareNotFound
+	}
+	return &share, owner, nil
+}
+
+// ShareOwner returns the file service as seen by the creator of a share
+func (s *FileService) ShareOwner(share *models.FileShare) (*FileService, error) {
+	if share.UserID == "" {
+		return s, nil
+	}
+	var user models.User
+	if s.db.Where("id = ?", share.UserID).Limit(1).Find(&user).RowsAffected == 0 {
+		return nil, ErrShareNotFound
+	}
+	owner, err := s.ForUser(user.ID, user.Username, user.Role)
+	if err != nil {
+		return nil, ErrShareNotFound
+	}
+	return owner, nil
+}
+
+// ShareTicket signs a ticket standing for kind, for a visitor of a share. A download
+// ticket is for the file at path. The ticket and when it expires are returned.
+func (s *FileService) ShareTicket(share *models.FileShare, kind, path string) (string, time.Time) {
+	ttl := shareAccessTTL
+	if kind == ShareTicketDownload {
+		ttl = shareDownloadTTL
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	return strconv.FormatInt(expires.Unix(), 10) + "." + s.shareTicketMAC(share, kind, path, expires.Unix()), expires
+}
+
+// CheckShareTicket reports whether a ticket of a share stands for kind and is current
+func (s *FileService) CheckShareTicket(share *models.FileShare, kind, path, ticket string) bool {
+	expiry, mac, ok := strings.Cut(ticket, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(s.shareTicketMAC(share, kind, path, unix)))
+}
+
+// shareTicketMAC signs a ticket, a new password of the share voids its tickets
+func (s *FileService) shareTicketMAC(share *models.FileShare, kind, path string, expires int64) string {
+	mac := hmac.New(sha256.New, s.shareKey)
+	for _, field := range []string{kind, share.ID, share.Password, path, strconv.FormatInt(expires, 10)} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ShareFile resolves a path below a shared directory, or the shared file for an empty
+// path. Links leading out of the share are not followed.
+func (s *FileService) ShareFile(share *models.FileShare, path string) (string, os.FileInfo, error) {
+	if share.Upload {
+		return "", nil, fmt.Errorf("%w: the share only takes uploads", ErrPathNotAllowed)
+	}
+	root, err := realPath(share.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	fullPath := root
+	if share.IsDir {
+		fullPath = filepath.Join(root, filepath.Clean("/"+path))
+	} else if path != "" && path != "/" {
+		return "", nil, os.ErrNotExist
+	}
+
+	resolved, err := s.checkPath(fullPath, fileRead)
+	if err != nil {
+		return "", nil, err
+	}
+	if !pathWithin(resolved, root) {
+		return "", nil, ErrPathNotAllowed
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", nil, err
+	}
+	return resolved, info, nil
+}
+
+// ListShareDir lists a directory below a shared directory
+func (s *FileService) ListShareDir(share *models.FileShare, path string) ([]ShareEntry, error) {
+	fullPath, info, err := s.ShareFile(share, path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%w: not a directory", ErrInvalidShare)
+	}
+	root, _ := realPath(share.Path)
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]ShareEntry, 0, len(entries))
+	for _, entry := range entries {
+		path := filepath.Join(fullPath, entry.Name())
+		if s.jail.check(path, false) != nil {
+			continue
+		}
+		// Links are listed as what they lead to, unless it is outside the share
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if entry.Type()&os.ModeSymlink != 0 {
+			if target, err := realPath(path); err != nil || !pathWithin(target, root) {
+				continue
+			}
+		}
+		rel, _ := filepath.Rel(root, path)
+		files = append(files, ShareEntry{
+			Name:    entry.Name(),
+			Path:    filepath.ToSlash(rel),
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].IsDir != files[j].IsDir {
+			return files[i].IsDir
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// CountShareDownload counts a download of a share, failing when its limit is reached
+func (s *FileService) CountShareDownload(share *models.FileShare) error {
+	result := s.db.Model(&models.FileShare{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", share.ID).
+		UpdateColumn("downloads", gorm.Expr("downloads + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: the download limit is reached", ErrShareExpired)
+	}
+	share.Downloads++
+	return nil
+}
+
+// ShareUpload saves a file a visitor drops into an upload share. Existing files are
+// never replaced, the upload is renamed instead. The path of the saved file relative to
+// the share is returned.
+func (s *FileService) ShareUpload(share *models.FileShare, name string, r io.Reader) (string, error) {
+	if !share.Upload {
+		return "", fmt.Errorf("%w: the share does not take uploads", ErrPathNotAllowed)
+	}
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == ".." || name == "/" || strings.HasPrefix(name, filePartPrefix) {
+		return "", fmt.Errorf("%w: invalid file name", ErrInvalidShare)
+	}
+
+	dir, err := s.checkPath(share.Path, fileWrite)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, filePartPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	// A hard link fails instead of replacing a file that appeared meanwhile
+	path := filepath.Join(dir, name)
+	for {
+		if err := s.jail.check(path, true); err != nil {
+			return "", err
+		}
+		err := os.Link(tmp.Name(), path)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		path = freePath(path, false)
+	}
+
+	s.db.Model(&models.FileShare{}).Where("id = ?", share.ID).UpdateColumn("uploads", gorm.Expr("uploads + 1"))
+	share.Uploads++
+	return filepath.Base(path), nil
+}
+
+// ShareMaxUpload returns the bytes a file dropped into an upload share may have, 0 for
+// no limit
+func (s *FileService) ShareMaxUpload() int64 {
+	return s.config.Files.ShareMaxUpload * 1024 * 1024
+}
+
+// Errors
+var (
+	ErrShareNotFound = errors.New("share not found")
+	ErrShareExpired  = errors.New("share has expired")
+	ErrSharePassword = errors.New("wrong or missing share password")
+	ErrInvalidShare  = errors.New("invalid share")
+)
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+func TestOpenSharePassword(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	share, err := fs.CreateShare(ShareOptions{Path: filepath.Join(root, "a.txt"), Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := fs.CreateShare(ShareOptions{Path: filepath.Join(root, "a.txt"), Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticket, expires := fs.ShareTicket(share, ShareTicketAccess, "")
+	if until := time.Until(expires); until <= 0 || until > shareAccessTTL {
+		t.Errorf("access ticket expires in %v, want at most %v", until, shareAccessTTL)
+	}
+	otherTicket, _ := fs.ShareTicket(other, ShareTicketAccess, "")
+	downloadTicket, _ := fs.ShareTicket(share, ShareTicketDownload, "")
+	expiry, mac, _ := strings.Cut(ticket, ".")
+	expired := "1000000000." + mac
+
+	tests := []struct {
+		name    string
+		access  ShareAccess
+		wantErr error
+	}{
+		{"no password", ShareAccess{}, ErrSharePassword},
+		{"wrong password", ShareAccess{Password: "guess"}, ErrSharePassword},
+		{"password", ShareAccess{Password: "secret"}, nil},
+		{"ticket", ShareAccess{Ticket: ticket}, nil},
+		{"ticket and wrong password", ShareAccess{Ticket: ticket, Password: "guess"}, nil},
+		{"ticket of another share", ShareAccess{Ticket: otherTicket}, ErrSharePassword},
+		{"download ticket", ShareAccess{Ticket: downloadTicket}, ErrSharePassword},
+		{"expired ticket", ShareAccess{Ticket: expired}, ErrSharePassword},
+		{"later expiry", ShareAccess{Ticket: expiry + "0." + mac}, ErrSharePassword},
+		{"forged ticket", ShareAccess{Ticket: expiry + ".AAAA"}, ErrSharePassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, owner, err := fs.OpenShare(share.Token, tt.access)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("OpenShare() error = %v, want %v", err, tt.wantErr)
+			}
+			if got == nil || got.ID != share.ID {
+				t.Errorf("OpenShare() = %v, want the share", got)
+			}
+			if (owner != nil) != (tt.wantErr == nil) {
+				t.Errorf("OpenShare() owner = %v", owner)
+			}
+		})
+	}
+
+	// A new key, as after a restart, voids the tickets
+	restarted := *fs
+	restarted.shareKey = []byte("other key")
+	if _, _, err := restarted.OpenShare(share.Token, ShareAccess{Ticket: ticket}); !errors.Is(err, ErrSharePassword) {
+		t.Errorf("OpenShare() with a ticket of another key error = %v, want ErrSharePassword", err)
+	}
+}
+
+func TestShareLimits(t *testing.T) {
+	fs, root := newTestFileService(t)
+	path := filepath.Join(root, "a.txt")
+	os.WriteFile(path, []byte("a"), 0644)
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		opts    ShareOptions
+		expire  *time.Time
+		counts  int // downloads counted before the share is opened
+		access  ShareAccess
+		wantErr error
+	}{
+		{"unlimited", ShareOptions{}, nil, 5, ShareAccess{}, nil},
+		{"below the limit", ShareOptions{MaxDownloads: 2}, nil, 1, ShareAccess{}, nil},
+		{"limit reached", ShareOptions{MaxDownloads: 2}, nil, 2, ShareAccess{}, ErrShareExpired},
+		{"resumed at the limit", ShareOptions{MaxDownloads: 2}, nil, 2, ShareAccess{Resume: true}, nil},
+		{"expired", ShareOptions{}, &past, 0, ShareAccess{}, ErrShareExpired},
+		{"expired and resumed", ShareOptions{}, &past, 0, ShareAccess{Resume: true}, ErrShareExpired},
+		{"upload share past the limit", ShareOptions{Path: root, Upload: true, MaxDownloads: 1}, nil, 1, ShareAccess{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opts.Path == "" {
+				tt.opts.Path = path
+			}
+			share, err := fs.CreateShare(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expire != nil {
+				fs.db.Model(share).UpdateColumn("expires_at", tt.expire)
+			}
+			for i := 0; i < tt.counts; i++ {
+				if err := fs.CountShareDownload(share); err != nil {
+					t.Fatalf("CountShareDownload() %d error = %v", i+1, err)
+				}
+			}
+			if _, _, err := fs.OpenShare(share.Token, tt.access); !errors.Is(err, tt.wantErr) {
+				t.Errorf("OpenShare() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCountShareDownload(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	share, err := fs.CreateShare(ShareOptions{Path: filepath.Join(root, "a.txt"), MaxDownloads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A stale copy of the share, as held by a request that opened it earlier
+	stale := *share
+
+	for i, wantErr := range []error{nil, nil, ErrShareExpired} {
+		if err := fs.CountShareDownload(share); !errors.Is(err, wantErr) {
+			t.Fatalf("download %d: error = %v, want %v", i+1, err, wantErr)
+		}
+	}
+	if err := fs.CountShareDownload(&stale); !errors.Is(err, ErrShareExpired) {
+		t.Errorf("download with a stale share error = %v, want ErrShareExpired", err)
+	}
+	var got models.FileShare
+	fs.db.First(&got, "id = ?", share.ID)
+	if got.Downloads != 2 {
+		t.Errorf("downloads = %d, want 2", got.Downloads)
+	}
+}
+
+func TestShareOwnerJail(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.MkdirAll(filepath.Join(root, "alice", "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "alice", "docs", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "secret.txt"), []byte("s"), 0644)
+
+	alice := &models.User{Username: "alice", Email: "alice@example.com", Password: "x", Role: "user"}
+	if err := fs.db.Create(alice).Error; err != nil {
+		t.Fatal(err)
+	}
+	jail := &models.FileJail{UserID: alice.ID, Roots: models.FileRoots{{Path: filepath.Join(root, "alice")}}}
+	if err := fs.CreateJail(jail); err != nil {
+		t.Fatal(err)
+	}
+	jailed, err := fs.ForUser(alice.ID, alice.Username, alice.Role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := jailed.CreateShare(ShareOptions{Path: filepath.Join(root, "alice", "docs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(root, "alice", "docs", "link"))
+
+	_, owner, err := fs.OpenShare(share.Token, ShareAccess{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		wantErr error
+	}{
+		{"a.txt", nil},
+		{"../../secret.txt", os.ErrNotExist},
+		{"link", ErrPathNotAllowed},
+	}
+	for _, tt := range tests {
+		if _, _, err := owner.ShareFile(share, tt.path); !errors.Is(err, tt.wantErr) {
+			t.Errorf("ShareFile(%q) error = %v, want %v", tt.path, err, tt.wantErr)
+		}
+	}
+
+	// The share is closed once it is outside the creator's jail
+	jail.Roots = models.FileRoots{{Path: filepath.Join(root, "alice", "other")}}
+	os.MkdirAll(filepath.Join(root, "alice", "other"), 0755)
+	if err := fs.UpdateJail(jail.ID, jail); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fs.OpenShare(share.Token, ShareAccess{}); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("OpenShare() outside the creator's jail error = %v, want ErrShareNotFound", err)
+	}
+
+	// And when the creator is gone
+	fs.db.Delete(&models.FileJail{}, "id = ?", jail.ID)
+	fs.db.Unscoped().Delete(alice)
+	if _, _, err := fs.OpenShare(share.Token, ShareAccess{}); !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("OpenShare() of a deleted user error = %v, want ErrShareNotFound", err)
+	}
+}
+
+func TestShareUpload(t *testing.T) {
+	fs, root := newTestFileService(t)
+	os.MkdirAll(filepath.Join(root, "drop"), 0755)
+	os.WriteFile(filepath.Join(root, "drop", "a.txt"), []byte("old"), 0644)
+	share, err := fs.CreateShare(ShareOptions{Path: filepath.Join(root, "drop"), Upload: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"b.txt", "b.txt", nil},
+		{"a.txt", "a (1).txt", nil},
+		{"../../escape.txt", "escape.txt", nil},
+		{`..\evil.txt`, "evil.txt", nil},
+		{"..", "", ErrInvalidShare},
+		{"a/..", "", ErrInvalidShare},
+		{filePartPrefix + "x", "", ErrInvalidShare},
+	}
+	for _, tt := range tests {
+		got, err := fs.ShareUpload(share, tt.name, strings.NewReader("new"))
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("ShareUpload(%q) = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "drop", "a.txt")); string(data) != "old" {
+		t.Errorf("existing file = %q, want it kept", data)
+	}
+	if _, _, err := fs.ShareFile(share, "a.txt"); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("ShareFile() of an upload share error = %v, want ErrPathNotAllowed", err)
+	}
+}
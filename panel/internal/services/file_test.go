@@ -0,0 +1,57 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/logger"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: gormlogger.Default.LogMode(gormlogger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a database of its own
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(
+		&models.User{},
+		&models.FileUpload{},
+		&models.FileTrash{},
+		&models.FileVersion{},
+		&models.FileJail{},
+		&models.FileShare{},
+		&models.FileLocation{},
+	); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestFileService returns a file service whose only root is a temporary directory,
+// configure changes the file manager configuration before the service is created
+func newTestFileService(t *testing.T, configure ...func(*config.FilesConfig)) (*FileService, string) {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.Files.Roots = []config.FileRootConfig{{Path: root}}
+	for _, f := range configure {
+		f(&cfg.Files)
+	}
+	return NewFileService(openTestDB(t), cfg, logger.New(logger.Config{Level: "error"})), root
+}
@@ -0,0 +1,369 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// Part files of uploads are hidden next to their destination
+const filePartPrefix = ".vpanel-upload-"
+
+// Algorithms of the chunk checksums, sent as "<algorithm> <base64 digest>" like tus
+var uploadChecksums = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// CreateUpload starts a resumable upload of size bytes to path. checksum is the
+// optional sha256 hex digest of the whole file, checked when the last chunk arrives.
+func (s *FileService) CreateUpload(userID, path string, size int64, checksum string, overwrite bool) (*models.FileUpload, error) {
+	s.expireUploads()
+
+	fullPath, err := s.checkPath(path, fileWrite)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: negative size", ErrInvalidUpload)
+	}
+	checksum = strings.ToLower(checksum)
+	if checksum != "" {
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%w: the checksum must be a sha256 hex digest", ErrInvalidUpload)
+		}
+	}
+	if info, err := os.Stat(fullPath); err == nil {
+		if info.IsDir() {
+			return nil, ErrIsDirectory
+		}
+		if !overwrite {
+			return nil, ErrFileExists
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, err
+	}
+
+	state, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	upload := &models.FileUpload{
+		UserID:    userID,
+		Path:      fullPath,
+		Size:      size,
+		Checksum:  checksum,
+		HashState: state,
+		Overwrite: overwrite,
+		ExpiresAt: s.uploadExpiry(),
+	}
+	if err := s.db.Create(upload).Error; err != nil {
+		return nil, err
+	}
+
+	part, err := os.OpenFile(uploadPartPath(upload), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		s.db.Unscoped().Delete(upload)
+		return nil, err
+	}
+	part.Close()
+
+	if size == 0 {
+		if err := s.completeUpload(upload, sha256.New()); err != nil {
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// GetUpload returns an unfinished upload of the user the service acts for
+func (s *FileService) GetUpload(id string) (*models.FileUpload, error) {
+	query := s.db.Where("id = ?", id)
+	if s.userID != "" {
+		query = query.Where("user_id = ?", s.userID)
+	}
+	var upload models.FileUpload
+	if err := query.First(&upload).Error; err != nil {
+		return nil, ErrUploadNotFound
+	}
+	// Uploads outside the jail are not there for its users
+	if _, err := s.checkPath(upload.Path, fileRead); err != nil {
+		return nil, ErrUploadNotFound
+	}
+	return &upload, nil
+}
+
+// ListUploads returns the unfinished uploads of a user, or of everyone when userID is empty
+func (s *FileService) ListUploads(userID string) ([]models.FileUpload, error) {
+	s.expireUploads()
+
+	var uploads []models.FileUpload
+	query := s.db.Order("created_at DESC")
+	if userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if err := query.Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// WriteUploadChunk appends a chunk to an upload. offset must be the bytes received so
+// far, checksum is the optional "<algorithm> <base64 digest>" of the chunk. A chunk
+// that fails is discarded whole so the upload resumes from the same offset. The upload
+// is moved into place with the last chunk.
+func (s *FileService) WriteUploadChunk(id string, offset int64, r io.Reader, checksum string) (*models.FileUpload, error) {
+	lock := s.uploadLock(id)
+	if !lock.TryLock() {
+		return nil, ErrUploadBusy
+	}
+	defer lock.Unlock()
+
+	upload, err := s.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.checkPath(upload.Path, fileWrite); err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("%w: expected offset %d", ErrUploadOffset, upload.Offset)
+	}
+
+	var chunkHash hash.Hash
+	var expected []byte
+	if checksum != "" {
+		algorithm, digest, _ := strings.Cut(checksum, " ")
+		newHash, ok := uploadChecksums[strings.ToLower(algorithm)]
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported checksum algorithm %q", ErrInvalidUpload, algorithm)
+		}
+		if expected, err = base64.StdEncoding.DecodeString(digest); err != nil {
+			return nil, fmt.Errorf("%w: the checksum must be base64", ErrInvalidUpload)
+		}
+		chunkHash = newHash()
+	}
+
+	whole := sha256.New()
+	if err := whole.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState); err != nil {
+		return nil, err
+	}
+
+	part, err := os.OpenFile(uploadPartPath(upload), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	// Drop what a failed chunk may have left behind
+	if err := part.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	writers := []io.Writer{part, whole}
+	if chunkHash != nil {
+		writers = append(writers, chunkHash)
+	}
+	remaining := upload.Size - offset
+	n, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(r, remaining+1))
+	switch {
+	case err != nil:
+	case n > remaining:
+		err = fmt.Errorf("%w: the upload is %d bytes", ErrUploadTooLarge, upload.Size)
+	case chunkHash != nil && !bytes.Equal(chunkHash.Sum(nil), expected):
+		err = ErrChecksumMismatch
+	}
+	if err != nil {
+		part.Truncate(offset)
+		return upload, err
+	}
+
+	state, err := whole.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset += n
+	upload.HashState = state
+	upload.ExpiresAt = s.uploadExpiry()
+
+	if upload.Offset == upload.Size {
+		if err := part.Sync(); err != nil {
+			return nil, err
+		}
+		if err := s.completeUpload(upload, whole); err != nil {
+			return upload, err
+		}
+		return upload, nil
+	}
+	if err := s.db.Save(upload).Error; err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// CancelUpload drops an unfinished upload and its part file
+func (s *FileService) CancelUpload(id string) error {
+	lock := s.uploadLock(id)
+	if !lock.TryLock() {
+		return ErrUploadBusy
+	}
+	defer lock.Unlock()
+
+	upload, err := s.GetUpload(id)
+	if err != nil {
+		return err
+	}
+	s.removeUpload(upload)
+	return nil
+}
+
+// SaveFile writes a stream to path, the file is replaced only once it is complete
+func (s *FileService) SaveFile(path string, r io.Reader) error {
+	backend, fullPath, err := s.locate(path, fileWrite)
+	if err != nil {
+		return err
+	}
+	if err := backend.MkdirAll(filepath.Dir(fullPath)); err != nil {
+		return err
+	}
+
+	w, err := backend.Create(fullPath, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// OpenFile opens a regular file for streaming
+func (s *FileService) OpenFile(path string) (io.ReadSeekCloser, os.FileInfo, error) {
+	backend, fullPath, err := s.locate(path, fileRead)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := backend.Stat(fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, ErrIsDirectory
+	}
+	f, err := backend.Open(fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// WriteArchive streams files and directories to w as an archive of format, see
+// ArchiveOptions
+func (s *FileService) WriteArchive(ctx context.Context, w io.Writer, paths []string, format string) error {
+	sources := make([]string, 0, len(paths))
+	for _, path := range paths {
+		fullPath, err := s.checkPath(path, fileRead)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(fullPath); err != nil {
+			return err
+		}
+		sources = append(sources, fullPath)
+	}
+	return s.writeArchive(ctx, w, sources, ArchiveOptions{Format: format}, "", nil)
+}
+
+// completeUpload checks the whole file checksum and moves the part file into place
+func (s *FileService) completeUpload(upload *models.FileUpload, whole hash.Hash) error {
+	if upload.Checksum != "" && hex.EncodeToString(whole.Sum(nil)) != upload.Checksum {
+		s.removeUpload(upload)
+		return fmt.Errorf("%w: the file does not match its checksum", ErrChecksumMismatch)
+	}
+	if _, err := os.Stat(upload.Path); err == nil && !upload.Overwrite {
+		s.db.Save(upload)
+		return ErrFileExists
+	}
+	if err := os.Rename(uploadPartPath(upload), upload.Path); err != nil {
+		s.db.Save(upload)
+		return err
+	}
+
+	s.db.Unscoped().Delete(upload)
+	s.uploadLocks.Delete(upload.ID)
+	s.log.Info("File uploaded", "path", upload.Path, "size", upload.Size)
+	return nil
+}
+
+// expireUploads drops the uploads that were not resumed in time
+func (s *FileService) expireUploads() {
+	var uploads []models.FileUpload
+	if err := s.db.Where("expires_at < ?", time.Now()).Find(&uploads).Error; err != nil {
+		return
+	}
+	for i := range uploads {
+		lock := s.uploadLock(uploads[i].ID)
+		if lock.TryLock() {
+			s.removeUpload(&uploads[i])
+			lock.Unlock()
+		}
+	}
+}
+
+func (s *FileService) removeUpload(upload *models.FileUpload) {
+	os.Remove(uploadPartPath(upload))
+	s.db.Unscoped().Delete(upload)
+	s.uploadLocks.Delete(upload.ID)
+}
+
+// uploadLock returns the lock that serializes the chunks of an upload
+func (s *FileService) uploadLock(id string) *sync.Mutex {
+	lock, _ := s.uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+func (s *FileService) uploadExpiry() time.Time {
+	hours := s.config.Storage.UploadExpiry
+	if hours <= 0 {
+		hours = 24
+	}
+	return time.Now().Add(time.Duration(hours) * time.Hour)
+}
+
+func uploadPartPath(upload *models.FileUpload) string {
+	return filepath.Join(filepath.Dir(upload.Path), filePartPrefix+upload.ID)
+}
+
+// Errors
+var (
+	ErrFileExists       = errors.New("file already exists")
+	ErrInvalidUpload    = errors.New("invalid upload")
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadBusy       = errors.New("a chunk of the upload is being written")
+	ErrUploadOffset     = errors.New("upload offset mismatch")
+	ErrUploadTooLarge   = errors.New("chunk exceeds the upload size")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadOwnership(t *testing.T) {
+	fs, root := newTestFileService(t)
+	alice, err := fs.ForUser("alice", "alice", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := fs.ForUser("bob", "bob", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := alice.CreateUpload("alice", filepath.Join(root, "a.txt"), 5, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		fs      *FileService
+		wantErr error
+	}{
+		{"owner", alice, nil},
+		{"other user", bob, ErrUploadNotFound},
+		{"system service", fs, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.fs.GetUpload(upload.ID); !errors.Is(err, tt.wantErr) {
+				t.Errorf("GetUpload() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := bob.WriteUploadChunk(upload.ID, 0, strings.NewReader("hello"), ""); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("WriteUploadChunk() by another user error = %v, want ErrUploadNotFound", err)
+	}
+	if err := bob.CancelUpload(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("CancelUpload() by another user error = %v, want ErrUploadNotFound", err)
+	}
+
+	if _, err := alice.WriteUploadChunk(upload.ID, 0, strings.NewReader("hello"), ""); err != nil {
+		t.Fatalf("WriteUploadChunk() by the owner error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "a.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("uploaded file = %q, %v, want %q", data, err, "hello")
+	}
+}
+
+func TestWriteUploadChunk(t *testing.T) {
+	fs, root := newTestFileService(t)
+	upload, err := fs.CreateUpload("alice", filepath.Join(root, "b.txt"), 6, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		offset     int64
+		chunk      string
+		wantErr    error
+		wantOffset int64
+	}{
+		{"first chunk", 0, "abc", nil, 3},
+		{"wrong offset", 0, "abc", ErrUploadOffset, 3},
+		{"too large", 3, "defg", ErrUploadTooLarge, 3},
+		{"last chunk", 3, "def", nil, 6},
+	}
+	for _, tt := range tests {
+		got, err := fs.WriteUploadChunk(upload.ID, tt.offset, strings.NewReader(tt.chunk), "")
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: WriteUploadChunk() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if got.Offset != tt.wantOffset {
+			t.Fatalf("%s: offset = %d, want %d", tt.name, got.Offset, tt.wantOffset)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "b.txt")); err != nil || string(data) != "abcdef" {
+		t.Errorf("uploaded file = %q, %v, want %q", data, err, "abcdef")
+	}
+}
@@ -0,0 +1,449 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// How a restore handles an existing file at its destination
+const (
+	TrashConflictFail      = "fail"
+	TrashConflictRename    = "rename"    // restore next to it as "name (1).ext"
+	TrashConflictOverwrite = "overwrite" // move the existing file to the trash first
+)
+
+// How often expired trash is purged in the background
+const trashSweepInterval = time.Hour
+
+// Trash moves a file or directory to the trash. It is deleted permanently when the
+// trash is turned off, in which case no item is returned.
+func (s *FileService) Trash(path string) (*models.FileTrash, error) {
+	dir, err := s.trashDir()
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return nil, s.Delete(path)
+	}
+
+	fullPath, err := s.checkPath(path, fileWrite|fileNoFollow)
+	if err != nil {
+		return nil, err
+	}
+	if fullPath == "/" || s.isRoot(fullPath) {
+		return nil, ErrPathNotAllowed
+	}
+	if pathWithin(fullPath, dir) || pathWithin(dir, fullPath) {
+		return nil, fmt.Errorf("%w: the path is or contains the trash", ErrPathNotAllowed)
+	}
+
+	s.trashLock.Lock()
+	defer s.trashLock.Unlock()
+
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	size, err := treeSize(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if max := s.trashMaxSize(); max > 0 && size > max {
+		return nil, fmt.Errorf("%w: %d bytes do not fit in the trash, delete permanently instead", ErrTrashTooLarge, size)
+	}
+
+	item := &models.FileTrash{
+		Path:     fullPath,
+		Name:     info.Name(),
+		IsDir:    info.IsDir(),
+		Size:     size,
+		UserID:   s.userID,
+		Username: s.username,
+	}
+	if err := s.db.Create(item).Error; err != nil {
+		return nil, err
+	}
+	if err := moveTree(fullPath, filepath.Join(dir, item.ID)); err != nil {
+		s.db.Unscoped().Delete(item)
+		return nil, err
+	}
+	s.log.Info("File moved to trash", "path", fullPath, "size", size, "user", s.username)
+
+	s.expireTrash(dir)
+	return item, nil
+}
+
+// ListTrash returns the trashed items the service can access, most recent first
+func (s *FileService) ListTrash() ([]models.FileTrash, error) {
+	dir, err := s.trashDir()
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		s.trashLock.Lock()
+		s.expireTrash(dir)
+		s.trashLock.Unlock()
+	}
+
+	var items []models.FileTrash
+	if err := s.db.Order("created_at DESC").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	visible := make([]models.FileTrash, 0, len(items))
+	for _, item := range items {
+		if _, err := s.checkPath(item.Path, fileRead); err == nil {
+			visible = append(visible, item)
+		}
+	}
+	return visible, nil
+}
+
+// GetTrash returns a trashed item
+func (s *FileService) GetTrash(id string) (*models.FileTrash, error) {
+	var item models.FileTrash
+	if err := s.db.First(&item, "id = ?", id).Error; err != nil {
+		return nil, ErrTrashNotFound
+	}
+	// Items deleted outside the jail are not there for its users
+	if _, err := s.checkPath(item.Path, fileRead); err != nil {
+		return nil, ErrTrashNotFound
+	}
+	return &item, nil
+}
+
+// RestoreTrash moves a trashed item back to where it was deleted from, or to path when
+// given. conflict says what happens when the destination exists. The path the item was
+// restored to is returned.
+func (s *FileService) RestoreTrash(id, path, conflict string) (string, error) {
+	switch conflict {
+	case "":
+		conflict = TrashConflictFail
+	case TrashConflictFail, TrashConflictRename, TrashConflictOverwrite:
+	default:
+		return "", fmt.Errorf("%w: unknown conflict handling %q", ErrInvalidTrashRestore, conflict)
+	}
+
+	dir, err := s.trashDir()
+	if err != nil {
+		return "", err
+	}
+	item, err := s.GetTrash(id)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		path = item.Path
+	}
+	fullPath, err := s.checkPath(path, fileWrite|fileNoFollow)
+	if err != nil {
+		return "", err
+	}
+	if fullPath == "/" || pathWithin(fullPath, dir) {
+		return "", ErrPathNotAllowed
+	}
+
+	if _, err := os.Lstat(fullPath); err == nil {
+		switch conflict {
+		case TrashConflictFail:
+			return "", fmt.Errorf("%w: %s", ErrFileExists, fullPath)
+		case TrashConflictRename:
+			fullPath = freePath(fullPath, item.IsDir)
+			if err := s.jail.check(fullPath, true); err != nil {
+				return "", err
+			}
+		case TrashConflictOverwrite:
+			if _, err := s.Trash(fullPath); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	s.trashLock.Lock()
+	defer s.trashLock.Unlock()
+
+	// The item may have been restored or purged meanwhile
+	if err := s.db.First(&models.FileTrash{}, "id = ?", item.ID).Error; err != nil {
+		return "", ErrTrashNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", err
+	}
+	if err := moveTree(filepath.Join(dir, item.ID), fullPath); err != nil {
+		return "", err
+	}
+	s.db.Unscoped().Delete(item)
+	s.log.Info("File restored from trash", "path", fullPath, "user", s.username)
+	return fullPath, nil
+}
+
+// PurgeTrash deletes a trashed item permanently
+func (s *FileService) PurgeTrash(id string) error {
+	dir, err := s.trashDir()
+	if err != nil {
+		return err
+	}
+	item, err := s.GetTrash(id)
+	if err != nil {
+		return err
+	}
+	if _, err := s.checkPath(item.Path, fileWrite|fileNoFollow); err != nil {
+		return err
+	}
+
+	s.trashLock.Lock()
+	defer s.trashLock.Unlock()
+	return s.purgeTrash(dir, item)
+}
+
+// EmptyTrash deletes every trashed item the service can write permanently and returns
+// how many were deleted
+func (s *FileService) EmptyTrash() (int, error) {
+	dir, err := s.trashDir()
+	if err != nil {
+		return 0, err
+	}
+	items, err := s.ListTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	s.trashLock.Lock()
+	defer s.trashLock.Unlock()
+
+	purged := 0
+	for i := range items {
+		if _, err := s.checkPath(items[i].Path, fileWrite|fileNoFollow); err != nil {
+			continue
+		}
+		if err := s.purgeTrash(dir, &items[i]); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// trashLoop periodically purges expired trash, which is otherwise only purged when the
+// trash is listed or written to
+func (s *FileService) trashLoop() {
+	files := s.config.Files
+	if files.TrashDir == "" || (files.TrashMaxAge <= 0 && files.TrashMaxSize <= 0) {
+		return
+	}
+	ticker := time.NewTicker(trashSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		s.sweepTrash()
+		<-ticker.C
+	}
+}
+
+// sweepTrash purges the trash items past their age or over the quota
+func (s *FileService) sweepTrash() {
+	dir, err := s.trashDir()
+	if err != nil {
+		s.log.Error("Failed to open the trash", "error", err)
+		return
+	}
+	if dir == "" {
+		return
+	}
+	s.trashLock.Lock()
+	defer s.trashLock.Unlock()
+	s.expireTrash(dir)
+}
+
+// expireTrash purges the items older than the maximum age, then the oldest items until
+// the trash fits its quota. The trash lock must be held.
+func (s *FileService) expireTrash(dir string) {
+	if days := s.config.Files.TrashMaxAge; days > 0 {
+		var expired []models.FileTrash
+		cutoff := time.Now().AddDate(0, 0, -days)
+		if err := s.db.Where("created_at < ?", cutoff).Find(&expired).Error; err == nil {
+			for i := range expired {
+				s.purgeTrash(dir, &expired[i])
+			}
+		}
+	}
+
+	max := s.trashMaxSize()
+	if max <= 0 {
+		return
+	}
+	var items []models.FileTrash
+	if err := s.db.Order("created_at DESC").Find(&items).Error; err != nil {
+		return
+	}
+	var total int64
+	for i := range items {
+		total += items[i].Size
+		if total > max && s.purgeTrash(dir, &items[i]) == nil {
+			total -= items[i].Size
+		}
+	}
+}
+
+func (s *FileService) purgeTrash(dir string, item *models.FileTrash) error {
+	if err := os.RemoveAll(filepath.Join(dir, item.ID)); err != nil {
+		return err
+	}
+	if err := s.db.Unscoped().Delete(item).Error; err != nil {
+		return err
+	}
+	s.log.Info("File purged from trash", "path", item.Path, "size", item.Size)
+	return nil
+}
+
+// trashDir returns the absolute trash directory, empty when the trash is off
+func (s *FileService) trashDir() (string, error) {
+	if s.config.Files.TrashDir == "" {
+		return "", nil
+	}
+	dir, err := filepath.Abs(s.config.Files.TrashDir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return realPath(dir)
+}
+
+func (s *FileService) trashMaxSize() int64 {
+	return s.config.Files.TrashMaxSize * 1024 * 1024
+}
+
+// treeSize returns the bytes of the regular files of a tree, links are not followed
+func treeSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// moveTree renames src to dst, across filesystems the tree is copied and then removed
+func moveTree(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies a tree keeping links, modes, owners and times. Sockets, pipes and
+// devices are left out.
+func copyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+	case info.IsDir():
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode().IsRegular():
+		if err := copyRegular(src, dst); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func copyRegular(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// freePath returns the first "name (n).ext" next to path that does not exist
+func freePath(path string, isDir bool) string {
+	dir, name := filepath.Split(path)
+	ext := ""
+	if !isDir {
+		ext = filepath.Ext(name)
+		// Keep .tar.gz and the like together
+		if inner := filepath.Ext(strings.TrimSuffix(name, ext)); inner == ".tar" {
+			ext = inner + ext
+		}
+		if ext == name {
+			ext = ""
+		}
+	}
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// Errors
+var (
+	ErrTrashNotFound       = errors.New("trash item not found")
+	ErrTrashTooLarge       = errors.New("too large for the trash")
+	ErrInvalidTrashRestore = errors.New("invalid trash restore")
+)
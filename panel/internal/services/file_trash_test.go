@@ -0,0 +1,124 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+)
+
+// newTestTrash returns a file service with a trash without limits, and its root and trash
+func newTestTrash(t *testing.T) (*FileService, string, string) {
+	t.Helper()
+	trash := t.TempDir()
+	fs, root := newTestFileService(t, func(cfg *config.FilesConfig) { cfg.TrashDir = trash })
+	return fs, root, trash
+}
+
+// trashFile writes a file of size bytes and moves it to the trash age ago
+func trashFile(t *testing.T, fs *FileService, path string, size int, age time.Duration) *models.FileTrash {
+	t.Helper()
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	item, err := fs.Trash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.CreatedAt = time.Now().Add(-age)
+	if err := fs.db.Model(item).UpdateColumn("created_at", item.CreatedAt).Error; err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestSweepTrash(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name    string
+		maxAge  int
+		maxSize int64
+		items   []time.Duration // ages of 1MB items
+		kept    int             // most recent items left
+	}{
+		{"nothing expired", 7, 0, []time.Duration{time.Hour, 24 * time.Hour}, 2},
+		{"past the age", 7, 0, []time.Duration{time.Hour, 8 * 24 * time.Hour, 30 * 24 * time.Hour}, 1},
+		{"over the quota", 0, 2, []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour}, 2},
+		{"age and quota", 7, 1, []time.Duration{time.Hour, 2 * time.Hour, 8 * 24 * time.Hour}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Items are trashed without limits, trashing would expire them too
+			fs, root, trash := newTestTrash(t)
+			var items []*models.FileTrash
+			for i, age := range tt.items {
+				items = append(items, trashFile(t, fs, filepath.Join(root, string(rune('a'+i))), mb, age))
+			}
+
+			limited := *fs
+			cfg := *fs.config
+			cfg.Files.TrashMaxAge = tt.maxAge
+			cfg.Files.TrashMaxSize = tt.maxSize
+			limited.config = &cfg
+			limited.sweepTrash()
+
+			for i, item := range items {
+				_, statErr := os.Stat(filepath.Join(trash, item.ID))
+				dbErr := fs.db.First(&models.FileTrash{}, "id = ?", item.ID).Error
+				if kept := i < tt.kept; kept != (statErr == nil) || kept != (dbErr == nil) {
+					t.Errorf("item %d aged %v: kept = %v, want %v", i, tt.items[i], statErr == nil && dbErr == nil, kept)
+				}
+			}
+		})
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	fs, root, _ := newTestTrash(t)
+	path := filepath.Join(root, "a.txt")
+
+	if _, err := fs.Trash(root); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("Trash() of a root error = %v, want ErrPathNotAllowed", err)
+	}
+
+	tests := []struct {
+		name     string
+		conflict string
+		want     string
+		wantErr  error
+	}{
+		{"no conflict", "", "a.txt", nil},
+		{"fail", TrashConflictFail, "", ErrFileExists},
+		{"rename", TrashConflictRename, "a (1).txt", nil},
+		{"overwrite", TrashConflictOverwrite, "a.txt", nil},
+		{"unknown", "merge", "", ErrInvalidTrashRestore},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := trashFile(t, fs, path, i, 0)
+			if i > 0 {
+				// Something else took the name meanwhile
+				os.WriteFile(path, []byte("new"), 0644)
+			}
+			got, err := fs.RestoreTrash(item.ID, "", tt.conflict)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("RestoreTrash() = %q, %v, want %v", got, err, tt.wantErr)
+				}
+				fs.PurgeTrash(item.ID)
+				return
+			}
+			if err != nil || got != filepath.Join(root, tt.want) {
+				t.Fatalf("RestoreTrash() = %q, %v, want %q", got, err, filepath.Join(root, tt.want))
+			}
+			if info, err := os.Stat(got); err != nil || info.Size() != int64(i) {
+				t.Errorf("restored file = %v, %v, want %d bytes", info, err, i)
+			}
+			os.Remove(filepath.Join(root, "a (1).txt"))
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/diff"
+)
+
+const (
+	// Largest file kept as versions, the same as the editor reads
+	fileVersionMaxSize = 10 * 1024 * 1024
+	// Bytes looked at for a NUL to tell binary files, like git
+	fileBinaryScan = 8000
+	// Steps a version diff may take, it takes (N+M)·D for N and M lines and D edits
+	fileVersionDiffCost = 50_000_000
+)
+
+// FilePrecondition guards a write against changes made since the file was read, the
+// zero value always holds
+type FilePrecondition struct {
+	IfMatch           string    // ETags the file must have, "*" for any existing file
+	IfUnmodifiedSince time.Time // the file must not be modified after it, to the second
+}
+
+// FileVersionDiff is a unified diff between two versions of a file
+type FileVersionDiff struct {
+	From    string `json:"from"`
+	To      string `json:"to"` // empty for the file on disk
+	Diff    string `json:"diff"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// FileETag returns the ETag of file content, the quoted sha256 of the content
+func FileETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// ListVersions returns the versions of a file, most recent first
+func (s *FileService) ListVersions(path string) ([]models.FileVersion, error) {
+	fullPath, err := s.checkPath(path, fileRead)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []models.FileVersion
+	if err := s.db.Where("path = ?", fullPath).Order("created_at DESC").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetVersion returns a version of a file and its content
+func (s *FileService) GetVersion(id string) (*models.FileVersion, []byte, error) {
+	var version models.FileVersion
+	if err := s.db.First(&version, "id = ?", id).Error; err != nil {
+		return nil, nil, ErrFileVersionNotFound
+	}
+	// Versions of files outside the jail are not there for its users
+	if _, err := s.checkPath(version.Path, fileRead); err != nil {
+		return nil, nil, ErrFileVersionNotFound
+	}
+
+	dir, err := s.versionDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := os.ReadFile(versionBlobPath(dir, version.Hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &version, content, nil
+}
+
+// DiffVersions returns a unified diff between two versions. An empty to compares
+// against the file on disk.
+func (s *FileService) DiffVersions(from, to string) (*FileVersionDiff, error) {
+	fromVersion, fromContent, err := s.GetVersion(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toName := fromVersion.Path
+	var toContent []byte
+	if to == "" {
+		content, _, _, err := readVersionable(fromVersion.Path)
+		if err != nil {
+			return nil, err
+		}
+		if content == nil {
+			return nil, ErrFileNotText
+		}
+		toContent = content
+	} else {
+		toVersion, content, err := s.GetVersion(to)
+		if err != nil {
+			return nil, err
+		}
+		toName = versionLabel(toVersion)
+		toContent = content
+	}
+
+	fromLines, toLines := diff.SplitLines(string(fromContent)), diff.SplitLines(string(toContent))
+	maxEdits := max(1, fileVersionDiffCost/(len(fromLines)+len(toLines)+1))
+	edits, err := diff.LinesLimit(fromLines, toLines, maxEdits)
+	if err != nil {
+		return nil, fmt.Errorf("%w: more than %d lines changed", ErrFilesTooDifferent, maxEdits)
+	}
+
+	result := &FileVersionDiff{
+		From: from,
+		To:   to,
+		Diff: diff.UnifiedEdits(versionLabel(fromVersion), toName, edits, 3),
+	}
+	result.Added, result.Removed = diff.Stats(edits)
+	return result, nil
+}
+
+// RestoreVersion writes a version back to its file when the file still meets cond, the
+// file on disk is kept as a version first
+func (s *FileService) RestoreVersion(id string, cond FilePrecondition) (string, error) {
+	version, content, err := s.GetVersion(id)
+	if err != nil {
+		return "", err
+	}
+	return s.WriteFile(version.Path, content, cond)
+}
+
+// saveVersion records content as the latest version of a file unless it already is,
+// then drops the versions beyond the retention limit. History is best effort and never
+// fails the write it belongs to.
+func (s *FileService) saveVersion(path string, content []byte, edited bool) {
+	max := s.config.Files.MaxVersions
+	if max <= 0 || len(content) > fileVersionMaxSize || isBinary(content) {
+		return
+	}
+	dir, err := s.versionDir()
+	if err != nil {
+		s.log.Warn("Failed to save file version", "path", path, "error", err)
+		return
+	}
+	// Contents are shared between files, keep them from being dropped while saved
+	lock := s.writeLock(dir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	var latest models.FileVersion
+	if s.db.Where("path = ?", path).Order("created_at DESC").Limit(1).Find(&latest).RowsAffected > 0 && latest.Hash == hash {
+		return
+	}
+
+	if err := writeVersionBlob(dir, hash, content); err != nil {
+		s.log.Warn("Failed to save file version", "path", path, "error", err)
+		return
+	}
+	version := &models.FileVersion{Path: path, Hash: hash, Size: int64(len(content))}
+	if edited {
+		version.UserID = s.userID
+		version.Username = s.username
+	}
+	if err := s.db.Create(version).Error; err != nil {
+		s.log.Warn("Failed to save file version", "path", path, "error", err)
+		return
+	}
+
+	var expired []models.FileVersion
+	s.db.Where("path = ?", path).Order("created_at DESC").Offset(max).Find(&expired)
+	for i := range expired {
+		s.db.Unscoped().Delete(&expired[i])
+		s.dropVersionBlob(dir, expired[i].Hash)
+	}
+}
+
+// dropVersionBlob removes content no version refers to anymore
+func (s *FileService) dropVersionBlob(dir, hash string) {
+	var count int64
+	if err := s.db.Model(&models.FileVersion{}).Where("hash = ?", hash).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	os.Remove(versionBlobPath(dir, hash))
+}
+
+// versionDir returns the absolute directory of the version contents
+func (s *FileService) versionDir() (string, error) {
+	dir := s.config.Files.VersionDir
+	if dir == "" {
+		dir = filepath.Join(s.config.Storage.DataDir, "file_versions")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// writeLock returns the lock that serializes the writes of a file
+func (s *FileService) writeLock(path string) *sync.Mutex {
+	lock, _ := s.writeLocks.LoadOrStore(path, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// check returns why a file with info and etag fails the precondition, info is nil when
+// the file does not exist
+func (p FilePrecondition) check(info os.FileInfo, etag string) error {
+	if p.IfMatch != "" {
+		if info == nil {
+			return fmt.Errorf("%w: the file no longer exists", ErrFileChanged)
+		}
+		matched := false
+		for _, tag := range strings.Split(p.IfMatch, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%w: its ETag is now %s", ErrFileChanged, etag)
+		}
+	}
+	if !p.IfUnmodifiedSince.IsZero() && info != nil && info.ModTime().Truncate(time.Second).After(p.IfUnmodifiedSince) {
+		return fmt.Errorf("%w: it was modified at %s", ErrFileChanged, info.ModTime().UTC().Format(time.RFC1123))
+	}
+	return nil
+}
+
+// readVersionable reads the state of a file for a write: its content when it can be kept
+// as a version, nil otherwise, and its ETag
+func readVersionable(path string) ([]byte, os.FileInfo, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if info.IsDir() {
+		return nil, nil, "", ErrIsDirectory
+	}
+
+	hash := sha256.New()
+	var content bytes.Buffer
+	var w io.Writer = hash
+	if info.Size() <= fileVersionMaxSize {
+		w = io.MultiWriter(hash, &content)
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, nil, "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+
+	if info.Size() > fileVersionMaxSize || isBinary(content.Bytes()) {
+		return nil, info, etag, nil
+	}
+	// An empty file is content too
+	return append([]byte{}, content.Bytes()...), info, etag, nil
+}
+
+func writeVersionBlob(dir, hash string, content []byte) error {
+	path := versionBlobPath(dir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content, 0600)
+}
+
+// versionBlobPath spreads the contents over directories named by the first hash byte
+func versionBlobPath(dir, hash string) string {
+	return filepath.Join(dir, hash[:2], hash)
+}
+
+func versionLabel(version *models.FileVersion) string {
+	return version.Path + "@" + version.Hash[:12]
+}
+
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), fileBinaryScan)], 0) >= 0
+}
+
+// Errors
+var (
+	ErrFileVersionNotFound = errors.New("file version not found")
+	ErrFileChanged         = errors.New("file changed since it was read")
+	ErrFileNotText         = errors.New("file is not a text file")
+	ErrFilesTooDifferent   = errors.New("files too different to diff")
+)
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vpanel/server/internal/config"
+)
+
+func newTestVersions(t *testing.T) (*FileService, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return newTestFileService(t, func(cfg *config.FilesConfig) {
+		cfg.VersionDir = dir
+		cfg.MaxVersions = 10
+	})
+}
+
+// numbered returns n lines "<prefix> <i>"
+func numbered(prefix string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%s %d\n", prefix, i)
+	}
+	return b.String()
+}
+
+func TestDiffVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		from, to     string
+		wantAdded    int
+		wantRemoved  int
+		wantContains string
+		wantErr      error
+	}{
+		{"one line changed", "a\nb\nc\n", "a\nx\nc\n", 1, 1, "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n", nil},
+		{"lines added", "a\n", "a\nb\nc\n", 2, 0, "+b\n+c\n", nil},
+		{"emptied", "a\nb\n", "", 0, 2, "-a\n-b\n", nil},
+		{"small change to a large file", numbered("line", 100000), strings.Replace(numbered("line", 100000), "line 500\n", "changed\n", 1), 1, 1, "-line 500\n+changed\n", nil},
+		{"large file rewritten", numbered("old", 50000), numbered("new", 50000), 0, 0, "", ErrFilesTooDifferent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, root := newTestVersions(t)
+			path := filepath.Join(root, "f.txt")
+			if _, err := fs.WriteFile(path, []byte(tt.from), FilePrecondition{}); err != nil {
+				t.Fatal(err)
+			}
+			versions, err := fs.ListVersions(path)
+			if err != nil || len(versions) != 1 {
+				t.Fatalf("ListVersions() = %d versions, %v, want 1", len(versions), err)
+			}
+			if err := os.WriteFile(path, []byte(tt.to), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := fs.DiffVersions(versions[0].ID, "")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DiffVersions() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DiffVersions() error = %v", err)
+			}
+			if got.Added != tt.wantAdded || got.Removed != tt.wantRemoved {
+				t.Errorf("DiffVersions() = +%d -%d, want +%d -%d", got.Added, got.Removed, tt.wantAdded, tt.wantRemoved)
+			}
+			if !strings.Contains(got.Diff, tt.wantContains) {
+				t.Errorf("DiffVersions() diff =\n%s\nwant it to contain\n%s", got.Diff, tt.wantContains)
+			}
+		})
+	}
+}
+
+func TestDiffVersionsBetweenVersions(t *testing.T) {
+	fs, root := newTestVersions(t)
+	path := filepath.Join(root, "f.txt")
+	for _, content := range []string{"a\n", "a\nb\n"} {
+		if _, err := fs.WriteFile(path, []byte(content), FilePrecondition{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := fs.ListVersions(path)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("ListVersions() = %d versions, %v, want 2", len(versions), err)
+	}
+	newest, oldest := versions[0], versions[1]
+
+	got, err := fs.DiffVersions(oldest.ID, newest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Added != 1 || got.Removed != 0 || !strings.Contains(got.Diff, "+++ "+path+"@"+newest.Hash[:12]) {
+		t.Errorf("DiffVersions() = %+v", got)
+	}
+	if _, err := fs.DiffVersions("missing", newest.ID); !errors.Is(err, ErrFileVersionNotFound) {
+		t.Errorf("DiffVersions() of a missing version error = %v, want ErrFileVersionNotFound", err)
+	}
+}
@@ -0,0 +1,837 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Lines of a page of the file viewer by default and at most
+	fileViewLines    = 200
+	fileViewMaxLines = 5000
+	// Bytes of a line the viewer returns, longer lines are cut
+	fileViewMaxLine = 64 * 1024
+	// Bytes of text a page holds at most, whatever its lines
+	fileViewMaxPage = 4 << 20
+	// Bytes a search of a file reads before it returns where to go on
+	fileViewSearchScan = 256 << 20
+	fileViewMaxMatches = 1000
+
+	// Lines between the offsets a line index keeps
+	fileLineMark = 4096
+	// Bytes a line index scans at most to number the lines of a page found by offset
+	fileLineScan = 512 << 20
+	// How long a line index is kept after it was last used
+	fileLineIndexTTL = 10 * time.Minute
+
+	// How often a followed file is checked for new lines, rotation and truncation
+	fileFollowInterval = 500 * time.Millisecond
+	// Lines a follow event holds at most
+	fileFollowBatch = 1000
+)
+
+// Events of a followed file
+const (
+	FileFollowLines     = "lines"     // lines were appended
+	FileFollowTruncated = "truncated" // the file was truncated, following goes on from its start
+	FileFollowRotated   = "rotated"   // the path is a new file, e.g. after logrotate
+	FileFollowRemoved   = "removed"   // the path is gone, it is followed again once it is back
+)
+
+// FileViewQuery selects a page of a file: the lines from Line when it is set, the lines
+// before the offset Before when it is set, -1 being the end of the file, and otherwise
+// the lines from the one Offset is in.
+type FileViewQuery struct {
+	Path   string
+	Offset int64
+	Line   int // 1-based
+	Before int64
+	Lines  int
+}
+
+// FileViewPage is a page of the lines of a file. The offsets of a compressed file are
+// offsets into its decompressed content.
+type FileViewPage struct {
+	Path        string         `json:"path"`
+	Size        int64          `json:"size"` // on disk
+	ModTime     time.Time      `json:"mod_time"`
+	Compression string         `json:"compression,omitempty"` // gz, bz2, xz or zst
+	Offset      int64          `json:"offset"`                // of the first line
+	Next        int64          `json:"next"`                  // where the next page starts
+	BOF         bool           `json:"bof"`                   // the page starts at the start of the file
+	EOF         bool           `json:"eof"`                   // the page ends at the end of the file
+	Lines       []FileViewLine `json:"lines"`
+}
+
+// FileViewLine is a line of a file
+type FileViewLine struct {
+	Number int     `json:"number,omitempty"` // 1-based, left out when it is not known
+	Offset int64   `json:"offset"`
+	Text   string  `json:"text"`
+	Cut    bool    `json:"cut,omitempty"`    // the line is longer than the text
+	Ranges [][]int `json:"ranges,omitempty"` // byte offsets of the matches of a search in the text
+}
+
+// FileViewSearch is a search of a file from the line Offset is in
+type FileViewSearch struct {
+	Path       string
+	Pattern    string // RE2 regular expression, or plain text with Literal
+	Literal    bool
+	IgnoreCase bool
+	Offset     int64
+	MaxResults int
+}
+
+// FileViewMatches are the lines of a file matching a search. A search stops after a
+// number of bytes, it goes on from Next until it reaches the end of the file.
+type FileViewMatches struct {
+	Path    string         `json:"path"`
+	Matches []FileViewLine `json:"matches"`
+	Next    int64          `json:"next"`
+	EOF     bool           `json:"eof"`
+}
+
+// FileFollowEvent is a change of a followed file, see the FileFollow constants
+type FileFollowEvent struct {
+	Type   string         `json:"type"`
+	Lines  []FileViewLine `json:"lines,omitempty"`
+	Offset int64          `json:"offset"` // where following goes on
+}
+
+// ViewFile returns a page of the lines of a text file of any size, a compressed file,
+// e.g. a rotated log, is decompressed on the fly
+func (s *FileService) ViewFile(ctx context.Context, q FileViewQuery) (*FileViewPage, error) {
+	if q.Offset < 0 || q.Line < 0 || q.Before < -1 {
+		return nil, fmt.Errorf("%w: offsets and lines cannot be negative", ErrInvalidFileView)
+	}
+	if q.Lines <= 0 {
+		q.Lines = fileViewLines
+	}
+	q.Lines = min(q.Lines, fileViewMaxLines)
+
+	v, err := s.openView(q.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer v.f.Close()
+
+	page := &FileViewPage{
+		Path:        q.Path,
+		Size:        v.info.Size(),
+		ModTime:     v.info.ModTime(),
+		Compression: v.compression,
+	}
+	if v.compression != "" {
+		err = v.compressedPage(ctx, q, page)
+	} else {
+		err = v.plainPage(ctx, q, page)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if page.Lines == nil {
+		page.Lines = []FileViewLine{}
+	}
+	page.BOF = page.Offset == 0
+	return page, nil
+}
+
+// SearchFile returns the lines of a text file matching a search, from the line the
+// offset of the search is in. Lines longer than the viewer shows are searched as cut.
+func (s *FileService) SearchFile(ctx context.Context, search FileViewSearch) (*FileViewMatches, error) {
+	if search.Pattern == "" {
+		return nil, fmt.Errorf("%w: a pattern is required", ErrInvalidSearch)
+	}
+	if search.Offset < 0 {
+		return nil, fmt.Errorf("%w: offsets cannot be negative", ErrInvalidFileView)
+	}
+	re, err := compileSearch(search.Pattern, search.Literal, search.IgnoreCase)
+	if err != nil {
+		return nil, err
+	}
+	if search.MaxResults <= 0 || search.MaxResults > fileViewMaxMatches {
+		search.MaxResults = fileViewMaxMatches
+	}
+
+	v, err := s.openView(search.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer v.f.Close()
+
+	var lr *lineReader
+	if v.compression != "" {
+		r, err := v.decompress()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		lr = newLineReader(&progressReader{ctx: ctx, r: r}, 0, 1)
+	} else {
+		start, err := alignLine(v.f, min(search.Offset, v.info.Size()))
+		if err != nil {
+			return nil, err
+		}
+		number, err := v.index.lineAt(ctx, v.f, start)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := v.f.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		lr = newLineReader(&progressReader{ctx: ctx, r: v.f}, start, number)
+	}
+
+	result := &FileViewMatches{Path: search.Path, Matches: []FileViewLine{}}
+	from := max(lr.offset, search.Offset)
+	for len(result.Matches) < search.MaxResults && lr.offset-from < fileViewSearchScan {
+		line, _, err := lr.next()
+		if err == io.EOF {
+			result.EOF = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The lines of a compressed file before the offset are read to get there
+		if lr.offset <= search.Offset {
+			continue
+		}
+		if ranges := re.FindAllStringIndex(line.Text, -1); ranges != nil {
+			line.Ranges = ranges
+			result.Matches = append(result.Matches, line)
+		}
+	}
+	result.Next = lr.offset
+	return result, nil
+}
+
+// FollowFile follows a file like tail -F: it sends the lines appended to the file from
+// offset, or from its end after the last lines when offset is -1, and tells when the
+// file is truncated, rotated or removed. The path is followed rather than the file it was
+// when following started. The channel is closed when ctx is done.
+func (s *FileService) FollowFile(ctx context.Context, path string, offset int64, lines int) (<-chan *FileFollowEvent, error) {
+	v, err := s.openView(path)
+	if err != nil {
+		return nil, err
+	}
+	if v.compression != "" {
+		v.f.Close()
+		return nil, fmt.Errorf("%w: compressed files are not appended to", ErrInvalidFileView)
+	}
+
+	// The last lines are sent first when following from the end
+	var backlog []FileViewLine
+	start := offset
+	if offset < 0 {
+		offset = v.info.Size()
+		start = offset
+		if lines > 0 {
+			if start, err = linesBefore(v.f, offset, min(lines, fileViewMaxLines)); err != nil {
+				v.f.Close()
+				return nil, err
+			}
+		}
+	}
+	number, err := v.index.lineAt(ctx, v.f, min(start, v.info.Size()))
+	if err != nil {
+		v.f.Close()
+		return nil, err
+	}
+
+	fw := &fileFollower{s: s, path: path, f: v.f, inode: fileInode(v.info), offset: start, number: number}
+	if start < offset {
+		if _, err := v.f.Seek(start, io.SeekStart); err != nil {
+			v.f.Close()
+			return nil, err
+		}
+		lr := newLineReader(v.f, start, number)
+		lr.whole = true
+		if backlog, _, err = readLines(lr, nil, fileViewMaxLines, offset); err != nil {
+			v.f.Close()
+			return nil, err
+		}
+		fw.offset, fw.number = lr.offset, lr.number
+	}
+
+	events := make(chan *FileFollowEvent, 16)
+	send := func(event *FileFollowEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(events)
+		defer fw.close()
+
+		if len(backlog) > 0 && !send(&FileFollowEvent{Type: FileFollowLines, Lines: backlog, Offset: fw.offset}) {
+			return
+		}
+		ticker := time.NewTicker(fileFollowInterval)
+		defer ticker.Stop()
+		for {
+			fw.poll(send)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return events, nil
+}
+
+// fileView is a text file opened by the viewer
+type fileView struct {
+	f           *os.File
+	info        os.FileInfo
+	compression string         // of a compressed file, whose content is read decompressed
+	index       *fileLineIndex // of a plain file
+}
+
+// openView opens a text file for viewing, a compressed file is told by its content
+func (s *FileService) openView(path string) (*fileView, error) {
+	fullPath, err := s.checkPath(path, fileRead)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrIsDirectory
+	}
+	// Reading a pipe or a device may never end
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%w: not a regular file", ErrFileNotText)
+	}
+
+	v := &fileView{f: f, info: info}
+	head := make([]byte, fileBinaryScan)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(head[:n], c.magic) {
+			v.compression = c.name
+			break
+		}
+	}
+	if v.compression != "" {
+		r, err := v.decompress()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		n, _ = io.ReadFull(r, head)
+		r.Close()
+	}
+	if isBinary(head[:n]) {
+		f.Close()
+		return nil, ErrFileNotText
+	}
+
+	if v.compression == "" {
+		if v.index, err = s.lineIndex(fullPath, f, info); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// decompress returns the decompressed content of a compressed file from its start
+func (v *fileView) decompress() (io.ReadCloser, error) {
+	r, err := decompressReader(io.NewSectionReader(v.f, 0, v.info.Size()), v.compression)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	return r, nil
+}
+
+// plainPage reads a page of a plain file, which is read from where the page starts
+func (v *fileView) plainPage(ctx context.Context, q FileViewQuery, page *FileViewPage) error {
+	size := v.info.Size()
+	end := int64(-1)
+	var start int64
+	var number int
+	var err error
+	switch {
+	case q.Line > 0:
+		if start, err = v.index.offsetOf(ctx, v.f, q.Line); err != nil {
+			return err
+		}
+		number = q.Line
+	case q.Before != 0:
+		end = q.Before
+		if end < 0 || end > size {
+			end = size
+		}
+		if start, err = linesBefore(v.f, end, q.Lines); err != nil {
+			return err
+		}
+		if number, err = v.index.lineAt(ctx, v.f, start); err != nil {
+			return err
+		}
+	default:
+		if start, err = alignLine(v.f, min(q.Offset, size)); err != nil {
+			return err
+		}
+		if number, err = v.index.lineAt(ctx, v.f, start); err != nil {
+			return err
+		}
+	}
+
+	if _, err := v.f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	lr := newLineReader(v.f, start, number)
+	page.Offset = start
+	page.Lines, page.EOF, err = readLines(lr, nil, q.Lines, end)
+	page.Next = lr.offset
+	return err
+}
+
+// compressedPage reads a page of a compressed file, which is decompressed from its start
+// up to the page
+func (v *fileView) compressedPage(ctx context.Context, q FileViewQuery, page *FileViewPage) error {
+	r, err := v.decompress()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	lr := newLineReader(&progressReader{ctx: ctx, r: r}, 0, 1)
+
+	if q.Before != 0 {
+		// The last lines before the offset are kept while the content is read
+		var lines []FileViewLine
+		var size int
+		next := int64(0)
+		for {
+			line, _, err := lr.next()
+			if err == io.EOF {
+				page.EOF = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if q.Before > 0 && line.Offset >= q.Before {
+				break
+			}
+			lines = append(lines, line)
+			next = lr.offset
+			for size += len(line.Text); len(lines) > q.Lines || size > fileViewMaxPage; lines = lines[1:] {
+				size -= len(lines[0].Text)
+			}
+		}
+		page.Lines, page.Next = lines, next
+		page.Offset = next
+		if len(lines) > 0 {
+			page.Offset = lines[0].Offset
+		}
+		return nil
+	}
+
+	// The lines before the page are read to get there
+	var lines []FileViewLine
+	for {
+		if q.Line > 0 && lr.number >= q.Line {
+			break
+		}
+		line, _, err := lr.next()
+		if err == io.EOF {
+			page.Offset, page.Next, page.EOF = lr.offset, lr.offset, true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if q.Line == 0 && lr.offset > q.Offset {
+			lines = append(lines, line)
+			break
+		}
+	}
+	page.Offset = lr.offset
+	if len(lines) > 0 {
+		page.Offset = lines[0].Offset
+	}
+	page.Lines, page.EOF, err = readLines(lr, lines, q.Lines, -1)
+	page.Next = lr.offset
+	return err
+}
+
+// lineReader reads lines with their offsets and numbers, lines longer than
+// fileViewMaxLine are cut
+type lineReader struct {
+	r      *bufio.Reader
+	offset int64 // of the next line
+	number int   // of the next line, 0 when it is not known
+	whole  bool  // a last line without its newline is left unread
+}
+
+func newLineReader(r io.Reader, offset int64, number int) *lineReader {
+	return &lineReader{r: bufio.NewReaderSize(r, 64*1024), offset: offset, number: number}
+}
+
+// next returns the next line and whether it ends with a newline, io.EOF after the last
+// line
+func (lr *lineReader) next() (FileViewLine, bool, error) {
+	line := FileViewLine{Number: lr.number, Offset: lr.offset}
+	var text []byte
+	size := 0
+	for {
+		chunk, err := lr.r.ReadSlice('\n')
+		size += len(chunk)
+		// One byte more than is shown tells a cut line from one that just fits
+		if len(text) <= fileViewMaxLine {
+			text = append(text, chunk[:min(len(chunk), fileViewMaxLine+1-len(text))]...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// With whole, the rest of a last line without its newline is still being written
+		if err != nil && (err != io.EOF || size == 0 || lr.whole) {
+			return line, false, err
+		}
+		complete := err == nil
+
+		if len(text) == size {
+			text = bytes.TrimSuffix(bytes.TrimSuffix(text, []byte("\n")), []byte("\r"))
+		} else {
+			text, line.Cut = text[:fileViewMaxLine], true
+		}
+		line.Text = string(text)
+		lr.offset += int64(size)
+		if lr.number > 0 {
+			lr.number++
+		}
+		return line, complete, nil
+	}
+}
+
+// readLines appends up to n lines to lines, stopping at the offset end unless it is -1,
+// and reports whether the file ends after them
+func readLines(lr *lineReader, lines []FileViewLine, n int, end int64) ([]FileViewLine, bool, error) {
+	size := 0
+	for _, line := range lines {
+		size += len(line.Text)
+	}
+	for len(lines) < n && size < fileViewMaxPage && (end < 0 || lr.offset < end) {
+		line, _, err := lr.next()
+		if err == io.EOF {
+			return lines, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		lines = append(lines, line)
+		size += len(line.Text)
+	}
+	_, err := lr.r.Peek(1)
+	return lines, err == io.EOF, nil
+}
+
+// alignLine returns the start of the line an offset is in, the offset itself in a line
+// longer than the viewer shows
+func alignLine(f *os.File, offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+	from := max(0, offset-fileViewMaxLine)
+	buf := make([]byte, offset-from)
+	if _, err := f.ReadAt(buf, from); err != nil {
+		return 0, err
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		return from + int64(i) + 1, nil
+	}
+	if from == 0 {
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// linesBefore returns the start of the n-th line before end, a line start or the end of
+// the file
+func linesBefore(f *os.File, end int64, n int) (int64, error) {
+	buf := make([]byte, 64*1024)
+	found := 0
+	for pos := end; pos > 0; {
+		size := min(int64(len(buf)), pos)
+		pos -= size
+		chunk := buf[:size]
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// The newline ending the line before end starts no line
+			if chunk[i] != '\n' || pos+int64(i) == end-1 {
+				continue
+			}
+			if found++; found == n {
+				return pos + int64(i) + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// fileLineIndex keeps the offsets of every fileLineMark-th line of a plain file, so a
+// page is found by its line and the lines of a page found by offset get their numbers
+// without the file being read from its start each time. Lines appended to the file keep
+// the index valid.
+type fileLineIndex struct {
+	mu    sync.Mutex
+	inode uint64
+	marks []int64 // marks[i] is the offset of line i*fileLineMark+1
+	end   int64   // the lines before end are indexed, a line start
+	lines int     // lines before end
+	used  atomic.Int64
+}
+
+// lineIndex returns the line index of a plain file, a new one when the file is not the
+// one that was indexed. Indexes unused for a while are dropped.
+func (s *FileService) lineIndex(path string, f *os.File, info os.FileInfo) (*fileLineIndex, error) {
+	now := time.Now()
+	s.lineIndexes.Range(func(key, value interface{}) bool {
+		if now.Sub(time.Unix(0, value.(*fileLineIndex).used.Load())) > fileLineIndexTTL {
+			s.lineIndexes.Delete(key)
+		}
+		return true
+	})
+
+	value, _ := s.lineIndexes.LoadOrStore(path, &fileLineIndex{inode: fileInode(info), marks: []int64{0}})
+	index := value.(*fileLineIndex)
+	index.used.Store(now.UnixNano())
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	valid := index.inode == fileInode(info) && index.end <= info.Size()
+	if valid && index.end > 0 {
+		// A file rewritten in place no longer has a line start where it had
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, index.end-1); err != nil && err != io.EOF {
+			return nil, err
+		}
+		valid = last[0] == '\n'
+	}
+	if !valid {
+		index.inode, index.marks, index.end, index.lines = fileInode(info), []int64{0}, 0, 0
+	}
+	return index, nil
+}
+
+// extend indexes the lines after end until done returns true, the end of the file or
+// limit bytes have been read
+func (x *fileLineIndex) extend(ctx context.Context, f *os.File, done func() bool, limit int64) error {
+	buf := make([]byte, 1<<20)
+	from := x.end
+	pos := from
+	for !done() && pos-from < limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := f.ReadAt(buf, pos)
+		for chunk, at := buf[:n], pos; ; {
+			i := bytes.IndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			x.lines++
+			x.end = at + int64(i) + 1
+			if x.lines%fileLineMark == 0 {
+				x.marks = append(x.marks, x.end)
+			}
+			chunk, at = chunk[i+1:], at+int64(i)+1
+		}
+		pos += int64(n)
+		if err == io.EOF || n == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offsetOf returns the offset of a line, the end of the file when it has fewer lines
+func (x *fileLineIndex) offsetOf(ctx context.Context, f *os.File, line int) (int64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.extend(ctx, f, func() bool { return x.lines+1 >= line }, math.MaxInt64); err != nil {
+		return 0, err
+	}
+	if x.lines+1 < line {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	if x.lines+1 == line {
+		return x.end, nil
+	}
+
+	// Counted from the mark before the line
+	mark := (line - 1) / fileLineMark
+	offset, number := x.marks[mark], mark*fileLineMark+1
+	buf := make([]byte, 64*1024)
+	for number < line {
+		n, err := f.ReadAt(buf, offset)
+		read := 0
+		for number < line {
+			i := bytes.IndexByte(buf[read:n], '\n')
+			if i < 0 {
+				read = n
+				break
+			}
+			read += i + 1
+			number++
+		}
+		offset += int64(read)
+		if err != nil && number < line {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// lineAt returns the number of the line starting at an offset, 0 when the lines before
+// it are not indexed and too many to index now
+func (x *fileLineIndex) lineAt(ctx context.Context, f *os.File, offset int64) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if err := x.extend(ctx, f, func() bool { return x.end >= offset }, fileLineScan); err != nil {
+		return 0, err
+	}
+	// The lines past the limit are not known, the offset may be in the last line
+	if offset-x.end > fileViewMaxLine {
+		return 0, nil
+	}
+
+	// Counted from the mark before the offset
+	mark := sort.Search(len(x.marks), func(i int) bool { return x.marks[i] > offset }) - 1
+	number := mark*fileLineMark + 1
+	buf := make([]byte, 64*1024)
+	for pos := x.marks[mark]; pos < offset; {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), offset-pos)], pos)
+		number += bytes.Count(buf[:n], []byte{'\n'})
+		pos += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+	}
+	return number, nil
+}
+
+// fileFollower follows the path of a file, see FollowFile
+type fileFollower struct {
+	s      *FileService
+	path   string
+	f      *os.File // nil while the path is gone
+	inode  uint64
+	offset int64 // of the first line not sent
+	number int   // of that line, 0 when it is not known
+}
+
+// poll sends the lines appended since the last poll, after telling when the path is a
+// different file or the file got shorter
+func (fw *fileFollower) poll(send func(*FileFollowEvent) bool) {
+	var info os.FileInfo
+	fullPath, err := fw.s.checkPath(fw.path, fileRead)
+	if err == nil {
+		info, err = os.Stat(fullPath)
+	}
+	switch {
+	case err != nil:
+		if fw.f != nil {
+			// The lines written before the file was removed
+			fw.drain(false, send)
+			fw.close()
+			send(&FileFollowEvent{Type: FileFollowRemoved, Offset: fw.offset})
+		}
+		return
+	case fw.f == nil || fileInode(info) != fw.inode:
+		if fw.f != nil {
+			// The lines written before the file was rotated
+			fw.drain(false, send)
+			fw.close()
+		}
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return
+		}
+		fw.f, fw.inode, fw.offset, fw.number = f, fileInode(info), 0, 1
+		if !send(&FileFollowEvent{Type: FileFollowRotated}) {
+			return
+		}
+	case info.Size() < fw.offset:
+		fw.offset, fw.number = 0, 1
+		if !send(&FileFollowEvent{Type: FileFollowTruncated}) {
+			return
+		}
+	}
+	fw.drain(true, send)
+}
+
+// drain sends the lines after the offset, a last line without its newline only when the
+// file is not written any more
+func (fw *fileFollower) drain(whole bool, send func(*FileFollowEvent) bool) {
+	if _, err := fw.f.Seek(fw.offset, io.SeekStart); err != nil {
+		return
+	}
+	lr := newLineReader(fw.f, fw.offset, fw.number)
+	lr.whole = whole
+	for {
+		lines, eof, err := readLines(lr, nil, fileFollowBatch, -1)
+		if len(lines) > 0 && !send(&FileFollowEvent{Type: FileFollowLines, Lines: lines, Offset: lr.offset}) {
+			return
+		}
+		fw.offset, fw.number = lr.offset, lr.number
+		if err != nil || eof || len(lines) == 0 {
+			return
+		}
+	}
+}
+
+func (fw *fileFollower) close() {
+	if fw.f != nil {
+		fw.f.Close()
+		fw.f = nil
+	}
+}
+
+// Errors
+var (
+	ErrInvalidFileView = errors.New("invalid file view")
+)
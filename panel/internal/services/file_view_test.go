@@ -0,0 +1,495 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// numberedLines returns a text of n lines "line <number>" and the offset of each line,
+// the last offset being the size of the text
+func numberedLines(n int) (string, []int64) {
+	var b strings.Builder
+	offsets := make([]int64, 0, n+1)
+	for i := 1; i <= n; i++ {
+		offsets = append(offsets, int64(b.Len()))
+		fmt.Fprintf(&b, "line %d\n", i)
+	}
+	return b.String(), append(offsets, int64(b.Len()))
+}
+
+// pageNumbers returns the numbers of the lines of a page, each line must have the text
+// of its number
+func pageNumbers(t *testing.T, lines []FileViewLine) []int {
+	t.Helper()
+	numbers := []int{}
+	for _, line := range lines {
+		if line.Text != fmt.Sprintf("line %d", line.Number) {
+			t.Errorf("line %d at %d = %q", line.Number, line.Offset, line.Text)
+		}
+		numbers = append(numbers, line.Number)
+	}
+	return numbers
+}
+
+func TestViewFile(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "app.log")
+	// More lines than are between two marks of the line index
+	content, offsets := numberedLines(3*fileLineMark + 10)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	last := len(offsets) - 1
+
+	tests := []struct {
+		name  string
+		query FileViewQuery
+		want  []int
+		bof   bool
+		eof   bool
+	}{
+		{"first lines", FileViewQuery{Lines: 3}, []int{1, 2, 3}, true, false},
+		{"by line", FileViewQuery{Line: 2*fileLineMark + 1, Lines: 2}, []int{2*fileLineMark + 1, 2*fileLineMark + 2}, false, false},
+		{"by line after a mark", FileViewQuery{Line: fileLineMark + 7, Lines: 1}, []int{fileLineMark + 7}, false, false},
+		{"by offset within a line", FileViewQuery{Offset: offsets[5000] + 3, Lines: 2}, []int{5001, 5002}, false, false},
+		{"by offset of a line", FileViewQuery{Offset: offsets[5000], Lines: 1}, []int{5001}, false, false},
+		{"offset past the end", FileViewQuery{Offset: offsets[last] + 100}, []int{}, false, true},
+		{"line past the end", FileViewQuery{Line: last + 5}, []int{}, false, true},
+		{"last line", FileViewQuery{Line: last, Lines: 5}, []int{last}, false, true},
+		{"end of the file", FileViewQuery{Before: -1, Lines: 2}, []int{last - 1, last}, false, true},
+		{"before an offset", FileViewQuery{Before: offsets[99], Lines: 3}, []int{97, 98, 99}, false, false},
+		{"before an offset within a line", FileViewQuery{Before: offsets[99] + 2, Lines: 2}, []int{99, 100}, false, false},
+		{"before the start", FileViewQuery{Before: offsets[2], Lines: 5}, []int{1, 2}, true, false},
+		{"before past the end", FileViewQuery{Before: offsets[last] + 100, Lines: 1}, []int{last}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			q.Path = path
+			page, err := s.ViewFile(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pageNumbers(t, page.Lines); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines = %v, want %v", got, tt.want)
+			}
+			if page.BOF != tt.bof || page.EOF != tt.eof {
+				t.Errorf("bof %v, eof %v, want %v, %v", page.BOF, page.EOF, tt.bof, tt.eof)
+			}
+			if len(page.Lines) > 0 {
+				first, end := page.Lines[0].Number, page.Lines[len(page.Lines)-1].Number
+				if page.Offset != offsets[first-1] || page.Next != offsets[end] {
+					t.Errorf("offset %d, next %d, want %d, %d", page.Offset, page.Next, offsets[first-1], offsets[end])
+				}
+				for _, line := range page.Lines {
+					if line.Offset != offsets[line.Number-1] {
+						t.Errorf("line %d offset = %d, want %d", line.Number, line.Offset, offsets[line.Number-1])
+					}
+				}
+			}
+			if page.Size != int64(len(content)) || page.Compression != "" {
+				t.Errorf("size %d, compression %q", page.Size, page.Compression)
+			}
+		})
+	}
+
+	page, err := s.ViewFile(context.Background(), FileViewQuery{Path: path})
+	if err != nil || len(page.Lines) != fileViewLines {
+		t.Errorf("%d lines by default, %v", len(page.Lines), err)
+	}
+	page, err = s.ViewFile(context.Background(), FileViewQuery{Path: path, Lines: fileViewMaxLines + 1})
+	if err != nil || len(page.Lines) != fileViewMaxLines {
+		t.Errorf("%d lines at most, %v", len(page.Lines), err)
+	}
+	for _, q := range []FileViewQuery{{Offset: -1}, {Line: -1}, {Before: -2}} {
+		q.Path = path
+		if _, err := s.ViewFile(context.Background(), q); !errors.Is(err, ErrInvalidFileView) {
+			t.Errorf("ViewFile(%+v) error = %v, want ErrInvalidFileView", q, err)
+		}
+	}
+}
+
+func TestViewFileLines(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "long.txt")
+	long := strings.Repeat("x", fileViewMaxLine+10)
+	exact := strings.Repeat("y", fileViewMaxLine)
+	content := long + "\n" + exact + "\n" + "crlf\r\n" + "no newline"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.ViewFile(context.Background(), FileViewQuery{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileViewLine{
+		{Number: 1, Offset: 0, Text: long[:fileViewMaxLine], Cut: true},
+		{Number: 2, Offset: int64(len(long) + 1), Text: exact},
+		{Number: 3, Offset: int64(len(long) + len(exact) + 2), Text: "crlf"},
+		{Number: 4, Offset: int64(len(long) + len(exact) + 8), Text: "no newline"},
+	}
+	if !reflect.DeepEqual(page.Lines, want) {
+		for i, line := range page.Lines {
+			t.Errorf("line %d: %d at %d, %d bytes, cut %v", i, line.Number, line.Offset, len(line.Text), line.Cut)
+		}
+	}
+	if !page.EOF || page.Next != int64(len(content)) {
+		t.Errorf("eof %v, next %d", page.EOF, page.Next)
+	}
+
+	// An offset in a line longer than is shown starts the page there
+	page, err = s.ViewFile(context.Background(), FileViewQuery{Path: path, Offset: fileViewMaxLine + 5, Lines: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Offset != fileViewMaxLine+5 || page.Lines[0].Text != "xxxxx" || page.Lines[0].Number != 1 {
+		t.Errorf("page in a long line = %+v", page.Lines)
+	}
+}
+
+func TestViewFileRewritten(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "app.log")
+	content, _ := numberedLines(2 * fileLineMark)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	view := func(line int) string {
+		t.Helper()
+		page, err := s.ViewFile(context.Background(), FileViewQuery{Path: path, Line: line, Lines: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Lines) == 0 {
+			return ""
+		}
+		return page.Lines[0].Text
+	}
+	if got := view(fileLineMark + 2); got != fmt.Sprintf("line %d", fileLineMark+2) {
+		t.Fatalf("line = %q", got)
+	}
+
+	// Appended lines keep the index
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("appended\n")
+	f.Close()
+	if got := view(2*fileLineMark + 1); got != "appended" {
+		t.Errorf("appended line = %q", got)
+	}
+
+	// Rewritten in place, the lines are no longer where they were indexed
+	var b strings.Builder
+	for i := 1; i <= fileLineMark+10; i++ {
+		fmt.Fprintf(&b, "rewritten line number %d\n", i)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := view(fileLineMark + 2); got != fmt.Sprintf("rewritten line number %d", fileLineMark+2) {
+		t.Errorf("rewritten line = %q", got)
+	}
+}
+
+func TestViewFileCompressed(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "app.log.1.gz")
+	content, offsets := numberedLines(1000)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(content))
+	zw.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query FileViewQuery
+		want  []int
+		eof   bool
+	}{
+		{"first lines", FileViewQuery{Lines: 2}, []int{1, 2}, false},
+		{"by line", FileViewQuery{Line: 500, Lines: 2}, []int{500, 501}, false},
+		{"by offset within a line", FileViewQuery{Offset: offsets[499] + 2, Lines: 2}, []int{500, 501}, false},
+		{"end of the file", FileViewQuery{Before: -1, Lines: 2}, []int{999, 1000}, true},
+		{"before an offset", FileViewQuery{Before: offsets[10], Lines: 3}, []int{8, 9, 10}, false},
+		{"past the end", FileViewQuery{Line: 2000}, []int{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			q.Path = path
+			page, err := s.ViewFile(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pageNumbers(t, page.Lines); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lines = %v, want %v", got, tt.want)
+			}
+			if page.EOF != tt.eof || page.Compression != "gz" || page.Size != int64(buf.Len()) {
+				t.Errorf("eof %v, compression %q, size %d", page.EOF, page.Compression, page.Size)
+			}
+			if len(page.Lines) > 0 && (page.Offset != offsets[tt.want[0]-1] || page.Next != offsets[tt.want[len(tt.want)-1]]) {
+				t.Errorf("offset %d, next %d", page.Offset, page.Next)
+			}
+		})
+	}
+
+	if _, err := s.FollowFile(context.Background(), path, -1, 0); !errors.Is(err, ErrInvalidFileView) {
+		t.Errorf("FollowFile() of a compressed file error = %v", err)
+	}
+}
+
+func TestViewFileNotText(t *testing.T) {
+	s, root := newTestFileService(t)
+	binary := filepath.Join(root, "app.bin")
+	if err := os.WriteFile(binary, []byte{0x7f, 'E', 'L', 'F', 0, 0, 1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ViewFile(context.Background(), FileViewQuery{Path: binary}); !errors.Is(err, ErrFileNotText) {
+		t.Errorf("ViewFile() of a binary file error = %v", err)
+	}
+	if _, err := s.ViewFile(context.Background(), FileViewQuery{Path: root}); !errors.Is(err, ErrIsDirectory) {
+		t.Errorf("ViewFile() of a directory error = %v", err)
+	}
+	if _, err := s.SearchFile(context.Background(), FileViewSearch{Path: binary, Pattern: "ELF"}); !errors.Is(err, ErrFileNotText) {
+		t.Errorf("SearchFile() of a binary file error = %v", err)
+	}
+}
+
+func TestSearchFile(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "app.log")
+	content, offsets := numberedLines(10000)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	search := func(search FileViewSearch) *FileViewMatches {
+		t.Helper()
+		search.Path = path
+		result, err := s.SearchFile(context.Background(), search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Line 99, 990 to 999 and 9900 to 9999 match
+	result := search(FileViewSearch{Pattern: "LINE 99", Literal: true, IgnoreCase: true, MaxResults: 5})
+	if got := pageNumbers(t, result.Matches); !reflect.DeepEqual(got, []int{99, 990, 991, 992, 993}) {
+		t.Errorf("matches = %v", got)
+	}
+	if result.EOF || result.Next != offsets[993] {
+		t.Errorf("eof %v, next %d, want %d", result.EOF, result.Next, offsets[993])
+	}
+	if ranges := result.Matches[0].Ranges; !reflect.DeepEqual(ranges, [][]int{{0, 7}}) {
+		t.Errorf("ranges = %v", ranges)
+	}
+
+	// Going on from where the search stopped
+	result = search(FileViewSearch{Pattern: "line 99", Literal: true, Offset: result.Next})
+	if len(result.Matches) != 106 || result.Matches[0].Number != 994 || !result.EOF || result.Next != offsets[10000] {
+		t.Errorf("%d matches from %d, eof %v", len(result.Matches), result.Matches[0].Number, result.EOF)
+	}
+
+	// From an offset within a line, that line is searched from its start
+	result = search(FileViewSearch{Pattern: `^line 22[0-5]$`, Offset: offsets[221] + 2})
+	if got := pageNumbers(t, result.Matches); !reflect.DeepEqual(got, []int{222, 223, 224, 225}) {
+		t.Errorf("matches = %v", got)
+	}
+
+	result = search(FileViewSearch{Pattern: "1", Literal: true, Offset: offsets[10000] + 10})
+	if len(result.Matches) != 0 || !result.EOF {
+		t.Errorf("search past the end = %+v", result)
+	}
+
+	for _, bad := range []FileViewSearch{{Pattern: ""}, {Pattern: "("}} {
+		bad.Path = path
+		if _, err := s.SearchFile(context.Background(), bad); !errors.Is(err, ErrInvalidSearch) {
+			t.Errorf("SearchFile(%q) error = %v, want ErrInvalidSearch", bad.Pattern, err)
+		}
+	}
+	if _, err := s.SearchFile(context.Background(), FileViewSearch{Path: path, Pattern: "a", Offset: -1}); !errors.Is(err, ErrInvalidFileView) {
+		t.Errorf("SearchFile() from a negative offset error = %v", err)
+	}
+
+	// A compressed file is searched from its start up to the offset
+	gz := filepath.Join(root, "app.log.gz")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(content))
+	zw.Close()
+	if err := os.WriteFile(gz, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := s.SearchFile(context.Background(), FileViewSearch{Path: gz, Pattern: "^line 999", Offset: offsets[9990]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pageNumbers(t, matches.Matches); !reflect.DeepEqual(got, []int{9991, 9992, 9993, 9994, 9995, 9996, 9997, 9998, 9999}) {
+		t.Errorf("compressed matches = %v", got)
+	}
+}
+
+func TestLinesBefore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	// The lines span the blocks read backwards
+	content, offsets := numberedLines(20000)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		end  int64
+		n    int
+		want int64
+	}{
+		{offsets[20000], 1, offsets[19999]},
+		{offsets[20000], 15000, offsets[5000]},
+		{offsets[20000], 30000, 0},
+		{offsets[100] + 3, 1, offsets[100]},
+		{offsets[100] + 3, 2, offsets[99]},
+		{offsets[1], 1, 0},
+		{0, 1, 0},
+	}
+	for _, tt := range tests {
+		if got, err := linesBefore(f, tt.end, tt.n); err != nil || got != tt.want {
+			t.Errorf("linesBefore(%d, %d) = %d, %v, want %d", tt.end, tt.n, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ offset, want int64 }{
+		{0, 0},
+		{offsets[10], offsets[10]},
+		{offsets[10] + 4, offsets[10]},
+		{offsets[11] - 1, offsets[10]},
+		{5, 0},
+	} {
+		if got, err := alignLine(f, tt.offset); err != nil || got != tt.want {
+			t.Errorf("alignLine(%d) = %d, %v, want %d", tt.offset, got, err, tt.want)
+		}
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "app.log")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, text string) {
+		t.Helper()
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(text)
+		f.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := s.FollowFile(ctx, path, -1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// next returns the type of the next event and its lines
+	next := func() string {
+		t.Helper()
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("events closed")
+			}
+			var texts []string
+			for _, line := range event.Lines {
+				texts = append(texts, fmt.Sprintf("%d:%s", line.Number, line.Text))
+			}
+			return strings.TrimSpace(event.Type + " " + strings.Join(texts, " "))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return ""
+	}
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			if got := next(); got != w {
+				t.Errorf("event = %q, want %q", got, w)
+			}
+		}
+	}
+
+	expect("lines 2:two 3:three")
+
+	// A line is sent once its newline is written
+	write(path, "fo")
+	time.Sleep(2 * fileFollowInterval)
+	write(path, "ur\n")
+	expect("lines 4:four")
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	write(path, "a\n")
+	expect("truncated", "lines 1:a")
+
+	// The lines written to the rotated file before the new one was seen come first
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	write(path+".1", "late")
+	write(path, "b\n")
+	expect("lines 2:late", "rotated", "lines 1:b")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect("removed")
+	write(path, "c\n")
+	expect("rotated", "lines 1:c")
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestFollowFileFromOffset(t *testing.T) {
+	s, root := newTestFileService(t)
+	path := filepath.Join(root, "app.log")
+	if err := os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := s.FollowFile(ctx, path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Type != FileFollowLines || len(event.Lines) != 2 || event.Lines[0].Number != 2 || event.Lines[1].Text != "three" || event.Offset != 14 {
+			t.Errorf("event = %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+}
@@ -0,0 +1,463 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Zip encryption, WinZip AES is the default and ZipCrypto is only for old tools
+const (
+	ZipEncryptionAES       = "aes"
+	ZipEncryptionZipCrypto = "zipcrypto"
+)
+
+const (
+	zipMethodAES     = 99
+	zipExtraAES      = 0x9901
+	zipFlagEncrypted = 0x1
+	zipFlagDataDesc  = 0x8
+	zipFlagUTF8      = 0x800
+
+	zipAESIterations = 1000
+	zipAESMacSize    = 10
+	zipCryptoHeader  = 12
+)
+
+// createEncrypted adds an encrypted file to a zip, the returned writer must be closed
+// before the next file is added
+func createEncrypted(zw *zip.Writer, fh *zip.FileHeader, password, encryption string) (io.WriteCloser, error) {
+	fh.Flags |= zipFlagEncrypted | zipFlagDataDesc
+	// CreateRaw leaves the MS-DOS time to the caller
+	fh.SetModTime(fh.Modified)
+	if !isASCII(fh.Name) && utf8.ValidString(fh.Name) {
+		fh.Flags |= zipFlagUTF8
+	}
+	method := fh.Method
+
+	if encryption == ZipEncryptionZipCrypto {
+		raw, err := zw.CreateRaw(fh)
+		if err != nil {
+			return nil, err
+		}
+		keys := newZipCryptoKeys(password)
+		header := make([]byte, zipCryptoHeader)
+		if _, err := rand.Read(header); err != nil {
+			return nil, err
+		}
+		// With a data descriptor the last byte checks the password against the time
+		header[zipCryptoHeader-1] = byte(fh.ModifiedTime >> 8)
+		keys.encrypt(header)
+
+		out := &zipEntryWriter{fh: fh, raw: raw, crc: crc32.NewIEEE()}
+		out.sink = &zipCryptoWriter{keys: keys, w: writerFunc(out.countRawWrite)}
+		out.compressed = zipCryptoHeader
+		if _, err := raw.Write(header); err != nil {
+			return nil, err
+		}
+		return out.start(method)
+	}
+
+	// WinZip AE-2 with a 256 bit key, the CRC is left out and the MAC authenticates
+	fh.Method = zipMethodAES
+	fh.Extra = append(fh.Extra, zipAESExtra(method)...)
+	raw, err := zw.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	encKey, macKey, verifier := zipAESKeys(password, salt, 32)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &zipEntryWriter{fh: fh, raw: raw, mac: hmac.New(sha1.New, macKey), aes: true}
+	out.sink = &zipAESWriter{ctr: newZipAESCounter(block), mac: out.mac, w: writerFunc(out.countRawWrite)}
+	out.compressed = int64(len(salt) + len(verifier))
+	if _, err := raw.Write(append(salt, verifier...)); err != nil {
+		return nil, err
+	}
+	return out.start(method)
+}
+
+// openEncrypted opens an encrypted file of a zip
+func openEncrypted(f *zip.File, password string) (io.ReadCloser, error) {
+	if password == "" {
+		return nil, ErrArchivePassword
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Method != zipMethodAES {
+		header := make([]byte, zipCryptoHeader)
+		if _, err := io.ReadFull(raw, header); err != nil {
+			return nil, err
+		}
+		keys := newZipCryptoKeys(password)
+		keys.decrypt(header)
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&zipFlagDataDesc != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		if header[zipCryptoHeader-1] != check {
+			return nil, ErrArchivePassword
+		}
+		plain := &zipCryptoReader{keys: keys, r: raw}
+		return zipDecompress(f.Method, plain, f.CRC32, true)
+	}
+
+	strength, method, ok := parseZipAESExtra(f.Extra)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid AES extra field", ErrUnsupportedFormat)
+	}
+	keySize := 8 * (strength + 1)
+	saltSize := keySize / 2
+	size := int64(f.CompressedSize64) - int64(saltSize) - 2 - zipAESMacSize
+	if size < 0 {
+		return nil, fmt.Errorf("%w: truncated AES entry", ErrUnsupportedFormat)
+	}
+	header := make([]byte, saltSize+2)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	encKey, macKey, verifier := zipAESKeys(password, header[:saltSize], keySize)
+	if !bytes.Equal(verifier, header[saltSize:]) {
+		return nil, ErrArchivePassword
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := &zipAESReader{
+		ctr:  newZipAESCounter(block),
+		mac:  hmac.New(sha1.New, macKey),
+		r:    io.LimitReader(raw, size),
+		tail: raw,
+	}
+	// AE-1 entries keep the CRC as well
+	return zipDecompress(method, plain, f.CRC32, f.CRC32 != 0)
+}
+
+// zipEntryWriter compresses and encrypts the content of a raw zip entry and fills in its
+// sizes and checksum when closed
+type zipEntryWriter struct {
+	fh         *zip.FileHeader
+	raw        io.Writer
+	sink       io.Writer // encrypts into raw
+	comp       io.WriteCloser
+	crc        hash.Hash32
+	mac        hash.Hash
+	aes        bool
+	size       int64
+	compressed int64
+}
+
+func (w *zipEntryWriter) start(method uint16) (io.WriteCloser, error) {
+	if w.crc == nil {
+		w.crc = crc32.NewIEEE()
+	}
+	switch method {
+	case zip.Store:
+		w.comp = nopWriteCloser{w.sink}
+	case zip.Deflate:
+		fw, err := flate.NewWriter(w.sink, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w.comp = fw
+	default:
+		return nil, fmt.Errorf("%w: zip method %d", ErrUnsupportedFormat, method)
+	}
+	return w, nil
+}
+
+func (w *zipEntryWriter) Write(p []byte) (int, error) {
+	w.crc.Write(p)
+	w.size += int64(len(p))
+	return w.comp.Write(p)
+}
+
+func (w *zipEntryWriter) countRawWrite(p []byte) (int, error) {
+	n, err := w.raw.Write(p)
+	w.compressed += int64(n)
+	return n, err
+}
+
+func (w *zipEntryWriter) Close() error {
+	if err := w.comp.Close(); err != nil {
+		return err
+	}
+	if w.aes {
+		if _, err := w.countRawWrite(w.mac.Sum(nil)[:zipAESMacSize]); err != nil {
+			return err
+		}
+		w.fh.CRC32 = 0
+	} else {
+		w.fh.CRC32 = w.crc.Sum32()
+	}
+	w.fh.CompressedSize64 = uint64(w.compressed)
+	w.fh.UncompressedSize64 = uint64(w.size)
+	if w.fh.CompressedSize64 >= math.MaxUint32 || w.fh.UncompressedSize64 >= math.MaxUint32 {
+		w.fh.CompressedSize = math.MaxUint32
+		w.fh.UncompressedSize = math.MaxUint32
+		w.fh.ReaderVersion = 45
+	} else {
+		w.fh.CompressedSize = uint32(w.fh.CompressedSize64)
+		w.fh.UncompressedSize = uint32(w.fh.UncompressedSize64)
+	}
+	return nil
+}
+
+// zipDecompress decompresses decrypted content, checking the CRC at the end when check
+func zipDecompress(method uint16, r io.ReadCloser, crc uint32, check bool) (io.ReadCloser, error) {
+	var content io.ReadCloser
+	switch method {
+	case zip.Store:
+		content = r
+	case zip.Deflate:
+		content = flate.NewReader(r)
+	default:
+		return nil, fmt.Errorf("%w: zip method %d", ErrUnsupportedFormat, method)
+	}
+	if !check {
+		return content, nil
+	}
+	return &crcReader{r: content, want: crc, crc: crc32.NewIEEE()}, nil
+}
+
+// WinZip AES
+
+func zipAESExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipExtraAES)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2) // AE-2
+	copy(extra[6:], "AE")
+	extra[8] = 3 // 256 bit
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+// parseZipAESExtra returns the key strength, 1 to 3 for 128 to 256 bits, and the
+// compression method of an AES entry
+func parseZipAESExtra(extra []byte) (int, uint16, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0, false
+		}
+		if id == zipExtraAES && size >= 7 {
+			strength := int(extra[8])
+			if strength < 1 || strength > 3 {
+				return 0, 0, false
+			}
+			return strength, binary.LittleEndian.Uint16(extra[9:]), true
+		}
+		extra = extra[4+size:]
+	}
+	return 0, 0, false
+}
+
+func zipAESKeys(password string, salt []byte, keySize int) (encKey, macKey, verifier []byte) {
+	key := pbkdf2.Key([]byte(password), salt, zipAESIterations, 2*keySize+2, sha1.New)
+	return key[:keySize], key[keySize : 2*keySize], key[2*keySize:]
+}
+
+// zipAESCounter is AES in CTR mode with the little-endian counter of WinZip, starting at 1
+type zipAESCounter struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newZipAESCounter(block cipher.Block) *zipAESCounter {
+	return &zipAESCounter{block: block, used: aes.BlockSize}
+}
+
+func (c *zipAESCounter) xor(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for k := range c.counter {
+				if c.counter[k]++; c.counter[k] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+type zipAESWriter struct {
+	ctr *zipAESCounter
+	mac hash.Hash
+	w   io.Writer
+}
+
+func (w *zipAESWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	w.ctr.xor(buf, p)
+	w.mac.Write(buf)
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type zipAESReader struct {
+	ctr  *zipAESCounter
+	mac  hash.Hash
+	r    io.Reader // the ciphertext
+	tail io.Reader // the MAC after it
+}
+
+func (r *zipAESReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.mac.Write(p[:n])
+	r.ctr.xor(p[:n], p[:n])
+	if err == io.EOF {
+		code := make([]byte, zipAESMacSize)
+		if _, err := io.ReadFull(r.tail, code); err != nil {
+			return n, err
+		}
+		if subtle.ConstantTimeCompare(code, r.mac.Sum(nil)[:zipAESMacSize]) != 1 {
+			return n, fmt.Errorf("%w: the entry fails authentication", ErrChecksumMismatch)
+		}
+	}
+	return n, err
+}
+
+func (r *zipAESReader) Close() error { return nil }
+
+// Traditional PKWARE encryption
+
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		keys.update(password[i])
+	}
+	return keys
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) stream() byte {
+	temp := k[2] | 2
+	return byte((temp * (temp ^ 1)) >> 8)
+}
+
+func (k *zipCryptoKeys) encrypt(p []byte) {
+	for i, b := range p {
+		p[i] = b ^ k.stream()
+		k.update(b)
+	}
+}
+
+func (k *zipCryptoKeys) decrypt(p []byte) {
+	for i, b := range p {
+		p[i] = b ^ k.stream()
+		k.update(p[i])
+	}
+}
+
+type zipCryptoWriter struct {
+	keys *zipCryptoKeys
+	w    io.Writer
+}
+
+func (w *zipCryptoWriter) Write(p []byte) (int, error) {
+	buf := append([]byte{}, p...)
+	w.keys.encrypt(buf)
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type zipCryptoReader struct {
+	keys *zipCryptoKeys
+	r    io.Reader
+}
+
+func (r *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.keys.decrypt(p[:n])
+	return n, err
+}
+
+func (r *zipCryptoReader) Close() error { return nil }
+
+// crcReader fails the read that ends content not matching its CRC. Content decrypted
+// with a wrong password that passed the check byte usually fails to inflate first.
+type crcReader struct {
+	r    io.ReadCloser
+	crc  hash.Hash32
+	want uint32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	var corrupt flate.CorruptInputError
+	if (err == io.EOF && r.crc.Sum32() != r.want) || errors.As(err, &corrupt) {
+		return n, fmt.Errorf("%w: wrong password or corrupt entry", ErrChecksumMismatch)
+	}
+	return n, err
+}
+
+func (r *crcReader) Close() error { return r.r.Close() }
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Errors
+var (
+	ErrArchivePassword = errors.New("wrong or missing archive password")
+)
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// infoZipArchive was made by Info-ZIP with zip -P secret, hello.txt deflated and s.txt stored
+const infoZipArchive = "UEsDBBQACQAIAGMFU11vZRnSIwAAADYAAAAJABwAaGVsbG8udHh0VVQJAAOZZ9VqmWfVanV4CwABBAAAAAAEAAAAAGgRmvMqdTPqarkRbA8SqlmpWZJ0hlCVQMx04+lezjkXwMrrUEsHCG9lGdIjAAAANgAAAFBLAwQKAAkAAABjBVNdC/lDVhIAAAAGAAAABQAcAHMudHh0VVQJAAOZZ9VqmWfVanV4CwABBAAAAAAEAAAAAHrb1zW3b1FK+2xikhg/Q4ZBqlBLBwgL+UNWEgAAAAYAAABQSwECHgMUAAkACABjBVNdb2UZ0iMAAAA2AAAACQAYAAAAAAABAAAApIEAAAAAaGVsbG8udHh0VVQFAAOZZ9VqdXgLAAEEAAAAAAQAAAAAUEsBAh4DCgAJAAAAYwVTXQv5Q1YSAAAABgAAAAUAGAAAAAAAAAAAAKSBdgAAAHMudHh0VVQFAAOZZ9VqdXgLAAEEAAAAAAQAAAAAUEsFBgAAAAACAAIAmgAAANcAAAAAAA=="
+
+// encryptedZip returns a zip of one file encrypted with password
+func encryptedZip(t *testing.T, content []byte, method uint16, password, encryption string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fh := &zip.FileHeader{Name: "file.txt", Method: method, Modified: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)}
+	w, err := createEncrypted(zw, fh, password, encryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readEncrypted reads the first file of a zip with password
+func readEncrypted(data []byte, password string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := openEncrypted(zr.File[0], password)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestZipEncryption(t *testing.T) {
+	random := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	contents := map[string][]byte{
+		"empty":  {},
+		"text":   bytes.Repeat([]byte("hello, zip\n"), 1000),
+		"random": random,
+	}
+
+	for _, encryption := range []string{ZipEncryptionAES, ZipEncryptionZipCrypto} {
+		for _, method := range []uint16{zip.Store, zip.Deflate} {
+			for name, content := range contents {
+				data := encryptedZip(t, content, method, "secret", encryption)
+				got, err := readEncrypted(data, "secret")
+				if err != nil || !bytes.Equal(got, content) {
+					t.Errorf("%s, method %d, %s: read %d bytes, %v, want %d bytes", encryption, method, name, len(got), err, len(content))
+				}
+
+				zr, _ := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+				f := zr.File[0]
+				if f.Flags&zipFlagEncrypted == 0 || f.UncompressedSize64 != uint64(len(content)) {
+					t.Errorf("%s, method %d, %s: flags %#x, size %d", encryption, method, name, f.Flags, f.UncompressedSize64)
+				}
+				if encryption == ZipEncryptionAES && (f.Method != zipMethodAES || f.CRC32 != 0) {
+					t.Errorf("%s, method %d, %s: method %d, CRC %#x, want AE-2", encryption, method, name, f.Method, f.CRC32)
+				}
+				if _, err := f.Open(); err == nil && encryption == ZipEncryptionAES {
+					t.Errorf("%s: archive/zip opened an AES entry", encryption)
+				}
+			}
+		}
+	}
+}
+
+func TestZipEncryptionPassword(t *testing.T) {
+	content := bytes.Repeat([]byte("secret content\n"), 100)
+	for _, encryption := range []string{ZipEncryptionAES, ZipEncryptionZipCrypto} {
+		data := encryptedZip(t, content, zip.Deflate, "secret", encryption)
+		if _, err := readEncrypted(data, ""); !errors.Is(err, ErrArchivePassword) {
+			t.Errorf("%s without a password: error = %v, want ErrArchivePassword", encryption, err)
+		}
+		// ZipCrypto checks a password against a single byte, one in 256 wrong passwords
+		// pass it and fail the CRC instead
+		for _, password := range []string{"Secret", "secret ", "x"} {
+			got, err := readEncrypted(data, password)
+			if err == nil {
+				t.Errorf("%s with password %q: read %q", encryption, password, got)
+			} else if !errors.Is(err, ErrArchivePassword) && !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("%s with password %q: error = %v", encryption, password, err)
+			}
+		}
+	}
+}
+
+func TestZipCryptoPasswordPassingCheck(t *testing.T) {
+	content := bytes.Repeat([]byte("secret content\n"), 100)
+	data := encryptedZip(t, content, zip.Deflate, "secret", ZipEncryptionZipCrypto)
+
+	// Find a wrong password whose check byte matches, the content then fails to inflate
+	for i := 0; i < 10000; i++ {
+		password := fmt.Sprintf("wrong%d", i)
+		_, err := readEncrypted(data, password)
+		if errors.Is(err, ErrArchivePassword) {
+			continue
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("password %q passing the check byte: error = %v, want ErrChecksumMismatch", password, err)
+		}
+		return
+	}
+	t.Fatal("no wrong password passed the check byte")
+}
+
+func TestZipEncryptionTampered(t *testing.T) {
+	content := bytes.Repeat([]byte("do not change\n"), 100)
+	for _, encryption := range []string{ZipEncryptionAES, ZipEncryptionZipCrypto} {
+		data := encryptedZip(t, content, zip.Store, "secret", encryption)
+		// Flip a bit in the middle of the encrypted content
+		i := bytes.Index(data, []byte("file.txt")) + len("file.txt") + 600
+		data[i] ^= 1
+		if _, err := readEncrypted(data, "secret"); !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: error = %v, want ErrChecksumMismatch", encryption, err)
+		}
+	}
+}
+
+func TestZipCryptoInfoZIP(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(infoZipArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"hello.txt": "hello, zip crypto\nhello, zip crypto\nhello, zip crypto\n",
+		"s.txt":     "stored",
+	}
+	for _, f := range zr.File {
+		rc, err := openEncrypted(f, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != want[f.Name] {
+			t.Errorf("%s = %q, %v, want %q", f.Name, got, err, want[f.Name])
+		}
+		if _, err := openEncrypted(f, "wrong"); err == nil {
+			// One in 256 wrong passwords passes the check byte, not this one
+			t.Errorf("%s opened with a wrong password", f.Name)
+		}
+	}
+}
+
+func TestZipAESCounter(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The keystream of block n is the encryption of n as a 128 bit little-endian number,
+	// starting at 1
+	counterBlock := func(n int) []byte {
+		counter := make([]byte, aes.BlockSize)
+		counter[0], counter[1] = byte(n), byte(n>>8)
+		out := make([]byte, aes.BlockSize)
+		block.Encrypt(out, counter)
+		return out
+	}
+
+	stream := make([]byte, 300*aes.BlockSize)
+	ctr := newZipAESCounter(block)
+	// Odd sizes cross block boundaries
+	for i := 0; i < len(stream); i += 7 {
+		ctr.xor(stream[i:min(i+7, len(stream))], stream[i:min(i+7, len(stream))])
+	}
+	for _, n := range []int{1, 2, 255, 256, 257, 300} {
+		if got, want := stream[(n-1)*aes.BlockSize:n*aes.BlockSize], counterBlock(n); !bytes.Equal(got, want) {
+			t.Errorf("keystream block %d = %x, want %x", n, got, want)
+		}
+	}
+}
+
+func TestZipAESExtra(t *testing.T) {
+	extra := append([]byte{0x55, 0x54, 1, 0, 0}, zipAESExtra(zip.Deflate)...)
+	strength, method, ok := parseZipAESExtra(extra)
+	if !ok || strength != 3 || method != zip.Deflate {
+		t.Errorf("parseZipAESExtra() = %d, %d, %v, want 3, %d, true", strength, method, ok, zip.Deflate)
+	}
+	if _, _, ok := parseZipAESExtra([]byte{0x01, 0x99, 7}); ok {
+		t.Error("parseZipAESExtra() of a truncated field = ok")
+	}
+}
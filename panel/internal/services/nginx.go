@@ -1,54 +1,69 @@
 package services
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"text/template"
-	"time"
 
+	"github.com/vpanel/server/internal/config"
 	"github.com/vpanel/server/internal/models"
 	"github.com/vpanel/server/pkg/logger"
+	"golang.org/x/crypto/acme"
 	"gorm.io/gorm"
 )
 
 // NginxService manages Nginx configuration
 type NginxService struct {
-	db  *gorm.DB
-	log *logger.Logger
+	db     *gorm.DB
+	cfg    *config.Config
+	log    *logger.Logger
+	notify *NotificationService
+	docker *DockerService
+
+	layout   *NginxLayout
+	layoutMu sync.Mutex
+
+	acme     *acme.Client
+	acmeMu   sync.Mutex
+	renewMu  sync.Mutex
+	applyMu  sync.Mutex
+	ingestMu sync.Mutex
 }
 
-// NewNginxService creates a new nginx service
-func NewNginxService(db *gorm.DB, log *logger.Logger) *NginxService {
-	return &NginxService{db: db, log: log}
+// NewNginxService creates a new nginx service, docker is used for an nginx running in a container
+func NewNginxService(db *gorm.DB, cfg *config.Config, log *logger.Logger, notify *NotificationService, docker *DockerService) *NginxService {
+	svc := &NginxService{db: db, cfg: cfg, log: log, notify: notify, docker: docker}
+
+	// Renew certificates and ingest access logs in the background
+	go svc.renewLoop()
+	go svc.ingestLoop()
+
+	return svc
 }
 
 // GetStatus returns nginx status
 func (s *NginxService) GetStatus() (map[string]interface{}, error) {
-	// Check if nginx is running
-	cmd := exec.Command("nginx", "-t")
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	layout := s.Layout()
 
+	// Check the configuration
+	output, err := s.runNginx(layout, "-t", "-c", layout.ConfPath)
 	isValid := err == nil
 	errorMsg := ""
 	if !isValid {
-		errorMsg = stderr.String()
+		errorMsg = strings.TrimSpace(string(output))
+		if errorMsg == "" {
+			errorMsg = err.Error()
+		}
 	}
 
 	// Check if nginx process is running
-	isRunning := false
-	cmd = exec.Command("pgrep", "-x", "nginx")
-	if err := cmd.Run(); err == nil {
-		isRunning = true
-	}
+	isRunning := s.nginxRunning(layout)
 
 	// Count sites
 	var totalSites, enabledSites int64
@@ -61,13 +76,14 @@ func (s *NginxService) GetStatus() (map[string]interface{}, error) {
 		"error":         errorMsg,
 		"total_sites":   totalSites,
 		"enabled_sites": enabledSites,
+		"version":       layout.Version,
+		"container":     layout.Container,
 	}, nil
 }
 
 // Reload reloads nginx configuration
 func (s *NginxService) Reload() error {
-	cmd := exec.Command("nginx", "-s", "reload")
-	if err := cmd.Run(); err != nil {
+	if err := s.reloadNginx(s.Layout()); err != nil {
 		s.log.Error("Failed to reload nginx", "error", err)
 		return fmt.Errorf("failed to reload nginx: %w", err)
 	}
@@ -122,16 +138,19 @@ func (s *NginxService) CreateSite(site *models.NginxSite) error {
 	if !site.ProxyEnabled && site.RootPath == "" {
 		site.RootPath = fmt.Sprintf("/var/www/%s", site.Domain)
 	}
+	if err := validateSiteRules(site); err != nil {
+		return err
+	}
 
 	// Create site in database
 	if err := s.db.Create(site).Error; err != nil {
 		return err
 	}
 
-	// Generate and write nginx config
+	// Generate and apply nginx config, a rejected config undoes the creation
 	if err := s.writeSiteConfig(site); err != nil {
-		s.log.Error("Failed to write nginx config", "error", err, "site_id", site.ID)
-		// Don't fail the creation, just log the error
+		s.db.Unscoped().Delete(site)
+		return err
 	}
 
 	s.log.Info("Nginx site created", "site_id", site.ID, "domain", site.Domain)
@@ -153,7 +172,19 @@ func (s *NginxService) UpdateSite(id string, updates map[string]interface{}) err
 		}
 	}
 
+	// A newly attached certificate must cover the site
+	if certID, ok := updates["ssl_cert_id"].(string); ok && certID != "" && certID != site.SSLCertID {
+		if err := s.checkSiteCertificate(certID, &site); err != nil {
+			return err
+		}
+	}
+
+	if err := decodeSiteUpdates(updates); err != nil {
+		return err
+	}
+
 	// Update in database
+	previous := site
 	if err := s.db.Model(&site).Updates(updates).Error; err != nil {
 		return err
 	}
@@ -162,10 +193,15 @@ func (s *NginxService) UpdateSite(id string, updates map[string]interface{}) err
 	if err := s.db.First(&site, "id = ?", id).Error; err != nil {
 		return err
 	}
+	if err := validateSiteRules(&site); err != nil {
+		s.db.Save(&previous)
+		return err
+	}
 
-	// Regenerate config
-	if err := s.writeSiteConfig(&site); err != nil {
-		s.log.Error("Failed to update nginx config", "error", err, "site_id", site.ID)
+	// Regenerate config, a rejected config restores the previous settings
+	if err := s.writeSiteConfig(&site, &previous); err != nil {
+		s.db.Save(&previous)
+		return err
 	}
 
 	s.log.Info("Nginx site updated", "site_id", site.ID)
@@ -179,16 +215,27 @@ func (s *NginxService) DeleteSite(id string) error {
 		return err
 	}
 
-	// Delete config file
-	configPath := s.getSiteConfigPath(&site)
-	if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
-		s.log.Warn("Failed to remove nginx config file", "error", err, "path", configPath)
+	// Delete config files, the site's limit zones and its htpasswd file
+	changes := []nginxFileChange{{path: s.getSiteConfigPath(&site), remove: true}}
+	if enabledPath := s.getSiteEnabledPath(&site); enabledPath != "" {
+		changes = append(changes, nginxFileChange{path: enabledPath, remove: true})
+	}
+	limits, err := s.limitConfigChanges(site.ID)
+	if err != nil {
+		return err
+	}
+	changes = append(changes, limits...)
+	changes = append(changes, nginxFileChange{path: s.Layout().HostPath(s.htpasswdPath(&site)), remove: true})
+	if err := s.applyConfig(changes...); err != nil {
+		return err
 	}
 
 	// Delete from database
 	if err := s.db.Delete(&site).Error; err != nil {
 		return err
 	}
+	s.db.Where("site_id = ?", site.ID).Delete(&models.NginxLocation{})
+	s.db.Where("site_id = ?", site.ID).Delete(&models.NginxAuthUser{})
 
 	s.log.Info("Nginx site deleted", "site_id", site.ID, "domain", site.Domain)
 	return nil
@@ -216,6 +263,9 @@ func (s *NginxService) ListCertificates(nodeID string) ([]models.SSLCertificate,
 	if err := query.Find(&certs).Error; err != nil {
 		return nil, err
 	}
+	for i := range certs {
+		s.syncCertificateMeta(&certs[i])
+	}
 	return certs, nil
 }
 
@@ -230,61 +280,38 @@ func (s *NginxService) GetCertificate(id string) (*models.SSLCertificate, error)
 
 // CreateCertificate creates a new SSL certificate
 func (s *NginxService) CreateCertificate(cert *models.SSLCertificate) error {
-	if cert.Domain == "" {
-		return fmt.Errorf("domain is required")
-	}
-
-	// If Let's Encrypt, use certbot to generate certificate
+	// Let's Encrypt certificates are issued over ACME
 	if cert.Type == "letsencrypt" {
+		if cert.Domain == "" {
+			return fmt.Errorf("domain is required")
+		}
 		return s.createLetsEncryptCert(cert)
 	}
 
-	// For custom certificates, validate paths
-	if cert.CertPath == "" || cert.KeyPath == "" {
-		return fmt.Errorf("cert_path and key_path are required for custom certificates")
-	}
-
-	// Save to database
-	if err := s.db.Create(cert).Error; err != nil {
-		return err
-	}
-
-	s.log.Info("SSL certificate created", "cert_id", cert.ID, "domain", cert.Domain, "type", cert.Type)
-	return nil
+	// Custom certificates are inspected at their paths
+	return s.CreateCustomCertificate(cert, nil, nil)
 }
 
-// createLetsEncryptCert creates a Let's Encrypt certificate using certbot
+// createLetsEncryptCert issues a certificate through the configured ACME directory
 func (s *NginxService) createLetsEncryptCert(cert *models.SSLCertificate) error {
-	// Check if certbot is available
-	if _, err := exec.LookPath("certbot"); err != nil {
-		return fmt.Errorf("certbot is not installed. Please install certbot to use Let's Encrypt")
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), acmeIssueTimeout)
+	defer cancel()
 
-	// Run certbot
-	cmd := exec.Command("certbot", "certonly", "--standalone", "--non-interactive", "--agree-tos",
-		"--email", "admin@example.com", // TODO: Get from config
-		"-d", cert.Domain,
-		"--cert-path", "/etc/letsencrypt/live/"+cert.Domain+"/fullchain.pem",
-		"--key-path", "/etc/letsencrypt/live/"+cert.Domain+"/privkey.pem")
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("certbot failed: %s", stderr.String())
+	if err := s.obtainCertificate(ctx, cert); err != nil {
+		return err
 	}
 
-	// Set certificate paths
-	cert.CertPath = fmt.Sprintf("/etc/letsencrypt/live/%s/fullchain.pem", cert.Domain)
-	cert.KeyPath = fmt.Sprintf("/etc/letsencrypt/live/%s/privkey.pem", cert.Domain)
-	cert.ChainPath = cert.CertPath
-
-	// Get expiration date (Let's Encrypt certs expire in 90 days)
-	cert.ExpiresAt = time.Now().Add(90 * 24 * time.Hour)
-
-	// Save to database
+	// Save to database. gorm writes the default of auto_renew in place of false, an opt
+	// out is stored afterwards.
+	autoRenew := cert.AutoRenew
 	if err := s.db.Create(cert).Error; err != nil {
 		return err
 	}
+	if !autoRenew {
+		if err := s.db.Model(cert).Update("auto_renew", false).Error; err != nil {
+			return err
+		}
+	}
 
 	s.log.Info("Let's Encrypt certificate created", "cert_id", cert.ID, "domain", cert.Domain)
 	return nil
@@ -308,6 +335,10 @@ func (s *NginxService) DeleteCertificate(id string) error {
 	if err := s.db.Delete(&cert).Error; err != nil {
 		return err
 	}
+	s.db.Where("certificate_id = ?", cert.ID).Delete(&models.SSLRenewal{})
+	if dir := filepath.Dir(cert.KeyPath); s.isManagedCertDir(dir) {
+		os.RemoveAll(dir)
+	}
 
 	s.log.Info("SSL certificate deleted", "cert_id", cert.ID, "domain", cert.Domain)
 	return nil
@@ -324,19 +355,17 @@ func (s *NginxService) RenewCertificate(id string) error {
 		return fmt.Errorf("only Let's Encrypt certificates can be renewed automatically")
 	}
 
-	// Run certbot renew
-	cmd := exec.Command("certbot", "renew", "--cert-name", cert.Domain, "--non-interactive")
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("certbot renew failed: %s", stderr.String())
+	changed, err := s.renewCertificate(cert, "manual")
+	if err != nil {
+		return err
 	}
 
-	// Update renewal time
-	now := time.Now()
-	cert.LastRenewed = &now
-	cert.ExpiresAt = now.Add(90 * 24 * time.Hour)
-	s.db.Save(cert)
+	// Sites using the certificate pick it up on reload
+	if changed && s.certificateInUse(cert.ID) {
+		if err := s.Reload(); err != nil {
+			return err
+		}
+	}
 
 	s.log.Info("SSL certificate renewed", "cert_id", cert.ID, "domain", cert.Domain)
 	return nil
@@ -354,12 +383,11 @@ func (s *NginxService) GetAccessLogs(siteID string, lines int) ([]string, error)
 			return nil, err
 		}
 		// Use site-specific log if available
-		logPath := fmt.Sprintf("/var/log/nginx/%s.access.log", site.Domain)
-		return s.readLogFile(logPath, lines)
+		return s.readLogFile(s.siteLogPath(&site, "access"), lines)
 	}
 
 	// Use default nginx access log
-	return s.readLogFile("/var/log/nginx/access.log", lines)
+	return s.readLogFile(s.nginxLogPath("access.log"), lines)
 }
 
 // GetErrorLogs returns nginx error logs
@@ -374,12 +402,11 @@ func (s *NginxService) GetErrorLogs(siteID string, lines int) ([]string, error)
 			return nil, err
 		}
 		// Use site-specific log if available
-		logPath := fmt.Sprintf("/var/log/nginx/%s.error.log", site.Domain)
-		return s.readLogFile(logPath, lines)
+		return s.readLogFile(s.siteLogPath(&site, "error"), lines)
 	}
 
 	// Use default nginx error log
-	return s.readLogFile("/var/log/nginx/error.log", lines)
+	return s.readLogFile(s.nginxLogPath("error.log"), lines)
 }
 
 // readLogFile reads the last N lines from a log file
@@ -409,405 +436,144 @@ func (s *NginxService) readLogFile(path string, lines int) ([]string, error) {
 	return logLines, nil
 }
 
-// LogEntry represents a parsed nginx access log entry
-type LogEntry struct {
-	IP        string
-	Time      time.Time
-	Method    string
-	Path      string
-	Status    int
-	Bytes     int64
-	Referer   string
-	UserAgent string
-}
-
-// GetAnalytics returns site analytics parsed from access logs
-func (s *NginxService) GetAnalytics(siteID string, days int) (map[string]interface{}, error) {
-	if days <= 0 {
-		days = 30
-	}
-
-	var site models.NginxSite
-	logPath := "/var/log/nginx/access.log"
-
-	if siteID != "" {
-		if err := s.db.First(&site, "id = ?", siteID).Error; err != nil {
-			return nil, err
-		}
-		logPath = fmt.Sprintf("/var/log/nginx/%s.access.log", site.Domain)
-	}
-
-	// Parse logs from the specified time range
-	cutoffTime := time.Now().AddDate(0, 0, -days)
-	entries, err := s.parseAccessLogs(logPath, cutoffTime)
+// writeSiteConfig applies the nginx configuration of a site, the files of its
+// previous state are removed when the domain changed
+func (s *NginxService) writeSiteConfig(site *models.NginxSite, previous ...*models.NginxSite) error {
+	changes, err := s.siteConfigChanges(site, previous...)
 	if err != nil {
-		// If log file doesn't exist, return empty stats
-		if os.IsNotExist(err) {
-			return s.emptyAnalytics(), nil
-		}
-		return nil, fmt.Errorf("failed to parse access logs: %w", err)
+		return err
 	}
 
-	// Calculate statistics
-	stats := s.calculateStats(entries)
-
-	return stats, nil
-}
-
-// parseAccessLogs parses nginx access logs and returns entries within the time range
-func (s *NginxService) parseAccessLogs(logPath string, cutoffTime time.Time) ([]LogEntry, error) {
-	file, err := os.Open(logPath)
+	// Limit zones and auth users live outside the site's file
+	limits, err := s.limitConfigChanges("")
 	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var entries []LogEntry
-	scanner := bufio.NewScanner(file)
-
-	// Increase buffer size for long lines
-	buf := make([]byte, 0, 64*1024)
-	scanner.Buffer(buf, 1024*1024)
-
-	// Nginx combined log format regex:
-	// $remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"
-	// Example: 192.168.1.1 - - [25/Dec/2023:10:15:30 +0000] "GET /page.html HTTP/1.1" 200 1234 "-" "Mozilla/5.0..."
-	logRegex := regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "(\S+) (\S+) ([^"]+)" (\d+) (\d+) "([^"]*)" "([^"]*)"`)
-
-	// For performance, read from end of file if cutoff time is recent
-	// Otherwise read entire file
-	fileInfo, _ := file.Stat()
-	fileSize := fileInfo.Size()
-
-	// If file is large and we only need recent data, start from a reasonable position
-	// For now, we'll read the entire file but optimize later if needed
-	lineCount := 0
-	maxLines := 1000000 // Limit to prevent memory issues
-
-	for scanner.Scan() {
-		lineCount++
-		if lineCount > maxLines {
-			s.log.Warn("Log file too large, truncating analysis", "lines_read", lineCount, "file_size", fileSize)
-			break
-		}
-
-		line := scanner.Text()
-		if line == "" {
-			continue
-		}
-
-		matches := logRegex.FindStringSubmatch(line)
-		if len(matches) < 10 {
-			// Try simpler format if combined format doesn't match
-			simpleEntries := s.parseSimpleLogLine(line, cutoffTime)
-			if len(simpleEntries) > 0 {
-				entries = append(entries, simpleEntries...)
-			}
-			continue
-		}
-
-		// Parse time
-		timeStr := matches[3]
-		logTime, err := s.parseLogTime(timeStr)
-		if err != nil {
-			continue
-		}
-
-		// Skip entries outside time range
-		if logTime.Before(cutoffTime) {
-			continue
-		}
-
-		// Parse status and bytes
-		status, _ := strconv.Atoi(matches[7])
-		bytes, _ := strconv.ParseInt(matches[8], 10, 64)
-
-		entry := LogEntry{
-			IP:        matches[1],
-			Time:      logTime,
-			Method:    matches[4],
-			Path:      matches[5],
-			Status:    status,
-			Bytes:     bytes,
-			Referer:   matches[9],
-			UserAgent: matches[10],
-		}
-
-		entries = append(entries, entry)
+		return err
 	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	users, err := s.htpasswdChange(site)
+	if err != nil {
+		return err
 	}
-
-	return entries, nil
+	changes = append(changes, limits...)
+	return s.applyConfig(append(changes, users)...)
 }
 
-// parseSimpleLogLine attempts to parse a simpler log format
-func (s *NginxService) parseSimpleLogLine(line string, cutoffTime time.Time) []LogEntry {
-	// Try to extract basic info from simpler formats
-	parts := strings.Fields(line)
-	if len(parts) < 7 {
-		return nil
-	}
-
-	// Look for timestamp pattern
-	timePattern := regexp.MustCompile(`\[([^\]]+)\]`)
-	timeMatches := timePattern.FindStringSubmatch(line)
-	if len(timeMatches) < 2 {
-		return nil
-	}
-
-	logTime, err := s.parseLogTime(timeMatches[1])
+// siteConfigChanges returns the file changes that write a site's configuration
+func (s *NginxService) siteConfigChanges(site *models.NginxSite, previous ...*models.NginxSite) ([]nginxFileChange, error) {
+	config, err := s.generateSiteConfig(site)
 	if err != nil {
-		return nil
-	}
-
-	if logTime.Before(cutoffTime) {
-		return nil
-	}
-
-	// Extract IP (first field)
-	ip := parts[0]
-
-	// Extract request (look for quoted string)
-	requestPattern := regexp.MustCompile(`"(\S+) (\S+)`)
-	requestMatches := requestPattern.FindStringSubmatch(line)
-	if len(requestMatches) < 3 {
-		return nil
+		return nil, err
 	}
 
-	method := requestMatches[1]
-	path := requestMatches[2]
+	configPath := s.getSiteConfigPath(site)
+	enabledPath := s.getSiteEnabledPath(site)
 
-	// Extract status code (usually after request)
-	var status int
-	var bytes int64
-	for i, part := range parts {
-		if statusCode, err := strconv.Atoi(part); err == nil && statusCode >= 100 && statusCode < 600 {
-			status = statusCode
-			if i+1 < len(parts) {
-				bytes, _ = strconv.ParseInt(parts[i+1], 10, 64)
-			}
-			break
+	// Files of the previous state are removed when the domain or the enabled state moved them
+	var changes []nginxFileChange
+	for _, prev := range previous {
+		if path := s.getSiteConfigPath(prev); path != configPath {
+			changes = append(changes, nginxFileChange{path: path, remove: true})
 		}
-	}
-
-	if status == 0 {
-		return nil
-	}
-
-	return []LogEntry{{
-		IP:     ip,
-		Time:   logTime,
-		Method: method,
-		Path:   path,
-		Status: status,
-		Bytes:  bytes,
-	}}
-}
-
-// parseLogTime parses nginx log time format
-func (s *NginxService) parseLogTime(timeStr string) (time.Time, error) {
-	// Nginx time format: 25/Dec/2023:10:15:30 +0000
-	formats := []string{
-		"02/Jan/2006:15:04:05 -0700",
-		"02/Jan/2006:15:04:05 +0000",
-		"02/Jan/2006:15:04:05",
-		time.RFC3339,
-		time.RFC3339Nano,
-	}
-
-	for _, format := range formats {
-		if t, err := time.Parse(format, timeStr); err == nil {
-			return t, nil
+		if path := s.getSiteEnabledPath(prev); path != "" && path != enabledPath {
+			changes = append(changes, nginxFileChange{path: path, remove: true})
 		}
 	}
+	changes = append(changes, nginxFileChange{path: configPath, content: []byte(config)})
 
-	return time.Time{}, fmt.Errorf("unable to parse time: %s", timeStr)
-}
-
-// calculateStats calculates statistics from log entries
-func (s *NginxService) calculateStats(entries []LogEntry) map[string]interface{} {
-	if len(entries) == 0 {
-		return s.emptyAnalytics()
-	}
-
-	var totalRequests int64
-	var totalBytes int64
-	uniqueIPs := make(map[string]bool)
-	pathCounts := make(map[string]int64)
-	statusCounts := make(map[int]int64)
-
-	for _, entry := range entries {
-		totalRequests++
-		totalBytes += entry.Bytes
-		uniqueIPs[entry.IP] = true
-
-		// Count paths (normalize by removing query strings)
-		path := entry.Path
-		if idx := strings.Index(path, "?"); idx != -1 {
-			path = path[:idx]
-		}
-		pathCounts[path]++
-
-		// Count status codes
-		statusCounts[entry.Status]++
-	}
-
-	// Get top pages
-	topPages := s.getTopPages(pathCounts, 10)
-
-	// Format bandwidth
-	bandwidth := s.formatBytes(totalBytes)
-
-	return map[string]interface{}{
-		"requests":        totalRequests,
-		"bandwidth":       bandwidth,
-		"bandwidth_bytes": totalBytes,
-		"unique_visitors": len(uniqueIPs),
-		"top_pages":       topPages,
-		"status_codes":    statusCounts,
-		"total_entries":   len(entries),
-	}
-}
-
-// getTopPages returns the top N pages by request count
-func (s *NginxService) getTopPages(pathCounts map[string]int64, n int) []map[string]interface{} {
-	type pageStat struct {
-		Path     string
-		Requests int64
-	}
-
-	var pages []pageStat
-	for path, count := range pathCounts {
-		pages = append(pages, pageStat{Path: path, Requests: count})
-	}
-
-	// Sort by request count (descending)
-	for i := 0; i < len(pages)-1; i++ {
-		for j := i + 1; j < len(pages); j++ {
-			if pages[i].Requests < pages[j].Requests {
-				pages[i], pages[j] = pages[j], pages[i]
+	// Only enabled sites are linked into sites-enabled, relative links also resolve in a container
+	if enabledPath != "" {
+		if site.Enabled {
+			target, err := filepath.Rel(filepath.Dir(enabledPath), configPath)
+			if err != nil {
+				target = configPath
 			}
+			changes = append(changes, nginxFileChange{path: enabledPath, symlink: target})
+		} else {
+			changes = append(changes, nginxFileChange{path: enabledPath, remove: true})
 		}
 	}
-
-	// Take top N
-	if n > len(pages) {
-		n = len(pages)
-	}
-
-	result := make([]map[string]interface{}, n)
-	for i := 0; i < n; i++ {
-		result[i] = map[string]interface{}{
-			"path":     pages[i].Path,
-			"requests": pages[i].Requests,
-		}
-	}
-
-	return result
+	return changes, nil
 }
 
-// formatBytes formats bytes into human-readable format
-func (s *NginxService) formatBytes(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
-	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+// getSiteConfigPath returns the path to the site's nginx config file on this host. Layouts
+// without an enabled directory keep disabled sites out of the included directory.
+func (s *NginxService) getSiteConfigPath(site *models.NginxSite) string {
+	layout := s.Layout()
+	dir := layout.SitesDir
+	if layout.EnabledDir == "" && !site.Enabled {
+		dir = filepath.Join(layout.ConfDir, nginxDisabledDir)
 	}
-	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+	return layout.HostPath(filepath.Join(dir, site.Domain+".conf"))
 }
 
-// emptyAnalytics returns empty analytics data
-func (s *NginxService) emptyAnalytics() map[string]interface{} {
-	return map[string]interface{}{
-		"requests":        int64(0),
-		"bandwidth":       "0 B",
-		"bandwidth_bytes": int64(0),
-		"unique_visitors": 0,
-		"top_pages":       []map[string]interface{}{},
-		"status_codes":    map[int]int64{},
-		"total_entries":   0,
+// getSiteEnabledPath returns the path to the site's enabled symlink, empty when the layout does not link sites
+func (s *NginxService) getSiteEnabledPath(site *models.NginxSite) string {
+	layout := s.Layout()
+	if layout.EnabledDir == "" {
+		return ""
 	}
+	return layout.HostPath(filepath.Join(layout.EnabledDir, site.Domain+".conf"))
 }
 
-// writeSiteConfig writes nginx configuration for a site
-func (s *NginxService) writeSiteConfig(site *models.NginxSite) error {
-	configPath := s.getSiteConfigPath(site)
-	configDir := filepath.Dir(configPath)
-
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return fmt.Errorf("failed to create config directory: %w", err)
-	}
-
-	// Generate config content
-	config, err := s.generateSiteConfig(site)
-	if err != nil {
-		return err
-	}
-
-	// Write config file
-	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
-		return fmt.Errorf("failed to write config file: %w", err)
-	}
-
-	// If site is disabled, remove from sites-enabled
-	if !site.Enabled {
-		enabledPath := s.getSiteEnabledPath(site)
-		os.Remove(enabledPath)
-	} else {
-		// Create symlink in sites-enabled
-		enabledPath := s.getSiteEnabledPath(site)
-		os.Remove(enabledPath) // Remove existing symlink if any
-		if err := os.Symlink(configPath, enabledPath); err != nil && !os.IsExist(err) {
-			s.log.Warn("Failed to create symlink", "error", err, "path", enabledPath)
-		}
-	}
-
-	return nil
+// siteLogPath returns the path of a site's access or error log on this host
+func (s *NginxService) siteLogPath(site *models.NginxSite, kind string) string {
+	return s.nginxLogPath(fmt.Sprintf("%s.%s.log", site.Domain, kind))
 }
 
-// getSiteConfigPath returns the path to the site's nginx config file
-func (s *NginxService) getSiteConfigPath(site *models.NginxSite) string {
-	// Use /etc/nginx/sites-available/ as default
-	return fmt.Sprintf("/etc/nginx/sites-available/%s.conf", site.Domain)
-}
-
-// getSiteEnabledPath returns the path to the site's enabled symlink
-func (s *NginxService) getSiteEnabledPath(site *models.NginxSite) string {
-	return fmt.Sprintf("/etc/nginx/sites-enabled/%s.conf", site.Domain)
+// nginxLogPath returns the path of a file in the nginx log directory on this host
+func (s *NginxService) nginxLogPath(name string) string {
+	layout := s.Layout()
+	return layout.HostPath(filepath.Join(layout.LogDir, name))
 }
 
 // generateSiteConfig generates nginx configuration for a site
 func (s *NginxService) generateSiteConfig(site *models.NginxSite) (string, error) {
-	tmpl := `{{if .SSLEnabled}}
+	tmpl := `# Access log format, combined with the request and upstream times or JSON
+{{.AccessLogFormat}}
+
+{{if .SSLEnabled}}
 # HTTP -> HTTPS redirect
 server {
     listen 80;
-    server_name {{.Domain}}{{range .Aliases}} {{.}}{{end}};
-    return 301 https://$server_name$request_uri;
+    server_name {{.ServerNames}};
+
+    # ACME HTTP-01 challenges
+    location ^~ /.well-known/acme-challenge/ {
+        root {{.ACMEWebroot}};
+        default_type "text/plain";
+    }
+
+    location / {
+        return 301 https://{{or .CanonicalName "$server_name"}}$request_uri;
+    }
 }
 {{end}}
 
 # Main server block
 server {
     listen {{.Port}}{{if .SSLEnabled}} ssl http2{{end}};
-    server_name {{.Domain}}{{range .Aliases}} {{.}}{{end}};
+    server_name {{.ServerNames}};
+
+    # ACME HTTP-01 challenges
+    location ^~ /.well-known/acme-challenge/ {
+        root {{.ACMEWebroot}};
+        default_type "text/plain";
+        {{- if .Restricted}}
+        allow all;
+        auth_basic off;
+        {{- end}}
+    }
 
     {{if .SSLEnabled}}
+    {{if and .SSLCertPath (not (custom "ssl_certificate" "ssl_certificate_key"))}}
     # SSL configuration
     ssl_certificate {{.SSLCertPath}};
     ssl_certificate_key {{.SSLKeyPath}};
-    {{if .SSLChainPath}}
+    {{end}}
+    {{if and .SSLChainPath (not (custom "ssl_trusted_certificate"))}}
     ssl_trusted_certificate {{.SSLChainPath}};
     {{end}}
     
+    {{if not (custom "ssl_session_timeout" "ssl_session_cache" "ssl_session_tickets" "ssl_protocols" "ssl_ciphers" "ssl_prefer_server_ciphers")}}
     # SSL optimization
     ssl_session_timeout 1d;
     ssl_session_cache shared:SSL:50m;
@@ -817,24 +583,102 @@ server {
     ssl_protocols TLSv1.2 TLSv1.3;
     ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384;
     ssl_prefer_server_ciphers off;
+    {{end}}
     
     # HSTS
     add_header Strict-Transport-Security "max-age=63072000" always;
     {{end}}
 
+    {{if not (custom "gzip" "gzip_vary" "gzip_min_length" "gzip_proxied" "gzip_types")}}
     # Gzip compression
     gzip on;
     gzip_vary on;
     gzip_min_length 1024;
     gzip_proxied any;
     gzip_types text/plain text/css text/xml text/javascript application/javascript application/xml+rss application/json image/svg+xml;
+    {{end}}
 
     # Security headers
     add_header X-Frame-Options "SAMEORIGIN" always;
     add_header X-Content-Type-Options "nosniff" always;
     add_header X-XSS-Protection "1; mode=block" always;
 
+    {{if .Access}}
+    # Access control
+    {{- range .Access}}
+    {{.}}
+    {{- end}}
+    {{end}}
+
+    {{if .CanonicalName}}
+    # Canonical host
+    if ($host = {{.OtherName}}) {
+        return 301 $scheme://{{.CanonicalName}}$request_uri;
+    }
+    {{end}}
+
+    {{if .Redirects}}
+    # Redirects and rewrites
+    {{- range .Redirects}}
+    {{.}}
+    {{- end}}
+    {{end}}
+
+    {{if .ErrorPages}}
+    # Error pages
+    {{- range .ErrorPages}}
+    {{.}}
+    {{- end}}
+    {{end}}
+
+    {{if .CustomConfig}}
+    # Custom configuration, its regex locations take precedence over the generated ones
+{{.CustomConfig}}
+    {{end}}
+
+    {{if .Locations}}
+    # Location rules
+    {{end}}
+    {{range .Locations}}
+    location {{.Match}} {
+        {{- range .Access}}
+        {{.}}
+        {{- end}}
+        {{- if .Proxy}}
+        proxy_pass {{.ProxyPass}};
+        proxy_http_version 1.1;
+        {{- range .Headers}}
+        proxy_set_header {{.Name}} {{.Value}};
+        {{- end}}
+        {{- if .ConnectTimeout}}
+        proxy_connect_timeout {{.ConnectTimeout}}s;
+        {{- end}}
+        {{- if .SendTimeout}}
+        proxy_send_timeout {{.SendTimeout}}s;
+        {{- end}}
+        {{- if .ReadTimeout}}
+        proxy_read_timeout {{.ReadTimeout}}s;
+        {{- end}}
+        {{- if .NoBuffering}}
+        proxy_buffering off;
+        {{- end}}
+        {{- if .NoRequestBuffer}}
+        proxy_request_buffering off;
+        {{- end}}
+        {{- else if .Alias}}
+        alias {{.Root}};
+        {{- else}}
+        root {{.Root}};
+        try_files $uri $uri/ =404;
+        {{- end}}
+        {{- range .ResponseHeaders}}
+        add_header {{.Name}} {{.Value}} always;
+        {{- end}}
+    }
+    {{end}}
+
     {{if .ProxyEnabled}}
+    {{if not (customLocation "/")}}
     # Reverse proxy configuration
     location / {
         proxy_pass {{.ProxyTarget}};
@@ -851,74 +695,140 @@ server {
         proxy_send_timeout 60s;
         proxy_read_timeout 60s;
     }
+    {{end}}
     {{else}}
     # Static/PHP file serving
+    {{if not (custom "root")}}
     root {{.RootPath}};
+    {{end}}
+    {{if not (custom "index")}}
     index index.html index.htm index.php;
+    {{end}}
 
+    {{if not (customLocation "~* \\.(js|css|png|jpg|jpeg|gif|ico|svg|woff|woff2|ttf|eot)$")}}
     # Cache static assets
     location ~* \.(js|css|png|jpg|jpeg|gif|ico|svg|woff|woff2|ttf|eot)$ {
         expires 1y;
         add_header Cache-Control "public, immutable";
     }
+    {{end}}
 
-    {{if .PHPEnabled}}
+    {{if and .PHPEnabled (not (customLocation "~ \\.php$"))}}
     # PHP configuration
     location ~ \.php$ {
-        fastcgi_pass unix:/var/run/php/php{{.PHPVersion}}-fpm.sock;
+        fastcgi_pass {{.FastCGIPass}};
         fastcgi_index index.php;
         fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
         include fastcgi_params;
     }
     {{end}}
 
+    {{if not (customLocation "/")}}
     # Main location
     location / {
         try_files $uri $uri/ /index.html;
     }
     {{end}}
-
-    {{if .CustomConfig}}
-    # Custom configuration
-{{.CustomConfig}}
     {{end}}
 
+    {{if not (customLocation "~ /\\.")}}
     # Disable access to hidden files
     location ~ /\. {
         deny all;
     }
+    {{end}}
 
     # Logging
-    access_log /var/log/nginx/{{.Domain}}.access.log;
-    error_log /var/log/nginx/{{.Domain}}.error.log;
+    {{if not (custom "access_log")}}
+    access_log {{.LogDir}}/{{.Domain}}.access.log {{.LogFormatName}};
+    {{end}}
+    {{if not (custom "error_log")}}
+    error_log {{.LogDir}}/{{.Domain}}.error.log;
+    {{end}}
 }
 `
 
-	t := template.Must(template.New("nginx").Parse(tmpl))
+	// Directives and locations of the custom configuration and the site's location rules
+	// replace the generated ones
+	layout := s.Layout()
+	overrides := parseNginxOverrides(site.Config, layout)
+	locations, err := s.siteLocations(site.ID)
+	if err != nil {
+		return "", err
+	}
+	for i := range locations {
+		overrides.locations[siteLocationKey(&locations[i])] = true
+	}
+	locationViews, err := s.siteLocationViews(site, locations)
+	if err != nil {
+		return "", err
+	}
+	t := template.Must(template.New("nginx").Funcs(template.FuncMap{
+		"custom":         overrides.hasDirective,
+		"customLocation": overrides.hasLocation,
+	}).Parse(tmpl))
 
 	// Get SSL certificate paths if SSL is enabled
 	var sslCertPath, sslKeyPath, sslChainPath string
 	if site.SSLEnabled && site.SSLCertID != "" {
 		var cert models.SSLCertificate
 		if err := s.db.First(&cert, "id = ?", site.SSLCertID).Error; err == nil {
-			sslCertPath = cert.CertPath
-			sslKeyPath = cert.KeyPath
-			sslChainPath = cert.ChainPath
+			sslCertPath = layout.NginxPath(cert.CertPath)
+			sslKeyPath = layout.NginxPath(cert.KeyPath)
+			sslChainPath = layout.NginxPath(cert.ChainPath)
 		}
 	}
 
+	// nginx needs an absolute webroot
+	acmeWebroot, err := filepath.Abs(s.cfg.ACME.WebrootDir)
+	if err != nil {
+		return "", err
+	}
+
+	serverNames, canonical, other := siteServerNames(site)
+
 	data := struct {
 		*models.NginxSite
 		SSLCertPath  string
 		SSLKeyPath   string
 		SSLChainPath string
 		CustomConfig string
+		ACMEWebroot  string
+		LogDir       string
+		FastCGIPass  string
+		Locations    []siteLocation
+
+		LogFormatName   string
+		AccessLogFormat string
+
+		ServerNames   string
+		CanonicalName string
+		OtherName     string
+		Access        []string
+		Restricted    bool // the ACME challenges must stay reachable
+		Redirects     []string
+		ErrorPages    []string
 	}{
 		NginxSite:    site,
 		SSLCertPath:  sslCertPath,
 		SSLKeyPath:   sslKeyPath,
 		SSLChainPath: sslChainPath,
 		CustomConfig: site.Config,
+		ACMEWebroot:  layout.NginxPath(acmeWebroot),
+		LogDir:       layout.LogDir,
+		FastCGIPass:  layout.FastCGIPass(site.PHPVersion),
+		Locations:    locationViews,
+
+		LogFormatName:   "vpanel_" + site.ID,
+		AccessLogFormat: accessLogFormat("vpanel_"+site.ID, site.LogFormat),
+
+		ServerNames:   strings.Join(serverNames, " "),
+		CanonicalName: canonical,
+		OtherName:     other,
+		Access:        accessDirectives(site.Access, site.ID, s.htpasswdPath(site)),
+		Restricted:    restrictsClients(site.Access),
+		Redirects:     redirectDirectives(site),
+		ErrorPages:    errorPageDirectives(site),
 	}
 
 	var buf bytes.Buffer
@@ -926,5 +836,24 @@ server {
 		return "", fmt.Errorf("failed to generate config: %w", err)
 	}
 
-	return buf.String(), nil
+	return collapseBlankLines(buf.String()), nil
+}
+
+// collapseBlankLines reduces the runs of blank lines left by template conditions to one
+func collapseBlankLines(text string) string {
+	var b strings.Builder
+	blank := false
+	for _, line := range strings.Split(strings.TrimLeft(text, "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			if !blank {
+				b.WriteString("\n")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
 }
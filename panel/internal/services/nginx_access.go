@@ -0,0 +1,521 @@
+package services
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+const (
+	// Rate and connection limit zones of all sites are written to one file next to the site configurations
+	nginxLimitsFile = "vpanel-limits.conf"
+
+	// Directory of the configuration that holds a htpasswd file per site
+	nginxHtpasswdDir = "vpanel-htpasswd"
+
+	// Size of a limit zone, one megabyte keeps about 16 thousand client addresses
+	nginxLimitZoneSize = "10m"
+)
+
+var (
+	authUsername = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+	bodySize     = regexp.MustCompile(`^\d+[kKmMgG]?$`)
+	siteDomain   = regexp.MustCompile(`^(\*\.|\.)?[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*(\.\*)?$`)
+)
+
+// Flags of the rewrite directive by redirect status, 0 rewrites internally
+var redirectFlags = map[int]string{
+	0:   "last",
+	301: "permanent",
+	302: "redirect",
+}
+
+// ListAuthUsers returns the basic auth users of a site
+func (s *NginxService) ListAuthUsers(siteID string) ([]models.NginxAuthUser, error) {
+	if _, err := s.GetSite(siteID); err != nil {
+		return nil, err
+	}
+	var users []models.NginxAuthUser
+	if err := s.db.Where("site_id = ?", siteID).Order("username ASC").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// CreateAuthUser adds a basic auth user to a site's htpasswd file
+func (s *NginxService) CreateAuthUser(siteID, username, password string) (*models.NginxAuthUser, error) {
+	site, err := s.GetSite(siteID)
+	if err != nil {
+		return nil, err
+	}
+	if !authUsername.MatchString(username) {
+		return nil, fmt.Errorf("%w: invalid username %q", ErrInvalidSiteRule, username)
+	}
+	var existing models.NginxAuthUser
+	if err := s.db.Where("site_id = ? AND username = ?", siteID, username).First(&existing).Error; err == nil {
+		return nil, fmt.Errorf("user %s already exists", username)
+	}
+
+	hash, err := apr1Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &models.NginxAuthUser{SiteID: site.ID, Username: username, PasswordHash: hash}
+	if err := s.db.Create(user).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.writeSiteConfig(site); err != nil {
+		s.db.Unscoped().Delete(user)
+		return nil, err
+	}
+
+	s.log.Info("Nginx auth user created", "site_id", site.ID, "username", username)
+	return user, nil
+}
+
+// UpdateAuthUser changes the password of a basic auth user
+func (s *NginxService) UpdateAuthUser(siteID, id, password string) error {
+	site, err := s.GetSite(siteID)
+	if err != nil {
+		return err
+	}
+	var user models.NginxAuthUser
+	if err := s.db.First(&user, "id = ? AND site_id = ?", id, siteID).Error; err != nil {
+		return fmt.Errorf("%w: %s", ErrAuthUserNotFound, id)
+	}
+
+	hash, err := apr1Hash(password)
+	if err != nil {
+		return err
+	}
+	previous := user.PasswordHash
+	if err := s.db.Model(&user).Update("password_hash", hash).Error; err != nil {
+		return err
+	}
+
+	if err := s.writeSiteConfig(site); err != nil {
+		s.db.Model(&user).Update("password_hash", previous)
+		return err
+	}
+
+	s.log.Info("Nginx auth user updated", "site_id", site.ID, "username", user.Username)
+	return nil
+}
+
+// DeleteAuthUser removes a basic auth user from a site's htpasswd file
+func (s *NginxService) DeleteAuthUser(siteID, id string) error {
+	site, err := s.GetSite(siteID)
+	if err != nil {
+		return err
+	}
+	var user models.NginxAuthUser
+	if err := s.db.First(&user, "id = ? AND site_id = ?", id, siteID).Error; err != nil {
+		return fmt.Errorf("%w: %s", ErrAuthUserNotFound, id)
+	}
+
+	if err := s.db.Delete(&user).Error; err != nil {
+		return err
+	}
+
+	if err := s.writeSiteConfig(site); err != nil {
+		s.db.Unscoped().Model(&user).Update("deleted_at", nil)
+		return err
+	}
+
+	s.log.Info("Nginx auth user deleted", "site_id", site.ID, "username", user.Username)
+	return nil
+}
+
+// validateSiteRules checks the server names, access controls, redirects, error pages and
+// log format of a site
+func validateSiteRules(site *models.NginxSite) error {
+	// The domain names the site's files, aliases are written to server_name as they are
+	// and may be quoted regexes like imported ones
+	if !siteDomain.MatchString(site.Domain) {
+		return fmt.Errorf("%w: invalid domain %q", ErrInvalidSiteRule, site.Domain)
+	}
+	for _, alias := range site.Aliases {
+		dirs, err := parseNginxConfig("server_name "+alias+";", "alias")
+		if alias == "" || err != nil || len(dirs) != 1 || len(dirs[0].Args) != 1 {
+			return fmt.Errorf("%w: invalid alias %q", ErrInvalidSiteRule, alias)
+		}
+	}
+
+	if err := validateAccess(&site.Access); err != nil {
+		return err
+	}
+
+	switch site.LogFormat {
+	case "", nginxLogCombined, nginxLogJSON:
+	default:
+		return fmt.Errorf("%w: unknown log format %q", ErrInvalidSiteRule, site.LogFormat)
+	}
+
+	switch site.CanonicalHost {
+	case "":
+	case "www", "apex":
+		if strings.Contains(site.Domain, "*") || net.ParseIP(site.Domain) != nil || !strings.Contains(site.Domain, ".") {
+			return fmt.Errorf("%w: a canonical host needs a domain name", ErrInvalidSiteRule)
+		}
+	default:
+		return fmt.Errorf("%w: unknown canonical host %q", ErrInvalidSiteRule, site.CanonicalHost)
+	}
+
+	for _, r := range site.Redirects {
+		flag, ok := redirectFlags[r.Code]
+		if !ok {
+			return fmt.Errorf("%w: unsupported redirect code %d", ErrInvalidSiteRule, r.Code)
+		}
+		switch r.Match {
+		case "exact", "prefix":
+			if !strings.HasPrefix(r.From, "/") {
+				return fmt.Errorf("%w: redirect path %q must start with /", ErrInvalidSiteRule, r.From)
+			}
+		case "regex":
+		default:
+			return fmt.Errorf("%w: unknown redirect match %q", ErrInvalidSiteRule, r.Match)
+		}
+		// Paths are matched decoded and may contain spaces, the target is sent as is
+		if r.From == "" || r.To == "" || strings.ContainsAny(r.From, "\r\n") || strings.ContainsAny(r.To, " \t\r\n") {
+			return fmt.Errorf("%w: invalid redirect from %q to %q", ErrInvalidSiteRule, r.From, r.To)
+		}
+		// A URL always redirects, nginx cannot rewrite to another host internally
+		if flag == "last" && !strings.HasPrefix(r.To, "/") {
+			return fmt.Errorf("%w: an internal rewrite needs a path, not %q", ErrInvalidSiteRule, r.To)
+		}
+	}
+
+	for _, p := range site.ErrorPages {
+		if len(p.Codes) == 0 {
+			return fmt.Errorf("%w: an error page needs status codes", ErrInvalidSiteRule)
+		}
+		for _, code := range p.Codes {
+			if code < 300 || code > 599 {
+				return fmt.Errorf("%w: invalid error page status %d", ErrInvalidSiteRule, code)
+			}
+		}
+		if strings.ContainsAny(p.Page, " \t\r\n;{}\"'") ||
+			!(strings.HasPrefix(p.Page, "/") || strings.HasPrefix(p.Page, "http://") || strings.HasPrefix(p.Page, "https://")) {
+			return fmt.Errorf("%w: invalid error page %q", ErrInvalidSiteRule, p.Page)
+		}
+	}
+	return nil
+}
+
+// validateAccess checks access controls and fills in their defaults
+func validateAccess(access *models.NginxAccess) error {
+	for _, addr := range append(append([]string{}, access.Allow...), access.Deny...) {
+		if net.ParseIP(addr) == nil {
+			if _, _, err := net.ParseCIDR(addr); err != nil {
+				return fmt.Errorf("%w: invalid address %q", ErrInvalidSiteRule, addr)
+			}
+		}
+	}
+	if access.BasicAuth {
+		if access.AuthRealm == "" {
+			access.AuthRealm = "Restricted"
+		}
+		if strings.ContainsAny(access.AuthRealm, "\r\n") {
+			return fmt.Errorf("%w: invalid auth realm", ErrInvalidSiteRule)
+		}
+	} else {
+		access.AuthRealm = ""
+	}
+	if access.Satisfy != "" && access.Satisfy != "all" && access.Satisfy != "any" {
+		return fmt.Errorf("%w: satisfy must be all or any", ErrInvalidSiteRule)
+	}
+	if access.RateLimit < 0 || access.RateBurst < 0 || access.ConnLimit < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidSiteRule)
+	}
+	if access.RateLimit == 0 {
+		access.RateBurst = 0
+	}
+	if access.MaxBodySize != "" && !bodySize.MatchString(access.MaxBodySize) {
+		return fmt.Errorf("%w: invalid max body size %q", ErrInvalidSiteRule, access.MaxBodySize)
+	}
+	return nil
+}
+
+// accessDirectives renders access controls, id names the limit zones and userFile is
+// the htpasswd file of the site
+func accessDirectives(access models.NginxAccess, id, userFile string) []string {
+	var lines []string
+	// The first matching rule wins, denials go before the allowed ranges they narrow
+	for _, addr := range access.Deny {
+		lines = append(lines, "deny "+addr+";")
+	}
+	for _, addr := range access.Allow {
+		lines = append(lines, "allow "+addr+";")
+	}
+	if len(access.Allow) > 0 {
+		lines = append(lines, "deny all;")
+	}
+	if access.BasicAuth {
+		lines = append(lines, "auth_basic "+quoteNginxArg(access.AuthRealm)+";", "auth_basic_user_file "+userFile+";")
+	}
+	if access.Satisfy == "any" {
+		lines = append(lines, "satisfy any;")
+	}
+	if access.RateLimit > 0 {
+		limit := "limit_req zone=" + limitZone("req", id)
+		if access.RateBurst > 0 {
+			limit += fmt.Sprintf(" burst=%d nodelay", access.RateBurst)
+		}
+		lines = append(lines, limit+";", "limit_req_status 429;")
+	}
+	if access.ConnLimit > 0 {
+		lines = append(lines, fmt.Sprintf("limit_conn %s %d;", limitZone("conn", id), access.ConnLimit), "limit_conn_status 429;")
+	}
+	if access.MaxBodySize != "" {
+		lines = append(lines, "client_max_body_size "+access.MaxBodySize+";")
+	}
+	return lines
+}
+
+// restrictsClients reports whether access controls keep some clients out
+func restrictsClients(access models.NginxAccess) bool {
+	return access.BasicAuth || len(access.Allow) > 0 || len(access.Deny) > 0
+}
+
+// redirectDirectives renders the redirect and rewrite rules of a site
+func redirectDirectives(site *models.NginxSite) []string {
+	var lines []string
+	for _, r := range site.Redirects {
+		pattern, replacement := r.From, r.To
+		switch r.Match {
+		case "exact":
+			pattern = "^" + regexp.QuoteMeta(r.From) + "$"
+		case "prefix":
+			pattern = "^" + regexp.QuoteMeta(r.From) + "(.*)$"
+			replacement += "$1"
+		}
+		lines = append(lines, fmt.Sprintf("rewrite %s %s %s;", quoteNginxArg(pattern), quoteNginxArg(replacement), redirectFlags[r.Code]))
+	}
+	return lines
+}
+
+// errorPageDirectives renders the custom error pages of a site
+func errorPageDirectives(site *models.NginxSite) []string {
+	var lines []string
+	for _, p := range site.ErrorPages {
+		codes := make([]string, len(p.Codes))
+		for i, code := range p.Codes {
+			codes[i] = fmt.Sprint(code)
+		}
+		lines = append(lines, fmt.Sprintf("error_page %s %s;", strings.Join(codes, " "), p.Page))
+	}
+	return lines
+}
+
+// siteServerNames returns the names a site answers to and the host the others redirect
+// to, the other one of www and apex is added when a canonical host is set
+func siteServerNames(site *models.NginxSite) ([]string, string, string) {
+	names := append([]string{site.Domain}, site.Aliases...)
+	if site.CanonicalHost == "" {
+		return names, "", ""
+	}
+
+	apex := strings.TrimPrefix(site.Domain, "www.")
+	canonical, other := "www."+apex, apex
+	if site.CanonicalHost == "apex" {
+		canonical, other = apex, "www."+apex
+	}
+	for _, name := range []string{canonical, other} {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, canonical, other
+}
+
+// limitZone returns the name of the rate or connection limit zone of a site or a location
+func limitZone(kind, id string) string {
+	return "vpanel_" + kind + "_" + id
+}
+
+// limitConfigChanges returns the file changes that write the limit zones of all sites
+// and locations, except those of the site being deleted
+func (s *NginxService) limitConfigChanges(excludeSiteID string) ([]nginxFileChange, error) {
+	var sites []models.NginxSite
+	if err := s.db.Where("id != ?", excludeSiteID).Order("created_at ASC").Find(&sites).Error; err != nil {
+		return nil, err
+	}
+	var locations []models.NginxLocation
+	if err := s.db.Where("site_id != ?", excludeSiteID).Order("created_at ASC").Find(&locations).Error; err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	zones := func(id string, access models.NginxAccess) {
+		if access.RateLimit > 0 {
+			lines = append(lines, fmt.Sprintf("limit_req_zone $binary_remote_addr zone=%s:%s rate=%dr/s;",
+				limitZone("req", id), nginxLimitZoneSize, access.RateLimit))
+		}
+		if access.ConnLimit > 0 {
+			lines = append(lines, fmt.Sprintf("limit_conn_zone $binary_remote_addr zone=%s:%s;", limitZone("conn", id), nginxLimitZoneSize))
+		}
+	}
+	for _, site := range sites {
+		zones(site.ID, site.Access)
+	}
+	for _, loc := range locations {
+		zones(loc.ID, loc.Access)
+	}
+
+	if len(lines) == 0 {
+		return s.httpConfigChanges(nginxLimitsFile, "")
+	}
+	return s.httpConfigChanges(nginxLimitsFile, "# Managed by VPanel, changes to this file are overwritten\n"+strings.Join(lines, "\n")+"\n")
+}
+
+// htpasswdChange returns the change that writes a site's htpasswd file, the file is
+// removed when the site has no users
+func (s *NginxService) htpasswdChange(site *models.NginxSite) (nginxFileChange, error) {
+	path := s.Layout().HostPath(s.htpasswdPath(site))
+	var users []models.NginxAuthUser
+	if err := s.db.Where("site_id = ?", site.ID).Find(&users).Error; err != nil {
+		return nginxFileChange{}, err
+	}
+	if len(users) == 0 {
+		return nginxFileChange{path: path, remove: true}, nil
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	var b strings.Builder
+	for _, user := range users {
+		b.WriteString(user.Username + ":" + user.PasswordHash + "\n")
+	}
+	return nginxFileChange{path: path, content: []byte(b.String())}, nil
+}
+
+// htpasswdPath returns the path of a site's htpasswd file as nginx sees it
+func (s *NginxService) htpasswdPath(site *models.NginxSite) string {
+	return filepath.Join(s.Layout().ConfDir, nginxHtpasswdDir, site.ID)
+}
+
+// decodeSiteUpdates converts the JSON columns of a site update, which arrive as generic
+// maps and lists, to their column types
+func decodeSiteUpdates(updates map[string]interface{}) error {
+	columns := map[string]interface{}{}
+	for _, key := range []string{"aliases", "access", "redirects", "error_pages"} {
+		if value, ok := updates[key]; ok {
+			columns[key] = value
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+	var site models.NginxSite
+	if err := json.Unmarshal(data, &site); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSiteRule, err)
+	}
+	for key := range columns {
+		switch key {
+		case "aliases":
+			updates[key] = site.Aliases
+		case "access":
+			updates[key] = site.Access
+		case "redirects":
+			updates[key] = site.Redirects
+		case "error_pages":
+			updates[key] = site.ErrorPages
+		}
+	}
+	return nil
+}
+
+// apr1Hash hashes a password with the Apache MD5 scheme, which nginx verifies on every
+// platform unlike the crypt(3) schemes that depend on the C library
+func apr1Hash(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("%w: the password is empty", ErrInvalidSiteRule)
+	}
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	salt := make([]byte, len(raw))
+	for i, b := range raw {
+		salt[i] = apr1Alphabet[int(b)%len(apr1Alphabet)]
+	}
+	return apr1Crypt(password, string(salt)), nil
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt implements the $apr1$ variant of the FreeBSD MD5 crypt
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(16, i)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 == 1 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 == 1 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return b.String()
+}
+
+// Errors
+var (
+	ErrInvalidSiteRule  = errors.New("invalid site rule")
+	ErrAuthUserNotFound = errors.New("auth user not found")
+)
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+func TestValidateSiteRules(t *testing.T) {
+	site := func(configure func(*models.NginxSite)) models.NginxSite {
+		s := models.NginxSite{Domain: "example.com"}
+		configure(&s)
+		return s
+	}
+	tests := []struct {
+		name string
+		site models.NginxSite
+		ok   bool
+	}{
+		{"plain", site(func(s *models.NginxSite) {}), true},
+		{"wildcard", site(func(s *models.NginxSite) { s.Domain = "*.example.com" }), true},
+		{"address", site(func(s *models.NginxSite) { s.Domain = "192.168.1.10" }), true},
+		{"aliases", site(func(s *models.NginxSite) { s.Aliases = []string{"www.example.com", `"~^(www\.)?example\.org$"`} }), true},
+		{"domain with a path", site(func(s *models.NginxSite) { s.Domain = "../../etc/nginx/nginx" }), false},
+		{"domain with directives", site(func(s *models.NginxSite) { s.Domain = "a.com; include /etc/passwd" }), false},
+		{"empty domain", site(func(s *models.NginxSite) { s.Domain = "" }), false},
+		{"alias with directives", site(func(s *models.NginxSite) { s.Aliases = []string{"a.com; } server { listen 81"} }), false},
+		{"alias comment", site(func(s *models.NginxSite) { s.Aliases = []string{"#"} }), false},
+		{"unterminated alias", site(func(s *models.NginxSite) { s.Aliases = []string{`"a.com`} }), false},
+		{"empty alias", site(func(s *models.NginxSite) { s.Aliases = []string{""} }), false},
+		{"log format", site(func(s *models.NginxSite) { s.LogFormat = "xml" }), false},
+		{"canonical host", site(func(s *models.NginxSite) { s.CanonicalHost = "www" }), true},
+		{"canonical host of a wildcard", site(func(s *models.NginxSite) { s.Domain, s.CanonicalHost = "*.example.com", "apex" }), false},
+		{"canonical host of an address", site(func(s *models.NginxSite) { s.Domain, s.CanonicalHost = "10.0.0.1", "www" }), false},
+		{"unknown canonical host", site(func(s *models.NginxSite) { s.CanonicalHost = "m" }), false},
+		{"redirects", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{
+				{Match: "exact", From: "/old page", To: "/new", Code: 301},
+				{Match: "prefix", From: "/blog/", To: "https://blog.example.com/", Code: 302},
+				{Match: "regex", From: `^/(\d+)$`, To: "/item?id=$1", Code: 0},
+			}
+		}), true},
+		{"redirect code", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{{Match: "exact", From: "/a", To: "/b", Code: 307}}
+		}), false},
+		{"redirect match", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{{Match: "glob", From: "/a", To: "/b", Code: 301}}
+		}), false},
+		{"relative redirect path", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{{Match: "prefix", From: "a", To: "/b", Code: 301}}
+		}), false},
+		{"redirect target with a space", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{{Match: "exact", From: "/a", To: "/b c", Code: 301}}
+		}), false},
+		{"redirect newline", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{{Match: "exact", From: "/a\n", To: "/b", Code: 301}}
+		}), false},
+		{"internal rewrite to a URL", site(func(s *models.NginxSite) {
+			s.Redirects = models.NginxRedirects{{Match: "exact", From: "/a", To: "https://b.example.com/", Code: 0}}
+		}), false},
+		{"error pages", site(func(s *models.NginxSite) {
+			s.ErrorPages = models.NginxErrorPages{{Codes: []int{404}, Page: "/404.html"}, {Codes: []int{502, 503}, Page: "https://status.example.com"}}
+		}), true},
+		{"error page without codes", site(func(s *models.NginxSite) { s.ErrorPages = models.NginxErrorPages{{Page: "/e.html"}} }), false},
+		{"error page code", site(func(s *models.NginxSite) { s.ErrorPages = models.NginxErrorPages{{Codes: []int{200}, Page: "/e.html"}} }), false},
+		{"error page injection", site(func(s *models.NginxSite) {
+			s.ErrorPages = models.NginxErrorPages{{Codes: []int{404}, Page: "/e.html; deny all"}}
+		}), false},
+		{"relative error page", site(func(s *models.NginxSite) { s.ErrorPages = models.NginxErrorPages{{Codes: []int{404}, Page: "e.html"}} }), false},
+		{"access", site(func(s *models.NginxSite) {
+			s.Access = models.NginxAccess{Allow: []string{"10.0.0.0/8", "::1"}, BasicAuth: true, Satisfy: "any", RateLimit: 5, RateBurst: 10, MaxBodySize: "10m"}
+		}), true},
+		{"address rule", site(func(s *models.NginxSite) { s.Access.Deny = []string{"all; allow all"} }), false},
+		{"auth realm", site(func(s *models.NginxSite) { s.Access = models.NginxAccess{BasicAuth: true, AuthRealm: "a\nb"} }), false},
+		{"satisfy", site(func(s *models.NginxSite) { s.Access.Satisfy = "none" }), false},
+		{"negative limit", site(func(s *models.NginxSite) { s.Access.ConnLimit = -1 }), false},
+		{"body size", site(func(s *models.NginxSite) { s.Access.MaxBodySize = "10m; deny all" }), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSiteRules(&tt.site)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("validateSiteRules() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidSiteRule) {
+				t.Errorf("validateSiteRules() error = %v, want ErrInvalidSiteRule", err)
+			}
+		})
+	}
+}
+
+func TestValidateAccessDefaults(t *testing.T) {
+	access := models.NginxAccess{BasicAuth: true, RateBurst: 5}
+	if err := validateAccess(&access); err != nil {
+		t.Fatal(err)
+	}
+	if access.AuthRealm != "Restricted" || access.RateBurst != 0 {
+		t.Errorf("validateAccess() = realm %q, burst %d, want Restricted and no burst without a rate", access.AuthRealm, access.RateBurst)
+	}
+
+	access = models.NginxAccess{AuthRealm: "left over"}
+	if err := validateAccess(&access); err != nil {
+		t.Fatal(err)
+	}
+	if access.AuthRealm != "" {
+		t.Errorf("realm %q kept without basic auth", access.AuthRealm)
+	}
+}
+
+func TestAccessDirectives(t *testing.T) {
+	tests := []struct {
+		name   string
+		access models.NginxAccess
+		want   []string
+	}{
+		{"none", models.NginxAccess{}, nil},
+		{
+			"addresses",
+			models.NginxAccess{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}},
+			[]string{"deny 10.0.0.1;", "allow 10.0.0.0/8;", "deny all;"},
+		},
+		{"deny only", models.NginxAccess{Deny: []string{"::1"}}, []string{"deny ::1;"}},
+		{
+			"basic auth",
+			models.NginxAccess{BasicAuth: true, AuthRealm: `Team "A"; area`, Allow: []string{"10.0.0.0/8"}, Satisfy: "any"},
+			[]string{"allow 10.0.0.0/8;", "deny all;", `auth_basic "Team \"A\"; area";`, "auth_basic_user_file /etc/nginx/vpanel-htpasswd/site;", "satisfy any;"},
+		},
+		{
+			"limits",
+			models.NginxAccess{RateLimit: 5, RateBurst: 10, ConnLimit: 3, MaxBodySize: "20m"},
+			[]string{"limit_req zone=vpanel_req_loc burst=10 nodelay;", "limit_req_status 429;", "limit_conn vpanel_conn_loc 3;", "limit_conn_status 429;", "client_max_body_size 20m;"},
+		},
+		{"rate without burst", models.NginxAccess{RateLimit: 5}, []string{"limit_req zone=vpanel_req_loc;", "limit_req_status 429;"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := accessDirectives(tt.access, "loc", "/etc/nginx/vpanel-htpasswd/site")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("accessDirectives() = %q, want %q", got, tt.want)
+			}
+			if _, err := parseNginxConfig(strings.Join(got, "\n"), "access"); err != nil {
+				t.Errorf("directives do not parse: %v", err)
+			}
+		})
+	}
+}
+
+func TestRedirectDirectives(t *testing.T) {
+	tests := []struct {
+		redirect models.NginxRedirect
+		want     string // arguments of the rewrite as nginx reads them
+	}{
+		{models.NginxRedirect{Match: "exact", From: "/old.html", To: "/new.html", Code: 301}, `^/old\.html$ /new.html permanent`},
+		{models.NginxRedirect{Match: "prefix", From: "/blog/", To: "https://blog.example.com/", Code: 302}, `^/blog/(.*)$ https://blog.example.com/$1 redirect`},
+		{models.NginxRedirect{Match: "regex", From: `^/item/(\d+)$`, To: "/item?id=$1", Code: 0}, `^/item/(\d+)$ /item?id=$1 last`},
+		{models.NginxRedirect{Match: "exact", From: "/a b{2}", To: "/c", Code: 301}, `^/a b\{2\}$ /c permanent`},
+		{models.NginxRedirect{Match: "exact", From: `/a\n; return 200`, To: "/c", Code: 301}, `^/a\\n; return 200$ /c permanent`},
+		{models.NginxRedirect{Match: "regex", From: `^/x"; deny all; #`, To: "/y", Code: 301}, `^/x"; deny all; # /y permanent`},
+	}
+	for _, tt := range tests {
+		lines := redirectDirectives(&models.NginxSite{Redirects: models.NginxRedirects{tt.redirect}})
+		dirs, err := parseNginxConfig(strings.Join(lines, "\n"), "redirects")
+		if err != nil {
+			t.Errorf("%q: %v", lines, err)
+			continue
+		}
+		if got := nginxArgs(dirs, "rewrite"); len(dirs) != 1 || !reflect.DeepEqual(got, []string{tt.want}) {
+			t.Errorf("redirectDirectives(%+v) = %q, want one rewrite %s", tt.redirect, lines, tt.want)
+		}
+	}
+}
+
+func TestErrorPageDirectives(t *testing.T) {
+	site := &models.NginxSite{ErrorPages: models.NginxErrorPages{
+		{Codes: []int{404}, Page: "/404.html"},
+		{Codes: []int{500, 502, 503}, Page: "https://status.example.com/"},
+	}}
+	want := []string{"error_page 404 /404.html;", "error_page 500 502 503 https://status.example.com/;"}
+	if got := errorPageDirectives(site); !reflect.DeepEqual(got, want) {
+		t.Errorf("errorPageDirectives() = %q, want %q", got, want)
+	}
+}
+
+func TestSiteServerNames(t *testing.T) {
+	tests := []struct {
+		domain, canonical string
+		aliases           []string
+		names             []string
+		to, from          string
+	}{
+		{"example.com", "", []string{"example.org"}, []string{"example.com", "example.org"}, "", ""},
+		{"example.com", "www", nil, []string{"example.com", "www.example.com"}, "www.example.com", "example.com"},
+		{"www.example.com", "apex", nil, []string{"www.example.com", "example.com"}, "example.com", "www.example.com"},
+		{"example.com", "www", []string{"www.example.com"}, []string{"example.com", "www.example.com"}, "www.example.com", "example.com"},
+	}
+	for _, tt := range tests {
+		site := &models.NginxSite{Domain: tt.domain, Aliases: tt.aliases, CanonicalHost: tt.canonical}
+		names, to, from := siteServerNames(site)
+		if !reflect.DeepEqual(names, tt.names) || to != tt.to || from != tt.from {
+			t.Errorf("siteServerNames(%s, %q) = %q, %q, %q, want %q, %q, %q", tt.domain, tt.canonical, names, to, from, tt.names, tt.to, tt.from)
+		}
+	}
+}
+
+func TestApr1Crypt(t *testing.T) {
+	// Hashes from openssl passwd -apr1
+	tests := []struct {
+		password, salt, want string
+	}{
+		{"password", "saltsalt", "$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/"},
+		{"a longer password with spaces and ünï", "x", "$apr1$x$hT5Oabv4WsbTgaVeMGcdi/"},
+		{"", "12345678", "$apr1$12345678$sHuPAw7VA9xjRbJz7zKV7/"},
+	}
+	for _, tt := range tests {
+		if got := apr1Crypt(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1Crypt(%q, %q) = %s, want %s", tt.password, tt.salt, got, tt.want)
+		}
+	}
+
+	hash, err := apr1Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := strings.Split(hash, "$")[2]
+	if len(salt) != 8 || apr1Crypt("secret", salt) != hash {
+		t.Errorf("apr1Hash() = %s does not verify", hash)
+	}
+	if _, err := apr1Hash(""); !errors.Is(err, ErrInvalidSiteRule) {
+		t.Errorf("apr1Hash(\"\") error = %v", err)
+	}
+}
@@ -0,0 +1,622 @@
+package services
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// Keys kept per dimension in a stored period, and client IPs kept to count visitors
+	logStatTopKeys = 20
+	logStatTopIPs  = 100
+
+	// Batches trim their counts to this many times the stored keys once they grow past
+	// ten times that, which bounds the memory of a backfill
+	logBatchKeepFactor = 10
+
+	// Most bytes of a live log read in one run, the rest is read by the next runs
+	nginxIngestChunk = 64 << 20
+
+	// The first line of a log identifies it after rotation, only this much of it is hashed
+	logFingerprintSize = 1024
+)
+
+// Periods of the stored aggregates
+const (
+	logPeriodMinute = "minute"
+	logPeriodHour   = "hour"
+	logPeriodDay    = "day"
+)
+
+var logPeriods = map[string]time.Duration{
+	logPeriodMinute: time.Minute,
+	logPeriodHour:   time.Hour,
+	logPeriodDay:    24 * time.Hour,
+}
+
+// Upper bounds in milliseconds of the upstream time histogram buckets, the last bucket
+// holds everything slower
+var upstreamBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// logStatKey identifies a stored period of a site
+type logStatKey struct {
+	period string
+	time   time.Time
+}
+
+// logBatch aggregates the lines read in one ingestion run of a site
+type logBatch struct {
+	siteID  string
+	cutoffs map[string]time.Time // lines older than these are not aggregated into the period
+	stats   map[logStatKey]*models.NginxLogStat
+	lines   int64
+}
+
+// ingestLoop periodically reads new access log lines of all sites into the aggregates
+func (s *NginxService) ingestLoop() {
+	if s.cfg.Nginx.AnalyticsInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.cfg.Nginx.AnalyticsInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.ingestLogs()
+		<-ticker.C
+	}
+}
+
+// ingestLogs ingests the access logs of all sites and drops expired aggregates
+func (s *NginxService) ingestLogs() {
+	s.ingestMu.Lock()
+	defer s.ingestMu.Unlock()
+
+	var sites []models.NginxSite
+	if err := s.db.Find(&sites).Error; err != nil {
+		s.log.Error("Failed to list sites for log ingestion", "error", err)
+		return
+	}
+	for i := range sites {
+		if err := s.ingestSiteLog(&sites[i]); err != nil {
+			s.log.Warn("Failed to ingest access log", "domain", sites[i].Domain, "error", err)
+		}
+	}
+
+	cutoffs := s.logRetention()
+	for period, cutoff := range cutoffs {
+		s.db.Where("period = ? AND time < ?", period, cutoff).Delete(&models.NginxLogStat{})
+	}
+	s.db.Where("site_id NOT IN (?)", s.db.Model(&models.NginxSite{}).Select("id")).Delete(&models.NginxLogStat{})
+	s.db.Where("site_id NOT IN (?)", s.db.Model(&models.NginxSite{}).Select("id")).Delete(&models.NginxLogCursor{})
+}
+
+// ingestSiteLog reads the lines of a site's access log written since the last run. The
+// first run also reads the rotated logs, a rotated or truncated log is finished from
+// its rotated copy before the new one is read.
+func (s *NginxService) ingestSiteLog(site *models.NginxSite) error {
+	path := s.siteLogPath(site, "access")
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// Rotated and not reopened yet, nginx still writes to the rotated file
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	inode := fileInode(info)
+	fingerprint := logFingerprint(path)
+
+	var cursor models.NginxLogCursor
+	lookup := s.db.Where("site_id = ?", site.ID).Limit(1).Find(&cursor)
+	if lookup.Error != nil {
+		return lookup.Error
+	}
+	found := lookup.RowsAffected > 0
+	batch := &logBatch{siteID: site.ID, cutoffs: s.logRetention(), stats: map[logStatKey]*models.NginxLogStat{}}
+
+	switch {
+	case !found || cursor.Path != path:
+		// The history of a new site or a renamed domain is in the rotated logs
+		for _, rotated := range rotatedLogs(path) {
+			if _, err := batch.readFile(rotated, 0, 0); err != nil {
+				s.log.Warn("Failed to read rotated access log", "path", rotated, "error", err)
+			}
+		}
+		cursor = models.NginxLogCursor{SiteID: site.ID, Path: path}
+	case inode != cursor.Inode || fingerprint != cursor.Fingerprint || info.Size() < cursor.Offset:
+		if cursor.Fingerprint != "" {
+			if rotated := findRotatedLog(path, cursor.Fingerprint); rotated != "" {
+				if _, err := batch.readFile(rotated, cursor.Offset, 0); err != nil {
+					s.log.Warn("Failed to read rotated access log", "path", rotated, "error", err)
+				}
+			}
+		}
+		cursor.Offset = 0
+	}
+
+	read, err := batch.readFile(path, cursor.Offset, nginxIngestChunk)
+	if err != nil {
+		return err
+	}
+	cursor.Offset += read
+	cursor.Inode = inode
+	cursor.Fingerprint = logFingerprint(path)
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := batch.flush(tx); err != nil {
+			return err
+		}
+		return tx.Save(&cursor).Error
+	})
+}
+
+// logRetention returns the time before which the aggregates of each period are dropped
+func (s *NginxService) logRetention() map[string]time.Time {
+	now := time.Now().UTC()
+	days := func(n, fallback int) time.Time {
+		if n <= 0 {
+			n = fallback
+		}
+		return now.AddDate(0, 0, -n)
+	}
+	return map[string]time.Time{
+		logPeriodMinute: days(s.cfg.Nginx.AnalyticsMinuteDays, 7),
+		logPeriodHour:   days(s.cfg.Nginx.AnalyticsHourDays, 90),
+		logPeriodDay:    days(s.cfg.Nginx.AnalyticsDays, 730),
+	}
+}
+
+// readFile aggregates the lines of a log from offset, gzip'd logs are decompressed. A
+// live log is only read up to its last complete line and at most limit bytes when limit
+// is set. It returns the bytes consumed.
+func (b *logBatch) readFile(path string, offset, limit int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	live := !strings.HasSuffix(path, ".gz")
+	if live {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	} else {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		if _, err := io.CopyN(io.Discard, gz, offset); err != nil {
+			return 0, err
+		}
+		r = gz
+	}
+	if limit > 0 {
+		r = io.LimitReader(r, limit)
+	}
+
+	var read int64
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && (err == nil || !live) {
+			read += int64(len(line))
+			if entry, ok := parseAccessLogLine(strings.TrimRight(string(line), "\r\n")); ok {
+				b.add(entry)
+			}
+		}
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// add aggregates an entry into its minute, hour and day
+func (b *logBatch) add(e *AccessLogEntry) {
+	b.lines++
+	for period, size := range logPeriods {
+		if e.Time.Before(b.cutoffs[period]) {
+			continue
+		}
+		key := logStatKey{period: period, time: e.Time.UTC().Truncate(size)}
+		stat := b.stats[key]
+		if stat == nil {
+			stat = newLogStat(b.siteID, period, key.time)
+			b.stats[key] = stat
+		}
+
+		stat.Requests++
+		stat.Bytes += e.Bytes
+		stat.Statuses[strconv.Itoa(e.Status)]++
+		if e.UpstreamTime >= 0 {
+			stat.UpstreamCount++
+			stat.UpstreamHist[upstreamBucket(e.UpstreamTime*1000)]++
+		}
+		path := e.Path
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		stat.Paths[path]++
+		if e.Referer != "" && e.Referer != "-" {
+			stat.Referrers[e.Referer]++
+		}
+		if e.UserAgent != "" && e.UserAgent != "-" {
+			stat.UserAgents[e.UserAgent]++
+		}
+		stat.IPs[e.IP]++
+	}
+
+	// Counts of long backfills are trimmed as they go
+	if b.lines%100000 == 0 {
+		for _, stat := range b.stats {
+			trimLogStat(stat, logBatchKeepFactor)
+		}
+	}
+}
+
+// flush merges the batch into the stored periods
+func (b *logBatch) flush(tx *gorm.DB) error {
+	for key, stat := range b.stats {
+		stat.Visitors = int64(len(stat.IPs))
+
+		var existing models.NginxLogStat
+		lookup := tx.Where("site_id = ? AND period = ? AND time = ?", b.siteID, key.period, key.time).Limit(1).Find(&existing)
+		if lookup.Error != nil {
+			return lookup.Error
+		}
+		if lookup.RowsAffected > 0 {
+			// Addresses already counted in the period are not new visitors
+			for ip := range stat.IPs {
+				if _, ok := existing.IPs[ip]; ok {
+					stat.Visitors--
+				}
+			}
+			stat.Visitors += existing.Visitors
+			mergeLogStat(stat, &existing)
+			stat.ID = existing.ID
+		}
+
+		trimLogStat(stat, 1)
+		stat.UpstreamP50 = histogramPercentile(stat.UpstreamHist, 0.50)
+		stat.UpstreamP95 = histogramPercentile(stat.UpstreamHist, 0.95)
+		if err := tx.Save(stat).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newLogStat(siteID, period string, t time.Time) *models.NginxLogStat {
+	return &models.NginxLogStat{
+		SiteID:       siteID,
+		Period:       period,
+		Time:         t,
+		Statuses:     models.Counts{},
+		UpstreamHist: make(models.Histogram, len(upstreamBuckets)+1),
+		Paths:        models.Counts{},
+		Referrers:    models.Counts{},
+		UserAgents:   models.Counts{},
+		IPs:          models.Counts{},
+	}
+}
+
+// mergeLogStat adds the counts of src to dst
+func mergeLogStat(dst, src *models.NginxLogStat) {
+	dst.Requests += src.Requests
+	dst.Bytes += src.Bytes
+	dst.UpstreamCount += src.UpstreamCount
+	for i, n := range src.UpstreamHist {
+		if i < len(dst.UpstreamHist) {
+			dst.UpstreamHist[i] += n
+		}
+	}
+	for _, pair := range [][2]models.Counts{
+		{dst.Statuses, src.Statuses}, {dst.Paths, src.Paths}, {dst.Referrers, src.Referrers},
+		{dst.UserAgents, src.UserAgents}, {dst.IPs, src.IPs},
+	} {
+		for k, n := range pair[1] {
+			pair[0][k] += n
+		}
+	}
+}
+
+// trimLogStat keeps the most frequent keys of each dimension, factor times the stored number
+func trimLogStat(stat *models.NginxLogStat, factor int) {
+	stat.Paths = topCounts(stat.Paths, logStatTopKeys*factor)
+	stat.Referrers = topCounts(stat.Referrers, logStatTopKeys*factor)
+	stat.UserAgents = topCounts(stat.UserAgents, logStatTopKeys*factor)
+	stat.IPs = topCounts(stat.IPs, logStatTopIPs*factor)
+}
+
+func topCounts(counts models.Counts, n int) models.Counts {
+	if len(counts) <= n {
+		return counts
+	}
+	top := models.Counts{}
+	for _, kv := range sortedCounts(counts, n) {
+		top[kv.Key] = kv.Count
+	}
+	return top
+}
+
+type countEntry struct {
+	Key   string
+	Count int64
+}
+
+// sortedCounts returns the n most frequent keys, most frequent first
+func sortedCounts(counts models.Counts, n int) []countEntry {
+	entries := make([]countEntry, 0, len(counts))
+	for k, c := range counts {
+		entries = append(entries, countEntry{k, c})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func upstreamBucket(ms float64) int {
+	for i, bound := range upstreamBuckets {
+		if ms <= bound {
+			return i
+		}
+	}
+	return len(upstreamBuckets)
+}
+
+// histogramPercentile estimates a percentile in milliseconds, interpolating inside the bucket
+func histogramPercentile(hist models.Histogram, p float64) float64 {
+	var total int64
+	for _, n := range hist {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := p * float64(total)
+	var seen int64
+	for i, n := range hist {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = upstreamBuckets[i-1]
+		}
+		if i >= len(upstreamBuckets) {
+			return lower
+		}
+		upper := upstreamBuckets[i]
+		return math.Round((lower+(upper-lower)*(rank-float64(seen))/float64(n))*100) / 100
+	}
+	return upstreamBuckets[len(upstreamBuckets)-1]
+}
+
+// rotatedLogs returns the rotated copies of a log, oldest first, e.g. access.log.2.gz,
+// access.log.1 and access.log-20240101
+func rotatedLogs(path string) []string {
+	var logs []string
+	for _, pattern := range []string{path + ".*", path + "-*"} {
+		matches, _ := filepath.Glob(pattern)
+		logs = append(logs, matches...)
+	}
+
+	mtimes := map[string]time.Time{}
+	files := logs[:0]
+	for _, log := range logs {
+		info, err := os.Stat(log)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		mtimes[log] = info.ModTime()
+		files = append(files, log)
+	}
+	sort.Slice(files, func(i, j int) bool { return mtimes[files[i]].Before(mtimes[files[j]]) })
+	return files
+}
+
+// findRotatedLog returns the rotated copy of a log that starts with the fingerprinted line
+func findRotatedLog(path, fingerprint string) string {
+	logs := rotatedLogs(path)
+	for i := len(logs) - 1; i >= 0; i-- {
+		if logFingerprint(logs[i]) == fingerprint {
+			return logs[i]
+		}
+	}
+	return ""
+}
+
+// logFingerprint hashes the first line of a log, empty while the log has no complete line
+func logFingerprint(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return ""
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	buf := make([]byte, logFingerprintSize)
+	n, _ := io.ReadFull(r, buf)
+	head := buf[:n]
+	if i := strings.IndexByte(string(head), '\n'); i >= 0 {
+		head = head[:i]
+	} else if n < logFingerprintSize {
+		return ""
+	}
+	sum := sha256.Sum256(head)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// GetAnalytics returns the access log analytics of a site, or of all sites when siteID
+// is empty, between from and to. Ranges are answered from the finest period that
+// covers them, hours and days are counted whole at the edges of the range.
+func (s *NginxService) GetAnalytics(siteID string, from, to time.Time) (map[string]interface{}, error) {
+	if siteID != "" {
+		if _, err := s.GetSite(siteID); err != nil {
+			return nil, err
+		}
+	}
+	if !to.After(from) {
+		return nil, fmt.Errorf("%w: the range ends before it starts", ErrInvalidAnalyticsRange)
+	}
+
+	retention := s.logRetention()
+	period := logPeriodDay
+	switch span := to.Sub(from); {
+	case span <= 48*time.Hour && !from.Before(retention[logPeriodMinute]):
+		period = logPeriodMinute
+	case span <= 62*24*time.Hour && !from.Before(retention[logPeriodHour]):
+		period = logPeriodHour
+	}
+	size := logPeriods[period]
+
+	query := s.db.Where("period = ? AND time >= ? AND time < ?", period, from.UTC().Truncate(size), to.UTC())
+	if siteID != "" {
+		query = query.Where("site_id = ?", siteID)
+	}
+	var stats []models.NginxLogStat
+	if err := query.Order("time ASC").Find(&stats).Error; err != nil {
+		return nil, err
+	}
+
+	// Series are bucketed to at most about 300 points
+	bucket := size
+	for to.Sub(from)/bucket > 300 {
+		bucket *= 2
+	}
+
+	total := newLogStat(siteID, period, from)
+	var series []map[string]interface{}
+	var current *models.NginxLogStat
+	var currentTime time.Time
+	emit := func() {
+		if current == nil {
+			return
+		}
+		series = append(series, map[string]interface{}{
+			"time":           currentTime,
+			"requests":       current.Requests,
+			"bytes":          current.Bytes,
+			"status_classes": statusClasses(current.Statuses),
+			"upstream_p50":   histogramPercentile(current.UpstreamHist, 0.50),
+			"upstream_p95":   histogramPercentile(current.UpstreamHist, 0.95),
+		})
+	}
+	for i := range stats {
+		stat := &stats[i]
+		mergeLogStat(total, stat)
+
+		t := stat.Time.Truncate(bucket)
+		if current == nil || !t.Equal(currentTime) {
+			emit()
+			current, currentTime = newLogStat(siteID, period, t), t
+		}
+		mergeLogStat(current, stat)
+	}
+	emit()
+
+	top := func(counts models.Counts, key string) []map[string]interface{} {
+		result := []map[string]interface{}{}
+		for _, kv := range sortedCounts(counts, 10) {
+			result = append(result, map[string]interface{}{key: kv.Key, "requests": kv.Count})
+		}
+		return result
+	}
+
+	return map[string]interface{}{
+		"from":            from,
+		"to":              to,
+		"period":          period,
+		"requests":        total.Requests,
+		"bandwidth":       s.formatBytes(total.Bytes),
+		"bandwidth_bytes": total.Bytes,
+		"unique_visitors": len(total.IPs), // exact while periods have fewer visitors than the kept IPs
+		"top_pages":       top(total.Paths, "path"),
+		"top_referrers":   top(total.Referrers, "referrer"),
+		"top_user_agents": top(total.UserAgents, "user_agent"),
+		"top_ips":         top(total.IPs, "ip"),
+		"status_codes":    total.Statuses,
+		"status_classes":  statusClasses(total.Statuses),
+		"upstream_count":  total.UpstreamCount,
+		"upstream_p50":    histogramPercentile(total.UpstreamHist, 0.50),
+		"upstream_p95":    histogramPercentile(total.UpstreamHist, 0.95),
+		"total_entries":   total.Requests,
+		"series":          series,
+	}, nil
+}
+
+// statusClasses groups status counts by class, e.g. 2xx
+func statusClasses(statuses models.Counts) map[string]int64 {
+	classes := map[string]int64{"1xx": 0, "2xx": 0, "3xx": 0, "4xx": 0, "5xx": 0}
+	for status, n := range statuses {
+		if status != "" {
+			classes[status[:1]+"xx"] += n
+		}
+	}
+	return classes
+}
+
+// formatBytes formats bytes into human-readable format
+func (s *NginxService) formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Errors
+var (
+	ErrInvalidAnalyticsRange = errors.New("invalid analytics range")
+)
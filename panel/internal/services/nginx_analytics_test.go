@@ -0,0 +1,360 @@
+package services
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// accessLine formats a line of the site log format, upstream is empty when the request
+// was not proxied
+func accessLine(t time.Time, ip, request string, status int, bytes int64, upstream string) string {
+	urt := "-"
+	if upstream != "" {
+		urt = upstream
+	}
+	return fmt.Sprintf(`%s - - [%s] "%s" %d %d "https://ref.example/" "curl/8.0" rt=0.020 urt="%s"`,
+		ip, t.Format("02/Jan/2006:15:04:05 -0700"), request, status, bytes, urt) + "\n"
+}
+
+// newTestAnalytics returns a nginx service logging to a temporary directory and a site
+// whose access log is at the returned path
+func newTestAnalytics(t *testing.T) (*NginxService, *models.NginxSite, string) {
+	t.Helper()
+	s := newTestNginxService(t)
+	if err := s.db.AutoMigrate(&models.NginxLogStat{}, &models.NginxLogCursor{}); err != nil {
+		t.Fatal(err)
+	}
+	s.layout.LogDir = t.TempDir()
+	site := &models.NginxSite{Domain: "example.com", RootPath: "/srv/example"}
+	if err := s.db.Create(site).Error; err != nil {
+		t.Fatal(err)
+	}
+	return s, site, s.siteLogPath(site, "access")
+}
+
+// siteRequests returns the requests stored for a site per period
+func siteRequests(t *testing.T, s *NginxService, site *models.NginxSite) map[string]int64 {
+	t.Helper()
+	var stats []models.NginxLogStat
+	if err := s.db.Where("site_id = ?", site.ID).Find(&stats).Error; err != nil {
+		t.Fatal(err)
+	}
+	requests := map[string]int64{}
+	for _, stat := range stats {
+		requests[stat.Period] += stat.Requests
+	}
+	return requests
+}
+
+// appendLog appends lines to a log
+func appendLog(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		if _, err := f.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpstreamPercentiles(t *testing.T) {
+	buckets := []struct {
+		ms   float64
+		want int
+	}{
+		{0, 0}, {1, 0}, {1.5, 1}, {3, 2}, {100, 6}, {100.1, 7}, {60000, 14}, {90000, 15},
+	}
+	for _, tt := range buckets {
+		if got := upstreamBucket(tt.ms); got != tt.want {
+			t.Errorf("upstreamBucket(%v) = %d, want %d", tt.ms, got, tt.want)
+		}
+	}
+
+	hist := func(counts map[int]int64) models.Histogram {
+		h := make(models.Histogram, len(upstreamBuckets)+1)
+		for i, n := range counts {
+			h[i] = n
+		}
+		return h
+	}
+	tests := []struct {
+		name string
+		hist models.Histogram
+		p    float64
+		want float64
+	}{
+		{"empty", hist(nil), 0.5, 0},
+		{"median inside a bucket", hist(map[int]int64{2: 10}), 0.5, 3.5},
+		{"p95 inside a bucket", hist(map[int]int64{2: 10}), 0.95, 4.85},
+		{"median in the faster bucket", hist(map[int]int64{0: 6, 9: 4}), 0.5, 0.83},
+		{"p95 in the slower bucket", hist(map[int]int64{0: 6, 9: 4}), 0.95, 937.5},
+		{"slower than every bound", hist(map[int]int64{15: 3}), 0.5, 60000},
+	}
+	for _, tt := range tests {
+		if got := histogramPercentile(tt.hist, tt.p); got != tt.want {
+			t.Errorf("%s: histogramPercentile(%v) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestLogBatchAdd(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	batch := &logBatch{
+		siteID:  "site",
+		cutoffs: map[string]time.Time{logPeriodMinute: now, logPeriodHour: now.Add(-24 * time.Hour), logPeriodDay: time.Time{}},
+		stats:   map[logStatKey]*models.NginxLogStat{},
+	}
+	lines := []string{
+		accessLine(now.Add(30*time.Second), "10.0.0.1", "GET /a?page=1 HTTP/1.1", 200, 100, "0.003"),
+		accessLine(now.Add(40*time.Second), "10.0.0.2", "GET /a?page=2 HTTP/1.1", 404, 50, ""),
+		accessLine(now.Add(2*time.Minute), "10.0.0.1", "POST /b HTTP/1.1", 502, 10, "0.001, 0.002"),
+		// Older than the minute and hour retention, only kept per day
+		accessLine(now.Add(-48*time.Hour), "10.0.0.3", "GET /old HTTP/1.1", 200, 1, ""),
+	}
+	for _, line := range lines {
+		entry, ok := parseAccessLogLine(line[:len(line)-1])
+		if !ok {
+			t.Fatalf("line not parsed: %s", line)
+		}
+		batch.add(entry)
+	}
+
+	counts := map[string]int{}
+	for key := range batch.stats {
+		counts[key.period]++
+	}
+	if want := map[string]int{logPeriodMinute: 2, logPeriodHour: 1, logPeriodDay: 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("periods = %v, want %v", counts, want)
+	}
+
+	hour := batch.stats[logStatKey{logPeriodHour, now}]
+	if hour == nil {
+		t.Fatal("no hour stored")
+	}
+	if hour.Requests != 3 || hour.Bytes != 160 || hour.UpstreamCount != 2 {
+		t.Errorf("hour: %d requests, %d bytes, %d upstream", hour.Requests, hour.Bytes, hour.UpstreamCount)
+	}
+	if want := (models.Counts{"200": 1, "404": 1, "502": 1}); !reflect.DeepEqual(hour.Statuses, want) {
+		t.Errorf("statuses = %v", hour.Statuses)
+	}
+	if want := (models.Counts{"/a": 2, "/b": 1}); !reflect.DeepEqual(hour.Paths, want) {
+		t.Errorf("paths = %v, want the query removed", hour.Paths)
+	}
+	if want := (models.Counts{"10.0.0.1": 2, "10.0.0.2": 1}); !reflect.DeepEqual(hour.IPs, want) {
+		t.Errorf("ips = %v", hour.IPs)
+	}
+	if hour.Referrers["https://ref.example/"] != 3 || hour.UserAgents["curl/8.0"] != 3 {
+		t.Errorf("referrers %v, user agents %v", hour.Referrers, hour.UserAgents)
+	}
+	if hour.UpstreamHist[upstreamBucket(3)] != 2 {
+		t.Errorf("upstream histogram = %v", hour.UpstreamHist)
+	}
+	if minute := batch.stats[logStatKey{logPeriodMinute, now}]; minute == nil || minute.Requests != 2 {
+		t.Errorf("first minute = %+v", minute)
+	}
+}
+
+func TestTopCounts(t *testing.T) {
+	counts := models.Counts{"a": 5, "b": 3, "c": 3, "d": 1}
+	if got := topCounts(counts, 10); !reflect.DeepEqual(got, counts) {
+		t.Errorf("topCounts() under the limit = %v", got)
+	}
+	if got, want := topCounts(counts, 2), (models.Counts{"a": 5, "b": 3}); !reflect.DeepEqual(got, want) {
+		t.Errorf("topCounts() = %v, want %v", got, want)
+	}
+	if got, want := sortedCounts(counts, 3), []countEntry{{"a", 5}, {"b", 3}, {"c", 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedCounts() = %v, want %v", got, want)
+	}
+	if got, want := statusClasses(models.Counts{"200": 3, "204": 1, "301": 2, "503": 4}),
+		map[string]int64{"1xx": 0, "2xx": 4, "3xx": 2, "4xx": 0, "5xx": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("statusClasses() = %v, want %v", got, want)
+	}
+}
+
+func TestIngestSiteLog(t *testing.T) {
+	s, site, path := newTestAnalytics(t)
+	now := time.Now().Add(-time.Hour)
+	line := func(i int) string {
+		return accessLine(now.Add(time.Duration(i)*time.Second), "10.0.0.1", "GET /p HTTP/1.1", 200, 10, "0.005")
+	}
+
+	// Rotated logs are read on the first run, oldest first
+	gzPath := path + ".2.gz"
+	f, err := os.Create(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(line(1) + line(2)))
+	gz.Close()
+	f.Close()
+	appendLog(t, path+".1", line(3))
+	os.Chtimes(gzPath, now, now)
+	os.Chtimes(path+".1", now.Add(time.Minute), now.Add(time.Minute))
+	if got, want := rotatedLogs(path), []string{gzPath, path + ".1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rotatedLogs() = %q, want %q", got, want)
+	}
+
+	// The incomplete last line is read once it is complete
+	partial := line(5)
+	appendLog(t, path, line(4), partial[:20])
+	if err := s.ingestSiteLog(site); err != nil {
+		t.Fatal(err)
+	}
+	if got := siteRequests(t, s, site)[logPeriodDay]; got != 4 {
+		t.Errorf("%d requests after the first run, want 4", got)
+	}
+	appendLog(t, path, partial[20:])
+	if err := s.ingestSiteLog(site); err != nil {
+		t.Fatal(err)
+	}
+	if got := siteRequests(t, s, site)[logPeriodDay]; got != 5 {
+		t.Errorf("%d requests after completing a line, want 5", got)
+	}
+
+	// Lines nginx writes before reopening its log are read from the rotated file
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path+".1", line(6))
+	appendLog(t, path, line(7), line(8))
+	if err := s.ingestSiteLog(site); err != nil {
+		t.Fatal(err)
+	}
+	if got := siteRequests(t, s, site)[logPeriodDay]; got != 8 {
+		t.Errorf("%d requests after rotation, want 8", got)
+	}
+
+	// A truncated log is read again from its start
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path, line(9))
+	if err := s.ingestSiteLog(site); err != nil {
+		t.Fatal(err)
+	}
+	requests := siteRequests(t, s, site)
+	if want := map[string]int64{logPeriodMinute: 9, logPeriodHour: 9, logPeriodDay: 9}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests after truncation = %v, want %v", requests, want)
+	}
+
+	// Nothing new is not counted twice
+	if err := s.ingestSiteLog(site); err != nil {
+		t.Fatal(err)
+	}
+	if got := siteRequests(t, s, site)[logPeriodMinute]; got != 9 {
+		t.Errorf("%d requests after an idle run, want 9", got)
+	}
+
+	var day models.NginxLogStat
+	s.db.Where("site_id = ? AND period = ?", site.ID, logPeriodDay).First(&day)
+	if day.Visitors != 1 || day.UpstreamP50 == 0 {
+		t.Errorf("day: %d visitors, upstream p50 %v", day.Visitors, day.UpstreamP50)
+	}
+}
+
+func TestGetAnalytics(t *testing.T) {
+	s, site, path := newTestAnalytics(t)
+	now := time.Now().UTC().Truncate(time.Hour).Add(-50 * time.Minute) // the lines share their hour and day
+	appendLog(t, path,
+		accessLine(now, "10.0.0.1", "GET / HTTP/1.1", 200, 1000, "0.004"),
+		accessLine(now.Add(time.Second), "10.0.0.2", "GET / HTTP/1.1", 200, 1000, "0.004"),
+		accessLine(now.Add(time.Minute), "10.0.0.1", "GET /missing HTTP/1.1", 404, 24, ""),
+		accessLine(now.Add(2*time.Minute), "10.0.0.3", "POST /api HTTP/1.1", 500, 0, "0.2"),
+	)
+	s.ingestLogs()
+
+	tests := []struct {
+		name   string
+		from   time.Time
+		to     time.Time
+		period string
+		want   int64
+		series int
+	}{
+		{"last hour", now.Add(-30 * time.Minute), now.Add(30 * time.Minute), logPeriodMinute, 4, 3},
+		{"one minute", now.Add(time.Minute), now.Add(2 * time.Minute), logPeriodMinute, 1, 1},
+		{"last week", now.AddDate(0, 0, -6), now.Add(time.Hour), logPeriodHour, 4, 1},
+		{"last year", now.AddDate(-1, 0, 0), now.Add(time.Hour), logPeriodDay, 4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := s.GetAnalytics(site.ID, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			series := result["series"].([]map[string]interface{})
+			if result["period"] != tt.period || result["requests"] != tt.want || len(series) != tt.series {
+				t.Errorf("%v requests per %v in %d points, want %d per %s in %d", result["requests"], result["period"], len(series), tt.want, tt.period, tt.series)
+			}
+		})
+	}
+
+	result, err := s.GetAnalytics("", now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["unique_visitors"] != 3 || result["bandwidth_bytes"] != int64(2024) || result["upstream_count"] != int64(3) {
+		t.Errorf("%v visitors, %v bytes, %v upstream", result["unique_visitors"], result["bandwidth_bytes"], result["upstream_count"])
+	}
+	if want := map[string]int64{"1xx": 0, "2xx": 2, "3xx": 0, "4xx": 1, "5xx": 1}; !reflect.DeepEqual(result["status_classes"], want) {
+		t.Errorf("status classes = %v", result["status_classes"])
+	}
+	pages := result["top_pages"].([]map[string]interface{})
+	if len(pages) != 3 || pages[0]["path"] != "/" || pages[0]["requests"] != int64(2) {
+		t.Errorf("top pages = %v", pages)
+	}
+
+	if _, err := s.GetAnalytics(site.ID, now, now); !errors.Is(err, ErrInvalidAnalyticsRange) {
+		t.Errorf("GetAnalytics() of an empty range error = %v", err)
+	}
+	if _, err := s.GetAnalytics("missing", now.Add(-time.Hour), now); err == nil {
+		t.Error("GetAnalytics() of an unknown site succeeded")
+	}
+
+	// Aggregates of deleted sites are dropped
+	s.db.Delete(site)
+	s.ingestLogs()
+	var count int64
+	s.db.Model(&models.NginxLogStat{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d aggregates kept for a deleted site", count)
+	}
+}
+
+func TestLogFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	first := logFingerprint(write("a.log", "first line\nsecond\n"))
+	if first == "" || logFingerprint(write("b.log", "first line\nother\n")) != first {
+		t.Error("logs starting with the same line have different fingerprints")
+	}
+	if logFingerprint(write("c.log", "another line\n")) == first {
+		t.Error("logs starting with different lines have the same fingerprint")
+	}
+	if logFingerprint(write("d.log", "incomplete")) != "" {
+		t.Error("fingerprint of a log without a complete line")
+	}
+	if logFingerprint(filepath.Join(dir, "missing.log")) != "" {
+		t.Error("fingerprint of a missing log")
+	}
+}
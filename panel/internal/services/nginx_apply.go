@@ -0,0 +1,513 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Files larger than this are copied to the staging tree without rewriting paths
+	nginxStageRewriteLimit = 1 << 20
+
+	// Lines shown around the line an nginx error points to
+	nginxErrorContext = 3
+)
+
+// Matches "nginx: [emerg] unknown directive "foo" in /etc/nginx/sites-enabled/a.conf:12"
+var nginxErrorLine = regexp.MustCompile(`\[(emerg|alert|crit|error)\] (.*?)(?: in (\S+):(\d+))?$`)
+
+// nginxFileChange is a pending change to a file of the nginx configuration
+type nginxFileChange struct {
+	path    string
+	content []byte // written when set
+	symlink string // a symlink to this target is created when set
+	remove  bool
+}
+
+// nginxFileState is the state of a file before a change, used for rollback
+type nginxFileState struct {
+	path    string
+	exists  bool
+	symlink string
+	content []byte
+	mode    os.FileMode
+}
+
+// NginxConfigError is returned when nginx rejects a configuration, it carries the
+// offending file and the lines around the reported line
+type NginxConfigError struct {
+	Message string   `json:"message"`
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line,omitempty"`
+	Context []string `json:"context,omitempty"` // numbered lines around Line
+	Output  string   `json:"output"`
+}
+
+func (e *NginxConfigError) Error() string {
+	if e.File == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s in %s:%d", e.Message, e.File, e.Line)
+}
+
+func (e *NginxConfigError) Unwrap() error {
+	return ErrNginxConfigInvalid
+}
+
+// applyConfig changes nginx configuration files transactionally. The changes are
+// staged in a copy of the configuration tree and tested with nginx -t, then swapped
+// in and nginx is reloaded. The previous files are restored when the test, the swap,
+// the reload or the health check after it fails.
+func (s *NginxService) applyConfig(changes ...nginxFileChange) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	// Without nginx there is nothing to validate against, e.g. on a development machine
+	layout := s.Layout()
+	if !layout.Available {
+		return s.swapConfig(changes)
+	}
+
+	if err := s.testStagedConfig(layout, changes); err != nil {
+		return err
+	}
+
+	previous := make([]nginxFileState, 0, len(changes))
+	for _, ch := range changes {
+		state, err := captureFileState(ch.path)
+		if err != nil {
+			return err
+		}
+		previous = append(previous, state)
+	}
+
+	running := s.nginxRunning(layout)
+	if err := s.swapConfig(changes); err != nil {
+		s.restoreConfig(layout, previous, false)
+		return err
+	}
+	if !running {
+		// The new configuration is used when nginx is started
+		return nil
+	}
+
+	if err := s.reloadAndCheck(layout); err != nil {
+		s.log.Error("Nginx reload failed, restoring previous configuration", "error", err)
+		s.restoreConfig(layout, previous, true)
+		return err
+	}
+	return nil
+}
+
+// testStagedConfig copies the configuration tree to a temporary directory, applies the
+// changes there and runs nginx -t against the copy. The copy of a containerised nginx
+// is made inside its configuration directory so that the container sees it.
+func (s *NginxService) testStagedConfig(layout *NginxLayout, changes []nginxFileChange) error {
+	parent := ""
+	if layout.Container != "" {
+		parent = layout.HostConfDir
+	}
+	dir, err := os.MkdirTemp(parent, nginxStagePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	stage, err := newNginxStage(layout, dir, changes)
+	if err != nil {
+		return err
+	}
+	if err := stage.copy(); err != nil {
+		return fmt.Errorf("failed to stage nginx configuration: %w", err)
+	}
+
+	for _, ch := range changes {
+		change := ch
+		change.path, _ = stage.rebase(ch.path)
+		if ch.content != nil {
+			change.content = stage.rewrite(ch.content)
+		}
+		if ch.symlink != "" {
+			change.symlink = stage.link(ch.path, ch.symlink, false)
+		}
+		if err := applyFileChange(change); err != nil {
+			return fmt.Errorf("failed to stage nginx configuration: %w", err)
+		}
+	}
+
+	conf := filepath.Join(stage.trees[0].nginxCopy, filepath.Base(layout.ConfPath))
+	output, err := s.runInNginx(layout, layout.Binary, "-t", "-q", "-c", conf)
+	if err == nil {
+		return nil
+	}
+	if len(output) == 0 {
+		output = []byte(err.Error())
+	}
+	return parseNginxError(stage.unstage(string(output)), stage)
+}
+
+// nginxStageTree is a directory of the configuration and its copy
+type nginxStageTree struct {
+	host      string // on this host
+	nginx     string // as nginx sees it
+	copy      string // the copy on this host
+	nginxCopy string // the copy as nginx sees it
+}
+
+// nginxStage is a copy of the configuration to test changes against. Besides the
+// configuration directory it holds the directories of changed files outside of it, e.g.
+// a sites directory configured elsewhere, references between them point into the copy.
+type nginxStage struct {
+	layout *NginxLayout
+	trees  []nginxStageTree // the configuration directory first
+
+	toCopy   *strings.Replacer
+	fromCopy *strings.Replacer
+}
+
+// newNginxStage plans a copy in dir of the configuration directory and of the directories
+// outside of it that the changes write to or link to
+func newNginxStage(layout *NginxLayout, dir string, changes []nginxFileChange) (*nginxStage, error) {
+	stage := &nginxStage{layout: layout}
+	stage.add(layout.HostConfDir, dir)
+	for _, ch := range changes {
+		paths := []string{ch.path}
+		if ch.symlink != "" {
+			paths = append(paths, linkTarget(ch.path, ch.symlink, false, layout))
+		}
+		for _, path := range paths {
+			if _, ok := stage.rebase(path); ok {
+				continue
+			}
+			parent := filepath.Dir(path)
+			if pathWithin(layout.HostConfDir, parent) {
+				return nil, fmt.Errorf("%w: %s contains the configuration directory", ErrNginxConfigInvalid, parent)
+			}
+			stage.add(parent, filepath.Join(dir, fmt.Sprintf("%sdir-%d", nginxStagePrefix, len(stage.trees))))
+		}
+	}
+
+	// The longest paths are replaced first, a nested directory has a copy of its own
+	byNginx := append([]nginxStageTree(nil), stage.trees...)
+	sort.Slice(byNginx, func(i, k int) bool { return len(byNginx[i].nginx) > len(byNginx[k].nginx) })
+	var toCopy, fromCopy []string
+	for _, tree := range byNginx {
+		toCopy = append(toCopy, tree.nginx+"/", tree.nginxCopy+"/")
+	}
+	sort.Slice(byNginx, func(i, k int) bool { return len(byNginx[i].nginxCopy) > len(byNginx[k].nginxCopy) })
+	for _, tree := range byNginx {
+		fromCopy = append(fromCopy, tree.nginxCopy, tree.nginx)
+	}
+	stage.toCopy = strings.NewReplacer(toCopy...)
+	stage.fromCopy = strings.NewReplacer(fromCopy...)
+	return stage, nil
+}
+
+func (st *nginxStage) add(host, copy string) {
+	st.trees = append(st.trees, nginxStageTree{
+		host:      host,
+		nginx:     st.layout.NginxPath(host),
+		copy:      copy,
+		nginxCopy: st.layout.NginxPath(copy),
+	})
+}
+
+// rebase returns where a path of this host is in the copy
+func (st *nginxStage) rebase(path string) (string, bool) {
+	return st.find(path, func(tree nginxStageTree) string { return tree.host })
+}
+
+// stagedFile returns the copy of a file named as nginx sees it
+func (st *nginxStage) stagedFile(path string) string {
+	staged, _ := st.find(path, func(tree nginxStageTree) string { return tree.nginx })
+	return staged
+}
+
+// find maps path into the copy of the most specific directory containing it
+func (st *nginxStage) find(path string, dir func(nginxStageTree) string) (string, bool) {
+	best := -1
+	for i, tree := range st.trees {
+		if pathWithin(path, dir(tree)) && (best < 0 || len(dir(tree)) > len(dir(st.trees[best]))) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return path, false
+	}
+	rel, _ := filepath.Rel(dir(st.trees[best]), path)
+	return filepath.Join(st.trees[best].copy, rel), true
+}
+
+// rewrite points the absolute references of a file into the copy
+func (st *nginxStage) rewrite(data []byte) []byte {
+	return []byte(st.toCopy.Replace(string(data)))
+}
+
+// unstage shows references to the copy, e.g. in nginx output, as the original paths
+func (st *nginxStage) unstage(text string) string {
+	return st.fromCopy.Replace(text)
+}
+
+// link returns the target of the copy of a symlink. Targets in the copy are linked
+// relatively, which resolves on this host and in a container alike. Absolute targets of
+// the live tree are as nginx sees them, those of a change are on this host.
+func (st *nginxStage) link(path, target string, live bool) string {
+	abs := linkTarget(path, target, live, st.layout)
+	staged, ok := st.rebase(abs)
+	if !ok {
+		if filepath.IsAbs(target) && live {
+			return target
+		}
+		return st.layout.NginxPath(abs)
+	}
+	linkCopy, _ := st.rebase(path)
+	if rel, err := filepath.Rel(filepath.Dir(linkCopy), staged); err == nil {
+		return rel
+	}
+	return staged
+}
+
+// linkTarget returns the path on this host a symlink at path points to
+func linkTarget(path, target string, live bool, layout *NginxLayout) string {
+	switch {
+	case !filepath.IsAbs(target):
+		return filepath.Join(filepath.Dir(path), target)
+	case live:
+		return layout.HostPath(target)
+	default:
+		return target
+	}
+}
+
+// copy copies the directories of the stage, absolute references to any of them in the
+// files are rewritten to point into the copy
+func (st *nginxStage) copy() error {
+	for _, tree := range st.trees {
+		if err := st.copyTree(tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *nginxStage) copyTree(tree nginxStageTree) error {
+	if _, err := os.Stat(tree.host); os.IsNotExist(err) {
+		// A directory the changes create
+		return os.MkdirAll(tree.copy, 0755)
+	}
+	return filepath.WalkDir(tree.host, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable parts are left out, nginx -t reports them if they are needed
+			if path != tree.host {
+				return nil
+			}
+			return err
+		}
+		rel, _ := filepath.Rel(tree.host, path)
+		target := filepath.Join(tree.copy, rel)
+
+		// Other staging copies are left out
+		if d.IsDir() && strings.HasPrefix(d.Name(), nginxStagePrefix) {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return nil
+			}
+			return os.Symlink(st.link(path, link, true), target)
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			if len(data) <= nginxStageRewriteLimit {
+				data = st.rewrite(data)
+			}
+			return os.WriteFile(target, data, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// swapConfig applies the changes to the live configuration tree
+func (s *NginxService) swapConfig(changes []nginxFileChange) error {
+	for _, ch := range changes {
+		if err := applyFileChange(ch); err != nil {
+			return fmt.Errorf("failed to write nginx configuration: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreConfig puts back the files captured before a change, reloading nginx when asked
+func (s *NginxService) restoreConfig(layout *NginxLayout, previous []nginxFileState, reload bool) {
+	for i := len(previous) - 1; i >= 0; i-- {
+		state := previous[i]
+		change := nginxFileChange{path: state.path, remove: !state.exists, symlink: state.symlink}
+		if state.exists && state.symlink == "" {
+			change.content = state.content
+		}
+		if err := applyFileChange(change); err != nil {
+			s.log.Error("Failed to restore nginx configuration", "path", state.path, "error", err)
+			continue
+		}
+		if change.content != nil {
+			os.Chmod(state.path, state.mode)
+		}
+	}
+
+	if reload {
+		if err := s.reloadNginx(layout); err != nil {
+			s.log.Error("Failed to reload nginx with the previous configuration", "error", err)
+		}
+	}
+}
+
+// reloadAndCheck reloads nginx and checks that the master process survived it
+func (s *NginxService) reloadAndCheck(layout *NginxLayout) error {
+	if err := s.reloadNginx(layout); err != nil {
+		return fmt.Errorf("%w: %v", ErrNginxReloadFailed, err)
+	}
+	s.log.Info("Nginx reloaded successfully")
+
+	// Workers are replaced asynchronously, give the master a moment to apply the configuration
+	time.Sleep(500 * time.Millisecond)
+
+	if !s.nginxRunning(layout) {
+		return fmt.Errorf("%w: nginx master process is not running after reload", ErrNginxReloadFailed)
+	}
+	return nil
+}
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// applyFileChange performs a single change, files and symlinks are replaced atomically
+func applyFileChange(ch nginxFileChange) error {
+	switch {
+	case ch.remove:
+		if err := os.Remove(ch.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case ch.symlink != "":
+		if err := os.MkdirAll(filepath.Dir(ch.path), 0755); err != nil {
+			return err
+		}
+		tmp := fmt.Sprintf("%s.tmp-%d", ch.path, time.Now().UnixNano())
+		if err := os.Symlink(ch.symlink, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, ch.path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	default:
+		if err := os.MkdirAll(filepath.Dir(ch.path), 0755); err != nil {
+			return err
+		}
+		return writeFileAtomic(ch.path, ch.content, 0644)
+	}
+}
+
+func captureFileState(path string) (nginxFileState, error) {
+	state := nginxFileState{path: path}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	state.exists = true
+	state.mode = info.Mode().Perm()
+	if info.Mode()&os.ModeSymlink != 0 {
+		state.symlink, err = os.Readlink(path)
+		return state, err
+	}
+	state.content, err = os.ReadFile(path)
+	return state, err
+}
+
+// parseNginxError extracts the first error of nginx -t output and the lines around it
+// from the staged file
+func parseNginxError(output string, stage *nginxStage) error {
+	cfgErr := &NginxConfigError{Output: strings.TrimSpace(output), Message: strings.TrimSpace(output)}
+
+	for _, line := range strings.Split(output, "\n") {
+		m := nginxErrorLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		cfgErr.Message = m[2]
+		if m[3] != "" {
+			cfgErr.File = m[3]
+			cfgErr.Line, _ = strconv.Atoi(m[4])
+			cfgErr.Context = fileLineContext(stage.stagedFile(m[3]), cfgErr.Line, nginxErrorContext, stage.unstage)
+		}
+		break
+	}
+	if cfgErr.Message == "" {
+		cfgErr.Message = "nginx configuration test failed"
+	}
+	return cfgErr
+}
+
+// fileLineContext returns numbered lines around line, ">" marks the line itself. The
+// lines are shown through unstage, which maps references to the staging copy back.
+func fileLineContext(path string, line, around int, unstage func(string) string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if n < line-around {
+			continue
+		}
+		if n > line+around {
+			break
+		}
+		marker := " "
+		if n == line {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s %4d | %s", marker, n, unstage(scanner.Text())))
+	}
+	return lines
+}
+
+// Errors
+var (
+	ErrNginxConfigInvalid = errors.New("nginx configuration test failed")
+	ErrNginxReloadFailed  = errors.New("nginx reload failed")
+)
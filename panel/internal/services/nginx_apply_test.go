@@ -0,0 +1,312 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// Test nginx whose -t copies the staged tree next to it and fails on "invalid_directive",
+// naming the staged file and line like nginx does. Reloads fail while a marker exists.
+const stageNginxScript = `#!/bin/sh
+echo "$@" >> "$0.log"
+case "$*" in
+*"-s reload"*)
+	if [ -e "$0.fail-reload" ]; then
+		rm "$0.fail-reload"
+		echo "nginx: [emerg] bind() to 0.0.0.0:80 failed (98: Address in use)" >&2
+		exit 1
+	fi
+	exit 0 ;;
+esac
+[ "$1" = "-t" ] || exit 0
+stage=$(dirname "$4")
+rm -rf "$0.staged" && cp -r "$stage" "$0.staged"
+hit=$(grep -rn "invalid_directive" "$stage" | head -n 1)
+[ -z "$hit" ] && exit 0
+file=${hit%%:*}
+rest=${hit#*:}
+echo "nginx: [emerg] unknown directive \"invalid_directive\" in $file:${rest%%:*}" >&2
+echo "nginx: configuration file $4 test failed" >&2
+exit 1
+`
+
+// withStageNginx replaces the test nginx binary with stageNginxScript
+func withStageNginx(t *testing.T, s *NginxService) {
+	t.Helper()
+	if err := os.WriteFile(s.layout.Binary, []byte(stageNginxScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withOutsideSitesDir moves the sites directory of the layout out of the configuration
+// directory and includes it from nginx.conf
+func withOutsideSitesDir(t *testing.T, s *NginxService) string {
+	t.Helper()
+	sites := filepath.Join(filepath.Dir(s.layout.ConfDir), "sites")
+	if err := os.MkdirAll(sites, 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := "events {}\nhttp {\n    include " + sites + "/*.conf;\n}\n"
+	if err := os.WriteFile(s.layout.ConfPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.layout.SitesDir = sites
+	s.layout.EnabledDir = ""
+	return sites
+}
+
+func TestApplyConfigUnavailable(t *testing.T) {
+	s := newTestNginxService(t)
+	s.layout.Available = false
+
+	path := filepath.Join(s.layout.ConfDir, "conf.d", "a.conf")
+	if err := s.applyConfig(nginxFileChange{path: path, content: []byte("a;")}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "a;" {
+		t.Errorf("written %q", data)
+	}
+	if nginxCommands(t, s) != nil {
+		t.Errorf("nginx ran without being available: %q", nginxCommands(t, s))
+	}
+
+	// A write that fails is reported, so is the site it was for
+	blocked := filepath.Join(s.layout.ConfPath, "a.conf")
+	if err := s.applyConfig(nginxFileChange{path: blocked, content: []byte("a;")}); err == nil {
+		t.Error("applyConfig() under a file succeeded")
+	}
+	s.layout.SitesDir = s.layout.ConfPath
+	if err := s.CreateSite(&models.NginxSite{Domain: "example.com", RootPath: "/srv/example"}); err == nil {
+		t.Error("CreateSite() succeeded without writing its configuration")
+	}
+	var count int64
+	s.db.Model(&models.NginxSite{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d sites stored after a failed write", count)
+	}
+}
+
+func TestApplyConfigStagesOutsideSitesDir(t *testing.T) {
+	s := newTestNginxService(t)
+	withStageNginx(t, s)
+	sites := withOutsideSitesDir(t, s)
+	staged := s.layout.Binary + ".staged"
+
+	site := &models.NginxSite{Domain: "example.com", RootPath: "/srv/example", Enabled: true}
+	if err := s.CreateSite(site); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(sites, "example.com.conf")); err != nil {
+		t.Fatalf("site not written: %v", err)
+	}
+
+	// The include of the sites directory points to its staged copy, which has the site
+	conf, err := os.ReadFile(filepath.Join(staged, "nginx.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(conf), sites+"/") {
+		t.Errorf("staged nginx.conf includes the live sites directory:\n%s", conf)
+	}
+	copies, _ := filepath.Glob(filepath.Join(staged, nginxStagePrefix+"*", "example.com.conf"))
+	if len(copies) != 1 {
+		t.Fatalf("staged copies of the site = %q", copies)
+	}
+	if !strings.Contains(string(conf), filepath.Base(filepath.Dir(copies[0]))+"/*.conf") {
+		t.Errorf("staged nginx.conf does not include the staged sites directory:\n%s", conf)
+	}
+
+	// A site nginx rejects is not written and its error names the live file
+	bad := &models.NginxSite{Domain: "bad.example.com", RootPath: "/srv/bad", Enabled: true, Config: "invalid_directive on;"}
+	err = s.CreateSite(bad)
+	var cfgErr *NginxConfigError
+	if !errors.As(err, &cfgErr) || !errors.Is(err, ErrNginxConfigInvalid) {
+		t.Fatalf("CreateSite() error = %v, want a NginxConfigError", err)
+	}
+	if want := filepath.Join(sites, "bad.example.com.conf"); cfgErr.File != want {
+		t.Errorf("error in %q, want %q", cfgErr.File, want)
+	}
+	if cfgErr.Message != `unknown directive "invalid_directive"` || cfgErr.Line == 0 {
+		t.Errorf("error = %q at line %d", cfgErr.Message, cfgErr.Line)
+	}
+	marked := ""
+	for _, line := range cfgErr.Context {
+		if strings.HasPrefix(line, ">") {
+			marked = line
+		}
+	}
+	if !strings.HasSuffix(marked, "| invalid_directive on;") || !strings.Contains(marked, strconv.Itoa(cfgErr.Line)) {
+		t.Errorf("context = %q", cfgErr.Context)
+	}
+	if strings.Contains(cfgErr.Output, nginxStagePrefix) {
+		t.Errorf("output names the staging copy: %q", cfgErr.Output)
+	}
+	if _, err := os.Stat(filepath.Join(sites, "bad.example.com.conf")); !os.IsNotExist(err) {
+		t.Errorf("rejected site written: %v", err)
+	}
+}
+
+func TestApplyConfigStagesLinks(t *testing.T) {
+	s := newTestNginxService(t)
+	withStageNginx(t, s)
+	staged := s.layout.Binary + ".staged"
+
+	site := &models.NginxSite{Domain: "example.com", RootPath: "/srv/example", Enabled: true}
+	if err := s.CreateSite(site); err != nil {
+		t.Fatal(err)
+	}
+	// The link in sites-enabled stays relative, it resolves in the copy
+	link, err := os.Readlink(filepath.Join(s.layout.EnabledDir, "example.com.conf"))
+	if err != nil || link != "../sites-available/example.com.conf" {
+		t.Errorf("enabled link = %q, %v", link, err)
+	}
+	data, err := os.ReadFile(filepath.Join(staged, "sites-enabled", "example.com.conf"))
+	if err != nil || !strings.Contains(string(data), "server_name example.com;") {
+		t.Errorf("staged enabled site = %q, %v", data, err)
+	}
+}
+
+func TestApplyConfigRollback(t *testing.T) {
+	s := newTestNginxService(t)
+	withStageNginx(t, s)
+	if err := os.WriteFile(s.layout.PIDPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(s.layout.ConfDir, "conf.d", "a.conf")
+	created := filepath.Join(s.layout.ConfDir, "conf.d", "b.conf")
+	if err := s.applyConfig(nginxFileChange{path: path, content: []byte("old;")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed reload restores the previous files and reloads them
+	os.WriteFile(s.layout.Binary+".fail-reload", nil, 0644)
+	err := s.applyConfig(nginxFileChange{path: path, content: []byte("new;")}, nginxFileChange{path: created, content: []byte("b;")})
+	if !errors.Is(err, ErrNginxReloadFailed) {
+		t.Fatalf("applyConfig() error = %v, want ErrNginxReloadFailed", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old;" {
+		t.Errorf("after rollback %q", data)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("created file kept after rollback: %v", err)
+	}
+	if got := reloads(t, s); got != 3 {
+		t.Errorf("%d reloads, want the first apply, the failed one and the restore", got)
+	}
+
+	// A rejected configuration is not swapped in at all
+	err = s.applyConfig(nginxFileChange{path: path, content: []byte("invalid_directive;")})
+	if !errors.Is(err, ErrNginxConfigInvalid) {
+		t.Fatalf("applyConfig() error = %v, want ErrNginxConfigInvalid", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old;" {
+		t.Errorf("after a rejected change %q", data)
+	}
+	if got := reloads(t, s); got != 3 {
+		t.Errorf("%d reloads after a rejected change, want 3", got)
+	}
+}
+
+func TestParseNginxError(t *testing.T) {
+	layout := &NginxLayout{ConfDir: "/etc/nginx", HostConfDir: "/etc/nginx"}
+	stage, err := newNginxStage(layout, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		output  string
+		message string
+		file    string
+		line    int
+	}{
+		{
+			"file and line",
+			"nginx: [emerg] unknown directive \"foo\" in /etc/nginx/sites-enabled/a.conf:12\nnginx: configuration file /etc/nginx/nginx.conf test failed",
+			`unknown directive "foo"`, "/etc/nginx/sites-enabled/a.conf", 12,
+		},
+		{
+			"warnings before the error",
+			"nginx: [warn] conflicting server name \"a\" on 0.0.0.0:80, ignored\nnginx: [emerg] host not found in upstream \"app:3000\" in /etc/nginx/conf.d/b.conf:3",
+			`host not found in upstream "app:3000"`, "/etc/nginx/conf.d/b.conf", 3,
+		},
+		{"no file", `nginx: [emerg] no "events" section in configuration`, `no "events" section in configuration`, "", 0},
+		{"alert", "nginx: [alert] could not open error log file: open() \"/var/log/nginx/error.log\" failed", `could not open error log file: open() "/var/log/nginx/error.log" failed`, "", 0},
+		{"not nginx output", "exit status 1", "exit status 1", "", 0},
+		{"no output", "", "nginx configuration test failed", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfgErr *NginxConfigError
+			if err := parseNginxError(tt.output, stage); !errors.As(err, &cfgErr) || !errors.Is(err, ErrNginxConfigInvalid) {
+				t.Fatalf("parseNginxError() = %v", err)
+			}
+			if cfgErr.Message != tt.message || cfgErr.File != tt.file || cfgErr.Line != tt.line {
+				t.Errorf("parseNginxError() = %q in %q:%d, want %q in %q:%d", cfgErr.Message, cfgErr.File, cfgErr.Line, tt.message, tt.file, tt.line)
+			}
+		})
+	}
+}
+
+func TestNginxStage(t *testing.T) {
+	layout := &NginxLayout{ConfDir: "/etc/nginx", HostConfDir: "/etc/nginx"}
+	changes := []nginxFileChange{
+		{path: "/etc/nginx/conf.d/a.conf", content: []byte("a;")},
+		{path: "/srv/sites/example.com.conf", content: []byte("b;")},
+		{path: "/etc/nginx/sites-enabled/example.com.conf", symlink: "../../../srv/sites/example.com.conf"},
+	}
+	stage, err := newNginxStage(layout, "/tmp/stage", changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	external := "/tmp/stage/" + nginxStagePrefix + "dir-1"
+	for path, want := range map[string]string{
+		"/etc/nginx/nginx.conf":       "/tmp/stage/nginx.conf",
+		"/etc/nginx/conf.d/a.conf":    "/tmp/stage/conf.d/a.conf",
+		"/srv/sites/example.com.conf": external + "/example.com.conf",
+	} {
+		if got, ok := stage.rebase(path); !ok || got != want {
+			t.Errorf("rebase(%q) = %q, %v, want %q", path, got, ok, want)
+		}
+	}
+	if got, ok := stage.rebase("/srv/other/x.conf"); ok {
+		t.Errorf("rebase() outside the stage = %q", got)
+	}
+
+	conf := "include /etc/nginx/mime.types;\ninclude /srv/sites/*.conf;\ninclude /etc/nginx-extra/x.conf;\n"
+	want := "include /tmp/stage/mime.types;\ninclude " + external + "/*.conf;\ninclude /etc/nginx-extra/x.conf;\n"
+	if got := string(stage.rewrite([]byte(conf))); got != want {
+		t.Errorf("rewrite() = %q, want %q", got, want)
+	}
+	if got := stage.unstage(want); got != conf {
+		t.Errorf("unstage() = %q, want %q", got, conf)
+	}
+
+	if got := stage.link(changes[2].path, changes[2].symlink, false); got != "../"+nginxStagePrefix+"dir-1/example.com.conf" {
+		t.Errorf("link() = %q", got)
+	}
+	if got := stage.link("/etc/nginx/modules", "/usr/lib/nginx/modules", true); got != "/usr/lib/nginx/modules" {
+		t.Errorf("link() out of the stage = %q", got)
+	}
+	if got := stage.stagedFile("/srv/sites/example.com.conf"); got != external+"/example.com.conf" {
+		t.Errorf("stagedFile() = %q", got)
+	}
+
+	// A directory holding the configuration directory is not copied
+	if _, err := newNginxStage(layout, "/tmp/stage", []nginxFileChange{{path: "/etc/x.conf", content: []byte("x;")}}); !errors.Is(err, ErrNginxConfigInvalid) {
+		t.Errorf("newNginxStage() with /etc error = %v", err)
+	}
+	if !reflect.DeepEqual(stage.trees[0], nginxStageTree{host: "/etc/nginx", nginx: "/etc/nginx", copy: "/tmp/stage", nginxCopy: "/tmp/stage"}) {
+		t.Errorf("first tree = %+v", stage.trees[0])
+	}
+}
@@ -0,0 +1,766 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// Leftover http level directives of an imported file are moved to a file with this prefix
+const nginxImportLeftoverPrefix = "vpanel-import-"
+
+// The panel's ACME location replaces an imported one
+const acmeChallengeLocation = "^~ /.well-known/acme-challenge/"
+
+// Matches the PHP version in a PHP-FPM socket or upstream, e.g. php8.2-fpm.sock
+var phpFPMVersion = regexp.MustCompile(`php-?(\d+(?:\.\d+)?)-fpm`)
+
+// NginxImportScan is the result of scanning the nginx configuration for existing sites
+type NginxImportScan struct {
+	Candidates []NginxImportCandidate `json:"candidates"`
+	Errors     []NginxParseError      `json:"errors"` // files that could not be parsed and are left alone
+}
+
+// NginxImportCandidate is a server block of the existing configuration and the site it
+// would be imported as. An HTTP to HTTPS redirect block for the same names is merged
+// into the candidate of the HTTPS block.
+type NginxImportCandidate struct {
+	Key            string           `json:"key"`    // file:line of the server block
+	Source         string           `json:"source"` // file in sites-enabled or conf.d that loads the block
+	File           string           `json:"file"`
+	Line           int              `json:"line"`
+	Merged         []string         `json:"merged,omitempty"` // keys of redirect blocks merged into this one
+	ServerNames    []string         `json:"server_names"`
+	Listen         []string         `json:"listen"`
+	Root           string           `json:"root,omitempty"`
+	ProxyPass      string           `json:"proxy_pass,omitempty"`
+	SSLCertificate string           `json:"ssl_certificate,omitempty"`
+	SSLKey         string           `json:"ssl_certificate_key,omitempty"`
+	Site           models.NginxSite `json:"site"`
+	Importable     bool             `json:"importable"`
+	Reason         string           `json:"reason,omitempty"`
+	Warnings       []string         `json:"warnings,omitempty"`
+
+	sslChain string
+	redirect bool // plain HTTP block that only redirects to HTTPS
+}
+
+// nginxImportSource is a file of sites-enabled or conf.d and what was parsed from it
+type nginxImportSource struct {
+	path       string
+	directives []*nginxDirective
+	candidates []*NginxImportCandidate
+}
+
+// ScanImport looks for server blocks in the files the http block includes, e.g.
+// sites-enabled and conf.d, that are not managed by the panel yet
+func (s *NginxService) ScanImport() (*NginxImportScan, error) {
+	sources, parseErrors, err := s.scanImportSources()
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &NginxImportScan{Candidates: []NginxImportCandidate{}, Errors: parseErrors}
+	for _, src := range sources {
+		for _, cand := range src.candidates {
+			scan.Candidates = append(scan.Candidates, *cand)
+		}
+	}
+	return scan, nil
+}
+
+// ImportSites adopts the candidates with the given keys as sites. Every server block of
+// a source file has to be imported together because the file is taken out of the
+// configuration; its other directives are kept in a file next to it. The generated
+// configuration replaces the source in a single nginx -t checked change.
+func (s *NginxService) ImportSites(keys []string) ([]models.NginxSite, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no server blocks selected", ErrNginxImport)
+	}
+
+	sources, _, err := s.scanImportSources()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		selected[key] = true
+	}
+
+	var picked []*nginxImportSource
+	found := 0
+	for _, src := range sources {
+		count := 0
+		for _, cand := range src.candidates {
+			if selected[cand.Key] {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+		if count < len(src.candidates) {
+			return nil, fmt.Errorf("%w: all %d server blocks of %s must be imported together", ErrNginxImport, len(src.candidates), src.path)
+		}
+		for _, cand := range src.candidates {
+			if !cand.Importable {
+				return nil, fmt.Errorf("%w: %s: %s", ErrNginxImport, cand.Key, cand.Reason)
+			}
+		}
+		found += count
+		picked = append(picked, src)
+	}
+	if found < len(selected) {
+		return nil, fmt.Errorf("%w: unknown server block, scan the configuration again", ErrNginxImport)
+	}
+
+	domains := make(map[string]string)
+	for _, src := range picked {
+		for _, cand := range src.candidates {
+			if other, ok := domains[cand.Site.Domain]; ok {
+				return nil, fmt.Errorf("%w: %s is served by both %s and %s", ErrNginxImport, cand.Site.Domain, other, cand.Key)
+			}
+			domains[cand.Site.Domain] = cand.Key
+		}
+	}
+
+	var sites []models.NginxSite
+	var createdCerts []string
+	var changes []nginxFileChange
+	var backups []string
+	rollback := func() {
+		for i := range sites {
+			s.db.Unscoped().Delete(&sites[i])
+		}
+		for _, id := range createdCerts {
+			s.db.Unscoped().Delete(&models.SSLCertificate{}, "id = ?", id)
+		}
+		for _, path := range backups {
+			os.Remove(path)
+		}
+	}
+
+	for _, src := range picked {
+		for _, cand := range src.candidates {
+			site := cand.Site
+			if cand.SSLCertificate != "" {
+				cert, created, err := s.importCertificate(cand)
+				if err != nil {
+					rollback()
+					return nil, err
+				}
+				if created {
+					createdCerts = append(createdCerts, cert.ID)
+				}
+				site.SSLCertID = cert.ID
+			}
+
+			if err := s.db.Create(&site).Error; err != nil {
+				rollback()
+				return nil, err
+			}
+			sites = append(sites, site)
+
+			siteChanges, err := s.siteConfigChanges(&site)
+			if err != nil {
+				rollback()
+				return nil, err
+			}
+			changes = append(changes, siteChanges...)
+		}
+
+		srcChanges, backup, err := s.importSourceChanges(src)
+		if backup != "" {
+			backups = append(backups, backup)
+		}
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		changes = append(changes, srcChanges...)
+	}
+
+	if err := s.applyConfig(changes...); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	for _, site := range sites {
+		s.log.Info("Nginx site imported", "site_id", site.ID, "domain", site.Domain)
+	}
+	return sites, nil
+}
+
+// scanImportSources parses the files of the scanned directories and analyses their server blocks
+func (s *NginxService) scanImportSources() ([]*nginxImportSource, []NginxParseError, error) {
+	var sites []models.NginxSite
+	if err := s.db.Find(&sites).Error; err != nil {
+		return nil, nil, err
+	}
+	layout := s.Layout()
+	managed := make(map[string]bool)
+	domains := make(map[string]bool)
+	for i := range sites {
+		managed[s.getSiteConfigPath(&sites[i])] = true
+		managed[s.getSiteEnabledPath(&sites[i])] = true
+		domains[sites[i].Domain] = true
+	}
+	for _, name := range []string{nginxUpstreamsFile, nginxLimitsFile} {
+		path, link := s.httpConfigPaths(name)
+		managed[path], managed[link] = true, true
+	}
+
+	// The files the http block includes, e.g. sites-enabled/* and conf.d/*.conf
+	includes := layout.Includes
+	if len(includes) == 0 {
+		includes = []string{filepath.Join(firstNonEmpty(layout.EnabledDir, layout.SitesDir), "*")}
+	}
+
+	parseErrors := []NginxParseError{}
+	var sources []*nginxImportSource
+	seen := make(map[string]bool)
+	for _, pattern := range includes {
+		for _, path := range resolveNginxInclude(pattern, layout) {
+			if seen[path] || managed[path] || strings.HasPrefix(filepath.Base(path), nginxImportLeftoverPrefix) {
+				continue
+			}
+			seen[path] = true
+			if target, err := filepath.EvalSymlinks(path); err == nil && managed[target] {
+				continue
+			}
+
+			dirs, err := parseNginxFile(path, layout)
+			if err != nil {
+				var parseErr *NginxParseError
+				if errors.As(err, &parseErr) {
+					parseErrors = append(parseErrors, *parseErr)
+				} else {
+					parseErrors = append(parseErrors, NginxParseError{File: path, Message: err.Error()})
+				}
+				continue
+			}
+
+			src := &nginxImportSource{path: path, directives: dirs}
+			for _, block := range findServerBlocks(dirs) {
+				src.candidates = append(src.candidates, analyseServerBlock(path, block, layout))
+			}
+			if len(src.candidates) == 0 {
+				continue
+			}
+			mergeRedirectCandidates(src)
+			s.checkImportCandidates(src, domains)
+			sources = append(sources, src)
+		}
+	}
+	return sources, parseErrors, nil
+}
+
+// checkImportCandidates marks the candidates of a source that cannot be imported, one
+// such candidate blocks the whole source
+func (s *NginxService) checkImportCandidates(src *nginxImportSource, domains map[string]bool) {
+	names := make(map[string]string)
+	for _, cand := range src.candidates {
+		if cand.Importable && domains[cand.Site.Domain] {
+			cand.Importable = false
+			cand.Reason = fmt.Sprintf("a site for %s already exists", cand.Site.Domain)
+		}
+		if other, ok := names[cand.Site.Domain]; ok && cand.Importable {
+			cand.Importable = false
+			cand.Reason = fmt.Sprintf("%s is also served by the server block at %s", cand.Site.Domain, other)
+		}
+		names[cand.Site.Domain] = cand.Key
+	}
+
+	for _, cand := range src.candidates {
+		if cand.Importable {
+			continue
+		}
+		for _, other := range src.candidates {
+			if other.Importable {
+				other.Importable = false
+				other.Reason = fmt.Sprintf("%s also contains the server block at %s that cannot be imported", src.path, cand.Key)
+			}
+		}
+		return
+	}
+}
+
+// importCertificate returns the certificate record for a candidate's ssl_certificate,
+// reusing a record with the same path
+func (s *NginxService) importCertificate(cand *NginxImportCandidate) (*models.SSLCertificate, bool, error) {
+	var existing models.SSLCertificate
+	if err := s.db.Where("cert_path = ?", cand.SSLCertificate).First(&existing).Error; err == nil {
+		return &existing, false, nil
+	}
+
+	cert := &models.SSLCertificate{
+		Type:      "custom",
+		CertPath:  cand.SSLCertificate,
+		KeyPath:   cand.SSLKey,
+		ChainPath: cand.sslChain,
+		AutoRenew: false,
+	}
+	// Certificates nginx already serves are accepted from any CA
+	err := s.CreateCustomCertificate(cert, &CertificateUpload{AllowUntrusted: true}, nil)
+	if err == nil {
+		return cert, true, nil
+	}
+	if !errors.Is(err, ErrCertificateChain) {
+		return nil, false, fmt.Errorf("%s: %w", cand.Key, err)
+	}
+
+	// An expired or incomplete chain is still tracked so that its expiry is alerted
+	leaf, leafErr := loadLeafCertificate(cert.CertPath)
+	if leafErr != nil {
+		return nil, false, fmt.Errorf("%s: %w", cand.Key, err)
+	}
+	applyCustomCertificateMeta(cert, leaf)
+	if err := s.db.Create(cert).Error; err != nil {
+		return nil, false, err
+	}
+	s.log.Warn("Imported certificate does not verify", "cert_id", cert.ID, "path", cert.CertPath, "error", err)
+	return cert, true, nil
+}
+
+// importSourceChanges takes a source file out of the configuration. Symlinks are removed,
+// regular files are backed up first. Directives other than server blocks are moved to
+// a file in the same directory so that they stay loaded.
+func (s *NginxService) importSourceChanges(src *nginxImportSource) ([]nginxFileChange, string, error) {
+	changes := []nginxFileChange{{path: src.path, remove: true}}
+
+	if leftover := importLeftovers(src.directives); hasNginxDirectives(leftover) {
+		name := nginxImportLeftoverPrefix + strings.TrimSuffix(filepath.Base(src.path), ".conf") + ".conf"
+		content := fmt.Sprintf("# Imported from %s by VPanel, the server blocks are managed as sites\n%s",
+			src.path, renderNginxDirectives(leftover, 0))
+		changes = append(changes, nginxFileChange{path: filepath.Join(filepath.Dir(src.path), name), content: []byte(content)})
+	}
+
+	info, err := os.Lstat(src.path)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		// The target stays in place
+		return changes, "", nil
+	}
+
+	data, err := os.ReadFile(src.path)
+	if err != nil {
+		return nil, "", err
+	}
+	rel, err := filepath.Rel(s.Layout().HostConfDir, src.path)
+	if err != nil {
+		rel = filepath.Base(src.path)
+	}
+	backup := filepath.Join(s.cfg.Storage.BackupDir, "nginx-import", time.Now().Format("20060102-150405"), rel)
+	if err := os.MkdirAll(filepath.Dir(backup), 0700); err != nil {
+		return nil, "", err
+	}
+	if err := os.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return nil, "", err
+	}
+	s.log.Info("Backed up imported nginx file", "path", src.path, "backup", backup)
+	return changes, backup, nil
+}
+
+// findServerBlocks returns the http server blocks of a file, including those of included
+// files and of an http block
+func findServerBlocks(dirs []*nginxDirective) []*nginxDirective {
+	var blocks []*nginxDirective
+	for _, d := range flattenNginxIncludes(dirs) {
+		switch {
+		case d.Name == "server" && d.block:
+			blocks = append(blocks, d)
+		case d.Name == "http" && d.block:
+			blocks = append(blocks, findServerBlocks(d.Block)...)
+		}
+	}
+	return blocks
+}
+
+// importLeftovers returns the directives of a source other than its server blocks,
+// includes that pull in server blocks are replaced by their other directives
+func importLeftovers(dirs []*nginxDirective) []*nginxDirective {
+	var rest []*nginxDirective
+	for _, d := range dirs {
+		switch {
+		case d.Name == "server" && d.block:
+			continue
+		case d.Name == "include" && len(findServerBlocks(d.Included)) > 0:
+			rest = append(rest, importLeftovers(d.Included)...)
+		case d.Name == "http" && d.block:
+			rest = append(rest, importLeftovers(d.Block)...)
+		default:
+			rest = append(rest, d)
+		}
+	}
+	return rest
+}
+
+func hasNginxDirectives(dirs []*nginxDirective) bool {
+	for _, d := range dirs {
+		if !d.IsComment() {
+			return true
+		}
+	}
+	return false
+}
+
+// analyseServerBlock maps a server block to a site. The directives the site's fields
+// stand for are lifted out, everything else is kept as written in the site's Config.
+func analyseServerBlock(source string, block *nginxDirective, layout *NginxLayout) *NginxImportCandidate {
+	cand := &NginxImportCandidate{
+		Key:        fmt.Sprintf("%s:%d", block.File, block.Line),
+		Source:     source,
+		File:       block.File,
+		Line:       block.Line,
+		Importable: true,
+		Site:       models.NginxSite{Enabled: true},
+	}
+	fail := func(reason string) {
+		if cand.Importable {
+			cand.Importable = false
+			cand.Reason = reason
+		}
+	}
+	warn := func(format string, args ...interface{}) {
+		cand.Warnings = append(cand.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	count := make(map[string]int)
+	for _, d := range block.Block {
+		count[d.Name]++
+	}
+
+	var rest []*nginxDirective
+	var rootDir *nginxDirective
+	var plainPorts, sslPorts []int
+	legacySSL := false
+	redirects := 0
+	onlyRedirect := true
+
+	for _, d := range block.Block {
+		if d.IsComment() {
+			rest = append(rest, d)
+			continue
+		}
+
+		switch {
+		case d.Name == "server_name":
+			for i, name := range d.Args {
+				if name == "" || name == "_" {
+					continue
+				}
+				cand.ServerNames = append(cand.ServerNames, name)
+				if strings.HasPrefix(name, "~") {
+					// Regex names are written back as they were quoted
+					name = d.raw[i]
+				}
+				if cand.Site.Domain == "" && !strings.HasPrefix(name, "~") {
+					cand.Site.Domain = name
+				} else {
+					cand.Site.Aliases = append(cand.Site.Aliases, name)
+				}
+			}
+			continue
+
+		case d.Name == "listen":
+			cand.Listen = append(cand.Listen, strings.Join(d.Args, " "))
+			port, ssl, extra, err := parseListen(d.Args)
+			if err != nil {
+				fail(err.Error())
+				continue
+			}
+			if len(extra) > 0 {
+				warn("listen %s: %s not kept", strings.Join(d.Args, " "), strings.Join(extra, ", "))
+			}
+			if ssl {
+				sslPorts = appendPort(sslPorts, port)
+			} else {
+				plainPorts = appendPort(plainPorts, port)
+			}
+			continue
+
+		case d.Name == "ssl" && len(d.Args) == 1:
+			legacySSL = d.Arg(0) == "on"
+			continue
+
+		case (d.Name == "ssl_certificate" || d.Name == "ssl_certificate_key" || d.Name == "ssl_trusted_certificate") && count[d.Name] == 1:
+			if strings.Contains(d.Arg(0), "$") {
+				warn("%s %s uses variables, the certificate is not tracked", d.Name, d.Arg(0))
+				rest = append(rest, d)
+				continue
+			}
+			path := d.Arg(0)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(layout.ConfDir, path)
+			}
+			path = layout.HostPath(path)
+			switch d.Name {
+			case "ssl_certificate":
+				cand.SSLCertificate = path
+			case "ssl_certificate_key":
+				cand.SSLKey = path
+			default:
+				cand.sslChain = path
+			}
+			continue
+
+		case d.Name == "root" && len(d.Args) == 1:
+			rootDir = d
+			cand.Root = d.Arg(0)
+			cand.Site.RootPath = d.Arg(0)
+
+		case d.Name == "location" && d.block:
+			key := nginxLocationKey(d.Args)
+			if key == acmeChallengeLocation {
+				warn("the ACME challenge location at line %d is replaced by the panel's", d.Line)
+				continue
+			}
+			if key == "/" {
+				for _, sub := range d.Block {
+					if sub.Name == "proxy_pass" {
+						cand.ProxyPass = sub.Arg(0)
+						cand.Site.ProxyEnabled = true
+						cand.Site.ProxyTarget = sub.Arg(0)
+					}
+				}
+			}
+			for _, sub := range d.Block {
+				if sub.Name == "fastcgi_pass" {
+					if m := phpFPMVersion.FindStringSubmatch(sub.Arg(0)); m != nil {
+						cand.Site.PHPEnabled = true
+						cand.Site.PHPVersion = m[1]
+					}
+				}
+			}
+			if !isRedirectOnly(d.Block, &redirects) {
+				onlyRedirect = false
+			}
+
+		case d.Name == "return":
+			if isHTTPSRedirect(d) {
+				redirects++
+			}
+
+		case d.Name == "if" && d.block:
+			if !isRedirectOnly(d.Block, &redirects) {
+				onlyRedirect = false
+			}
+
+		default:
+			onlyRedirect = false
+		}
+
+		rest = append(rest, d)
+	}
+
+	if count["ssl_certificate"] > 1 {
+		warn("several ssl_certificate directives are kept in the custom configuration")
+	}
+	if legacySSL {
+		for _, port := range plainPorts {
+			sslPorts = appendPort(sslPorts, port)
+		}
+		plainPorts = nil
+	}
+	if len(plainPorts) == 0 && len(sslPorts) == 0 {
+		plainPorts = []int{80}
+	}
+
+	switch {
+	case cand.Site.Domain == "":
+		fail("the server block has no server_name")
+	case len(sslPorts) > 1 || len(plainPorts) > 1 || (len(sslPorts) == 1 && len(plainPorts) == 1 && plainPorts[0] != 80):
+		fail("the server block listens on several ports")
+	case len(sslPorts) == 1:
+		cand.Site.Port = sslPorts[0]
+		cand.Site.SSLEnabled = true
+		if len(plainPorts) == 1 {
+			warn("plain HTTP on port 80 redirects to HTTPS after the import")
+		}
+		if cand.SSLCertificate == "" && !hasNginxDirective(block.Block, "ssl_certificate") {
+			warn("the certificate is inherited from the http block and not tracked")
+		}
+	default:
+		cand.Site.Port = plainPorts[0]
+		cand.redirect = onlyRedirect && redirects > 0
+	}
+
+	// The root of a static site is generated from RootPath, proxies only set it in Config
+	if rootDir != nil && !cand.Site.ProxyEnabled {
+		rest = removeNginxDirective(rest, rootDir)
+	}
+	cand.Site.Name = cand.Site.Domain
+	cand.Site.Config = strings.TrimRight(renderNginxDirectives(rest, 1), "\n")
+	return cand
+}
+
+// mergeRedirectCandidates folds plain HTTP blocks that only redirect to HTTPS into the
+// HTTPS candidate for the same names, the generated configuration has its own redirect
+func mergeRedirectCandidates(src *nginxImportSource) {
+	var kept []*NginxImportCandidate
+	for _, cand := range src.candidates {
+		if !cand.redirect || !cand.Importable {
+			kept = append(kept, cand)
+			continue
+		}
+
+		var target *NginxImportCandidate
+		for _, other := range src.candidates {
+			if other.Site.SSLEnabled && other.Importable && coversNames(other.ServerNames, cand.ServerNames) {
+				target = other
+				break
+			}
+		}
+		if target == nil {
+			kept = append(kept, cand)
+			continue
+		}
+		target.Merged = append(target.Merged, cand.Key)
+		if target.Site.Port != 443 {
+			target.Warnings = append(target.Warnings, "the HTTP redirect points to the default HTTPS port")
+		}
+	}
+	src.candidates = kept
+}
+
+// parseListen returns the port of a listen directive, whether it uses ssl and the
+// parameters a site cannot express
+func parseListen(args []string) (int, bool, []string, error) {
+	if len(args) == 0 {
+		return 0, false, nil, fmt.Errorf("listen without an address")
+	}
+
+	addr := args[0]
+	if strings.HasPrefix(addr, "unix:") {
+		return 0, false, nil, fmt.Errorf("listening on a unix socket is not supported")
+	}
+
+	var extra []string
+	portText := addr
+	if i := strings.LastIndex(addr, ":"); i >= 0 {
+		host := addr[:i]
+		portText = addr[i+1:]
+		if strings.HasPrefix(host, "[") {
+			extra = append(extra, "IPv6 address "+host)
+		} else if host != "*" && host != "0.0.0.0" {
+			extra = append(extra, "address "+host)
+		}
+	} else if strings.HasPrefix(addr, "[") {
+		extra = append(extra, "IPv6 address "+addr)
+		portText = "80"
+	} else if _, err := strconv.Atoi(addr); err != nil {
+		// A bare host listens on port 80
+		extra = append(extra, "address "+addr)
+		portText = "80"
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, false, nil, fmt.Errorf("invalid listen address %s", addr)
+	}
+
+	ssl := false
+	for _, param := range args[1:] {
+		switch param {
+		case "ssl":
+			ssl = true
+		case "http2":
+		default:
+			extra = append(extra, param)
+		}
+	}
+	return port, ssl, extra, nil
+}
+
+// nginxLocationKey normalizes the modifier and pattern of a location, "~\.php$" and
+// "~ \.php$" are the same location
+func nginxLocationKey(args []string) string {
+	if len(args) == 1 {
+		for _, mod := range []string{"^~", "~*", "~", "="} {
+			if rest := strings.TrimPrefix(args[0], mod); rest != args[0] && rest != "" {
+				return mod + " " + rest
+			}
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// isRedirectOnly reports whether a block only returns, counting redirects to HTTPS
+func isRedirectOnly(block []*nginxDirective, redirects *int) bool {
+	for _, d := range block {
+		switch {
+		case d.IsComment():
+		case d.Name == "return":
+			if isHTTPSRedirect(d) {
+				*redirects++
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isHTTPSRedirect(d *nginxDirective) bool {
+	return len(d.Args) == 2 && strings.HasPrefix(d.Arg(0), "30") && strings.HasPrefix(d.Arg(1), "https://")
+}
+
+func removeNginxDirective(dirs []*nginxDirective, remove *nginxDirective) []*nginxDirective {
+	kept := dirs[:0]
+	for _, d := range dirs {
+		if d != remove {
+			kept = append(kept, d)
+		}
+	}
+	return kept
+}
+
+func hasNginxDirective(dirs []*nginxDirective, name string) bool {
+	found := false
+	walkNginxDirectives(dirs, true, func(d *nginxDirective) {
+		if d.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// coversNames reports whether names contains every name of subset
+func coversNames(names, subset []string) bool {
+	if len(subset) == 0 {
+		return false
+	}
+	for _, name := range subset {
+		if !containsString(names, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func appendPort(ports []int, port int) []int {
+	for _, p := range ports {
+		if p == port {
+			return ports
+		}
+	}
+	ports = append(ports, port)
+	sort.Ints(ports)
+	return ports
+}
+
+// Errors
+var (
+	ErrNginxImport = errors.New("cannot import nginx configuration")
+)
@@ -0,0 +1,503 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+const (
+	// Site configurations of layouts without an enabled directory are kept here while disabled
+	nginxDisabledDir = "disabled-sites"
+
+	// Prefix of the staging copies made by applyConfig
+	nginxStagePrefix = ".vpanel-stage-"
+
+	// A layout without a working nginx is detected again after this long
+	nginxRedetectInterval = time.Minute
+
+	nginxCommandTimeout = 30 * time.Second
+)
+
+// nginxFlavorDefaults are used for what cannot be read from nginx itself
+var nginxFlavorDefaults = map[string]struct {
+	sitesDir, enabledDir, phpSocket string
+}{
+	"debian": {"sites-available", "sites-enabled", "unix:/run/php/php{version}-fpm.sock"},
+	"rhel":   {"conf.d", "", "unix:/run/php-fpm/www.sock"},
+	"alpine": {"http.d", "", "127.0.0.1:9000"},
+	"other":  {"conf.d", "", "127.0.0.1:9000"},
+}
+
+// NginxLayout describes where nginx and its configuration live. Paths are as nginx sees
+// them, for a container they are mapped to this host through its bind mounts.
+type NginxLayout struct {
+	Binary       string    `json:"binary"`
+	Version      string    `json:"version"`
+	Available    bool      `json:"available"` // nginx -V succeeded
+	Flavor       string    `json:"flavor"`    // debian, rhel, alpine, other
+	Container    string    `json:"container,omitempty"`
+	ConfPath     string    `json:"conf_path"`
+	ConfDir      string    `json:"conf_dir"`
+	HostConfDir  string    `json:"host_conf_dir"`
+	SitesDir     string    `json:"sites_dir"`
+	EnabledDir   string    `json:"enabled_dir"` // empty when sites are not linked
+	Includes     []string  `json:"includes"`    // include patterns of the http block
+	LogDir       string    `json:"log_dir"`
+	PIDPath      string    `json:"pid_path"`
+	PHPFPMSocket string    `json:"php_fpm_socket"`
+	Reload       string    `json:"reload"` // exec, signal
+	DetectedAt   time.Time `json:"detected_at"`
+
+	mounts []nginxMount
+}
+
+// nginxMount maps a directory of this host into the nginx container
+type nginxMount struct {
+	host  string
+	nginx string
+}
+
+// HostPath maps a path as nginx sees it to this host
+func (l *NginxLayout) HostPath(path string) string {
+	return mapMountPath(path, l.mounts, func(m nginxMount) (string, string) { return m.nginx, m.host })
+}
+
+// NginxPath maps a path of this host to the path nginx sees
+func (l *NginxLayout) NginxPath(path string) string {
+	return mapMountPath(path, l.mounts, func(m nginxMount) (string, string) { return m.host, m.nginx })
+}
+
+// FastCGIPass returns the PHP-FPM address for a PHP version
+func (l *NginxLayout) FastCGIPass(version string) string {
+	pass := strings.ReplaceAll(l.PHPFPMSocket, "{version}", version)
+	if strings.HasPrefix(pass, "/") {
+		pass = "unix:" + pass
+	}
+	return pass
+}
+
+// Layout returns the nginx layout in use
+func (s *NginxService) Layout() *NginxLayout {
+	s.layoutMu.Lock()
+	defer s.layoutMu.Unlock()
+
+	if s.layout == nil || (!s.layout.Available && time.Since(s.layout.DetectedAt) > nginxRedetectInterval) {
+		s.layout = s.detectLayout()
+	}
+	return s.layout
+}
+
+// DetectLayout detects the nginx layout again, e.g. after nginx was installed or moved
+func (s *NginxService) DetectLayout() *NginxLayout {
+	s.layoutMu.Lock()
+	defer s.layoutMu.Unlock()
+
+	s.layout = s.detectLayout()
+	return s.layout
+}
+
+// detectLayout reads the build configuration from nginx -V and the include layout from
+// the main configuration file, configured values take precedence
+func (s *NginxService) detectLayout() *NginxLayout {
+	cfg := s.cfg.Nginx
+	layout := &NginxLayout{
+		Binary:     cfg.Binary,
+		Container:  cfg.Container,
+		Reload:     cfg.Reload,
+		DetectedAt: time.Now(),
+	}
+	if layout.Binary == "" {
+		layout.Binary = "nginx"
+	}
+	if layout.Reload != "signal" {
+		layout.Reload = "exec"
+	}
+
+	if layout.Container != "" {
+		mounts, err := s.containerMounts(layout.Container)
+		if err != nil {
+			s.log.Warn("Failed to inspect nginx container", "container", layout.Container, "error", err)
+		}
+		layout.mounts = mounts
+	}
+
+	// nginx -V prints the build configuration to stderr
+	build := map[string]string{}
+	if output, err := s.runInNginx(layout, layout.Binary, "-V"); err == nil {
+		layout.Available = true
+		layout.Version, build = parseNginxBuild(string(output))
+	} else {
+		s.log.Warn("Failed to detect nginx", "binary", layout.Binary, "container", layout.Container, "error", err)
+	}
+
+	layout.Flavor = s.detectFlavor(layout)
+	defaults := nginxFlavorDefaults[layout.Flavor]
+
+	// Main configuration file
+	layout.ConfPath = firstNonEmpty(cfg.ConfPath, build["conf-path"], "/etc/nginx/nginx.conf")
+	if !filepath.IsAbs(layout.ConfPath) {
+		layout.ConfPath = filepath.Join(firstNonEmpty(build["prefix"], "/etc/nginx"), layout.ConfPath)
+	}
+	layout.ConfDir = filepath.Dir(layout.ConfPath)
+	layout.HostConfDir = layout.HostPath(layout.ConfDir)
+
+	// Include layout and pid file of the main configuration
+	// An included file that does not parse still leaves the main file usable
+	var pidDirective string
+	dirs, err := parseNginxFile(layout.HostPath(layout.ConfPath), layout)
+	if err != nil && !os.IsNotExist(err) {
+		s.log.Warn("Failed to parse nginx configuration", "path", layout.ConfPath, "error", err)
+	}
+	for _, d := range flattenNginxIncludes(dirs) {
+		switch {
+		case d.Name == "pid" && len(d.Args) == 1:
+			pidDirective = d.Arg(0)
+		case d.Name == "http" && d.block:
+			layout.Includes = httpIncludes(d.Block, layout.ConfDir)
+		}
+	}
+
+	sitesDir, enabledDir := includeLayout(layout.Includes)
+	if sitesDir == "" {
+		sitesDir = filepath.Join(layout.ConfDir, defaults.sitesDir)
+		if defaults.enabledDir != "" {
+			enabledDir = filepath.Join(layout.ConfDir, defaults.enabledDir)
+		}
+	}
+	layout.SitesDir = firstNonEmpty(cfg.SitesDir, sitesDir)
+	layout.EnabledDir = firstNonEmpty(cfg.EnabledDir, enabledDir)
+	if layout.EnabledDir == "none" {
+		layout.EnabledDir = ""
+	}
+
+	logDir := ""
+	if path := build["http-log-path"]; path != "" {
+		logDir = filepath.Dir(path)
+	}
+	layout.LogDir = firstNonEmpty(cfg.LogDir, logDir, "/var/log/nginx")
+	layout.PIDPath = firstNonEmpty(cfg.PIDPath, pidDirective, build["pid-path"], "/run/nginx.pid")
+	if !filepath.IsAbs(layout.PIDPath) {
+		layout.PIDPath = filepath.Join(firstNonEmpty(build["prefix"], "/etc/nginx"), layout.PIDPath)
+	}
+	layout.PHPFPMSocket = firstNonEmpty(cfg.PHPFPMSocket, defaults.phpSocket)
+
+	s.log.Info("Nginx layout detected", "available", layout.Available, "version", layout.Version,
+		"flavor", layout.Flavor, "conf", layout.ConfPath, "sites", layout.SitesDir, "container", layout.Container)
+	return layout
+}
+
+// detectFlavor reads the distribution nginx runs on from os-release
+func (s *NginxService) detectFlavor(layout *NginxLayout) string {
+	output, err := s.runInNginx(layout, "cat", "/etc/os-release")
+	if err != nil {
+		return "other"
+	}
+
+	ids := ""
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && (key == "ID" || key == "ID_LIKE") {
+			ids += " " + strings.Trim(value, `"'`)
+		}
+	}
+	for _, id := range strings.Fields(ids) {
+		switch id {
+		case "debian", "ubuntu":
+			return "debian"
+		case "rhel", "centos", "fedora", "rocky", "almalinux", "ol", "amzn":
+			return "rhel"
+		case "alpine":
+			return "alpine"
+		}
+	}
+	return "other"
+}
+
+// runInNginx runs a command where nginx runs, on this host or in its container
+func (s *NginxService) runInNginx(layout *NginxLayout, cmd ...string) ([]byte, error) {
+	if layout.Container == "" {
+		return exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	}
+	return s.dockerExec(layout.Container, cmd)
+}
+
+// runNginx runs the nginx binary with the main configuration file of the layout
+func (s *NginxService) runNginx(layout *NginxLayout, args ...string) ([]byte, error) {
+	cmd := append([]string{layout.Binary}, args...)
+	output, err := s.runInNginx(layout, cmd...)
+	if err != nil && len(output) > 0 {
+		return output, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return output, err
+}
+
+// reloadNginx asks the nginx master to reload its configuration
+func (s *NginxService) reloadNginx(layout *NginxLayout) error {
+	if layout.Reload == "signal" {
+		if layout.Container != "" {
+			if s.docker == nil || s.docker.client == nil {
+				return ErrDockerNotConnected
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), nginxCommandTimeout)
+			defer cancel()
+			return s.docker.client.ContainerKill(ctx, layout.Container, "HUP")
+		}
+		pid := nginxMasterPID(layout.PIDPath)
+		if pid <= 0 {
+			return fmt.Errorf("nginx master process is not running")
+		}
+		return syscall.Kill(pid, syscall.SIGHUP)
+	}
+
+	_, err := s.runNginx(layout, "-c", layout.ConfPath, "-s", "reload")
+	return err
+}
+
+// nginxRunning reports whether the nginx master process is running
+func (s *NginxService) nginxRunning(layout *NginxLayout) bool {
+	if layout.Container == "" {
+		return nginxMasterPID(layout.PIDPath) > 0
+	}
+	if s.docker == nil || s.docker.client == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nginxCommandTimeout)
+	defer cancel()
+	info, err := s.docker.client.ContainerInspect(ctx, layout.Container)
+	return err == nil && info.State != nil && info.State.Running
+}
+
+// containerMounts returns the bind mounts of the nginx container
+func (s *NginxService) containerMounts(container string) ([]nginxMount, error) {
+	if s.docker == nil || s.docker.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nginxCommandTimeout)
+	defer cancel()
+	info, err := s.docker.client.ContainerInspect(ctx, container)
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []nginxMount
+	for _, m := range info.Mounts {
+		if m.Source != "" && m.Destination != "" {
+			mounts = append(mounts, nginxMount{host: filepath.Clean(m.Source), nginx: filepath.Clean(m.Destination)})
+		}
+	}
+	return mounts, nil
+}
+
+// dockerExec runs a command in a container and returns its combined output
+func (s *NginxService) dockerExec(container string, cmd []string) ([]byte, error) {
+	if s.docker == nil || s.docker.client == nil {
+		return nil, ErrDockerNotConnected
+	}
+	cli := s.docker.client
+
+	ctx, cancel := context.WithTimeout(context.Background(), nginxCommandTimeout)
+	defer cancel()
+
+	created, err := cli.ContainerExecCreate(ctx, container, types.ExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return nil, err
+	}
+	attach, err := cli.ContainerExecAttach(ctx, created.ID, types.ExecStartCheck{})
+	if err != nil {
+		return nil, err
+	}
+	defer attach.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil {
+		return output.Bytes(), err
+	}
+
+	inspect, err := cli.ContainerExecInspect(ctx, created.ID)
+	if err != nil {
+		return output.Bytes(), err
+	}
+	if inspect.ExitCode != 0 {
+		return output.Bytes(), fmt.Errorf("exit status %d", inspect.ExitCode)
+	}
+	return output.Bytes(), nil
+}
+
+// parseNginxBuild returns the version and configure arguments printed by nginx -V
+func parseNginxBuild(output string) (string, map[string]string) {
+	version := ""
+	build := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "nginx version:"):
+			v := strings.TrimSpace(strings.TrimPrefix(line, "nginx version:"))
+			if _, after, ok := strings.Cut(v, "/"); ok {
+				v = after
+			}
+			version, _, _ = strings.Cut(v, " ")
+		case strings.HasPrefix(line, "configure arguments:"):
+			for _, arg := range splitShellWords(strings.TrimPrefix(line, "configure arguments:")) {
+				if !strings.HasPrefix(arg, "--") {
+					continue
+				}
+				key, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+				build[key] = value
+			}
+		}
+	}
+	return version, build
+}
+
+// httpIncludes returns the include patterns of an http block as absolute paths
+func httpIncludes(block []*nginxDirective, confDir string) []string {
+	var includes []string
+	for _, d := range block {
+		if d.Name != "include" || len(d.Args) != 1 {
+			continue
+		}
+		pattern := d.Arg(0)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(confDir, pattern)
+		}
+		includes = append(includes, pattern)
+	}
+	return includes
+}
+
+// includeLayout picks the directory sites are written to from the include patterns of
+// the http block. A sites-enabled directory means sites are linked from sites-available.
+func includeLayout(includes []string) (sitesDir, enabledDir string) {
+	var dirs []string
+	for _, pattern := range includes {
+		if !strings.ContainsAny(filepath.Base(pattern), "*?[") {
+			continue
+		}
+		dirs = append(dirs, filepath.Dir(pattern))
+	}
+
+	for _, dir := range dirs {
+		if filepath.Base(dir) == "sites-enabled" {
+			return filepath.Join(filepath.Dir(dir), "sites-available"), dir
+		}
+	}
+	for _, preferred := range []string{"http.d", "conf.d"} {
+		for _, dir := range dirs {
+			if filepath.Base(dir) == preferred {
+				return dir, ""
+			}
+		}
+	}
+	if len(dirs) > 0 {
+		return dirs[0], ""
+	}
+	return "", ""
+}
+
+// mapMountPath maps path through the mount whose side selected by from is its longest prefix
+func mapMountPath(path string, mounts []nginxMount, sides func(nginxMount) (string, string)) string {
+	if path == "" || len(mounts) == 0 {
+		return path
+	}
+	clean := filepath.Clean(path)
+
+	sorted := append([]nginxMount(nil), mounts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, _ := sides(sorted[i])
+		b, _ := sides(sorted[j])
+		return len(a) > len(b)
+	})
+	for _, m := range sorted {
+		from, to := sides(m)
+		if clean == from {
+			return to
+		}
+		if rel := strings.TrimPrefix(clean, from+"/"); rel != clean {
+			return filepath.Join(to, rel)
+		}
+	}
+	return path
+}
+
+// nginxMasterPID returns the pid of the nginx master process, 0 when it is not running
+func nginxMasterPID(pidPath string) int {
+	for _, path := range []string{pidPath, "/run/nginx.pid", "/var/run/nginx.pid"} {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid > 0 && processAlive(pid) {
+			return pid
+		}
+	}
+
+	output, err := exec.Command("pgrep", "-o", "-x", "nginx").Output()
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	return pid
+}
+
+// splitShellWords splits a command line at spaces, honouring single and double quotes
+func splitShellWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,205 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/pkg/logger"
+)
+
+func TestParseNginxBuild(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		version string
+		build   map[string]string
+	}{
+		{
+			"debian",
+			"nginx version: nginx/1.22.1\nbuilt with OpenSSL 3.0.9 30 May 2023\nTLS SNI support enabled\n" +
+				"configure arguments: --with-cc-opt='-g -O2 -ffile-prefix-map=/build/nginx=. -fstack-protector-strong' " +
+				"--prefix=/usr/share/nginx --conf-path=/etc/nginx/nginx.conf --http-log-path=/var/log/nginx/access.log " +
+				"--pid-path=/run/nginx.pid --with-http_ssl_module\n",
+			"1.22.1",
+			map[string]string{
+				"with-cc-opt":          "-g -O2 -ffile-prefix-map=/build/nginx=. -fstack-protector-strong",
+				"prefix":               "/usr/share/nginx",
+				"conf-path":            "/etc/nginx/nginx.conf",
+				"http-log-path":        "/var/log/nginx/access.log",
+				"pid-path":             "/run/nginx.pid",
+				"with-http_ssl_module": "",
+			},
+		},
+		{
+			"openresty with a suffix",
+			"nginx version: openresty/1.21.4.3 (custom)\nconfigure arguments: --prefix=/usr/local/openresty/nginx \"--with-ld-opt=-Wl,-rpath,/usr/local/lib\"\n",
+			"1.21.4.3",
+			map[string]string{"prefix": "/usr/local/openresty/nginx", "with-ld-opt": "-Wl,-rpath,/usr/local/lib"},
+		},
+		{"no configure arguments", "nginx version: nginx/1.25.3\n", "1.25.3", map[string]string{}},
+		{"not nginx", "sh: nginx: not found\n", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, build := parseNginxBuild(tt.output)
+			if version != tt.version {
+				t.Errorf("version = %q, want %q", version, tt.version)
+			}
+			if !reflect.DeepEqual(build, tt.build) {
+				t.Errorf("build = %q, want %q", build, tt.build)
+			}
+		})
+	}
+}
+
+func TestIncludeLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		sites    string
+		enabled  string
+	}{
+		{
+			"sites-enabled before conf.d",
+			[]string{"/etc/nginx/mime.types", "/etc/nginx/conf.d/*.conf", "/etc/nginx/sites-enabled/*"},
+			"/etc/nginx/sites-available", "/etc/nginx/sites-enabled",
+		},
+		{"http.d", []string{"/etc/nginx/mime.types", "/etc/nginx/http.d/*.conf"}, "/etc/nginx/http.d", ""},
+		{"http.d before conf.d", []string{"/etc/nginx/conf.d/*.conf", "/etc/nginx/http.d/*.conf"}, "/etc/nginx/http.d", ""},
+		{"conf.d before other directories", []string{"/opt/vhosts/*.conf", "/etc/nginx/conf.d/*.conf"}, "/etc/nginx/conf.d", ""},
+		{"first other directory", []string{"/opt/vhosts/*.conf", "/srv/nginx/*.conf"}, "/opt/vhosts", ""},
+		{"only files", []string{"/etc/nginx/mime.types", "/etc/nginx/conf.d/default.conf"}, "", ""},
+		{"no includes", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sites, enabled := includeLayout(tt.includes)
+			if sites != tt.sites || enabled != tt.enabled {
+				t.Errorf("includeLayout() = %q, %q, want %q, %q", sites, enabled, tt.sites, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestMapMountPath(t *testing.T) {
+	layout := &NginxLayout{mounts: []nginxMount{
+		{host: "/srv/nginx", nginx: "/etc/nginx"},
+		{host: "/srv/nginx-sites", nginx: "/etc/nginx/sites-enabled"},
+		{host: "/srv/www", nginx: "/var/www"},
+	}}
+	tests := []struct {
+		nginx string
+		host  string
+	}{
+		{"/etc/nginx/nginx.conf", "/srv/nginx/nginx.conf"},
+		{"/etc/nginx", "/srv/nginx"},
+		{"/etc/nginx/sites-enabled/a.conf", "/srv/nginx-sites/a.conf"},
+		{"/etc/nginx/sites-enabled", "/srv/nginx-sites"},
+		{"/etc/nginx/sites-enabled-old/a.conf", "/srv/nginx/sites-enabled-old/a.conf"},
+		{"/var/www/html/index.html", "/srv/www/html/index.html"},
+		{"/var/log/nginx/access.log", "/var/log/nginx/access.log"},
+		{"/etc/nginxx/a.conf", "/etc/nginxx/a.conf"},
+	}
+	for _, tt := range tests {
+		if got := layout.HostPath(tt.nginx); got != tt.host {
+			t.Errorf("HostPath(%q) = %q, want %q", tt.nginx, got, tt.host)
+		}
+		if got := layout.NginxPath(tt.host); got != tt.nginx {
+			t.Errorf("NginxPath(%q) = %q, want %q", tt.host, got, tt.nginx)
+		}
+	}
+
+	if got := layout.HostPath("/etc/nginx/conf.d/../nginx.conf"); got != "/srv/nginx/nginx.conf" {
+		t.Errorf("HostPath() of an unclean path = %q", got)
+	}
+	if got := (&NginxLayout{}).HostPath("/etc/nginx/nginx.conf"); got != "/etc/nginx/nginx.conf" {
+		t.Errorf("HostPath() without mounts = %q", got)
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  a  b\tc ", []string{"a", "b", "c"}},
+		{`--with-cc-opt='-g -O2' --prefix=/usr`, []string{"--with-cc-opt=-g -O2", "--prefix=/usr"}},
+		{`"a b"c 'd "e"'`, []string{"a bc", `d "e"`}},
+		{`'' x`, []string{"", "x"}},
+		{`'unterminated quote`, []string{"unterminated quote"}},
+	}
+	for _, tt := range tests {
+		if got := splitShellWords(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitShellWords(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestDetectLayoutFlavors(t *testing.T) {
+	// cat answers with the os-release of the test case, nginx with a build without paths
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"cat":   "#!/bin/sh\n[ -n \"$TEST_OS_RELEASE\" ] || exit 1\nprintf '%s\\n' \"$TEST_OS_RELEASE\"\n",
+		"nginx": "#!/bin/sh\necho 'nginx version: nginx/1.24.0' >&2\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		name      string
+		osRelease string
+		conf      string
+		flavor    string
+		sites     string
+		enabled   string
+		phpSocket string
+	}{
+		{"debian", "ID=debian", "events {}\n", "debian", "sites-available", "sites-enabled", "unix:/run/php/php{version}-fpm.sock"},
+		{"ubuntu", "ID=ubuntu\nID_LIKE=debian", "events {}\n", "debian", "sites-available", "sites-enabled", "unix:/run/php/php{version}-fpm.sock"},
+		{"rocky", "ID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"", "events {}\n", "rhel", "conf.d", "", "unix:/run/php-fpm/www.sock"},
+		{"alpine", "ID=alpine", "events {}\n", "alpine", "http.d", "", "127.0.0.1:9000"},
+		{"arch", "ID=arch", "events {}\n", "other", "conf.d", "", "127.0.0.1:9000"},
+		{"no os-release", "", "events {}\n", "other", "conf.d", "", "127.0.0.1:9000"},
+		{
+			// The includes of the configuration win over the flavor
+			"includes", "ID=debian", "events {}\nhttp {\n    include vhosts/*.conf;\n}\n",
+			"debian", "vhosts", "", "unix:/run/php/php{version}-fpm.sock",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_OS_RELEASE", tt.osRelease)
+			confDir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(confDir, "nginx.conf"), []byte(tt.conf), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &config.Config{}
+			cfg.Nginx.ConfPath = filepath.Join(confDir, "nginx.conf")
+			s := &NginxService{cfg: cfg, log: logger.New(logger.Config{Level: "error"})}
+
+			layout := s.detectLayout()
+			if !layout.Available || layout.Version != "1.24.0" {
+				t.Errorf("nginx %q available %v", layout.Version, layout.Available)
+			}
+			enabled := ""
+			if tt.enabled != "" {
+				enabled = filepath.Join(confDir, tt.enabled)
+			}
+			if layout.Flavor != tt.flavor || layout.SitesDir != filepath.Join(confDir, tt.sites) ||
+				layout.EnabledDir != enabled || layout.PHPFPMSocket != tt.phpSocket {
+				t.Errorf("layout %s: sites %q, enabled %q, php %q", layout.Flavor, layout.SitesDir, layout.EnabledDir, layout.PHPFPMSocket)
+			}
+			if layout.ConfDir != confDir || layout.HostConfDir != confDir || layout.LogDir != "/var/log/nginx" || layout.PIDPath != "/run/nginx.pid" {
+				t.Errorf("layout conf %q (%q), logs %q, pid %q", layout.ConfDir, layout.HostConfDir, layout.LogDir, layout.PIDPath)
+			}
+		})
+	}
+}
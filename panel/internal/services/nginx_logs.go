@@ -0,0 +1,596 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// Formats of a site's access log
+const (
+	nginxLogCombined = "combined"
+	nginxLogJSON     = "json"
+)
+
+const (
+	// Most bytes read backwards from the end of a log to find the last matching lines
+	nginxLogScanLimit = 64 << 20
+
+	// How often a followed log is checked for new lines, rotation and truncation
+	nginxFollowInterval = 500 * time.Millisecond
+)
+
+// The combined format followed by the request and upstream times of the site log format:
+// 1.2.3.4 - - [25/Dec/2023:10:15:30 +0000] "GET / HTTP/1.1" 200 1234 "-" "curl/8.0" rt=0.012 urt="0.010"
+var accessLogLine = regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"(?: rt=(\S+))?(?: urt="([^"]*)")?`)
+
+// An error log line: 2024/01/02 15:04:05 [error] 123#123: *45 message, client: 1.2.3.4, ...
+var errorLogLine = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) \[(\w+)\] (\d+)#\d+: (?:\*(\d+) )?(.*)$`)
+
+// The context nginx appends to an error message
+var errorLogContext = regexp.MustCompile(`, (client|server|request|upstream|host|referrer): ("(?:[^"\\]|\\.)*"|[^,]*)`)
+
+// Error log levels from the least to the most severe
+var errorLogLevels = map[string]int{
+	"debug": 0, "info": 1, "notice": 2, "warn": 3, "error": 4, "crit": 5, "alert": 6, "emerg": 7,
+}
+
+// AccessLogEntry is a parsed access log line
+type AccessLogEntry struct {
+	Time         time.Time `json:"time"`
+	IP           string    `json:"ip"`
+	User         string    `json:"user,omitempty"`
+	Host         string    `json:"host,omitempty"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Protocol     string    `json:"protocol,omitempty"`
+	Status       int       `json:"status"`
+	Bytes        int64     `json:"bytes"`
+	Referer      string    `json:"referer,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	RequestTime  float64   `json:"request_time"`  // seconds, -1 when not logged
+	UpstreamTime float64   `json:"upstream_time"` // seconds, -1 when the request was not passed to an upstream
+	Raw          string    `json:"raw"`
+}
+
+// ErrorLogEntry is a parsed error log line, lines that are not parsed only have the message
+type ErrorLogEntry struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	PID        int       `json:"pid"`
+	Connection int64     `json:"connection,omitempty"`
+	Message    string    `json:"message"`
+	Client     string    `json:"client,omitempty"`
+	Server     string    `json:"server,omitempty"`
+	Request    string    `json:"request,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Referrer   string    `json:"referrer,omitempty"`
+	Raw        string    `json:"raw"`
+}
+
+// jsonAccessLogLine is a line of the JSON site log format
+type jsonAccessLogLine struct {
+	Time         string  `json:"time"`
+	RemoteAddr   string  `json:"remote_addr"`
+	RemoteUser   string  `json:"remote_user"`
+	Host         string  `json:"host"`
+	Method       string  `json:"method"`
+	URI          string  `json:"uri"`
+	Protocol     string  `json:"protocol"`
+	Status       int     `json:"status"`
+	Bytes        int64   `json:"bytes"`
+	Referer      string  `json:"referer"`
+	UserAgent    string  `json:"user_agent"`
+	RequestTime  float64 `json:"request_time"`
+	UpstreamTime string  `json:"upstream_time"`
+}
+
+// NginxLogFilter selects log entries, zero values match everything. Status codes and
+// response times only apply to access logs, levels only to error logs.
+type NginxLogFilter struct {
+	StatusMin int
+	StatusMax int
+	Methods   []string
+	Path      string  // regular expression matched against the request path
+	ClientIP  string  // an IP or a CIDR
+	MinTime   float64 // seconds
+	Level     string  // the least severe error log level
+
+	path    *regexp.Regexp
+	network *net.IPNet
+}
+
+// QueryLogs returns the last lines of a site's access or error log that match the
+// filter, or of the nginx log when siteID is empty. Entries are *AccessLogEntry or
+// *ErrorLogEntry.
+func (s *NginxService) QueryLogs(siteID, kind string, lines int, filter NginxLogFilter) ([]interface{}, error) {
+	if lines <= 0 {
+		lines = 100
+	}
+	path, err := s.logPath(siteID, kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := filter.compile(); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return []interface{}{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lastLogEntries(path, info.Size(), kind, lines, &filter)
+}
+
+// FollowLogs streams the entries of a site's access or error log, or of the nginx log
+// when siteID is empty, that match the filter: the last lines first, then the lines
+// appended to the log. The log is followed across rotation and truncation until ctx is
+// done, which closes the channel.
+func (s *NginxService) FollowLogs(ctx context.Context, siteID, kind string, lines int, filter NginxLogFilter) (<-chan interface{}, error) {
+	path, err := s.logPath(siteID, kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := filter.compile(); err != nil {
+		return nil, err
+	}
+
+	entries := make(chan interface{}, 100)
+	send := func(entry interface{}) {
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		defer close(entries)
+
+		backlog := func(f *os.File, end int64) {
+			if lines <= 0 {
+				return
+			}
+			last, err := lastLogEntries(f.Name(), end, kind, lines, &filter)
+			if err != nil {
+				s.log.Warn("Failed to read log", "path", path, "error", err)
+				return
+			}
+			for _, entry := range last {
+				send(entry)
+			}
+		}
+		followLog(ctx, path, backlog, func(line string) {
+			if entry := filter.match(kind, line); entry != nil {
+				send(entry)
+			}
+		})
+	}()
+	return entries, nil
+}
+
+// logPath returns the path of a site's access or error log, or of the nginx log
+func (s *NginxService) logPath(siteID, kind string) (string, error) {
+	if kind != "access" && kind != "error" {
+		return "", fmt.Errorf("%w: unknown log %q", ErrInvalidLogFilter, kind)
+	}
+	if siteID == "" {
+		return s.nginxLogPath(kind + ".log"), nil
+	}
+	var site models.NginxSite
+	if err := s.db.First(&site, "id = ?", siteID).Error; err != nil {
+		return "", err
+	}
+	return s.siteLogPath(&site, kind), nil
+}
+
+// compile checks the filter and prepares its path expression and client network
+func (f *NginxLogFilter) compile() error {
+	if f.StatusMax != 0 && f.StatusMax < f.StatusMin {
+		return fmt.Errorf("%w: the status range ends before it starts", ErrInvalidLogFilter)
+	}
+	if f.Path != "" {
+		re, err := regexp.Compile(f.Path)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidLogFilter, err)
+		}
+		f.path = re
+	}
+	if f.ClientIP != "" {
+		ip := f.ClientIP
+		if !strings.Contains(ip, "/") {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("%w: invalid client IP %q", ErrInvalidLogFilter, ip)
+			}
+			if strings.Contains(ip, ":") {
+				ip += "/128"
+			} else {
+				ip += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(ip)
+		if err != nil {
+			return fmt.Errorf("%w: invalid client network %q", ErrInvalidLogFilter, f.ClientIP)
+		}
+		f.network = network
+	}
+	if f.Level != "" {
+		if _, ok := errorLogLevels[f.Level]; !ok {
+			return fmt.Errorf("%w: unknown level %q", ErrInvalidLogFilter, f.Level)
+		}
+	}
+	for i, method := range f.Methods {
+		f.Methods[i] = strings.ToUpper(method)
+	}
+	return nil
+}
+
+// empty reports whether the filter matches everything, lines that are not parsed are
+// only returned then
+func (f *NginxLogFilter) empty() bool {
+	return f.StatusMin == 0 && f.StatusMax == 0 && len(f.Methods) == 0 && f.path == nil &&
+		f.network == nil && f.MinTime == 0 && f.Level == ""
+}
+
+// match parses a line of an access or error log, it returns nil when the entry does
+// not match the filter
+func (f *NginxLogFilter) match(kind, line string) interface{} {
+	if kind == "error" {
+		entry := parseErrorLogLine(line)
+		if entry.Level == "" {
+			if f.empty() {
+				return entry
+			}
+			return nil
+		}
+		if f.StatusMin != 0 || f.StatusMax != 0 || f.MinTime != 0 {
+			return nil
+		}
+		if f.Level != "" && errorLogLevels[entry.Level] < errorLogLevels[f.Level] {
+			return nil
+		}
+		method, path := "", ""
+		if request := strings.Fields(entry.Request); len(request) >= 2 {
+			method, path = request[0], request[1]
+		}
+		if !f.matchRequest(entry.Client, method, path) {
+			return nil
+		}
+		return entry
+	}
+
+	entry, ok := parseAccessLogLine(line)
+	if !ok {
+		if f.empty() {
+			return &AccessLogEntry{Raw: line, RequestTime: -1, UpstreamTime: -1}
+		}
+		return nil
+	}
+	if f.StatusMin != 0 && entry.Status < f.StatusMin || f.StatusMax != 0 && entry.Status > f.StatusMax {
+		return nil
+	}
+	if f.MinTime != 0 && entry.RequestTime < f.MinTime {
+		return nil
+	}
+	if !f.matchRequest(entry.IP, entry.Method, entry.Path) {
+		return nil
+	}
+	return entry
+}
+
+func (f *NginxLogFilter) matchRequest(ip, method, path string) bool {
+	if f.network != nil {
+		addr := net.ParseIP(ip)
+		if addr == nil || !f.network.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.Methods) > 0 {
+		found := false
+		for _, m := range f.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.path == nil || f.path.MatchString(path)
+}
+
+// lastLogEntries returns the last lines before end of a log that match the filter,
+// oldest first
+func lastLogEntries(path string, end int64, kind string, lines int, filter *NginxLogFilter) ([]interface{}, error) {
+	var entries []interface{}
+	err := scanLastLines(path, end, nginxLogScanLimit, func(line string) bool {
+		if entry := filter.match(kind, line); entry != nil {
+			entries = append(entries, entry)
+		}
+		return len(entries) < lines
+	})
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if entries == nil {
+		entries = []interface{}{}
+	}
+	return entries, err
+}
+
+// scanLastLines calls fn with the lines of a file before end, from the last one
+// backwards, until fn returns false or limit bytes have been read
+func scanLastLines(path string, end, limit int64, fn func(line string) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The log may have been truncated since
+	if info, err := f.Stat(); err == nil && info.Size() < end {
+		end = info.Size()
+	}
+
+	var read int64
+	var rest []byte // the end of a line that starts in an earlier block
+	for end > 0 && read < limit {
+		size := min(int64(64*1024), end)
+		end -= size
+		buf := make([]byte, size, int(size)+len(rest))
+		if _, err := f.ReadAt(buf, end); err != nil {
+			return err
+		}
+		read += size
+		buf = append(buf, rest...)
+
+		for {
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			if line := strings.TrimRight(string(buf[i+1:]), "\r"); line != "" && !fn(line) {
+				return nil
+			}
+			buf = buf[:i]
+		}
+		rest = buf
+	}
+	if end == 0 && len(rest) > 0 {
+		fn(strings.TrimRight(string(rest), "\r"))
+	}
+	return nil
+}
+
+// followLog calls fn with the lines appended to a log until ctx is done. The log is
+// reopened when it is rotated, after the lines written to the rotated file, or
+// truncated. backlog is called with the log and its size when it is first opened.
+func followLog(ctx context.Context, path string, backlog func(f *os.File, end int64), fn func(line string)) {
+	var (
+		f       *os.File
+		reader  *bufio.Reader
+		inode   uint64
+		offset  int64
+		partial []byte
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	// drain reads the complete lines written since the last read
+	drain := func() {
+		for {
+			line, err := reader.ReadBytes('\n')
+			offset += int64(len(line))
+			if err != nil {
+				partial = append(partial, line...)
+				return
+			}
+			if len(partial) > 0 {
+				line = append(partial, line...)
+				partial = nil
+			}
+			fn(strings.TrimRight(string(line), "\r\n"))
+		}
+	}
+
+	ticker := time.NewTicker(nginxFollowInterval)
+	defer ticker.Stop()
+
+	first := true
+	for {
+		if info, err := os.Stat(path); err == nil {
+			rotated := f != nil && fileInode(info) != inode
+			truncated := f != nil && !rotated && info.Size() < offset
+			if rotated {
+				// The lines written before nginx reopened its log
+				drain()
+			}
+			if f == nil || rotated || truncated {
+				if f != nil {
+					f.Close()
+					f = nil
+				}
+				partial = nil
+				if opened, err := os.Open(path); err == nil {
+					f, inode, offset = opened, fileInode(info), 0
+					if first {
+						// Only lines written from now are followed
+						offset, _ = f.Seek(0, io.SeekEnd)
+						backlog(f, offset)
+					}
+					reader = bufio.NewReader(f)
+				}
+			}
+		}
+		first = false
+
+		if f != nil {
+			drain()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseAccessLogLine parses a line of the combined or JSON site log format, plain
+// combined lines are parsed without the times
+func parseAccessLogLine(line string) (*AccessLogEntry, bool) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSONAccessLogLine(line)
+	}
+
+	m := accessLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[3])
+	if err != nil {
+		return nil, false
+	}
+
+	e := &AccessLogEntry{Time: t, IP: m[1], Referer: m[7], UserAgent: m[8], RequestTime: -1, UpstreamTime: -1, Raw: line}
+	if m[2] != "-" {
+		e.User = m[2]
+	}
+	if request := strings.Fields(m[4]); len(request) >= 2 {
+		e.Method, e.Path = request[0], request[1]
+		if len(request) >= 3 {
+			e.Protocol = request[2]
+		}
+	}
+	e.Status, _ = strconv.Atoi(m[5])
+	e.Bytes, _ = strconv.ParseInt(m[6], 10, 64)
+	if m[9] != "" {
+		if v, err := strconv.ParseFloat(m[9], 64); err == nil {
+			e.RequestTime = v
+		}
+	}
+	e.UpstreamTime = parseUpstreamTime(m[10])
+	return e, true
+}
+
+func parseJSONAccessLogLine(line string) (*AccessLogEntry, bool) {
+	var l jsonAccessLogLine
+	if err := json.Unmarshal([]byte(line), &l); err != nil {
+		return nil, false
+	}
+	t, err := time.Parse(time.RFC3339, l.Time)
+	if err != nil {
+		return nil, false
+	}
+	return &AccessLogEntry{
+		Time:         t,
+		IP:           l.RemoteAddr,
+		User:         l.RemoteUser,
+		Host:         l.Host,
+		Method:       l.Method,
+		Path:         l.URI,
+		Protocol:     l.Protocol,
+		Status:       l.Status,
+		Bytes:        l.Bytes,
+		Referer:      l.Referer,
+		UserAgent:    l.UserAgent,
+		RequestTime:  l.RequestTime,
+		UpstreamTime: parseUpstreamTime(l.UpstreamTime),
+		Raw:          line,
+	}, true
+}
+
+// parseUpstreamTime sums the times of the upstreams a request was tried on, e.g.
+// "0.002, 0.010" or "0.001 : 0.004", -1 when no upstream was involved
+func parseUpstreamTime(value string) float64 {
+	total, found := 0.0, false
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' || r == ' ' }) {
+		if v, err := strconv.ParseFloat(part, 64); err == nil {
+			total += v
+			found = true
+		}
+	}
+	if !found {
+		return -1
+	}
+	return total
+}
+
+// parseErrorLogLine parses an error log line, the times are in the local time of nginx
+func parseErrorLogLine(line string) *ErrorLogEntry {
+	e := &ErrorLogEntry{Message: line, Raw: line}
+	m := errorLogLine.FindStringSubmatch(line)
+	if m == nil {
+		return e
+	}
+	t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+	if err != nil {
+		return e
+	}
+	e.Time, e.Level = t, m[2]
+	e.PID, _ = strconv.Atoi(m[3])
+	e.Connection, _ = strconv.ParseInt(m[4], 10, 64)
+
+	message := m[5]
+	if i := strings.Index(message, ", client: "); i >= 0 {
+		for _, c := range errorLogContext.FindAllStringSubmatch(message[i:], -1) {
+			value := c[2]
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			switch c[1] {
+			case "client":
+				e.Client = value
+			case "server":
+				e.Server = value
+			case "request":
+				e.Request = value
+			case "upstream":
+				e.Upstream = value
+			case "host":
+				e.Host = value
+			case "referrer":
+				e.Referrer = value
+			}
+		}
+		message = message[:i]
+	}
+	e.Message = message
+	return e
+}
+
+// accessLogFormat returns the log_format directive of a site's access log
+func accessLogFormat(name, format string) string {
+	if format == nginxLogJSON {
+		return "log_format " + name + ` escape=json '{"time":"$time_iso8601","remote_addr":"$remote_addr",'
+    '"remote_user":"$remote_user","host":"$host","method":"$request_method","uri":"$request_uri",'
+    '"protocol":"$server_protocol","status":$status,"bytes":$body_bytes_sent,'
+    '"referer":"$http_referer","user_agent":"$http_user_agent",'
+    '"request_time":$request_time,"upstream_time":"$upstream_response_time"}';`
+	}
+	return "log_format " + name + ` '$remote_addr - $remote_user [$time_local] "$request" '
+    '$status $body_bytes_sent "$http_referer" "$http_user_agent" '
+    'rt=$request_time urt="$upstream_response_time"';`
+}
+
+// Errors
+var (
+	ErrInvalidLogFilter = errors.New("invalid log filter")
+)
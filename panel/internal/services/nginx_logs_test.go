@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccessLogLine(t *testing.T) {
+	at := time.Date(2023, 12, 25, 10, 15, 30, 0, time.FixedZone("", 3600))
+	tests := []struct {
+		name string
+		line string
+		want *AccessLogEntry
+	}{
+		{
+			"site format",
+			`1.2.3.4 - alice [25/Dec/2023:10:15:30 +0100] "GET /a?b=1 HTTP/1.1" 200 1234 "-" "curl/8.0" rt=0.012 urt="0.010"`,
+			&AccessLogEntry{Time: at, IP: "1.2.3.4", User: "alice", Method: "GET", Path: "/a?b=1", Protocol: "HTTP/1.1",
+				Status: 200, Bytes: 1234, Referer: "-", UserAgent: "curl/8.0", RequestTime: 0.012, UpstreamTime: 0.010},
+		},
+		{
+			"plain combined",
+			`::1 - - [25/Dec/2023:10:15:30 +0100] "POST /login HTTP/2.0" 302 - "https://example.com/" "Mozilla/5.0 (X11)"`,
+			&AccessLogEntry{Time: at, IP: "::1", Method: "POST", Path: "/login", Protocol: "HTTP/2.0",
+				Status: 302, Referer: "https://example.com/", UserAgent: "Mozilla/5.0 (X11)", RequestTime: -1, UpstreamTime: -1},
+		},
+		{
+			"escaped quotes and several upstreams",
+			`1.2.3.4 - - [25/Dec/2023:10:15:30 +0100] "GET / HTTP/1.1" 502 0 "-" "say \"hi\"" rt=1.5 urt="0.5, 0.25 : 0.25"`,
+			&AccessLogEntry{Time: at, IP: "1.2.3.4", Method: "GET", Path: "/", Protocol: "HTTP/1.1",
+				Status: 502, Referer: "-", UserAgent: `say \"hi\"`, RequestTime: 1.5, UpstreamTime: 1},
+		},
+		{
+			"not proxied",
+			`1.2.3.4 - - [25/Dec/2023:10:15:30 +0100] "GET / HTTP/1.1" 200 5 "-" "-" rt=0.000 urt="-"`,
+			&AccessLogEntry{Time: at, IP: "1.2.3.4", Method: "GET", Path: "/", Protocol: "HTTP/1.1",
+				Status: 200, Bytes: 5, Referer: "-", UserAgent: "-", RequestTime: 0, UpstreamTime: -1},
+		},
+		{
+			"bad request",
+			`1.2.3.4 - - [25/Dec/2023:10:15:30 +0100] "\x16\x03\x01" 400 150 "-" "-"`,
+			&AccessLogEntry{Time: at, IP: "1.2.3.4", Status: 400, Bytes: 150, Referer: "-", UserAgent: "-", RequestTime: -1, UpstreamTime: -1},
+		},
+		{
+			"json",
+			`{"time":"2023-12-25T10:15:30+01:00","remote_addr":"1.2.3.4","remote_user":"","host":"example.com","method":"GET",` +
+				`"uri":"/a","protocol":"HTTP/1.1","status":404,"bytes":10,"referer":"","user_agent":"curl/8.0",` +
+				`"request_time":0.003,"upstream_time":"0.002"}`,
+			&AccessLogEntry{Time: at, IP: "1.2.3.4", Host: "example.com", Method: "GET", Path: "/a", Protocol: "HTTP/1.1",
+				Status: 404, Bytes: 10, UserAgent: "curl/8.0", RequestTime: 0.003, UpstreamTime: 0.002},
+		},
+		{"bad time", `1.2.3.4 - - [yesterday] "GET / HTTP/1.1" 200 5 "-" "-"`, nil},
+		{"not a log line", `nginx: [warn] something`, nil},
+		{"broken json", `{"time":`, nil},
+		{"json without time", `{"status":200}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseAccessLogLine(tt.line)
+			if tt.want == nil {
+				if ok {
+					t.Errorf("parseAccessLogLine() = %+v, want no entry", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("line not parsed")
+			}
+			tt.want.Raw = tt.line
+			if !got.Time.Equal(tt.want.Time) {
+				t.Errorf("time = %v, want %v", got.Time, tt.want.Time)
+			}
+			got.Time = tt.want.Time
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAccessLogLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUpstreamTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"", -1},
+		{"-", -1},
+		{"0.010", 0.010},
+		{"0.5, 0.25", 0.75},
+		{"0.5 : 0.25", 0.75},
+		{"-, 0.5", 0.5},
+	}
+	for _, tt := range tests {
+		if got := parseUpstreamTime(tt.value); got != tt.want {
+			t.Errorf("parseUpstreamTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrorLogLine(t *testing.T) {
+	line := `2024/01/02 15:04:05 [error] 123#123: *45 connect() failed (111: Connection refused) while connecting to upstream, ` +
+		`client: 10.0.0.1, server: example.com, request: "GET /api?x=\"1\" HTTP/1.1", upstream: "http://127.0.0.1:3000/api", ` +
+		`host: "example.com", referrer: "https://example.com/"`
+	want := &ErrorLogEntry{
+		Time:       time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local),
+		Level:      "error",
+		PID:        123,
+		Connection: 45,
+		Message:    "connect() failed (111: Connection refused) while connecting to upstream",
+		Client:     "10.0.0.1",
+		Server:     "example.com",
+		Request:    `GET /api?x="1" HTTP/1.1`,
+		Upstream:   "http://127.0.0.1:3000/api",
+		Host:       "example.com",
+		Referrer:   "https://example.com/",
+		Raw:        line,
+	}
+	if got := parseErrorLogLine(line); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseErrorLogLine() = %+v, want %+v", got, want)
+	}
+
+	notice := "2024/01/02 15:04:05 [notice] 1#1: signal process started"
+	if got := parseErrorLogLine(notice); got.Level != "notice" || got.Connection != 0 || got.Message != "signal process started" {
+		t.Errorf("parseErrorLogLine() = %+v", got)
+	}
+	other := "nginx: [emerg] bind() failed"
+	if got := parseErrorLogLine(other); got.Level != "" || got.Message != other || !got.Time.IsZero() {
+		t.Errorf("parseErrorLogLine() of another line = %+v", got)
+	}
+}
+
+func TestNginxLogFilterCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter NginxLogFilter
+		valid  bool
+	}{
+		{"empty", NginxLogFilter{}, true},
+		{"status range", NginxLogFilter{StatusMin: 400, StatusMax: 499}, true},
+		{"minimum status only", NginxLogFilter{StatusMin: 500}, true},
+		{"reversed status range", NginxLogFilter{StatusMin: 500, StatusMax: 400}, false},
+		{"path", NginxLogFilter{Path: `^/api/`}, true},
+		{"bad path", NginxLogFilter{Path: `(`}, false},
+		{"ip", NginxLogFilter{ClientIP: "10.0.0.1"}, true},
+		{"ipv6", NginxLogFilter{ClientIP: "2001:db8::1"}, true},
+		{"network", NginxLogFilter{ClientIP: "10.0.0.0/8"}, true},
+		{"bad ip", NginxLogFilter{ClientIP: "10.0.0"}, false},
+		{"bad network", NginxLogFilter{ClientIP: "10.0.0.0/33"}, false},
+		{"level", NginxLogFilter{Level: "warn"}, true},
+		{"bad level", NginxLogFilter{Level: "warning"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.compile()
+			if tt.valid && err != nil {
+				t.Errorf("compile() error = %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidLogFilter) {
+				t.Errorf("compile() error = %v, want ErrInvalidLogFilter", err)
+			}
+		})
+	}
+}
+
+func TestNginxLogFilterMatch(t *testing.T) {
+	at := time.Now()
+	access := func(ip, request string, status int) string {
+		return strings.TrimSuffix(accessLine(at, ip, request, status, 10, ""), "\n")
+	}
+	slow := `10.0.0.1 - - [25/Dec/2023:10:15:30 +0000] "GET /slow HTTP/1.1" 200 5 "-" "-" rt=2.500 urt="2.490"`
+	errorLine := `2024/01/02 15:04:05 [error] 1#1: *2 open() failed, client: 10.0.0.1, server: a, request: "GET /missing HTTP/1.1"`
+	warnLine := `2024/01/02 15:04:05 [warn] 1#1: *3 an upstream response is buffered, client: 192.168.1.5, server: a, request: "POST /api HTTP/1.1"`
+
+	tests := []struct {
+		name   string
+		filter NginxLogFilter
+		kind   string
+		line   string
+		match  bool
+	}{
+		{"empty matches everything", NginxLogFilter{}, "access", access("10.0.0.1", "GET / HTTP/1.1", 200), true},
+		{"empty keeps unparsed lines", NginxLogFilter{}, "access", "garbage", true},
+		{"filters drop unparsed lines", NginxLogFilter{StatusMin: 200}, "access", "garbage", false},
+		{"status in range", NginxLogFilter{StatusMin: 400, StatusMax: 499}, "access", access("10.0.0.1", "GET / HTTP/1.1", 404), true},
+		{"status below", NginxLogFilter{StatusMin: 400, StatusMax: 499}, "access", access("10.0.0.1", "GET / HTTP/1.1", 200), false},
+		{"status above", NginxLogFilter{StatusMin: 400, StatusMax: 499}, "access", access("10.0.0.1", "GET / HTTP/1.1", 500), false},
+		{"method", NginxLogFilter{Methods: []string{"post", "put"}}, "access", access("10.0.0.1", "POST /api HTTP/1.1", 201), true},
+		{"other method", NginxLogFilter{Methods: []string{"post"}}, "access", access("10.0.0.1", "GET /api HTTP/1.1", 200), false},
+		{"path", NginxLogFilter{Path: `^/api/v\d+/`}, "access", access("10.0.0.1", "GET /api/v2/users HTTP/1.1", 200), true},
+		{"other path", NginxLogFilter{Path: `^/api/`}, "access", access("10.0.0.1", "GET /static/api/x HTTP/1.1", 200), false},
+		{"client network", NginxLogFilter{ClientIP: "10.0.0.0/8"}, "access", access("10.2.3.4", "GET / HTTP/1.1", 200), true},
+		{"client outside the network", NginxLogFilter{ClientIP: "10.0.0.0/8"}, "access", access("11.0.0.1", "GET / HTTP/1.1", 200), false},
+		{"client ip", NginxLogFilter{ClientIP: "10.0.0.1"}, "access", access("10.0.0.10", "GET / HTTP/1.1", 200), false},
+		{"slow request", NginxLogFilter{MinTime: 1}, "access", slow, true},
+		{"fast request", NginxLogFilter{MinTime: 1}, "access", access("10.0.0.1", "GET / HTTP/1.1", 200), false},
+		{"request time not logged", NginxLogFilter{MinTime: 0.001}, "access",
+			`10.0.0.1 - - [25/Dec/2023:10:15:30 +0000] "GET / HTTP/1.1" 200 5 "-" "-"`, false},
+		{"error level", NginxLogFilter{Level: "warn"}, "error", errorLine, true},
+		{"error below the level", NginxLogFilter{Level: "error"}, "error", warnLine, false},
+		{"error client and method", NginxLogFilter{ClientIP: "192.168.0.0/16", Methods: []string{"POST"}}, "error", warnLine, true},
+		{"error path", NginxLogFilter{Path: "^/missing$"}, "error", errorLine, true},
+		{"status filters drop error lines", NginxLogFilter{StatusMin: 500}, "error", errorLine, false},
+		{"empty keeps unparsed error lines", NginxLogFilter{}, "error", "PHP message: stack trace", true},
+		{"level drops unparsed error lines", NginxLogFilter{Level: "debug"}, "error", "PHP message: stack trace", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+			if err := filter.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.match(tt.kind, tt.line); (got != nil) != tt.match {
+				t.Errorf("match() = %+v, want a match %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestLastLogEntries(t *testing.T) {
+	path := t.TempDir() + "/access.log"
+	at := time.Now()
+	// Enough lines to span several of the blocks read backwards
+	var lines []string
+	for i := 0; i < 2000; i++ {
+		status := 200
+		if i%10 == 0 {
+			status = 500
+		}
+		lines = append(lines, accessLine(at, "10.0.0.1", fmt.Sprintf("GET /%04d HTTP/1.1", i), status, 10, ""))
+	}
+	appendLog(t, path, lines...)
+	appendLog(t, path, "no newline at the end")
+	info, _ := os.Stat(path)
+
+	paths := func(entries []interface{}) []string {
+		var result []string
+		for _, e := range entries {
+			result = append(result, e.(*AccessLogEntry).Path)
+		}
+		return result
+	}
+
+	filter := NginxLogFilter{StatusMin: 500}
+	filter.compile()
+	entries, err := lastLogEntries(path, info.Size(), "access", 3, &filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(entries), []string{"/1970", "/1980", "/1990"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("last errors = %q, want %q", got, want)
+	}
+
+	// Every line back to the first one, the unterminated last line included
+	all := NginxLogFilter{}
+	entries, err = lastLogEntries(path, info.Size(), "access", 5000, &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2001 || entries[0].(*AccessLogEntry).Path != "/0000" || entries[2000].(*AccessLogEntry).Raw != "no newline at the end" {
+		t.Errorf("%d entries from %+v", len(entries), entries[0])
+	}
+
+	// Up to end only, the log may have grown since
+	end := int64(len(strings.Join(lines[:5], "")))
+	entries, _ = lastLogEntries(path, end, "access", 2, &all)
+	if got, want := paths(entries), []string{"/0003", "/0004"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries before %d = %q, want %q", end, got, want)
+	}
+
+	none := NginxLogFilter{Methods: []string{"DELETE"}}
+	none.compile()
+	if entries, _ := lastLogEntries(path, info.Size(), "access", 10, &none); entries == nil || len(entries) != 0 {
+		t.Errorf("entries without a match = %v, want an empty list", entries)
+	}
+}
+
+func TestFollowLogs(t *testing.T) {
+	s, site, path := newTestAnalytics(t)
+	at := time.Now()
+	line := func(request string, status int) string { return accessLine(at, "10.0.0.1", request, status, 10, "") }
+	appendLog(t, path, line("GET /old1 HTTP/1.1", 200), line("GET /old2 HTTP/1.1", 500), line("GET /old3 HTTP/1.1", 500))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries, err := s.FollowLogs(ctx, site.ID, "access", 1, NginxLogFilter{StatusMin: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		t.Helper()
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				t.Fatal("entries closed")
+			}
+			return entry.(*AccessLogEntry).Path
+		case <-time.After(5 * time.Second):
+			t.Fatal("no entry followed")
+		}
+		return ""
+	}
+
+	if got := next(); got != "/old3" {
+		t.Errorf("backlog = %s, want /old3", got)
+	}
+
+	appendLog(t, path, line("GET /ok HTTP/1.1", 200), line("GET /new HTTP/1.1", 502))
+	if got := next(); got != "/new" {
+		t.Errorf("appended = %s, want /new", got)
+	}
+
+	// Rotation: the lines still written to the rotated file come first
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path+".1", line("GET /late HTTP/1.1", 503))
+	appendLog(t, path, line("GET /rotated HTTP/1.1", 500))
+	for _, want := range []string{"/late", "/rotated"} {
+		if got := next(); got != want {
+			t.Errorf("after rotation = %s, want %s", got, want)
+		}
+	}
+
+	// Truncation: the log is read again from its start
+	time.Sleep(2 * nginxFollowInterval)
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path, line("GET /t HTTP/1.1", 500))
+	if got := next(); got != "/t" {
+		t.Errorf("after truncation = %s, want /t", got)
+	}
+
+	cancel()
+	for range entries {
+	}
+
+	if _, err := s.FollowLogs(context.Background(), site.ID, "debug", 0, NginxLogFilter{}); !errors.Is(err, ErrInvalidLogFilter) {
+		t.Errorf("FollowLogs() of an unknown log error = %v", err)
+	}
+	if _, err := s.QueryLogs(site.ID, "access", 10, NginxLogFilter{Path: "("}); !errors.Is(err, ErrInvalidLogFilter) {
+		t.Errorf("QueryLogs() with a bad path error = %v", err)
+	}
+}
+
+func TestQueryLogs(t *testing.T) {
+	s, site, path := newTestAnalytics(t)
+	entries, err := s.QueryLogs(site.ID, "error", 10, NginxLogFilter{})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("QueryLogs() of a missing log = %v, %v", entries, err)
+	}
+
+	appendLog(t, path, accessLine(time.Now(), "10.0.0.1", "GET / HTTP/1.1", 200, 10, ""))
+	entries, err = s.QueryLogs(site.ID, "access", 0, NginxLogFilter{})
+	if err != nil || len(entries) != 1 {
+		t.Errorf("QueryLogs() = %v, %v", entries, err)
+	}
+	if _, err := s.QueryLogs("missing", "access", 10, NginxLogFilter{}); err == nil {
+		t.Error("QueryLogs() of an unknown site succeeded")
+	}
+}
+
+func TestAccessLogFormatJSON(t *testing.T) {
+	format := accessLogFormat("vpanel_json", nginxLogJSON)
+	if !strings.HasPrefix(format, "log_format vpanel_json escape=json '") {
+		t.Fatalf("format = %s", format)
+	}
+
+	// The variables of the format fill every field of a JSON log line
+	values := map[string]string{
+		"$time_iso8601": "2023-12-25T10:15:30+00:00", "$remote_addr": "1.2.3.4", "$remote_user": "",
+		"$host": "example.com", "$request_method": "GET", "$request_uri": "/", "$server_protocol": "HTTP/1.1",
+		"$status": "200", "$body_bytes_sent": "5", "$http_referer": "", "$http_user_agent": "curl",
+		"$request_time": "0.001", "$upstream_response_time": "0.001",
+	}
+	line := strings.NewReplacer("'\n    '", "", "'", "").Replace(strings.TrimSuffix(strings.TrimPrefix(format, "log_format vpanel_json escape=json "), ";"))
+	for variable, value := range values {
+		line = strings.ReplaceAll(line, variable, value)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		t.Fatalf("rendered line %s: %v", line, err)
+	}
+	var want map[string]interface{}
+	data, _ := json.Marshal(jsonAccessLogLine{})
+	json.Unmarshal(data, &want)
+	for key := range want {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("format does not log %s", key)
+		}
+	}
+	if _, ok := parseAccessLogLine(line); !ok {
+		t.Errorf("rendered line not parsed: %s", line)
+	}
+
+	combined := accessLogFormat("vpanel", nginxLogCombined)
+	if !strings.Contains(combined, `rt=$request_time urt="$upstream_response_time"`) {
+		t.Errorf("combined format = %s", combined)
+	}
+}
@@ -0,0 +1,440 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Include directives nested deeper than this are treated as a loop
+const nginxMaxIncludeDepth = 16
+
+// nginxDirective is a directive of an nginx configuration file. Comments are kept as
+// directives named "#" so that rendering a parsed file does not drop them.
+type nginxDirective struct {
+	Name  string
+	Args  []string // unquoted arguments
+	raw   []string // arguments as written, used when rendering
+	Block []*nginxDirective
+	block bool
+	File  string
+	Line  int
+
+	// Directives of the files an include pulls in, the include itself is rendered as written
+	Included []*nginxDirective
+
+	comment string // comment on the line the directive ends on
+	endLine int
+}
+
+// IsComment reports whether the directive is a comment
+func (d *nginxDirective) IsComment() bool {
+	return d.Name == "#"
+}
+
+// Arg returns the i-th argument, empty when there is none
+func (d *nginxDirective) Arg(i int) string {
+	if i < len(d.Args) {
+		return d.Args[i]
+	}
+	return ""
+}
+
+// Escapes nginx resolves in quoted strings and bare words alike
+var nginxEscapes = map[byte]byte{'"': '"', '\'': '\'', '\\': '\\', 't': '\t', 'r': '\r', 'n': '\n'}
+
+// nginxToken is a word, a quoted string, one of ";{}" or a comment
+type nginxToken struct {
+	text   string // unquoted
+	raw    string
+	line   int
+	quoted bool
+}
+
+// NginxParseError is returned for configuration files that are not valid nginx syntax
+type NginxParseError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e *NginxParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+func (e *NginxParseError) Unwrap() error {
+	return ErrNginxParse
+}
+
+// parseNginxFile parses a configuration file of this host and the files it includes.
+// Include paths are resolved like nginx does and mapped to this host.
+func parseNginxFile(path string, layout *NginxLayout) ([]*nginxDirective, error) {
+	return parseNginxFileDepth(path, layout, 0)
+}
+
+func parseNginxFileDepth(path string, layout *NginxLayout, depth int) ([]*nginxDirective, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := parseNginxConfig(string(data), path)
+	if err != nil {
+		return nil, err
+	}
+	if err := expandNginxIncludes(dirs, layout, depth); err != nil {
+		return dirs, err
+	}
+	return dirs, nil
+}
+
+// expandNginxIncludes parses the files matched by the include directives of dirs
+func expandNginxIncludes(dirs []*nginxDirective, layout *NginxLayout, depth int) error {
+	var firstErr error
+	walkNginxDirectives(dirs, false, func(d *nginxDirective) {
+		if d.Name != "include" || len(d.Args) != 1 {
+			return
+		}
+		if depth >= nginxMaxIncludeDepth {
+			if firstErr == nil {
+				firstErr = &NginxParseError{File: d.File, Line: d.Line, Message: "include nesting too deep"}
+			}
+			return
+		}
+
+		for _, file := range resolveNginxInclude(d.Arg(0), layout) {
+			included, err := parseNginxFileDepth(file, layout, depth+1)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			d.Included = append(d.Included, included...)
+		}
+	})
+	return firstErr
+}
+
+// resolveNginxInclude returns the files of this host an include argument matches, in the
+// order nginx reads them
+func resolveNginxInclude(pattern string, layout *NginxLayout) []string {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(layout.ConfDir, pattern)
+	}
+	matches, err := filepath.Glob(layout.HostPath(pattern))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(matches)
+
+	files := matches[:0]
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+			files = append(files, m)
+		}
+	}
+	return files
+}
+
+// walkNginxDirectives calls fn for every directive in dirs and their blocks, depth first.
+// The directives of included files are visited too when includes is set.
+func walkNginxDirectives(dirs []*nginxDirective, includes bool, fn func(*nginxDirective)) {
+	for _, d := range dirs {
+		fn(d)
+		walkNginxDirectives(d.Block, includes, fn)
+		if includes {
+			walkNginxDirectives(d.Included, includes, fn)
+		}
+	}
+}
+
+// flattenNginxIncludes returns dirs with include directives replaced by the directives
+// of the files they include, blocks are not descended into
+func flattenNginxIncludes(dirs []*nginxDirective) []*nginxDirective {
+	var flat []*nginxDirective
+	for _, d := range dirs {
+		if d.Name == "include" && len(d.Included) > 0 {
+			flat = append(flat, flattenNginxIncludes(d.Included)...)
+			continue
+		}
+		flat = append(flat, d)
+	}
+	return flat
+}
+
+// nginxOverrides are the directives and locations a site's custom configuration sets,
+// the generated configuration leaves them out so that they do not clash
+type nginxOverrides struct {
+	directives map[string]bool
+	locations  map[string]bool
+}
+
+// parseNginxOverrides collects the server level directives and locations of a custom
+// configuration, following its includes. Text that does not parse overrides nothing,
+// nginx -t reports it.
+func parseNginxOverrides(config string, layout *NginxLayout) nginxOverrides {
+	o := nginxOverrides{directives: map[string]bool{}, locations: map[string]bool{}}
+	if strings.TrimSpace(config) == "" {
+		return o
+	}
+	dirs, err := parseNginxConfig(config, "config")
+	if err != nil {
+		return o
+	}
+	expandNginxIncludes(dirs, layout, 0)
+
+	for _, d := range flattenNginxIncludes(dirs) {
+		switch {
+		case d.IsComment():
+		case d.Name == "location" && d.block:
+			o.locations[nginxLocationKey(d.Args)] = true
+		default:
+			o.directives[d.Name] = true
+		}
+	}
+	return o
+}
+
+func (o nginxOverrides) hasDirective(names ...string) bool {
+	for _, name := range names {
+		if o.directives[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (o nginxOverrides) hasLocation(key string) bool {
+	return o.locations[key]
+}
+
+// parseNginxConfig parses configuration text, file is used in errors and positions
+func parseNginxConfig(text, file string) ([]*nginxDirective, error) {
+	tokens, err := tokenizeNginx(text, file)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := 0
+	var parse func(depth int) ([]*nginxDirective, error)
+	parse = func(depth int) ([]*nginxDirective, error) {
+		var dirs []*nginxDirective
+		for pos < len(tokens) {
+			tok := tokens[pos]
+			pos++
+
+			switch {
+			case !tok.quoted && strings.HasPrefix(tok.raw, "#"):
+				// A comment after a directive on the same line stays with the directive
+				if n := len(dirs); n > 0 && !dirs[n-1].IsComment() && dirs[n-1].endLine == tok.line && dirs[n-1].comment == "" {
+					dirs[n-1].comment = tok.raw
+					continue
+				}
+				dirs = append(dirs, &nginxDirective{Name: "#", raw: []string{tok.raw}, File: file, Line: tok.line})
+				continue
+			case !tok.quoted && tok.raw == "}":
+				if depth == 0 {
+					return nil, &NginxParseError{File: file, Line: tok.line, Message: `unexpected "}"`}
+				}
+				return dirs, nil
+			case !tok.quoted && (tok.raw == ";" || tok.raw == "{"):
+				return nil, &NginxParseError{File: file, Line: tok.line, Message: fmt.Sprintf("unexpected %q", tok.raw)}
+			}
+
+			d := &nginxDirective{Name: tok.text, File: file, Line: tok.line}
+			for {
+				if pos >= len(tokens) {
+					return nil, &NginxParseError{File: file, Line: tok.line, Message: fmt.Sprintf("unexpected end of file, expecting \";\" or \"}\" after %q", d.Name)}
+				}
+				arg := tokens[pos]
+				pos++
+				if !arg.quoted && arg.raw == ";" {
+					d.endLine = arg.line
+					break
+				}
+				if !arg.quoted && arg.raw == "{" {
+					d.block = true
+					block, err := parse(depth + 1)
+					if err != nil {
+						return nil, err
+					}
+					d.endLine = tokens[pos-1].line
+					if block == nil {
+						block = []*nginxDirective{}
+					}
+					d.Block = block
+					break
+				}
+				if !arg.quoted && arg.raw == "}" {
+					return nil, &NginxParseError{File: file, Line: arg.line, Message: fmt.Sprintf(`unexpected "}" in %q`, d.Name)}
+				}
+				if !arg.quoted && strings.HasPrefix(arg.raw, "#") {
+					// A comment between arguments is dropped, nginx ignores it as well
+					continue
+				}
+				d.Args = append(d.Args, arg.text)
+				d.raw = append(d.raw, arg.raw)
+			}
+			dirs = append(dirs, d)
+		}
+		if depth > 0 {
+			return nil, &NginxParseError{File: file, Line: countLines(text), Message: `unexpected end of file, expecting "}"`}
+		}
+		return dirs, nil
+	}
+
+	return parse(0)
+}
+
+// tokenizeNginx splits configuration text into tokens
+func tokenizeNginx(text, file string) ([]nginxToken, error) {
+	var tokens []nginxToken
+	line := 1
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				end = len(text) - i
+			}
+			tokens = append(tokens, nginxToken{text: text[i : i+end], raw: strings.TrimRight(text[i:i+end], " \t\r"), line: line})
+			i += end
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, nginxToken{text: string(c), raw: string(c), line: line})
+			i++
+		case c == '"' || c == '\'':
+			start, startLine := i, line
+			var value strings.Builder
+			i++
+			for ; i < len(text) && text[i] != c; i++ {
+				if text[i] == '\n' {
+					line++
+				}
+				if text[i] == '\\' && i+1 < len(text) {
+					// Like nginx, other escapes are kept as written for regexes
+					if unescaped, ok := nginxEscapes[text[i+1]]; ok {
+						i++
+						value.WriteByte(unescaped)
+						continue
+					}
+				}
+				value.WriteByte(text[i])
+			}
+			if i >= len(text) {
+				return nil, &NginxParseError{File: file, Line: startLine, Message: "unterminated quoted string"}
+			}
+			i++
+			tokens = append(tokens, nginxToken{text: value.String(), raw: text[start:i], line: startLine, quoted: true})
+		default:
+			start := i
+			for i < len(text) {
+				c := text[i]
+				if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';' || c == '{' || c == '}' {
+					break
+				}
+				if c == '\\' && i+1 < len(text) {
+					i += 2
+					continue
+				}
+				// Variables may be written as ${name}
+				if c == '$' && i+1 < len(text) && text[i+1] == '{' {
+					if end := strings.IndexByte(text[i:], '}'); end > 0 {
+						i += end + 1
+						continue
+					}
+				}
+				i++
+			}
+			word := text[start:i]
+			tokens = append(tokens, nginxToken{text: unescapeNginx(word), raw: word, line: line})
+		}
+	}
+	return tokens, nil
+}
+
+// unescapeNginx resolves the escapes of a bare word
+func unescapeNginx(word string) string {
+	if !strings.Contains(word, `\`) {
+		return word
+	}
+	var b strings.Builder
+	for i := 0; i < len(word); i++ {
+		if word[i] == '\\' && i+1 < len(word) {
+			if unescaped, ok := nginxEscapes[word[i+1]]; ok {
+				i++
+				b.WriteByte(unescaped)
+				continue
+			}
+		}
+		b.WriteByte(word[i])
+	}
+	return b.String()
+}
+
+// renderNginxDirectives writes directives back as configuration text, indented by indent
+// levels of four spaces. Includes are written as the include directive itself.
+func renderNginxDirectives(dirs []*nginxDirective, indent int) string {
+	var b strings.Builder
+	renderNginxInto(&b, dirs, indent)
+	return b.String()
+}
+
+func renderNginxInto(b *strings.Builder, dirs []*nginxDirective, indent int) {
+	pad := strings.Repeat("    ", indent)
+	for _, d := range dirs {
+		b.WriteString(pad)
+		if d.IsComment() {
+			b.WriteString(d.raw[0])
+			b.WriteByte('\n')
+			continue
+		}
+
+		b.WriteString(quoteNginxArg(d.Name))
+		for i, arg := range d.Args {
+			b.WriteByte(' ')
+			if i < len(d.raw) {
+				b.WriteString(d.raw[i])
+			} else {
+				b.WriteString(quoteNginxArg(arg))
+			}
+		}
+		if !d.block {
+			b.WriteString(";")
+		} else {
+			b.WriteString(" {\n")
+			renderNginxInto(b, d.Block, indent+1)
+			b.WriteString(pad)
+			b.WriteString("}")
+		}
+		if d.comment != "" {
+			b.WriteString(" ")
+			b.WriteString(d.comment)
+		}
+		b.WriteByte('\n')
+	}
+}
+
+// quoteNginxArg quotes an argument when it cannot be written as a bare word. nginx
+// resolves escapes in bare words too, so an argument with a backslash is quoted.
+func quoteNginxArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\r\n;{}#\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+func countLines(text string) int {
+	return strings.Count(text, "\n") + 1
+}
+
+// Errors
+var (
+	ErrNginxParse = errors.New("invalid nginx configuration")
+)
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// dumpNginx writes parsed directives with their unquoted arguments, one per line
+func dumpNginx(dirs []*nginxDirective) string {
+	var lines []string
+	var walk func(dirs []*nginxDirective, depth int)
+	walk = func(dirs []*nginxDirective, depth int) {
+		for _, d := range dirs {
+			line := strings.Repeat("  ", depth) + d.Name
+			if d.IsComment() {
+				line += " " + d.raw[0]
+			}
+			for _, arg := range d.Args {
+				line += fmt.Sprintf(" %q", arg)
+			}
+			if d.comment != "" {
+				line += " " + d.comment
+			}
+			lines = append(lines, line)
+			walk(d.Block, depth+1)
+		}
+	}
+	walk(dirs, 0)
+	return strings.Join(lines, "\n")
+}
+
+func TestQuoteNginxArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"/var/www/html", "/var/www/html"},
+		{"$host", "$host"},
+		{"", `""`},
+		{"1; mode=block", `"1; mode=block"`},
+		{"a}b", `"a}b"`},
+		{"{", `"{"`},
+		{"#comment", `"#comment"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"it's", `"it's"`},
+		{`\.php$`, `"\\.php$"`},
+		{`x\nSet-Cookie: a=b`, `"x\\nSet-Cookie: a=b"`},
+		{"a\tb", "\"a\tb\""},
+	}
+	for _, tt := range tests {
+		if got := quoteNginxArg(tt.arg); got != tt.want {
+			t.Errorf("quoteNginxArg(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteNginxArgParses(t *testing.T) {
+	// Whatever an argument holds, nginx must read it back as that one argument
+	args := []string{
+		"plain", "", " ", "a b", "; deny all", "} server { listen 81", "# rest", `"`, `'`, `\`, `\"`,
+		`\\`, `x\n`, `x\r\nSet-Cookie: a=b`, "tab\there", `~* \.(js|css)$`, "${host}", "a\"b'c\\d",
+	}
+	for _, arg := range args {
+		text := "add_header X " + quoteNginxArg(arg) + ";"
+		dirs, err := parseNginxConfig(text, "test")
+		if err != nil {
+			t.Errorf("%s: %v", text, err)
+			continue
+		}
+		if len(dirs) != 1 || len(dirs[0].Args) != 2 || dirs[0].Args[1] != arg {
+			t.Errorf("%s parses as\n%s\nwant the argument %q", text, dumpNginx(dirs), arg)
+		}
+	}
+}
+
+func TestParseNginxConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"directive", "listen 80;", `listen "80"`},
+		{"no arguments", "ip_hash;", `ip_hash`},
+		{
+			"block",
+			"server {\n    listen 443 ssl;\n    location / { root /srv; }\n}",
+			"server\n  listen \"443\" \"ssl\"\n  location \"/\"\n    root \"/srv\"",
+		},
+		{"empty block", "events {}", "events"},
+		{
+			"comments",
+			"# top\nlisten 80; # port\nroot /srv;",
+			"# # top\nlisten \"80\" # port\nroot \"/srv\"",
+		},
+		{"comment between arguments", "listen 80 # port\n ssl;", `listen "80" "ssl"`},
+		{"double quotes", `add_header X "a \"b\" \\ c";`, `add_header "X" "a \"b\" \\ c"`},
+		{"single quotes", `add_header X 'it\'s';`, `add_header "X" "it's"`},
+		{"escaped quote of the other kind", `add_header X "it\'s";`, `add_header "X" "it's"`},
+		{"escapes", `return 200 "a\tb\nc";`, `return "200" "a\tb\nc"`},
+		{"regex escapes kept", `location ~ "\.php$" {}`, `location "~" "\\.php$"`},
+		{"bare regex", `location ~* \.(js|css)$ {}`, `location "~*" "\\.(js|css)$"`},
+		{"bare escapes", `add_header X a\"b\\c\nd;`, `add_header "X" "a\"b\\c\nd"`},
+		{"escaped space", `root /a\ b;`, `root "/a\\ b"`},
+		{"braced variable", "return 200 ${host}x;", `return "200" "${host}x"`},
+		{"quoted braces", `if ($uri ~ "^/a{2}$") { return 404; }`, "if \"($uri\" \"~\" \"^/a{2}$\" \")\"\n  return \"404\""},
+		{"multiline string", "return 200 \"a\nb\";\nlisten 80;", "return \"200\" \"a\\nb\"\nlisten \"80\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirs, err := parseNginxConfig(tt.text, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dumpNginx(dirs); got != tt.want {
+				t.Errorf("parseNginxConfig(%q) =\n%s\nwant\n%s", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNginxConfigLines(t *testing.T) {
+	dirs, err := parseNginxConfig("# a\nserver {\n    return 200 \"x\ny\";\n    listen 80;\n}\n", "site.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := dirs[1]
+	if server.Line != 2 || server.File != "site.conf" {
+		t.Errorf("server at %s:%d, want site.conf:2", server.File, server.Line)
+	}
+	if got := server.Block[1].Line; got != 5 {
+		t.Errorf("listen at line %d, want 5 after the multiline string", got)
+	}
+}
+
+func TestParseNginxConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		line int
+	}{
+		{"unexpected close", "listen 80;\n}", 2},
+		{"close in a directive", "server {\n    listen 80 }", 2},
+		{"stray semicolon", "listen 80;\n;", 2},
+		{"stray brace", "{ listen 80; }", 1},
+		{"missing semicolon", "listen 80;\nroot /srv", 2},
+		{"unclosed block", "server {\n    listen 80;\n", 3},
+		{"unterminated string", "listen 80;\nreturn 200 \"abc;\n}", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseNginxConfig(tt.text, "site.conf")
+			var perr *NginxParseError
+			if !errors.As(err, &perr) || !errors.Is(err, ErrNginxParse) {
+				t.Fatalf("parseNginxConfig(%q) error = %v, want a parse error", tt.text, err)
+			}
+			if perr.File != "site.conf" || perr.Line != tt.line {
+				t.Errorf("error at %s:%d, want site.conf:%d (%v)", perr.File, perr.Line, tt.line, err)
+			}
+		})
+	}
+}
+
+func TestRenderNginxDirectives(t *testing.T) {
+	tests := []string{
+		"listen 80;\n",
+		"# top\nserver {\n    listen 443 ssl; # tls\n    location ~ \\.php$ {\n        fastcgi_pass 'unix:/run/php.sock';\n    }\n    location / {\n    }\n}\n",
+		"add_header X \"a \\\"b\\\"\" always;\nreturn 200 'it\\'s';\n",
+	}
+	for _, text := range tests {
+		dirs, err := parseNginxConfig(text, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Arguments are written as they were
+		if got := renderNginxDirectives(dirs, 0); got != text {
+			t.Errorf("renderNginxDirectives() =\n%s\nwant\n%s", got, text)
+		}
+	}
+
+	// Arguments set by the panel are quoted
+	dirs := []*nginxDirective{{Name: "server", block: true, Block: []*nginxDirective{
+		{Name: "add_header", Args: []string{"X-Note", "a; b", `c\n`}},
+		{Name: "root", Args: []string{"/srv/my site"}},
+	}}}
+	got := renderNginxDirectives(dirs, 1)
+	want := "    server {\n        add_header X-Note \"a; b\" \"c\\\\n\";\n        root \"/srv/my site\";\n    }\n"
+	if got != want {
+		t.Errorf("renderNginxDirectives() =\n%s\nwant\n%s", got, want)
+	}
+	parsed, err := parseNginxConfig(got, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumpNginx(parsed) != dumpNginx(dirs) {
+		t.Errorf("rendered directives parse as\n%s\nwant\n%s", dumpNginx(parsed), dumpNginx(dirs))
+	}
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/logger"
+)
+
+// newTestNginxService returns a service with a Debian layout in a temporary directory.
+// Its nginx binary accepts every command and appends it to nginxCommands.
+func newTestNginxService(t *testing.T) *NginxService {
+	t.Helper()
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.NginxSite{}, &models.NginxLocation{}, &models.NginxUpstream{},
+		&models.NginxAuthUser{}, &models.SSLCertificate{}, &models.SSLRenewal{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "nginx")
+	for _, sub := range []string{"sites-available", "sites-enabled"} {
+		if err := os.MkdirAll(filepath.Join(confDir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(confDir, "nginx.conf"), []byte("events {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "nginx.sh")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\necho \"$@\" >> \"$0.log\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.ACME.WebrootDir = filepath.Join(dir, "acme")
+	cfg.ACME.CertDir = filepath.Join(dir, "certs")
+	return &NginxService{
+		db:  db,
+		cfg: cfg,
+		log: logger.New(logger.Config{Level: "error"}),
+		layout: &NginxLayout{
+			Binary:       binary,
+			Available:    true,
+			Flavor:       "debian",
+			ConfPath:     filepath.Join(confDir, "nginx.conf"),
+			ConfDir:      confDir,
+			HostConfDir:  confDir,
+			SitesDir:     filepath.Join(confDir, "sites-available"),
+			EnabledDir:   filepath.Join(confDir, "sites-enabled"),
+			LogDir:       "/var/log/nginx",
+			PIDPath:      filepath.Join(dir, "nginx.pid"),
+			PHPFPMSocket: "unix:/run/php/php{version}-fpm.sock",
+			DetectedAt:   time.Now(),
+		},
+	}
+}
+
+// nginxCommands returns the commands the test nginx binary ran
+func nginxCommands(t *testing.T, s *NginxService) []string {
+	t.Helper()
+	data, err := os.ReadFile(s.layout.Binary + ".log")
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// generateTestSite generates and parses the configuration of a site
+func generateTestSite(t *testing.T, s *NginxService, site *models.NginxSite) []*nginxDirective {
+	t.Helper()
+	config, err := s.generateSiteConfig(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := parseNginxConfig(config, "site.conf")
+	if err != nil {
+		t.Fatalf("generated configuration does not parse: %v\n%s", err, config)
+	}
+	return dirs
+}
+
+// nginxArgs returns the arguments of the directives of a block with a name, joined by spaces
+func nginxArgs(block []*nginxDirective, name string) []string {
+	var args []string
+	for _, d := range block {
+		if d.Name == name {
+			args = append(args, strings.Join(d.Args, " "))
+		}
+	}
+	return args
+}
+
+// nginxBlock returns the block of the directive with a name and arguments
+func nginxBlock(block []*nginxDirective, name, args string) []*nginxDirective {
+	for _, d := range block {
+		if d.Name == name && strings.Join(d.Args, " ") == args {
+			return d.Block
+		}
+	}
+	return nil
+}
+
+// mainServer returns the last server block, the one that serves the site
+func mainServer(t *testing.T, dirs []*nginxDirective) []*nginxDirective {
+	t.Helper()
+	var server []*nginxDirective
+	for _, d := range dirs {
+		if d.Name == "server" {
+			server = d.Block
+		}
+	}
+	if server == nil {
+		t.Fatal("no server block")
+	}
+	return server
+}
+
+func TestGenerateSiteConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		site    models.NginxSite
+		servers int
+		want    map[string][]string // directives of the main server block
+		blocks  []string            // locations of the main server block
+	}{
+		{
+			name:    "static",
+			site:    models.NginxSite{Domain: "example.com", Aliases: []string{"www.example.com"}, Port: 80, RootPath: "/var/www/example.com"},
+			servers: 1,
+			want: map[string][]string{
+				"listen":      {"80"},
+				"server_name": {"example.com www.example.com"},
+				"root":        {"/var/www/example.com"},
+				"access_log":  {"/var/log/nginx/example.com.access.log vpanel_site"},
+			},
+			blocks: []string{"^~ /.well-known/acme-challenge/", `~* \.(js|css|png|jpg|jpeg|gif|ico|svg|woff|woff2|ttf|eot)$`, "/", `~ /\.`},
+		},
+		{
+			name:    "php",
+			site:    models.NginxSite{Domain: "php.test", Port: 8080, RootPath: "/srv/php", PHPEnabled: true, PHPVersion: "8.2"},
+			servers: 1,
+			want:    map[string][]string{"listen": {"8080"}, "root": {"/srv/php"}},
+			blocks:  []string{"^~ /.well-known/acme-challenge/", `~* \.(js|css|png|jpg|jpeg|gif|ico|svg|woff|woff2|ttf|eot)$`, `~ \.php$`, "/", `~ /\.`},
+		},
+		{
+			name:    "proxy with ssl",
+			site:    models.NginxSite{Domain: "app.test", Port: 443, SSLEnabled: true, ProxyEnabled: true, ProxyTarget: "http://127.0.0.1:3000"},
+			servers: 2,
+			want:    map[string][]string{"listen": {"443 ssl http2"}, "root": nil},
+			blocks:  []string{"^~ /.well-known/acme-challenge/", "/", `~ /\.`},
+		},
+		{
+			name: "custom configuration",
+			site: models.NginxSite{Domain: "custom.test", Port: 80, RootPath: "/var/www/custom.test",
+				Config: "root /srv/custom;\nlocation / {\n    return 204;\n}\ngzip off;"},
+			servers: 1,
+			want:    map[string][]string{"root": {"/srv/custom"}, "gzip": {"off"}, "gzip_types": nil},
+			blocks:  []string{"^~ /.well-known/acme-challenge/", "/", `~* \.(js|css|png|jpg|jpeg|gif|ico|svg|woff|woff2|ttf|eot)$`, `~ /\.`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNginxService(t)
+			tt.site.ID = "site"
+			dirs := generateTestSite(t, s, &tt.site)
+
+			if got := len(nginxArgs(dirs, "server")); got != tt.servers {
+				t.Errorf("%d server blocks, want %d", got, tt.servers)
+			}
+			server := mainServer(t, dirs)
+			for name, want := range tt.want {
+				if got := nginxArgs(server, name); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if got := nginxArgs(server, "location"); !reflect.DeepEqual(got, tt.blocks) {
+				t.Errorf("locations = %q, want %q", got, tt.blocks)
+			}
+		})
+	}
+}
+
+func TestGenerateSiteConfigRedirectsToHTTPS(t *testing.T) {
+	s := newTestNginxService(t)
+	site := &models.NginxSite{BaseModel: models.BaseModel{ID: "site"}, Domain: "example.com", Port: 443, SSLEnabled: true,
+		RootPath: "/var/www/example.com", CanonicalHost: "www"}
+	dirs := generateTestSite(t, s, site)
+
+	redirect := nginxBlock(dirs, "server", "")
+	if !reflect.DeepEqual(nginxArgs(redirect, "listen"), []string{"80"}) {
+		t.Fatalf("first block is not the HTTP server:\n%s", dumpNginx(dirs))
+	}
+	if got := nginxArgs(nginxBlock(redirect, "location", "/"), "return"); !reflect.DeepEqual(got, []string{"301 https://www.example.com$request_uri"}) {
+		t.Errorf("HTTP redirect = %q", got)
+	}
+	// The challenges are answered over plain HTTP
+	if got := nginxArgs(nginxBlock(redirect, "location", acmeChallengeLocation), "root"); len(got) != 1 {
+		t.Errorf("HTTP server has no ACME challenge location")
+	}
+	server := mainServer(t, dirs)
+	if got := nginxArgs(server, "server_name"); !reflect.DeepEqual(got, []string{"example.com www.example.com"}) {
+		t.Errorf("server_name = %q", got)
+	}
+	if got := nginxArgs(nginxBlock(server, "if", "($host = example.com)"), "return"); !reflect.DeepEqual(got, []string{"301 $scheme://www.example.com$request_uri"}) {
+		t.Errorf("canonical host redirect = %q", got)
+	}
+}
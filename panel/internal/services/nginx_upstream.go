@@ -0,0 +1,666 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// Upstream groups of all sites are written to one file next to the site configurations
+const nginxUpstreamsFile = "vpanel-upstreams.conf"
+
+var (
+	upstreamName    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	upstreamAddress = regexp.MustCompile(`^(unix:/\S+|\[[0-9A-Fa-f:.]+\](:\d{1,5})?|[A-Za-z0-9.-]+(:\d{1,5})?)$`)
+	headerName      = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+)
+
+// Balancing methods and the directive that selects them, round robin is nginx's default
+var upstreamMethods = map[string]string{
+	"":                "",
+	"round_robin":     "",
+	"least_conn":      "least_conn",
+	"ip_hash":         "ip_hash",
+	"hash":            "hash",
+	"consistent_hash": "hash",
+	"random":          "random",
+}
+
+// Location match types and their modifiers
+var locationModifiers = map[string]string{
+	"":         "",
+	"prefix":   "",
+	"exact":    "=",
+	"priority": "^~",
+	"regex":    "~",
+	"regex_i":  "~*",
+}
+
+const upstreamsTemplate = `# Managed by VPanel, changes to this file are overwritten
+{{range .}}
+upstream {{.Name}} {
+    {{- with .Method}}
+    {{.}};
+    {{- end}}
+    {{- range .Servers}}
+    server {{.}};
+    {{- end}}
+    {{- if .Keepalive}}
+    keepalive {{.Keepalive}};
+    {{- if .KeepaliveTimeout}}
+    keepalive_timeout {{.KeepaliveTimeout}}s;
+    {{- end}}
+    {{- end}}
+}
+{{end}}`
+
+// siteLocation is a location rule prepared for the site template
+type siteLocation struct {
+	Match           string // modifier and path
+	Access          []string
+	Proxy           bool
+	ProxyPass       string
+	Root            string
+	Alias           bool
+	Headers         []models.NginxHeader
+	ResponseHeaders []models.NginxHeader
+	ConnectTimeout  int
+	SendTimeout     int
+	ReadTimeout     int
+	NoBuffering     bool
+	NoRequestBuffer bool
+}
+
+// ListUpstreams returns all upstream groups
+func (s *NginxService) ListUpstreams(nodeID string) ([]models.NginxUpstream, error) {
+	var upstreams []models.NginxUpstream
+	query := s.db.Order("name ASC")
+
+	if nodeID != "" {
+		query = query.Where("node_id = ?", nodeID)
+	}
+
+	if err := query.Find(&upstreams).Error; err != nil {
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+// GetUpstream returns an upstream group by ID
+func (s *NginxService) GetUpstream(id string) (*models.NginxUpstream, error) {
+	var upstream models.NginxUpstream
+	if err := s.db.First(&upstream, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &upstream, nil
+}
+
+// CreateUpstream creates an upstream group and writes it to the nginx configuration
+func (s *NginxService) CreateUpstream(upstream *models.NginxUpstream) error {
+	if err := s.validateUpstream(upstream, ""); err != nil {
+		return err
+	}
+
+	if err := s.db.Create(upstream).Error; err != nil {
+		return err
+	}
+
+	changes, err := s.upstreamConfigChanges()
+	if err == nil {
+		err = s.applyConfig(changes...)
+	}
+	if err != nil {
+		s.db.Unscoped().Delete(upstream)
+		return err
+	}
+
+	s.log.Info("Nginx upstream created", "upstream_id", upstream.ID, "name", upstream.Name)
+	return nil
+}
+
+// UpdateUpstream replaces the settings of an upstream group, sites routing to it are
+// rewritten when it is renamed
+func (s *NginxService) UpdateUpstream(id string, upstream *models.NginxUpstream) error {
+	previous, err := s.GetUpstream(id)
+	if err != nil {
+		return err
+	}
+
+	upstream.BaseModel = previous.BaseModel
+	if err := s.validateUpstream(upstream, id); err != nil {
+		return err
+	}
+
+	if err := s.db.Save(upstream).Error; err != nil {
+		return err
+	}
+
+	changes, err := s.upstreamConfigChanges()
+	if err == nil && upstream.Name != previous.Name {
+		var sites []models.NginxSite
+		sites, err = s.upstreamSites(id)
+		for i := 0; err == nil && i < len(sites); i++ {
+			var siteChanges []nginxFileChange
+			siteChanges, err = s.siteConfigChanges(&sites[i])
+			changes = append(changes, siteChanges...)
+		}
+	}
+	if err == nil {
+		err = s.applyConfig(changes...)
+	}
+	if err != nil {
+		s.db.Save(previous)
+		return err
+	}
+
+	s.log.Info("Nginx upstream updated", "upstream_id", upstream.ID, "name", upstream.Name)
+	return nil
+}
+
+// DeleteUpstream deletes an upstream group that no location routes to
+func (s *NginxService) DeleteUpstream(id string) error {
+	upstream, err := s.GetUpstream(id)
+	if err != nil {
+		return err
+	}
+
+	sites, err := s.upstreamSites(id)
+	if err != nil {
+		return err
+	}
+	if len(sites) > 0 {
+		return fmt.Errorf("%w: used by %d site(s)", ErrUpstreamInUse, len(sites))
+	}
+
+	if err := s.db.Delete(upstream).Error; err != nil {
+		return err
+	}
+
+	changes, err := s.upstreamConfigChanges()
+	if err == nil {
+		err = s.applyConfig(changes...)
+	}
+	if err != nil {
+		s.db.Unscoped().Model(upstream).Update("deleted_at", nil)
+		return err
+	}
+
+	s.log.Info("Nginx upstream deleted", "upstream_id", upstream.ID, "name", upstream.Name)
+	return nil
+}
+
+// ListLocations returns the location rules of a site in the order they are written
+func (s *NginxService) ListLocations(siteID string) ([]models.NginxLocation, error) {
+	if _, err := s.GetSite(siteID); err != nil {
+		return nil, err
+	}
+	return s.siteLocations(siteID)
+}
+
+// CreateLocation adds a location rule to a site
+func (s *NginxService) CreateLocation(siteID string, location *models.NginxLocation) error {
+	site, err := s.GetSite(siteID)
+	if err != nil {
+		return err
+	}
+
+	location.SiteID = site.ID
+	if err := s.validateLocation(site, location, ""); err != nil {
+		return err
+	}
+
+	if err := s.db.Create(location).Error; err != nil {
+		return err
+	}
+
+	// A rejected config undoes the creation
+	if err := s.writeSiteConfig(site); err != nil {
+		s.db.Unscoped().Delete(location)
+		return err
+	}
+
+	s.log.Info("Nginx location created", "site_id", site.ID, "location_id", location.ID, "path", location.Path)
+	return nil
+}
+
+// UpdateLocation replaces a location rule of a site
+func (s *NginxService) UpdateLocation(siteID, id string, location *models.NginxLocation) error {
+	site, err := s.GetSite(siteID)
+	if err != nil {
+		return err
+	}
+
+	var previous models.NginxLocation
+	if err := s.db.First(&previous, "id = ? AND site_id = ?", id, siteID).Error; err != nil {
+		return fmt.Errorf("%w: %s", ErrLocationNotFound, id)
+	}
+
+	location.BaseModel = previous.BaseModel
+	location.SiteID = site.ID
+	if err := s.validateLocation(site, location, id); err != nil {
+		return err
+	}
+
+	if err := s.db.Save(location).Error; err != nil {
+		return err
+	}
+
+	// A rejected config restores the previous rule
+	if err := s.writeSiteConfig(site); err != nil {
+		s.db.Save(&previous)
+		return err
+	}
+
+	s.log.Info("Nginx location updated", "site_id", site.ID, "location_id", location.ID)
+	return nil
+}
+
+// DeleteLocation removes a location rule from a site
+func (s *NginxService) DeleteLocation(siteID, id string) error {
+	site, err := s.GetSite(siteID)
+	if err != nil {
+		return err
+	}
+
+	var location models.NginxLocation
+	if err := s.db.First(&location, "id = ? AND site_id = ?", id, siteID).Error; err != nil {
+		return fmt.Errorf("%w: %s", ErrLocationNotFound, id)
+	}
+
+	if err := s.db.Delete(&location).Error; err != nil {
+		return err
+	}
+
+	if err := s.writeSiteConfig(site); err != nil {
+		s.db.Unscoped().Model(&location).Update("deleted_at", nil)
+		return err
+	}
+
+	s.log.Info("Nginx location deleted", "site_id", site.ID, "location_id", location.ID)
+	return nil
+}
+
+// validateUpstream checks an upstream group, nginx rejects the whole configuration
+// over a bad one
+func (s *NginxService) validateUpstream(upstream *models.NginxUpstream, id string) error {
+	if !upstreamName.MatchString(upstream.Name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidUpstream, upstream.Name)
+	}
+	var existing models.NginxUpstream
+	if err := s.db.Where("name = ? AND id != ?", upstream.Name, id).First(&existing).Error; err == nil {
+		return fmt.Errorf("upstream %s already exists", upstream.Name)
+	}
+
+	if _, ok := upstreamMethods[upstream.Method]; !ok {
+		return fmt.Errorf("%w: unknown balancing method %q", ErrInvalidUpstream, upstream.Method)
+	}
+	hashed := upstream.Method == "hash" || upstream.Method == "consistent_hash"
+	if hashed && strings.TrimSpace(upstream.HashKey) == "" {
+		return fmt.Errorf("%w: the %s method needs a hash key", ErrInvalidUpstream, upstream.Method)
+	}
+	if !hashed {
+		upstream.HashKey = ""
+	}
+	if strings.ContainsAny(upstream.HashKey, ";{}\n") {
+		return fmt.Errorf("%w: invalid hash key", ErrInvalidUpstream)
+	}
+	if upstream.Keepalive < 0 || upstream.KeepaliveTimeout < 0 {
+		return fmt.Errorf("%w: keepalive must not be negative", ErrInvalidUpstream)
+	}
+
+	if len(upstream.Servers) == 0 {
+		return fmt.Errorf("%w: at least one server is required", ErrInvalidUpstream)
+	}
+	primary := 0
+	for _, server := range upstream.Servers {
+		if !upstreamAddress.MatchString(server.Address) {
+			return fmt.Errorf("%w: invalid server address %q", ErrInvalidUpstream, server.Address)
+		}
+		if server.Weight < 0 || server.MaxFails < 0 || server.FailTimeout < 0 || server.MaxConns < 0 {
+			return fmt.Errorf("%w: server %s has a negative setting", ErrInvalidUpstream, server.Address)
+		}
+		if server.Backup {
+			// Only round robin and least_conn fall back to backup servers
+			if upstream.Method != "" && upstream.Method != "round_robin" && upstream.Method != "least_conn" {
+				return fmt.Errorf("%w: the %s method does not support backup servers", ErrInvalidUpstream, upstream.Method)
+			}
+			continue
+		}
+		primary++
+	}
+	if primary == 0 {
+		return fmt.Errorf("%w: at least one server must not be a backup", ErrInvalidUpstream)
+	}
+	return nil
+}
+
+// validateLocation checks a location rule against the site, its other rules and the
+// restrictions nginx puts on proxy_pass
+func (s *NginxService) validateLocation(site *models.NginxSite, location *models.NginxLocation, id string) error {
+	modifier, ok := locationModifiers[location.Match]
+	if !ok {
+		return fmt.Errorf("%w: unknown match type %q", ErrInvalidLocation, location.Match)
+	}
+	if location.Match == "" {
+		location.Match = "prefix"
+	}
+	regex := modifier == "~" || modifier == "~*"
+	if location.Path == "" || strings.ContainsAny(location.Path, "\r\n") {
+		return fmt.Errorf("%w: invalid path %q", ErrInvalidLocation, location.Path)
+	}
+	if !regex && !strings.HasPrefix(location.Path, "/") {
+		return fmt.Errorf("%w: path %q must start with /", ErrInvalidLocation, location.Path)
+	}
+
+	// The same location twice is a duplicate for nginx
+	key := siteLocationKey(location)
+	if key == acmeChallengeLocation {
+		return fmt.Errorf("%w: the ACME challenge location is managed by the panel", ErrInvalidLocation)
+	}
+	if parseNginxOverrides(site.Config, s.Layout()).hasLocation(key) {
+		return fmt.Errorf("%w: location %s is already defined in the custom configuration", ErrInvalidLocation, key)
+	}
+	others, err := s.siteLocations(site.ID)
+	if err != nil {
+		return err
+	}
+	for i := range others {
+		if others[i].ID != id && siteLocationKey(&others[i]) == key {
+			return fmt.Errorf("%w: location %s already exists", ErrInvalidLocation, key)
+		}
+	}
+
+	switch location.Target {
+	case "upstream":
+		var upstream models.NginxUpstream
+		if err := s.db.First(&upstream, "id = ?", location.UpstreamID).Error; err != nil {
+			return fmt.Errorf("%w: upstream not found", ErrInvalidLocation)
+		}
+		if location.UpstreamPath != "" {
+			// nginx cannot replace the part of the URI a regex matched
+			if regex {
+				return fmt.Errorf("%w: an upstream path cannot be used with a regex location", ErrInvalidLocation)
+			}
+			if !strings.HasPrefix(location.UpstreamPath, "/") || strings.ContainsAny(location.UpstreamPath, " \t\r\n;{}\"'") {
+				return fmt.Errorf("%w: invalid upstream path %q", ErrInvalidLocation, location.UpstreamPath)
+			}
+		}
+		location.ProxyTarget, location.RootPath, location.Alias = "", "", false
+	case "proxy":
+		u, err := url.Parse(location.ProxyTarget)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			strings.ContainsAny(location.ProxyTarget, " \t\r\n;{}\"'") {
+			return fmt.Errorf("%w: invalid proxy target %q", ErrInvalidLocation, location.ProxyTarget)
+		}
+		if regex && (u.Path != "" || u.RawQuery != "") {
+			return fmt.Errorf("%w: the proxy target of a regex location cannot have a path", ErrInvalidLocation)
+		}
+		location.UpstreamID, location.UpstreamPath, location.RootPath, location.Alias = "", "", "", false
+	case "static":
+		if !filepath.IsAbs(location.RootPath) || strings.ContainsAny(location.RootPath, "\r\n") {
+			return fmt.Errorf("%w: the root path must be absolute", ErrInvalidLocation)
+		}
+		location.UpstreamID, location.UpstreamPath, location.ProxyTarget = "", "", ""
+		location.WebSocket, location.NoBuffering, location.NoRequestBuffer = false, false, false
+		location.Headers = nil
+		location.ConnectTimeout, location.SendTimeout, location.ReadTimeout = 0, 0, 0
+	default:
+		return fmt.Errorf("%w: unknown target %q", ErrInvalidLocation, location.Target)
+	}
+
+	for _, header := range append(append(models.NginxHeaders{}, location.Headers...), location.ResponseHeaders...) {
+		if !headerName.MatchString(header.Name) || strings.ContainsAny(header.Value, "\r\n") {
+			return fmt.Errorf("%w: invalid header %q", ErrInvalidLocation, header.Name)
+		}
+	}
+	if location.ConnectTimeout < 0 || location.SendTimeout < 0 || location.ReadTimeout < 0 {
+		return fmt.Errorf("%w: timeouts must not be negative", ErrInvalidLocation)
+	}
+	return validateAccess(&location.Access)
+}
+
+// upstreamConfigChanges returns the file changes that write all upstream groups
+func (s *NginxService) upstreamConfigChanges() ([]nginxFileChange, error) {
+	var upstreams []models.NginxUpstream
+	if err := s.db.Order("name ASC").Find(&upstreams).Error; err != nil {
+		return nil, err
+	}
+	if len(upstreams) == 0 {
+		return s.httpConfigChanges(nginxUpstreamsFile, "")
+	}
+
+	config, err := generateUpstreamsConfig(upstreams)
+	if err != nil {
+		return nil, err
+	}
+	return s.httpConfigChanges(nginxUpstreamsFile, config)
+}
+
+// httpConfigChanges returns the file changes that write a panel managed file of http
+// level directives, it is linked like a site where the layout links sites and removed
+// when content is empty
+func (s *NginxService) httpConfigChanges(name, content string) ([]nginxFileChange, error) {
+	configPath, enabledPath := s.httpConfigPaths(name)
+	if content == "" {
+		changes := []nginxFileChange{{path: configPath, remove: true}}
+		if enabledPath != "" {
+			changes = append(changes, nginxFileChange{path: enabledPath, remove: true})
+		}
+		return changes, nil
+	}
+
+	changes := []nginxFileChange{{path: configPath, content: []byte(content)}}
+	if enabledPath != "" {
+		target, err := filepath.Rel(filepath.Dir(enabledPath), configPath)
+		if err != nil {
+			target = configPath
+		}
+		changes = append(changes, nginxFileChange{path: enabledPath, symlink: target})
+	}
+	return changes, nil
+}
+
+// httpConfigPaths returns the paths of a managed http level file and its enabled symlink on this host
+func (s *NginxService) httpConfigPaths(name string) (string, string) {
+	layout := s.Layout()
+	configPath := layout.HostPath(filepath.Join(layout.SitesDir, name))
+	if layout.EnabledDir == "" {
+		return configPath, ""
+	}
+	return configPath, layout.HostPath(filepath.Join(layout.EnabledDir, name))
+}
+
+// upstreamSites returns the sites with a location routed to an upstream
+func (s *NginxService) upstreamSites(upstreamID string) ([]models.NginxSite, error) {
+	var sites []models.NginxSite
+	err := s.db.Where("id IN (?)", s.db.Model(&models.NginxLocation{}).Select("site_id").Where("upstream_id = ?", upstreamID)).
+		Find(&sites).Error
+	return sites, err
+}
+
+// siteLocations returns the location rules of a site in the order they are written
+func (s *NginxService) siteLocations(siteID string) ([]models.NginxLocation, error) {
+	var locations []models.NginxLocation
+	if err := s.db.Where("site_id = ?", siteID).Order("priority ASC, created_at ASC").Find(&locations).Error; err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// siteLocationViews prepares the location rules of a site for the template
+func (s *NginxService) siteLocationViews(site *models.NginxSite, locations []models.NginxLocation) ([]siteLocation, error) {
+	views := make([]siteLocation, 0, len(locations))
+	for _, loc := range locations {
+		match := quoteNginxArg(loc.Path)
+		if modifier := locationModifiers[loc.Match]; modifier != "" {
+			match = modifier + " " + match
+		}
+		view := siteLocation{
+			Match:           match,
+			Access:          accessDirectives(loc.Access, loc.ID, s.htpasswdPath(site)),
+			ConnectTimeout:  loc.ConnectTimeout,
+			SendTimeout:     loc.SendTimeout,
+			ReadTimeout:     loc.ReadTimeout,
+			NoBuffering:     loc.NoBuffering,
+			NoRequestBuffer: loc.NoRequestBuffer,
+		}
+
+		keepalive := false
+		switch loc.Target {
+		case "upstream":
+			var upstream models.NginxUpstream
+			if err := s.db.First(&upstream, "id = ?", loc.UpstreamID).Error; err != nil {
+				return nil, fmt.Errorf("%w: upstream of location %s not found", ErrInvalidLocation, loc.Path)
+			}
+			view.Proxy = true
+			view.ProxyPass = "http://" + upstream.Name + loc.UpstreamPath
+			keepalive = upstream.Keepalive > 0
+		case "proxy":
+			view.Proxy = true
+			view.ProxyPass = loc.ProxyTarget
+		default:
+			view.Root = quoteNginxArg(loc.RootPath)
+			view.Alias = loc.Alias
+		}
+
+		if view.Proxy {
+			headers := []models.NginxHeader{
+				{Name: "Host", Value: "$host"},
+				{Name: "X-Real-IP", Value: "$remote_addr"},
+				{Name: "X-Forwarded-For", Value: "$proxy_add_x_forwarded_for"},
+				{Name: "X-Forwarded-Proto", Value: "$scheme"},
+			}
+			switch {
+			case loc.WebSocket:
+				headers = append(headers, models.NginxHeader{Name: "Upgrade", Value: "$http_upgrade"},
+					models.NginxHeader{Name: "Connection", Value: "upgrade"})
+			case keepalive:
+				// Cached upstream connections must not be closed by the client's Connection header
+				headers = append(headers, models.NginxHeader{Name: "Connection", Value: ""})
+			}
+			view.Headers = quoteHeaders(mergeHeaders(headers, loc.Headers))
+		}
+
+		// A location with its own add_header no longer inherits the server's
+		if len(loc.ResponseHeaders) > 0 {
+			view.ResponseHeaders = quoteHeaders(mergeHeaders(siteResponseHeaders(site), loc.ResponseHeaders))
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// siteResponseHeaders returns the headers the generated server block adds to responses
+func siteResponseHeaders(site *models.NginxSite) []models.NginxHeader {
+	var headers []models.NginxHeader
+	if site.SSLEnabled {
+		headers = append(headers, models.NginxHeader{Name: "Strict-Transport-Security", Value: "max-age=63072000"})
+	}
+	return append(headers,
+		models.NginxHeader{Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+		models.NginxHeader{Name: "X-Content-Type-Options", Value: "nosniff"},
+		models.NginxHeader{Name: "X-XSS-Protection", Value: "1; mode=block"},
+	)
+}
+
+// mergeHeaders overrides base headers with the ones of the same name from extra
+func mergeHeaders(base []models.NginxHeader, extra models.NginxHeaders) []models.NginxHeader {
+	merged := make([]models.NginxHeader, 0, len(base)+len(extra))
+	for _, header := range base {
+		overridden := false
+		for _, e := range extra {
+			if strings.EqualFold(e.Name, header.Name) {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, header)
+		}
+	}
+	return append(merged, extra...)
+}
+
+// quoteHeaders quotes header names and values for the template, a name may hold quotes
+// and "#" like any HTTP token
+func quoteHeaders(headers []models.NginxHeader) []models.NginxHeader {
+	quoted := make([]models.NginxHeader, len(headers))
+	for i, header := range headers {
+		quoted[i] = models.NginxHeader{Name: quoteNginxArg(header.Name), Value: quoteNginxArg(header.Value)}
+	}
+	return quoted
+}
+
+// siteLocationKey returns the key of a location rule as nginxLocationKey does for parsed ones
+func siteLocationKey(location *models.NginxLocation) string {
+	if modifier := locationModifiers[location.Match]; modifier != "" {
+		return nginxLocationKey([]string{modifier, location.Path})
+	}
+	return nginxLocationKey([]string{location.Path})
+}
+
+// generateUpstreamsConfig renders the upstream blocks
+func generateUpstreamsConfig(upstreams []models.NginxUpstream) (string, error) {
+	type upstreamView struct {
+		Name             string
+		Method           string
+		Servers          []string
+		Keepalive        int
+		KeepaliveTimeout int
+	}
+
+	views := make([]upstreamView, 0, len(upstreams))
+	for _, u := range upstreams {
+		view := upstreamView{Name: u.Name, Method: upstreamMethods[u.Method], Keepalive: u.Keepalive, KeepaliveTimeout: u.KeepaliveTimeout}
+		switch u.Method {
+		case "hash":
+			view.Method += " " + quoteNginxArg(u.HashKey)
+		case "consistent_hash":
+			view.Method += " " + quoteNginxArg(u.HashKey) + " consistent"
+		}
+
+		for _, server := range u.Servers {
+			parts := []string{server.Address}
+			if server.Weight > 0 {
+				parts = append(parts, fmt.Sprintf("weight=%d", server.Weight))
+			}
+			if server.MaxFails > 0 {
+				parts = append(parts, fmt.Sprintf("max_fails=%d", server.MaxFails))
+			}
+			if server.FailTimeout > 0 {
+				parts = append(parts, fmt.Sprintf("fail_timeout=%ds", server.FailTimeout))
+			}
+			if server.MaxConns > 0 {
+				parts = append(parts, fmt.Sprintf("max_conns=%d", server.MaxConns))
+			}
+			if server.Backup {
+				parts = append(parts, "backup")
+			}
+			if server.Down {
+				parts = append(parts, "down")
+			}
+			view.Servers = append(view.Servers, strings.Join(parts, " "))
+		}
+		views = append(views, view)
+	}
+
+	var b strings.Builder
+	if err := template.Must(template.New("upstreams").Parse(upstreamsTemplate)).Execute(&b, views); err != nil {
+		return "", fmt.Errorf("failed to generate config: %w", err)
+	}
+	return collapseBlankLines(b.String()), nil
+}
+
+// Errors
+var (
+	ErrInvalidUpstream  = errors.New("invalid upstream")
+	ErrUpstreamInUse    = errors.New("upstream is in use")
+	ErrInvalidLocation  = errors.New("invalid location")
+	ErrLocationNotFound = errors.New("location not found")
+)
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+func TestGenerateUpstreamsConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream models.NginxUpstream
+		want     string
+	}{
+		{
+			"round robin",
+			models.NginxUpstream{Name: "app", Servers: models.UpstreamServers{{Address: "10.0.0.1:8080"}, {Address: "10.0.0.2:8080"}}},
+			"upstream \"app\"\n  server \"10.0.0.1:8080\"\n  server \"10.0.0.2:8080\"",
+		},
+		{
+			"server settings",
+			models.NginxUpstream{Name: "app", Method: "least_conn", Servers: models.UpstreamServers{
+				{Address: "10.0.0.1:8080", Weight: 3, MaxFails: 2, FailTimeout: 10, MaxConns: 100},
+				{Address: "unix:/run/app.sock", Backup: true},
+				{Address: "[::1]:9000", Down: true},
+			}},
+			"upstream \"app\"\n  least_conn\n  server \"10.0.0.1:8080\" \"weight=3\" \"max_fails=2\" \"fail_timeout=10s\" \"max_conns=100\"\n" +
+				"  server \"unix:/run/app.sock\" \"backup\"\n  server \"[::1]:9000\" \"down\"",
+		},
+		{
+			"hash",
+			models.NginxUpstream{Name: "app", Method: "hash", HashKey: "$request_uri", Servers: models.UpstreamServers{{Address: "a:1"}}},
+			"upstream \"app\"\n  hash \"$request_uri\"\n  server \"a:1\"",
+		},
+		{
+			"consistent hash with a quoted key",
+			models.NginxUpstream{Name: "app", Method: "consistent_hash", HashKey: `$host "$uri"`, Servers: models.UpstreamServers{{Address: "a:1"}}},
+			"upstream \"app\"\n  hash \"$host \\\"$uri\\\"\" \"consistent\"\n  server \"a:1\"",
+		},
+		{
+			"keepalive",
+			models.NginxUpstream{Name: "app", Keepalive: 16, KeepaliveTimeout: 60, Servers: models.UpstreamServers{{Address: "a:1"}}},
+			"upstream \"app\"\n  server \"a:1\"\n  keepalive \"16\"\n  keepalive_timeout \"60s\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := generateUpstreamsConfig([]models.NginxUpstream{tt.upstream})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dirs, err := parseNginxConfig(config, "upstreams.conf")
+			if err != nil {
+				t.Fatalf("%v\n%s", err, config)
+			}
+			if got := dumpNginx(dirs[1:]); got != tt.want {
+				t.Errorf("generateUpstreamsConfig() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeHeaders(t *testing.T) {
+	base := []models.NginxHeader{{Name: "Host", Value: "$host"}, {Name: "X-Real-IP", Value: "$remote_addr"}}
+	tests := []struct {
+		name  string
+		extra models.NginxHeaders
+		want  []models.NginxHeader
+	}{
+		{"none", nil, base},
+		{"added", models.NginxHeaders{{Name: "X-App", Value: "1"}}, append(append([]models.NginxHeader{}, base...), models.NginxHeader{Name: "X-App", Value: "1"})},
+		{
+			"overridden in any case",
+			models.NginxHeaders{{Name: "host", Value: "backend"}},
+			[]models.NginxHeader{{Name: "X-Real-IP", Value: "$remote_addr"}, {Name: "host", Value: "backend"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := mergeHeaders(base, tt.extra); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mergeHeaders() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateSiteConfigLocations(t *testing.T) {
+	s := newTestNginxService(t)
+	upstream := models.NginxUpstream{Name: "app", Keepalive: 8, Servers: models.UpstreamServers{{Address: "10.0.0.1:8080"}}}
+	if err := s.db.Create(&upstream).Error; err != nil {
+		t.Fatal(err)
+	}
+	site := &models.NginxSite{BaseModel: models.BaseModel{ID: "site"}, Domain: "example.com", Port: 80, RootPath: "/var/www/example.com"}
+
+	// Values the validation lets through that nginx reads as syntax when written bare
+	locations := []models.NginxLocation{
+		{Match: "prefix", Path: "/api/", Target: "upstream", UpstreamID: upstream.ID, UpstreamPath: "/",
+			Headers: models.NginxHeaders{{Name: "'a", Value: "' ; deny all; #"}, {Name: "X-Note", Value: `x\nSet-Cookie: a=b`}}},
+		{Match: "regex_i", Path: `\.(png|jpg)$`, Priority: 1, Target: "static", RootPath: "/srv/my images",
+			ResponseHeaders: models.NginxHeaders{{Name: "#x", Value: "1; mode=block"}}},
+		{Match: "exact", Path: "/ws; return 200 {}", Target: "proxy", ProxyTarget: "http://127.0.0.1:3000", WebSocket: true, ReadTimeout: 3600},
+		{Match: "priority", Path: "/files/", Target: "static", RootPath: "/srv/files/", Alias: true},
+	}
+	for i := range locations {
+		locations[i].SiteID = site.ID
+		if err := s.db.Create(&locations[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := mainServer(t, generateTestSite(t, s, site))
+	tests := []struct {
+		location string
+		want     map[string][]string
+	}{
+		{
+			"/api/",
+			map[string][]string{
+				"proxy_pass": {"http://app/"},
+				"proxy_set_header": {"Host $host", "X-Real-IP $remote_addr", "X-Forwarded-For $proxy_add_x_forwarded_for",
+					"X-Forwarded-Proto $scheme", "Connection ", "'a ' ; deny all; #", `X-Note x\nSet-Cookie: a=b`},
+				"deny": nil,
+			},
+		},
+		{
+			`~* \.(png|jpg)$`,
+			map[string][]string{
+				"root":       {"/srv/my images"},
+				"try_files":  {"$uri $uri/ =404"},
+				"add_header": {"X-Frame-Options SAMEORIGIN always", "X-Content-Type-Options nosniff always", "X-XSS-Protection 1; mode=block always", "#x 1; mode=block always"},
+			},
+		},
+		{
+			"= /ws; return 200 {}",
+			map[string][]string{
+				"proxy_pass":         {"http://127.0.0.1:3000"},
+				"proxy_read_timeout": {"3600s"},
+				"proxy_set_header": {"Host $host", "X-Real-IP $remote_addr", "X-Forwarded-For $proxy_add_x_forwarded_for",
+					"X-Forwarded-Proto $scheme", "Upgrade $http_upgrade", "Connection upgrade"},
+				"return": nil,
+			},
+		},
+		{
+			"^~ /files/",
+			map[string][]string{"alias": {"/srv/files/"}, "root": nil, "try_files": nil},
+		},
+	}
+	for _, tt := range tests {
+		block := nginxBlock(server, "location", tt.location)
+		if block == nil {
+			t.Errorf("no location %s in %q", tt.location, nginxArgs(server, "location"))
+			continue
+		}
+		for name, want := range tt.want {
+			if got := nginxArgs(block, name); !reflect.DeepEqual(got, want) {
+				t.Errorf("location %s: %s = %q, want %q", tt.location, name, got, want)
+			}
+		}
+	}
+
+	// A location rule replaces the generated location of the same path
+	site.ProxyEnabled, site.ProxyTarget = true, "http://127.0.0.1:8000"
+	if err := s.db.Create(&models.NginxLocation{SiteID: site.ID, Path: "/", Target: "static", RootPath: "/srv/root"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	server = mainServer(t, generateTestSite(t, s, site))
+	if got := nginxArgs(nginxBlock(server, "location", "/"), "root"); !reflect.DeepEqual(got, []string{"/srv/root"}) {
+		t.Errorf("location / root = %q, want the rule's", got)
+	}
+	written := 0
+	for _, args := range nginxArgs(server, "location") {
+		if args == "/" {
+			written++
+		}
+	}
+	if written != 1 {
+		t.Errorf("location / written %d times", written)
+	}
+}
+
+func TestValidateLocation(t *testing.T) {
+	s := newTestNginxService(t)
+	upstream := models.NginxUpstream{Name: "app", Servers: models.UpstreamServers{{Address: "10.0.0.1:8080"}}}
+	if err := s.db.Create(&upstream).Error; err != nil {
+		t.Fatal(err)
+	}
+	site := &models.NginxSite{BaseModel: models.BaseModel{ID: "site"}, Domain: "example.com", Config: "location /custom/ {\n}"}
+	if err := s.db.Create(&models.NginxLocation{SiteID: site.ID, Path: "/taken/", Target: "static", RootPath: "/srv"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	static := func(path string) models.NginxLocation {
+		return models.NginxLocation{Path: path, Target: "static", RootPath: "/srv"}
+	}
+	tests := []struct {
+		name     string
+		location models.NginxLocation
+		ok       bool
+	}{
+		{"static", static("/static/"), true},
+		{"regex", models.NginxLocation{Match: "regex", Path: `\.php$`, Target: "proxy", ProxyTarget: "http://127.0.0.1:9000"}, true},
+		{"upstream", models.NginxLocation{Path: "/api/", Target: "upstream", UpstreamID: upstream.ID, UpstreamPath: "/v1/"}, true},
+		{"unknown match", models.NginxLocation{Match: "glob", Path: "/a/", Target: "static", RootPath: "/srv"}, false},
+		{"unknown target", models.NginxLocation{Path: "/a/", Target: "php"}, false},
+		{"empty path", static(""), false},
+		{"relative path", static("a/"), false},
+		{"newline in the path", static("/a\n}"), false},
+		{"duplicate", static("/taken/"), false},
+		{"defined in the custom configuration", static("/custom/"), false},
+		{"acme challenge", models.NginxLocation{Match: "priority", Path: "/.well-known/acme-challenge/", Target: "static", RootPath: "/srv"}, false},
+		{"relative root", models.NginxLocation{Path: "/a/", Target: "static", RootPath: "srv"}, false},
+		{"missing upstream", models.NginxLocation{Path: "/a/", Target: "upstream", UpstreamID: "nope"}, false},
+		{"upstream path of a regex", models.NginxLocation{Match: "regex", Path: "^/a", Target: "upstream", UpstreamID: upstream.ID, UpstreamPath: "/"}, false},
+		{"upstream path injection", models.NginxLocation{Path: "/a/", Target: "upstream", UpstreamID: upstream.ID, UpstreamPath: "/; deny all"}, false},
+		{"proxy scheme", models.NginxLocation{Path: "/a/", Target: "proxy", ProxyTarget: "ftp://host"}, false},
+		{"proxy injection", models.NginxLocation{Path: "/a/", Target: "proxy", ProxyTarget: "http://host;deny"}, false},
+		{"proxy path of a regex", models.NginxLocation{Match: "regex", Path: "^/a", Target: "proxy", ProxyTarget: "http://host/x"}, false},
+		{"header name", models.NginxLocation{Path: "/a/", Target: "proxy", ProxyTarget: "http://host", Headers: models.NginxHeaders{{Name: "X A", Value: "1"}}}, false},
+		{"header value newline", models.NginxLocation{Path: "/a/", Target: "proxy", ProxyTarget: "http://host", Headers: models.NginxHeaders{{Name: "X-A", Value: "1\r\nX-B: 2"}}}, false},
+		{"response header newline", models.NginxLocation{Path: "/a/", Target: "static", RootPath: "/srv", ResponseHeaders: models.NginxHeaders{{Name: "X-A", Value: "\n"}}}, false},
+		{"negative timeout", models.NginxLocation{Path: "/a/", Target: "proxy", ProxyTarget: "http://host", ReadTimeout: -1}, false},
+		{"invalid access", models.NginxLocation{Path: "/a/", Target: "static", RootPath: "/srv", Access: models.NginxAccess{Allow: []string{"all; "}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.validateLocation(site, &tt.location, "")
+			if tt.ok {
+				if err != nil {
+					t.Errorf("validateLocation() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidLocation) && !errors.Is(err, ErrInvalidSiteRule) {
+				t.Errorf("validateLocation() error = %v, want an invalid location", err)
+			}
+		})
+	}
+}
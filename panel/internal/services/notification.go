@@ -0,0 +1,242 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/logger"
+	"gorm.io/gorm"
+)
+
+// Alerts with the same title are not raised again while one is active within this window
+const alertDedupWindow = time.Hour
+
+// NotificationService raises alerts and delivers them through the configured channels
+type NotificationService struct {
+	db       *gorm.DB
+	log      *logger.Logger
+	settings *SettingsService
+}
+
+// NewNotificationService creates a new notification service
+func NewNotificationService(db *gorm.DB, log *logger.Logger, settings *SettingsService) *NotificationService {
+	return &NotificationService{db: db, log: log, settings: settings}
+}
+
+// Alert records an alert and notifies the enabled channels. Alerts are skipped when the
+// matching "<type>_alerts" setting is disabled or an identical alert is still active.
+func (s *NotificationService) Alert(alertType, severity, title, message string) (*models.Alert, error) {
+	if !s.settings.GetBool(alertType+"_alerts", true) {
+		return nil, nil
+	}
+
+	var count int64
+	s.db.Model(&models.Alert{}).
+		Where("type = ? AND title = ? AND status = ? AND created_at > ?", alertType, title, "active", time.Now().Add(-alertDedupWindow)).
+		Count(&count)
+	if count > 0 {
+		return nil, nil
+	}
+
+	alert := &models.Alert{
+		Type:     alertType,
+		Severity: severity,
+		Title:    title,
+		Message:  message,
+		Status:   "active",
+	}
+	if err := s.db.Create(alert).Error; err != nil {
+		return nil, err
+	}
+
+	s.log.Warn("Alert raised", "type", alertType, "severity", severity, "title", title)
+
+	go s.Notify(alertType, severity, title, message)
+
+	return alert, nil
+}
+
+// Notify delivers a message through email, the global webhook and notification channels
+func (s *NotificationService) Notify(event, severity, title, message string) {
+	payload := map[string]interface{}{
+		"event":    event,
+		"severity": severity,
+		"title":    title,
+		"message":  message,
+		"time":     time.Now().Format(time.RFC3339),
+	}
+
+	if s.settings.GetBool("email_enabled", false) {
+		if err := s.sendEmail(title, message); err != nil {
+			s.log.Error("Failed to send alert email", "error", err)
+		}
+	}
+
+	if s.settings.GetBool("webhook_enabled", false) {
+		if url := s.settings.GetString("webhook_url", ""); url != "" {
+			if err := postJSON(url, payload); err != nil {
+				s.log.Error("Failed to send alert webhook", "error", err)
+			}
+		}
+	}
+
+	var channels []models.Notification
+	s.db.Where("enabled = ?", true).Find(&channels)
+	for _, ch := range channels {
+		if len(ch.Events) > 0 && !containsString(ch.Events, event) {
+			continue
+		}
+		if err := s.sendToChannel(&ch, title, message, payload); err != nil {
+			s.log.Error("Failed to send notification", "channel", ch.Name, "error", err)
+		}
+	}
+}
+
+func (s *NotificationService) sendToChannel(ch *models.Notification, title, message string, payload map[string]interface{}) error {
+	cfg := func(key string) string {
+		if v, ok := ch.Config[key]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+
+	switch ch.Type {
+	case "webhook":
+		return postJSON(cfg("url"), payload)
+	case "slack":
+		return postJSON(cfg("url"), map[string]string{"text": "*" + title + "*\n" + message})
+	case "telegram":
+		url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", cfg("bot_token"))
+		return postJSON(url, map[string]string{"chat_id": cfg("chat_id"), "text": title + "\n" + message})
+	case "email":
+		return s.sendEmailTo(strings.Split(cfg("to"), ","), title, message)
+	default:
+		return fmt.Errorf("unsupported notification type %s", ch.Type)
+	}
+}
+
+// sendEmail sends a message to all active administrators
+func (s *NotificationService) sendEmail(subject, body string) error {
+	var admins []models.User
+	s.db.Where("role = ? AND status = ?", "admin", "active").Find(&admins)
+
+	var to []string
+	for _, u := range admins {
+		if u.Email != "" {
+			to = append(to, u.Email)
+		}
+	}
+	return s.sendEmailTo(to, subject, body)
+}
+
+func (s *NotificationService) sendEmailTo(to []string, subject, body string) error {
+	var recipients []string
+	for _, addr := range to {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			recipients = append(recipients, addr)
+		}
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("no email recipients")
+	}
+
+	host := s.settings.GetString("smtp_host", "")
+	if host == "" {
+		return fmt.Errorf("smtp host is not configured")
+	}
+	port := s.settings.GetInt("smtp_port", 587)
+	username := s.settings.GetString("smtp_username", "")
+	password := s.settings.GetString("smtp_password", "")
+	from := s.settings.GetString("from_email", username)
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, strings.Join(recipients, ", "), subject, time.Now().Format(time.RFC1123Z), body)
+
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if port != 465 {
+		// SendMail upgrades to STARTTLS when the server supports it
+		return smtp.SendMail(addr, auth, from, recipients, []byte(msg))
+	}
+
+	// Port 465 uses implicit TLS
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func postJSON(url string, payload interface{}) error {
+	if url == "" {
+		return fmt.Errorf("url is not configured")
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
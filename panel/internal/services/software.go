@@ -0,0 +1,805 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/logger"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+//go:embed apptemplates/*.yaml
+var builtinAppTemplates embed.FS
+
+// How long the remote catalogue index is cached
+const remoteCatalogTTL = time.Hour
+
+var appNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// AppTemplate describes a deployable application defined as a parameterised compose file.
+// Field values are written to the project's .env file and referenced as ${KEY} in Compose.
+type AppTemplate struct {
+	Name        string     `yaml:"name" json:"name"`
+	Title       string     `yaml:"title" json:"title"`
+	Description string     `yaml:"description" json:"description"`
+	Category    string     `yaml:"category" json:"category"`
+	Version     string     `yaml:"version" json:"version"`
+	Icon        string     `yaml:"icon" json:"icon"`
+	Website     string     `yaml:"website" json:"website"`
+	WebPort     string     `yaml:"web_port" json:"web_port"` // key of the port field proxied by nginx
+	Fields      []AppField `yaml:"fields" json:"fields"`
+	Compose     string     `yaml:"compose" json:"compose,omitempty"`
+	Source      string     `yaml:"-" json:"source"` // builtin, remote, local
+}
+
+// AppField defines a typed input of an app template
+type AppField struct {
+	Key         string           `yaml:"key" json:"key"`
+	Type        string           `yaml:"type" json:"type"` // string, int, bool, select, password, secret, port
+	Label       string           `yaml:"label" json:"label"`
+	Description string           `yaml:"description" json:"description,omitempty"`
+	Default     string           `yaml:"default" json:"default,omitempty"`
+	Required    bool             `yaml:"required" json:"required"`
+	Options     []AppFieldOption `yaml:"options" json:"options,omitempty"`
+	Pattern     string           `yaml:"pattern" json:"pattern,omitempty"`
+	Length      int              `yaml:"length" json:"length,omitempty"` // length of generated secrets
+}
+
+// AppFieldOption defines a select option
+type AppFieldOption struct {
+	Value string `yaml:"value" json:"value"`
+	Label string `yaml:"label" json:"label"`
+}
+
+// AppCatalogIndex is the format of a remote catalogue index
+type AppCatalogIndex struct {
+	Apps []AppTemplate `yaml:"apps" json:"apps"`
+}
+
+// InstallAppRequest represents a request to deploy an app template
+type InstallAppRequest struct {
+	App    string            `json:"app" binding:"required"`
+	Name   string            `json:"name" binding:"required"`
+	Values map[string]string `json:"values"`
+	Domain string            `json:"domain"` // optional reverse-proxy site
+	SSL    bool              `json:"ssl"`    // request a Let's Encrypt certificate for Domain
+}
+
+// InstallAppResult represents the outcome of an app deployment
+type InstallAppResult struct {
+	Software *models.Software             `json:"software"`
+	Project  *models.DockerComposeProject `json:"project"`
+	Site     *models.NginxSite            `json:"site,omitempty"`
+	Output   string                       `json:"output"`
+	Warnings []string                     `json:"warnings"`
+}
+
+// InstalledAppStatus represents the live status of an installed app
+type InstalledAppStatus struct {
+	Software *models.Software     `json:"software"`
+	Status   string               `json:"status"`
+	Services []ComposeServiceInfo `json:"services"`
+}
+
+// AppValidationError reports invalid field values keyed by field
+type AppValidationError struct {
+	Fields map[string]string
+}
+
+func (e *AppValidationError) Error() string {
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + ": " + e.Fields[k]
+	}
+	return "invalid values: " + strings.Join(parts, "; ")
+}
+
+// SoftwareService manages the app catalogue and app deployments
+type SoftwareService struct {
+	db     *gorm.DB
+	config *config.Config
+	log    *logger.Logger
+	docker *DockerService
+	nginx  *NginxService
+
+	mu            sync.Mutex
+	remote        []AppTemplate
+	remoteFetched time.Time
+}
+
+// NewSoftwareService creates a new software service
+func NewSoftwareService(db *gorm.DB, cfg *config.Config, log *logger.Logger, docker *DockerService, nginx *NginxService) *SoftwareService {
+	return &SoftwareService{db: db, config: cfg, log: log, docker: docker, nginx: nginx}
+}
+
+// ListTemplates returns the app catalogue, optionally filtered by category.
+// Local templates override the built-in catalogue, remote ones only add apps missing from both.
+func (s *SoftwareService) ListTemplates(ctx context.Context, category string) ([]AppTemplate, error) {
+	catalog := make(map[string]AppTemplate)
+
+	builtin, err := loadBuiltinTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range builtin {
+		catalog[t.Name] = t
+	}
+
+	for _, t := range s.localTemplates() {
+		catalog[t.Name] = t
+	}
+
+	// A remote index only adds apps, it cannot swap the compose file of a built-in
+	// or local template that installed apps are upgraded from
+	for _, t := range s.remoteTemplates(ctx, false) {
+		if _, ok := catalog[t.Name]; ok {
+			continue
+		}
+		catalog[t.Name] = t
+	}
+
+	result := make([]AppTemplate, 0, len(catalog))
+	for _, t := range catalog {
+		if category != "" && t.Category != category {
+			continue
+		}
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+// GetTemplate returns a single app template by name
+func (s *SoftwareService) GetTemplate(ctx context.Context, name string) (*AppTemplate, error) {
+	templates, err := s.ListTemplates(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for i := range templates {
+		if templates[i].Name == name {
+			return &templates[i], nil
+		}
+	}
+	return nil, ErrAppTemplateNotFound
+}
+
+// RefreshCatalog forces the remote catalogue index to be fetched again
+func (s *SoftwareService) RefreshCatalog(ctx context.Context) ([]AppTemplate, error) {
+	s.remoteTemplates(ctx, true)
+	return s.ListTemplates(ctx, "")
+}
+
+// ListInstalled returns installed apps with their current status
+func (s *SoftwareService) ListInstalled(ctx context.Context) ([]models.Software, error) {
+	var apps []models.Software
+	if err := s.db.Order("created_at DESC").Find(&apps).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range apps {
+		if apps[i].ComposeProjectID == "" {
+			continue
+		}
+		if project, err := s.docker.GetComposeProject(ctx, apps[i].ComposeProjectID); err == nil {
+			apps[i].Status = project.Status
+		}
+	}
+
+	return apps, nil
+}
+
+// GetStatus returns the status of an installed app by name
+func (s *SoftwareService) GetStatus(ctx context.Context, name string) (*InstalledAppStatus, error) {
+	var app models.Software
+	if err := s.db.Where("name = ?", name).First(&app).Error; err != nil {
+		return nil, ErrAppNotInstalled
+	}
+
+	status := &InstalledAppStatus{Software: &app, Status: app.Status, Services: []ComposeServiceInfo{}}
+	if app.ComposeProjectID == "" {
+		return status, nil
+	}
+
+	project, err := s.docker.GetComposeProject(ctx, app.ComposeProjectID)
+	if err != nil {
+		return nil, err
+	}
+	status.Status = project.Status
+
+	if services, err := s.docker.ListComposeServices(ctx, app.ComposeProjectID); err == nil {
+		status.Services = services
+	}
+
+	return status, nil
+}
+
+// Install deploys an app template as a compose project, optionally behind an nginx site
+func (s *SoftwareService) Install(ctx context.Context, req *InstallAppRequest, installedBy string) (*InstallAppResult, error) {
+	if !appNamePattern.MatchString(req.Name) {
+		return nil, &AppValidationError{Fields: map[string]string{
+			"name": "must be lowercase letters, digits, '-' or '_'",
+		}}
+	}
+
+	var count int64
+	s.db.Model(&models.Software{}).Where("name = ?", req.Name).Count(&count)
+	if count == 0 {
+		s.db.Model(&models.DockerComposeProject{}).Where("name = ?", req.Name).Count(&count)
+	}
+	if count > 0 {
+		return nil, ErrAppAlreadyInstalled
+	}
+
+	tmpl, err := s.GetTemplate(ctx, req.App)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := s.resolveValues(ctx, tmpl, req.Values, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	installDir, err := filepath.Abs(s.config.Apps.InstallDir)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(installDir, req.Name)
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return nil, ErrAppAlreadyInstalled
+	}
+
+	project, err := s.docker.CreateComposeProject(ctx, req.Name, path, tmpl.Compose, renderEnvContent(tmpl, values),
+		tmpl.Title+" "+tmpl.Version, installedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &InstallAppResult{Project: project, Warnings: []string{}}
+
+	var output bytes.Buffer
+	if err := s.docker.ComposeUp(ctx, project.ID, &output); err != nil {
+		// Leave nothing half deployed behind
+		s.docker.RemoveComposeProject(ctx, project.ID)
+		os.RemoveAll(path)
+		return nil, fmt.Errorf("failed to start app: %w: %s", err, strings.TrimSpace(output.String()))
+	}
+	result.Output = output.String()
+
+	app := &models.Software{
+		Name:             req.Name,
+		App:              tmpl.Name,
+		Version:          tmpl.Version,
+		LatestVersion:    tmpl.Version,
+		Status:           "running",
+		ServiceName:      project.ProjectName,
+		ConfigPath:       composeFilePath(project),
+		DataPath:         path,
+		AutoStart:        true,
+		ComposeProjectID: project.ID,
+	}
+	if tmpl.WebPort != "" {
+		app.Port, _ = strconv.Atoi(values[tmpl.WebPort])
+	}
+
+	if req.Domain != "" {
+		site, warnings := s.createProxySite(req, app.Port)
+		result.Site = site
+		result.Warnings = append(result.Warnings, warnings...)
+		if site != nil {
+			app.SiteID = site.ID
+		}
+	}
+
+	if err := s.db.Create(app).Error; err != nil {
+		return nil, err
+	}
+	result.Software = app
+
+	s.log.Info("App installed", "app", tmpl.Name, "name", req.Name, "project_id", project.ID)
+	return result, nil
+}
+
+// Uninstall removes an installed app, its compose project and optionally its data and site
+func (s *SoftwareService) Uninstall(ctx context.Context, id string, removeData, removeSite bool) error {
+	var app models.Software
+	if err := s.db.First(&app, "id = ?", id).Error; err != nil {
+		return ErrAppNotInstalled
+	}
+
+	if app.ComposeProjectID != "" {
+		if err := s.docker.RemoveComposeProject(ctx, app.ComposeProjectID); err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+	}
+
+	if removeData && app.DataPath != "" {
+		// Only remove directories created by the app installer
+		installDir, _ := filepath.Abs(s.config.Apps.InstallDir)
+		if rel, err := filepath.Rel(installDir, app.DataPath); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			os.RemoveAll(app.DataPath)
+		}
+	}
+
+	if removeSite && app.SiteID != "" {
+		if err := s.nginx.DeleteSite(app.SiteID); err != nil {
+			s.log.Warn("Failed to remove app site", "site_id", app.SiteID, "error", err)
+		}
+	}
+
+	s.log.Info("App uninstalled", "app", app.App, "name", app.Name)
+	return s.db.Delete(&app).Error
+}
+
+// Upgrade re-renders an installed app from the current template, keeping existing values,
+// then pulls and recreates its containers
+func (s *SoftwareService) Upgrade(ctx context.Context, id, upgradedBy string, out io.Writer) error {
+	var app models.Software
+	if err := s.db.First(&app, "id = ?", id).Error; err != nil {
+		return ErrAppNotInstalled
+	}
+	if app.ComposeProjectID == "" || app.App == "" {
+		return ErrAppNotUpgradable
+	}
+
+	tmpl, err := s.GetTemplate(ctx, app.App)
+	if err != nil {
+		return err
+	}
+
+	project, err := s.docker.GetComposeProject(ctx, app.ComposeProjectID)
+	if err != nil {
+		return err
+	}
+
+	existing := parseEnvContent(project.EnvContent)
+	values, err := s.resolveValues(ctx, tmpl, existing, existing)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.docker.UpdateComposeProject(ctx, project.ID, tmpl.Compose, renderEnvContent(tmpl, values),
+		fmt.Sprintf("Upgrade %s to %s", tmpl.Name, tmpl.Version), upgradedBy); err != nil {
+		return err
+	}
+
+	if err := s.docker.ComposePull(ctx, project.ID, out); err != nil {
+		return err
+	}
+	if err := s.docker.ComposeUp(ctx, project.ID, out); err != nil {
+		return err
+	}
+
+	return s.db.Model(&app).Updates(map[string]interface{}{
+		"version":        tmpl.Version,
+		"latest_version": tmpl.Version,
+		"status":         "running",
+	}).Error
+}
+
+// resolveValues validates the supplied values against the template fields, applying defaults
+// and generating secrets. Ports listed in owned belong to the app itself and skip conflict checks.
+func (s *SoftwareService) resolveValues(ctx context.Context, tmpl *AppTemplate, input, owned map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(tmpl.Fields))
+	invalid := make(map[string]string)
+	usedPorts := make(map[int]string)
+
+	for _, f := range tmpl.Fields {
+		v := strings.TrimSpace(input[f.Key])
+		if v == "" {
+			v = f.Default
+		}
+
+		if strings.ContainsAny(v, "\r\n") {
+			invalid[f.Key] = "must be a single line"
+			continue
+		}
+
+		switch f.Type {
+		case "secret":
+			if v == "" {
+				length := f.Length
+				if length <= 0 {
+					length = 24
+				}
+				secret, err := generateSecret(length)
+				if err != nil {
+					return nil, err
+				}
+				v = secret
+			}
+		case "int":
+			if v != "" {
+				if _, err := strconv.Atoi(v); err != nil {
+					invalid[f.Key] = "must be a number"
+					continue
+				}
+			}
+		case "bool":
+			if v != "" && v != "true" && v != "false" {
+				invalid[f.Key] = "must be true or false"
+				continue
+			}
+		case "select":
+			if v != "" && !appFieldHasOption(f, v) {
+				invalid[f.Key] = "is not a valid option"
+				continue
+			}
+		case "port":
+			if v == "" {
+				break
+			}
+			port, err := strconv.Atoi(v)
+			if err != nil || port < 1 || port > 65535 {
+				invalid[f.Key] = "must be a port between 1 and 65535"
+				continue
+			}
+			if other, ok := usedPorts[port]; ok {
+				invalid[f.Key] = "conflicts with " + other
+				continue
+			}
+			usedPorts[port] = f.Key
+			if owned[f.Key] == v {
+				break
+			}
+			if reason := s.checkPort(port); reason != "" {
+				invalid[f.Key] = reason
+				continue
+			}
+		}
+
+		if v == "" && f.Required {
+			invalid[f.Key] = "is required"
+			continue
+		}
+
+		if f.Pattern != "" && v != "" {
+			re, err := regexp.Compile(f.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("template %s has an invalid pattern for %s: %w", tmpl.Name, f.Key, err)
+			}
+			if !re.MatchString(v) {
+				invalid[f.Key] = "does not match " + f.Pattern
+				continue
+			}
+		}
+
+		values[f.Key] = v
+	}
+
+	if len(invalid) > 0 {
+		return nil, &AppValidationError{Fields: invalid}
+	}
+	return values, nil
+}
+
+// checkPort returns why a host port cannot be used, or an empty string when it is free
+func (s *SoftwareService) checkPort(port int) string {
+	var count int64
+	s.db.Model(&models.Software{}).Where("port = ?", port).Count(&count)
+	if count > 0 {
+		return fmt.Sprintf("port %d is used by another app", port)
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Sprintf("port %d is already in use", port)
+	}
+	ln.Close()
+	return ""
+}
+
+// createProxySite creates the reverse-proxy site and certificate for an app.
+// Failures are reported as warnings since the app itself is already running.
+func (s *SoftwareService) createProxySite(req *InstallAppRequest, port int) (*models.NginxSite, []string) {
+	var warnings []string
+	if port == 0 {
+		return nil, append(warnings, "app does not expose a web port, skipped nginx site")
+	}
+
+	site := &models.NginxSite{
+		Name:         req.Name,
+		Domain:       req.Domain,
+		ProxyEnabled: true,
+		ProxyTarget:  fmt.Sprintf("http://127.0.0.1:%d", port),
+		Enabled:      true,
+	}
+	if err := s.nginx.CreateSite(site); err != nil {
+		return nil, append(warnings, "failed to create nginx site: "+err.Error())
+	}
+
+	if req.SSL {
+		cert := &models.SSLCertificate{
+			Domain:    req.Domain,
+			Type:      "letsencrypt",
+			AutoRenew: true,
+		}
+		if err := s.nginx.CreateCertificate(cert); err != nil {
+			warnings = append(warnings, "failed to issue certificate: "+err.Error())
+		} else if err := s.nginx.UpdateSite(site.ID, map[string]interface{}{
+			"ssl_enabled": true,
+			"ssl_cert_id": cert.ID,
+		}); err != nil {
+			warnings = append(warnings, "failed to enable SSL on site: "+err.Error())
+		} else {
+			site.SSLEnabled = true
+			site.SSLCertID = cert.ID
+		}
+	}
+
+	if err := s.nginx.Reload(); err != nil {
+		warnings = append(warnings, "failed to reload nginx: "+err.Error())
+	}
+
+	return site, warnings
+}
+
+// remoteTemplates returns the cached remote catalogue, fetching it when stale
+func (s *SoftwareService) remoteTemplates(ctx context.Context, force bool) []AppTemplate {
+	url := s.config.Apps.RemoteIndex
+	if url == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !force && time.Since(s.remoteFetched) < remoteCatalogTTL {
+		return s.remote
+	}
+
+	templates, err := fetchRemoteCatalog(ctx, url)
+	if err != nil {
+		s.log.Warn("Failed to fetch remote app catalogue", "url", url, "error", err)
+		// Keep serving the previous index and retry on the next TTL
+		s.remoteFetched = time.Now()
+		return s.remote
+	}
+
+	s.remote = templates
+	s.remoteFetched = time.Now()
+	return s.remote
+}
+
+// localTemplates loads templates from the configured directory. Each template is either
+// a <name>.yaml file or a <name>/app.yaml file with an optional docker-compose.yml beside it.
+func (s *SoftwareService) localTemplates() []AppTemplate {
+	dir := s.config.Apps.TemplateDir
+	if dir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var templates []AppTemplate
+	for _, entry := range entries {
+		var path, composePath string
+		if entry.IsDir() {
+			path = filepath.Join(dir, entry.Name(), "app.yaml")
+			composePath = filepath.Join(dir, entry.Name(), defaultComposeFile)
+		} else if ext := filepath.Ext(entry.Name()); ext == ".yaml" || ext == ".yml" {
+			path = filepath.Join(dir, entry.Name())
+		} else {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		var t AppTemplate
+		if err := yaml.Unmarshal(data, &t); err != nil {
+			s.log.Warn("Invalid app template", "path", path, "error", err)
+			continue
+		}
+		if t.Compose == "" && composePath != "" {
+			if content, err := os.ReadFile(composePath); err == nil {
+				t.Compose = string(content)
+			}
+		}
+		if err := validateAppTemplate(&t); err != nil {
+			s.log.Warn("Invalid app template", "path", path, "error", err)
+			continue
+		}
+
+		t.Source = "local"
+		templates = append(templates, t)
+	}
+
+	return templates
+}
+
+func loadBuiltinTemplates() ([]AppTemplate, error) {
+	entries, err := builtinAppTemplates.ReadDir("apptemplates")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]AppTemplate, 0, len(entries))
+	for _, entry := range entries {
+		data, err := builtinAppTemplates.ReadFile("apptemplates/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		var t AppTemplate
+		if err := yaml.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("builtin template %s: %w", entry.Name(), err)
+		}
+		t.Source = "builtin"
+		templates = append(templates, t)
+	}
+
+	return templates, nil
+}
+
+func fetchRemoteCatalog(ctx context.Context, url string) ([]AppTemplate, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON so both index formats are accepted
+	var index AppCatalogIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+
+	templates := make([]AppTemplate, 0, len(index.Apps))
+	for _, t := range index.Apps {
+		if err := validateAppTemplate(&t); err != nil {
+			continue
+		}
+		t.Source = "remote"
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func validateAppTemplate(t *AppTemplate) error {
+	if !appNamePattern.MatchString(t.Name) {
+		return fmt.Errorf("invalid template name %q", t.Name)
+	}
+	if strings.TrimSpace(t.Compose) == "" {
+		return fmt.Errorf("template %s has no compose content", t.Name)
+	}
+	for _, f := range t.Fields {
+		if f.Key == "" {
+			return fmt.Errorf("template %s has a field without key", t.Name)
+		}
+	}
+	return nil
+}
+
+func appFieldHasOption(f AppField, value string) bool {
+	for _, o := range f.Options {
+		if o.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// renderEnvContent renders resolved values as a .env file in template field order
+func renderEnvContent(tmpl *AppTemplate, values map[string]string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Generated by VPanel from the %s app template\n", tmpl.Name)
+	for _, f := range tmpl.Fields {
+		fmt.Fprintf(&sb, "%s=%s\n", f.Key, quoteEnvValue(values[f.Key]))
+	}
+	return sb.String()
+}
+
+func quoteEnvValue(v string) string {
+	safe := true
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.:/@+,", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return v
+	}
+	if !strings.Contains(v, "'") {
+		// Single quotes disable interpolation in compose env files
+		return "'" + v + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+// parseEnvContent parses KEY=VALUE lines of a .env file
+func parseEnvContent(content string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		value = strings.TrimSpace(value)
+
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(value[1 : len(value)-1])
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// generateSecret returns a random alphanumeric string of the given length
+func generateSecret(length int) (string, error) {
+	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	max := big.NewInt(int64(len(charset)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// Software errors
+var (
+	ErrAppTemplateNotFound = errors.New("app template not found")
+	ErrAppNotInstalled     = errors.New("app not installed")
+	ErrAppAlreadyInstalled = errors.New("an app or compose project with this name already exists")
+	ErrAppNotUpgradable    = errors.New("app was not installed from a template")
+)
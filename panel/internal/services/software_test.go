@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vpanel/server/internal/config"
+	"github.com/vpanel/server/internal/models"
+	"github.com/vpanel/server/pkg/logger"
+)
+
+// newTestSoftwareService returns a software service without docker or nginx,
+// reading local templates from a temporary directory
+func newTestSoftwareService(t *testing.T, remoteIndex string) (*SoftwareService, string) {
+	t.Helper()
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&models.Software{}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := &config.Config{Apps: config.AppsConfig{TemplateDir: dir, InstallDir: t.TempDir(), RemoteIndex: remoteIndex}}
+	return NewSoftwareService(db, cfg, logger.New(logger.Config{Level: "error"}), nil, nil), dir
+}
+
+// freePort returns a TCP port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestListTemplatesSources(t *testing.T) {
+	index := `apps:
+  - name: redis
+    title: Remote Redis
+    compose: "services: {redis: {image: evil/redis}}"
+  - name: gitea
+    title: Remote Gitea
+    compose: "services: {gitea: {image: evil/gitea}}"
+  - name: whoami
+    title: Whoami
+    compose: "services: {whoami: {image: traefik/whoami}}"
+  - name: "Not Valid"
+    compose: "services: {}"
+`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(index))
+	}))
+	defer srv.Close()
+
+	s, dir := newTestSoftwareService(t, srv.URL)
+	local := "name: gitea\ntitle: Local Gitea\ncompose: \"services: {gitea: {image: gitea/gitea}}\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "gitea.yaml"), []byte(local), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := s.ListTemplates(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, tmpl := range templates {
+		got[tmpl.Name] = tmpl.Source + ": " + tmpl.Title
+	}
+	for name, want := range map[string]string{
+		"redis":  "builtin: Redis",
+		"gitea":  "local: Local Gitea",
+		"whoami": "remote: Whoami",
+	} {
+		if got[name] != want {
+			t.Errorf("template %s = %q, want %q", name, got[name], want)
+		}
+	}
+	if _, ok := got["Not Valid"]; ok {
+		t.Error("invalid remote template listed")
+	}
+
+	tmpl, err := s.GetTemplate(context.Background(), "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(tmpl.Compose, "evil/") {
+		t.Errorf("built-in compose replaced by the remote index: %s", tmpl.Compose)
+	}
+}
+
+func TestResolveValues(t *testing.T) {
+	s, _ := newTestSoftwareService(t, "")
+	taken := freePort(t)
+	if err := s.db.Create(&models.Software{Name: "other", Port: taken}).Error; err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	listening := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	free := strconv.Itoa(freePort(t))
+
+	tmpl := &AppTemplate{Name: "test", Fields: []AppField{
+		{Key: "NAME", Type: "string", Default: "app", Pattern: `^[a-z]+$`},
+		{Key: "WORKERS", Type: "int", Default: "2"},
+		{Key: "DEBUG", Type: "bool"},
+		{Key: "MODE", Type: "select", Default: "small", Options: []AppFieldOption{{Value: "small"}, {Value: "large"}}},
+		{Key: "PORT", Type: "port", Required: true},
+		{Key: "ADMIN_PORT", Type: "port"},
+	}}
+
+	tests := []struct {
+		name    string
+		input   map[string]string
+		owned   map[string]string
+		want    map[string]string
+		invalid map[string]string
+	}{
+		{
+			name:  "defaults",
+			input: map[string]string{"PORT": free},
+			want:  map[string]string{"NAME": "app", "WORKERS": "2", "DEBUG": "", "MODE": "small", "PORT": free, "ADMIN_PORT": ""},
+		},
+		{
+			name:  "values trimmed",
+			input: map[string]string{"NAME": " web ", "DEBUG": "true", "MODE": "large", "PORT": free},
+			want:  map[string]string{"NAME": "web", "WORKERS": "2", "DEBUG": "true", "MODE": "large", "PORT": free, "ADMIN_PORT": ""},
+		},
+		{
+			name:  "invalid values",
+			input: map[string]string{"NAME": "Web", "WORKERS": "two", "DEBUG": "yes", "MODE": "huge"},
+			invalid: map[string]string{
+				"NAME":    "does not match ^[a-z]+$",
+				"WORKERS": "must be a number",
+				"DEBUG":   "must be true or false",
+				"MODE":    "is not a valid option",
+				"PORT":    "is required",
+			},
+		},
+		{
+			name:    "multiple lines",
+			input:   map[string]string{"NAME": "a\nEVIL=1", "PORT": free},
+			invalid: map[string]string{"NAME": "must be a single line"},
+		},
+		{
+			name:    "port out of range",
+			input:   map[string]string{"PORT": "0", "ADMIN_PORT": "65536"},
+			invalid: map[string]string{"PORT": "must be a port between 1 and 65535", "ADMIN_PORT": "must be a port between 1 and 65535"},
+		},
+		{
+			name:    "same port twice",
+			input:   map[string]string{"PORT": free, "ADMIN_PORT": free},
+			invalid: map[string]string{"ADMIN_PORT": "conflicts with PORT"},
+		},
+		{
+			name:    "port of another app",
+			input:   map[string]string{"PORT": strconv.Itoa(taken)},
+			invalid: map[string]string{"PORT": "port " + strconv.Itoa(taken) + " is used by another app"},
+		},
+		{
+			name:    "port in use",
+			input:   map[string]string{"PORT": listening},
+			invalid: map[string]string{"PORT": "port " + listening + " is already in use"},
+		},
+		{
+			// An upgraded app keeps the port its own containers listen on
+			name:  "owned port",
+			input: map[string]string{"PORT": listening},
+			owned: map[string]string{"PORT": listening},
+			want:  map[string]string{"NAME": "app", "WORKERS": "2", "DEBUG": "", "MODE": "small", "PORT": listening, "ADMIN_PORT": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := s.resolveValues(context.Background(), tmpl, tt.input, tt.owned)
+			if tt.invalid != nil {
+				var verr *AppValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("resolveValues() error = %v, want a validation error", err)
+				}
+				if !reflect.DeepEqual(verr.Fields, tt.invalid) {
+					t.Errorf("invalid fields = %q, want %q", verr.Fields, tt.invalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(values, tt.want) {
+				t.Errorf("resolveValues() = %q, want %q", values, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveValuesSecrets(t *testing.T) {
+	s, _ := newTestSoftwareService(t, "")
+	tmpl := &AppTemplate{Name: "test", Fields: []AppField{
+		{Key: "PASSWORD", Type: "secret", Length: 40},
+		{Key: "TOKEN", Type: "secret"},
+	}}
+
+	first, err := s.resolveValues(context.Background(), tmpl, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first["PASSWORD"]) != 40 || len(first["TOKEN"]) != 24 {
+		t.Errorf("secret lengths %d and %d, want 40 and 24", len(first["PASSWORD"]), len(first["TOKEN"]))
+	}
+	second, err := s.resolveValues(context.Background(), tmpl, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first["PASSWORD"] == second["PASSWORD"] {
+		t.Error("the same secret was generated twice")
+	}
+
+	// Upgrades keep the stored secret
+	kept, err := s.resolveValues(context.Background(), tmpl, first, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(kept, first) {
+		t.Errorf("secrets changed on upgrade: %q, want %q", kept, first)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	for _, length := range []int{1, 16, 64} {
+		secret, err := generateSecret(length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secret) != length {
+			t.Errorf("generateSecret(%d) has length %d", length, len(secret))
+		}
+		if quoteEnvValue(secret) != secret {
+			t.Errorf("generateSecret(%d) = %q needs quoting", length, secret)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		secret, _ := generateSecret(16)
+		if seen[secret] {
+			t.Fatalf("generateSecret() repeated %q", secret)
+		}
+		seen[secret] = true
+	}
+}
+
+func TestQuoteEnvValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"redis:7-alpine", "redis:7-alpine"},
+		{"user@example.com", "user@example.com"},
+		{"a b", "'a b'"},
+		{"$HOME", "'$HOME'"},
+		{"p#ss", "'p#ss'"},
+		{`say "hi"`, `'say "hi"'`},
+		{"it's", `"it's"`},
+		{`it's "a\b"`, `"it's \"a\\b\""`},
+	}
+	for _, tt := range tests {
+		if got := quoteEnvValue(tt.value); got != tt.want {
+			t.Errorf("quoteEnvValue(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+
+	// Rendered values read back unchanged
+	tmpl := &AppTemplate{Name: "test"}
+	values := make(map[string]string)
+	for i, tt := range tests {
+		key := "KEY_" + strconv.Itoa(i)
+		tmpl.Fields = append(tmpl.Fields, AppField{Key: key})
+		values[key] = tt.value
+	}
+	if got := parseEnvContent(renderEnvContent(tmpl, values)); !reflect.DeepEqual(got, values) {
+		t.Errorf("parseEnvContent(renderEnvContent()) = %q, want %q", got, values)
+	}
+}
@@ -0,0 +1,461 @@
+package services
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vpanel/server/internal/models"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Uploaded certificates are stored under this directory of the certificate directory
+const customCertDir = "custom"
+
+// CertificateUpload holds a custom certificate as PEM parts or a PKCS#12 bundle
+type CertificateUpload struct {
+	Certificate    []byte // PEM, may be followed by the chain
+	Chain          []byte // PEM intermediates
+	Key            []byte // PEM private key
+	PKCS12         []byte
+	Password       string // PKCS#12 password
+	AllowUntrusted bool   // accept chains that do not end in a system root, e.g. an internal CA
+}
+
+// verifiedCertificate is a parsed certificate whose key matches and whose chain verifies
+type verifiedCertificate struct {
+	leaf  *x509.Certificate
+	chain []*x509.Certificate // intermediates in order, without the root
+	key   crypto.Signer
+}
+
+// CreateCustomCertificate validates a custom certificate and saves it. Uploaded files are
+// stored under the certificate directory, without an upload the files at the certificate's
+// paths are inspected in place. When site is set the certificate must cover its names.
+func (s *NginxService) CreateCustomCertificate(cert *models.SSLCertificate, upload *CertificateUpload, site *models.NginxSite) error {
+	if upload == nil {
+		upload = &CertificateUpload{}
+	}
+	managed := len(upload.Certificate) > 0 || len(upload.PKCS12) > 0
+	if !managed {
+		if cert.CertPath == "" || cert.KeyPath == "" {
+			return fmt.Errorf("%w: upload a certificate or set cert_path and key_path", ErrInvalidCertificate)
+		}
+		if err := readCertificateFiles(cert, upload); err != nil {
+			return err
+		}
+	}
+
+	verified, err := parseCertificateUpload(upload)
+	if err != nil {
+		return err
+	}
+	if site != nil {
+		if err := checkCertificateCovers(verified.leaf, []models.NginxSite{*site}); err != nil {
+			return err
+		}
+	}
+
+	if cert.ID == "" {
+		cert.ID = uuid.New().String()
+	}
+	if cert.Type == "" {
+		cert.Type = "custom"
+	}
+	if managed {
+		if err := s.storeVerifiedCertificate(cert, verified); err != nil {
+			return err
+		}
+	}
+	applyCustomCertificateMeta(cert, verified.leaf)
+
+	if err := s.db.Create(cert).Error; err != nil {
+		if managed {
+			os.RemoveAll(filepath.Dir(cert.KeyPath))
+		}
+		return err
+	}
+
+	s.log.Info("SSL certificate created", "cert_id", cert.ID, "domain", cert.Domain, "type", cert.Type, "expires_at", cert.ExpiresAt)
+	return nil
+}
+
+// ReplaceCertificate replaces the files of a custom certificate with an upload. The new
+// certificate must still cover every site using it, whose configuration is rewritten to
+// the new files.
+func (s *NginxService) ReplaceCertificate(id string, upload *CertificateUpload) (*models.SSLCertificate, error) {
+	cert, err := s.GetCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Type == "letsencrypt" {
+		return nil, fmt.Errorf("%w: ACME certificates are replaced by renewing them", ErrInvalidCertificate)
+	}
+	if len(upload.Certificate) == 0 && len(upload.PKCS12) == 0 {
+		return nil, fmt.Errorf("%w: no certificate uploaded", ErrInvalidCertificate)
+	}
+
+	verified, err := parseCertificateUpload(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []models.NginxSite
+	s.db.Where("ssl_cert_id = ?", cert.ID).Find(&sites)
+	if err := checkCertificateCovers(verified.leaf, sites); err != nil {
+		return nil, err
+	}
+
+	previous := *cert
+	oldDir := filepath.Dir(cert.KeyPath)
+	if err := s.storeVerifiedCertificate(cert, verified); err != nil {
+		return nil, err
+	}
+	newDir := filepath.Dir(cert.KeyPath)
+	applyCustomCertificateMeta(cert, verified.leaf)
+	if err := s.db.Save(cert).Error; err != nil {
+		if newDir != oldDir {
+			os.RemoveAll(newDir)
+		}
+		return nil, err
+	}
+
+	// The sites name the files in their configuration, they are pointed to the new files
+	// before the old ones go away. A rejected configuration keeps the previous certificate.
+	if newDir != oldDir {
+		if err := s.writeCertificateSites(sites); err != nil {
+			s.db.Save(&previous)
+			os.RemoveAll(newDir)
+			return nil, err
+		}
+		if s.isManagedCertDir(oldDir) {
+			os.RemoveAll(oldDir)
+		}
+	}
+
+	s.log.Info("SSL certificate replaced", "cert_id", cert.ID, "domain", cert.Domain, "expires_at", cert.ExpiresAt)
+	return cert, nil
+}
+
+// writeCertificateSites regenerates the configuration of the sites using a certificate
+// in a single apply, which reloads nginx when it is running
+func (s *NginxService) writeCertificateSites(sites []models.NginxSite) error {
+	var changes []nginxFileChange
+	for i := range sites {
+		siteChanges, err := s.siteConfigChanges(&sites[i])
+		if err != nil {
+			return err
+		}
+		changes = append(changes, siteChanges...)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return s.applyConfig(changes...)
+}
+
+// checkSiteCertificate verifies that the certificate covers the site's domain and aliases
+func (s *NginxService) checkSiteCertificate(certID string, site *models.NginxSite) error {
+	cert, err := s.GetCertificate(certID)
+	if err != nil {
+		return err
+	}
+	leaf, err := loadLeafCertificate(cert.CertPath)
+	if err != nil {
+		return err
+	}
+	return checkCertificateCovers(leaf, []models.NginxSite{*site})
+}
+
+// syncCertificateMeta refreshes the stored metadata when the file on disk was replaced,
+// e.g. by an external tool managing a custom certificate
+func (s *NginxService) syncCertificateMeta(cert *models.SSLCertificate) {
+	if cert.CertPath == "" {
+		return
+	}
+	leaf, err := loadLeafCertificate(cert.CertPath)
+	if err != nil || certificateSHA256(leaf) == cert.Fingerprint {
+		return
+	}
+
+	if cert.Type == "letsencrypt" {
+		applyCertificateMeta(cert, leaf)
+	} else {
+		applyCustomCertificateMeta(cert, leaf)
+	}
+	s.db.Model(cert).Select("domain", "sans", "key_type", "expires_at", "not_before", "issuer", "serial", "fingerprint").Updates(cert)
+}
+
+// storeVerifiedCertificate writes the certificate to a new directory under the custom
+// directory and points the certificate's paths to it
+func (s *NginxService) storeVerifiedCertificate(cert *models.SSLCertificate, verified *verifiedCertificate) error {
+	der := [][]byte{verified.leaf.Raw}
+	for _, c := range verified.chain {
+		der = append(der, c.Raw)
+	}
+
+	// A directory per upload keeps the old files valid until nginx is reloaded
+	name := filepath.Join(customCertDir, cert.ID+"-"+certificateSHA256(verified.leaf)[:12])
+	paths, err := s.storeCertificate(name, der, verified.key)
+	if err != nil {
+		return err
+	}
+	cert.CertPath = paths.fullchain
+	cert.KeyPath = paths.key
+	cert.ChainPath = paths.chain
+	return nil
+}
+
+// isManagedCertDir reports whether dir holds an uploaded certificate
+func (s *NginxService) isManagedCertDir(dir string) bool {
+	base, err := filepath.Abs(filepath.Join(s.cfg.ACME.CertDir, customCertDir))
+	if err != nil {
+		return false
+	}
+	return filepath.Dir(dir) == base
+}
+
+// readCertificateFiles loads the files referenced by the certificate's paths
+func readCertificateFiles(cert *models.SSLCertificate, upload *CertificateUpload) error {
+	var err error
+	if upload.Certificate, err = os.ReadFile(cert.CertPath); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	if upload.Key, err = os.ReadFile(cert.KeyPath); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	if cert.ChainPath != "" {
+		if upload.Chain, err = os.ReadFile(cert.ChainPath); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+		}
+	}
+	return nil
+}
+
+// parseCertificateUpload decodes the upload and verifies the key and chain
+func parseCertificateUpload(upload *CertificateUpload) (*verifiedCertificate, error) {
+	var certs []*x509.Certificate
+	var key crypto.Signer
+
+	if len(upload.PKCS12) > 0 {
+		privateKey, leaf, caCerts, err := pkcs12.DecodeChain(upload.PKCS12, upload.Password)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+		}
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: unsupported private key type", ErrInvalidCertificate)
+		}
+		key = signer
+		certs = append([]*x509.Certificate{leaf}, caCerts...)
+	} else {
+		for _, data := range [][]byte{upload.Certificate, upload.Chain} {
+			parsed, err := parseCertificatesPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, parsed...)
+		}
+		if len(upload.Key) == 0 {
+			return nil, fmt.Errorf("%w: private key is required", ErrInvalidCertificate)
+		}
+		var err error
+		if key, err = parsePrivateKey(upload.Key); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+		}
+	}
+
+	return verifyCertificateChain(certs, key, upload.AllowUntrusted)
+}
+
+// verifyCertificateChain picks the certificate matching the key as the leaf and builds a
+// verified chain from the others, which may be in any order
+func verifyCertificateChain(certs []*x509.Certificate, key crypto.Signer, allowUntrusted bool) (*verifiedCertificate, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: no certificate found", ErrInvalidCertificate)
+	}
+
+	// A key matching one of the CA certificates of the chain is not accepted
+	var leaf *x509.Certificate
+	for _, c := range certs {
+		if c.IsCA && len(certs) > 1 {
+			continue
+		}
+		if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(c.PublicKey) {
+			leaf = c
+			break
+		}
+	}
+	if leaf == nil {
+		return nil, ErrCertificateKeyMismatch
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if c != leaf {
+			intermediates.AddCert(c)
+		}
+	}
+
+	opts := x509.VerifyOptions{Intermediates: intermediates}
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		var unknown x509.UnknownAuthorityError
+		if !allowUntrusted || !errors.As(err, &unknown) {
+			return nil, fmt.Errorf("%w: %v", ErrCertificateChain, err)
+		}
+
+		// Trust the uploaded CA certificates, or a self-signed leaf, the chain must
+		// still link up and be valid for serving
+		roots := x509.NewCertPool()
+		for _, c := range certs {
+			if c != leaf || isSelfSigned(c) {
+				roots.AddCert(c)
+			}
+		}
+		opts.Roots = roots
+		if chains, err = leaf.Verify(opts); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCertificateChain, err)
+		}
+	}
+
+	chain := chains[0][1:]
+	if n := len(chain); n > 0 && isSelfSigned(chain[n-1]) {
+		chain = chain[:n-1]
+	}
+	return &verifiedCertificate{leaf: leaf, chain: chain, key: key}, nil
+}
+
+// checkCertificateCovers returns ErrCertificateDomainMismatch listing the site names the
+// certificate is not valid for
+func checkCertificateCovers(leaf *x509.Certificate, sites []models.NginxSite) error {
+	var missing []string
+	for _, site := range sites {
+		for _, name := range append([]string{site.Domain}, site.Aliases...) {
+			if name != "" && leaf.VerifyHostname(name) != nil {
+				missing = append(missing, name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrCertificateDomainMismatch, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// applyCertificateMeta copies the validity and identity of leaf to the certificate
+func applyCertificateMeta(cert *models.SSLCertificate, leaf *x509.Certificate) {
+	cert.ExpiresAt = leaf.NotAfter
+	cert.NotBefore = leaf.NotBefore
+	cert.Issuer = leaf.Issuer.CommonName
+	if cert.Issuer == "" {
+		cert.Issuer = leaf.Issuer.String()
+	}
+	cert.Serial = strings.ToUpper(leaf.SerialNumber.Text(16))
+	cert.Fingerprint = certificateSHA256(leaf)
+}
+
+// applyCustomCertificateMeta also takes the names and key type from leaf, replacing
+// whatever was entered for a custom certificate
+func applyCustomCertificateMeta(cert *models.SSLCertificate, leaf *x509.Certificate) {
+	applyCertificateMeta(cert, leaf)
+
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	if len(names) > 0 {
+		primary := names[0]
+		if containsString(names, leaf.Subject.CommonName) {
+			primary = leaf.Subject.CommonName
+		}
+		cert.Domain = primary
+		cert.SANs = models.StringArray{}
+		for _, n := range names {
+			if n != primary {
+				cert.SANs = append(cert.SANs, n)
+			}
+		}
+	}
+	cert.KeyType = publicKeyType(leaf.PublicKey)
+}
+
+// loadLeafCertificate reads the first certificate of a PEM file
+func loadLeafCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificatesPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: no certificate found in %s", ErrInvalidCertificate, path)
+	}
+	return certs[0], nil
+}
+
+func parseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+		}
+		certs = append(certs, c)
+	}
+}
+
+func certificateSHA256(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// isSelfSigned reports whether c is signed by its own key. CheckSignatureFrom is not used
+// as it also requires c to be a CA, which a self-signed leaf often is not.
+func isSelfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil
+}
+
+// publicKeyType names a public key like the ACME key types, e.g. ec256 or rsa2048
+func publicKeyType(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ec%d", k.Curve.Params().BitSize)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "ed25519"
+	default:
+		return ""
+	}
+}
+
+// Errors
+var (
+	ErrInvalidCertificate        = errors.New("invalid certificate")
+	ErrCertificateKeyMismatch    = errors.New("private key does not match the certificate")
+	ErrCertificateChain          = errors.New("certificate chain does not verify")
+	ErrCertificateDomainMismatch = errors.New("certificate does not cover")
+)
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vpanel/server/internal/models"
+)
+
+// selfSignedUpload returns an upload of a self-signed certificate for names
+func selfSignedUpload(t *testing.T, names ...string) *CertificateUpload {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CertificateUpload{
+		Certificate:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:            pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		AllowUntrusted: true,
+	}
+}
+
+// siteCertificatePaths returns the ssl_certificate and ssl_certificate_key of a site's file
+func siteCertificatePaths(t *testing.T, s *NginxService, site *models.NginxSite) []string {
+	t.Helper()
+	data, err := os.ReadFile(s.getSiteConfigPath(site))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := parseNginxConfig(string(data), "site.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mainServer(t, dirs)
+	return append(nginxArgs(server, "ssl_certificate"), nginxArgs(server, "ssl_certificate_key")...)
+}
+
+// newTestCertificateSite stores an uploaded certificate and an enabled site using it
+func newTestCertificateSite(t *testing.T, s *NginxService) (*models.SSLCertificate, *models.NginxSite) {
+	t.Helper()
+	cert := &models.SSLCertificate{}
+	if err := s.CreateCustomCertificate(cert, selfSignedUpload(t, "example.com", "www.example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	site := &models.NginxSite{Domain: "example.com", Aliases: []string{"www.example.com"}, Port: 443, SSLEnabled: true,
+		SSLCertID: cert.ID, RootPath: "/srv/example", Enabled: true}
+	if err := s.CreateSite(site); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := siteCertificatePaths(t, s, site), []string{cert.CertPath, cert.KeyPath}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("site certificate = %q, want %q", got, want)
+	}
+	return cert, site
+}
+
+func TestReplaceCertificate(t *testing.T) {
+	s := newTestNginxService(t)
+	cert, site := newTestCertificateSite(t, s)
+	oldDir := filepath.Dir(cert.KeyPath)
+
+	replaced, err := s.ReplaceCertificate(cert.ID, selfSignedUpload(t, "example.com", "www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(replaced.KeyPath) == oldDir {
+		t.Fatal("replacement stored in the directory of the previous certificate")
+	}
+	if got, want := siteCertificatePaths(t, s, site), []string{replaced.CertPath, replaced.KeyPath}; !reflect.DeepEqual(got, want) {
+		t.Errorf("site certificate = %q, want %q", got, want)
+	}
+	for _, path := range []string{replaced.CertPath, replaced.KeyPath} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("new file missing: %v", err)
+		}
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("previous certificate directory kept: %v", err)
+	}
+
+	var stored models.SSLCertificate
+	s.db.First(&stored, "id = ?", cert.ID)
+	if stored.CertPath != replaced.CertPath || stored.Fingerprint != replaced.Fingerprint || stored.Fingerprint == cert.Fingerprint {
+		t.Errorf("stored certificate %s with fingerprint %s", stored.CertPath, stored.Fingerprint)
+	}
+}
+
+func TestReplaceCertificateRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		names  []string
+		reject bool // nginx -t fails
+		want   error
+	}{
+		{"site not covered", []string{"example.com"}, false, ErrCertificateDomainMismatch},
+		{"configuration rejected", []string{"example.com", "www.example.com"}, true, ErrNginxConfigInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestNginxService(t)
+			cert, site := newTestCertificateSite(t, s)
+			if tt.reject {
+				script := "#!/bin/sh\necho 'nginx: [emerg] cannot load certificate' >&2\nexit 1\n"
+				if err := os.WriteFile(s.layout.Binary, []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := s.ReplaceCertificate(cert.ID, selfSignedUpload(t, tt.names...)); !errors.Is(err, tt.want) {
+				t.Fatalf("ReplaceCertificate() error = %v, want %v", err, tt.want)
+			}
+
+			// The site keeps serving the previous files
+			if got, want := siteCertificatePaths(t, s, site), []string{cert.CertPath, cert.KeyPath}; !reflect.DeepEqual(got, want) {
+				t.Errorf("site certificate = %q, want %q", got, want)
+			}
+			var stored models.SSLCertificate
+			s.db.First(&stored, "id = ?", cert.ID)
+			if stored.CertPath != cert.CertPath || stored.Fingerprint != cert.Fingerprint {
+				t.Errorf("stored certificate %s with fingerprint %s", stored.CertPath, stored.Fingerprint)
+			}
+			entries, _ := os.ReadDir(filepath.Dir(filepath.Dir(cert.KeyPath)))
+			if len(entries) != 1 {
+				t.Errorf("%d certificate directories, want only the previous one", len(entries))
+			}
+			if _, err := os.Stat(cert.KeyPath); err != nil {
+				t.Errorf("previous key removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseCertificateUpload(t *testing.T) {
+	valid := selfSignedUpload(t, "example.com")
+	other := selfSignedUpload(t, "example.com")
+	trusted := *valid
+	trusted.AllowUntrusted = false
+	mismatched := *valid
+	mismatched.Key = other.Key
+	noKey := *valid
+	noKey.Key = nil
+
+	tests := []struct {
+		name   string
+		upload *CertificateUpload
+		want   error
+	}{
+		{"self-signed allowed", valid, nil},
+		{"self-signed not trusted", &trusted, ErrCertificateChain},
+		{"key of another certificate", &mismatched, ErrCertificateKeyMismatch},
+		{"no key", &noKey, ErrInvalidCertificate},
+		{"no certificate", &CertificateUpload{Key: valid.Key}, ErrInvalidCertificate},
+		{"garbage bundle", &CertificateUpload{PKCS12: []byte("not pkcs12")}, ErrInvalidCertificate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseCertificateUpload(tt.upload)
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("parseCertificateUpload() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
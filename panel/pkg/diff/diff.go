@@ -0,0 +1,357 @@
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Op represents the kind of a single line edit
+type Op int
+
+const (
+	Equal Op = iota
+	Insert
+	Delete
+)
+
+// Edit represents a single line in an edit script
+type Edit struct {
+	Op   Op
+	Line string
+}
+
+// SplitLines splits text into lines, dropping the trailing empty line
+func SplitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	lines := strings.Split(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// ErrTooDifferent is returned when two texts need more edits than the limit of a diff
+var ErrTooDifferent = errors.New("texts are too different to diff")
+
+// Lines computes a shortest edit script between a and b using the linear space variant
+// of the Myers algorithm. The time it takes grows with (N+M)·D, D being the number of
+// inserted and deleted lines, see LinesLimit to bound it.
+func Lines(a, b []string) []Edit {
+	edits, _ := LinesLimit(a, b, 0)
+	return edits
+}
+
+// LinesLimit computes a shortest edit script between a and b like Lines, but gives up
+// with ErrTooDifferent when more than maxEdits lines have to be inserted and deleted, so
+// the time it takes grows with (N+M)·maxEdits at most. A maxEdits of 0 sets no limit.
+func LinesLimit(a, b []string, maxEdits int) ([]Edit, error) {
+	if maxEdits > 0 && abs(len(a)-len(b)) > maxEdits {
+		return nil, ErrTooDifferent
+	}
+
+	// Lines are compared as numbers
+	ids := make(map[string]int, len(a)+len(b))
+	d := &differ{a: a, b: b, edits: make([]Edit, 0, max(len(a), len(b)))}
+	if !d.compare(lineIDs(a, ids), lineIDs(b, ids), 0, 0, maxEdits) {
+		return nil, ErrTooDifferent
+	}
+	return d.edits, nil
+}
+
+// differ appends the edit script of a and b to edits
+type differ struct {
+	a, b  []string
+	edits []Edit
+}
+
+// compare appends the edits turning x into y, the lines of a from i and of b from j. It
+// reports false when that takes more than limit edits, 0 setting no limit.
+func (d *differ) compare(x, y []int, i, j, limit int) bool {
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	d.equal(i, prefix)
+	x, y = x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+	i, j = i+prefix, j+prefix
+
+	switch {
+	case len(x) == 0:
+		d.insert(j, len(y))
+	case len(y) == 0:
+		d.delete(i, len(x))
+	default:
+		sx, sy, ok := bisect(x, y, limit)
+		if !ok {
+			return false
+		}
+		if sx < 0 {
+			// Nothing in common
+			d.delete(i, len(x))
+			d.insert(j, len(y))
+		} else {
+			d.compare(x[:sx], y[:sy], i, j, 0)
+			d.compare(x[sx:], y[sy:], i+sx, j+sy, 0)
+		}
+	}
+	d.equal(i+len(x), suffix)
+	return true
+}
+
+func (d *differ) equal(i, n int) {
+	for _, line := range d.a[i : i+n] {
+		d.edits = append(d.edits, Edit{Op: Equal, Line: line})
+	}
+}
+
+func (d *differ) insert(j, n int) {
+	for _, line := range d.b[j : j+n] {
+		d.edits = append(d.edits, Edit{Op: Insert, Line: line})
+	}
+}
+
+func (d *differ) delete(i, n int) {
+	for _, line := range d.a[i : i+n] {
+		d.edits = append(d.edits, Edit{Op: Delete, Line: line})
+	}
+}
+
+// bisect finds where a shortest edit script of x and y crosses the middle by searching
+// from both ends at once, keeping only the furthest points of the current distance. x
+// and y are not empty and neither start nor end alike. It returns -1, -1 when they have
+// nothing in common and false when they need more than limit edits.
+func bisect(x, y []int, limit int) (int, int, bool) {
+	n, m := len(x), len(y)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+
+	delta := n - m
+	// With an odd delta the paths meet on a forward step, with an even one on a backward step
+	odd := delta%2 != 0
+	// Diagonals that ran off the edit graph are not searched again
+	var fStart, fEnd, bStart, bEnd int
+
+	for d := 0; d < maxD; d++ {
+		// Paths of d edits each meet at a distance of 2d-1 at least
+		if limit > 0 && 2*d-1 > limit {
+			return 0, 0, false
+		}
+
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var px int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				px = forward[offset+k+1]
+			} else {
+				px = forward[offset+k-1] + 1
+			}
+			py := px - k
+			for px < n && py < m && x[px] == y[py] {
+				px++
+				py++
+			}
+			forward[offset+k] = px
+			switch {
+			case px > n:
+				fEnd += 2
+			case py > m:
+				fStart += 2
+			case odd:
+				if bk := offset + delta - k; bk >= 0 && bk < len(backward) && backward[bk] != -1 && px >= n-backward[bk] {
+					return px, py, true
+				}
+			}
+		}
+
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			var px int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				px = backward[offset+k+1]
+			} else {
+				px = backward[offset+k-1] + 1
+			}
+			py := px - k
+			for px < n && py < m && x[n-px-1] == y[m-py-1] {
+				px++
+				py++
+			}
+			backward[offset+k] = px
+			switch {
+			case px > n:
+				bEnd += 2
+			case py > m:
+				bStart += 2
+			case !odd:
+				if fk := offset + delta - k; fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+					fx := forward[fk]
+					if fx >= n-px {
+						return fx, fx - (fk - offset), true
+					}
+				}
+			}
+		}
+	}
+
+	if limit > 0 && n+m > limit {
+		return 0, 0, false
+	}
+	return -1, -1, true
+}
+
+// lineIDs numbers the lines, equal lines get the same number
+func lineIDs(lines []string, ids map[string]int) []int {
+	numbers := make([]int, len(lines))
+	for i, line := range lines {
+		id, ok := ids[line]
+		if !ok {
+			id = len(ids)
+			ids[line] = id
+		}
+		numbers[i] = id
+	}
+	return numbers
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Stats counts inserted and deleted lines in an edit script
+func Stats(edits []Edit) (added, removed int) {
+	for _, e := range edits {
+		switch e.Op {
+		case Insert:
+			added++
+		case Delete:
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// Unified returns a unified diff between two texts with the given number of context lines.
+// An empty string is returned when the texts are identical.
+func Unified(fromName, toName, from, to string, context int) string {
+	return UnifiedEdits(fromName, toName, Lines(SplitLines(from), SplitLines(to)), context)
+}
+
+// UnifiedEdits returns the unified diff of an edit script with the given number of
+// context lines. An empty string is returned when the script has no changes.
+func UnifiedEdits(fromName, toName string, edits []Edit, context int) string {
+	if context < 0 {
+		context = 3
+	}
+
+	// Find indices of changed edits
+	var changes []int
+	for i, e := range edits {
+		if e.Op != Equal {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	// Group changes into hunks, merging those whose context overlaps
+	type hunk struct{ start, end int }
+	var hunks []hunk
+	cur := hunk{start: changes[0], end: changes[0]}
+	for _, idx := range changes[1:] {
+		if idx-cur.end <= 2*context+1 {
+			cur.end = idx
+			continue
+		}
+		hunks = append(hunks, cur)
+		cur = hunk{start: idx, end: idx}
+	}
+	hunks = append(hunks, cur)
+
+	// Precompute line numbers for each edit position
+	fromLine := make([]int, len(edits)+1)
+	toLine := make([]int, len(edits)+1)
+	fl, tl := 1, 1
+	for i, e := range edits {
+		fromLine[i] = fl
+		toLine[i] = tl
+		if e.Op != Insert {
+			fl++
+		}
+		if e.Op != Delete {
+			tl++
+		}
+	}
+	fromLine[len(edits)] = fl
+	toLine[len(edits)] = tl
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	for _, h := range hunks {
+		start := h.start - context
+		if start < 0 {
+			start = 0
+		}
+		end := h.end + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		var fromCount, toCount int
+		for _, e := range edits[start:end] {
+			if e.Op != Insert {
+				fromCount++
+			}
+			if e.Op != Delete {
+				toCount++
+			}
+		}
+
+		fromStart := fromLine[start]
+		if fromCount == 0 {
+			fromStart--
+		}
+		toStart := toLine[start]
+		if toCount == 0 {
+			toStart--
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(fromStart, fromCount), hunkRange(toStart, toCount))
+		for _, e := range edits[start:end] {
+			switch e.Op {
+			case Equal:
+				sb.WriteString(" ")
+			case Insert:
+				sb.WriteString("+")
+			case Delete:
+				sb.WriteString("-")
+			}
+			sb.WriteString(e.Line)
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
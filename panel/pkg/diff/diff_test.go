@@ -0,0 +1,206 @@
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// script writes an edit script as "=a -b +c"
+func script(edits []Edit) string {
+	parts := make([]string, 0, len(edits))
+	for _, e := range edits {
+		parts = append(parts, string("=+-"[e.Op])+e.Line)
+	}
+	return strings.Join(parts, " ")
+}
+
+// apply returns the texts an edit script turns into each other
+func apply(edits []Edit) (from, to []string) {
+	from, to = []string{}, []string{}
+	for _, e := range edits {
+		if e.Op != Insert {
+			from = append(from, e.Line)
+		}
+		if e.Op != Delete {
+			to = append(to, e.Line)
+		}
+	}
+	return from, to
+}
+
+// lcs returns the length of a longest common subsequence of a and b
+func lcs(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"\n", []string{""}},
+		{"a", []string{"a"}},
+		{"a\n", []string{"a"}},
+		{"a\nb", []string{"a", "b"}},
+		{"a\n\nb\n", []string{"a", "", "b"}},
+	}
+	for _, tt := range tests {
+		if got := SplitLines(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"all insert", "", "a b c", "+a +b +c"},
+		{"all delete", "a b c", "", "-a -b -c"},
+		{"identical", "a b c", "a b c", "=a =b =c"},
+		{"replace", "a", "b", "-a +b"},
+		{"insert in the middle", "a c", "a b c", "=a +b =c"},
+		{"delete in the middle", "a b c", "a c", "=a -b =c"},
+		{"change at both ends", "x a b y", "a b", "-x =a =b -y"},
+		{"nothing in common", "a b", "c d e", "-a -b +c +d +e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edits := Lines(strings.Fields(tt.a), strings.Fields(tt.b))
+			if got := script(edits); got != tt.want {
+				t.Errorf("Lines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinesShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	words := func() []string {
+		lines := make([]string, rng.Intn(40))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(4)))
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a, b := words(), words()
+		edits := Lines(a, b)
+
+		from, to := apply(edits)
+		if !reflect.DeepEqual(from, a) || !reflect.DeepEqual(to, b) {
+			t.Fatalf("Lines(%q, %q) = %q does not turn one into the other", a, b, script(edits))
+		}
+		added, removed := Stats(edits)
+		if want := len(a) + len(b) - 2*lcs(a, b); added+removed != want {
+			t.Fatalf("Lines(%q, %q) = %q has %d edits, want %d", a, b, script(edits), added+removed, want)
+		}
+	}
+}
+
+func TestLinesLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     string
+		maxEdits int
+		wantErr  bool
+	}{
+		{"no limit", "a b c", "d e f", 0, false},
+		{"within the limit", "a b c", "a x c", 2, false},
+		{"over the limit", "a b c", "a x y", 3, true},
+		{"lengths too far apart", "", "a b c", 2, true},
+		{"nothing in common over the limit", "a b", "c d", 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := strings.Fields(tt.a), strings.Fields(tt.b)
+			edits, err := LinesLimit(a, b, tt.maxEdits)
+			if tt.wantErr {
+				if !errors.Is(err, ErrTooDifferent) {
+					t.Fatalf("LinesLimit(%q, %q, %d) error = %v, want ErrTooDifferent", tt.a, tt.b, tt.maxEdits, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LinesLimit(%q, %q, %d) error = %v", tt.a, tt.b, tt.maxEdits, err)
+			}
+			if want := Lines(a, b); !reflect.DeepEqual(edits, want) {
+				t.Errorf("LinesLimit(%q, %q, %d) = %q, want %q", tt.a, tt.b, tt.maxEdits, script(edits), script(want))
+			}
+		})
+	}
+}
+
+func TestLinesFullyChanged(t *testing.T) {
+	const n = 10000
+	a, b := make([]string, n), make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprintf("old %d", i)
+		b[i] = fmt.Sprintf("new %d", i)
+	}
+	added, removed := Stats(Lines(a, b))
+	if added != n || removed != n {
+		t.Errorf("Stats = %d added, %d removed, want %d each", added, removed, n)
+	}
+	if _, err := LinesLimit(a, b, 1000); !errors.Is(err, ErrTooDifferent) {
+		t.Errorf("LinesLimit error = %v, want ErrTooDifferent", err)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		context  int
+		want     string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", 3, ""},
+		{
+			"all insert", "", "a\nb\n", 3,
+			"--- x\n+++ y\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			"all delete", "a\n", "", 3,
+			"--- x\n+++ y\n@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			"change with context", "1\n2\n3\n4\n5\n", "1\n2\nx\n4\n5\n", 1,
+			"--- x\n+++ y\n@@ -2,3 +2,3 @@\n 2\n-3\n+x\n 4\n",
+		},
+		{
+			"separate hunks", "1\n2\n3\n4\n5\n6\n7\n8\n", "x\n2\n3\n4\n5\n6\n7\ny\n", 1,
+			"--- x\n+++ y\n@@ -1,2 +1,2 @@\n-1\n+x\n 2\n@@ -7,2 +7,2 @@\n 7\n-8\n+y\n",
+		},
+		{
+			"hunks merged by their context", "1\n2\n3\n4\n", "x\n2\n3\ny\n", 1,
+			"--- x\n+++ y\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n-4\n+y\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified("x", "y", tt.from, tt.to, tt.context); got != tt.want {
+				t.Errorf("Unified() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
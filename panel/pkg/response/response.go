@@ -107,6 +107,11 @@ func Conflict(c *gin.Context, message string) {
 	Error(c, http.StatusConflict, "CONFLICT", message)
 }
 
+// PreconditionFailed sends a 412 precondition failed response
+func PreconditionFailed(c *gin.Context, message string) {
+	Error(c, http.StatusPreconditionFailed, "PRECONDITION_FAILED", message)
+}
+
 // TooManyRequests sends a 429 too many requests response
 func TooManyRequests(c *gin.Context, message string) {
 	Error(c, http.StatusTooManyRequests, "TOO_MANY_REQUESTS", message)